@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAlertInterval is the minimum time between alerts for a device.
+	defaultAlertInterval = 15 * time.Minute
+	// alertAttempts is how many times a webhook delivery is tried.
+	alertAttempts = 3
+)
+
+// parseWatts parses a power value such as "1500", "1500W" or "1.5kW".
+func parseWatts(s string) (float64, error) {
+	v := strings.TrimSpace(s)
+	scale := 1.0
+	switch lower := strings.ToLower(v); {
+	case strings.HasSuffix(lower, "kw"):
+		v, scale = v[:len(v)-2], 1000
+	case strings.HasSuffix(lower, "w"):
+		v = v[:len(v)-1]
+	}
+	watts, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || watts < 0 {
+		return 0, fmt.Errorf("invalid power %q: want a value such as 1500W or 1.5kW", s)
+	}
+	return watts * scale, nil
+}
+
+// wattsFlag is a flag.Value accepting parseWatts syntax.
+type wattsFlag float64
+
+func (w *wattsFlag) String() string {
+	if *w == 0 {
+		return ""
+	}
+	return formatFloat(float64(*w)) + "W"
+}
+
+func (w *wattsFlag) Set(s string) error {
+	v, err := parseWatts(s)
+	if err != nil {
+		return err
+	}
+	*w = wattsFlag(v)
+	return nil
+}
+
+// parseSignedWatts parses a power value as parseWatts does, allowing a
+// minus sign for export, such as "-3kW".
+func parseSignedWatts(s string) (float64, error) {
+	v, negative := strings.CutPrefix(strings.TrimSpace(s), "-")
+	watts, err := parseWatts(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid power %q: want a value such as 1500W or -1.5kW", s)
+	}
+	if negative {
+		watts = -watts
+	}
+	return watts, nil
+}
+
+// signedWattsFlag is a flag.Value accepting parseSignedWatts syntax. As
+// zero is a meaningful threshold, it records whether it was set.
+type signedWattsFlag struct {
+	watts float64
+	set   bool
+}
+
+func (w *signedWattsFlag) String() string {
+	if !w.set {
+		return ""
+	}
+	return formatFloat(w.watts) + "W"
+}
+
+func (w *signedWattsFlag) Set(s string) error {
+	v, err := parseSignedWatts(s)
+	if err != nil {
+		return err
+	}
+	*w = signedWattsFlag{v, true}
+	return nil
+}
+
+// threshold returns the value set, or nil.
+func (w signedWattsFlag) threshold() *float64 {
+	if !w.set {
+		return nil
+	}
+	return &w.watts
+}
+
+// alertRule is the thresholds a device alerts above and, when Below is
+// set, below, such as an export threshold of a bidirectional device
+// reporting negative power. An alert clears once a reading drops below
+// ClearBelow, which defaults to Above, or rises above ClearAbove, which
+// defaults to Below.
+type alertRule struct {
+	Above      float64
+	ClearBelow float64
+	Below      *float64
+	ClearAbove *float64
+}
+
+// alertRuleConfig is a per-device rule in the config file's alerts map.
+type alertRuleConfig struct {
+	Above      string `yaml:"above,omitempty"`
+	ClearBelow string `yaml:"clear-below,omitempty"`
+	Below      string `yaml:"below,omitempty"`
+	ClearAbove string `yaml:"clear-above,omitempty"`
+}
+
+// rule parses c.
+func (c alertRuleConfig) rule() (alertRule, error) {
+	var r alertRule
+	var err error
+	if c.Above != "" || c.Below == "" {
+		if r.Above, err = parseWatts(c.Above); err != nil {
+			return r, err
+		}
+	}
+	if c.ClearBelow != "" {
+		if r.ClearBelow, err = parseWatts(c.ClearBelow); err != nil {
+			return r, err
+		}
+	}
+	for _, v := range []struct {
+		s   string
+		dst **float64
+	}{{c.Below, &r.Below}, {c.ClearAbove, &r.ClearAbove}} {
+		if v.s == "" {
+			continue
+		}
+		watts, err := parseSignedWatts(v.s)
+		if err != nil {
+			return r, err
+		}
+		*v.dst = &watts
+	}
+	return r.withDefaults()
+}
+
+// withDefaults fills in ClearBelow and ClearAbove and checks the rule is
+// consistent.
+func (r alertRule) withDefaults() (alertRule, error) {
+	if r.ClearBelow == 0 {
+		r.ClearBelow = r.Above
+	}
+	if r.ClearBelow > r.Above {
+		return r, fmt.Errorf("alert clear-below %sW is above the %sW threshold", formatFloat(r.ClearBelow), formatFloat(r.Above))
+	}
+	switch {
+	case r.Below == nil && r.ClearAbove != nil:
+		return r, errors.New("alert clear-above needs a below threshold")
+	case r.Below == nil:
+	case r.ClearAbove == nil:
+		r.ClearAbove = r.Below
+	case *r.ClearAbove < *r.Below:
+		return r, fmt.Errorf("alert clear-above %sW is below the %sW threshold", formatFloat(*r.ClearAbove), formatFloat(*r.Below))
+	}
+	return r, nil
+}
+
+// active reports whether r has any threshold.
+func (r alertRule) active() bool {
+	return r.Above > 0 || r.Below != nil
+}
+
+// alertPayload is the JSON body POSTed to the webhook. Condition is
+// "above" or "below" the threshold.
+type alertPayload struct {
+	Device    string    `json:"device"`
+	Host      string    `json:"host,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	Watts     float64   `json:"watts"`
+	Threshold float64   `json:"threshold"`
+	Condition string    `json:"condition"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// alertState tracks whether a device is over or under its thresholds.
+type alertState struct {
+	firing      bool
+	firingBelow bool
+	lastSent    time.Time
+}
+
+// alerter posts a webhook when a device's reading crosses its threshold.
+// Once firing, a device must drop below its clear level before it can alert
+// again, and alerts for a device are at least interval apart. Deliveries
+// run in the background so polling is never held up.
+type alerter struct {
+	webhook  string
+	client   *http.Client
+	interval time.Duration
+	backoff  time.Duration
+
+	mu    sync.Mutex
+	rule  alertRule
+	rules map[string]alertRule
+	state map[string]*alertState
+	wg    sync.WaitGroup
+}
+
+// newAlerter returns an alerter posting to webhook. rule applies to devices
+// without an entry in rules, which is keyed by instance name.
+func newAlerter(webhook string, rule alertRule, rules map[string]alertRule, interval time.Duration) *alerter {
+	if interval <= 0 {
+		interval = defaultAlertInterval
+	}
+	return &alerter{
+		webhook:  webhook,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		rule:     rule,
+		rules:    rules,
+		interval: interval,
+		backoff:  time.Second,
+		state:    make(map[string]*alertState),
+	}
+}
+
+// observe checks the reading in r against its device's threshold.
+func (a *alerter) observe(ctx context.Context, r deviceResult) {
+	if r.PowerInfo == nil || r.Error != "" {
+		return
+	}
+	a.mu.Lock()
+	rule, ok := a.rules[r.Instance]
+	if !ok {
+		rule = a.rule
+	}
+	if !rule.active() {
+		a.mu.Unlock()
+		return
+	}
+	key := resultKey(r)
+	st, ok := a.state[key]
+	if !ok {
+		st = &alertState{}
+		a.state[key] = st
+	}
+	var condition string
+	var threshold float64
+	switch {
+	case rule.Above > 0 && !st.firing && r.CurrentWatts > rule.Above:
+		st.firing = true
+		condition, threshold = "above", rule.Above
+	case st.firing && r.CurrentWatts < rule.ClearBelow:
+		st.firing = false
+	}
+	switch {
+	case rule.Below != nil && !st.firingBelow && r.CurrentWatts < *rule.Below:
+		st.firingBelow = true
+		condition, threshold = "below", *rule.Below
+	case st.firingBelow && (rule.ClearAbove == nil || r.CurrentWatts > *rule.ClearAbove):
+		st.firingBelow = false
+	}
+	send := condition != "" && r.Time.Sub(st.lastSent) >= a.interval
+	if send {
+		st.lastSent = r.Time
+	}
+	a.mu.Unlock()
+
+	if !send {
+		return
+	}
+	payload := alertPayload{Device: r.Instance, Host: r.HostName, Channel: r.Channel, Watts: r.CurrentWatts, Threshold: threshold, Condition: condition, Timestamp: r.Time}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := a.deliver(context.WithoutCancel(ctx), payload); err != nil {
+			slog.Error("alert delivery failed", "device", payload.Device, "error", err)
+		}
+	}()
+}
+
+// setRules replaces the thresholds, as newAlerter takes them. Devices
+// already firing stay so until they drop below their new clear level.
+func (a *alerter) setRules(rule alertRule, rules map[string]alertRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rule, a.rules = rule, rules
+}
+
+// wait blocks until every pending delivery has finished.
+func (a *alerter) wait() {
+	a.wg.Wait()
+}
+
+// deliver POSTs payload, retrying with exponential backoff.
+func (a *alerter) deliver(ctx context.Context, payload alertPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	backoff := a.backoff
+	for attempt := 1; ; attempt++ {
+		if err = a.post(ctx, body); err == nil {
+			slog.Info("alert sent", "device", payload.Device, "watts", payload.Watts, "threshold", payload.Threshold)
+			return nil
+		}
+		if attempt == alertAttempts {
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (a *alerter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestParseWatts(t *testing.T) {
+	cases := map[string]float64{"1500": 1500, "1500W": 1500, "1.5kW": 1500, " 20 w": 20}
+	for in, want := range cases {
+		if got, err := parseWatts(in); err != nil || got != want {
+			t.Fatalf("parseWatts(%q): expected %v, got %v (%v)", in, want, got, err)
+		}
+	}
+	if _, err := parseWatts("lots"); err == nil {
+		t.Fatal("expected error for non-numeric power")
+	}
+}
+
+func TestAlertRuleRejectsClearAboveThreshold(t *testing.T) {
+	if _, err := (alertRuleConfig{Above: "1000W", ClearBelow: "1200W"}).rule(); err == nil {
+		t.Fatal("expected error when clear-below exceeds the threshold")
+	}
+	rule, err := (alertRuleConfig{Above: "1kW"}).rule()
+	if err != nil || rule.ClearBelow != 1000 {
+		t.Fatalf("expected clear level to default to the threshold, got %+v (%v)", rule, err)
+	}
+}
+
+// webhook records the alerts it receives, failing the first failures posts.
+type webhook struct {
+	mu       sync.Mutex
+	failures int
+	posts    int
+	alerts   []alertPayload
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.posts++
+	if h.posts <= h.failures {
+		http.Error(w, "down", http.StatusBadGateway)
+		return
+	}
+	var p alertPayload
+	json.NewDecoder(r.Body).Decode(&p)
+	h.alerts = append(h.alerts, p)
+}
+
+func TestAlerterHysteresisAndInterval(t *testing.T) {
+	hook := &webhook{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	a := newAlerter(server.URL, alertRule{Above: 1500, ClearBelow: 1200}, map[string]alertRule{"Heater": {Above: 3000, ClearBelow: 3000}}, 10*time.Minute)
+	start := time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC)
+	observe := func(name string, offset time.Duration, watts float64) {
+		a.observe(context.Background(), deviceResult{Instance: name, Time: start.Add(offset), PowerInfo: &collector.PowerInfo{CurrentWatts: watts}})
+	}
+
+	observe("Kettle", 0, 2000)             // fires
+	observe("Kettle", time.Minute, 2100)   // still firing
+	observe("Kettle", 2*time.Minute, 1300) // below threshold but above clear level
+	observe("Kettle", 3*time.Minute, 1100) // clears
+	observe("Kettle", 4*time.Minute, 2000) // fires again within the interval: suppressed
+	observe("Kettle", 5*time.Minute, 1000) // clears
+	observe("Kettle", 20*time.Minute, 1600)
+	observe("Heater", 0, 2500) // under its own threshold
+	a.wait()
+
+	if len(hook.alerts) != 2 {
+		t.Fatalf("expected 2 alerts, got %+v", hook.alerts)
+	}
+	sort.Slice(hook.alerts, func(i, j int) bool { return hook.alerts[i].Timestamp.Before(hook.alerts[j].Timestamp) })
+	got := hook.alerts[0]
+	if got.Device != "Kettle" || got.Watts != 2000 || got.Threshold != 1500 || !got.Timestamp.Equal(start) {
+		t.Fatalf("unexpected alert payload %+v", got)
+	}
+}
+
+func TestAlerterRetriesDelivery(t *testing.T) {
+	hook := &webhook{failures: 2}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	a := newAlerter(server.URL, alertRule{Above: 10, ClearBelow: 10}, nil, time.Minute)
+	a.backoff = time.Millisecond
+	a.observe(context.Background(), deviceResult{Instance: "Lamp", Time: time.Now(), PowerInfo: &collector.PowerInfo{CurrentWatts: 20}})
+	a.wait()
+
+	if hook.posts != 3 || len(hook.alerts) != 1 {
+		t.Fatalf("expected delivery on the third attempt, got %d posts and %d alerts", hook.posts, len(hook.alerts))
+	}
+}
+
+func TestAlerterBelowThreshold(t *testing.T) {
+	if w, err := parseSignedWatts("-3kW"); err != nil || w != -3000 {
+		t.Fatalf("expected -3000 W, got %v (%v)", w, err)
+	}
+	if _, err := (alertRuleConfig{Below: "-1kW", ClearAbove: "-2kW"}).rule(); err == nil {
+		t.Fatal("expected error when clear-above is below the threshold")
+	}
+	if _, err := (alertRuleConfig{Above: "1kW", ClearAbove: "0"}).rule(); err == nil {
+		t.Fatal("expected error for clear-above without below")
+	}
+	rule, err := (alertRuleConfig{Below: "-3kW", ClearAbove: "-500W"}).rule()
+	if err != nil || rule.Above != 0 || *rule.Below != -3000 || *rule.ClearAbove != -500 {
+		t.Fatalf("expected an export-only rule, got %+v (%v)", rule, err)
+	}
+
+	hook := &webhook{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	a := newAlerter(server.URL, rule, nil, time.Minute)
+	start := time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)
+	for i, watts := range []float64{200, -3500, -1000, -3200, -400, -3100} {
+		a.observe(context.Background(), deviceResult{Instance: "Solar", Time: start.Add(time.Duration(i) * time.Hour), PowerInfo: &collector.PowerInfo{CurrentWatts: watts}})
+	}
+	a.wait()
+
+	if len(hook.alerts) != 2 {
+		t.Fatalf("expected an alert each time export passed 3 kW after clearing, got %+v", hook.alerts)
+	}
+	sort.Slice(hook.alerts, func(i, j int) bool { return hook.alerts[i].Timestamp.Before(hook.alerts[j].Timestamp) })
+	if got := hook.alerts[0]; got.Watts != -3500 || got.Threshold != -3000 || got.Condition != "below" {
+		t.Fatalf("unexpected alert payload %+v", got)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// aliases maps devices to the display names set under aliases: in the
+// config file. A key matches a device's instance name, its host name or
+// the MAC address in its TXT records, tried in that order.
+type aliases map[string]string
+
+// newAliases normalises the keys of the config file's aliases map. Host
+// names and MAC addresses compare case-insensitively, and MAC addresses
+// with or without separators.
+func newAliases(m map[string]string) (aliases, error) {
+	a := make(aliases, len(m))
+	for key, name := range m {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("config aliases: %s: empty name", key)
+		}
+		a[key] = name
+		if host := hostKey(key); host != key {
+			a[host] = name
+		}
+		if mac := macKey(key); mac != "" {
+			a[mac] = name
+		}
+	}
+	return a, nil
+}
+
+// name returns d's display name, or an empty string when d has no alias.
+func (a aliases) name(d collector.Device) string {
+	if len(a) == 0 {
+		return ""
+	}
+	if name, ok := a[d.Instance]; ok {
+		return name
+	}
+	if name, ok := a[hostKey(d.HostName)]; ok && d.HostName != "" {
+		return name
+	}
+	for _, txt := range d.Text {
+		key, value, ok := strings.Cut(txt, "=")
+		if !ok || !strings.EqualFold(key, "mac") {
+			continue
+		}
+		if name, ok := a[macKey(value)]; ok && macKey(value) != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// liveAliases applies the aliases in polling mode, where a reload can
+// replace them. It remembers the advertised name of every device it
+// renamed, so a renamed device can be renamed again.
+type liveAliases struct {
+	mu         sync.RWMutex
+	aliases    aliases
+	advertised map[string]string
+}
+
+func newLiveAliases(a aliases) *liveAliases {
+	return &liveAliases{aliases: a, advertised: make(map[string]string)}
+}
+
+// name returns d's display name, as aliases.name does, for discovery.
+func (l *liveAliases) name(d collector.Device) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name := l.aliases.name(d)
+	if name != "" {
+		l.advertised[baseKey(name, d.HostName)] = d.Instance
+	}
+	return name
+}
+
+// set replaces the aliases.
+func (l *liveAliases) set(a aliases) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.aliases = a
+}
+
+// rename returns the name the polled device d has under the current
+// aliases: its alias, or else the name it was advertised under.
+func (l *liveAliases) rename(d collector.Device) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	advertised := d
+	if instance, ok := l.advertised[baseKey(d.Instance, d.HostName)]; ok {
+		advertised.Instance = instance
+	}
+	name := l.aliases.name(advertised)
+	if name == "" {
+		return advertised.Instance
+	}
+	l.advertised[baseKey(name, d.HostName)] = advertised.Instance
+	return name
+}
+
+// lookup returns the display name of the alias keyed by key, compared as
+// the keys are and also case-insensitively, or an empty string when no
+// alias is. A nil liveAliases has none.
+func (l *liveAliases) lookup(key string) string {
+	if l == nil {
+		return ""
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, k := range []string{key, hostKey(key), macKey(key)} {
+		if name, ok := l.aliases[k]; ok && k != "" {
+			return name
+		}
+	}
+	for k, name := range l.aliases {
+		if strings.EqualFold(k, key) {
+			return name
+		}
+	}
+	return ""
+}
+
+// baseKey is the key of a device's channels together.
+func baseKey(instance, host string) string {
+	return collector.Device{Instance: instance, HostName: host}.Key()
+}
+
+// hostKey is the form host names are compared in.
+func hostKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// macKey is the form MAC addresses are compared in: twelve lower-case hex
+// digits. It returns an empty string for anything else.
+func macKey(s string) string {
+	mac := strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.ToLower(s))
+	if len(mac) != 12 {
+		return ""
+	}
+	for _, c := range mac {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return ""
+		}
+	}
+	return mac
+}
+
+// printUnaliased browses like --list and writes the discovered devices
+// without an alias as an aliases: map to be filled in.
+func printUnaliased(ctx context.Context, opts options, w io.Writer) error {
+	browseCtx, cancel := context.WithTimeout(ctx, opts.browseTimeout)
+	defer cancel()
+
+	discover := opts.discoverOptions()
+	discover.Static = nil
+	discover.Settle = opts.settle
+	discover.Alias = nil
+	unaliased := make(map[string]collector.Device)
+	err := collector.DiscoverFunc(browseCtx, discover, func(d collector.Device) {
+		if opts.aliases.name(d) != "" {
+			return
+		}
+		unaliased[d.Instance] = d
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(unaliased) == 0 {
+		fmt.Fprintln(w, "# every discovered device has an alias")
+		return nil
+	}
+	fmt.Fprintln(w, "aliases:")
+	for _, instance := range sortedKeys(unaliased) {
+		d := unaliased[instance]
+		fmt.Fprintf(w, "  %s: \"\"  # %s %s\n", strconv.Quote(instance), orDash(d.HostName), orDash(d.Address))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func TestAliasesMatchInstanceHostAndMAC(t *testing.T) {
+	a, err := newAliases(map[string]string{
+		"A3F2C1B4D5E6F708-0000000000000017": "Kettle",
+		"Fridge.local":                      "Fridge",
+		"AA:BB:CC:DD:EE:FF":                 "Heater",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		device collector.Device
+		want   string
+	}{
+		{collector.Device{Instance: "A3F2C1B4D5E6F708-0000000000000017", HostName: "fridge.local"}, "Kettle"},
+		{collector.Device{Instance: "B1", HostName: "FRIDGE.local."}, "Fridge"},
+		{collector.Device{Instance: "B2", HostName: "b2.local", Text: []string{"MAC=aabbccddeeff"}}, "Heater"},
+		{collector.Device{Instance: "B3", HostName: "b3.local", Text: []string{"mac=aa-bb-cc-dd-ee-ff"}}, "Heater"},
+		{collector.Device{Instance: "B4", HostName: "b4.local", Text: []string{"mac=nonsense"}}, ""},
+		{collector.Device{Instance: "B5"}, ""},
+	}
+	for _, c := range cases {
+		if got := a.name(c.device); got != c.want {
+			t.Errorf("name(%+v) = %q, want %q", c.device, got, c.want)
+		}
+	}
+}
+
+func TestNewAliasesRejectsEmptyNames(t *testing.T) {
+	if _, err := newAliases(map[string]string{"Plug": " "}); err == nil || !strings.Contains(err.Error(), "Plug") {
+		t.Fatalf("expected an error naming the key, got %v", err)
+	}
+}
+
+func TestRunUsesAliasesInOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	opts := statusOptions(addr.Port)
+	opts.allowDupes = true
+	opts.cfg = &config{aliases: map[string]string{"A3F2C1B4D5E6F708-0000000000000017": "Kettle"}}
+	opts.resolver = zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "A3F2C1B4D5E6F708-0000000000000017", HostName: "a3f2.local.", AddrIPv4: []net.IP{addr.IP}}},
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}}},
+	)
+	var stdout bytes.Buffer
+	if err := run(context.Background(), opts, &stdout, io.Discard); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	out := stdout.String()
+	if !strings.Contains(out, `"instance":"Kettle"`) || !strings.Contains(out, `"instance":"Lamp"`) || strings.Contains(out, "A3F2") {
+		t.Fatalf("expected the aliased and unmatched names, got %s", out)
+	}
+}
+
+func TestRunPrintsUnaliasedDevices(t *testing.T) {
+	opts := statusOptions(0)
+	opts.showUnaliased = true
+	opts.cfg = &config{aliases: map[string]string{"kettle.local": "Kettle"}}
+	opts.resolver = zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "A3F2C1B4D5E6F708-0000000000000017", HostName: "kettle.local.", AddrIPv4: []net.IP{net.ParseIP("192.0.2.1")}}},
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "B7C9", HostName: "b7c9.local.", AddrIPv4: []net.IP{net.ParseIP("192.0.2.2")}}},
+	)
+	var stdout bytes.Buffer
+	if err := run(context.Background(), opts, &stdout, io.Discard); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	want := "aliases:\n  \"B7C9\": \"\"  # b7c9.local 192.0.2.2\n"
+	if stdout.String() != want {
+		t.Fatalf("unexpected output:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+}
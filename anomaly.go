@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// voltageRangeFlag is the plausible voltage range of --voltage-range,
+// written as MIN-MAX.
+type voltageRangeFlag struct {
+	min, max float64
+}
+
+func (v *voltageRangeFlag) String() string {
+	if v.min == 0 && v.max == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v.min, 'f', -1, 64) + "-" + strconv.FormatFloat(v.max, 'f', -1, 64)
+}
+
+func (v *voltageRangeFlag) Set(s string) error {
+	lo, hi, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return fmt.Errorf("invalid voltage range %q: want MIN-MAX such as 90-260", s)
+	}
+	minVolts, err1 := strconv.ParseFloat(strings.TrimSpace(lo), 64)
+	maxVolts, err2 := strconv.ParseFloat(strings.TrimSpace(hi), 64)
+	if err1 != nil || err2 != nil || minVolts < 0 || maxVolts <= minVolts {
+		return fmt.Errorf("invalid voltage range %q: want MIN-MAX such as 90-260", s)
+	}
+	v.min, v.max = minVolts, maxVolts
+	return nil
+}
+
+// newValidator builds the reading validator configured by the flags, or
+// nil when no check was asked for.
+func newValidator(o options) (*collector.Validator, error) {
+	mode := collector.AnomalyMode(o.anomalyMode)
+	if mode != "" && !slices.Contains(collector.AnomalyModes, mode) {
+		return nil, fmt.Errorf("invalid --anomaly-mode %q: want flag, clamp or drop", o.anomalyMode)
+	}
+	if o.maxWatts < 0 || o.maxMismatch < 0 {
+		return nil, errors.New("--max-watts and --max-power-mismatch must not be negative")
+	}
+	if o.maxWatts == 0 && !o.rejectNegative && o.voltageRange.max == 0 && o.maxMismatch == 0 {
+		return nil, nil
+	}
+	return &collector.Validator{
+		MaxWatts:       o.maxWatts,
+		RejectNegative: o.rejectNegative,
+		MinVolts:       o.voltageRange.min,
+		MaxVolts:       o.voltageRange.max,
+		MaxMismatch:    o.maxMismatch,
+		Mode:           mode,
+	}, nil
+}
+
+// suspect reports whether r is a reading flagged as implausible, which is
+// left out of totals, energy and statistics unless --include-suspect is
+// set.
+func suspect(r collector.Reading) bool {
+	return r.Err == nil && r.Power != nil && r.Power.Suspect
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestVoltageRangeFlag(t *testing.T) {
+	var v voltageRangeFlag
+	if err := v.Set("90-260"); err != nil || v.min != 90 || v.max != 260 || v.String() != "90-260" {
+		t.Fatalf("unexpected range %+v, %v", v, err)
+	}
+	for _, bad := range []string{"230", "260-90", "a-b", "-5-10"} {
+		if err := (&voltageRangeFlag{}).Set(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestNewValidator(t *testing.T) {
+	if v, err := newValidator(options{anomalyMode: "flag"}); v != nil || err != nil {
+		t.Fatalf("expected no validator without checks, got %+v, %v", v, err)
+	}
+	if _, err := newValidator(options{anomalyMode: "ignore", maxWatts: 4000}); err == nil {
+		t.Fatal("expected an unknown anomaly mode to be rejected")
+	}
+	if _, err := newValidator(options{maxWatts: -1}); err == nil {
+		t.Fatal("expected negative --max-watts to be rejected")
+	}
+
+	if v, err := newValidator(options{rejectNegative: true}); v == nil || !v.RejectNegative || err != nil {
+		t.Fatalf("expected --reject-negative alone to build a validator, got %+v, %v", v, err)
+	}
+
+	v, err := newValidator(options{anomalyMode: "clamp", maxWatts: 4000, voltageRange: voltageRangeFlag{90, 260}, maxMismatch: 25})
+	if err != nil || v.MaxWatts != 4000 || v.MinVolts != 90 || v.MaxVolts != 260 || v.MaxMismatch != 25 || v.Mode != collector.AnomalyClamp {
+		t.Fatalf("unexpected validator %+v, %v", v, err)
+	}
+}
+
+func TestSummarizeExcludesSuspectReadings(t *testing.T) {
+	results := []deviceResult{
+		{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}},
+		{Instance: "Glitch", PowerInfo: &collector.PowerInfo{CurrentWatts: 65535, Suspect: true}},
+	}
+
+	sum := newSummarizer(false).summarize(time.Now(), results)
+	if sum.TotalWatts != 12.5 || sum.Failed != 0 || sum.MaxWatts != 12.5 {
+		t.Fatalf("expected the suspect reading to be left out, got %+v", sum)
+	}
+
+	s := newSummarizer(false)
+	s.includeSuspect = true
+	if sum := s.summarize(time.Now(), results); sum.TotalWatts != 65547.5 {
+		t.Fatalf("expected --include-suspect to count it, got %+v", sum)
+	}
+}
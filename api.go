@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// apiDevice is a device as reported by the HTTP API.
+type apiDevice struct {
+	Instance string `json:"instance"`
+	HostName string `json:"hostname"`
+	Address  string `json:"address,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	Group    string `json:"group"`
+	// Source is "push" for devices that push their readings to POST
+	// /ingest.
+	Source string `json:"source,omitempty"`
+	// LastSeen is when the device last answered, even with an error, and
+	// LastSuccess when it last returned a reading.
+	LastSeen    time.Time              `json:"lastSeen,omitzero"`
+	LastSuccess time.Time              `json:"lastSuccess,omitzero"`
+	State       collector.Availability `json:"state,omitempty"`
+	Failing     bool                   `json:"failing,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	// IntervalSeconds is how often the device is polled, stretched while
+	// it answers 429 Too Many Requests and adapted with --adaptive-poll.
+	IntervalSeconds float64 `json:"intervalSeconds,omitempty"`
+
+	power   *collector.PowerInfo
+	channel string
+}
+
+// apiGroup is an element of GET /groups and, with its members, the body of
+// GET /groups/{name}. TotalWatts adds up the members' last good readings.
+type apiGroup struct {
+	Name       string      `json:"name"`
+	TotalWatts float64     `json:"totalWatts"`
+	Devices    int         `json:"devices"`
+	Failed     int         `json:"failed"`
+	Members    []apiDevice `json:"members,omitempty"`
+}
+
+// apiHealth is the body of GET /healthz.
+type apiHealth struct {
+	Status    string    `json:"status"`
+	LastCycle time.Time `json:"lastCycle,omitzero"`
+	Devices   int       `json:"devices"`
+	Failed    int       `json:"failed"`
+}
+
+// api serves the latest readings as JSON. The poller records readings while
+// handlers read them, so all state is guarded by mu.
+type api struct {
+	mu      sync.RWMutex
+	devices map[string]*apiDevice
+	health  apiHealth
+	// stats, when set, serves GET /devices/{instance}/stats.
+	stats *statsTracker
+	// baselines, when set, serves GET /standby.
+	baselines *baselineTracker
+	// stream, when set, serves GET /stream and GET /events.
+	stream *streamHub
+	// homeAssistant serves GET /ha/{device} and GET /ha/total, with the
+	// aliases in names, when set, accepted as device names.
+	homeAssistant bool
+	names         *liveAliases
+	// ingest, when set, serves POST /ingest.
+	ingest *ingester
+	// monitor, when set, serves GET /debugz.
+	monitor *selfMonitor
+	// events, when set, serves GET /device-events. GET /events is the
+	// readings' Server-Sent Events stream.
+	events *deviceLog
+	// pprof serves the net/http/pprof profiles under /debug/pprof/.
+	pprof bool
+}
+
+func newAPI() *api {
+	return &api{devices: make(map[string]*apiDevice), health: apiHealth{Status: "starting"}}
+}
+
+// record stores a reading. A failed reading keeps the last good power value.
+func (a *api) record(r collector.Reading) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := r.Device.Key()
+	d, ok := a.devices[key]
+	if !ok {
+		d = &apiDevice{}
+		a.devices[key] = d
+	}
+	d.Instance = r.Device.Instance
+	d.HostName = r.Device.HostName
+	d.Address = r.Device.Address
+	d.Firmware = r.Device.Firmware
+	d.Group = groupName(r.Device.Group)
+	d.Source = r.Device.Source
+	d.channel = r.Device.Channel
+	d.Failing = r.Failing
+	d.State = r.State
+	d.IntervalSeconds = r.Interval.Seconds()
+	d.Error = ""
+	if !r.LastSeen.IsZero() {
+		d.LastSeen = r.LastSeen
+	}
+	if r.Err != nil {
+		d.Error = r.Err.Error()
+		return
+	}
+	if r.LastSeen.IsZero() {
+		d.LastSeen = r.Time
+	}
+	d.LastSuccess = r.Time
+	d.power = r.Power
+}
+
+// recordCycle records the outcome of a poll cycle for GET /healthz. A cycle
+// succeeds unless every device in it failed.
+func (a *api) recordCycle(now time.Time, readings []collector.Reading) {
+	failed := 0
+	for _, r := range readings {
+		if r.Err != nil {
+			failed++
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.health = apiHealth{Status: "ok", LastCycle: now, Devices: len(readings), Failed: failed}
+	if len(readings) > 0 && failed == len(readings) {
+		a.health.Status = "failing"
+	}
+}
+
+// register adds the API routes to mux.
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /devices", a.listDevices)
+	mux.HandleFunc("GET /devices/{instance}/power", a.devicePower)
+	mux.HandleFunc("GET /devices/{instance}/stats", a.deviceStats)
+	mux.HandleFunc("GET /standby", a.standby)
+	mux.HandleFunc("GET /groups", a.listGroups)
+	mux.HandleFunc("GET /groups/{name}", a.group)
+	mux.HandleFunc("GET /healthz", a.healthz)
+	mux.HandleFunc("GET /version", a.version)
+	if a.stream != nil {
+		a.stream.register(mux)
+	}
+	if a.ingest != nil {
+		mux.Handle("POST /ingest", a.ingest)
+	}
+	if a.monitor != nil {
+		mux.HandleFunc("GET /debugz", a.debugz)
+	}
+	if a.events != nil {
+		mux.HandleFunc("GET /device-events", a.deviceEvents)
+	}
+	if a.pprof {
+		registerPprof(mux)
+	}
+	if a.homeAssistant {
+		mux.HandleFunc("GET /ha/total", a.haRESTTotal)
+		mux.HandleFunc("GET /ha/{device}", a.haREST)
+	}
+}
+
+func (a *api) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentBuild())
+}
+
+func (a *api) listDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.deviceList())
+}
+
+// deviceList returns a snapshot of the devices, sorted by name.
+func (a *api) deviceList() []apiDevice {
+	a.mu.RLock()
+	list := make([]apiDevice, 0, len(a.devices))
+	for _, d := range a.devices {
+		list = append(list, *d)
+	}
+	a.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Instance != list[j].Instance {
+			return list[i].Instance < list[j].Instance
+		}
+		return list[i].HostName < list[j].HostName
+	})
+	return list
+}
+
+// groups returns every group with its members, sorted by name.
+func (a *api) groups() []apiGroup {
+	byName := make(map[string]*apiGroup)
+	for _, d := range a.deviceList() {
+		g := byName[d.Group]
+		if g == nil {
+			g = &apiGroup{Name: d.Group}
+			byName[d.Group] = g
+		}
+		g.Devices++
+		if d.Error != "" {
+			g.Failed++
+		}
+		if d.power != nil {
+			g.TotalWatts += d.power.CurrentWatts
+		}
+		g.Members = append(g.Members, d)
+	}
+	list := make([]apiGroup, 0, len(byName))
+	for _, name := range sortedKeys(byName) {
+		list = append(list, *byName[name])
+	}
+	return list
+}
+
+func (a *api) listGroups(w http.ResponseWriter, r *http.Request) {
+	list := a.groups()
+	for i := range list {
+		list[i].Members = nil
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *api) group(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	for _, g := range a.groups() {
+		if g.Name == name {
+			writeJSON(w, http.StatusOK, g)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown group " + name})
+}
+
+func (a *api) devicePower(w http.ResponseWriter, r *http.Request) {
+	instance := r.PathValue("instance")
+
+	a.mu.RLock()
+	var power *collector.PowerInfo
+	found := false
+	for _, d := range a.devices {
+		if d.Instance == instance {
+			found = true
+			if d.power != nil {
+				power = d.power
+				break
+			}
+		}
+	}
+	a.mu.RUnlock()
+
+	switch {
+	case !found:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown device " + instance})
+	case power == nil:
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no reading yet for " + instance})
+	default:
+		writeJSON(w, http.StatusOK, power)
+	}
+}
+
+// deviceStats serves the power statistics of a device, or of one channel
+// of it with ?channel=.
+func (a *api) deviceStats(w http.ResponseWriter, r *http.Request) {
+	instance, channel := r.PathValue("instance"), r.URL.Query().Get("channel")
+	if a.stats == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "statistics are not enabled"})
+		return
+	}
+
+	var keys []string
+	a.mu.RLock()
+	for key, d := range a.devices {
+		if d.Instance == instance && d.channel == channel {
+			keys = append(keys, key)
+		}
+	}
+	a.mu.RUnlock()
+	if len(keys) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown device " + deviceLabel(instance, channel)})
+		return
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		if st, ok := a.stats.device(key, now); ok {
+			writeJSON(w, http.StatusOK, st)
+			return
+		}
+	}
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no reading yet for " + deviceLabel(instance, channel)})
+}
+
+// standby serves the devices idling above --standby-threshold, the
+// largest first.
+func (a *api) standby(w http.ResponseWriter, r *http.Request) {
+	if a.baselines == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "standby detection is not enabled"})
+		return
+	}
+	loads := a.baselines.standby(time.Now())
+	if loads == nil {
+		loads = []standbyDevice{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"thresholdWatts": a.baselines.threshold, "devices": loads})
+}
+
+func (a *api) healthz(w http.ResponseWriter, r *http.Request) {
+	a.mu.RLock()
+	health := a.health
+	a.mu.RUnlock()
+
+	status := http.StatusOK
+	if health.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
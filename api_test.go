@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func apiGet(t *testing.T, a *api, path string, v any) int {
+	t.Helper()
+	mux := http.NewServeMux()
+	a.register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s: unexpected content type %q", path, ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: expected JSON body, got %q (%v)", path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAPIServesDevicesAndPower(t *testing.T) {
+	a := newAPI()
+	seen := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	lamp := collector.Device{Instance: "Desk Lamp", HostName: "lamp.local", Firmware: "1.2"}
+	a.record(collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 12.5}, Time: seen})
+	a.record(collector.Reading{Device: lamp, Err: errors.New("timeout"), Time: seen.Add(time.Minute)})
+
+	var devices []apiDevice
+	if code := apiGet(t, a, "/devices", &devices); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(devices) != 1 || devices[0].Firmware != "1.2" || !devices[0].LastSeen.Equal(seen) || devices[0].Error != "timeout" {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+
+	var power collector.PowerInfo
+	if code := apiGet(t, a, "/devices/Desk%20Lamp/power", &power); code != http.StatusOK || power.CurrentWatts != 12.5 {
+		t.Fatalf("expected last good reading, got %d %+v", code, power)
+	}
+	if code := apiGet(t, a, "/devices/Nope/power", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown device, got %d", code)
+	}
+}
+
+func TestAPIServesGroups(t *testing.T) {
+	a := newAPI()
+	now := time.Now()
+	a.record(collector.Reading{Device: collector.Device{Instance: "Desk Lamp", Group: "office"}, Power: &collector.PowerInfo{CurrentWatts: 12.5}, Time: now})
+	a.record(collector.Reading{Device: collector.Device{Instance: "Monitor", Group: "office"}, Err: errors.New("timeout"), Time: now})
+	a.record(collector.Reading{Device: collector.Device{Instance: "Shed"}, Power: &collector.PowerInfo{CurrentWatts: 5}, Time: now})
+
+	var groups []apiGroup
+	if code := apiGet(t, a, "/groups", &groups); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(groups) != 2 || groups[0].Name != defaultGroup || groups[0].TotalWatts != 5 || groups[1].Name != "office" || groups[1].Devices != 2 || groups[1].Failed != 1 || groups[1].Members != nil {
+		t.Fatalf("unexpected groups %+v", groups)
+	}
+
+	var office apiGroup
+	if code := apiGet(t, a, "/groups/office", &office); code != http.StatusOK || office.TotalWatts != 12.5 || len(office.Members) != 2 || office.Members[0].Group != "office" {
+		t.Fatalf("expected the office and its members, got %d %+v", code, office)
+	}
+	if code := apiGet(t, a, "/groups/garage", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown group, got %d", code)
+	}
+}
+
+func TestAPIServesVersion(t *testing.T) {
+	var build buildInfo
+	if code := apiGet(t, newAPI(), "/version", &build); code != http.StatusOK || build != currentBuild() || build.Version == "" {
+		t.Fatalf("expected the build information, got %d %+v", code, build)
+	}
+}
+
+func TestAPIReportsAvailability(t *testing.T) {
+	a := newAPI()
+	success := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	seen := success.Add(time.Minute)
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local"}
+	a.record(collector.Reading{Device: plug, Power: &collector.PowerInfo{CurrentWatts: 3}, Time: success, State: collector.Online, LastSeen: success, LastSuccess: success})
+	a.record(collector.Reading{Device: plug, Err: errors.New("unexpected status 500"), Time: seen, State: collector.Degraded, Failing: true, LastSeen: seen, LastSuccess: success})
+	a.record(collector.Reading{Device: plug, Err: errors.New("timeout"), Time: seen.Add(time.Minute), State: collector.Offline, Failing: true, LastSeen: seen, LastSuccess: success})
+
+	var devices []apiDevice
+	apiGet(t, a, "/devices", &devices)
+	if len(devices) != 1 || devices[0].State != collector.Offline || !devices[0].LastSeen.Equal(seen) || !devices[0].LastSuccess.Equal(success) {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+}
+
+func TestAPIReportsPollInterval(t *testing.T) {
+	a := newAPI()
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local"}
+	a.record(collector.Reading{Device: plug, Err: errors.New("unexpected status 429"), Time: time.Now(), Interval: 80 * time.Second})
+
+	var devices []apiDevice
+	apiGet(t, a, "/devices", &devices)
+	if len(devices) != 1 || devices[0].IntervalSeconds != 80 {
+		t.Fatalf("expected the stretched interval, got %+v", devices)
+	}
+}
+
+func TestAPIServesDeviceStats(t *testing.T) {
+	a := newAPI()
+	if code := apiGet(t, a, "/devices/Plug/stats", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 without statistics, got %d", code)
+	}
+
+	a.stats = newStatsTracker(time.Hour, time.Local)
+	now := time.Now()
+	for _, r := range []collector.Reading{
+		{Device: collector.Device{Instance: "Plug", HostName: "plug.local"}, Power: &collector.PowerInfo{CurrentWatts: 10}, Time: now.Add(-time.Minute)},
+		{Device: collector.Device{Instance: "Plug", HostName: "plug.local"}, Power: &collector.PowerInfo{CurrentWatts: 30}, Time: now},
+		{Device: collector.Device{Instance: "Plug", HostName: "plug.local", Channel: "1"}, Power: &collector.PowerInfo{CurrentWatts: 5}, Time: now},
+	} {
+		a.record(r)
+		a.stats.add(r)
+	}
+
+	var st deviceStats
+	if code := apiGet(t, a, "/devices/Plug/stats", &st); code != http.StatusOK || st.Window == nil || st.Window.Mean != 20 {
+		t.Fatalf("expected the device's statistics, got %d %+v", code, st.Window)
+	}
+	if code := apiGet(t, a, "/devices/Plug/stats?channel=1", &st); code != http.StatusOK || st.Window.Max != 5 {
+		t.Fatalf("expected the channel's statistics, got %d %+v", code, st.Window)
+	}
+	if code := apiGet(t, a, "/devices/Nope/stats", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown device, got %d", code)
+	}
+}
+
+func TestAPIHealthz(t *testing.T) {
+	a := newAPI()
+	var health apiHealth
+	if code := apiGet(t, a, "/healthz", &health); code != http.StatusServiceUnavailable || health.Status != "starting" {
+		t.Fatalf("expected 503 before the first cycle, got %d %+v", code, health)
+	}
+
+	failed := collector.Reading{Device: collector.Device{Instance: "Lamp"}, Err: errors.New("timeout")}
+	ok := collector.Reading{Device: collector.Device{Instance: "Plug"}, Power: &collector.PowerInfo{}}
+	a.recordCycle(time.Now(), []collector.Reading{failed, ok})
+	if code := apiGet(t, a, "/healthz", &health); code != http.StatusOK || health.Failed != 1 {
+		t.Fatalf("expected healthy cycle with one failure, got %d %+v", code, health)
+	}
+
+	a.recordCycle(time.Now(), []collector.Reading{failed})
+	if code := apiGet(t, a, "/healthz", &health); code != http.StatusServiceUnavailable || health.Status != "failing" {
+		t.Fatalf("expected 503 when every device failed, got %d %+v", code, health)
+	}
+}
+
+func TestAPIHealthzStarting(t *testing.T) {
+	a := newAPI()
+	var health map[string]any
+	if code := apiGet(t, a, "/healthz", &health); code != http.StatusServiceUnavailable || health["status"] != "starting" {
+		t.Fatalf("expected 503 before the first cycle, got %d %v", code, health)
+	}
+	if _, ok := health["lastCycle"]; ok {
+		t.Fatalf("expected no lastCycle before the first cycle, got %v", health)
+	}
+
+	a.record(collector.Reading{Device: collector.Device{Instance: "Plug"}, Err: errors.New("timeout"), Time: time.Now()})
+	var devices []map[string]any
+	apiGet(t, a, "/devices", &devices)
+	if len(devices) != 1 {
+		t.Fatalf("expected one device, got %v", devices)
+	}
+	if _, ok := devices[0]["lastSuccess"]; ok {
+		t.Fatalf("expected no lastSuccess for a device that never answered, got %v", devices[0])
+	}
+}
+
+func TestAPIConcurrentAccess(t *testing.T) {
+	a := newAPI()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				a.record(collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: float64(j)}})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				apiGet(t, a, "/devices/Lamp/power", nil)
+			}
+		}()
+	}
+	wg.Wait()
+}
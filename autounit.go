@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// autoUnitMaxWatts is the most a single metered device plausibly draws;
+// a reading above it is more likely in milliwatts.
+const autoUnitMaxWatts = 25000
+
+// unitCheck implements --auto-unit: it warns, once per device, about
+// readings whose power looks to be in another unit than watts, suggesting
+// the unit to set for the device. Readings are never changed. A nil
+// unitCheck checks nothing.
+type unitCheck struct {
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+func newUnitCheck() *unitCheck {
+	return &unitCheck{warned: make(map[string]bool)}
+}
+
+// check warns when info, a reading of d, looks to be in another unit.
+// Devices with a unit set are taken at their word.
+func (c *unitCheck) check(d collector.Device, info *collector.PowerInfo) {
+	if c == nil || info == nil || d.Unit != "" {
+		return
+	}
+	unit := guessUnit(info)
+	if unit == "" {
+		return
+	}
+	c.mu.Lock()
+	warned := c.warned[d.Key()]
+	c.warned[d.Key()] = true
+	c.mu.Unlock()
+	if !warned {
+		slog.Warn("implausible power reading", "device", d.Instance, "host", d.HostName, "watts", info.CurrentWatts,
+			"likelyUnit", unit, "hint", "set unit: "+unit+" for the device in the devices file")
+	}
+}
+
+// guessUnit returns the unit info's power is likely in when it does not
+// look like watts, or an empty string. Against the voltage and current, a
+// power a thousand times too high or low gives it away; without them, a
+// power above autoUnitMaxWatts suggests milliwatts.
+func guessUnit(info *collector.PowerInfo) string {
+	watts := info.CurrentWatts
+	if watts <= 0 {
+		return ""
+	}
+	if info.Voltage > 0 && info.Amperage > 0 {
+		switch ratio := watts / (info.Voltage * info.Amperage); {
+		case ratio > 100:
+			return collector.UnitMilliwatts
+		case ratio < 0.01:
+			return collector.UnitKilowatts
+		}
+		return ""
+	}
+	if watts > autoUnitMaxWatts {
+		return collector.UnitMilliwatts
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestGuessUnit(t *testing.T) {
+	cases := []struct {
+		info collector.PowerInfo
+		want string
+	}{
+		{collector.PowerInfo{CurrentWatts: 12450}, ""},
+		{collector.PowerInfo{CurrentWatts: 31000}, collector.UnitMilliwatts},
+		{collector.PowerInfo{CurrentWatts: 12450, Voltage: 230, Amperage: 0.055}, collector.UnitMilliwatts},
+		{collector.PowerInfo{CurrentWatts: 1.21, Voltage: 230, Amperage: 5.3}, collector.UnitKilowatts},
+		{collector.PowerInfo{CurrentWatts: 1.21, Voltage: 230, Amperage: 0.006}, ""},
+		{collector.PowerInfo{CurrentWatts: 1.21}, ""},
+	}
+	for _, c := range cases {
+		if got := guessUnit(&c.info); got != c.want {
+			t.Errorf("%+v: expected %q, got %q", c.info, c.want, got)
+		}
+	}
+}
+
+func TestUnitCheckWarnsOncePerDevice(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	c := newUnitCheck()
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local"}
+	reading := &collector.PowerInfo{CurrentWatts: 1.21, Voltage: 230, Amperage: 5.3}
+	c.check(plug, reading)
+	c.check(plug, reading)
+	c.check(collector.Device{Instance: "Configured", Unit: collector.UnitWatts}, reading)
+	var none *unitCheck
+	none.check(plug, reading)
+
+	if got := strings.Count(buf.String(), "implausible power reading"); got != 1 {
+		t.Fatalf("expected one warning, got %d: %s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "likelyUnit=kW") {
+		t.Fatalf("expected the likely unit suggested, got %s", buf.String())
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+const (
+	// baselineWindow is how far back a device's idle baseline looks.
+	baselineWindow = 24 * time.Hour
+	// baselineResolution is the span of readings averaged into each
+	// sample of the baseline, bounding what is kept and saved per device.
+	baselineResolution = time.Minute
+	// baselinePercentile is the quantile of a device's readings taken as
+	// its idle baseline.
+	baselinePercentile = 0.10
+	// baselineMinReadings is how many readings within the window a device
+	// needs before it has a baseline.
+	baselineMinReadings = 30
+)
+
+// baselineSlot averages the readings of one baselineResolution span.
+type baselineSlot struct {
+	Start time.Time `json:"t"`
+	Sum   float64   `json:"sum"`
+	Count int       `json:"n"`
+}
+
+// baselineDevice holds a device's readings over the baseline window, as
+// kept in the --state file.
+type baselineDevice struct {
+	Instance string         `json:"instance"`
+	HostName string         `json:"host,omitempty"`
+	Channel  string         `json:"channel,omitempty"`
+	Slots    []baselineSlot `json:"slots"`
+}
+
+// standbyDevice is a device idling above --standby-threshold.
+type standbyDevice struct {
+	Device        string  `json:"device"`
+	HostName      string  `json:"hostname,omitempty"`
+	BaselineWatts float64 `json:"baselineWatts"`
+	Readings      int     `json:"readings"`
+}
+
+// baselineTracker estimates each device's idle power as the 10th
+// percentile of its readings over the last 24 hours, once it has enough of
+// them, and reports the devices idling above threshold as standby loads.
+// A nil baselineTracker tracks nothing.
+type baselineTracker struct {
+	threshold float64
+
+	mu      sync.Mutex
+	devices map[string]*baselineDevice
+}
+
+func newBaselineTracker(threshold float64) *baselineTracker {
+	return &baselineTracker{threshold: threshold, devices: make(map[string]*baselineDevice)}
+}
+
+// add records a successful reading and returns the device's baseline, or
+// nil until it has one.
+func (b *baselineTracker) add(r collector.Reading) *float64 {
+	if b == nil || r.Err != nil || r.Power == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := r.Device.Key()
+	dev, ok := b.devices[key]
+	if !ok {
+		dev = &baselineDevice{}
+		b.devices[key] = dev
+	}
+	dev.Instance, dev.HostName, dev.Channel = r.Device.Instance, r.Device.HostName, r.Device.Channel
+	start := r.Time.Truncate(baselineResolution)
+	if n := len(dev.Slots); n > 0 && dev.Slots[n-1].Start.Equal(start) {
+		dev.Slots[n-1].Sum += r.Power.CurrentWatts
+		dev.Slots[n-1].Count++
+	} else {
+		dev.Slots = append(dev.Slots, baselineSlot{Start: start, Sum: r.Power.CurrentWatts, Count: 1})
+	}
+	watts, _, ok := dev.baseline(r.Time)
+	if !ok {
+		return nil
+	}
+	return &watts
+}
+
+// baseline drops the slots that have left the window as of now and
+// returns the device's baseline and the readings it is taken from, and
+// false while there are too few of them.
+func (d *baselineDevice) baseline(now time.Time) (float64, int, bool) {
+	cutoff := now.Add(-baselineWindow)
+	i := 0
+	for i < len(d.Slots) && !d.Slots[i].Start.After(cutoff) {
+		i++
+	}
+	d.Slots = slices.Delete(d.Slots, 0, i)
+
+	readings := 0
+	values := make([]float64, len(d.Slots))
+	for i, slot := range d.Slots {
+		values[i] = slot.Sum / float64(slot.Count)
+		readings += slot.Count
+	}
+	if readings < baselineMinReadings {
+		return 0, readings, false
+	}
+	return percentile(values, baselinePercentile), readings, true
+}
+
+// device returns the baseline of the device with key as of now.
+func (b *baselineTracker) device(key string, now time.Time) (float64, bool) {
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dev, ok := b.devices[key]
+	if !ok {
+		return 0, false
+	}
+	watts, _, ok := dev.baseline(now)
+	return watts, ok
+}
+
+// standby returns the devices whose baseline as of now exceeds the
+// threshold, the largest first.
+func (b *baselineTracker) standby(now time.Time) []standbyDevice {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var loads []standbyDevice
+	for _, dev := range b.devices {
+		watts, readings, ok := dev.baseline(now)
+		if ok && watts > b.threshold {
+			loads = append(loads, standbyDevice{Device: deviceLabel(dev.Instance, dev.Channel), HostName: dev.HostName, BaselineWatts: watts, Readings: readings})
+		}
+	}
+	slices.SortFunc(loads, func(x, y standbyDevice) int {
+		if x.BaselineWatts != y.BaselineWatts {
+			if x.BaselineWatts > y.BaselineWatts {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(x.Device, y.Device)
+	})
+	return loads
+}
+
+// restore resumes the readings saved in the --state file.
+func (b *baselineTracker) restore(devices map[string]*baselineDevice) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, dev := range devices {
+		if dev != nil {
+			b.devices[key] = dev
+		}
+	}
+}
+
+// snapshot returns a copy of the readings to save in the --state file.
+func (b *baselineTracker) snapshot() map[string]*baselineDevice {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	devices := make(map[string]*baselineDevice, len(b.devices))
+	for key, dev := range b.devices {
+		cp := *dev
+		cp.Slots = slices.Clone(dev.Slots)
+		devices[key] = &cp
+	}
+	return devices
+}
+
+// standbyText describes the standby loads in the text summary, such as
+// "Fridge 12.30 W, TV 4.10 W".
+func standbyText(loads []standbyDevice) string {
+	parts := make([]string, len(loads))
+	for i, l := range loads {
+		parts[i] = fmt.Sprintf("%s %.2f W", l.Device, l.BaselineWatts)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// feedBaseline adds a reading of watts a minute for each of n minutes
+// from start, returning the last baseline.
+func feedBaseline(b *baselineTracker, d collector.Device, start time.Time, n int, watts float64) *float64 {
+	var baseline *float64
+	for i := range n {
+		baseline = b.add(collector.Reading{Device: d, Power: &collector.PowerInfo{CurrentWatts: watts}, Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	return baseline
+}
+
+func TestBaselineTrackerEstimatesIdlePower(t *testing.T) {
+	b := newBaselineTracker(3)
+	fridge := collector.Device{Instance: "Fridge", HostName: "fridge.local"}
+	lamp := collector.Device{Instance: "Lamp"}
+	start := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+
+	if got := feedBaseline(b, fridge, start, 20, 5); got != nil {
+		t.Fatalf("expected no baseline from too few readings, got %v", *got)
+	}
+	got := feedBaseline(b, fridge, start.Add(20*time.Minute), 20, 120)
+	if got == nil || *got != 5 {
+		t.Fatalf("expected the idle draw as the baseline, got %v", got)
+	}
+	feedBaseline(b, lamp, start, 40, 0.5)
+	b.add(collector.Reading{Device: lamp, Err: errors.New("timeout"), Time: start})
+
+	now := start.Add(40 * time.Minute)
+	loads := b.standby(now)
+	if len(loads) != 1 || loads[0].Device != "Fridge" || loads[0].BaselineWatts != 5 || loads[0].Readings != 40 {
+		t.Fatalf("expected only the fridge reported as a standby load, got %+v", loads)
+	}
+	if text := standbyText(loads); text != "Fridge 5.00 W" {
+		t.Fatalf("unexpected standby text %q", text)
+	}
+	if _, ok := b.device(fridge.Key(), now.Add(25*time.Hour)); ok {
+		t.Fatal("expected readings older than the window dropped")
+	}
+
+	var none *baselineTracker
+	if none.add(collector.Reading{Device: fridge, Power: &collector.PowerInfo{}}) != nil || none.standby(now) != nil {
+		t.Fatal("expected a nil tracker to track nothing")
+	}
+}
+
+func TestBaselineSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	fridge := collector.Device{Instance: "Fridge"}
+	start := time.Now().Add(-time.Hour)
+	b := newBaselineTracker(3)
+	feedBaseline(b, fridge, start, 40, 7)
+
+	energy := newEnergyMeter(0)
+	energy.setBaselines(b.snapshot())
+	if err := energy.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newEnergyMeter(0)
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := newBaselineTracker(3)
+	restored.restore(loaded.baselines)
+	if watts, ok := restored.device(fridge.Key(), time.Now()); !ok || watts != 7 {
+		t.Fatalf("expected the baseline restored from the state file, got %v, %v", watts, ok)
+	}
+}
+
+func TestStandbyServedAndExported(t *testing.T) {
+	fridge := collector.Device{Instance: "Fridge", HostName: "fridge.local"}
+	b := newBaselineTracker(3)
+	feedBaseline(b, fridge, time.Now().Add(-time.Hour), 40, 12)
+
+	a := newAPI()
+	var body struct {
+		Threshold float64         `json:"thresholdWatts"`
+		Devices   []standbyDevice `json:"devices"`
+	}
+	if code := apiGet(t, a, "/standby", nil); code != 404 {
+		t.Fatalf("expected /standby disabled without --standby-threshold, got %d", code)
+	}
+	a.baselines = b
+	if code := apiGet(t, a, "/standby", &body); code != 200 || body.Threshold != 3 || len(body.Devices) != 1 || body.Devices[0].BaselineWatts != 12 {
+		t.Fatalf("unexpected /standby answer %d %+v", code, body)
+	}
+
+	e := newExporter()
+	e.baselines = b
+	e.record(collector.Reading{Device: fridge, Power: &collector.PowerInfo{CurrentWatts: 80}, Time: time.Now()})
+	if out := scrape(t, e); !strings.Contains(out, `power_device_baseline_watts{device="Fridge",host="fridge.local"} 12`) {
+		t.Fatalf("expected the baseline metric, got %s", out)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// defaultCacheTTL is how long a device stays in the --cache file without
+// being discovered again.
+const defaultCacheTTL = 7 * 24 * time.Hour
+
+// cachedDevice is a discovered device as kept in the cache file.
+type cachedDevice struct {
+	Instance  string    `json:"instance"`
+	HostName  string    `json:"hostname"`
+	Address   string    `json:"address,omitempty"`
+	Addresses []string  `json:"addresses,omitempty"`
+	Preferred string    `json:"preferredAddress,omitempty"`
+	Text      []string  `json:"txt,omitempty"`
+	Firmware  string    `json:"firmware,omitempty"`
+	Services  []string  `json:"services,omitempty"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// device returns the collector device c was cached from.
+func (c cachedDevice) device() collector.Device {
+	return collector.Device{
+		Instance:  c.Instance,
+		HostName:  c.HostName,
+		Address:   c.Address,
+		Addresses: c.Addresses,
+		Firmware:  c.Firmware,
+		Text:      c.Text,
+		Meta:      collector.ParseTXT(&collector.ServiceEntry{Text: c.Text}),
+		Services:  c.Services,
+	}
+}
+
+// cacheFile is the JSON document of the cache file.
+type cacheFile struct {
+	Devices []cachedDevice `json:"devices"`
+}
+
+// deviceCache remembers discovered devices across runs, so a run can start
+// querying them before discovery finds them again. Devices not seen for
+// ttl are dropped; a zero ttl keeps them forever. A nil cache ignores
+// every call.
+type deviceCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	devices map[string]cachedDevice
+}
+
+func newDeviceCache(ttl time.Duration) *deviceCache {
+	return &deviceCache{ttl: ttl, devices: make(map[string]cachedDevice)}
+}
+
+// load reads the cache file at path, keeping the devices seen within the
+// ttl of now. A missing file is an empty cache.
+func (c *deviceCache) load(path string, now time.Time) error {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from the operator
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read cache: %w", err)
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse cache %s: %w", path, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range file.Devices {
+		if d.Instance != "" && !c.expired(d, now) {
+			c.devices[d.device().Key()] = d
+		}
+	}
+	return nil
+}
+
+// expired reports whether d was last seen longer than the ttl before now.
+func (c *deviceCache) expired(d cachedDevice, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(d.LastSeen) > c.ttl
+}
+
+// seen records that d was discovered at now.
+func (c *deviceCache) seen(d collector.Device, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.devices[d.Key()] = cachedDevice{
+		Instance:  d.Instance,
+		HostName:  d.HostName,
+		Address:   d.Address,
+		Addresses: d.Addresses,
+		Preferred: c.devices[d.Key()].Preferred,
+		Text:      d.Text,
+		Firmware:  d.Firmware,
+		Services:  d.Services,
+		LastSeen:  now,
+	}
+}
+
+// setPreferred records the addresses devices last answered on, keyed by
+// collector.EndpointKey, as learned by the fetcher.
+func (c *deviceCache) setPreferred(addrs map[string]string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, addr := range addrs {
+		if d, ok := c.devices[key]; ok {
+			d.Preferred = addr
+			c.devices[key] = d
+		}
+	}
+}
+
+// preferred returns the preferred address of every cached device that has
+// one, keyed by collector.EndpointKey.
+func (c *deviceCache) preferred() map[string]string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := make(map[string]string)
+	for key, d := range c.devices {
+		if d.Preferred != "" {
+			addrs[key] = d.Preferred
+		}
+	}
+	return addrs
+}
+
+// fresh returns the cached devices seen within the ttl of now, most
+// recently seen first.
+func (c *deviceCache) fresh(now time.Time) []collector.Device {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := c.sortedLocked(now)
+	devices := make([]collector.Device, len(entries))
+	for i, d := range entries {
+		devices[i] = d.device()
+	}
+	return devices
+}
+
+// sortedLocked returns the unexpired devices, most recently seen first.
+// The caller holds c.mu.
+func (c *deviceCache) sortedLocked(now time.Time) []cachedDevice {
+	entries := make([]cachedDevice, 0, len(c.devices))
+	for _, d := range c.devices {
+		if !c.expired(d, now) {
+			entries = append(entries, d)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].LastSeen.Equal(entries[j].LastSeen) {
+			return entries[i].LastSeen.After(entries[j].LastSeen)
+		}
+		return entries[i].Instance < entries[j].Instance
+	})
+	return entries
+}
+
+// save writes the unexpired devices to the cache file at path, replacing
+// it atomically.
+func (c *deviceCache) save(path string, now time.Time) error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(cacheFile{Devices: c.sortedLocked(now)}, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("write cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write cache: %w", err)
+	}
+	return nil
+}
+
+// saveAndLog saves the cache to path, logging any error.
+func (c *deviceCache) saveAndLog(path string) {
+	if err := c.save(path, time.Now()); err != nil {
+		slog.Error("discovery cache error", "path", path, "error", err)
+	}
+}
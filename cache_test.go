@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func TestDeviceCacheRoundTripDropsExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.cache.json")
+	now := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	c := newDeviceCache(7 * 24 * time.Hour)
+	c.seen(collector.Device{Instance: "Old", HostName: "old.local", Address: "10.0.0.1"}, now.Add(-8*24*time.Hour))
+	c.seen(collector.Device{Instance: "Plug", HostName: "plug.local", Address: "10.0.0.7", Text: []string{"VP=65521+32768"}, Firmware: "1.2", Services: []string{collector.OperationalService}}, now.Add(-time.Hour))
+	if err := c.save(path, now); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newDeviceCache(7 * 24 * time.Hour)
+	if err := loaded.load(path, now); err != nil {
+		t.Fatal(err)
+	}
+	devices := loaded.fresh(now)
+	if len(devices) != 1 {
+		t.Fatalf("expected the expired device dropped, got %+v", devices)
+	}
+	if d := devices[0]; d.Instance != "Plug" || d.Address != "10.0.0.7" || d.Firmware != "1.2" || d.Meta.VendorID != 65521 || !d.Operational() {
+		t.Fatalf("unexpected cached device %+v", d)
+	}
+	if devices := loaded.fresh(now.Add(7 * 24 * time.Hour)); len(devices) != 0 {
+		t.Fatalf("expected the device to expire, got %+v", devices)
+	}
+}
+
+func TestDeviceCacheKeepsPreferredAddress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.cache.json")
+	now := time.Now()
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local", Address: "10.0.0.7", Addresses: []string{"10.0.0.7", "192.168.1.7"}}
+	c := newDeviceCache(defaultCacheTTL)
+	c.seen(plug, now)
+	c.setPreferred(map[string]string{collector.EndpointKey(plug): "192.168.1.7", "gone": "10.0.0.9"})
+	c.seen(plug, now)
+	if err := c.save(path, now); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newDeviceCache(defaultCacheTTL)
+	if err := loaded.load(path, now); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{collector.EndpointKey(plug): "192.168.1.7"}
+	if got := loaded.preferred(); !maps.Equal(got, want) {
+		t.Fatalf("expected the preferred address kept across rediscovery and restarts, got %v", got)
+	}
+}
+
+func TestDeviceCacheLoadReportsCorruption(t *testing.T) {
+	c := newDeviceCache(defaultCacheTTL)
+	if err := c.load(filepath.Join(t.TempDir(), "missing.json"), time.Now()); err != nil {
+		t.Fatalf("expected a missing cache to be empty, got %v", err)
+	}
+	if err := c.load(writeFile(t, "devices.cache.json", "{not json"), time.Now()); err == nil {
+		t.Fatal("expected an error for a corrupt cache")
+	}
+}
+
+func TestRunUsesCacheWhileDiscoveryRefreshesIt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	path := filepath.Join(t.TempDir(), "devices.cache.json")
+
+	// A corrupt cache is replaced by what this run discovers.
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts := statusOptions(addr.Port)
+	opts.cachePath, opts.useCache = path, true
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}}})
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err != nil {
+		t.Fatalf("expected a corrupt cache not to be fatal, got %v", err)
+	}
+
+	// Nothing is discovered now, but the cached device is still queried.
+	var out bytes.Buffer
+	opts.resolver = zeroconf.NewStubResolver()
+	if err := run(context.Background(), opts, &out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"instance":"Lamp"`) || !strings.Contains(out.String(), `"currentWatts":5`) {
+		t.Fatalf("expected the cached device queried, got %q", out.String())
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// changeThresholdFlag is --change-threshold: an absolute power such as
+// 1.5W, or a percentage of the last emitted reading such as 5%.
+type changeThresholdFlag struct {
+	value   float64
+	percent bool
+}
+
+func (c *changeThresholdFlag) String() string {
+	switch {
+	case c.value == 0:
+		return ""
+	case c.percent:
+		return formatFloat(c.value) + "%"
+	}
+	return formatFloat(c.value) + "W"
+}
+
+func (c *changeThresholdFlag) Set(s string) error {
+	if v, ok := strings.CutSuffix(strings.TrimSpace(s), "%"); ok {
+		pct, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || pct < 0 {
+			return fmt.Errorf("invalid change threshold %q: want a power such as 1.5W or a percentage such as 5%%", s)
+		}
+		c.value, c.percent = pct, true
+		return nil
+	}
+	watts, err := parseWatts(s)
+	if err != nil {
+		return fmt.Errorf("invalid change threshold %q: want a power such as 1.5W or a percentage such as 5%%", s)
+	}
+	c.value, c.percent = watts, false
+	return nil
+}
+
+// exceeded reports whether watts differs from last by more than the
+// threshold.
+func (c changeThresholdFlag) exceeded(last, watts float64) bool {
+	limit := c.value
+	if c.percent {
+		limit = math.Abs(last) * c.value / 100
+	}
+	return math.Abs(watts-last) > limit
+}
+
+// changeFilter picks the readings --only-changes emits: a device's first
+// reading, one whose power moved past the threshold since the last
+// emitted, one that fails or recovers, and, with a heartbeat, any reading
+// once the last emission is that old. A nil changeFilter emits every
+// reading.
+type changeFilter struct {
+	threshold changeThresholdFlag
+	heartbeat time.Duration
+
+	mu   sync.Mutex
+	last map[string]emission
+}
+
+// emission is the last reading emitted for a device.
+type emission struct {
+	watts  float64
+	failed bool
+	at     time.Time
+}
+
+func newChangeFilter(threshold changeThresholdFlag, heartbeat time.Duration) *changeFilter {
+	return &changeFilter{threshold: threshold, heartbeat: heartbeat, last: make(map[string]emission)}
+}
+
+// allow reports whether r is emitted, remembering it if so.
+func (f *changeFilter) allow(r collector.Reading) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.Device.Key()
+	failed := r.Power == nil
+	prev, ok := f.last[key]
+	switch {
+	case !ok || failed != prev.failed:
+	case f.heartbeat > 0 && r.Time.Sub(prev.at) >= f.heartbeat:
+	case failed || !f.threshold.exceeded(prev.watts, r.Power.CurrentWatts):
+		return false
+	}
+	e := emission{failed: failed, at: r.Time}
+	if !failed {
+		e.watts = r.Power.CurrentWatts
+	}
+	f.last[key] = e
+	return true
+}
+
+// emitted reports whether r is the reading last emitted for its device,
+// so that a cycle's batch holds only the readings allow let through.
+func (f *changeFilter) emitted(r collector.Reading) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.last[r.Device.Key()]
+	return ok && e.at.Equal(r.Time)
+}
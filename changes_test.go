@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestChangeThresholdFlag(t *testing.T) {
+	var c changeThresholdFlag
+	if err := c.Set("1.5W"); err != nil || c.value != 1.5 || c.percent || c.String() != "1.5W" {
+		t.Fatalf("expected an absolute threshold, got %+v (%v)", c, err)
+	}
+	if err := c.Set("5%"); err != nil || c.value != 5 || !c.percent || c.String() != "5%" {
+		t.Fatalf("expected a relative threshold, got %+v (%v)", c, err)
+	}
+	for _, bad := range []string{"lots", "-5%", "%"} {
+		if err := c.Set(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestChangeFilterEmitsChanges(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	lamp := collector.Device{Instance: "Lamp", HostName: "lamp.local"}
+	reading := func(at time.Duration, watts float64) collector.Reading {
+		return collector.Reading{Device: lamp, Time: start.Add(at), Power: &collector.PowerInfo{CurrentWatts: watts}}
+	}
+	failure := func(at time.Duration) collector.Reading {
+		return collector.Reading{Device: lamp, Time: start.Add(at), Err: errors.New("timeout")}
+	}
+
+	f := newChangeFilter(changeThresholdFlag{value: 1.5}, time.Minute)
+	for i, tt := range []struct {
+		r    collector.Reading
+		want bool
+	}{
+		{reading(0, 100), true},
+		{reading(10*time.Second, 101), false},
+		// Compared with the last reading emitted, not the last one seen.
+		{reading(20*time.Second, 101.6), true},
+		{failure(30 * time.Second), true},
+		{failure(40 * time.Second), false},
+		{reading(50*time.Second, 101.6), true},
+		{reading(time.Minute, 101.6), false},
+		{reading(110*time.Second, 101.6), true},
+	} {
+		if got := f.allow(tt.r); got != tt.want {
+			t.Fatalf("reading %d: expected emitted=%v, got %v", i, tt.want, got)
+		}
+		if f.emitted(tt.r) != tt.want {
+			t.Fatalf("reading %d: expected emitted to agree with allow", i)
+		}
+	}
+
+	pct := newChangeFilter(changeThresholdFlag{value: 5, percent: true}, 0)
+	for i, tt := range []struct {
+		r    collector.Reading
+		want bool
+	}{
+		{reading(0, 1000), true},
+		{reading(time.Hour, 1040), false},
+		{reading(2*time.Hour, 1051), true},
+	} {
+		if got := pct.allow(tt.r); got != tt.want {
+			t.Fatalf("percentage reading %d: expected emitted=%v, got %v", i, tt.want, got)
+		}
+	}
+
+	var none *changeFilter
+	if !none.allow(reading(0, 1)) || !none.emitted(reading(0, 1)) {
+		t.Fatal("expected a nil filter to emit everything")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Default power thresholds of --color-warn-watts and --color-high-watts.
+const (
+	defaultColorWarnWatts = 1000
+	defaultColorHighWatts = 2000
+)
+
+// ANSI select graphic rendition codes used in text output.
+const (
+	ansiRed    = "31"
+	ansiYellow = "33"
+	ansiDim    = "2"
+)
+
+// palette colors human-readable output. The zero palette adds no escape
+// codes, which is what every machine-readable format uses.
+type palette struct {
+	enabled bool
+	// warnWatts and highWatts, when positive, are the readings shown in
+	// yellow and red.
+	warnWatts float64
+	highWatts float64
+	// minFirmware, when set, is the oldest firmware not flagged as
+	// outdated.
+	minFirmware string
+}
+
+// newPalette returns the palette for text written to w: colored only when
+// w is a terminal and neither --no-color nor NO_COLOR is set.
+func newPalette(o options, w io.Writer) palette {
+	return palette{
+		enabled:     !o.noColor && os.Getenv("NO_COLOR") == "" && isTerminal(w),
+		warnWatts:   o.colorWarnWatts,
+		highWatts:   o.colorHighWatts,
+		minFirmware: o.minFirmware,
+	}
+}
+
+// paint wraps s in the SGR code when the palette is enabled.
+func (p palette) paint(code, s string) string {
+	if !p.enabled || code == "" || s == "" {
+		return s
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+// wattsColor returns the code a reading of watts is shown in.
+func (p palette) wattsColor(watts float64) string {
+	switch {
+	case p.highWatts > 0 && watts >= p.highWatts:
+		return ansiRed
+	case p.warnWatts > 0 && watts >= p.warnWatts:
+		return ansiYellow
+	}
+	return ""
+}
+
+// firmware returns fw, marked when it is older than minFirmware, and the
+// code it is shown in.
+func (p palette) firmware(fw string) (string, string) {
+	if p.minFirmware == "" || fw == "" || compareVersions(fw, p.minFirmware) >= 0 {
+		return fw, ""
+	}
+	return fw + " (outdated)", ansiYellow
+}
+
+// deviceFirmware returns r's firmware like firmware, but marked against
+// the version --expected-firmware expects of it when there is one.
+func (p palette) deviceFirmware(r deviceResult) (string, string) {
+	switch {
+	case r.Outdated:
+		return r.Firmware + " OUTDATED (expected " + r.ExpectedFirmware + ")", ansiYellow
+	case r.ExpectedFirmware != "":
+		return r.Firmware, ""
+	}
+	return p.firmware(r.Firmware)
+}
+
+// versionNumbers matches the numeric parts of a version string.
+var versionNumbers = regexp.MustCompile(`\d+`)
+
+// compareVersions compares two firmware versions by their numeric parts,
+// so 1.10 is newer than 1.9 and v2.0-beta equals 2.0. A version that is a
+// prefix of the other is older.
+func compareVersions(a, b string) int {
+	as, bs := versionNumbers.FindAllString(a, -1), versionNumbers.FindAllString(b, -1)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, errX := strconv.ParseUint(as[i], 10, 64)
+		y, errY := strconv.ParseUint(bs[i], 10, 64)
+		if errX != nil || errY != nil {
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// cell is a table cell and the code it is shown in.
+type cell struct {
+	text  string
+	color string
+}
+
+// writeTable writes rows under header, each column padded to its widest
+// cell plus two spaces, except the last. Padding is computed from the
+// text alone, so colored cells stay aligned.
+func (p palette) writeTable(w io.Writer, header []string, rows [][]cell) {
+	widths := make([]int, len(header))
+	for i, h := range header {
+		widths[i] = utf8.RuneCountInString(h)
+	}
+	for _, row := range rows {
+		for i, c := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(c.text))
+		}
+	}
+
+	var b strings.Builder
+	line := func(cells []cell) {
+		for i, c := range cells {
+			b.WriteString(p.paint(c.color, c.text))
+			if i < len(cells)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c.text)+2))
+			}
+		}
+		b.WriteByte('\n')
+	}
+	heading := make([]cell, len(header))
+	for i, h := range header {
+		heading[i] = cell{text: h}
+	}
+	line(heading)
+	for _, row := range rows {
+		line(row)
+	}
+	io.WriteString(w, b.String())
+}
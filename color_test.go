@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.9", "1.10", -1},
+		{"v2.0-beta", "2.0", 0},
+		{"1.2", "1.2.1", -1},
+		{"20240101-1200/v1.14.0", "20230913-112003/v1.14.0", 1},
+		{"2.1", "10", -1},
+	} {
+		if got := compareVersions(c.a, c.b); got != c.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestPaletteColorsOnlyWhenEnabled(t *testing.T) {
+	pal := palette{warnWatts: 1000, highWatts: 2000, minFirmware: "1.4"}
+	if got := pal.paint(pal.wattsColor(2500), "2500 W"); got != "2500 W" {
+		t.Fatalf("expected a disabled palette to add no escape codes, got %q", got)
+	}
+
+	pal.enabled = true
+	for watts, want := range map[float64]string{10: "10 W", 1000: "\x1b[33m1000 W\x1b[0m", 2000: "\x1b[31m2000 W\x1b[0m"} {
+		if got := pal.paint(pal.wattsColor(watts), formatFloat(watts)+" W"); got != want {
+			t.Errorf("%v W: got %q, want %q", watts, got, want)
+		}
+	}
+	if fw, color := pal.firmware("1.3.9"); fw != "1.3.9 (outdated)" || color != ansiYellow {
+		t.Fatalf("expected old firmware to be flagged, got %q %q", fw, color)
+	}
+	if fw, color := pal.firmware("1.4.0"); fw != "1.4.0" || color != "" {
+		t.Fatalf("expected current firmware to be plain, got %q %q", fw, color)
+	}
+}
+
+func TestNewPaletteHonorsNoColor(t *testing.T) {
+	opts := defaultOptions()
+	t.Setenv("NO_COLOR", "")
+	if newPalette(opts, &bytes.Buffer{}).enabled {
+		t.Fatal("expected no color for a writer that is not a terminal")
+	}
+	opts.noColor = true
+	if pal := newPalette(opts, &bytes.Buffer{}); pal.enabled || pal.warnWatts != defaultColorWarnWatts || pal.highWatts != defaultColorHighWatts {
+		t.Fatalf("unexpected palette %+v", pal)
+	}
+}
+
+func TestWriteTableAlignsColoredCells(t *testing.T) {
+	var buf bytes.Buffer
+	pal := palette{enabled: true}
+	pal.writeTable(&buf, []string{"DEVICE", "WATTS", "TREND"}, [][]cell{
+		{{text: "Kettle"}, {"2000.00", ansiRed}, {text: "↑"}},
+		{{text: "A lamp with a long name"}, {text: "5.00"}, {text: ""}},
+	})
+	want := "DEVICE                   WATTS    TREND\n" +
+		"Kettle                   \x1b[31m2000.00\x1b[0m  ↑\n" +
+		"A lamp with a long name  5.00     \n"
+	if buf.String() != want {
+		t.Fatalf("unexpected table:\n%q\nwant:\n%q", buf.String(), want)
+	}
+}
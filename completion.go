@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// completionCommand is the subcommand that prints a shell completion
+// script.
+const completionCommand = "completion"
+
+// completionShells are the shells completionCommand supports.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// subcommands are completed in place of the first argument.
+var subcommands = []string{completionCommand, mockCommand, replayJSONLCommand, discoverCommand, collectCommand}
+
+// fileFlags take a path, so that shells complete file names for them.
+var fileFlags = map[string]bool{
+	"config": true, "devices": true, "output": true, "state": true, "cache": true, "sqlite": true, "jsonl": true, "spool-dir": true,
+	"record": true, "replay": true, "report": true, "expected-firmware": true, "vendor-db": true, "ca-cert": true, "mqtt-ca-cert": true, "otlp-ca-cert": true,
+}
+
+// flagChoices returns the values completed for the flags that take one of
+// a fixed set.
+func flagChoices() map[string][]string {
+	anomalyModes := make([]string, len(collector.AnomalyModes))
+	for i, m := range collector.AnomalyModes {
+		anomalyModes[i] = string(m)
+	}
+	return map[string][]string{
+		"format":        outputFormats,
+		"driver":        append([]string{"auto"}, collector.DriverNames()...),
+		"sort":          watchSorts,
+		"log-level":     {"debug", "info", "warn", "error"},
+		"log-format":    {logFormatText, logFormatJSON},
+		"statsd-format": {statsdFormatDog, statsdFormatPlain},
+		"anomaly-mode":  anomalyModes,
+		"scheme":        {"http", "https"},
+		"connect-by":    {connectByIP, connectByHostName},
+		"time-format":   {timeFormatRFC3339, timeFormatUnix, timeFormatUnixMs},
+	}
+}
+
+func completionMain(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(stderr, "usage: %s %s %s\n", os.Args[0], completionCommand, strings.Join(completionShells, "|"))
+		return exitSetup
+	}
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	registerFlags(fs, new(options))
+	if err := writeCompletion(stdout, args[0], fs); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitSetup
+	}
+	return exitOK
+}
+
+// writeCompletion writes the completion script of the given shell for
+// the flags of fs, named after the program fs is named for.
+func writeCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, fs)
+	case "zsh":
+		writeZshCompletion(w, fs)
+	case "fish":
+		writeFishCompletion(w, fs)
+	default:
+		return fmt.Errorf("unsupported shell %q: want %s", shell, strings.Join(completionShells, ", "))
+	}
+	return nil
+}
+
+// isBoolFlag reports whether f takes no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// completionFunc returns the shell function name for the program name.
+func completionFunc(name string) string {
+	return "_" + strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func writeBashCompletion(w io.Writer, fs *flag.FlagSet) {
+	choices := flagChoices()
+	var flags []string
+	fmt.Fprintf(w, "# bash completion for %s\n", fs.Name())
+	fmt.Fprintf(w, "%s() {\n", completionFunc(fs.Name()))
+	fmt.Fprint(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprint(w, "\tcase \"$prev\" in\n")
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "--"+f.Name)
+		switch {
+		case choices[f.Name] != nil:
+			fmt.Fprintf(w, "\t--%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", f.Name, strings.Join(choices[f.Name], " "))
+		case fileFlags[f.Name]:
+			fmt.Fprintf(w, "\t--%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", f.Name)
+		case !isBoolFlag(f):
+			fmt.Fprintf(w, "\t--%s) COMPREPLY=(); return ;;\n", f.Name)
+		}
+	})
+	fmt.Fprint(w, "\tesac\n")
+	fmt.Fprintf(w, "\tif [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then\n\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(subcommands, " "))
+	fmt.Fprintf(w, "\tif [[ ${COMP_WORDS[1]} == %s ]]; then\n\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n\t\treturn\n\tfi\n", completionCommand, strings.Join(completionShells, " "))
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(flags, " "))
+	fmt.Fprint(w, "}\n")
+	fmt.Fprintf(w, "complete -F %s %s\n", completionFunc(fs.Name()), fs.Name())
+}
+
+func writeZshCompletion(w io.Writer, fs *flag.FlagSet) {
+	choices := flagChoices()
+	escape := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`)
+	specs := []string{fmt.Sprintf("1::command:(%s)", strings.Join(subcommands, " "))}
+	fs.VisitAll(func(f *flag.Flag) {
+		_, help := flag.UnquoteUsage(f)
+		spec := fmt.Sprintf("--%s[%s]", f.Name, escape.Replace(help))
+		switch {
+		case choices[f.Name] != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(choices[f.Name], " "))
+		case fileFlags[f.Name]:
+			spec += fmt.Sprintf(":%s:_files", f.Name)
+		case !isBoolFlag(f):
+			spec += fmt.Sprintf(":%s: ", f.Name)
+		}
+		specs = append(specs, spec)
+	})
+	fmt.Fprintf(w, "#compdef %s\n\n_arguments \\\n\t'%s'\n", fs.Name(), strings.Join(specs, "' \\\n\t'"))
+}
+
+func writeFishCompletion(w io.Writer, fs *flag.FlagSet) {
+	choices := flagChoices()
+	escape := strings.NewReplacer(`\`, `\\`, "'", `\'`)
+	name := fs.Name()
+	fmt.Fprintf(w, "# fish completion for %s\n", name)
+	fmt.Fprintf(w, "complete -c %s -f\n", name)
+	fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a '%s'\n", name, strings.Join(subcommands, " "))
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s' -a '%s'\n", name, completionCommand, strings.Join(completionShells, " "))
+	fs.VisitAll(func(f *flag.Flag) {
+		_, help := flag.UnquoteUsage(f)
+		line := fmt.Sprintf("complete -c %s -l %s -d '%s'", name, f.Name, escape.Replace(help))
+		switch {
+		case choices[f.Name] != nil:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(choices[f.Name], " "))
+		case fileFlags[f.Name]:
+			line += " -r -F"
+		case !isBoolFlag(f):
+			line += " -x"
+		}
+		fmt.Fprintln(w, line)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestCompletionsCoverEveryFlag(t *testing.T) {
+	fs := flag.NewFlagSet("powercollector", flag.ContinueOnError)
+	registerFlags(fs, new(options))
+	for _, shell := range completionShells {
+		var buf bytes.Buffer
+		if err := writeCompletion(&buf, shell, fs); err != nil {
+			t.Fatalf("%s: %v", shell, err)
+		}
+		script := buf.String()
+		fs.VisitAll(func(f *flag.Flag) {
+			want := "--" + f.Name
+			if shell == "fish" {
+				want = "-l " + f.Name + " "
+			}
+			if !strings.Contains(script, want) {
+				t.Errorf("%s: expected %q in the completion script", shell, want)
+			}
+		})
+		for _, want := range []string{"json csv influx", "debug info warn error", "completion serve-mock"} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s: expected the values %q in the completion script", shell, want)
+			}
+		}
+	}
+}
+
+func TestCompletionRejectsUnknownShell(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if got := completionMain([]string{"ksh"}, &stdout, &stderr); got != exitSetup || !strings.Contains(stderr.String(), "unsupported shell") {
+		t.Fatalf("expected exit status %d for an unknown shell, got %d (%q)", exitSetup, got, stderr.String())
+	}
+	if got := completionMain([]string{"bash"}, &stdout, &stderr); got != exitOK || !strings.Contains(stdout.String(), "complete -F") {
+		t.Fatalf("expected a bash script, got %d (%q)", got, stdout.String())
+	}
+}
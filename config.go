@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variable for each flag, e.g.
+// POWERCOLLECTOR_MQTT_BROKER for --mqtt-broker.
+const envPrefix = "POWERCOLLECTOR_"
+
+// configDevicesKey is the config file key holding the static device list.
+// A scalar value instead sets the --devices file path.
+const configDevicesKey = "devices"
+
+// configAlertsKey is the config file key holding per-device alert rules,
+// keyed by device name (the alias, for devices that have one).
+const configAlertsKey = "alerts"
+
+// configAliasesKey is the config file key holding device display names,
+// keyed by instance name, host name or MAC address.
+const configAliasesKey = "aliases"
+
+// configTariffScheduleKey is the config file key holding the time-of-use
+// periods that override the --tariff rate.
+const configTariffScheduleKey = "tariff-schedule"
+
+// configOnlyFlags are flags that cannot themselves be set from a config file.
+var configOnlyFlags = map[string]bool{"config": true, "print-config": true, "print-unaliased": true, "version": true}
+
+// repeatableFlags take several values from one environment variable, one
+// per line, since their values may themselves hold commas.
+var repeatableFlags = map[string]bool{"service": true, "interface": true, "webhook-header": true, "scan-cidr": true}
+
+// secretFlags are redacted by --print-config.
+var secretFlags = map[string]bool{"influx-token": true, "mqtt-password": true, "http-pass": true, "http-token": true, "otlp-headers": true, "webhook-header": true, "ingest-token": true}
+
+// config holds the settings read from a --config file. Keys are flag names.
+type config struct {
+	values  map[string]string
+	devices []staticDevice
+	alerts  map[string]alertRuleConfig
+	aliases map[string]string
+	// tariffSchedule is the time-of-use part of the tariff.
+	tariffSchedule []tariffPeriodConfig
+}
+
+// envName returns the environment variable that sets the named flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig reads the YAML config file at path. Keys must name flags in
+// fs; unknown keys are reported on warn and ignored. A .toml file is
+// refused rather than misread as YAML.
+func loadConfig(path string, fs *flag.FlagSet, warn io.Writer) (*config, error) {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return nil, fmt.Errorf("config %s: TOML is not supported, use YAML", path)
+	}
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var doc map[string]yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	cfg := &config{values: make(map[string]string)}
+	for key, node := range doc {
+		if key == configDevicesKey && node.Kind == yaml.SequenceNode {
+			if err := node.Decode(&cfg.devices); err != nil {
+				return nil, fmt.Errorf("config %s: devices: %w", path, err)
+			}
+			continue
+		}
+		if key == configAlertsKey {
+			if err := node.Decode(&cfg.alerts); err != nil {
+				return nil, fmt.Errorf("config %s: alerts: %w", path, err)
+			}
+			continue
+		}
+		if key == configAliasesKey {
+			if err := node.Decode(&cfg.aliases); err != nil {
+				return nil, fmt.Errorf("config %s: aliases: %w", path, err)
+			}
+			continue
+		}
+		if key == configTariffScheduleKey {
+			if err := node.Decode(&cfg.tariffSchedule); err != nil {
+				return nil, fmt.Errorf("config %s: tariff-schedule: %w", path, err)
+			}
+			continue
+		}
+		if fs.Lookup(key) == nil || configOnlyFlags[key] {
+			fmt.Fprintf(warn, "config %s: ignoring unknown key %q\n", path, key)
+			continue
+		}
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("config %s: %s must be a single value", path, key)
+		}
+		cfg.values[key] = node.Value
+	}
+	return cfg, nil
+}
+
+// applySettings fills in every flag not given on the command line from its
+// environment variable, then from cfg, so that flags take precedence over
+// the environment, which takes precedence over the config file. It returns
+// the flags set from the environment.
+func applySettings(fs *flag.FlagSet, cfg *config, getenv func(string) string) (fromEnv []string, err error) {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || configOnlyFlags[f.Name] {
+			return
+		}
+		if v := getenv(envName(f.Name)); v != "" {
+			if setErr := setFromEnv(fs, f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+				return
+			}
+			fromEnv = append(fromEnv, f.Name)
+			return
+		}
+		if cfg == nil {
+			return
+		}
+		if v, ok := cfg.values[f.Name]; ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("config key %s: %w", f.Name, setErr)
+			}
+		}
+	})
+	return fromEnv, err
+}
+
+// setFromEnv sets the named flag from the value of its environment
+// variable, once per line for a repeatable flag.
+func setFromEnv(fs *flag.FlagSet, name, value string) error {
+	if !repeatableFlags[name] {
+		return fs.Set(name, value)
+	}
+	for line := range strings.Lines(value) {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := fs.Set(name, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alertRules parses the per-device alert rules in cfg.
+func (cfg *config) alertRules() (map[string]alertRule, error) {
+	rules := make(map[string]alertRule, len(cfg.alerts))
+	for name, rc := range cfg.alerts {
+		rule, err := rc.rule()
+		if err != nil {
+			return nil, fmt.Errorf("config alerts: %s: %w", name, err)
+		}
+		rules[name] = rule
+	}
+	return rules, nil
+}
+
+// writeConfig prints the effective configuration for --print-config,
+// including the devices from the --devices file, headed by a comment naming
+// the environment variables that set any of it.
+func writeConfig(w io.Writer, fs *flag.FlagSet, opts options) error {
+	var devices []staticDevice
+	var alerts map[string]alertRuleConfig
+	var aliases map[string]string
+	var schedule []tariffPeriodConfig
+	if opts.cfg != nil {
+		devices = opts.cfg.devices
+		alerts = opts.cfg.alerts
+		aliases = opts.cfg.aliases
+		schedule = opts.cfg.tariffSchedule
+	}
+	if opts.devicesPath != "" {
+		fileDevices, err := readDevicesFile(opts.devicesPath)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, fileDevices...)
+	}
+	if len(opts.fromEnv) > 0 {
+		fmt.Fprintln(w, "# Set from the environment:")
+		for _, name := range opts.fromEnv {
+			fmt.Fprintf(w, "#   %s (%s)\n", envName(name), name)
+		}
+	}
+	return printConfig(w, fs, devices, alerts, aliases, schedule)
+}
+
+// printConfig writes the effective settings of fs, the static devices, the
+// per-device alert rules, the device aliases and the tariff schedule as a
+// YAML config file. Each device shows the settings that apply to it, from
+// its own entry or the flags. Secrets are redacted.
+// When devices is non-empty it replaces the --devices path, whose entries
+// the caller should include.
+func printConfig(w io.Writer, fs *flag.FlagSet, devices []staticDevice, alerts map[string]alertRuleConfig, aliases map[string]string, schedule []tariffPeriodConfig) error {
+	settings := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if configOnlyFlags[f.Name] || (f.Name == configDevicesKey && len(devices) > 0) {
+			return
+		}
+		var v any = f.Value.String()
+		if g, ok := f.Value.(flag.Getter); ok {
+			v = g.Get()
+		}
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		if secretFlags[f.Name] && f.Value.String() != "" {
+			v = "<redacted>"
+		}
+		settings[f.Name] = v
+	})
+	if len(devices) > 0 {
+		redacted := make([]staticDevice, len(devices))
+		for i, d := range devices {
+			redacted[i] = d.effective(fs).redacted()
+		}
+		settings[configDevicesKey] = redacted
+	}
+	if len(alerts) > 0 {
+		settings[configAlertsKey] = alerts
+	}
+	if len(aliases) > 0 {
+		settings[configAliasesKey] = aliases
+	}
+	if len(schedule) > 0 {
+		settings[configTariffScheduleKey] = schedule
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFlagSet(opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.DurationVar(&opts.browseTimeout, "timeout", 15*time.Second, "")
+	fs.DurationVar(&opts.interval, "interval", 0, "")
+	fs.StringVar(&opts.format, "format", formatText, "")
+	fs.StringVar(&opts.mqttPassword, "mqtt-password", "", "")
+	fs.StringVar(&opts.devicesPath, "devices", "", "")
+	return fs
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	var opts options
+	fs := testFlagSet(&opts)
+	if err := fs.Parse([]string{"--format", "csv"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeFile(t, "config.yaml", "timeout: 20s\ninterval: 1m\nformat: json\nlisten: :9109\n")
+	var warn bytes.Buffer
+	cfg, err := loadConfig(path, fs, &warn)
+	if err != nil {
+		t.Fatalf("expected config to load, got %v", err)
+	}
+	if !strings.Contains(warn.String(), `unknown key "listen"`) {
+		t.Fatalf("expected unknown key warning, got %q", warn.String())
+	}
+
+	env := map[string]string{"POWERCOLLECTOR_INTERVAL": "2m", "POWERCOLLECTOR_FORMAT": "influx"}
+	fromEnv, err := applySettings(fs, cfg, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("expected settings to apply, got %v", err)
+	}
+	if !slices.Equal(fromEnv, []string{"interval"}) {
+		t.Fatalf("expected only the interval to come from the environment, got %v", fromEnv)
+	}
+
+	if opts.format != formatCSV {
+		t.Fatalf("expected flag to beat environment, got format %q", opts.format)
+	}
+	if opts.interval != 2*time.Minute {
+		t.Fatalf("expected environment to beat config, got interval %s", opts.interval)
+	}
+	if opts.browseTimeout != 20*time.Second {
+		t.Fatalf("expected config to beat default, got timeout %s", opts.browseTimeout)
+	}
+}
+
+func TestApplySettingsReportsBadValues(t *testing.T) {
+	var opts options
+	fs := testFlagSet(&opts)
+	cfg := &config{values: map[string]string{"timeout": "soon"}}
+	if _, err := applySettings(fs, cfg, func(string) string { return "" }); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected error naming the key, got %v", err)
+	}
+}
+
+func TestApplySettingsFromEnvironment(t *testing.T) {
+	var opts options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs, &opts)
+	env := map[string]string{
+		"POWERCOLLECTOR_INTERVAL":       "30s",
+		"POWERCOLLECTOR_LIST":           "true",
+		"POWERCOLLECTOR_WEBHOOK_HEADER": "Authorization: Bearer a,b\nX-Site: home\n",
+		"POWERCOLLECTOR_SCAN_CIDR":      "10.0.0.0/30,10.0.1.0/30",
+	}
+	if _, err := applySettings(fs, nil, func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("expected the environment to apply, got %v", err)
+	}
+	if opts.interval != 30*time.Second || !opts.listOnly {
+		t.Fatalf("expected the interval and --list from the environment, got %s and %v", opts.interval, opts.listOnly)
+	}
+	if !slices.Equal(opts.webhookHeaders, headerFlag{"Authorization: Bearer a,b", "X-Site: home"}) {
+		t.Fatalf("expected one header per line, got %q", opts.webhookHeaders)
+	}
+	if len(opts.scanCIDRs) != 2 {
+		t.Fatalf("expected both subnets, got %v", opts.scanCIDRs)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs, &opts)
+	env = map[string]string{"POWERCOLLECTOR_INTERVAL": "often"}
+	if _, err := applySettings(fs, nil, func(k string) string { return env[k] }); err == nil || !strings.Contains(err.Error(), "POWERCOLLECTOR_INTERVAL") {
+		t.Fatalf("expected an error naming the variable, got %v", err)
+	}
+}
+
+func TestWriteConfigNamesEnvironment(t *testing.T) {
+	var opts options
+	fs := testFlagSet(&opts)
+	opts.fromEnv = []string{"interval"}
+	var buf bytes.Buffer
+	if err := writeConfig(&buf, fs, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "# Set from the environment:\n#   POWERCOLLECTOR_INTERVAL (interval)\n") {
+		t.Fatalf("expected the environment to be named, got:\n%s", buf.String())
+	}
+}
+
+func TestLoadConfigDevices(t *testing.T) {
+	var opts options
+	fs := testFlagSet(&opts)
+
+	cfg, err := loadConfig(writeFile(t, "config.yaml", "devices:\n  - name: Garage\n    address: 10.0.0.5\n"), fs, &bytes.Buffer{})
+	if err != nil || len(cfg.devices) != 1 || cfg.devices[0].Name != "Garage" {
+		t.Fatalf("expected inline device list, got %+v (%v)", cfg, err)
+	}
+
+	cfg, err = loadConfig(writeFile(t, "config.yaml", "devices: /etc/devices.yaml\n"), fs, &bytes.Buffer{})
+	if err != nil || cfg.values["devices"] != "/etc/devices.yaml" {
+		t.Fatalf("expected devices file path, got %+v (%v)", cfg, err)
+	}
+}
+
+func TestLoadConfigRejectsTOML(t *testing.T) {
+	var opts options
+	_, err := loadConfig(writeFile(t, "config.toml", "interval = \"30s\"\n"), testFlagSet(&opts), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "TOML is not supported") {
+		t.Fatalf("expected TOML to be refused, got %v", err)
+	}
+}
+
+func TestLoadConfigTariffSchedule(t *testing.T) {
+	var opts options
+	fs := testFlagSet(&opts)
+
+	cfg, err := loadConfig(writeFile(t, "config.yaml", "tariff-schedule:\n  - from: \"23:00\"\n    to: \"07:00\"\n    rate: 0.18\n"), fs, &bytes.Buffer{})
+	if err != nil || len(cfg.tariffSchedule) != 1 {
+		t.Fatalf("expected a tariff schedule, got %+v (%v)", cfg, err)
+	}
+	if p := cfg.tariffSchedule[0]; p.From != "23:00" || p.To != "07:00" || p.Rate != 0.18 {
+		t.Fatalf("unexpected schedule entry %+v", p)
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	var opts options
+	fs := testFlagSet(&opts)
+	if err := fs.Parse([]string{"--mqtt-password", "hunter2", "--interval", "30s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := printConfig(&buf, fs, []staticDevice{{Name: "Garage", Address: "10.0.0.5", Username: "admin", Password: "hunter2"}}, nil, nil, nil); err != nil {
+		t.Fatalf("expected config to print, got %v", err)
+	}
+	got := buf.String()
+	for _, want := range []string{"interval: 30s", "mqtt-password: <redacted>", "- name: Garage", "username: admin", "password: <redacted>"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in printed config:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "hunter2") {
+		t.Fatalf("expected password to be redacted:\n%s", got)
+	}
+}
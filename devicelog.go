@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// maxDeviceEvents is how many of the latest device events GET
+// /device-events lists.
+const maxDeviceEvents = 100
+
+// The fields a deviceEvent reports a change of.
+const (
+	eventFirmware  = "firmware"
+	eventVendorID  = "vendorId"
+	eventProductID = "productId"
+	eventHostName  = "hostname"
+	eventTXT       = "txt"
+)
+
+// deviceEvent reports that a device announced a new value of one of its
+// identifying fields.
+type deviceEvent struct {
+	Type   string    `json:"type"`
+	Time   time.Time `json:"timestamp"`
+	Device string    `json:"device"`
+	Host   string    `json:"host,omitempty"`
+	Field  string    `json:"field"`
+	Before string    `json:"before"`
+	After  string    `json:"after"`
+}
+
+// eventSink is a sink that also delivers device events.
+type eventSink interface {
+	event(ctx context.Context, ev deviceEvent) error
+}
+
+// deviceIdentity is what a deviceLog compares of a device's announcements.
+// Empty fields are unknown.
+type deviceIdentity struct {
+	hostName  string
+	firmware  string
+	vendorID  int
+	productID int
+	// txt is the device's TXT records, sorted.
+	txt []string
+}
+
+func identityOf(d collector.Device) deviceIdentity {
+	txt := slices.Clone(d.Text)
+	slices.Sort(txt)
+	return deviceIdentity{hostName: d.HostName, firmware: d.Firmware, vendorID: d.Meta.VendorID, productID: d.Meta.ProductID, txt: txt}
+}
+
+// merge returns id updated with the fields next knows.
+func (id deviceIdentity) merge(next deviceIdentity) deviceIdentity {
+	if next.hostName != "" {
+		id.hostName = next.hostName
+	}
+	if next.firmware != "" {
+		id.firmware = next.firmware
+	}
+	if next.vendorID != 0 {
+		id.vendorID = next.vendorID
+	}
+	if next.productID != 0 {
+		id.productID = next.productID
+	}
+	if len(next.txt) > 0 {
+		id.txt = next.txt
+	}
+	return id
+}
+
+// changes returns the fields, with their values before and after, that
+// differ between id and next where both know them. A change to the TXT
+// records is only reported when it changes none of the other fields, as
+// it usually carries them.
+func (id deviceIdentity) changes(next deviceIdentity) [][3]string {
+	var changes [][3]string
+	diff := func(field, before, after string) {
+		if before != "" && after != "" && before != after {
+			changes = append(changes, [3]string{field, before, after})
+		}
+	}
+	hexID := func(v int) string {
+		if v == 0 {
+			return ""
+		}
+		return fmt.Sprintf("0x%04X", v)
+	}
+	diff(eventFirmware, id.firmware, next.firmware)
+	diff(eventVendorID, hexID(id.vendorID), hexID(next.vendorID))
+	diff(eventProductID, hexID(id.productID), hexID(next.productID))
+	diff(eventHostName, id.hostName, next.hostName)
+	if len(changes) == 0 {
+		diff(eventTXT, strings.Join(id.txt, " "), strings.Join(next.txt, " "))
+	}
+	return changes
+}
+
+// deviceLog notices when a discovered device announces a new firmware
+// version, vendor or product ID, host name or set of TXT records, keyed by
+// instance name so that a new host name is the same device. Each change is
+// logged, kept for GET /device-events and delivered to the sinks that take
+// events, in the background so discovery is never held up. Seeded from
+// the --cache file, it notices changes between runs too. A nil deviceLog
+// records nothing.
+type deviceLog struct {
+	sinks *sinkSet
+
+	mu    sync.Mutex
+	known map[string]deviceIdentity
+	// events holds the latest events, the oldest first.
+	events []deviceEvent
+	wg     sync.WaitGroup
+}
+
+func newDeviceLog(sinks *sinkSet) *deviceLog {
+	return &deviceLog{sinks: sinks, known: make(map[string]deviceIdentity), events: []deviceEvent{}}
+}
+
+// restore remembers devices, as announced in an earlier run, without
+// reporting them. Only the first of each instance counts, so devices
+// should come most recently seen first.
+func (l *deviceLog) restore(devices []collector.Device) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range devices {
+		if _, ok := l.known[d.Instance]; !ok {
+			l.known[d.Instance] = identityOf(d)
+		}
+	}
+}
+
+// seen compares d, announced at now, with the device's earlier
+// announcements and reports what changed.
+func (l *deviceLog) seen(ctx context.Context, d collector.Device, now time.Time) {
+	if l == nil {
+		return
+	}
+	next := identityOf(d)
+	l.mu.Lock()
+	was, ok := l.known[d.Instance]
+	l.known[d.Instance] = was.merge(next)
+	var events []deviceEvent
+	if ok {
+		for _, c := range was.changes(next) {
+			events = append(events, deviceEvent{Type: "device_changed", Time: now, Device: d.Instance, Host: d.HostName, Field: c[0], Before: c[1], After: c[2]})
+		}
+	}
+	l.events = append(l.events, events...)
+	if extra := len(l.events) - maxDeviceEvents; extra > 0 {
+		l.events = append(l.events[:0], l.events[extra:]...)
+	}
+	l.mu.Unlock()
+
+	for _, ev := range events {
+		slog.Info("device changed", "device", ev.Device, "host", ev.Host, "field", ev.Field, "before", ev.Before, "after", ev.After)
+	}
+	if len(events) == 0 || l.sinks == nil {
+		return
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		for _, ev := range events {
+			l.sinks.event(context.WithoutCancel(ctx), ev)
+		}
+	}()
+}
+
+// since returns the events after t, the oldest first; all of them when t
+// is zero.
+func (l *deviceLog) since(t time.Time) []deviceEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i, _ := slices.BinarySearchFunc(l.events, t, func(ev deviceEvent, t time.Time) int {
+		if ev.Time.After(t) {
+			return 1
+		}
+		return -1
+	})
+	return slices.Clone(l.events[i:])
+}
+
+// wait blocks until every pending delivery has finished.
+func (l *deviceLog) wait() {
+	if l != nil {
+		l.wg.Wait()
+	}
+}
+
+// deviceEvents serves GET /device-events, optionally only the events after
+// the RFC 3339 time in ?since=.
+func (a *api) deviceEvents(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid since: want an RFC 3339 time such as 2024-05-01T12:00:00Z"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, a.events.since(since))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/testsupport"
+	"powerusagecollection/pkg/collector"
+)
+
+func TestDeviceLogReportsChanges(t *testing.T) {
+	clock := testsupport.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	l := newDeviceLog(nil)
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local", Firmware: "1.0", Text: []string{"VP=4874+105", "SII=1000"}}
+	plug.Meta.VendorID, plug.Meta.ProductID = 0x130A, 0x0069
+	l.seen(context.Background(), plug, clock.Now())
+	if got := l.since(time.Time{}); len(got) != 0 {
+		t.Fatalf("expected no events for a new device, got %+v", got)
+	}
+
+	clock.Advance(time.Minute)
+	plug.Firmware, plug.HostName = "1.1", "plug-2.local"
+	plug.Meta.VendorID = 0x1234
+	l.seen(context.Background(), plug, clock.Now())
+	want := []deviceEvent{
+		{Type: "device_changed", Time: clock.Now(), Device: "Plug", Host: "plug-2.local", Field: eventFirmware, Before: "1.0", After: "1.1"},
+		{Type: "device_changed", Time: clock.Now(), Device: "Plug", Host: "plug-2.local", Field: eventVendorID, Before: "0x130A", After: "0x1234"},
+		{Type: "device_changed", Time: clock.Now(), Device: "Plug", Host: "plug-2.local", Field: eventHostName, Before: "plug.local", After: "plug-2.local"},
+	}
+	if got := l.since(time.Time{}); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	// An announcement that leaves a field out has not changed it, and TXT
+	// records are only reported when nothing else changed.
+	clock.Advance(time.Minute)
+	l.seen(context.Background(), collector.Device{Instance: "Plug"}, clock.Now())
+	plug.Text = []string{"SII=2000", "VP=4874+105"}
+	l.seen(context.Background(), plug, clock.Now())
+	got := l.since(want[0].Time)
+	if len(got) != 1 || got[0].Field != eventTXT || got[0].Before != "SII=1000 VP=4874+105" || got[0].After != "SII=2000 VP=4874+105" {
+		t.Fatalf("expected only the TXT change, got %+v", got)
+	}
+}
+
+func TestDeviceLogKeepsLatestEvents(t *testing.T) {
+	clock := testsupport.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	l := newDeviceLog(nil)
+	for i := range maxDeviceEvents + 5 {
+		l.seen(context.Background(), collector.Device{Instance: "Plug", Firmware: string(rune('a' + i%2))}, clock.Now())
+		clock.Advance(time.Second)
+	}
+	got := l.since(time.Time{})
+	if len(got) != maxDeviceEvents || got[0].Time != clock.Now().Add(-maxDeviceEvents*time.Second) {
+		t.Fatalf("expected the latest %d events, got %d from %v", maxDeviceEvents, len(got), got[0].Time)
+	}
+}
+
+func TestDeviceLogNoticesChangesBetweenRuns(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "cache.json")
+	cache := newDeviceCache(0)
+	cache.seen(collector.Device{Instance: "Plug", HostName: "plug.local", Firmware: "1.0"}, now)
+	if err := cache.save(path, now); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = newDeviceCache(0)
+	if err := cache.load(path, now); err != nil {
+		t.Fatal(err)
+	}
+	l := newDeviceLog(nil)
+	l.restore(cache.fresh(now))
+	l.seen(context.Background(), collector.Device{Instance: "Plug", HostName: "plug.local", Firmware: "2.0"}, now)
+	if got := l.since(time.Time{}); len(got) != 1 || got[0].Before != "1.0" || got[0].After != "2.0" {
+		t.Fatalf("expected the firmware update since the last run, got %+v", got)
+	}
+}
+
+func TestDeviceLogDeliversToSinks(t *testing.T) {
+	receiver := &batchReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	webhook, err := newWebhookSink(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := newFakePublisher()
+	mqtt := &mqttSink{topic: "power/{instance}", qos: 1, retain: true, dial: func(context.Context) (mqttPublisher, error) { return pub, nil }}
+	sinks := &sinkSet{}
+	sinks.add("webhook", webhook, feedChanges)
+	sinks.add("mqtt", mqtt, feedChanges)
+
+	l := newDeviceLog(sinks)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l.seen(context.Background(), collector.Device{Instance: "Plug", Firmware: "1.0"}, now)
+	l.seen(context.Background(), collector.Device{Instance: "Plug", Firmware: "1.1"}, now)
+	l.wait()
+
+	if len(receiver.batches) != 1 || len(receiver.batches[0].Events) != 1 || receiver.batches[0].Events[0].After != "1.1" {
+		t.Fatalf("expected the event posted to the webhook, got %+v", receiver.batches)
+	}
+	if len(pub.messages) != 1 {
+		t.Fatalf("expected the event published, got %+v", pub.messages)
+	}
+	var ev deviceEvent
+	if msg := pub.messages[0]; msg.Topic != "power/events" || msg.Retain || json.Unmarshal(msg.Payload, &ev) != nil || ev.Field != eventFirmware || ev.Before != "1.0" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+}
+
+func TestMQTTEventsTopic(t *testing.T) {
+	for topic, want := range map[string]string{
+		"power/{instance}":        "power/events",
+		"home/power/{host}/state": "home/power/events",
+		"{instance}":              "events",
+		"meters":                  "meters/events",
+	} {
+		if got := mqttEventsTopic(topic); got != want {
+			t.Errorf("expected %q for %q, got %q", want, topic, got)
+		}
+	}
+}
+
+func TestAPIServesDeviceEvents(t *testing.T) {
+	clock := testsupport.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	a := newAPI()
+	a.events = newDeviceLog(nil)
+	for _, fw := range []string{"1.0", "1.1", "1.2"} {
+		a.events.seen(context.Background(), collector.Device{Instance: "Plug", Firmware: fw}, clock.Now())
+		clock.Advance(time.Minute)
+	}
+	mux := http.NewServeMux()
+	a.register(mux)
+
+	get := func(query string) (int, []deviceEvent) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/device-events"+query, nil))
+		var events []deviceEvent
+		json.Unmarshal(rec.Body.Bytes(), &events)
+		return rec.Code, events
+	}
+	if code, events := get(""); code != http.StatusOK || len(events) != 2 {
+		t.Fatalf("expected every event, got %d %+v", code, events)
+	}
+	since := clock.Now().Add(-2 * time.Minute).Format(time.RFC3339)
+	if code, events := get("?since=" + url.QueryEscape(since)); code != http.StatusOK || len(events) != 1 || events[0].After != "1.2" {
+		t.Fatalf("expected the events after %s, got %d %+v", since, code, events)
+	}
+	if code, _ := get("?since=yesterday"); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid since rejected, got %d", code)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// staticDevice is a device listed in the --devices file.
+type staticDevice struct {
+	Name    string `yaml:"name" json:"name"`
+	Address string `yaml:"address" json:"address"`
+	// HostName is the device's mDNS host name, when it has one besides
+	// its address.
+	HostName string `yaml:"hostname,omitempty" json:"hostname,omitempty"`
+	Port     int    `yaml:"port,omitempty" json:"port,omitempty"`
+	Path     string `yaml:"path,omitempty" json:"path,omitempty"`
+	Driver   string `yaml:"driver,omitempty" json:"driver,omitempty"`
+	// Platform hints at the device's firmware, as its TXT records would,
+	// such as esphome.
+	Platform string `yaml:"platform,omitempty" json:"platform,omitempty"`
+	// Group is the group, such as a room, the device is reported under.
+	Group string `yaml:"group,omitempty" json:"group,omitempty"`
+	// Unit is the unit the device reports power in, mW, W or kW, when
+	// not watts.
+	Unit string `yaml:"unit,omitempty" json:"unit,omitempty"`
+	// Channels lists the meter channels queried separately, such as
+	// [0, 1] for a dual-relay plug.
+	Channels []string `yaml:"channels,omitempty" json:"channels,omitempty"`
+	// Username, Password and Token override the --http-* credentials.
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+	Token    string `yaml:"token,omitempty" json:"token,omitempty"`
+	// Timeout and Retries override --http-timeout and --retries, for
+	// devices on a slow or flaky link.
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Retries *int   `yaml:"retries,omitempty" json:"retries,omitempty"`
+	// Bidirectional marks a device that reports export as negative power,
+	// such as a meter behind a solar inverter.
+	Bidirectional bool `yaml:"bidirectional,omitempty" json:"bidirectional,omitempty"`
+	// Disabled devices are listed but never queried.
+	Disabled bool `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+}
+
+// devicesFile is the layout of the --devices file.
+type devicesFile struct {
+	Devices []staticDevice `yaml:"devices" json:"devices"`
+}
+
+// loadDevices reads the statically configured devices from the YAML file at
+// path.
+func loadDevices(path string) ([]collector.Device, error) {
+	list, err := readDevicesFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return staticDevices(list, "devices file "+path)
+}
+
+// stdinPath names standard input in place of a devices file.
+const stdinPath = "-"
+
+// readStdin reads standard input once, so that a reload finds the same
+// devices.
+var readStdin = sync.OnceValues(func() ([]byte, error) { return io.ReadAll(os.Stdin) })
+
+// readDevicesFile parses the YAML file at path, or standard input for
+// stdinPath, without validating entries. JSON, as written by the discover
+// command, is YAML too.
+func readDevicesFile(path string) ([]staticDevice, error) {
+	var data []byte
+	var err error
+	if path == stdinPath {
+		data, err = readStdin()
+	} else {
+		data, err = os.ReadFile(path) // #nosec G304 -- path comes from the operator
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read devices file: %w", err)
+	}
+
+	var file devicesFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse devices file %s: %w", path, err)
+	}
+
+	return file.Devices, nil
+}
+
+// staticDevices validates list and converts it to collector devices. source
+// names where the list came from in errors.
+func staticDevices(list []staticDevice, source string) ([]collector.Device, error) {
+	devices := make([]collector.Device, 0, len(list))
+	for i, sd := range list {
+		d, err := sd.device()
+		if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %w", source, i+1, err)
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// redacted returns sd with its secrets masked for --print-config.
+func (sd staticDevice) redacted() staticDevice {
+	if sd.Password != "" {
+		sd.Password = "<redacted>"
+	}
+	if sd.Token != "" {
+		sd.Token = "<redacted>"
+	}
+	return sd
+}
+
+// effective returns sd with the settings it leaves unset taken from the
+// flags in fs, as they apply to it.
+func (sd staticDevice) effective(fs *flag.FlagSet) staticDevice {
+	value := func(name string) string {
+		if f := fs.Lookup(name); f != nil {
+			return f.Value.String()
+		}
+		return ""
+	}
+	if sd.Timeout == "" {
+		sd.Timeout = value("http-timeout")
+	}
+	if sd.Retries == nil {
+		if n, err := strconv.Atoi(value("retries")); err == nil {
+			sd.Retries = &n
+		}
+	}
+	if sd.Path == "" {
+		sd.Path = value("power-path")
+	}
+	if sd.Driver == "" {
+		sd.Driver = value("driver")
+	}
+	return sd
+}
+
+// device validates sd and converts it to a collector.Device.
+func (sd staticDevice) device() (collector.Device, error) {
+	if sd.Name == "" {
+		return collector.Device{}, fmt.Errorf("name is required")
+	}
+	if sd.Address == "" {
+		return collector.Device{}, fmt.Errorf("%s: address is required", sd.Name)
+	}
+	if sd.Port < 0 || sd.Port > 65535 {
+		return collector.Device{}, fmt.Errorf("%s: invalid port %d", sd.Name, sd.Port)
+	}
+	if sd.Driver != "" && sd.Driver != "auto" {
+		if _, err := collector.LookupDriver(sd.Driver); err != nil {
+			return collector.Device{}, fmt.Errorf("%s: %w", sd.Name, err)
+		}
+	}
+
+	var timeout time.Duration
+	if sd.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(sd.Timeout); err != nil || timeout <= 0 {
+			return collector.Device{}, fmt.Errorf("%s: invalid timeout %q", sd.Name, sd.Timeout)
+		}
+	}
+	if sd.Retries != nil && *sd.Retries < 0 {
+		return collector.Device{}, fmt.Errorf("%s: retries must not be negative", sd.Name)
+	}
+	if sd.Unit != "" {
+		if _, err := collector.ParseUnit(sd.Unit); err != nil {
+			return collector.Device{}, fmt.Errorf("%s: %w", sd.Name, err)
+		}
+		if drv, err := collector.LookupDriver(sd.Driver); err == nil {
+			if r, ok := drv.(collector.UnitReporter); ok && r.ReportsUnit() {
+				return collector.Device{}, fmt.Errorf("%s: the %s driver reports its own unit", sd.Name, sd.Driver)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, ch := range sd.Channels {
+		if ch == "" || seen[ch] {
+			return collector.Device{}, fmt.Errorf("%s: channels must be unique and non-empty", sd.Name)
+		}
+		seen[ch] = true
+	}
+
+	// IPv6 addresses may be written bracketed, as in URLs, and link-local
+	// ones need a zone such as fe80::1%eth0.
+	addr := strings.TrimSuffix(strings.TrimPrefix(sd.Address, "["), "]")
+	host := addr
+	if sd.HostName != "" {
+		host = strings.TrimSuffix(sd.HostName, ".")
+	}
+	d := collector.Device{
+		Instance:      sd.Name,
+		HostName:      host,
+		Address:       addr,
+		Port:          sd.Port,
+		Path:          sd.Path,
+		Channels:      sd.Channels,
+		Auth:          collector.Credentials{Username: sd.Username, Password: sd.Password, Token: sd.Token},
+		Timeout:       timeout,
+		Retries:       sd.Retries,
+		Disabled:      sd.Disabled,
+		Group:         sd.Group,
+		Unit:          sd.Unit,
+		Bidirectional: sd.Bidirectional,
+	}
+	if sd.Driver != "auto" {
+		d.Driver = sd.Driver
+	}
+	if sd.Platform != "" {
+		d.Text = []string{"platform=" + sd.Platform}
+	}
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		d.Addresses = []string{ip.String()}
+	}
+	return d, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDevices(t *testing.T) {
+	path := writeFile(t, "devices.yaml", `devices:
+  - name: Garage plug
+    address: 10.0.20.5
+    port: 8080
+    path: /status
+    driver: shelly
+    username: admin
+    password: secret
+  - name: Shed
+    address: fe80::1%eth0
+`)
+
+	devices, err := loadDevices(path)
+	if err != nil {
+		t.Fatalf("expected devices to load, got %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected two devices, got %+v", devices)
+	}
+	d := devices[0]
+	if d.Instance != "Garage plug" || d.Address != "10.0.20.5" || d.Port != 8080 || d.Path != "/status" || d.Driver != "shelly" {
+		t.Fatalf("unexpected device %+v", d)
+	}
+	if d.Auth.Username != "admin" || d.Auth.Password != "secret" || !devices[1].Auth.IsZero() {
+		t.Fatalf("unexpected credentials %+v, %+v", d.Auth, devices[1].Auth)
+	}
+	if devices[1].Address != "fe80::1%eth0" || devices[1].PowerURL() != "http://[fe80::1%25eth0]:80/api/power" {
+		t.Fatalf("expected a zoned IPv6 address, got %q", devices[1].Address)
+	}
+}
+
+func TestLoadDevicesRejectsInvalidEntries(t *testing.T) {
+	cases := map[string]string{
+		"address is required":  "devices:\n  - name: Garage\n",
+		"unknown driver":       "devices:\n  - name: Garage\n    address: 10.0.0.1\n    driver: nope\n",
+		"field adress":         "devices:\n  - name: Garage\n    adress: 10.0.0.1\n",
+		"channels must be":     "devices:\n  - name: Garage\n    address: 10.0.0.1\n    channels: [0, 0]\n",
+		"invalid unit":         "devices:\n  - name: Garage\n    address: 10.0.0.1\n    unit: MW\n",
+		"reports its own unit": "devices:\n  - name: Garage\n    address: 10.0.0.1\n    driver: kasa\n    unit: mW\n",
+	}
+	for want, content := range cases {
+		_, err := loadDevices(writeFile(t, "devices.yaml", content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error containing %q, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadDevicesOverrides(t *testing.T) {
+	path := writeFile(t, "devices.yaml", `devices:
+  - name: Loft
+    address: 10.0.20.6
+    timeout: 15s
+    retries: 5
+  - name: Spare
+    address: 10.0.20.7
+    retries: 0
+    disabled: true
+`)
+	devices, err := loadDevices(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := devices[0]; d.Timeout != 15*time.Second || d.Retries == nil || *d.Retries != 5 || d.Disabled {
+		t.Fatalf("unexpected overrides %+v", d)
+	}
+	if d := devices[1]; d.Timeout != 0 || d.Retries == nil || *d.Retries != 0 || !d.Disabled {
+		t.Fatalf("unexpected overrides %+v", d)
+	}
+
+	for want, content := range map[string]string{
+		"invalid timeout":      "devices:\n  - name: Loft\n    address: 10.0.0.1\n    timeout: soon\n",
+		"must not be negative": "devices:\n  - name: Loft\n    address: 10.0.0.1\n    retries: -1\n",
+	} {
+		if _, err := loadDevices(writeFile(t, "devices.yaml", content)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error containing %q, got %v", want, err)
+		}
+	}
+}
+
+func TestStaticDeviceEffectiveSettings(t *testing.T) {
+	var opts options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs, &opts)
+	if err := fs.Parse([]string{"--http-timeout", "5s", "--retries", "1", "--driver", "shelly"}); err != nil {
+		t.Fatal(err)
+	}
+
+	five := 5
+	got := staticDevice{Name: "Loft", Timeout: "15s", Retries: &five}.effective(fs)
+	if got.Timeout != "15s" || *got.Retries != 5 || got.Driver != "shelly" || got.Path != "" {
+		t.Fatalf("expected the device's settings to win, got %+v", got)
+	}
+	got = staticDevice{Name: "Hall", Driver: "tasmota", Path: "/cm"}.effective(fs)
+	if got.Timeout != "5s" || got.Retries == nil || *got.Retries != 1 || got.Driver != "tasmota" || got.Path != "/cm" {
+		t.Fatalf("expected the flags to fill unset settings, got %+v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := printConfig(&buf, fs, []staticDevice{{Name: "Hall", Address: "10.0.0.5", Disabled: true}}, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"timeout: 5s", "retries: 1", "driver: shelly", "disabled: true"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %q in printed config:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRunListsDisabledDeviceWithoutQuerying(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected a disabled device not to be queried")
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	opts := statusOptions(addr.Port)
+	opts.format = formatText
+	opts.noDiscovery = true
+	opts.cfg = &config{devices: []staticDevice{{Name: "Spare", Address: addr.IP.String(), Disabled: true}}}
+	var out bytes.Buffer
+	err := run(context.Background(), opts, &out, io.Discard)
+	if exitCode(err) != exitNoDevices {
+		t.Fatalf("expected no queried devices, got %v", err)
+	}
+	if !strings.Contains(out.String(), "Spare") || !strings.Contains(out.String(), "Disabled; skipping power query.") {
+		t.Fatalf("expected the disabled device listed, got %q", out.String())
+	}
+}
+
+func TestLoadDevicesPlatformHint(t *testing.T) {
+	path := writeFile(t, "devices.yaml", `devices:
+  - name: Dryer
+    address: 10.0.20.8
+    platform: esphome
+`)
+	devices, err := loadDevices(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collector.SelectDriver(devices[0]).Name(); got != collector.ESPHomeDriver {
+		t.Fatalf("expected the platform hint to select the esphome driver, got %s", got)
+	}
+}
+
+func TestLoadDevicesHostName(t *testing.T) {
+	path := writeFile(t, "devices.json", `{"devices": [
+  {"name": "Plug", "address": "10.0.20.9", "hostname": "plug.local."},
+  {"name": "Lamp", "address": "10.0.20.10", "bidirectional": true}
+]}`)
+	devices, err := loadDevices(path)
+	if err != nil {
+		t.Fatalf("expected a JSON devices file to load, got %v", err)
+	}
+	if devices[0].HostName != "plug.local" || devices[0].Address != "10.0.20.9" {
+		t.Fatalf("expected the host name kept apart from the address, got %+v", devices[0])
+	}
+	if !devices[1].Bidirectional || devices[0].Bidirectional {
+		t.Fatalf("expected bidirectional set on the lamp alone, got %+v", devices)
+	}
+	if devices[1].HostName != "10.0.20.10" {
+		t.Fatalf("expected the address as host name without one, got %q", devices[1].HostName)
+	}
+}
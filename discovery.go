@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// cacheSource names the --cache file as a discovery source, alongside the
+// collector's "mdns <service>" browses.
+const cacheSource = "cache"
+
+// sourceFailures records the discovery sources that failed, so that the
+// summaries can report them. A nil sourceFailures records nothing.
+type sourceFailures struct {
+	mu     sync.Mutex
+	failed []string
+}
+
+// record logs a source's failure and remembers it.
+func (f *sourceFailures) record(source string, err error) {
+	slog.Warn("discovery source failed", "source", source, "error", err)
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.Contains(f.failed, source) {
+		f.failed = append(f.failed, source)
+	}
+}
+
+// list returns the failed sources in the order they failed.
+func (f *sourceFailures) list() []string {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.failed)
+}
+
+// brokenResolver stands in for a resolver that could not be created, so
+// that browsing fails as one source without stopping the others.
+type brokenResolver struct{ err error }
+
+func (r brokenResolver) Browse(context.Context, string, string, chan<- *collector.ServiceEntry) error {
+	return r.err
+}
+
+// cachedFallback returns the error of a discovery pass that used the cached
+// devices, which are a source of their own: unless --require-discovery is
+// set, discovery failing altogether is only logged while they are left.
+func cachedFallback(err error, cached []collector.Device, opts options) error {
+	if err == nil || len(cached) == 0 || opts.mustDiscover {
+		return err
+	}
+	slog.Warn("discovery failed; carrying on with the cached devices", "count", len(cached), "error", err)
+	return nil
+}
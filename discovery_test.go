@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// commissionableFails browses operational nodes with its stub and fails
+// to browse anything else.
+type commissionableFails struct{ stub *zeroconf.Stub }
+
+func (r commissionableFails) Browse(ctx context.Context, service, domain string, entries chan<- *collector.ServiceEntry) error {
+	if service != collector.OperationalService {
+		return errors.New("multicast unavailable")
+	}
+	return r.stub.Browse(ctx, service, domain, entries)
+}
+
+func TestRunCarriesOnPastFailedSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	resolver := commissionableFails{zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})}
+
+	opts := statusOptions(addr.Port)
+	opts.resolver = resolver
+	var out bytes.Buffer
+	if err := run(context.Background(), opts, &out, io.Discard); err != nil {
+		t.Fatalf("expected the working source's device to be queried, got %v", err)
+	}
+	for _, want := range []string{`"instance":"Lamp"`, `"failedSources":["mdns _matterc._udp"]`} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in the output, got:\n%s", want, out.String())
+		}
+	}
+
+	opts.mustDiscover = true
+	if got := exitCode(run(context.Background(), opts, io.Discard, io.Discard)); got != exitSetup {
+		t.Fatalf("expected exit status %d with --require-discovery, got %d", exitSetup, got)
+	}
+}
+
+func TestRunFallsBackToCachedDevices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	opts := statusOptions(addr.Port)
+	opts.cachePath = filepath.Join(t.TempDir(), "cache.json")
+	cache := newDeviceCache(0)
+	cache.seen(collector.Device{Instance: "Lamp", HostName: "lamp.local", Address: addr.IP.String(), Port: addr.Port}, time.Now())
+	if err := cache.save(opts.cachePath, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	opts.useCache = true
+	opts.resolver = failingResolver{}
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err != nil {
+		t.Fatalf("expected the cached device to be queried, got %v", err)
+	}
+}
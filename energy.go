@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// defaultMaxGap is the longest interval between samples that is integrated.
+const defaultMaxGap = 5 * time.Minute
+
+// energyReport is the cumulative energy per device and in total, with its
+// cost when a tariff is set. TotalKWh and Devices count imported energy;
+// energy exported by bidirectional devices is counted apart.
+type energyReport struct {
+	TotalKWh  float64            `json:"totalKWh"`
+	Devices   map[string]float64 `json:"devices"`
+	ExportKWh float64            `json:"exportKWh,omitempty"`
+	Exports   map[string]float64 `json:"exports,omitempty"`
+	TotalCost *float64           `json:"totalCost,omitempty"`
+	Costs     map[string]float64 `json:"costs,omitempty"`
+}
+
+// energyDevice is the accumulated energy of one device: KWh imported
+// while its power was positive and ExportKWh exported while it was
+// negative. Only imported energy is priced.
+type energyDevice struct {
+	Instance  string  `json:"instance"`
+	HostName  string  `json:"host,omitempty"`
+	KWh       float64 `json:"kwh"`
+	ExportKWh float64 `json:"exportKwh,omitempty"`
+	Cost      float64 `json:"cost,omitempty"`
+
+	lastWatts float64
+	lastTime  time.Time
+	// interval is how often the device was polled after its last reading.
+	interval time.Duration
+}
+
+// energyState is the layout of the --state file. Endpoints holds the
+// power endpoint paths found by probing, keyed by collector.EndpointKey,
+// and Baselines the readings of each device's idle baseline.
+type energyState struct {
+	Devices   map[string]*energyDevice   `json:"devices"`
+	Endpoints map[string]string          `json:"endpoints,omitempty"`
+	Baselines map[string]*baselineDevice `json:"baselines,omitempty"`
+}
+
+// energyMeter integrates each device's power over time using the
+// trapezoidal rule between the times its readings were taken, pricing it
+// with tariff when set. Gaps longer than maxGap, or than twice the
+// device's poll interval when that is longer, such as those left by
+// failed polls, are not integrated. An interval over which power changes
+// sign is split where it crosses zero, so that import and export are
+// accumulated apart.
+type energyMeter struct {
+	maxGap time.Duration
+
+	mu      sync.Mutex
+	tariff  *tariff
+	devices map[string]*energyDevice
+	// endpoints and baselines are carried through the state file for the
+	// fetcher and the baselineTracker.
+	endpoints map[string]string
+	baselines map[string]*baselineDevice
+}
+
+func newEnergyMeter(maxGap time.Duration) *energyMeter {
+	if maxGap <= 0 {
+		maxGap = defaultMaxGap
+	}
+	return &energyMeter{maxGap: maxGap, devices: make(map[string]*energyDevice)}
+}
+
+// setTariff prices the energy integrated from now on with t. The cost
+// already accumulated is kept.
+func (m *energyMeter) setTariff(t *tariff) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tariff = t
+}
+
+// add integrates a successful reading against the device's previous one.
+// With a tariff it returns the device's accumulated cost.
+func (m *energyMeter) add(r collector.Reading) *float64 {
+	if r.Err != nil || r.Power == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := r.Device.Key()
+	dev, ok := m.devices[key]
+	if !ok {
+		dev = &energyDevice{}
+		m.devices[key] = dev
+	}
+	dev.Instance = r.Device.Instance
+	dev.HostName = r.Device.HostName
+
+	watts := r.Power.CurrentWatts
+	if !dev.lastTime.IsZero() {
+		if gap := r.Time.Sub(dev.lastTime); gap > 0 && gap <= max(m.maxGap, 2*dev.interval) {
+			if (dev.lastWatts < 0) != (watts < 0) && watts != 0 && dev.lastWatts != 0 {
+				at := dev.lastTime.Add(time.Duration(float64(gap) * dev.lastWatts / (dev.lastWatts - watts)))
+				m.integrate(dev, dev.lastTime, at, dev.lastWatts, 0)
+				m.integrate(dev, at, r.Time, 0, watts)
+			} else {
+				m.integrate(dev, dev.lastTime, r.Time, dev.lastWatts, watts)
+			}
+		}
+	}
+	dev.lastWatts = watts
+	dev.lastTime = r.Time
+	dev.interval = r.Interval
+	if m.tariff == nil {
+		return nil
+	}
+	cost := dev.Cost
+	return &cost
+}
+
+// integrate adds to dev the energy of power changing linearly from wFrom
+// to wTo watts between from and to, over which it does not change sign.
+func (m *energyMeter) integrate(dev *energyDevice, from, to time.Time, wFrom, wTo float64) {
+	kwh := (wFrom + wTo) / 2 * to.Sub(from).Hours() / 1000
+	if kwh < 0 {
+		dev.ExportKWh -= kwh
+		return
+	}
+	dev.KWh += kwh
+	if m.tariff != nil {
+		dev.Cost += m.tariff.cost(from, to, wFrom, wTo)
+	}
+}
+
+// report returns the cumulative energy keyed by device instance name.
+func (m *energyMeter) report() *energyReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rep := &energyReport{Devices: make(map[string]float64, len(m.devices))}
+	if m.tariff != nil {
+		rep.TotalCost = new(float64)
+		rep.Costs = make(map[string]float64, len(m.devices))
+	}
+	for _, dev := range m.devices {
+		rep.Devices[dev.Instance] += dev.KWh
+		rep.TotalKWh += dev.KWh
+		if dev.ExportKWh > 0 {
+			if rep.Exports == nil {
+				rep.Exports = make(map[string]float64)
+			}
+			rep.Exports[dev.Instance] += dev.ExportKWh
+			rep.ExportKWh += dev.ExportKWh
+		}
+		if m.tariff != nil {
+			rep.Costs[dev.Instance] += dev.Cost
+			*rep.TotalCost += dev.Cost
+		}
+	}
+	return rep
+}
+
+// load restores accumulated energy from the state file at path. A missing
+// file is not an error.
+func (m *energyMeter) load(path string) error {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from the operator
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read state: %w", err)
+	}
+
+	var state energyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parse state %s: %w", path, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, dev := range state.Devices {
+		if dev != nil {
+			m.devices[key] = dev
+		}
+	}
+	m.endpoints = state.Endpoints
+	m.baselines = state.Baselines
+	return nil
+}
+
+// setEndpoints replaces the probed endpoints written to the state file.
+func (m *energyMeter) setEndpoints(endpoints map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoints = endpoints
+}
+
+// setBaselines replaces the baseline readings written to the state file.
+func (m *energyMeter) setBaselines(baselines map[string]*baselineDevice) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.baselines = baselines
+}
+
+// save writes the accumulated energy to the state file at path, replacing
+// it atomically.
+func (m *energyMeter) save(path string) error {
+	m.mu.Lock()
+	data, err := json.MarshalIndent(energyState{Devices: m.devices, Endpoints: m.endpoints, Baselines: m.baselines}, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+// writeEnergyReport writes the final energy report, taken at now, in the
+// output format. Formats with a fixed record shape get no report.
+func writeEnergyReport(out *output, now time.Time, rep *energyReport) {
+	switch out.format {
+	case formatText:
+		names := make([]string, 0, len(rep.Devices))
+		for name := range rep.Devices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		buf := []byte(fmt.Sprintf("\nEnergy (%s):\n", out.times.format(now)))
+		for _, name := range names {
+			buf = fmt.Appendf(buf, "  %s: %.3f kWh", name, rep.Devices[name])
+			if exported, ok := rep.Exports[name]; ok {
+				buf = fmt.Appendf(buf, " imported, %.3f kWh exported", exported)
+			}
+			if rep.TotalCost != nil {
+				buf = fmt.Appendf(buf, ", cost %.2f", rep.Costs[name])
+			}
+			buf = append(buf, '\n')
+		}
+		buf = fmt.Appendf(buf, "  Total: %.3f kWh", rep.TotalKWh)
+		if rep.ExportKWh > 0 {
+			buf = fmt.Appendf(buf, " imported, %.3f kWh exported, %.3f kWh net", rep.ExportKWh, rep.TotalKWh-rep.ExportKWh)
+		}
+		if rep.TotalCost != nil {
+			buf = fmt.Appendf(buf, ", cost %.2f", *rep.TotalCost)
+		}
+		buf = append(buf, '\n')
+		out.text(buf)
+	case formatJSON:
+		b, err := json.Marshal(struct {
+			Type string `json:"type"`
+			Time any    `json:"timestamp"`
+			*energyReport
+		}{"energy", out.times.value(now), rep})
+		if err != nil {
+			return
+		}
+		out.text(append(b, '\n'))
+	}
+}
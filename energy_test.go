@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/testsupport"
+	"powerusagecollection/pkg/collector"
+)
+
+func reading(d collector.Device, at time.Time, watts float64) collector.Reading {
+	return collector.Reading{Device: d, Power: &collector.PowerInfo{CurrentWatts: watts}, Time: at}
+}
+
+func TestEnergyMeterIntegratesTrapezoids(t *testing.T) {
+	start := time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC)
+	lamp := collector.Device{Instance: "Lamp", HostName: "lamp.local"}
+
+	m := newEnergyMeter(time.Hour)
+	m.add(reading(lamp, start, 100))
+	m.add(reading(lamp, start.Add(30*time.Minute), 300))
+	m.add(collector.Reading{Device: lamp, Err: errors.New("timeout"), Time: start.Add(45 * time.Minute)})
+	m.add(reading(lamp, start.Add(time.Hour), 300))
+
+	// (100+300)/2 W for 0.5 h plus 300 W for 0.5 h = 250 Wh.
+	rep := m.report()
+	if math.Abs(rep.TotalKWh-0.25) > 1e-9 || math.Abs(rep.Devices["Lamp"]-0.25) > 1e-9 {
+		t.Fatalf("expected 0.25 kWh, got %+v", rep)
+	}
+}
+
+func TestEnergyMeterIntegratesPolledReadingsInVirtualTime(t *testing.T) {
+	clk := testsupport.NewFakeClock(time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC))
+	p := collector.NewPoller(15 * time.Minute)
+	p.Clock = clk
+	p.Fetch = func(context.Context, collector.Device) (*collector.PowerInfo, error) {
+		return &collector.PowerInfo{CurrentWatts: 400}, nil
+	}
+	p.Add(collector.Device{Instance: "Lamp"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readings := make(chan collector.Reading)
+	stopped := make(chan struct{})
+	go func() {
+		p.Run(ctx, func(r collector.Reading) { readings <- r })
+		close(stopped)
+	}()
+
+	m := newEnergyMeter(time.Hour)
+	clk.BlockUntil(1)
+	for range 4 {
+		clk.Advance(15 * time.Minute)
+		m.add(<-readings)
+	}
+	cancel()
+	<-stopped
+
+	// 400 W between the first and fourth readings, 45 minutes apart.
+	if got := m.report().TotalKWh; math.Abs(got-0.3) > 1e-9 {
+		t.Fatalf("expected 0.3 kWh, got %v", got)
+	}
+}
+
+func TestEnergyMeterIntegratesAdaptiveSpacing(t *testing.T) {
+	clk := testsupport.NewFakeClock(time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC))
+	p := collector.NewPoller(5 * time.Second)
+	p.Clock = clk
+	p.AdaptiveMaxInterval = time.Minute
+	p.Fetch = func(context.Context, collector.Device) (*collector.PowerInfo, error) {
+		return &collector.PowerInfo{CurrentWatts: 600}, nil
+	}
+	p.Add(collector.Device{Instance: "Fridge"})
+
+	// A --max-gap shorter than the adapted intervals does not cut the
+	// steady device's readings apart.
+	m := newEnergyMeter(30 * time.Second)
+	var times []time.Duration
+	for range 28 {
+		p.Poll(context.Background(), func(r collector.Reading) {
+			times = append(times, r.Time.Sub(time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC)))
+			m.add(r)
+		})
+		clk.Advance(5 * time.Second)
+	}
+	want := []time.Duration{0, 5 * time.Second, 15 * time.Second, 35 * time.Second, 75 * time.Second, 135 * time.Second}
+	if !slices.Equal(times, want) {
+		t.Fatalf("expected readings at %v, got %v", want, times)
+	}
+	// 600 W over the 135 seconds between the first and last readings.
+	if got := m.report().TotalKWh; math.Abs(got-0.0225) > 1e-9 {
+		t.Fatalf("expected 0.0225 kWh, got %v", got)
+	}
+}
+
+func TestEnergyMeterSkipsLongGaps(t *testing.T) {
+	start := time.Now()
+	lamp := collector.Device{Instance: "Lamp"}
+
+	m := newEnergyMeter(time.Minute)
+	m.add(reading(lamp, start, 1000))
+	m.add(reading(lamp, start.Add(10*time.Minute), 1000))
+	if got := m.report().TotalKWh; got != 0 {
+		t.Fatalf("expected a gap longer than --max-gap to be skipped, got %v kWh", got)
+	}
+}
+
+func TestEnergyMeterPersistsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	start := time.Now()
+	lamp := collector.Device{Instance: "Lamp"}
+
+	m := newEnergyMeter(time.Hour)
+	m.add(reading(lamp, start, 1000))
+	m.add(reading(lamp, start.Add(time.Hour), 1000))
+	m.setEndpoints(map[string]string{"Lamp|": "/status"})
+	if err := m.save(path); err != nil {
+		t.Fatalf("expected state to save, got %v", err)
+	}
+
+	restored := newEnergyMeter(time.Hour)
+	if err := restored.load(path); err != nil {
+		t.Fatalf("expected state to load, got %v", err)
+	}
+	if restored.endpoints["Lamp|"] != "/status" {
+		t.Fatalf("expected probed endpoints to be restored, got %v", restored.endpoints)
+	}
+	restored.add(reading(lamp, start.Add(2*time.Hour), 1000))
+	if got := restored.report().TotalKWh; math.Abs(got-1) > 1e-9 {
+		t.Fatalf("expected restored 1 kWh without integrating across the restart, got %v", got)
+	}
+
+	if err := newEnergyMeter(0).load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatalf("expected a missing state file to be ignored, got %v", err)
+	}
+}
+
+func TestEnergyMeterPricesWithTariff(t *testing.T) {
+	start := time.Date(2024, 2, 2, 22, 0, 0, 0, time.UTC)
+	lamp := collector.Device{Instance: "Lamp"}
+
+	m := newEnergyMeter(3 * time.Hour)
+	if cost := m.add(reading(lamp, start, 1000)); cost != nil {
+		t.Fatalf("expected no cost without a tariff, got %v", *cost)
+	}
+	m.tariff = nightTariff(t, time.UTC)
+	m.add(reading(lamp, start, 1000))
+	cost := m.add(reading(lamp, start.Add(2*time.Hour), 1000))
+	if want := 0.32 + 0.18; cost == nil || math.Abs(*cost-want) > 1e-9 {
+		t.Fatalf("expected accumulated cost %v, got %v", want, cost)
+	}
+	rep := m.report()
+	if rep.TotalCost == nil || math.Abs(*rep.TotalCost-0.5) > 1e-9 || math.Abs(rep.Costs["Lamp"]-0.5) > 1e-9 {
+		t.Fatalf("expected the report to carry the cost, got %+v", rep)
+	}
+}
+
+func TestWriteEnergyReport(t *testing.T) {
+	now := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	rep := &energyReport{TotalKWh: 1.5, Devices: map[string]float64{"Lamp": 0.5, "Fridge": 1}}
+
+	var buf bytes.Buffer
+	writeEnergyReport(newOutput(&buf, formatText), now, rep)
+	if got := buf.String(); !strings.Contains(got, "  Fridge: 1.000 kWh\n  Lamp: 0.500 kWh\n  Total: 1.500 kWh\n") {
+		t.Fatalf("unexpected text report %q", got)
+	}
+
+	buf.Reset()
+	writeEnergyReport(newOutput(&buf, formatJSON), now, rep)
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("expected JSON report, got %q (%v)", buf.String(), err)
+	}
+	if decoded["type"] != "energy" || decoded["totalKWh"] != 1.5 {
+		t.Fatalf("unexpected JSON report %v", decoded)
+	}
+
+	total := 0.45
+	rep.TotalCost, rep.Costs = &total, map[string]float64{"Lamp": 0.15, "Fridge": 0.3}
+	buf.Reset()
+	writeEnergyReport(newOutput(&buf, formatText), now, rep)
+	if got := buf.String(); !strings.Contains(got, "  Lamp: 0.500 kWh, cost 0.15\n  Total: 1.500 kWh, cost 0.45\n") {
+		t.Fatalf("unexpected text report with cost %q", got)
+	}
+}
+
+func TestEnergyMeterSplitsImportAndExport(t *testing.T) {
+	start := time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)
+	meter := collector.Device{Instance: "Solar", Bidirectional: true}
+
+	m := newEnergyMeter(time.Hour)
+	flat, err := newTariff(0.5, nil, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setTariff(flat)
+	// Oscillating across zero between every pair of polls: 300 W to
+	// -100 W crosses zero 45 minutes in, and back up halfway.
+	m.add(reading(meter, start, 300))
+	m.add(reading(meter, start.Add(time.Hour), -100))
+	m.add(reading(meter, start.Add(2*time.Hour), 100))
+
+	// 300 W over 45 minutes halved is 112.5 Wh, and 100 W over 30
+	// minutes halved 25 Wh, imported; 12.5 Wh and 25 Wh exported.
+	rep := m.report()
+	if math.Abs(rep.TotalKWh-0.1375) > 1e-9 || math.Abs(rep.ExportKWh-0.0375) > 1e-9 || math.Abs(rep.Exports["Solar"]-0.0375) > 1e-9 {
+		t.Fatalf("expected 0.1375 kWh imported and 0.0375 kWh exported, got %+v", rep)
+	}
+	if rep.TotalCost == nil || math.Abs(*rep.TotalCost-0.1375*0.5) > 1e-9 {
+		t.Fatalf("expected only imported energy priced, got %v", rep.TotalCost)
+	}
+
+	var buf bytes.Buffer
+	writeEnergyReport(newOutput(&buf, formatText), start, rep)
+	if got := buf.String(); !strings.Contains(got, "  Solar: 0.138 kWh imported, 0.038 kWh exported, cost 0.07\n  Total: 0.138 kWh imported, 0.038 kWh exported, 0.100 kWh net, cost 0.07\n") {
+		t.Fatalf("unexpected text report %q", got)
+	}
+}
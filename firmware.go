@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// firmwareEntry is an element of the --expected-firmware file: the latest
+// known firmware of a product, by the Matter vendor and product IDs of
+// its VP TXT record. A zero Product covers every product of the vendor
+// without an entry of its own.
+type firmwareEntry struct {
+	Vendor   int    `yaml:"vendor"`
+	Product  int    `yaml:"product,omitempty"`
+	Firmware string `yaml:"firmware"`
+}
+
+// expectedFirmware flags listed devices running older firmware than the
+// --expected-firmware file expects of their product. A nil
+// expectedFirmware expects nothing.
+type expectedFirmware struct {
+	entries []firmwareEntry
+
+	// warned holds the version pairs already warned about as not
+	// comparable.
+	mu     sync.Mutex
+	warned map[[2]string]bool
+}
+
+// loadExpectedFirmware reads the --expected-firmware YAML file, a list of
+// firmwareEntry.
+func loadExpectedFirmware(path string) (*expectedFirmware, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return nil, fmt.Errorf("read expected firmware: %w", err)
+	}
+	var entries []firmwareEntry
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&entries); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse expected firmware %s: %w", path, err)
+	}
+	for i, e := range entries {
+		if e.Vendor <= 0 || e.Firmware == "" {
+			return nil, fmt.Errorf("expected firmware %s: entry %d needs a vendor and a firmware version", path, i+1)
+		}
+	}
+	return &expectedFirmware{entries: entries, warned: make(map[[2]string]bool)}, nil
+}
+
+// expected returns the firmware expected of a product, if any.
+func (f *expectedFirmware) expected(vendor, product int) (string, bool) {
+	var fallback *firmwareEntry
+	for i, e := range f.entries {
+		switch {
+		case e.Vendor != vendor:
+		case e.Product == product:
+			return e.Firmware, true
+		case e.Product == 0:
+			fallback = &f.entries[i]
+		}
+	}
+	if fallback == nil {
+		return "", false
+	}
+	return fallback.Firmware, true
+}
+
+// check records in r the firmware expected of its product and whether it
+// runs older firmware.
+func (f *expectedFirmware) check(r *deviceResult) {
+	if f == nil || r.VendorID == 0 {
+		return
+	}
+	want, ok := f.expected(r.VendorID, r.ProductID)
+	if !ok {
+		return
+	}
+	r.ExpectedFirmware = want
+	if r.Firmware != "" {
+		r.Outdated = f.older(r.Firmware, want)
+	}
+}
+
+// older reports whether firmware have is older than want. Versions with
+// numbers, from 1.2.3-beta to plain build numbers, compare by them;
+// anything else is outdated unless it matches exactly, with a warning.
+func (f *expectedFirmware) older(have, want string) bool {
+	if versionNumbers.MatchString(have) && versionNumbers.MatchString(want) {
+		return compareVersions(have, want) < 0
+	}
+	f.mu.Lock()
+	if pair := [2]string{have, want}; !f.warned[pair] {
+		f.warned[pair] = true
+		slog.Warn("firmware versions not comparable; treating any difference as outdated", "firmware", have, "expected", want)
+	}
+	f.mu.Unlock()
+	return have != want
+}
+
+// firmwareSummary is the record counting the listed devices with outdated
+// firmware.
+type firmwareSummary struct {
+	Type     string `json:"type"`
+	Devices  int    `json:"devices"`
+	Outdated int    `json:"outdated"`
+}
+
+// writeFirmwareSummary writes how many of the listed devices run outdated
+// firmware, in text or JSON; other formats carry only device records.
+func writeFirmwareSummary(out *output, results []deviceResult) {
+	sum := firmwareSummary{Type: "firmware", Devices: len(results)}
+	for _, r := range results {
+		if r.Outdated {
+			sum.Outdated++
+		}
+	}
+	switch out.format {
+	case formatText:
+		out.text([]byte(fmt.Sprintf("\nOutdated firmware: %d of %d devices\n", sum.Outdated, sum.Devices)))
+	case formatJSON:
+		b, err := json.Marshal(sum)
+		if err != nil {
+			return
+		}
+		out.text(append(b, '\n'))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+const expectedFirmwareYAML = `
+- vendor: 4874
+  firmware: "2.0"
+- vendor: 4874
+  product: 77
+  firmware: 1.4.2
+- vendor: 4999
+  firmware: stable
+`
+
+func loadTestFirmware(t *testing.T) *expectedFirmware {
+	t.Helper()
+	f, err := loadExpectedFirmware(writeFile(t, "firmware.yaml", expectedFirmwareYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestExpectedFirmwareLookup(t *testing.T) {
+	f := loadTestFirmware(t)
+	for _, tt := range []struct {
+		vendor, product int
+		want            string
+		ok              bool
+	}{
+		{4874, 77, "1.4.2", true},
+		{4874, 78, "2.0", true},
+		{4874, 0, "2.0", true},
+		{1, 77, "", false},
+	} {
+		if got, ok := f.expected(tt.vendor, tt.product); got != tt.want || ok != tt.ok {
+			t.Errorf("expected(%d, %d) = %q, %v; want %q, %v", tt.vendor, tt.product, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExpectedFirmwareRejectsIncompleteEntries(t *testing.T) {
+	if _, err := loadExpectedFirmware(writeFile(t, "firmware.yaml", "- vendor: 4874\n")); err == nil || !strings.Contains(err.Error(), "entry 1") {
+		t.Fatalf("expected an error naming the entry, got %v", err)
+	}
+	if _, err := loadExpectedFirmware(writeFile(t, "firmware.yaml", "- vendor: 4874\n  version: 1.0\n")); err == nil {
+		t.Fatal("expected unknown keys to be rejected")
+	}
+}
+
+func TestExpectedFirmwareOlder(t *testing.T) {
+	f := loadTestFirmware(t)
+	for _, tt := range []struct {
+		have, want string
+		older      bool
+	}{
+		{"1.4.1", "1.4.2", true},
+		{"v1.10.0", "1.9", false},
+		{"1.4.2-beta", "1.4.2", false},
+		{"1.4", "1.4.2", true},
+		{"20231001", "20240115", true},
+		{"20240115", "20240115", false},
+		{"beta", "stable", true},
+		{"stable", "stable", false},
+	} {
+		if got := f.older(tt.have, tt.want); got != tt.older {
+			t.Errorf("older(%q, %q) = %v, want %v", tt.have, tt.want, got, tt.older)
+		}
+	}
+}
+
+func TestCheckMarksOutdatedDevices(t *testing.T) {
+	f := loadTestFirmware(t)
+	r := deviceResult{Firmware: "1.3", VendorID: 4874, ProductID: 77}
+	f.check(&r)
+	if r.ExpectedFirmware != "1.4.2" || !r.Outdated {
+		t.Fatalf("expected 1.3 to be outdated against 1.4.2, got %+v", r)
+	}
+	if fw, color := (palette{}).deviceFirmware(r); fw != "1.3 OUTDATED (expected 1.4.2)" || color != ansiYellow {
+		t.Fatalf("unexpected marker %q %q", fw, color)
+	}
+
+	r = deviceResult{Firmware: "9.0", VendorID: 1}
+	f.check(&r)
+	if r.ExpectedFirmware != "" || r.Outdated {
+		t.Fatalf("expected unknown vendors to be left alone, got %+v", r)
+	}
+	var none *expectedFirmware
+	none.check(&r)
+}
+
+func TestListReportsOutdatedFirmware(t *testing.T) {
+	resolver := zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", Text: []string{"VP=4874+77", "firmware=1.3"}}},
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "Plug", HostName: "plug.local.", Text: []string{"VP=4874+78", "firmware=2.1"}}},
+	)
+	var buf bytes.Buffer
+	opts := options{listOnly: true, browseTimeout: 100 * time.Millisecond, resolver: resolver, out: newOutput(&buf, formatJSON), expectedFW: loadTestFirmware(t)}
+
+	stats, err := runOnce(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = resultError(stats.report(time.Now()), false)
+	if exitCode(err) != exitOutdated || err.Error() != "1 of 2 devices run outdated firmware" {
+		t.Fatalf("expected exit status %d, got %v", exitOutdated, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var lamp deviceResult
+	var sum firmwareSummary
+	for _, line := range lines {
+		switch {
+		case strings.Contains(line, `"instance":"Lamp"`):
+			json.Unmarshal([]byte(line), &lamp)
+		case strings.Contains(line, `"type":"firmware"`):
+			json.Unmarshal([]byte(line), &sum)
+		}
+	}
+	if lamp.Firmware != "1.3" || lamp.ExpectedFirmware != "1.4.2" || !lamp.Outdated {
+		t.Fatalf("expected current and expected versions in the JSON, got %+v", lamp)
+	}
+	if sum.Devices != 2 || sum.Outdated != 1 {
+		t.Fatalf("unexpected summary %+v in %q", sum, buf.String())
+	}
+}
+
+func TestListFirmwareSummaryText(t *testing.T) {
+	var buf bytes.Buffer
+	writeFirmwareSummary(newOutput(&buf, formatText), []deviceResult{{Outdated: true}, {}, {}})
+	if got := buf.String(); got != "\nOutdated firmware: 1 of 3 devices\n" {
+		t.Fatalf("unexpected summary %q", got)
+	}
+}
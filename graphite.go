@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultGraphiteBuffer is how many points are held while Carbon is
+	// unreachable.
+	defaultGraphiteBuffer = 10000
+	// graphiteMinBackoff and graphiteMaxBackoff bound the delay between
+	// reconnect attempts after the Carbon connection is lost.
+	graphiteMinBackoff = time.Second
+	graphiteMaxBackoff = time.Minute
+	// graphiteDialTimeout bounds each connection attempt and
+	// graphiteWriteTimeout each write of the buffered points.
+	graphiteDialTimeout  = 10 * time.Second
+	graphiteWriteTimeout = 10 * time.Second
+)
+
+// graphiteUnsafe matches the characters that cannot appear in a metric
+// path node.
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// graphiteSink sends readings to Carbon in the plaintext protocol. Points
+// are buffered and sent after every run or poll cycle; while the
+// connection is down they stay buffered, oldest dropped first beyond
+// limit, and the connection is redialled with exponential backoff.
+type graphiteSink struct {
+	prefix string
+	limit  int
+	dial   func(ctx context.Context) (net.Conn, error)
+
+	mu      sync.Mutex
+	conn    net.Conn
+	backoff time.Duration
+	retryAt time.Time
+	pending []string
+	dropped int
+	// spooled drops the points a failed flush leaves, as the spool keeps
+	// them instead.
+	spooled bool
+	// named holds the devices whose metric path has been logged.
+	named map[string]bool
+}
+
+// newGraphiteSink returns a sink for the Carbon server at addr, a
+// host:port. The connection is made on the first flush.
+func newGraphiteSink(addr, prefix string, limit int) (*graphiteSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid --graphite-addr %q: want host:port", addr)
+	}
+	if limit < 1 {
+		return nil, fmt.Errorf("invalid --graphite-buffer %d: must be at least 1", limit)
+	}
+	dialer := &net.Dialer{Timeout: graphiteDialTimeout}
+	return &graphiteSink{
+		prefix: strings.Trim(prefix, "."),
+		limit:  limit,
+		named:  make(map[string]bool),
+		dial: func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		},
+	}, nil
+}
+
+// graphiteNode makes s usable as one node of a metric path.
+func graphiteNode(s string) string {
+	return graphiteUnsafe.ReplaceAllString(s, "_")
+}
+
+// path returns the metric path of r's device, logging it the first time
+// the device is seen. The caller must hold s.mu.
+func (s *graphiteSink) path(r deviceResult) string {
+	name := graphiteNode(r.Instance)
+	if r.Channel != "" {
+		name += "." + graphiteNode(r.Channel)
+	}
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+	if key := resultKey(r); !s.named[key] {
+		s.named[key] = true
+		slog.Info("graphite metric path", "device", r.Instance, "path", name)
+	}
+	return name
+}
+
+// add buffers the points for the reading in r, if any.
+func (s *graphiteSink) add(r deviceResult) {
+	if r.PowerInfo == nil {
+		return
+	}
+	stamp := r.Time
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+	ts := strconv.FormatInt(stamp.Unix(), 10)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(r)
+	s.push(path + ".watts " + formatFloat(r.CurrentWatts) + " " + ts)
+	if r.Voltage != 0 {
+		s.push(path + ".voltage " + formatFloat(r.Voltage) + " " + ts)
+	}
+	if r.Amperage != 0 {
+		s.push(path + ".amperage " + formatFloat(r.Amperage) + " " + ts)
+	}
+}
+
+// queued returns how many points are buffered.
+func (s *graphiteSink) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// push buffers line, dropping the oldest point when the buffer is full.
+// The caller must hold s.mu.
+func (s *graphiteSink) push(line string) {
+	if len(s.pending) >= s.limit {
+		s.pending = s.pending[1:]
+		s.dropped++
+	}
+	s.pending = append(s.pending, line)
+}
+
+// Write buffers the points for results and sends the buffer.
+func (s *graphiteSink) Write(ctx context.Context, results []deviceResult) error {
+	for _, r := range results {
+		s.add(r)
+	}
+	return s.flush(ctx)
+}
+
+// Flush sends the buffered points.
+func (s *graphiteSink) Flush(ctx context.Context) error {
+	return s.flush(ctx)
+}
+
+// flush sends the buffered points, which stay buffered when the
+// connection is unavailable or the write fails, unless spooled.
+func (s *graphiteSink) flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spooled {
+		defer func() { s.pending = nil }()
+	}
+
+	if s.dropped > 0 {
+		slog.Warn("graphite buffer full, dropped oldest points", "dropped", s.dropped)
+		s.dropped = 0
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if err := s.connect(ctx); err != nil {
+		return fmt.Errorf("%w (%d points buffered)", err, len(s.pending))
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(graphiteWriteTimeout))
+	if _, err := s.conn.Write([]byte(strings.Join(s.pending, "\n") + "\n")); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.scheduleRetry()
+		return fmt.Errorf("write: %w (%d points buffered)", err, len(s.pending))
+	}
+	s.pending = nil
+	return nil
+}
+
+// connect dials Carbon unless connected or a reconnect is still backing
+// off. The caller must hold s.mu.
+func (s *graphiteSink) connect(ctx context.Context) error {
+	if s.conn != nil {
+		return nil
+	}
+	if wait := time.Until(s.retryAt); wait > 0 {
+		return fmt.Errorf("carbon unavailable, reconnecting in %s", wait.Round(time.Second))
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, graphiteDialTimeout)
+	defer cancel()
+	conn, err := s.dial(dialCtx)
+	if err != nil {
+		s.scheduleRetry()
+		return fmt.Errorf("connect: %w", err)
+	}
+	s.conn = conn
+	s.backoff = 0
+	return nil
+}
+
+// scheduleRetry doubles the reconnect delay. The caller must hold s.mu.
+func (s *graphiteSink) scheduleRetry() {
+	if s.backoff == 0 {
+		s.backoff = graphiteMinBackoff
+	} else {
+		s.backoff = min(s.backoff*2, graphiteMaxBackoff)
+	}
+	s.retryAt = time.Now().Add(s.backoff)
+}
+
+// Close closes the connection to Carbon.
+func (s *graphiteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
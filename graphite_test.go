@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// fakeCarbon collects the plaintext lines sent to it.
+type fakeCarbon struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	lines []string
+}
+
+func newFakeCarbon(t *testing.T) *fakeCarbon {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeCarbon{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					c.mu.Lock()
+					c.lines = append(c.lines, scanner.Text())
+					c.mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return c
+}
+
+// waitLines waits until n lines have arrived and returns them.
+func (c *fakeCarbon) waitLines(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.Lock()
+		lines := append([]string(nil), c.lines...)
+		c.mu.Unlock()
+		if len(lines) >= n || time.Now().After(deadline) {
+			return lines
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGraphiteSendsSanitizedPaths(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	s, err := newGraphiteSink(carbon.ln.Addr().String(), "home.power.", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	stamp := time.Unix(1706886245, 0)
+	s.add(deviceResult{Instance: "Living Room.Lamp", Time: stamp, PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230}})
+	s.add(deviceResult{Instance: "Heat Pump", Channel: "1", Time: stamp, PowerInfo: &collector.PowerInfo{CurrentWatts: 800}})
+	s.add(deviceResult{Instance: "Broken", Error: "timeout"})
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatalf("expected flush to succeed, got %v", err)
+	}
+
+	want := []string{
+		"home.power.Living_Room_Lamp.watts 12.5 1706886245",
+		"home.power.Living_Room_Lamp.voltage 230 1706886245",
+		"home.power.Heat_Pump.1.watts 800 1706886245",
+	}
+	if got := carbon.waitLines(t, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected lines:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestGraphiteBuffersWhileDisconnected(t *testing.T) {
+	carbon := newFakeCarbon(t)
+	s, err := newGraphiteSink(carbon.ln.Addr().String(), "p", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	dial := s.dial
+	down := true
+	s.dial = func(ctx context.Context) (net.Conn, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return dial(ctx)
+	}
+
+	for i, watts := range []float64{1, 2, 3} {
+		s.add(deviceResult{Instance: "Lamp", Time: time.Unix(int64(i), 0), PowerInfo: &collector.PowerInfo{CurrentWatts: watts}})
+	}
+	if err := s.flush(context.Background()); err == nil || !strings.Contains(err.Error(), "2 points buffered") {
+		t.Fatalf("expected the flush to fail keeping 2 points, got %v", err)
+	}
+	if err := s.flush(context.Background()); err == nil || !strings.Contains(err.Error(), "reconnecting in") {
+		t.Fatalf("expected the reconnect to back off, got %v", err)
+	}
+
+	down = false
+	s.retryAt = time.Time{}
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatalf("expected the flush to succeed once reconnected, got %v", err)
+	}
+	want := []string{"p.Lamp.watts 2 1", "p.Lamp.watts 3 2"}
+	if got := carbon.waitLines(t, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected the oldest point to be dropped, got %q", got)
+	}
+}
+
+func TestNewGraphiteSinkRejectsInvalidSettings(t *testing.T) {
+	if _, err := newGraphiteSink("graphite", "p", 10); err == nil {
+		t.Error("expected an address without a port to be rejected")
+	}
+	if _, err := newGraphiteSink("graphite:2003", "p", 0); err == nil {
+		t.Error("expected an empty buffer to be rejected")
+	}
+}
+
+func TestRunSendsToGraphite(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer device.Close()
+	addr := device.Listener.Addr().(*net.TCPAddr)
+	carbon := newFakeCarbon(t)
+
+	opts := statusOptions(addr.Port)
+	opts.graphiteAddr = carbon.ln.Addr().String()
+	opts.graphitePrefix = "home.power"
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	lines := carbon.waitLines(t, 1)
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "home.power.Lamp.watts 5 ") {
+		t.Fatalf("expected the reading to reach Graphite, got %q", lines)
+	}
+}
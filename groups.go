@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// defaultGroup is the group of devices that belong to no other.
+const defaultGroup = "default"
+
+// grouper assigns devices to the groups, such as rooms, that readings are
+// subtotalled by: a static device to the group of its entry, found by name
+// or address, and any other to the value of its txtKey TXT record. The
+// static groups are replaced on reload. Without any group configured,
+// devices are left ungrouped.
+type grouper struct {
+	txtKey string
+
+	mu     sync.RWMutex
+	static map[string]string
+}
+
+func newGrouper(list []staticDevice, txtKey string) *grouper {
+	g := &grouper{txtKey: txtKey}
+	g.set(list)
+	return g
+}
+
+// set replaces the static groups with those of list.
+func (g *grouper) set(list []staticDevice) {
+	static := make(map[string]string)
+	for _, sd := range list {
+		if sd.Group == "" {
+			continue
+		}
+		static[sd.Name] = sd.Group
+		static[addressKey(sd.Address)] = sd.Group
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.static = static
+}
+
+// addressKey is the static group key of a device address, kept apart from
+// device names.
+func addressKey(addr string) string {
+	return "address " + strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// group returns d's group, defaultGroup when it has none, or an empty
+// string when no group is configured at all. A nil grouper groups
+// nothing.
+func (g *grouper) group(d collector.Device) string {
+	if g == nil {
+		return ""
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.txtKey == "" && len(g.static) == 0 {
+		return ""
+	}
+	if group, ok := g.static[d.Instance]; ok {
+		return group
+	}
+	if group, ok := g.static[addressKey(d.Address)]; ok && d.Address != "" {
+		return group
+	}
+	if g.txtKey != "" {
+		for _, txt := range d.Text {
+			key, value, ok := strings.Cut(txt, "=")
+			if ok && strings.EqualFold(key, g.txtKey) && value != "" {
+				return value
+			}
+		}
+	}
+	return defaultGroup
+}
+
+// groupName returns the name a device's group is reported under.
+func groupName(group string) string {
+	if group == "" {
+		return defaultGroup
+	}
+	return group
+}
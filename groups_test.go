@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestGrouperAssignsGroups(t *testing.T) {
+	g := newGrouper([]staticDevice{
+		{Name: "Desk Lamp", Address: "10.0.0.7", Group: "office"},
+		{Name: "Fridge", Address: "[fd00::5]", Group: "kitchen"},
+		{Name: "Shed", Address: "10.0.0.9"},
+	}, "room")
+
+	for _, c := range []struct {
+		device collector.Device
+		want   string
+	}{
+		{collector.Device{Instance: "Desk Lamp"}, "office"},
+		{collector.Device{Instance: "Kitchen fridge", Address: "fd00::5"}, "kitchen"},
+		{collector.Device{Instance: "Scope", Text: []string{"Room=lab"}}, "lab"},
+		{collector.Device{Instance: "Shed", Address: "10.0.0.9"}, defaultGroup},
+		{collector.Device{Instance: "Plug", Text: []string{"room="}}, defaultGroup},
+	} {
+		if got := g.group(c.device); got != c.want {
+			t.Errorf("%+v: got group %q, want %q", c.device, got, c.want)
+		}
+	}
+
+	if got := newGrouper([]staticDevice{{Name: "Shed"}}, "").group(collector.Device{Instance: "Shed"}); got != "" {
+		t.Fatalf("expected no group without any configured, got %q", got)
+	}
+	var none *grouper
+	if got := none.group(collector.Device{Instance: "Shed"}); got != "" || groupName(got) != defaultGroup {
+		t.Fatalf("expected a nil grouper to group nothing, got %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// haRESTState is the body of GET /ha/{device} and GET /ha/total, in the
+// form Home Assistant's RESTful sensor reads: the power as the state, and
+// the rest as attributes picked out with json_attributes.
+type haRESTState struct {
+	State      float64          `json:"state"`
+	Attributes haRESTAttributes `json:"attributes"`
+}
+
+type haRESTAttributes struct {
+	UnitOfMeasurement string    `json:"unit_of_measurement"`
+	DeviceClass       string    `json:"device_class"`
+	FriendlyName      string    `json:"friendly_name"`
+	Voltage           float64   `json:"voltage,omitempty"`
+	Current           float64   `json:"current,omitempty"`
+	PowerFactor       float64   `json:"power_factor,omitempty"`
+	LastSuccess       time.Time `json:"last_success,omitzero"`
+	// Devices and Failed count the devices behind the total.
+	Devices int `json:"devices,omitempty"`
+	Failed  int `json:"failed,omitempty"`
+}
+
+// haREST serves a device's last good reading to Home Assistant's RESTful
+// sensor. The device is named by its display name, an alias key from the
+// config file or its host name, in any case; an unknown name is answered
+// 404 with the names known.
+func (a *api) haREST(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("device")
+	devices := a.deviceList()
+	d, ok := a.haDevice(devices, name)
+	if !ok {
+		known := make([]string, 0, len(devices))
+		for _, d := range devices {
+			known = append(known, deviceLabel(d.Instance, d.channel))
+		}
+		writeJSON(w, http.StatusNotFound, map[string]any{"error": "unknown device " + name, "devices": known})
+		return
+	}
+	label := deviceLabel(d.Instance, d.channel)
+	if d.power == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no reading yet for " + label})
+		return
+	}
+	writeJSON(w, http.StatusOK, haRESTState{
+		State: d.power.CurrentWatts,
+		Attributes: haRESTAttributes{
+			UnitOfMeasurement: "W",
+			DeviceClass:       "power",
+			FriendlyName:      label,
+			Voltage:           d.power.Voltage,
+			Current:           d.power.Amperage,
+			PowerFactor:       d.power.PowerFactor,
+			LastSuccess:       d.LastSuccess,
+		},
+	})
+}
+
+// haDevice finds the device called name among devices.
+func (a *api) haDevice(devices []apiDevice, name string) (apiDevice, bool) {
+	alias := a.names.lookup(name)
+	for _, d := range devices {
+		label := deviceLabel(d.Instance, d.channel)
+		if strings.EqualFold(label, name) || (alias != "" && strings.EqualFold(label, alias)) {
+			return d, true
+		}
+	}
+	for _, d := range devices {
+		if d.channel == "" && d.HostName != "" && hostKey(d.HostName) == hostKey(name) {
+			return d, true
+		}
+	}
+	return apiDevice{}, false
+}
+
+// haRESTTotal serves the sum of every device's last good reading. It
+// shadows any device called "total".
+func (a *api) haRESTTotal(w http.ResponseWriter, r *http.Request) {
+	var total haRESTState
+	total.Attributes = haRESTAttributes{UnitOfMeasurement: "W", DeviceClass: "power", FriendlyName: "Total power"}
+	for _, d := range a.deviceList() {
+		total.Attributes.Devices++
+		if d.Error != "" {
+			total.Attributes.Failed++
+		}
+		if d.power != nil {
+			total.State += d.power.CurrentWatts
+		}
+		if d.LastSuccess.After(total.Attributes.LastSuccess) {
+			total.Attributes.LastSuccess = d.LastSuccess
+		}
+	}
+	writeJSON(w, http.StatusOK, total)
+}
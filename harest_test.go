@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestHARESTServesDevicesByAnyName(t *testing.T) {
+	a := newAPI()
+	a.homeAssistant = true
+	a.names = newLiveAliases(aliases{"shelly-plug-a1": "Office Lamp"})
+	now := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	lamp := collector.Device{Instance: "Office Lamp", HostName: "shelly-plug-a1.local."}
+	a.record(collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230.1}, Time: now})
+	a.record(collector.Reading{Device: collector.Device{Instance: "Heater"}, Power: &collector.PowerInfo{CurrentWatts: 1000}, Time: now})
+	a.record(collector.Reading{Device: collector.Device{Instance: "Fridge"}, Err: errors.New("timeout"), Time: now})
+
+	for _, name := range []string{"Office%20Lamp", "office%20lamp", "SHELLY-PLUG-A1", "shelly-plug-a1.local"} {
+		var st haRESTState
+		if code := apiGet(t, a, "/ha/"+name, &st); code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", name, code)
+		}
+		want := haRESTAttributes{UnitOfMeasurement: "W", DeviceClass: "power", FriendlyName: "Office Lamp", Voltage: 230.1, LastSuccess: now}
+		if st.State != 12.5 || st.Attributes != want {
+			t.Fatalf("%s: unexpected state %+v", name, st)
+		}
+	}
+
+	if code := apiGet(t, a, "/ha/fridge", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before a first reading, got %d", code)
+	}
+	var miss struct {
+		Devices []string `json:"devices"`
+	}
+	if code := apiGet(t, a, "/ha/nope", &miss); code != http.StatusNotFound || len(miss.Devices) != 3 || miss.Devices[0] != "Fridge" {
+		t.Fatalf("expected 404 listing the known devices, got %d %+v", code, miss)
+	}
+
+	var total haRESTState
+	if code := apiGet(t, a, "/ha/total", &total); code != http.StatusOK || total.State != 1012.5 {
+		t.Fatalf("expected the total of the last good readings, got %d %+v", code, total)
+	}
+	if total.Attributes.Devices != 3 || total.Attributes.Failed != 1 {
+		t.Fatalf("unexpected total attributes %+v", total.Attributes)
+	}
+}
+
+func TestHARESTOnlyWhenEnabled(t *testing.T) {
+	a := newAPI()
+	a.record(collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: 5}, Time: time.Now()})
+	mux := http.NewServeMux()
+	a.register(mux)
+	if _, pattern := mux.Handler(httptest.NewRequest("GET", "/ha/Lamp", nil)); pattern != "" {
+		t.Fatalf("expected /ha routes without --ha-rest, got %q", pattern)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime/metrics"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"powerusagecollection/internal/promtext"
+	"powerusagecollection/pkg/collector"
+)
+
+// maxDebugErrors is how many of the latest query errors GET /debugz lists.
+const maxDebugErrors = 50
+
+// cycleDurationBuckets are the upper bounds, in seconds, of the poll cycle
+// duration histogram.
+var cycleDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// runtimeSamples are the runtime metrics a healthSample reads.
+var runtimeSamples = []string{"/sched/goroutines:goroutines", "/memory/classes/heap/objects:bytes", "/memory/classes/total:bytes"}
+
+// debugError is a failed query listed by GET /debugz.
+type debugError struct {
+	Time   time.Time `json:"time"`
+	Device string    `json:"device"`
+	Host   string    `json:"host,omitempty"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error"`
+}
+
+// healthSample is the collector's own state as the last poll cycle left
+// it.
+type healthSample struct {
+	Time       time.Time `json:"time"`
+	Goroutines uint64    `json:"goroutines"`
+	// HeapBytes is the memory held by live and not yet swept heap
+	// objects, and MemoryBytes all the memory the runtime has mapped.
+	HeapBytes   uint64 `json:"heapBytes"`
+	MemoryBytes uint64 `json:"memoryBytes"`
+	// CycleSeconds is how long the cycle's queries took.
+	CycleSeconds float64 `json:"cycleSeconds"`
+	// Backlog is how many readings taken between cycles wait for the
+	// next one to reach the sinks.
+	Backlog int                 `json:"backlog"`
+	Pool    collector.PoolStats `json:"pool"`
+	// SinkQueues is how many records each sink holding some has yet to
+	// deliver.
+	SinkQueues map[string]int `json:"sinkQueues,omitempty"`
+}
+
+// debugReport is the body of GET /debugz.
+type debugReport struct {
+	Health           healthSample `json:"health"`
+	DiscoveryEntries int64        `json:"discoveryEntries"`
+	Devices          []apiDevice  `json:"devices"`
+	Errors           []debugError `json:"errors"`
+}
+
+// selfMonitor keeps the collector's health metrics and diagnostics. It is
+// sampled once per poll cycle, off the path of each reading; only the
+// discovery entry count is kept as entries arrive. A nil selfMonitor
+// records nothing.
+type selfMonitor struct {
+	cycles     *histogram
+	discovered atomic.Int64
+
+	mu     sync.Mutex
+	sample healthSample
+	// errors holds the latest query errors, the oldest first.
+	errors []debugError
+}
+
+func newSelfMonitor() *selfMonitor {
+	return &selfMonitor{cycles: newHistogram(cycleDurationBuckets...), errors: []debugError{}}
+}
+
+// entry counts a discovery entry received.
+func (m *selfMonitor) entry() {
+	if m != nil {
+		m.discovered.Add(1)
+	}
+}
+
+// cycle samples the collector's state at the end of a poll cycle, whose
+// queries took the given time, and keeps the cycle's errors.
+func (m *selfMonitor) cycle(now time.Time, took time.Duration, readings []collector.Reading, backlog int, pool *collector.Pool, sinks *sinkSet) {
+	if m == nil {
+		return
+	}
+	m.cycles.observe(took.Seconds())
+	sample := healthSample{Time: now, CycleSeconds: took.Seconds(), Backlog: backlog, SinkQueues: sinks.queued()}
+	if pool != nil {
+		sample.Pool = pool.Stats()
+	}
+	runtime := make([]metrics.Sample, len(runtimeSamples))
+	for i, name := range runtimeSamples {
+		runtime[i].Name = name
+	}
+	metrics.Read(runtime)
+	for _, s := range runtime {
+		if s.Value.Kind() != metrics.KindUint64 {
+			continue
+		}
+		switch s.Name {
+		case runtimeSamples[0]:
+			sample.Goroutines = s.Value.Uint64()
+		case runtimeSamples[1]:
+			sample.HeapBytes = s.Value.Uint64()
+		case runtimeSamples[2]:
+			sample.MemoryBytes = s.Value.Uint64()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample = sample
+	for _, r := range readings {
+		if r.Err == nil {
+			continue
+		}
+		m.errors = append(m.errors, debugError{
+			Time:   r.Time,
+			Device: deviceLabel(r.Device.Instance, r.Device.Channel),
+			Host:   r.Device.HostName,
+			Reason: collector.FailureReason(r.Err),
+			Error:  r.Err.Error(),
+		})
+	}
+	if extra := len(m.errors) - maxDebugErrors; extra > 0 {
+		m.errors = append(m.errors[:0], m.errors[extra:]...)
+	}
+}
+
+// write writes the health metrics, those sampled as of the last cycle
+// once there has been one.
+func (m *selfMonitor) write(pw *promtext.Writer, sinks *sinkSet) {
+	if m == nil {
+		return
+	}
+	m.cycles.write(pw, "power_collector_cycle_duration_seconds", "Time the queries of each poll cycle took.")
+	pw.Family("power_collector_discovery_entries_total", "Devices announced by discovery, repeated announcements included.", promtext.Counter)
+	pw.Sample("power_collector_discovery_entries_total", float64(m.discovered.Load()))
+	if sinks != nil && len(sinks.sinks) > 0 {
+		pw.Family("power_collector_sink_duration_seconds", "Time each sink's writes and flushes took.", promtext.Histogram)
+		for _, n := range sinks.sinks {
+			n.durations.samples(pw, "power_collector_sink_duration_seconds", "sink", n.name)
+		}
+		wroteFamily := false
+		for _, n := range sinks.sinks {
+			spool, ok := n.sink.(*spooledSink)
+			if !ok {
+				continue
+			}
+			if !wroteFamily {
+				pw.Family("power_collector_spool_evicted_total", "Batches evicted from each sink's full --spool-dir spool undelivered.", promtext.Counter)
+				wroteFamily = true
+			}
+			pw.Sample("power_collector_spool_evicted_total", float64(spool.evictions()), "sink", n.name)
+		}
+	}
+
+	m.mu.Lock()
+	sample := m.sample
+	m.mu.Unlock()
+	if sample.Time.IsZero() {
+		return
+	}
+	pw.Family("power_collector_goroutines", "Goroutines running at the end of the last poll cycle.", promtext.Gauge)
+	pw.Sample("power_collector_goroutines", float64(sample.Goroutines))
+	pw.Family("power_collector_heap_bytes", "Heap memory in use at the end of the last poll cycle.", promtext.Gauge)
+	pw.Sample("power_collector_heap_bytes", float64(sample.HeapBytes))
+	pw.Family("power_collector_memory_bytes", "Memory mapped by the Go runtime at the end of the last poll cycle.", promtext.Gauge)
+	pw.Sample("power_collector_memory_bytes", float64(sample.MemoryBytes))
+	pw.Family("power_collector_backlog_readings", "Readings taken between poll cycles waiting to reach the sinks.", promtext.Gauge)
+	pw.Sample("power_collector_backlog_readings", float64(sample.Backlog))
+	pw.Family("power_collector_pool_workers", "Query workers by state at the end of the last poll cycle: busy, idle, or waiting for a free worker.", promtext.Gauge)
+	pw.Sample("power_collector_pool_workers", float64(sample.Pool.Busy), "state", "busy")
+	pw.Sample("power_collector_pool_workers", float64(sample.Pool.Size-sample.Pool.Busy), "state", "idle")
+	pw.Sample("power_collector_pool_workers", float64(sample.Pool.Waiting), "state", "waiting")
+
+	if len(sample.SinkQueues) > 0 {
+		pw.Family("power_collector_sink_queue", "Records each sink held undelivered at the end of the last poll cycle.", promtext.Gauge)
+		for _, name := range sortedKeys(sample.SinkQueues) {
+			pw.Sample("power_collector_sink_queue", float64(sample.SinkQueues[name]), "sink", name)
+		}
+	}
+}
+
+// report returns the body of GET /debugz, with devices as the device
+// table.
+func (m *selfMonitor) report(devices []apiDevice) debugReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return debugReport{
+		Health:           m.sample,
+		DiscoveryEntries: m.discovered.Load(),
+		Devices:          devices,
+		Errors:           slices.Clone(m.errors),
+	}
+}
+
+func (a *api) debugz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.monitor.report(a.deviceList()))
+}
+
+// registerPprof serves the net/http/pprof profiles under /debug/pprof/.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// queuingSink is a fakeSink that reports records held back.
+type queuingSink struct {
+	fakeSink
+	held int
+}
+
+func (s *queuingSink) queued() int { return s.held }
+
+func TestSelfMonitorKeepsLatestErrors(t *testing.T) {
+	m := newSelfMonitor()
+	now := time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC)
+	for i := range maxDebugErrors + 5 {
+		m.cycle(now, time.Second, []collector.Reading{
+			{Device: collector.Device{Instance: fmt.Sprintf("Plug %d", i)}, Err: errors.New("unreachable"), Time: now},
+			{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: 5}, Time: now},
+		}, 0, nil, nil)
+	}
+
+	rep := m.report(nil)
+	if len(rep.Errors) != maxDebugErrors || rep.Errors[0].Device != "Plug 5" || rep.Errors[maxDebugErrors-1].Device != fmt.Sprintf("Plug %d", maxDebugErrors+4) {
+		t.Fatalf("expected the latest %d errors, oldest first, got %+v", maxDebugErrors, rep.Errors)
+	}
+	if rep.Health.Goroutines == 0 || rep.Health.MemoryBytes == 0 || rep.Health.CycleSeconds != 1 {
+		t.Fatalf("expected the runtime sampled with the cycle, got %+v", rep.Health)
+	}
+}
+
+func TestExporterRendersHealth(t *testing.T) {
+	e := newExporter()
+	e.sinks = &sinkSet{}
+	e.sinks.add("influx", &queuingSink{held: 7}, feedFresh)
+	e.monitor = newSelfMonitor()
+	e.monitor.entry()
+	e.monitor.entry()
+
+	body := scrape(t, e)
+	if strings.Contains(body, "power_collector_goroutines") {
+		t.Fatalf("expected no sampled gauges before the first cycle:\n%s", body)
+	}
+	if !strings.Contains(body, "power_collector_discovery_entries_total 2\n") {
+		t.Fatalf("expected the discovery entries counted:\n%s", body)
+	}
+
+	e.sinks.write(context.Background(), newSinkBatch(nil))
+	pool := collector.NewPool(4)
+	e.monitor.cycle(time.Now(), 300*time.Millisecond, nil, 3, pool, e.sinks)
+	body = scrape(t, e)
+	for _, want := range []string{
+		"power_collector_cycle_duration_seconds_bucket{le=\"0.5\"} 1\n",
+		"power_collector_backlog_readings 3\n",
+		"power_collector_pool_workers{state=\"idle\"} 4\n",
+		"power_collector_sink_queue{sink=\"influx\"} 7\n",
+		"power_collector_sink_duration_seconds_count{sink=\"influx\"} 1\n",
+		"# TYPE power_collector_goroutines gauge\n",
+		"# TYPE power_collector_heap_bytes gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestAPIServesDebugz(t *testing.T) {
+	a := newAPI()
+	mux := http.NewServeMux()
+	a.register(mux)
+	for _, path := range []string{"/debugz", "/debug/pprof/"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("expected %s off by default, got %d", path, rec.Code)
+		}
+	}
+
+	a.monitor = newSelfMonitor()
+	a.pprof = true
+	now := time.Now()
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local"}
+	a.record(collector.Reading{Device: plug, Err: errors.New("connection refused"), Time: now})
+	a.monitor.cycle(now, time.Second, []collector.Reading{{Device: plug, Err: errors.New("connection refused"), Time: now}}, 0, collector.NewPool(2), nil)
+
+	var rep debugReport
+	if code := apiGet(t, a, "/debugz", &rep); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(rep.Devices) != 1 || len(rep.Errors) != 1 || rep.Errors[0].Reason != collector.ReasonUnreachable || rep.Health.Pool.Size != 2 {
+		t.Fatalf("expected the device table, pool and errors, got %+v", rep)
+	}
+
+	mux = http.NewServeMux()
+	a.register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine") {
+		t.Fatalf("expected the pprof index with --enable-pprof, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// helpGroup is a section of --help and the flags listed under it.
+type helpGroup struct {
+	title string
+	flags []string
+}
+
+// helpGroups sorts every flag into a --help section, in the order shown.
+var helpGroups = []helpGroup{
+	{"General", []string{
+		"config", "print-config", "version", "log-level", "log-format", "verbose", "quiet",
+	}},
+	{"Discovery", []string{
+		"service", "domain", "interface", "ipv4-only", "ipv6-only", "prefer-ipv6", "timeout", "settle",
+		"no-discovery", "require-discovery", "devices", "cache", "use-cache", "cache-ttl",
+		"no-host-lookup", "scan-cidr", "scan-interval", "scan-timeout", "match", "exclude", "require-txt",
+		"vendor-db", "min-firmware", "expected-firmware", "allow-duplicates", "group-by-txt-key", "list", "print-unaliased",
+	}},
+	{"Querying", []string{
+		"interval", "adaptive-poll", "interval-min", "interval-max", "adaptive-threshold", "count", "duration", "concurrency", "driver", "no-probe", "connect-by", "scheme", "port", "power-path", "url-template",
+		"http-timeout", "http-header-timeout", "http-body-timeout", "http-user", "http-pass", "http-token", "ca-cert", "insecure-skip-verify",
+		"retries", "retry-backoff", "max-retry-after", "rate-limit", "rate-limit-burst",
+		"per-device-min-interval", "min-poll-gap", "max-rate-limit-interval", "max-response-bytes",
+		"fail-threshold", "offline-threshold", "offline-poll-interval", "carry-last", "max-gap",
+		"watts-field", "voltage-field", "amps-field", "pf-field", "frequency-field",
+		"phase-watts-field", "phase-voltage-field", "phase-amps-field", "phase-pf-field",
+		"esphome-sensor", "timestamp-layout", "max-timestamp-skew", "auto-unit", "max-watts", "reject-negative", "voltage-range",
+		"max-power-mismatch", "anomaly-mode", "include-suspect", "trace-http", "record", "replay", "replay-speed",
+	}},
+	{"Output", []string{
+		"format", "json", "output", "no-color", "color-warn-watts", "color-high-watts", "watch", "sort", "width", "timezone", "time-format",
+		"only-changes", "change-threshold", "heartbeat", "tariff", "state", "standby-threshold", "stats-window",
+		"stats-timezone", "report", "report-interval", "fail-on-any-error",
+	}},
+	{"Sinks", []string{
+		"listen", "socket-mode", "scrape-on-demand", "ingest", "ingest-token", "enable-pprof", "ha-rest", "metric-staleness", "metric-device-ttl",
+		"pushgateway-url", "pushgateway-collector", "influx-url", "influx-org", "influx-bucket", "influx-token",
+		"mqtt-broker", "mqtt-topic", "mqtt-client-id", "mqtt-username", "mqtt-password", "mqtt-qos",
+		"mqtt-retain", "mqtt-ca-cert", "mqtt-insecure-skip-verify", "ha-discovery", "ha-prefix", "ha-cleanup",
+		"graphite-addr", "graphite-prefix", "graphite-buffer", "statsd-addr", "statsd-format",
+		"otlp-endpoint", "otlp-headers", "otlp-tls", "otlp-ca-cert", "otlp-insecure-skip-verify",
+		"webhook-url", "webhook-header", "sqlite", "sqlite-retention",
+		"jsonl", "jsonl-max-size", "jsonl-keep", "jsonl-gzip", "spool-dir", "spool-max-size",
+		"alert-above", "alert-clear-below", "alert-below", "alert-clear-above", "alert-interval", "alert-webhook",
+	}},
+}
+
+// commandsHelp lists the subcommands in --help.
+const commandsHelp = `
+Commands:
+  completion bash|zsh|fish  print a shell completion script
+  serve-mock                serve fake devices for testing (see serve-mock --help)
+  replay-jsonl FILE         write a --jsonl file through the configured sinks
+  discover                  print the discovered devices as a --devices file
+  collect                   query the devices of --devices, or stdin, without discovery
+`
+
+// examplesHelp shows typical invocations in --help.
+const examplesHelp = `
+Examples:
+  # Read every device on the network once
+  %[1]s
+
+  # Poll every 30s and serve Prometheus metrics on port 9109
+  %[1]s --interval 30s --listen :9109
+
+  # Publish to MQTT only when a reading moves by 5%%, at least every 5m
+  %[1]s --interval 10s --mqtt-broker tcp://broker:1883 --only-changes --change-threshold 5%% --heartbeat 5m
+
+  # Discover once, then poll the saved inventory without mDNS
+  %[1]s discover > devices.json && %[1]s collect --devices devices.json --interval 30s
+`
+
+// usage prints the grouped flag defaults, the subcommands, examples and
+// the exit statuses.
+func usage() {
+	writeUsage(flag.CommandLine.Output(), flag.CommandLine)
+}
+
+func writeUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s [flags]\n       %s <command> [args]\n", fs.Name(), fs.Name())
+	for _, g := range helpGroups {
+		fmt.Fprintf(w, "\n%s:\n", g.title)
+		for _, name := range g.flags {
+			if f := fs.Lookup(name); f != nil {
+				writeFlagHelp(w, f)
+			}
+		}
+	}
+	fmt.Fprint(w, commandsHelp)
+	fmt.Fprintf(w, examplesHelp, fs.Name())
+	fmt.Fprint(w, exitStatusHelp)
+}
+
+// writeFlagHelp describes f the way flag.PrintDefaults does.
+func writeFlagHelp(w io.Writer, f *flag.Flag) {
+	kind, help := flag.UnquoteUsage(f)
+	line := "  --" + f.Name
+	if kind != "" {
+		line += " " + kind
+	}
+	line += "\n    \t" + strings.ReplaceAll(help, "\n", "\n    \t")
+	switch f.DefValue {
+	case "", "0", "0s", "false", "[]":
+	default:
+		if kind == "string" {
+			line += fmt.Sprintf(" (default %q)", f.DefValue)
+		} else {
+			line += fmt.Sprintf(" (default %v)", f.DefValue)
+		}
+	}
+	fmt.Fprintln(w, line)
+}
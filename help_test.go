@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestHelpGroupsCoverEveryFlag(t *testing.T) {
+	fs := flag.NewFlagSet("powercollector", flag.ContinueOnError)
+	registerFlags(fs, new(options))
+	grouped := make(map[string]string)
+	for _, g := range helpGroups {
+		for _, name := range g.flags {
+			if fs.Lookup(name) == nil {
+				t.Fatalf("%s lists unknown flag --%s", g.title, name)
+			}
+			if other, ok := grouped[name]; ok {
+				t.Fatalf("--%s is listed under both %s and %s", name, other, g.title)
+			}
+			grouped[name] = g.title
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := grouped[f.Name]; !ok {
+			t.Errorf("--%s is in no --help section", f.Name)
+		}
+	})
+}
+
+func TestWriteUsage(t *testing.T) {
+	fs := flag.NewFlagSet("powercollector", flag.ContinueOnError)
+	registerFlags(fs, new(options))
+	var buf bytes.Buffer
+	writeUsage(&buf, fs)
+	got := buf.String()
+	for _, want := range []string{
+		"\nDiscovery:\n", "\nQuerying:\n", "\nOutput:\n", "\nSinks:\n",
+		"  --format string\n    \tOutput format: text, json, csv, influx, table (default \"text\")\n",
+		"  --json\n",
+		"powercollector --interval 30s --listen :9109",
+		"--change-threshold 5% ",
+		"completion bash|zsh|fish",
+		"Exit status:",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in the help:\n%s", want, got)
+		}
+	}
+	if strings.Index(got, "--service") > strings.Index(got, "--interval") {
+		t.Fatal("expected the discovery flags before the querying ones")
+	}
+}
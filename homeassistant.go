@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"powerusagecollection/internal/mqtt"
+)
+
+// defaultHAPrefix is Home Assistant's default MQTT discovery prefix.
+const defaultHAPrefix = "homeassistant"
+
+// haSensor describes one Home Assistant sensor entity derived from a reading.
+type haSensor struct {
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+	field       string
+	present     func(r deviceResult) bool
+}
+
+var haSensors = []haSensor{
+	{key: "power", name: "Power", deviceClass: "power", unit: "W", field: "currentWatts", present: func(r deviceResult) bool { return true }},
+	{key: "voltage", name: "Voltage", deviceClass: "voltage", unit: "V", field: "voltage", present: func(r deviceResult) bool { return r.Voltage != 0 }},
+	{key: "amperage", name: "Current", deviceClass: "current", unit: "A", field: "amperage", present: func(r deviceResult) bool { return r.Amperage != 0 }},
+}
+
+// haConfig is a Home Assistant MQTT discovery config message.
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	ValueTemplate     string   `json:"value_template"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	SWVersion   string   `json:"sw_version,omitempty"`
+}
+
+// haNodeID derives a stable Home Assistant identifier from the device's
+// instance name, hostname and channel so re-runs update the same entities.
+func haNodeID(r deviceResult) string {
+	id := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '_', c == '-':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		}
+		return '_'
+	}, strings.ReplaceAll(resultKey(r), "|", "_"))
+	return "powerusagecollection_" + id
+}
+
+// haConfigTopic returns the discovery topic for sensor on the device in r.
+func haConfigTopic(prefix string, r deviceResult, sensor haSensor) string {
+	return prefix + "/sensor/" + haNodeID(r) + "/" + sensor.key + "/config"
+}
+
+// haMessages returns the discovery config messages for every sensor the
+// reading in r supports.
+func haMessages(prefix, stateTopic string, r deviceResult) []mqtt.Message {
+	nodeID := haNodeID(r)
+	var msgs []mqtt.Message
+	for _, sensor := range haSensors {
+		if !sensor.present(r) {
+			continue
+		}
+		payload, err := json.Marshal(haConfig{
+			Name:              sensor.name,
+			UniqueID:          nodeID + "_" + sensor.key,
+			StateTopic:        stateTopic,
+			DeviceClass:       sensor.deviceClass,
+			StateClass:        "measurement",
+			UnitOfMeasurement: sensor.unit,
+			ValueTemplate:     "{{ value_json." + sensor.field + " }}",
+			Device:            haDevice{Identifiers: []string{nodeID}, Name: deviceLabel(r.Instance, r.Channel), SWVersion: r.Firmware},
+		})
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, mqtt.Message{Topic: haConfigTopic(prefix, r, sensor), Payload: payload, QoS: 1, Retain: true})
+	}
+	return msgs
+}
+
+// announce publishes discovery configs for sensors of r not yet announced.
+func (s *mqttSink) announce(ctx context.Context, client mqttPublisher, r deviceResult) error {
+	for _, msg := range haMessages(s.haPrefix, mqttTopic(s.topic, r), r) {
+		s.mu.Lock()
+		done := s.announced[msg.Topic]
+		s.mu.Unlock()
+		if done {
+			continue
+		}
+		if err := client.Publish(ctx, msg); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.announced[msg.Topic] = true
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// removeAnnouncements publishes empty retained configs for every announced
+// sensor, which makes Home Assistant delete the entities. The caller must
+// hold s.mu.
+func (s *mqttSink) removeAnnouncements(ctx context.Context, client mqttPublisher) {
+	for topic := range s.announced {
+		client.Publish(ctx, mqtt.Message{Topic: topic, QoS: 1, Retain: true})
+		delete(s.announced, topic)
+	}
+}
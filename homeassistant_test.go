@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestHANodeIDIsStable(t *testing.T) {
+	r := deviceResult{Instance: "Desk Lamp", HostName: "lamp.local"}
+	if got := haNodeID(r); got != "powerusagecollection_desk_lamp_lamp_local" {
+		t.Fatalf("unexpected node id %q", got)
+	}
+}
+
+func TestHAMessagesDeclareSensorsPresentInReading(t *testing.T) {
+	r := deviceResult{Instance: "Lamp", HostName: "lamp.local", Firmware: "1.2", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230}}
+	msgs := haMessages("homeassistant", "power/Lamp", r)
+	if len(msgs) != 2 {
+		t.Fatalf("expected power and voltage sensors, got %d messages", len(msgs))
+	}
+
+	if msgs[0].Topic != "homeassistant/sensor/powerusagecollection_lamp_lamp_local/power/config" || !msgs[0].Retain {
+		t.Fatalf("unexpected config message %+v", msgs[0])
+	}
+	var cfg haConfig
+	if err := json.Unmarshal(msgs[0].Payload, &cfg); err != nil {
+		t.Fatalf("expected JSON config, got error: %v", err)
+	}
+	if cfg.DeviceClass != "power" || cfg.UnitOfMeasurement != "W" || cfg.StateTopic != "power/Lamp" ||
+		cfg.UniqueID != "powerusagecollection_lamp_lamp_local_power" || cfg.ValueTemplate != "{{ value_json.currentWatts }}" {
+		t.Fatalf("unexpected power config %+v", cfg)
+	}
+	if cfg.Device.Name != "Lamp" || cfg.Device.SWVersion != "1.2" {
+		t.Fatalf("unexpected device block %+v", cfg.Device)
+	}
+
+	if err := json.Unmarshal(msgs[1].Payload, &cfg); err != nil || cfg.DeviceClass != "voltage" || cfg.UnitOfMeasurement != "V" {
+		t.Fatalf("unexpected voltage config %+v (%v)", cfg, err)
+	}
+}
+
+func TestMQTTSinkAnnouncesOnceAndCleansUp(t *testing.T) {
+	pub := newFakePublisher()
+	sink := &mqttSink{
+		topic:     "power/{instance}",
+		haPrefix:  defaultHAPrefix,
+		haCleanup: true,
+		announced: make(map[string]bool),
+		dial:      func(context.Context) (mqttPublisher, error) { return pub, nil },
+	}
+	r := deviceResult{Instance: "Lamp", HostName: "lamp.local", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}}
+
+	sink.Write(context.Background(), []deviceResult{r})
+	sink.Write(context.Background(), []deviceResult{r})
+	if len(pub.messages) != 3 {
+		t.Fatalf("expected one config and two readings, got %d messages", len(pub.messages))
+	}
+
+	sink.Close()
+	last := pub.messages[len(pub.messages)-1]
+	if last.Topic != haConfigTopic(defaultHAPrefix, r, haSensors[0]) || len(last.Payload) != 0 || !last.Retain {
+		t.Fatalf("expected empty retained config on close, got %+v", last)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// hostLookupTimeout bounds each lookup of a host name that mDNS announced
+// without address records.
+const hostLookupTimeout = 2 * time.Second
+
+// hostLookup finds addresses for devices announced with a host name but no
+// address records, through the system resolver, which answers .local
+// names with Avahi or systemd-resolved where they run. Each host name is
+// looked up once per session. A nil hostLookup finds nothing.
+type hostLookup struct {
+	lookup  func(ctx context.Context, host string) ([]netip.Addr, error)
+	timeout time.Duration
+
+	ipv4Only   bool
+	ipv6Only   bool
+	preferIPv6 bool
+
+	mu sync.Mutex
+	// addrs holds each host name's addresses, empty when its lookup
+	// failed.
+	addrs map[string][]string
+}
+
+func newHostLookup(o options) *hostLookup {
+	return &hostLookup{
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		timeout:    hostLookupTimeout,
+		ipv4Only:   o.ipv4Only,
+		ipv6Only:   o.ipv6Only,
+		preferIPv6: o.preferIPv6,
+		addrs:      make(map[string][]string),
+	}
+}
+
+// resolve returns d with the addresses of its host name when it has no
+// address, or d unchanged when the lookup finds none.
+func (h *hostLookup) resolve(ctx context.Context, d collector.Device) collector.Device {
+	if h == nil || d.Address != "" || d.HostName == "" {
+		return d
+	}
+	addrs := h.addresses(ctx, d.HostName)
+	if len(addrs) == 0 {
+		return d
+	}
+	d.Address, d.Addresses = addrs[0], addrs
+	return d
+}
+
+// addresses returns host's usable addresses, the preferred family first,
+// looking them up unless already known.
+func (h *hostLookup) addresses(ctx context.Context, host string) []string {
+	h.mu.Lock()
+	addrs, ok := h.addrs[host]
+	h.mu.Unlock()
+	if ok {
+		return addrs
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	ips, err := h.lookup(lookupCtx, host)
+	if err != nil && ctx.Err() != nil {
+		// Cut short by shutdown: try again another time.
+		return nil
+	}
+	addrs = h.pick(ips)
+	switch {
+	case err != nil:
+		slog.Debug("host lookup failed", "host", host, "error", err)
+	case len(addrs) == 0:
+		slog.Debug("host lookup found no usable address", "host", host, "addresses", ips)
+	default:
+		slog.Info("resolved host without mDNS address records", "host", host, "address", addrs[0])
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs[host] = addrs
+	return addrs
+}
+
+// pick orders ips by the preferred family, leaving out any the family
+// flags exclude.
+func (h *hostLookup) pick(ips []netip.Addr) []string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		switch {
+		case ip.Is4() && !h.ipv6Only:
+			v4 = append(v4, ip.String())
+		case ip.Is6() && !h.ipv4Only:
+			v6 = append(v6, ip.String())
+		}
+	}
+	if h.preferIPv6 {
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
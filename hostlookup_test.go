@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// fakeHostLookup returns a hostLookup answering from hosts and counting
+// its lookups.
+func fakeHostLookup(hosts map[string][]netip.Addr) (*hostLookup, *int) {
+	h := newHostLookup(options{})
+	var mu sync.Mutex
+	calls := new(int)
+	h.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		mu.Lock()
+		*calls++
+		mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if addrs, ok := hosts[host]; ok {
+			return addrs, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	return h, calls
+}
+
+func TestHostLookupResolvesDevicesWithoutAddress(t *testing.T) {
+	h, calls := fakeHostLookup(map[string][]netip.Addr{
+		"plug.local": {netip.MustParseAddr("fe80::1"), netip.MustParseAddr("192.168.1.20")},
+	})
+	ctx := context.Background()
+
+	d := h.resolve(ctx, collector.Device{Instance: "Plug", HostName: "plug.local"})
+	if d.Address != "192.168.1.20" || len(d.Addresses) != 2 {
+		t.Fatalf("expected the IPv4 address first, got %q %v", d.Address, d.Addresses)
+	}
+	h.resolve(ctx, collector.Device{Instance: "Plug", HostName: "plug.local"})
+	if *calls != 1 {
+		t.Fatalf("expected the answer cached, got %d lookups", *calls)
+	}
+
+	if d := h.resolve(ctx, collector.Device{HostName: "gone.local"}); d.Address != "" {
+		t.Fatalf("expected no address for an unknown host, got %q", d.Address)
+	}
+	h.resolve(ctx, collector.Device{HostName: "gone.local"})
+	if *calls != 2 {
+		t.Fatalf("expected the failure cached, got %d lookups", *calls)
+	}
+
+	if d := h.resolve(ctx, collector.Device{HostName: "plug.local", Address: "10.0.0.1"}); d.Address != "10.0.0.1" || *calls != 2 {
+		t.Fatalf("expected devices with an address left alone, got %q after %d lookups", d.Address, *calls)
+	}
+	var none *hostLookup
+	if d := none.resolve(ctx, collector.Device{HostName: "plug.local"}); d.Address != "" {
+		t.Fatal("expected a nil hostLookup to resolve nothing")
+	}
+}
+
+func TestHostLookupHonoursFamilyFlags(t *testing.T) {
+	h, _ := fakeHostLookup(map[string][]netip.Addr{
+		"plug.local": {netip.MustParseAddr("192.168.1.20"), netip.MustParseAddr("2001:db8::20")},
+	})
+	h.preferIPv6 = true
+	if d := h.resolve(context.Background(), collector.Device{HostName: "plug.local"}); d.Address != "2001:db8::20" {
+		t.Fatalf("expected the IPv6 address preferred, got %q", d.Address)
+	}
+
+	h, _ = fakeHostLookup(map[string][]netip.Addr{"v6.local": {netip.MustParseAddr("2001:db8::21")}})
+	h.ipv4Only = true
+	if d := h.resolve(context.Background(), collector.Device{HostName: "v6.local"}); d.Address != "" {
+		t.Fatalf("expected IPv6 addresses left out with --ipv4-only, got %q", d.Address)
+	}
+}
+
+func TestHostLookupRetriesAfterCancellation(t *testing.T) {
+	h, calls := fakeHostLookup(map[string][]netip.Addr{"plug.local": {netip.MustParseAddr("192.168.1.20")}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if d := h.resolve(ctx, collector.Device{HostName: "plug.local"}); d.Address != "" {
+		t.Fatalf("expected no address once cancelled, got %q", d.Address)
+	}
+	if d := h.resolve(context.Background(), collector.Device{HostName: "plug.local"}); d.Address != "192.168.1.20" || *calls != 2 {
+		t.Fatalf("expected a fresh lookup after cancellation, got %q after %d lookups", d.Address, *calls)
+	}
+}
+
+func TestQueryDeviceLooksUpHostName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":7}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	h, _ := fakeHostLookup(map[string][]netip.Addr{"plug.local": {netip.MustParseAddr(addr.IP.String())}})
+	opts := options{hosts: h, httpFetcher: &collector.Fetcher{Port: addr.Port}}
+	d := collector.NewDevice(&collector.ServiceEntry{Instance: "Plug", HostName: "plug.local."})
+
+	result := queryDevice(context.Background(), d, opts)
+	if result.Error != "" || result.PowerInfo == nil || result.CurrentWatts != 7 {
+		t.Fatalf("expected a reading through the looked-up address, got %+v", result)
+	}
+	if result.Address != addr.IP.String() {
+		t.Fatalf("expected the looked-up address in the result, got %q", result.Address)
+	}
+
+	opts.hosts = nil
+	if result := queryDevice(context.Background(), d, opts); result.Error != "no usable address available" {
+		t.Fatalf("expected the device skipped with --no-host-lookup, got %+v", result)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	formatInflux = "influx"
+
+	// influxMaxBatch is the number of points that forces a write before
+	// the end of the poll cycle.
+	influxMaxBatch = 5000
+	// influxAttempts is how many times a batch write is tried.
+	influxAttempts = 3
+)
+
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// influxLine formats r as a line protocol point, or returns an empty string
+// when r carries no reading.
+func influxLine(r deviceResult) string {
+	if r.PowerInfo == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("power,device=")
+	b.WriteString(influxTagEscaper.Replace(r.Instance))
+	if r.HostName != "" {
+		b.WriteString(",host=")
+		b.WriteString(influxTagEscaper.Replace(r.HostName))
+	}
+	if r.Channel != "" {
+		b.WriteString(",channel=")
+		b.WriteString(influxTagEscaper.Replace(r.Channel))
+	}
+	if r.Source != "" {
+		b.WriteString(",source=")
+		b.WriteString(influxTagEscaper.Replace(r.Source))
+	}
+	b.WriteString(" watts=")
+	b.WriteString(formatFloat(r.CurrentWatts))
+	if r.Voltage != 0 {
+		b.WriteString(",voltage=")
+		b.WriteString(formatFloat(r.Voltage))
+	}
+	for _, f := range []struct {
+		key   string
+		value float64
+	}{{"amperage", r.Amperage}, {"power_factor", r.PowerFactor}, {"frequency_hz", r.FrequencyHz}, {"apparent_va", r.ApparentVA}, {"reactive_var", r.ReactiveVAr}} {
+		if f.value != 0 {
+			b.WriteString("," + f.key + "=")
+			b.WriteString(formatFloat(f.value))
+		}
+	}
+	if !r.Time.IsZero() {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(r.Time.UnixNano(), 10))
+	}
+	return b.String()
+}
+
+// influxWriter batches points and writes them to the InfluxDB v2 write API.
+type influxWriter struct {
+	url     string
+	token   string
+	client  *http.Client
+	backoff time.Duration
+
+	mu    sync.Mutex
+	batch []string
+}
+
+// newInfluxWriter returns a writer for the bucket at the InfluxDB server
+// baseURL.
+func newInfluxWriter(baseURL, token, org, bucket string) (*influxWriter, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid influx url %q", baseURL)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("--influx-bucket is required with --influx-url")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	q := url.Values{"bucket": {bucket}, "precision": {"ns"}}
+	if org != "" {
+		q.Set("org", org)
+	}
+	u.RawQuery = q.Encode()
+
+	return &influxWriter{
+		url:     u.String(),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+	}, nil
+}
+
+// add queues the point for r, writing the batch early once it is full.
+func (w *influxWriter) add(ctx context.Context, r deviceResult) {
+	line := influxLine(r)
+	if line == "" {
+		return
+	}
+
+	w.mu.Lock()
+	w.batch = append(w.batch, line)
+	full := len(w.batch) >= influxMaxBatch
+	w.mu.Unlock()
+
+	if full {
+		w.flushAndLog(ctx)
+	}
+}
+
+// queued returns how many points wait in the batch.
+func (w *influxWriter) queued() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.batch)
+}
+
+// Write queues the points for results and writes the batch.
+func (w *influxWriter) Write(ctx context.Context, results []deviceResult) error {
+	for _, r := range results {
+		w.add(ctx, r)
+	}
+	return w.flush(ctx)
+}
+
+// Flush writes the pending batch.
+func (w *influxWriter) Flush(ctx context.Context) error {
+	return w.flush(ctx)
+}
+
+// Close does nothing; every request is made and closed by flush.
+func (w *influxWriter) Close() error {
+	return nil
+}
+
+// flushAndLog writes the pending batch, logging any failure.
+func (w *influxWriter) flushAndLog(ctx context.Context) {
+	if err := w.flush(ctx); err != nil {
+		slog.Error("influx write error", "error", err)
+	}
+}
+
+// flush writes the pending batch, retrying with exponential backoff. The
+// batch is dropped once every attempt has failed.
+func (w *influxWriter) flush(ctx context.Context) error {
+	w.mu.Lock()
+	batch := w.batch
+	w.batch = nil
+	w.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body := []byte(strings.Join(batch, "\n") + "\n")
+	backoff := w.backoff
+	var err error
+	for attempt := 1; attempt <= influxAttempts; attempt++ {
+		if err = w.post(ctx, body); err == nil {
+			return nil
+		}
+		if attempt == influxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("dropping %d points: %w", len(batch), ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("dropping %d points after %d attempts: %w", len(batch), influxAttempts, err)
+}
+
+func (w *influxWriter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestInfluxLine(t *testing.T) {
+	r := deviceResult{
+		Instance:  "Lamp",
+		HostName:  "demo.local",
+		PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230.1},
+		Time:      time.Unix(1706886245, 0),
+	}
+	if got, want := influxLine(r), "power,device=Lamp,host=demo.local watts=12.5,voltage=230.1 1706886245000000000"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestInfluxLineElectricalFields(t *testing.T) {
+	r := deviceResult{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5, PowerFactor: 0.94, FrequencyHz: 50, ApparentVA: 13.3, ReactiveVAr: 4.5}}
+	if got, want := influxLine(r), "power,device=Lamp watts=12.5,power_factor=0.94,frequency_hz=50,apparent_va=13.3,reactive_var=4.5"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestInfluxLineEscapesTags(t *testing.T) {
+	r := deviceResult{Instance: "Office Plug, left=1", PowerInfo: &collector.PowerInfo{CurrentWatts: 3}}
+	if got, want := influxLine(r), `power,device=Office\ Plug\,\ left\=1 watts=3`; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestInfluxLineSkipsErrors(t *testing.T) {
+	if got := influxLine(deviceResult{Instance: "Lamp", Error: "timeout"}); got != "" {
+		t.Fatalf("expected no point for a failed reading, got %q", got)
+	}
+}
+
+func TestInfluxWriterPostsBatch(t *testing.T) {
+	var mu sync.Mutex
+	var gotBody, gotAuth, gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		gotBody, gotAuth, gotQuery = string(body), r.Header.Get("Authorization"), r.URL.RawQuery
+		if r.URL.Path != "/api/v2/write" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w, err := newInfluxWriter(server.URL, "secret", "home", "power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.add(context.Background(), deviceResult{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}})
+	w.add(context.Background(), deviceResult{Instance: "Plug", PowerInfo: &collector.PowerInfo{CurrentWatts: 2}})
+	if err := w.flush(context.Background()); err != nil {
+		t.Fatalf("expected flush to succeed, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if gotBody != "power,device=Lamp watts=1\npower,device=Plug watts=2\n" {
+		t.Fatalf("unexpected body %q", gotBody)
+	}
+	if gotAuth != "Token secret" {
+		t.Fatalf("unexpected Authorization header %q", gotAuth)
+	}
+	if !strings.Contains(gotQuery, "bucket=power") || !strings.Contains(gotQuery, "org=home") || !strings.Contains(gotQuery, "precision=ns") {
+		t.Fatalf("unexpected query %q", gotQuery)
+	}
+}
+
+func TestInfluxWriterRetriesFailedWrites(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w, _ := newInfluxWriter(server.URL, "", "", "power")
+	w.backoff = time.Millisecond
+	w.add(context.Background(), deviceResult{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}})
+	if err := w.flush(context.Background()); err != nil {
+		t.Fatalf("expected third attempt to succeed, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestInfluxWriterGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	w, _ := newInfluxWriter(server.URL, "", "", "power")
+	w.backoff = time.Millisecond
+	w.add(context.Background(), deviceResult{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}})
+	err := w.flush(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") || !strings.Contains(err.Error(), "bad token") {
+		t.Fatalf("expected final error after retries, got %v", err)
+	}
+}
+
+func TestNewInfluxWriterValidates(t *testing.T) {
+	if _, err := newInfluxWriter("not a url", "", "", "power"); err == nil {
+		t.Fatal("expected invalid URL to be rejected")
+	}
+	if _, err := newInfluxWriter("http://influx:8086", "", "", ""); err == nil {
+		t.Fatal("expected missing bucket to be rejected")
+	}
+}
+
+func TestOutputInfluxFormat(t *testing.T) {
+	var buf strings.Builder
+	out := newOutput(&buf, formatInflux)
+	writeReading(out, collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: 4}, Time: time.Unix(1, 0)}, nil, nil, nil)
+	writeReading(out, collector.Reading{Device: collector.Device{Instance: "Plug"}, Err: io.EOF, Time: time.Unix(1, 0)}, nil, nil, nil)
+
+	if got, want := buf.String(), "power,device=Lamp watts=4 1000000000\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
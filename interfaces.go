@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// interfaceFlag is a repeatable flag.Value naming network interfaces. Each
+// value may also be a comma-separated list, as from the environment or a
+// config file.
+type interfaceFlag []string
+
+func (f *interfaceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *interfaceFlag) Set(s string) error {
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*f = append(*f, name)
+		}
+	}
+	return nil
+}
+
+// browseInterfaces returns the interfaces named by --interface, or nil to
+// browse on the default ones.
+func browseInterfaces(names []string) ([]net.Interface, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	available, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	return lookupInterfaces(names, available)
+}
+
+// lookupInterfaces returns the named interfaces from available. An
+// unknown name, or an interface that cannot carry multicast, is an error
+// listing the interfaces that can.
+func lookupInterfaces(names []string, available []net.Interface) ([]net.Interface, error) {
+	var ifaces []net.Interface
+	for _, name := range names {
+		i := -1
+		for j, ifi := range available {
+			if ifi.Name == name {
+				i = j
+				break
+			}
+		}
+		switch {
+		case i < 0:
+			return nil, fmt.Errorf("unknown interface %q (available: %s)", name, multicastNames(available))
+		case available[i].Flags&net.FlagMulticast == 0:
+			return nil, fmt.Errorf("interface %q does not support multicast (available: %s)", name, multicastNames(available))
+		}
+		ifaces = append(ifaces, available[i])
+	}
+	return ifaces, nil
+}
+
+// multicastNames lists the names of the multicast-capable interfaces.
+func multicastNames(ifaces []net.Interface) string {
+	var names []string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagMulticast != 0 {
+			names = append(names, ifi.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestInterfaceFlag(t *testing.T) {
+	var f interfaceFlag
+	f.Set("eth1")
+	f.Set(" wlan0, eth2 ,")
+	if got := f.String(); got != "eth1,wlan0,eth2" {
+		t.Fatalf("unexpected interfaces %q", got)
+	}
+}
+
+func TestLookupInterfaces(t *testing.T) {
+	available := []net.Interface{
+		{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast},
+		{Index: 3, Name: "eth1", Flags: net.FlagUp | net.FlagMulticast},
+	}
+	ifaces, err := lookupInterfaces([]string{"eth1"}, available)
+	if err != nil || len(ifaces) != 1 || ifaces[0].Index != 3 {
+		t.Fatalf("expected eth1, got %+v (%v)", ifaces, err)
+	}
+
+	_, err = lookupInterfaces([]string{"eth1", "tun0"}, available)
+	if err == nil || !strings.Contains(err.Error(), `"tun0"`) || !strings.Contains(err.Error(), "available: eth0, eth1") {
+		t.Fatalf("expected an unknown interface error listing eth0 and eth1, got %v", err)
+	}
+	if _, err := lookupInterfaces([]string{"lo"}, available); err == nil || !strings.Contains(err.Error(), "multicast") {
+		t.Fatalf("expected a non-multicast interface to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,380 @@
+// Package mqtt implements the small subset of MQTT 3.1.1 needed to publish
+// readings: connecting, publishing at QoS 0 or 1, and keepalive pings.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Packet types used by the client.
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typePingreq    = 12
+	typePingresp   = 13
+	typeDisconnect = 14
+)
+
+// ErrClosed is returned when publishing on a closed or broken connection.
+var ErrClosed = errors.New("mqtt: connection closed")
+
+// Options configures a connection to a broker.
+type Options struct {
+	// Broker is the broker URL, e.g. tcp://192.168.1.10:1883 or
+	// ssl://broker:8883.
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+	// KeepAlive is the interval between pings. Zero disables keepalive.
+	KeepAlive time.Duration
+	// Will, when set, is published by the broker if the client drops.
+	Will *Message
+}
+
+// Message is an application message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Client is a connection to an MQTT broker. It is safe for concurrent use.
+type Client struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint16
+	acks    map[uint16]chan struct{}
+	err     error
+	done    chan struct{}
+}
+
+// Dial connects to the broker and completes the MQTT handshake.
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	u, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: invalid broker %q: %w", opts.Broker, err)
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		cfg := opts.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		td := &tls.Dialer{NetDialer: dialer, Config: cfg}
+		conn, err = td.DialContext(ctx, "tcp", hostPort(u, "8883"))
+	default:
+		return nil, fmt.Errorf("mqtt: unsupported broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := handshake(ctx, conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func handshake(ctx context.Context, conn net.Conn, opts Options) (*Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(connectPacket(opts)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	typ, _, body, err := readPacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: read CONNACK: %w", err)
+	}
+	if typ != typeConnack || len(body) != 2 {
+		return nil, fmt.Errorf("mqtt: expected CONNACK, got packet type %d", typ)
+	}
+	if body[1] != 0 {
+		return nil, fmt.Errorf("mqtt: connection refused: %s", connackReason(body[1]))
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Client{conn: conn, acks: make(map[uint16]chan struct{}), done: make(chan struct{})}
+	go c.readLoop(r)
+	if opts.KeepAlive > 0 {
+		go c.pingLoop(opts.KeepAlive)
+	}
+	return c, nil
+}
+
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("code %d", code)
+}
+
+// Publish sends msg. At QoS 1 it waits for the broker's acknowledgement.
+func (c *Client) Publish(ctx context.Context, msg Message) error {
+	if msg.QoS > 1 {
+		return fmt.Errorf("mqtt: QoS %d not supported", msg.QoS)
+	}
+
+	var id uint16
+	var ack chan struct{}
+	if msg.QoS == 1 {
+		c.mu.Lock()
+		if c.err != nil {
+			c.mu.Unlock()
+			return c.err
+		}
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		id = c.nextID
+		ack = make(chan struct{})
+		c.acks[id] = ack
+		c.mu.Unlock()
+	}
+
+	if err := c.write(publishPacket(msg, id)); err != nil {
+		if ack != nil {
+			c.mu.Lock()
+			delete(c.acks, id)
+			c.mu.Unlock()
+		}
+		return err
+	}
+	if ack == nil {
+		return nil
+	}
+
+	select {
+	case <-ack:
+		return nil
+	case <-c.done:
+		return c.closedErr()
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.acks, id)
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Done is closed once the connection has failed or been closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close sends DISCONNECT and closes the connection.
+func (c *Client) Close() error {
+	c.write([]byte{typeDisconnect << 4, 0})
+	c.fail(ErrClosed)
+	return nil
+}
+
+func (c *Client) write(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.closedErr(); err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(b); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	for {
+		typ, _, body, err := readPacket(r)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+		if typ == typePuback && len(body) >= 2 {
+			id := uint16(body[0])<<8 | uint16(body[1])
+			c.mu.Lock()
+			if ack, ok := c.acks[id]; ok {
+				close(ack)
+				delete(c.acks, id)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *Client) pingLoop(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write([]byte{typePingreq << 4, 0}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func connectPacket(opts Options) []byte {
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = appendString(payload, opts.ClientID)
+	if opts.Will != nil {
+		flags |= 0x04 | opts.Will.QoS<<3
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+		payload = appendString(payload, opts.Will.Topic)
+		payload = appendBytes(payload, opts.Will.Payload)
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		payload = appendString(payload, opts.Username)
+		if opts.Password != "" {
+			flags |= 0x40
+			payload = appendString(payload, opts.Password)
+		}
+	}
+
+	keepAlive := uint16(opts.KeepAlive / time.Second)
+	var vh []byte
+	vh = appendString(vh, "MQTT")
+	vh = append(vh, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	return packet(typeConnect<<4, append(vh, payload...))
+}
+
+func publishPacket(msg Message, id uint16) []byte {
+	header := byte(typePublish<<4) | msg.QoS<<1
+	if msg.Retain {
+		header |= 0x01
+	}
+	var body []byte
+	body = appendString(body, msg.Topic)
+	if msg.QoS > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, msg.Payload...)
+	return packet(header, body)
+}
+
+func packet(header byte, body []byte) []byte {
+	out := []byte{header}
+	out = appendLength(out, len(body))
+	return append(out, body...)
+}
+
+func appendLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b, s []byte) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// readPacket reads one control packet, returning its type, flags and body.
+func readPacket(r *bufio.Reader) (typ, flags byte, body []byte, err error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
@@ -0,0 +1,170 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// broker is a minimal in-process MQTT broker that records publishes.
+type broker struct {
+	ln        net.Listener
+	connects  chan []byte
+	publishes chan Message
+	refuse    byte
+}
+
+func newBroker(t *testing.T) *broker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{ln: ln, connects: make(chan []byte, 4), publishes: make(chan Message, 16)}
+	t.Cleanup(func() { ln.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *broker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		typ, flags, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case typeConnect:
+			b.connects <- body
+			conn.Write([]byte{typeConnack << 4, 2, 0, b.refuse})
+		case typePublish:
+			n := int(body[0])<<8 | int(body[1])
+			msg := Message{Topic: string(body[2 : 2+n]), QoS: flags >> 1 & 0x03, Retain: flags&0x01 != 0}
+			rest := body[2+n:]
+			if msg.QoS > 0 {
+				conn.Write([]byte{typePuback << 4, 2, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			msg.Payload = rest
+			b.publishes <- msg
+		case typePingreq:
+			conn.Write([]byte{typePingresp << 4, 0})
+		case typeDisconnect:
+			return
+		}
+	}
+}
+
+func TestPublishQoS1Retained(t *testing.T) {
+	b := newBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, Options{Broker: b.url(), ClientID: "test", Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatalf("expected connection, got %v", err)
+	}
+	defer c.Close()
+
+	connect := <-b.connects
+	if flags := connect[7]; flags&0xc0 != 0xc0 {
+		t.Fatalf("expected username and password flags, got %08b", flags)
+	}
+
+	if err := c.Publish(ctx, Message{Topic: "power/Lamp", Payload: []byte(`{"currentWatts":12.5}`), QoS: 1, Retain: true}); err != nil {
+		t.Fatalf("expected acknowledged publish, got %v", err)
+	}
+	got := <-b.publishes
+	if got.Topic != "power/Lamp" || string(got.Payload) != `{"currentWatts":12.5}` || got.QoS != 1 || !got.Retain {
+		t.Fatalf("unexpected message %+v", got)
+	}
+}
+
+func TestDialReportsRefusal(t *testing.T) {
+	b := newBroker(t)
+	b.refuse = 5
+
+	_, err := Dial(context.Background(), Options{Broker: b.url()})
+	if err == nil || err.Error() != "mqtt: connection refused: not authorized" {
+		t.Fatalf("expected not authorized error, got %v", err)
+	}
+}
+
+func TestDialRejectsUnknownScheme(t *testing.T) {
+	if _, err := Dial(context.Background(), Options{Broker: "http://broker:1883"}); err == nil {
+		t.Fatal("expected error for unsupported scheme")
+	}
+}
+
+func TestPublishAfterBrokerDrops(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		readPacket(bufio.NewReader(conn))
+		conn.Write([]byte{typeConnack << 4, 2, 0, 0})
+		conn.Close()
+	}()
+
+	c, err := Dial(context.Background(), Options{Broker: "tcp://" + ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("expected connection, got %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected client to notice the dropped connection")
+	}
+	if err := c.Publish(context.Background(), Message{Topic: "t", QoS: 1}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPublishForgetsAckOnWriteError(t *testing.T) {
+	conn, peer := net.Pipe()
+	peer.Close()
+	c := &Client{conn: conn, acks: make(map[uint16]chan struct{}), done: make(chan struct{})}
+
+	if err := c.Publish(context.Background(), Message{Topic: "t", QoS: 1}); err == nil {
+		t.Fatal("expected write error")
+	}
+	if len(c.acks) != 0 {
+		t.Fatalf("expected no pending acks, got %d", len(c.acks))
+	}
+}
+
+func TestRemainingLengthEncoding(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151} {
+		b := appendLength(nil, n)
+		r := bufio.NewReader(bytes.NewReader(append(append([]byte{0x30}, b...), make([]byte, n)...)))
+		_, _, body, err := readPacket(r)
+		if err != nil || len(body) != n {
+			t.Fatalf("length %d: got %d bytes, err %v", n, len(body), err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Package otlp implements the small subset of the OpenTelemetry protocol
+// needed to export metrics: gauges and monotonic sums of numbers, encoded
+// as protobuf and sent over gRPC or HTTP.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// grpcExportPath is the gRPC method that receives metrics.
+const grpcExportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// Attribute is a string-valued key/value pair.
+type Attribute struct {
+	Key, Value string
+}
+
+// Point is one data point of a metric.
+type Point struct {
+	Attributes []Attribute
+	// Start is the start of a sum's accumulation; gauges leave it zero.
+	Start time.Time
+	Time  time.Time
+	Value float64
+}
+
+// Metric is a gauge, or a cumulative monotonic sum when Sum is set.
+type Metric struct {
+	Name, Description, Unit string
+	Sum                     bool
+	Points                  []Point
+}
+
+// Request is one export: metrics from a single resource and scope.
+type Request struct {
+	Resource []Attribute
+	Scope    string
+	Metrics  []Metric
+}
+
+// Marshal encodes r as an ExportMetricsServiceRequest.
+func (r Request) Marshal() []byte {
+	var req encoder
+	req.message(1, func(e *encoder) { // resource_metrics
+		e.message(1, func(e *encoder) { // resource
+			for _, a := range r.Resource {
+				e.message(1, func(e *encoder) { a.encode(e) })
+			}
+		})
+		e.message(2, func(e *encoder) { // scope_metrics
+			e.message(1, func(e *encoder) { e.string(1, r.Scope) })
+			for _, m := range r.Metrics {
+				e.message(2, func(e *encoder) { m.encode(e) })
+			}
+		})
+	})
+	return req.buf.Bytes()
+}
+
+func (m Metric) encode(e *encoder) {
+	e.string(1, m.Name)
+	e.string(2, m.Description)
+	e.string(3, m.Unit)
+	field := 5 // gauge
+	if m.Sum {
+		field = 7 // sum
+	}
+	e.message(field, func(e *encoder) {
+		for _, p := range m.Points {
+			e.message(1, func(e *encoder) { p.encode(e) })
+		}
+		if m.Sum {
+			e.varint(2, 2) // AGGREGATION_TEMPORALITY_CUMULATIVE
+			e.varint(3, 1) // is_monotonic
+		}
+	})
+}
+
+func (p Point) encode(e *encoder) {
+	if !p.Start.IsZero() {
+		e.fixed64(2, uint64(p.Start.UnixNano())) // #nosec G115 -- timestamps after 1970
+	}
+	e.fixed64(3, uint64(p.Time.UnixNano())) // #nosec G115 -- timestamps after 1970
+	e.fixed64(4, math.Float64bits(p.Value))
+	for _, a := range p.Attributes {
+		e.message(7, func(e *encoder) { a.encode(e) })
+	}
+}
+
+func (a Attribute) encode(e *encoder) {
+	e.string(1, a.Key)
+	e.message(2, func(e *encoder) { e.string(1, a.Value) })
+}
+
+// encoder appends protobuf fields to a buffer.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) tag(field, wireType int) {
+	e.uvarint(uint64(field<<3 | wireType)) // #nosec G115 -- small field numbers
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (e *encoder) varint(field int, v uint64) {
+	e.tag(field, 0)
+	e.uvarint(v)
+}
+
+func (e *encoder) fixed64(field int, v uint64) {
+	e.tag(field, 1)
+	e.buf.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.tag(field, 2)
+	e.uvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+// string writes a string field, omitting it when empty as proto3 does.
+func (e *encoder) string(field int, s string) {
+	if s != "" {
+		e.bytes(field, []byte(s))
+	}
+}
+
+func (e *encoder) message(field int, fill func(*encoder)) {
+	var sub encoder
+	fill(&sub)
+	e.bytes(field, sub.buf.Bytes())
+}
+
+// Client exports metrics to an OpenTelemetry collector.
+type Client struct {
+	url     string
+	grpc    bool
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewClient returns a client for endpoint. An http:// or https:// URL is
+// exported to over HTTP, at /v1/metrics unless the URL has a path; a bare
+// host:port is exported to over gRPC, with TLS when tlsConfig is set and
+// over cleartext HTTP/2 otherwise. headers are sent with every export.
+func NewClient(endpoint string, tlsConfig *tls.Config, headers map[string]string, timeout time.Duration) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c := &Client{headers: headers, client: &http.Client{Timeout: timeout, Transport: transport}}
+
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("otlp: invalid endpoint %q", endpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		c.url = u.String()
+		return c, nil
+	}
+
+	if strings.Contains(endpoint, "/") || !strings.Contains(endpoint, ":") {
+		return nil, fmt.Errorf("otlp: invalid endpoint %q: want host:port for gRPC or an http(s):// URL", endpoint)
+	}
+	c.grpc = true
+	if tlsConfig != nil {
+		transport.ForceAttemptHTTP2 = true
+		c.url = "https://" + endpoint + grpcExportPath
+	} else {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		c.url = "http://" + endpoint + grpcExportPath
+	}
+	return c, nil
+}
+
+// Export sends req.
+func (c *Client) Export(ctx context.Context, req Request) error {
+	body := req.Marshal()
+	contentType := "application/x-protobuf"
+	if c.grpc {
+		// A gRPC message is prefixed by an uncompressed flag and its
+		// length.
+		framed := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(framed[1:], uint32(len(body))) // #nosec G115 -- exports are far below 4 GiB
+		body = append(framed, body...)
+		contentType = "application/grpc"
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	if c.grpc {
+		httpReq.Header.Set("TE", "trailers")
+	}
+	for k, v := range c.headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("otlp: unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if c.grpc {
+		// Errors come in the trailers, or in the headers of a response
+		// without a body.
+		status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			return fmt.Errorf("otlp: grpc status %s: %s", status, message)
+		}
+	}
+	return nil
+}
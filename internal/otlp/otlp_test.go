@@ -0,0 +1,202 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fields decodes one level of a protobuf message into the raw values of
+// each field: varints and fixed64s as 8 little-endian bytes, and
+// length-delimited fields as their contents.
+func fields(t *testing.T, b []byte) map[int][][]byte {
+	t.Helper()
+	out := make(map[int][][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag in %x", b)
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			out[field] = append(out[field], binary.LittleEndian.AppendUint64(nil, v))
+			b = b[n:]
+		case 1:
+			out[field] = append(out[field], b[:8])
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			b = b[n:]
+			out[field] = append(out[field], b[:size])
+			b = b[size:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return out
+}
+
+// one returns the single value of field in msg.
+func one(t *testing.T, msg map[int][][]byte, field int) []byte {
+	t.Helper()
+	if len(msg[field]) != 1 {
+		t.Fatalf("expected one field %d, got %d", field, len(msg[field]))
+	}
+	return msg[field][0]
+}
+
+func TestRequestMarshal(t *testing.T) {
+	at := time.Unix(1706886245, 0)
+	req := Request{
+		Resource: []Attribute{{"service.name", "powerusagecollection"}},
+		Scope:    "powerusagecollection",
+		Metrics: []Metric{
+			{Name: "power.device.watts", Unit: "W", Points: []Point{{Attributes: []Attribute{{"device", "Lamp"}}, Time: at, Value: 12.5}}},
+			{Name: "power.collector.scrape.errors", Sum: true, Points: []Point{{Start: at.Add(-time.Hour), Time: at, Value: 3}}},
+		},
+	}
+
+	resourceMetrics := fields(t, one(t, fields(t, req.Marshal()), 1))
+	resource := fields(t, one(t, resourceMetrics, 1))
+	attr := fields(t, one(t, resource, 1))
+	if string(one(t, attr, 1)) != "service.name" || string(one(t, fields(t, one(t, attr, 2)), 1)) != "powerusagecollection" {
+		t.Fatalf("unexpected resource attribute %q", attr)
+	}
+
+	scopeMetrics := fields(t, one(t, resourceMetrics, 2))
+	if name := one(t, fields(t, one(t, scopeMetrics, 1)), 1); string(name) != "powerusagecollection" {
+		t.Fatalf("unexpected scope %q", name)
+	}
+	metrics := scopeMetrics[2]
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+
+	gauge := fields(t, metrics[0])
+	if string(one(t, gauge, 1)) != "power.device.watts" || string(one(t, gauge, 3)) != "W" {
+		t.Fatalf("unexpected gauge %q", gauge)
+	}
+	point := fields(t, one(t, fields(t, one(t, gauge, 5)), 1))
+	if v := math.Float64frombits(binary.LittleEndian.Uint64(one(t, point, 4))); v != 12.5 {
+		t.Fatalf("expected value 12.5, got %v", v)
+	}
+	if ts := binary.LittleEndian.Uint64(one(t, point, 3)); ts != uint64(at.UnixNano()) {
+		t.Fatalf("unexpected time %d", ts)
+	}
+	if _, ok := point[2]; ok {
+		t.Fatal("expected a gauge point without a start time")
+	}
+	if key := one(t, fields(t, one(t, point, 7)), 1); string(key) != "device" {
+		t.Fatalf("unexpected point attribute %q", key)
+	}
+
+	sum := fields(t, one(t, fields(t, metrics[1]), 7))
+	if temporality := binary.LittleEndian.Uint64(one(t, sum, 2)); temporality != 2 {
+		t.Fatalf("expected cumulative temporality, got %d", temporality)
+	}
+	if monotonic := binary.LittleEndian.Uint64(one(t, sum, 3)); monotonic != 1 {
+		t.Fatal("expected a monotonic sum")
+	}
+	if start := binary.LittleEndian.Uint64(one(t, fields(t, one(t, sum, 1)), 2)); start != uint64(at.Add(-time.Hour).UnixNano()) {
+		t.Fatalf("unexpected start time %d", start)
+	}
+}
+
+func TestClientExportsOverHTTP(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, nil, map[string]string{"Authorization": "Bearer t0ken"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := Request{Scope: "test"}
+	if err := c.Export(context.Background(), req); err != nil {
+		t.Fatalf("expected export to succeed, got %v", err)
+	}
+	if got.URL.Path != "/v1/metrics" || got.Header.Get("Content-Type") != "application/x-protobuf" || got.Header.Get("Authorization") != "Bearer t0ken" {
+		t.Fatalf("unexpected request %s %v", got.URL, got.Header)
+	}
+	if !bytes.Equal(body, req.Marshal()) {
+		t.Fatalf("unexpected body %x", body)
+	}
+}
+
+// grpcHandler answers exports with the given gRPC status.
+func grpcHandler(t *testing.T, status string, got *[]byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != grpcExportPath || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("unexpected request %s %s %v", r.Proto, r.URL.Path, r.Header)
+		}
+		*got, _ = io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", status)
+		if status != "0" {
+			w.Header().Set("Grpc-Message", "rejected")
+		}
+	})
+}
+
+func TestClientExportsOverCleartextGRPC(t *testing.T) {
+	var body []byte
+	server := httptest.NewUnstartedServer(grpcHandler(t, "0", &body))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	c, err := NewClient(strings.TrimPrefix(server.URL, "http://"), nil, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := Request{Scope: "test"}
+	if err := c.Export(context.Background(), req); err != nil {
+		t.Fatalf("expected export to succeed, got %v", err)
+	}
+	want := append([]byte{0, 0, 0, 0, byte(len(req.Marshal()))}, req.Marshal()...)
+	if !bytes.Equal(body, want) {
+		t.Fatalf("expected a length-prefixed message %x, got %x", want, body)
+	}
+}
+
+func TestClientReportsGRPCStatusOverTLS(t *testing.T) {
+	var body []byte
+	server := httptest.NewUnstartedServer(grpcHandler(t, "3", &body))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+	c, err := NewClient(strings.TrimPrefix(server.URL, "https://"), tlsConfig, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Export(context.Background(), Request{}); err == nil || !strings.Contains(err.Error(), "grpc status 3: rejected") {
+		t.Fatalf("expected the gRPC status to be reported, got %v", err)
+	}
+}
+
+func TestNewClientRejectsInvalidEndpoints(t *testing.T) {
+	for _, endpoint := range []string{"", "localhost", "localhost:4317/v1", "http://"} {
+		if _, err := NewClient(endpoint, nil, nil, time.Second); err == nil {
+			t.Errorf("expected %q to be rejected", endpoint)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package promtext
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestWriterFormatsFamiliesAndSamples(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Family("power_device_watts", "Current power draw in watts.", Gauge)
+	w.Sample("power_device_watts", 12.5, "device", "Lamp", "host", "lamp.local")
+	w.Sample("power_up", 1)
+	if err := w.Flush(); err != nil {
+		t.Fatalf("expected flush to succeed, got %v", err)
+	}
+
+	want := "# HELP power_device_watts Current power draw in watts.\n" +
+		"# TYPE power_device_watts gauge\n" +
+		"power_device_watts{device=\"Lamp\",host=\"lamp.local\"} 12.5\n" +
+		"power_up 1\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriterEscapesLabelValues(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Sample("m", 1, "device", "say \"hi\"\\\n")
+	w.Flush()
+
+	if got, want := buf.String(), "m{device=\"say \\\"hi\\\"\\\\\\n\"} 1\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFormatValueSpecials(t *testing.T) {
+	cases := map[float64]string{math.Inf(1): "+Inf", math.Inf(-1): "-Inf", 0.25: "0.25", 1e21: "1e+21"}
+	for in, want := range cases {
+		if got := formatValue(in); got != want {
+			t.Fatalf("formatValue(%v) = %q, want %q", in, got, want)
+		}
+	}
+	if got := formatValue(math.NaN()); got != "NaN" {
+		t.Fatalf("expected NaN, got %q", got)
+	}
+}
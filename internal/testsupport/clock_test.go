@@ -0,0 +1,63 @@
+package testsupport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockFiresInOrder(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	later := c.After(3 * time.Second)
+	sooner := c.After(time.Second)
+	ticker := c.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	c.Advance(time.Second)
+	if got := <-sooner; !got.Equal(start.Add(time.Second)) {
+		t.Fatalf("expected the sooner timer to fire at 1s, got %v", got)
+	}
+	select {
+	case <-later:
+		t.Fatal("expected the later timer still pending")
+	default:
+	}
+
+	c.Advance(5 * time.Second)
+	if got := <-later; !got.Equal(start.Add(3 * time.Second)) {
+		t.Fatalf("expected the later timer to fire at 3s, got %v", got)
+	}
+	// Only the tick at 2s is kept: those at 4s and 6s are dropped while
+	// nobody receives it.
+	if got := <-ticker.C(); !got.Equal(start.Add(2 * time.Second)) {
+		t.Fatalf("expected the first tick kept, got %v", got)
+	}
+	if !c.Now().Equal(start.Add(6 * time.Second)) {
+		t.Fatalf("expected the clock at 6s, got %v", c.Now())
+	}
+	if c.Waiters() != 1 {
+		t.Fatalf("expected only the ticker pending, got %d", c.Waiters())
+	}
+	ticker.Stop()
+	if c.Waiters() != 0 {
+		t.Fatal("expected the stopped ticker removed")
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		<-c.After(time.Minute)
+		close(done)
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Minute)
+	<-done
+
+	select {
+	case <-c.After(0):
+	default:
+		t.Fatal("expected a zero wait to fire at once")
+	}
+}
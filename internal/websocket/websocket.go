@@ -0,0 +1,306 @@
+// Package websocket implements the server side of the small subset of
+// RFC 6455 needed to push messages to browsers: the opening handshake,
+// unfragmented text messages, ping/pong keepalive and the closing
+// handshake. Messages from the client are read and discarded.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505 -- the handshake is defined with SHA-1
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes used by the server.
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+// Close status codes.
+const (
+	CloseNormal    = 1000
+	CloseGoingAway = 1001
+	closeNoStatus  = 1005
+)
+
+// maxControlFrame is the largest control frame payload.
+const maxControlFrame = 125
+
+// maxClientFrame bounds the frames read from clients, which have nothing
+// to send but control frames.
+const maxClientFrame = 64 << 10
+
+// closeWait is how long Close waits for the client to answer the closing
+// handshake.
+const closeWait = time.Second
+
+// acceptGUID is appended to the client's key to compute the accept key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrClosed is returned when writing to a closed or broken connection.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// IsUpgrade reports whether r asks for a WebSocket connection.
+func IsUpgrade(r *http.Request) bool {
+	return headerHas(r.Header, "Connection", "upgrade") && headerHas(r.Header, "Upgrade", "websocket")
+}
+
+// headerHas reports whether the comma-separated header name lists token,
+// ignoring case.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conn is a server-side WebSocket connection. Its write methods are safe
+// for concurrent use.
+type Conn struct {
+	conn net.Conn
+	idle time.Duration
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	err     error
+	closing bool
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Upgrade completes the opening handshake of r and takes over its
+// connection. Unless idle is zero, the connection fails once nothing,
+// not even a pong, has been heard from the client for that long. On
+// failure an HTTP error has been written.
+func Upgrade(w http.ResponseWriter, r *http.Request, idle time.Duration) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet || !IsUpgrade(r):
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	case key == "":
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade unsupported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	if _, err := fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", AcceptKey(key)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &Conn{conn: conn, idle: idle, done: make(chan struct{})}
+	go c.readLoop(rw.Reader)
+	return c, nil
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value for a client's key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID)) // #nosec G401 -- the handshake is defined with SHA-1
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WriteText sends p as one text message.
+func (c *Conn) WriteText(p []byte) error {
+	return c.writeFrame(opText, p)
+}
+
+// Ping sends a ping, which the client answers with a pong.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// Close starts the closing handshake with code and reason, waits briefly
+// for the client to answer and closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxControlFrame-2 {
+		reason = reason[:maxControlFrame-2]
+	}
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	err := c.writeFrame(opClose, closePayload(code, reason))
+	select {
+	case <-c.done:
+	case <-time.After(closeWait):
+	}
+	c.fail(ErrClosed)
+	return err
+}
+
+// Done is closed once the connection has been closed by either side or
+// has failed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func closePayload(code int, reason string) []byte {
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code)) // #nosec G115 -- close codes fit in 16 bits
+	return append(p, reason...)
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(frame(op, payload)); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// frame encodes an unmasked, unfragmented server frame.
+func frame(op byte, payload []byte) []byte {
+	n := len(payload)
+	b := make([]byte, 0, n+10)
+	b = append(b, 0x80|op)
+	switch {
+	case n <= 125:
+		b = append(b, byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	return append(b, payload...)
+}
+
+// fail ends the connection with err, unless it has already ended.
+func (c *Conn) fail(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// readLoop answers the client's control frames until the connection ends.
+func (c *Conn) readLoop(r *bufio.Reader) {
+	for {
+		if c.idle > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		}
+		op, payload, err := readFrame(r)
+		if err != nil {
+			c.mu.Lock()
+			closing := c.closing
+			c.mu.Unlock()
+			if closing {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+		switch op {
+		case opPing:
+			c.writeFrame(opPong, payload)
+		case opClose:
+			c.mu.Lock()
+			answered := c.closing
+			c.closing = true
+			c.mu.Unlock()
+			if !answered {
+				code := closeNoStatus
+				if len(payload) >= 2 {
+					code = int(binary.BigEndian.Uint16(payload))
+				}
+				if code == closeNoStatus {
+					c.writeFrame(opClose, nil)
+				} else {
+					c.writeFrame(opClose, closePayload(code, ""))
+				}
+			}
+			c.fail(ErrClosed)
+			return
+		}
+	}
+}
+
+// readFrame reads one masked client frame, unmasking its payload.
+func readFrame(r *bufio.Reader) (op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op = head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("websocket: unmasked client frame")
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxClientFrame || (op >= opClose && n > maxControlFrame) {
+		return 0, nil, fmt.Errorf("websocket: %d byte frame too large", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
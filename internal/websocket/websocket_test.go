@@ -0,0 +1,161 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client is the raw client side of a connection.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial opens a WebSocket connection to the test server.
+func dial(t *testing.T, server *httptest.Server) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake response %d %v", resp.StatusCode, resp.Header)
+	}
+	return &client{conn: conn, r: r}
+}
+
+// read reads one unmasked server frame.
+func (c *client) read(t *testing.T) (byte, []byte) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := int(head[1] & 0x7F)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+// write sends a masked client frame.
+func (c *client) write(op byte, payload []byte) {
+	mask := [4]byte{1, 2, 3, 4}
+	b := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	b = append(b, mask[:]...)
+	for i, p := range payload {
+		b = append(b, p^mask[i%4])
+	}
+	c.conn.Write(b)
+}
+
+func serve(t *testing.T, idle time.Duration, handle func(*Conn)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, idle)
+		if err != nil {
+			return
+		}
+		handle(c)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWriteTextAndClose(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	server := serve(t, 0, func(c *Conn) {
+		c.WriteText([]byte(`{"watts":5}`))
+		c.WriteText([]byte(long))
+		c.Close(CloseGoingAway, "shutting down")
+	})
+	cl := dial(t, server)
+	if op, p := cl.read(t); op != opText || string(p) != `{"watts":5}` {
+		t.Fatalf("unexpected frame %x %q", op, p)
+	}
+	if op, p := cl.read(t); op != opText || string(p) != long {
+		t.Fatalf("unexpected long frame %x (%d bytes)", op, len(p))
+	}
+	op, p := cl.read(t)
+	if op != opClose || binary.BigEndian.Uint16(p) != CloseGoingAway || string(p[2:]) != "shutting down" {
+		t.Fatalf("unexpected close frame %x %q", op, p)
+	}
+	cl.write(opClose, p[:2])
+}
+
+func TestAnswersPingAndClose(t *testing.T) {
+	done := make(chan error, 1)
+	server := serve(t, 0, func(c *Conn) {
+		<-c.Done()
+		done <- c.Err()
+	})
+	cl := dial(t, server)
+	cl.write(opPing, []byte("hi"))
+	if op, p := cl.read(t); op != opPong || string(p) != "hi" {
+		t.Fatalf("expected a pong, got %x %q", op, p)
+	}
+	cl.write(opClose, []byte{0x03, 0xE8})
+	if op, p := cl.read(t); op != opClose || binary.BigEndian.Uint16(p) != CloseNormal {
+		t.Fatalf("expected the close to be echoed, got %x %q", op, p)
+	}
+	if err := <-done; !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected a clean close, got %v", err)
+	}
+}
+
+func TestIdleClientFails(t *testing.T) {
+	done := make(chan error, 1)
+	server := serve(t, 50*time.Millisecond, func(c *Conn) {
+		c.Ping()
+		<-c.Done()
+		done <- c.Err()
+	})
+	cl := dial(t, server)
+	if op, _ := cl.read(t); op != opPing {
+		t.Fatalf("expected a ping, got %x", op)
+	}
+	select {
+	case err := <-done:
+		if err == nil || errors.Is(err, ErrClosed) {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the silent client to be dropped")
+	}
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	server := serve(t, 0, func(*Conn) { t.Error("expected no connection") })
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,317 @@
+package zeroconf
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS record types used by service discovery.
+const (
+	typeA    uint16 = 1
+	typePTR  uint16 = 12
+	typeTXT  uint16 = 16
+	typeAAAA uint16 = 28
+	typeSRV  uint16 = 33
+	typeANY  uint16 = 255
+)
+
+const (
+	classIN = 1
+	// classUnicast is the top bit of a question's class, asking responders
+	// to reply by unicast (RFC 6762 section 5.4). In answers the same bit
+	// is the cache-flush flag and is ignored here.
+	classUnicast = 1 << 15
+
+	flagResponse = 1 << 15
+
+	headerLen = 12
+	// maxPointers bounds compression pointer chains so a malicious packet
+	// cannot loop forever.
+	maxPointers = 32
+)
+
+var errMessage = errors.New("malformed DNS message")
+
+// question is a single DNS query.
+type question struct {
+	name  string
+	qtype uint16
+	// unicast is set on received questions asking for a unicast reply.
+	unicast bool
+}
+
+// record is a decoded resource record. Only the fields for its type are
+// set.
+type record struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+
+	target string   // PTR and SRV
+	port   uint16   // SRV
+	text   []string // TXT
+	ip     net.IP   // A and AAAA
+}
+
+// message is a decoded DNS message, with answers, authority and additional
+// records merged into records.
+type message struct {
+	response  bool
+	questions []question
+	records   []record
+}
+
+// canonical returns the form of name used for comparisons: lower case with
+// a trailing dot.
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// packQuery encodes a query for questions, asking for unicast responses.
+func packQuery(questions []question) []byte {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(questions)))
+	for _, q := range questions {
+		b = appendName(b, q.name)
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, classIN|classUnicast)
+	}
+	return b
+}
+
+// packResponse encodes records as an uncompressed mDNS response.
+func packResponse(records ...record) []byte {
+	b := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(b[2:], flagResponse)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(records)))
+	for _, r := range records {
+		var data []byte
+		switch r.rtype {
+		case typeA, typeAAAA:
+			data = r.ip
+			if ip4 := r.ip.To4(); r.rtype == typeA && ip4 != nil {
+				data = ip4
+			}
+		case typePTR:
+			data = appendName(nil, r.target)
+		case typeSRV:
+			data = binary.BigEndian.AppendUint16(make([]byte, 4), r.port)
+			data = appendName(data, r.target)
+		case typeTXT:
+			for _, s := range r.text {
+				data = append(append(data, byte(len(s))), s...)
+			}
+		}
+		b = appendName(b, r.name)
+		b = binary.BigEndian.AppendUint16(b, r.rtype)
+		b = binary.BigEndian.AppendUint16(b, classIN)
+		b = binary.BigEndian.AppendUint32(b, r.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	return b
+}
+
+// appendName appends name in wire format. Dots escaped with a backslash are
+// kept within their label, as in service instance names.
+func appendName(b []byte, name string) []byte {
+	for _, label := range splitName(name) {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// splitName splits a presentation-format name into its unescaped labels.
+func splitName(name string) []string {
+	var (
+		labels []string
+		label  strings.Builder
+	)
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '\\' && i+1 < len(name):
+			i++
+			label.WriteByte(name[i])
+		case c == '.':
+			if label.Len() > 0 {
+				labels = append(labels, label.String())
+			}
+			label.Reset()
+		default:
+			label.WriteByte(c)
+		}
+	}
+	if label.Len() > 0 {
+		labels = append(labels, label.String())
+	}
+	return labels
+}
+
+// joinLabels returns the presentation form of labels, escaping dots and
+// backslashes within them.
+func joinLabels(labels []string) string {
+	var b strings.Builder
+	for _, label := range labels {
+		for i := 0; i < len(label); i++ {
+			if c := label[i]; c == '.' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(label[i])
+		}
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+// parseMessage decodes a DNS message. Records of types other than those
+// used for service discovery are skipped.
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < headerLen {
+		return nil, errMessage
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	rrcount := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+
+	m := &message{response: flags&flagResponse != 0}
+	off := headerLen
+	for i := 0; i < qdcount; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+		if off > len(b) {
+			return nil, errMessage
+		}
+		class := binary.BigEndian.Uint16(b[n+2:])
+		m.questions = append(m.questions, question{name: name, qtype: binary.BigEndian.Uint16(b[n:]), unicast: class&classUnicast != 0})
+	}
+	for i := 0; i < rrcount; i++ {
+		r, n, err := readRecord(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if r != nil {
+			m.records = append(m.records, *r)
+		}
+	}
+	return m, nil
+}
+
+// readRecord decodes the resource record at off, returning nil for
+// unsupported types, and the offset following it.
+func readRecord(b []byte, off int) (*record, int, error) {
+	name, off, err := readName(b, off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off+10 > len(b) {
+		return nil, 0, errMessage
+	}
+	r := &record{
+		name:  name,
+		rtype: binary.BigEndian.Uint16(b[off:]),
+		ttl:   binary.BigEndian.Uint32(b[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(b[off+8:]))
+	start := off + 10
+	end := start + length
+	if end > len(b) {
+		return nil, 0, errMessage
+	}
+	data := b[start:end]
+
+	switch r.rtype {
+	case typeA:
+		if length != net.IPv4len {
+			return nil, 0, errMessage
+		}
+		r.ip = net.IP(append([]byte(nil), data...))
+	case typeAAAA:
+		if length != net.IPv6len {
+			return nil, 0, errMessage
+		}
+		r.ip = net.IP(append([]byte(nil), data...))
+	case typePTR:
+		if r.target, _, err = readName(b, start); err != nil {
+			return nil, 0, err
+		}
+	case typeSRV:
+		if length < 7 {
+			return nil, 0, errMessage
+		}
+		r.port = binary.BigEndian.Uint16(data[4:])
+		if r.target, _, err = readName(b, start+6); err != nil {
+			return nil, 0, err
+		}
+	case typeTXT:
+		for i := 0; i < len(data); {
+			n := int(data[i])
+			if i+1+n > len(data) {
+				return nil, 0, errMessage
+			}
+			if n > 0 {
+				r.text = append(r.text, string(data[i+1:i+1+n]))
+			}
+			i += 1 + n
+		}
+	default:
+		return nil, end, nil
+	}
+	return r, end, nil
+}
+
+// readName decodes the possibly compressed name at off and returns it with
+// the offset following it in the original position.
+func readName(b []byte, off int) (string, int, error) {
+	var (
+		labels   []string
+		next     = -1
+		pointers int
+	)
+	for {
+		if off >= len(b) {
+			return "", 0, errMessage
+		}
+		c := int(b[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return joinLabels(labels), next, nil
+			}
+			if off+1+c > len(b) {
+				return "", 0, errMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+c]))
+			off += 1 + c
+		case 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errMessage
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, errMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		default:
+			return "", 0, errMessage
+		}
+	}
+}
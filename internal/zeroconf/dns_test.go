@@ -0,0 +1,91 @@
+package zeroconf
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestPackQueryAsksForUnicastReplies(t *testing.T) {
+	b := packQuery([]question{{name: "_matter._tcp.local.", qtype: typePTR}})
+
+	name, off, err := readName(b, headerLen)
+	if err != nil || name != "_matter._tcp.local." {
+		t.Fatalf("unexpected question name %q (%v)", name, err)
+	}
+	if got := binary.BigEndian.Uint16(b[off:]); got != typePTR {
+		t.Fatalf("expected PTR question, got type %d", got)
+	}
+	if got := binary.BigEndian.Uint16(b[off+2:]); got != classIN|classUnicast {
+		t.Fatalf("expected unicast-response class, got %#x", got)
+	}
+	if m, err := parseMessage(b); err != nil || m.response {
+		t.Fatalf("expected a parseable query, got %+v (%v)", m, err)
+	}
+}
+
+func TestParseMessageDecodesRecords(t *testing.T) {
+	b := packResponse(
+		record{name: "_matter._tcp.local.", rtype: typePTR, ttl: 120, target: `Desk\.Lamp._matter._tcp.local.`},
+		record{name: `Desk\.Lamp._matter._tcp.local.`, rtype: typeSRV, ttl: 120, port: 5540, target: "lamp.local."},
+		record{name: `Desk\.Lamp._matter._tcp.local.`, rtype: typeTXT, ttl: 120, text: []string{"VP=1+2", "SII=5000"}},
+		record{name: "lamp.local.", rtype: typeA, ttl: 120, ip: net.IPv4(10, 0, 0, 7)},
+		record{name: "lamp.local.", rtype: typeAAAA, ttl: 120, ip: net.ParseIP("fe80::1")},
+	)
+
+	m, err := parseMessage(b)
+	if err != nil {
+		t.Fatalf("expected message to parse, got %v", err)
+	}
+	if !m.response || len(m.records) != 5 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if r := m.records[0]; r.target != `Desk\.Lamp._matter._tcp.local.` {
+		t.Fatalf("expected escaped instance name, got %q", r.target)
+	}
+	if r := m.records[1]; r.port != 5540 || r.target != "lamp.local." {
+		t.Fatalf("unexpected SRV record %+v", r)
+	}
+	if r := m.records[2]; len(r.text) != 2 || r.text[1] != "SII=5000" {
+		t.Fatalf("unexpected TXT record %+v", r)
+	}
+	if r := m.records[3]; !r.ip.Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Fatalf("unexpected A record %+v", r)
+	}
+	if r := m.records[4]; !r.ip.Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("unexpected AAAA record %+v", r)
+	}
+}
+
+func TestReadNameFollowsCompressionPointers(t *testing.T) {
+	b := make([]byte, headerLen)
+	b = appendName(b, "lamp.local.")
+	// "www" followed by a pointer to "local." at offset headerLen+5.
+	ptr := len(b)
+	b = append(b, 3, 'w', 'w', 'w', 0xC0, byte(headerLen+5))
+
+	name, next, err := readName(b, ptr)
+	if err != nil || name != "www.local." {
+		t.Fatalf("unexpected name %q (%v)", name, err)
+	}
+	if next != len(b) {
+		t.Fatalf("expected to resume after the pointer at %d, got %d", len(b), next)
+	}
+}
+
+func TestReadNameRejectsPointerLoops(t *testing.T) {
+	b := make([]byte, headerLen)
+	b = append(b, 0xC0, byte(headerLen))
+
+	if _, _, err := readName(b, headerLen); err == nil {
+		t.Fatal("expected a pointer loop to be rejected")
+	}
+}
+
+func TestParseMessageRejectsTruncatedRecords(t *testing.T) {
+	b := packResponse(record{name: "lamp.local.", rtype: typeA, ttl: 120, ip: net.IPv4(10, 0, 0, 7)})
+
+	if _, err := parseMessage(b[:len(b)-2]); err == nil {
+		t.Fatal("expected a truncated record to be rejected")
+	}
+}
@@ -0,0 +1,437 @@
+package zeroconf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Multicast DNS groups (RFC 6762).
+var (
+	mdnsIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// Queries are repeated with a doubling interval up to maxQueryInterval so
+// devices that power on later are still found.
+const (
+	initialQueryInterval = time.Second
+	maxQueryInterval     = time.Minute
+)
+
+// MDNS browses for services with multicast DNS. It queries both IPv4 and
+// IPv6 groups, asking for unicast replies, and also listens for multicast
+// announcements where the mDNS port can be shared.
+type MDNS struct {
+	// Interfaces limits browsing to these interfaces. When empty, IPv6
+	// queries go out on every interface that is up and multicast capable
+	// and IPv4 queries on the system's default multicast interface.
+	Interfaces []net.Interface
+
+	// group, when set, replaces the multicast groups so tests can run a
+	// responder on loopback.
+	group *net.UDPAddr
+}
+
+// mdnsConn is a socket queries are sent from or announcements arrive on.
+type mdnsConn struct {
+	conn *net.UDPConn
+	// send is set for sockets that queries are written to.
+	send func(conn *net.UDPConn, b []byte)
+}
+
+type mdnsPacket struct {
+	data  []byte
+	iface string
+}
+
+// Browse sends PTR queries for service in domain and emits an entry for
+// every instance once its SRV target has an address, and again whenever
+// the instance's records change. entries is closed once ctx is done.
+func (m *MDNS) Browse(ctx context.Context, service, domain string, entries chan<- *ServiceEntry) error {
+	conns, err := m.listen()
+	if err != nil {
+		return err
+	}
+
+	packets := make(chan mdnsPacket)
+	for _, c := range conns {
+		go readPackets(ctx, c.conn, packets)
+	}
+
+	b := newBrowser(service, domain)
+	go func() {
+		defer close(entries)
+		defer func() {
+			for _, c := range conns {
+				c.conn.Close()
+			}
+		}()
+
+		query := func(questions []question) {
+			if len(questions) == 0 {
+				return
+			}
+			msg := packQuery(questions)
+			for _, c := range conns {
+				if c.send != nil {
+					c.send(c.conn, msg)
+				}
+			}
+		}
+
+		interval := initialQueryInterval
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				query(b.questions())
+				timer.Reset(interval)
+				interval = min(2*interval, maxQueryInterval)
+			case p := <-packets:
+				for _, e := range b.handle(p.data, p.iface) {
+					select {
+					case entries <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+				query(b.followUps())
+			}
+		}
+	}()
+	return nil
+}
+
+// listen opens the sockets used for browsing. Failing to join a multicast
+// group is not an error as long as queries can be sent.
+func (m *MDNS) listen() ([]mdnsConn, error) {
+	if m.group != nil {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return nil, fmt.Errorf("mdns: %w", err)
+		}
+		group := m.group
+		return []mdnsConn{{conn: conn, send: func(c *net.UDPConn, b []byte) { c.WriteToUDP(b, group) }}}, nil
+	}
+
+	ifaces := m.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = multicastInterfaces()
+	}
+
+	var (
+		conns []mdnsConn
+		errs  []error
+	)
+	sendIPv4 := func(c *net.UDPConn, b []byte) { c.WriteToUDP(b, mdnsIPv4) }
+	if len(m.Interfaces) == 0 {
+		if conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero}); err == nil {
+			conns = append(conns, mdnsConn{conn: conn, send: sendIPv4})
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	// A multicast sent from a socket bound to an interface's address
+	// leaves through that interface, so each selected interface gets its
+	// own IPv4 socket.
+	for _, ifi := range m.Interfaces {
+		for _, ip := range interfaceIPv4s(ifi) {
+			if conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip}); err == nil {
+				conns = append(conns, mdnsConn{conn: conn, send: sendIPv4})
+			} else {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified}); err == nil {
+		conns = append(conns, mdnsConn{conn: conn, send: func(c *net.UDPConn, b []byte) {
+			for _, ifi := range ifaces {
+				c.WriteToUDP(b, &net.UDPAddr{IP: mdnsIPv6.IP, Port: mdnsIPv6.Port, Zone: ifi.Name})
+			}
+		}})
+	} else {
+		errs = append(errs, err)
+	}
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("mdns: %w", errors.Join(errs...))
+	}
+
+	// Announcements are only a bonus on top of the unicast replies, so the
+	// groups are joined on the default interface, or each selected one,
+	// and errors are ignored.
+	groupIfaces := []*net.Interface{nil}
+	if len(m.Interfaces) > 0 {
+		groupIfaces = groupIfaces[:0]
+		for i := range m.Interfaces {
+			groupIfaces = append(groupIfaces, &m.Interfaces[i])
+		}
+	}
+	for _, ifi := range groupIfaces {
+		if conn, err := net.ListenMulticastUDP("udp4", ifi, mdnsIPv4); err == nil {
+			conns = append(conns, mdnsConn{conn: conn})
+		}
+		if conn, err := net.ListenMulticastUDP("udp6", ifi, mdnsIPv6); err == nil {
+			conns = append(conns, mdnsConn{conn: conn})
+		}
+	}
+	return conns, nil
+}
+
+// interfaceIPv4s returns the IPv4 addresses assigned to ifi.
+func interfaceIPv4s(ifi net.Interface) []net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	return ips
+}
+
+// multicastInterfaces returns the interfaces that are up and support
+// multicast, excluding loopback.
+func multicastInterfaces() []net.Interface {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ifaces []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			ifaces = append(ifaces, ifi)
+		}
+	}
+	return ifaces
+}
+
+// readPackets forwards datagrams from conn until it is closed. The zone of
+// an IPv6 sender names the interface the packet arrived on.
+func readPackets(ctx context.Context, conn *net.UDPConn, packets chan<- mdnsPacket) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		p := mdnsPacket{data: append([]byte(nil), buf[:n]...), iface: src.Zone}
+		select {
+		case packets <- p:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// browser assembles service entries from the records in mDNS responses.
+type browser struct {
+	// service is the canonical name PTR queries are sent for, and
+	// serviceType the service type as given.
+	service     string
+	serviceType string
+	instances   map[string]*instance
+	hosts       map[string]*host
+	// asked holds follow-up questions already sent since the last
+	// periodic query.
+	asked map[question]bool
+}
+
+type instance struct {
+	name   string
+	target string
+	port   uint16
+	srv    bool
+	text   []string
+	txt    bool
+	iface  string
+	// sent describes the last entry emitted, so unchanged repeats are
+	// dropped.
+	sent string
+}
+
+type host struct {
+	ipv4 []net.IP
+	ipv6 []net.IP
+}
+
+func newBrowser(service, domain string) *browser {
+	return &browser{
+		service:     canonical(strings.Trim(service, ".") + "." + strings.Trim(domain, ".")),
+		serviceType: strings.Trim(service, "."),
+		instances:   make(map[string]*instance),
+		hosts:       make(map[string]*host),
+		asked:       make(map[question]bool),
+	}
+}
+
+// questions returns the periodic query: the service PTR plus follow-ups for
+// anything still incomplete.
+func (b *browser) questions() []question {
+	clear(b.asked)
+	return append([]question{{name: b.service, qtype: typePTR}}, b.followUps()...)
+}
+
+// followUps returns queries for the SRV, TXT and address records that known
+// instances still lack, skipping those already asked.
+func (b *browser) followUps() []question {
+	var qs []question
+	ask := func(q question) {
+		if !b.asked[q] {
+			b.asked[q] = true
+			qs = append(qs, q)
+		}
+	}
+	for _, key := range b.keys() {
+		inst := b.instances[key]
+		if !inst.srv {
+			ask(question{name: inst.name, qtype: typeSRV})
+		}
+		if !inst.txt {
+			ask(question{name: inst.name, qtype: typeTXT})
+		}
+		if h := b.hosts[canonical(inst.target)]; inst.srv && (h == nil || len(h.ipv4)+len(h.ipv6) == 0) {
+			ask(question{name: inst.target, qtype: typeA})
+			ask(question{name: inst.target, qtype: typeAAAA})
+		}
+	}
+	return qs
+}
+
+// handle applies the records of a response and returns the entries that
+// are new or changed as a result. Malformed packets and queries are
+// ignored.
+func (b *browser) handle(data []byte, iface string) []*ServiceEntry {
+	msg, err := parseMessage(data)
+	if err != nil || !msg.response {
+		return nil
+	}
+
+	for _, r := range msg.records {
+		switch r.rtype {
+		case typePTR:
+			if canonical(r.name) != b.service {
+				continue
+			}
+			if r.ttl == 0 {
+				delete(b.instances, canonical(r.target))
+				continue
+			}
+			b.instance(r.target, iface)
+		case typeSRV:
+			if inst := b.instance(r.name, iface); inst != nil && r.ttl > 0 {
+				inst.target, inst.port, inst.srv = r.target, r.port, true
+			}
+		case typeTXT:
+			if inst := b.instance(r.name, iface); inst != nil && r.ttl > 0 {
+				inst.text, inst.txt = r.text, true
+			}
+		}
+	}
+
+	// Address records are only kept for hosts that instances point at, as
+	// the multicast socket sees every name on the network.
+	targets := make(map[string]bool)
+	for _, inst := range b.instances {
+		if inst.srv {
+			targets[canonical(inst.target)] = true
+		}
+	}
+	for _, r := range msg.records {
+		if (r.rtype != typeA && r.rtype != typeAAAA) || r.ttl == 0 || !targets[canonical(r.name)] {
+			continue
+		}
+		h := b.hosts[canonical(r.name)]
+		if h == nil {
+			h = &host{}
+			b.hosts[canonical(r.name)] = h
+		}
+		if ip4 := r.ip.To4(); ip4 != nil {
+			h.ipv4 = appendIP(h.ipv4, ip4)
+		} else {
+			h.ipv6 = appendIP(h.ipv6, r.ip)
+		}
+	}
+
+	var entries []*ServiceEntry
+	for _, key := range b.keys() {
+		if e := b.entry(b.instances[key]); e != nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// instance returns the instance record for name, creating it when name is
+// an instance of the browsed service and nil otherwise.
+func (b *browser) instance(name, iface string) *instance {
+	key := canonical(name)
+	if !strings.HasSuffix(key, "."+b.service) {
+		return nil
+	}
+	inst, ok := b.instances[key]
+	if !ok {
+		inst = &instance{name: name}
+		b.instances[key] = inst
+	}
+	if iface != "" {
+		inst.iface = iface
+	}
+	return inst
+}
+
+// entry returns the entry for inst when it is complete and differs from
+// the one last emitted.
+func (b *browser) entry(inst *instance) *ServiceEntry {
+	h := b.hosts[canonical(inst.target)]
+	if !inst.srv || h == nil {
+		return nil
+	}
+	sig := fmt.Sprint(inst.target, inst.port, inst.text, h.ipv4, h.ipv6, inst.iface)
+	if sig == inst.sent {
+		return nil
+	}
+	inst.sent = sig
+
+	labels := splitName(inst.name)
+	return &ServiceEntry{
+		Instance:  labels[0],
+		HostName:  inst.target,
+		Service:   b.serviceType,
+		Port:      int(inst.port),
+		Text:      slices.Clone(inst.text),
+		AddrIPv4:  slices.Clone(h.ipv4),
+		AddrIPv6:  slices.Clone(h.ipv6),
+		Interface: inst.iface,
+	}
+}
+
+// keys returns the instance keys in a stable order.
+func (b *browser) keys() []string {
+	keys := make([]string, 0, len(b.instances))
+	for key := range b.instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
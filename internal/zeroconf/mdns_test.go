@@ -0,0 +1,183 @@
+package zeroconf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+const testService = "_matter._tcp.local."
+
+func lampRecords(ttl uint32) []record {
+	return []record{
+		{name: testService, rtype: typePTR, ttl: ttl, target: "Lamp._matter._tcp.local."},
+		{name: "Lamp._matter._tcp.local.", rtype: typeSRV, ttl: ttl, port: 5540, target: "lamp.local."},
+		{name: "Lamp._matter._tcp.local.", rtype: typeTXT, ttl: ttl, text: []string{"fv=1.0"}},
+		{name: "lamp.local.", rtype: typeA, ttl: ttl, ip: net.IPv4(10, 0, 0, 7)},
+		{name: "lamp.local.", rtype: typeAAAA, ttl: ttl, ip: net.ParseIP("fe80::7")},
+	}
+}
+
+func TestBrowserAssemblesEntries(t *testing.T) {
+	b := newBrowser("_matter._tcp", "local.")
+
+	entries := b.handle(packResponse(lampRecords(120)...), "eth0")
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Instance != "Lamp" || e.HostName != "lamp.local." || e.Service != "_matter._tcp" || e.Port != 5540 || e.Interface != "eth0" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if len(e.Text) != 1 || e.Text[0] != "fv=1.0" {
+		t.Fatalf("unexpected TXT %v", e.Text)
+	}
+	if len(e.AddrIPv4) != 1 || !e.AddrIPv4[0].Equal(net.IPv4(10, 0, 0, 7)) || len(e.AddrIPv6) != 1 {
+		t.Fatalf("unexpected addresses %v %v", e.AddrIPv4, e.AddrIPv6)
+	}
+
+	if again := b.handle(packResponse(lampRecords(120)...), "eth0"); len(again) != 0 {
+		t.Fatalf("expected an unchanged repeat to be dropped, got %+v", again)
+	}
+
+	changed := packResponse(record{name: "Lamp._matter._tcp.local.", rtype: typeTXT, ttl: 120, text: []string{"fv=1.1"}})
+	if got := b.handle(changed, "eth0"); len(got) != 1 || got[0].Text[0] != "fv=1.1" {
+		t.Fatalf("expected a changed TXT record to re-emit the entry, got %+v", got)
+	}
+}
+
+func TestBrowserAsksForMissingRecords(t *testing.T) {
+	b := newBrowser("_matter._tcp", "local.")
+
+	if qs := b.questions(); len(qs) != 1 || qs[0] != (question{name: testService, qtype: typePTR}) {
+		t.Fatalf("expected only the PTR query, got %+v", qs)
+	}
+
+	ptr := packResponse(lampRecords(120)[0])
+	if entries := b.handle(ptr, ""); len(entries) != 0 {
+		t.Fatalf("expected no entry before SRV and addresses, got %+v", entries)
+	}
+	qs := b.followUps()
+	if len(qs) != 2 || qs[0].qtype != typeSRV || qs[1].qtype != typeTXT {
+		t.Fatalf("expected SRV and TXT follow-ups, got %+v", qs)
+	}
+	if again := b.followUps(); len(again) != 0 {
+		t.Fatalf("expected follow-ups to be asked once, got %+v", again)
+	}
+
+	b.handle(packResponse(lampRecords(120)[1]), "")
+	qs = b.followUps()
+	if len(qs) != 2 || qs[0] != (question{name: "lamp.local.", qtype: typeA}) || qs[1].qtype != typeAAAA {
+		t.Fatalf("expected address follow-ups, got %+v", qs)
+	}
+
+	if qs := b.questions(); len(qs) != 4 {
+		t.Fatalf("expected the periodic query to repeat outstanding follow-ups, got %+v", qs)
+	}
+}
+
+func TestBrowserIgnoresUnrelatedRecords(t *testing.T) {
+	b := newBrowser("_matter._tcp", "local.")
+
+	other := packResponse(
+		record{name: "_http._tcp.local.", rtype: typePTR, ttl: 120, target: "Printer._http._tcp.local."},
+		record{name: "Printer._http._tcp.local.", rtype: typeSRV, ttl: 120, port: 80, target: "printer.local."},
+		record{name: "printer.local.", rtype: typeA, ttl: 120, ip: net.IPv4(10, 0, 0, 9)},
+	)
+	if entries := b.handle(other, ""); len(entries) != 0 || len(b.instances) != 0 || len(b.hosts) != 0 {
+		t.Fatalf("expected other services to be ignored, got %+v", entries)
+	}
+
+	query := packQuery([]question{{name: testService, qtype: typePTR}})
+	if entries := b.handle(query, ""); len(entries) != 0 {
+		t.Fatalf("expected queries to be ignored, got %+v", entries)
+	}
+}
+
+func TestBrowserForgetsGoodbyes(t *testing.T) {
+	b := newBrowser("_matter._tcp", "local.")
+	b.handle(packResponse(lampRecords(120)...), "")
+
+	b.handle(packResponse(lampRecords(0)[0]), "")
+	if len(b.instances) != 0 {
+		t.Fatalf("expected a goodbye to remove the instance, got %+v", b.instances)
+	}
+	if entries := b.handle(packResponse(lampRecords(120)...), ""); len(entries) != 1 {
+		t.Fatalf("expected the instance to be emitted again after returning, got %+v", entries)
+	}
+}
+
+func TestMDNSBrowseQueriesResponder(t *testing.T) {
+	responder, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, src, err := responder.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if m, err := parseMessage(buf[:n]); err != nil || m.response {
+				continue
+			}
+			responder.WriteToUDP(packResponse(lampRecords(120)...), src)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r := &MDNS{group: responder.LocalAddr().(*net.UDPAddr)}
+	entries := make(chan *ServiceEntry)
+	if err := r.Browse(ctx, "_matter._tcp", "local.", entries); err != nil {
+		t.Fatalf("expected browse to start, got %v", err)
+	}
+
+	e, ok := <-entries
+	if !ok {
+		t.Fatal("expected an entry before the channel closed")
+	}
+	if e.Instance != "Lamp" || len(e.AddrIPv4) != 1 {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	cancel()
+	for range entries {
+	}
+}
+
+func TestMDNSListensOnSelectedInterfaces(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo *net.Interface
+	for i, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 && len(interfaceIPv4s(ifi)) > 0 {
+			lo = &ifaces[i]
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface with an IPv4 address")
+	}
+
+	conns, err := (&MDNS{Interfaces: []net.Interface{*lo}}).listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bound bool
+	for _, c := range conns {
+		if addr := c.conn.LocalAddr().(*net.UDPAddr); c.send != nil && addr.IP.IsLoopback() {
+			bound = true
+		}
+		c.conn.Close()
+	}
+	if !bound {
+		t.Fatal("expected an IPv4 query socket bound to the interface's address")
+	}
+}
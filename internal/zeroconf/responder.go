@@ -0,0 +1,164 @@
+package zeroconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// responderTTL is the TTL of the records a Responder answers with.
+const responderTTL = 120
+
+// Service is a service instance advertised by a Responder.
+type Service struct {
+	Instance string
+	// Service is the service type, such as "_matter._tcp".
+	Service string
+	// Domain defaults to "local.".
+	Domain   string
+	HostName string
+	Port     int
+	IPs      []net.IP
+	Text     []string
+}
+
+// name returns the instance name, keeping the case of the instance.
+func (s Service) name() string {
+	return joinLabels([]string{s.Instance}) + canonical(s.Service+"."+s.domain())
+}
+
+func (s Service) domain() string {
+	if s.Domain == "" {
+		return "local."
+	}
+	return canonical(s.Domain)
+}
+
+// records returns the PTR, SRV, TXT and address records of s, with ttl.
+func (s Service) records(ttl uint32) []record {
+	name := s.name()
+	records := []record{
+		{name: canonical(s.Service + "." + s.domain()), rtype: typePTR, ttl: ttl, target: name},
+		{name: name, rtype: typeSRV, ttl: ttl, port: uint16(s.Port), target: canonical(s.HostName)},
+		{name: name, rtype: typeTXT, ttl: ttl, text: s.Text},
+	}
+	for _, ip := range s.IPs {
+		rtype := typeAAAA
+		if ip.To4() != nil {
+			rtype = typeA
+		}
+		records = append(records, record{name: canonical(s.HostName), rtype: rtype, ttl: ttl, ip: ip})
+	}
+	return records
+}
+
+// Responder answers multicast DNS queries for its services, so that
+// browsers on this host or its network discover them. It is a minimal
+// responder: names are assumed unique, so it neither probes for conflicts
+// nor defends them.
+type Responder struct {
+	Services []Service
+
+	// group, when set, replaces the IPv4 multicast group so tests can run
+	// on loopback.
+	group *net.UDPAddr
+}
+
+// Serve announces the services and answers queries for them until ctx is
+// done, then announces their goodbyes.
+func (r *Responder) Serve(ctx context.Context) error {
+	group := r.group
+	var (
+		conn *net.UDPConn
+		err  error
+	)
+	if group != nil {
+		conn, err = net.ListenUDP("udp4", group)
+	} else {
+		group = mdnsIPv4
+		conn, err = net.ListenMulticastUDP("udp4", nil, group)
+	}
+	if err != nil {
+		return fmt.Errorf("mdns: %w", err)
+	}
+	return r.serve(ctx, conn, group)
+}
+
+func (r *Responder) serve(ctx context.Context, conn *net.UDPConn, group *net.UDPAddr) error {
+	announce := func(ttl uint32) {
+		var records []record
+		for _, s := range r.Services {
+			records = append(records, s.records(ttl)...)
+		}
+		conn.WriteToUDP(packResponse(records...), group)
+	}
+	go func() {
+		<-ctx.Done()
+		announce(0)
+		conn.Close()
+	}()
+	// Announcements are sent twice, a second apart (RFC 6762 section 8.3).
+	announce(responderTTL)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			announce(responderTTL)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("mdns: %w", err)
+		}
+		m, err := parseMessage(buf[:n])
+		if err != nil || m.response {
+			continue
+		}
+		answers, unicast := r.answer(m.questions)
+		if len(answers) == 0 {
+			continue
+		}
+		// Queries from a port other than 5353 come from simple resolvers
+		// that only read unicast replies (RFC 6762 section 6.7).
+		to := group
+		if unicast || src.Port != mdnsIPv4.Port {
+			to = src
+		}
+		conn.WriteToUDP(packResponse(answers...), to)
+	}
+}
+
+// answer returns the records answering questions, and whether any asked
+// for a unicast reply. A PTR answer carries the instance's other records
+// along so browsers need no follow-up queries.
+func (r *Responder) answer(questions []question) ([]record, bool) {
+	var (
+		answers []record
+		unicast bool
+	)
+	for _, q := range questions {
+		name := canonical(q.name)
+		for _, s := range r.Services {
+			for _, rec := range s.records(responderTTL) {
+				match := canonical(rec.name) == name
+				if rec.rtype == typePTR && match && (q.qtype == typePTR || q.qtype == typeANY) {
+					answers = append(answers, s.records(responderTTL)...)
+					unicast = unicast || q.unicast
+					break
+				}
+				if rec.rtype != typePTR && match && (q.qtype == rec.rtype || q.qtype == typeANY) {
+					answers = append(answers, rec)
+					unicast = unicast || q.unicast
+				}
+			}
+		}
+	}
+	return answers, unicast
+}
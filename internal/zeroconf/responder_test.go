@@ -0,0 +1,67 @@
+package zeroconf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func mockService() Service {
+	return Service{
+		Instance: "Mock Plug 1",
+		Service:  "_matter._tcp",
+		HostName: "mock-1.local",
+		Port:     8080,
+		IPs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Text:     []string{"fv=mock"},
+	}
+}
+
+func TestResponderAnswersQuestions(t *testing.T) {
+	r := &Responder{Services: []Service{mockService()}}
+
+	answers, unicast := r.answer([]question{{name: testService, qtype: typePTR, unicast: true}})
+	if !unicast || len(answers) != 4 || answers[0].target != `Mock Plug 1._matter._tcp.local.` {
+		t.Fatalf("expected the PTR with the instance's records, got %+v", answers)
+	}
+
+	answers, _ = r.answer([]question{{name: "MOCK-1.local.", qtype: typeA}})
+	if len(answers) != 1 || !answers[0].ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected the address record, got %+v", answers)
+	}
+
+	if answers, _ := r.answer([]question{{name: "_hap._tcp.local.", qtype: typePTR}}); len(answers) != 0 {
+		t.Fatalf("expected no answer for another service, got %+v", answers)
+	}
+}
+
+func TestResponderIsDiscoveredByBrowse(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := conn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := &Responder{Services: []Service{mockService()}}
+	served := make(chan error)
+	go func() { served <- r.serve(ctx, conn, group) }()
+
+	entries := make(chan *ServiceEntry)
+	if err := (&MDNS{group: group}).Browse(ctx, "_matter._tcp", "local.", entries); err != nil {
+		t.Fatal(err)
+	}
+	e := <-entries
+	if e == nil || e.Instance != "Mock Plug 1" || e.Port != 8080 || len(e.AddrIPv4) != 1 || e.Text[0] != "fv=mock" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	cancel()
+	for range entries {
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+}
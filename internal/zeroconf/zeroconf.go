@@ -3,34 +3,91 @@ package zeroconf
 import (
 	"context"
 	"net"
+	"time"
 )
 
 // ServiceEntry represents a discovered service instance.
 type ServiceEntry struct {
 	Instance string
 	HostName string
+	// Service is the service type the entry was browsed under, such as
+	// "_matter._tcp", when the resolver knows it.
+	Service string
+	// Port is the service port from the SRV record.
+	Port     int
 	Text     []string
 	AddrIPv4 []net.IP
 	AddrIPv6 []net.IP
+	// Interface is the name of the network interface the entry was seen
+	// on, used as the zone of link-local IPv6 addresses.
+	Interface string
 }
 
-// Resolver performs service browsing. This is a lightweight stub that
-// immediately closes the provided results channel when the context is done.
-type Resolver struct{}
+// ScheduledEntry is an entry emitted by a stub resolver once Delay has
+// elapsed since browsing started.
+type ScheduledEntry struct {
+	Delay time.Duration
+	Entry *ServiceEntry
+}
+
+// Resolver browses for service instances. Implementations send discovered
+// entries on the channel and close it once ctx is done.
+type Resolver interface {
+	Browse(ctx context.Context, service, domain string, entries chan<- *ServiceEntry) error
+}
 
-// NewResolver returns a stub resolver. It intentionally ignores the
-// provided configuration to keep the dependency offline-friendly.
-func NewResolver(_ interface{}) (*Resolver, error) {
-	return &Resolver{}, nil
+// NewResolver returns a resolver that discovers services with multicast
+// DNS on ifaces, or on the default interfaces when ifaces is empty.
+func NewResolver(ifaces []net.Interface) (Resolver, error) {
+	return &MDNS{Interfaces: ifaces}, nil
 }
 
-// Browse starts a background goroutine that closes the entries channel once
-// the context is done. No network discovery is performed in this stub
-// implementation.
-func (r *Resolver) Browse(ctx context.Context, _ string, _ string, entries chan<- *ServiceEntry) error {
+// Stub is a resolver that performs no network discovery. It emits any
+// scheduled entries and closes the results channel when the context is
+// done.
+type Stub struct {
+	schedule []ScheduledEntry
+}
+
+// NewStubResolver returns a resolver that discovers nothing, for running
+// with configured devices only.
+func NewStubResolver() *Stub {
+	return &Stub{}
+}
+
+// NewScheduledResolver returns a stub resolver that emits the given entries
+// on schedule, which is useful for exercising discovery timing in tests.
+func NewScheduledResolver(schedule ...ScheduledEntry) *Stub {
+	return &Stub{schedule: schedule}
+}
+
+// Browse starts a background goroutine that emits the scheduled entries and
+// closes the entries channel once the context is done. Entries naming
+// another service are skipped.
+func (r *Stub) Browse(ctx context.Context, service string, _ string, entries chan<- *ServiceEntry) error {
 	go func() {
+		defer close(entries)
+
+		start := time.Now()
+		for _, s := range r.schedule {
+			if s.Entry.Service != "" && s.Entry.Service != service {
+				continue
+			}
+			timer := time.NewTimer(time.Until(start.Add(s.Delay)))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			select {
+			case entries <- s.Entry:
+			case <-ctx.Done():
+				return
+			}
+		}
 		<-ctx.Done()
-		close(entries)
 	}()
 	return nil
 }
@@ -0,0 +1,76 @@
+package zeroconf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScheduledResolverEmitsInOrder(t *testing.T) {
+	r := NewScheduledResolver(
+		ScheduledEntry{Delay: 10 * time.Millisecond, Entry: &ServiceEntry{Instance: "first"}},
+		ScheduledEntry{Delay: 30 * time.Millisecond, Entry: &ServiceEntry{Instance: "second"}},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	entries := make(chan *ServiceEntry)
+	if err := r.Browse(ctx, "_matter._tcp", "local.", entries); err != nil {
+		t.Fatalf("expected browse to start, got %v", err)
+	}
+
+	start := time.Now()
+	var got []string
+	for e := range entries {
+		got = append(got, e.Instance)
+		if len(got) == 2 {
+			cancel()
+		}
+	}
+
+	if len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Fatalf("unexpected entries %v", got)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("expected entries to respect their schedule, finished after %v", elapsed)
+	}
+}
+
+func TestScheduledResolverSkipsOtherServices(t *testing.T) {
+	r := NewScheduledResolver(
+		ScheduledEntry{Entry: &ServiceEntry{Instance: "operational", Service: "_matter._tcp"}},
+		ScheduledEntry{Entry: &ServiceEntry{Instance: "commissionable", Service: "_matterc._udp"}},
+		ScheduledEntry{Entry: &ServiceEntry{Instance: "untagged"}},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	entries := make(chan *ServiceEntry)
+	r.Browse(ctx, "_matterc._udp", "local.", entries)
+
+	var got []string
+	for e := range entries {
+		got = append(got, e.Instance)
+	}
+	if len(got) != 2 || got[0] != "commissionable" || got[1] != "untagged" {
+		t.Fatalf("unexpected entries %v", got)
+	}
+}
+
+func TestStubResolverClosesOnCancel(t *testing.T) {
+	r := NewStubResolver()
+	ctx, cancel := context.WithCancel(context.Background())
+	entries := make(chan *ServiceEntry)
+	r.Browse(ctx, "_matter._tcp", "local.", entries)
+	cancel()
+
+	select {
+	case _, ok := <-entries:
+		if ok {
+			t.Fatal("expected no entries from the stub resolver")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected entries channel to close after cancellation")
+	}
+}
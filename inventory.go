@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"powerusagecollection/pkg/collector"
+)
+
+const (
+	// discoverCommand is the subcommand that browses once and writes the
+	// discovered devices as a --devices file.
+	discoverCommand = "discover"
+	// collectCommand is the subcommand that queries the devices of a
+	// --devices file, or of standard input, without discovery.
+	collectCommand = "collect"
+)
+
+// setCommand applies the subcommand named on the command line, if any, and
+// the arguments left after its flags.
+func (o *options) setCommand(command string, args []string) error {
+	switch command {
+	case replayJSONLCommand:
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s %s [flags] FILE", os.Args[0], replayJSONLCommand)
+		}
+		o.jsonlReplay = args[0]
+		return nil
+	case discoverCommand, collectCommand:
+		if len(args) != 0 {
+			return fmt.Errorf("usage: %s %s [flags]", os.Args[0], command)
+		}
+	}
+	o.command = command
+	if command == collectCommand {
+		o.noDiscovery = true
+		if o.devicesPath == "" {
+			o.devicesPath = stdinPath
+		}
+	}
+	return nil
+}
+
+// writeInventory browses like --list and writes the discovered devices,
+// with the addresses they were found at, in the layout of the --devices
+// file: to --output if set, otherwise to w.
+func writeInventory(ctx context.Context, opts options, w io.Writer) error {
+	browseCtx, cancel := context.WithTimeout(ctx, opts.browseTimeout)
+	defer cancel()
+
+	discover := opts.discoverOptions()
+	discover.Static = nil
+	discover.Settle = opts.settle
+	var inventory devicesFile
+	err := collector.DiscoverFunc(browseCtx, discover, func(d collector.Device) {
+		if d = opts.hosts.resolve(browseCtx, d); d.Address == "" {
+			return
+		}
+		inventory.Devices = append(inventory.Devices, inventoryDevice(d))
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(inventory.Devices, func(a, b staticDevice) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.Address, b.Address))
+	})
+	if inventory.Devices == nil {
+		inventory.Devices = []staticDevice{}
+	}
+
+	data, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if opts.outputPath != "" {
+		return os.WriteFile(opts.outputPath, data, 0o644)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// inventoryDevice returns the --devices entry that reaches d again.
+func inventoryDevice(d collector.Device) staticDevice {
+	sd := staticDevice{
+		Name:          d.Instance,
+		Address:       d.Address,
+		Port:          d.Port,
+		Path:          d.Path,
+		Driver:        d.Driver,
+		Group:         d.Group,
+		Unit:          d.Unit,
+		Channels:      d.Channels,
+		Disabled:      d.Disabled,
+		Bidirectional: d.Bidirectional,
+	}
+	if host := strings.TrimSuffix(d.HostName, "."); host != d.Address {
+		sd.HostName = host
+	}
+	for _, txt := range d.Text {
+		if k, v, ok := strings.Cut(txt, "="); ok && strings.EqualFold(k, "platform") {
+			sd.Platform = v
+		}
+	}
+	return sd
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func TestWriteInventoryRoundTrips(t *testing.T) {
+	resolver := zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "Plug", HostName: "plug.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.0.2")}, Text: []string{"platform=esphome"}}},
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.0.1")}}},
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "Ghost", HostName: "ghost.local."}},
+	)
+	opts := options{browseTimeout: 10 * time.Second, settle: 100 * time.Millisecond, resolver: resolver}
+
+	var buf bytes.Buffer
+	if err := writeInventory(context.Background(), opts, &buf); err != nil {
+		t.Fatalf("expected the inventory written, got %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "{\n  \"devices\": [") {
+		t.Fatalf("expected indented JSON, got %q", buf.String())
+	}
+	path := writeFile(t, "devices.json", buf.String())
+	devices, err := loadDevices(path)
+	if err != nil {
+		t.Fatalf("expected the inventory to load as a --devices file, got %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected the devices without an address left out, got %+v", devices)
+	}
+	lamp, plug := devices[0], devices[1]
+	if lamp.Instance != "Lamp" || lamp.Address != "10.0.0.1" || lamp.HostName != "lamp.local" {
+		t.Fatalf("expected the devices sorted by name with their host names, got %+v", lamp)
+	}
+	if len(plug.Text) != 1 || plug.Text[0] != "platform=esphome" {
+		t.Fatalf("expected the platform kept, got %+v", plug)
+	}
+
+	opts.outputPath = filepath.Join(t.TempDir(), "inventory.json")
+	buf.Reset()
+	if err := writeInventory(context.Background(), opts, &buf); err != nil {
+		t.Fatalf("expected the inventory written, got %v", err)
+	}
+	if data, err := os.ReadFile(opts.outputPath); err != nil || !strings.Contains(string(data), `"name": "Plug"`) || buf.Len() != 0 {
+		t.Fatalf("expected the inventory written to --output only, got %q (%v), stdout %q", data, err, buf.String())
+	}
+}
+
+func TestSetCommand(t *testing.T) {
+	var opts options
+	if err := opts.setCommand(collectCommand, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !opts.noDiscovery || opts.devicesPath != stdinPath || opts.command != collectCommand {
+		t.Fatalf("expected collect to read stdin without discovery, got %+v", opts)
+	}
+
+	opts = options{devicesPath: "devices.json"}
+	opts.setCommand(collectCommand, nil)
+	if opts.devicesPath != "devices.json" {
+		t.Fatalf("expected --devices kept, got %q", opts.devicesPath)
+	}
+
+	opts = options{}
+	if err := opts.setCommand(replayJSONLCommand, []string{"readings.jsonl"}); err != nil || opts.jsonlReplay != "readings.jsonl" {
+		t.Fatalf("expected the file to replay set, got %q (%v)", opts.jsonlReplay, err)
+	}
+	if err := opts.setCommand(replayJSONLCommand, nil); err == nil {
+		t.Fatal("expected replay-jsonl without a file rejected")
+	}
+	if err := opts.setCommand(discoverCommand, []string{"extra"}); err == nil {
+		t.Fatal("expected discover with an argument rejected")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultJSONLMaxSize is the size past which the --jsonl file is
+	// rotated.
+	defaultJSONLMaxSize = 50 << 20
+	// defaultJSONLKeep is how many rotated --jsonl files are kept.
+	defaultJSONLKeep = 10
+	// jsonlMaxPending bounds the encoded records held for the next cycle
+	// while writes fail; the oldest are dropped past it.
+	jsonlMaxPending = 16 << 20
+	// jsonlRotatedLayout timestamps rotated files so that they sort by
+	// name in the order they were rotated.
+	jsonlRotatedLayout = "20060102T150405.000000000Z"
+	// jsonlReplayBatch is how many records replay-jsonl writes to the
+	// sinks at once.
+	jsonlReplayBatch = 500
+	// replayJSONLCommand is the subcommand that writes a --jsonl file
+	// through the configured sinks.
+	replayJSONLCommand = "replay-jsonl"
+)
+
+// jsonlRecord is a line of the --jsonl file: a record and when the
+// collector produced it.
+type jsonlRecord struct {
+	Time time.Time `json:"time"`
+	deviceResult
+}
+
+// jsonlSink appends each record as a JSON line to a file, written once per
+// poll cycle, and rotates the file once it grows past maxSize. Rotated
+// files are renamed with a timestamp, gzipped when compress is set, and
+// all but the newest keep removed; a zero keep keeps them all. A failed
+// write keeps its records for the next one, so that a full disk loses
+// nothing once space is freed.
+type jsonlSink struct {
+	path     string
+	maxSize  int64
+	keep     int
+	compress bool
+	now      func() time.Time
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	pending []byte
+}
+
+// newJSONLSink opens the file at path for appending, creating it if
+// needed.
+func newJSONLSink(path string, maxSize int64, keep int, compress bool) (*jsonlSink, error) {
+	if keep < 0 {
+		return nil, errors.New("--jsonl-keep must not be negative")
+	}
+	s := &jsonlSink{path: path, maxSize: maxSize, keep: keep, compress: compress, now: time.Now}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the file, rotating it first if it is already full. The
+// caller holds s.mu or owns s.
+func (s *jsonlSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return fmt.Errorf("open jsonl: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open jsonl: %w", err)
+	}
+	s.file, s.size = f, info.Size()
+	s.rotateIfFull()
+	return nil
+}
+
+// Write appends results, after any records an earlier write failed to.
+func (s *jsonlSink) Write(_ context.Context, results []deviceResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.pending
+	for _, r := range results {
+		line, err := json.Marshal(jsonlRecord{Time: r.Time, deviceResult: r})
+		if err != nil {
+			return fmt.Errorf("encode jsonl record: %w", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	s.pending = nil
+	if err := s.write(data); err != nil {
+		s.hold(data)
+		return err
+	}
+	return nil
+}
+
+// write appends data to the file, reopening it if an earlier write failed.
+// A partly written batch is cut off again, so that the retry does not
+// leave a broken line. The caller holds s.mu.
+func (s *jsonlSink) write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(data)
+	if err != nil {
+		if n > 0 {
+			s.file.Truncate(s.size)
+		}
+		s.file.Close()
+		s.file = nil
+		return fmt.Errorf("write jsonl: %w", err)
+	}
+	s.size += int64(n)
+	s.rotateIfFull()
+	return nil
+}
+
+// hold keeps data for the next write, dropping the oldest whole records
+// past jsonlMaxPending. The caller holds s.mu.
+func (s *jsonlSink) hold(data []byte) {
+	if over := len(data) - jsonlMaxPending; over > 0 {
+		cut := over
+		if i := bytes.IndexByte(data[over:], '\n'); i >= 0 {
+			cut += i + 1
+		} else {
+			cut = len(data)
+		}
+		slog.Warn("jsonl records dropped while writes fail", "path", s.path, "records", bytes.Count(data[:cut], []byte{'\n'}))
+		data = data[cut:]
+	}
+	s.pending = data
+}
+
+// rotateIfFull rotates the file once it has grown past maxSize, logging
+// any failure; the file then keeps growing until a rotation succeeds.
+// The caller holds s.mu or owns s.
+func (s *jsonlSink) rotateIfFull() {
+	if s.maxSize <= 0 || s.size < s.maxSize {
+		return
+	}
+	if err := s.rotate(); err != nil {
+		slog.Warn("jsonl rotation failed", "path", s.path, "error", err)
+	}
+}
+
+// rotate renames the full file aside and prunes the oldest rotated
+// files. The next write opens a new file.
+func (s *jsonlSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	ext := filepath.Ext(s.path)
+	rotated := strings.TrimSuffix(s.path, ext) + "-" + s.now().UTC().Format(jsonlRotatedLayout) + ext
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	slog.Info("rotated jsonl file", "path", s.path, "rotated", rotated)
+	if s.compress {
+		if err := gzipFile(rotated); err != nil {
+			return fmt.Errorf("gzip %s: %w", rotated, err)
+		}
+	}
+	return s.prune()
+}
+
+// prune removes all but the newest keep rotated files.
+func (s *jsonlSink) prune() error {
+	if s.keep <= 0 {
+		return nil
+	}
+	rotated, err := s.rotated()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > s.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotated returns the paths of the rotated files, oldest first.
+func (s *jsonlSink) rotated() ([]string, error) {
+	dir := filepath.Dir(s.path)
+	ext := filepath.Ext(s.path)
+	prefix := strings.TrimSuffix(filepath.Base(s.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+		if _, err := time.Parse(jsonlRotatedLayout, stamp); err == nil {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+// gzipFile compresses the file at path to path.gz and removes it.
+func gzipFile(path string) error {
+	in, err := os.Open(path) // #nosec G304 -- a file the sink rotated
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz") // #nosec G304 -- next to the rotated file
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Flush writes any records still held from a failed write.
+func (s *jsonlSink) Flush(ctx context.Context) error {
+	return s.Write(ctx, nil)
+}
+
+// Close closes the file.
+func (s *jsonlSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// readJSONL calls fn with the records of the --jsonl file at path, in
+// batches of up to jsonlReplayBatch. A rotated file ending in .gz is
+// decompressed.
+func readJSONL(path string, fn func([]deviceResult)) (int, error) {
+	f, err := os.Open(path) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	var batch []deviceResult
+	total, line := 0, 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec jsonlRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return total, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rec.deviceResult.Time = rec.Time
+		batch = append(batch, rec.deviceResult)
+		if len(batch) == jsonlReplayBatch {
+			fn(batch)
+			total += len(batch)
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return total, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(batch) > 0 {
+		fn(batch)
+		total += len(batch)
+	}
+	return total, nil
+}
+
+// replayJSONL writes the records of the --jsonl file at path through the
+// configured sinks, such as to backfill InfluxDB after an outage.
+func replayJSONL(ctx context.Context, opts options, path string) error {
+	if opts.sinks == nil || len(opts.sinks.sinks) == 0 {
+		return errors.New(replayJSONLCommand + " needs a sink to write to, such as --influx-url or --mqtt-broker")
+	}
+	if opts.jsonlPath != "" && filepath.Clean(opts.jsonlPath) == filepath.Clean(path) {
+		return errors.New(replayJSONLCommand + " cannot write to the --jsonl file it reads")
+	}
+	n, err := readJSONL(path, func(batch []deviceResult) {
+		opts.sinks.write(ctx, newSinkBatch(batch))
+	})
+	opts.sinks.flush(ctx)
+	if err != nil {
+		return err
+	}
+	counts := opts.sinks.counts()
+	slog.Info("replayed jsonl records", "path", path, "records", n, "sinks", sinksText(counts))
+	for _, c := range counts {
+		if c.Failed > 0 {
+			return fmt.Errorf("some records were not written: %s", sinksText(counts))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestJSONLSinkRotatesAndPrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+	s, err := newJSONLSink(path, 10, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, name := range []string{"Lamp", "Plug", "Fridge"} {
+		r := deviceResult{Instance: name, PowerInfo: &collector.PowerInfo{CurrentWatts: 5}, Time: now}
+		if err := s.Write(context.Background(), []deviceResult{r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, err := s.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 || !strings.HasSuffix(rotated[1], "readings-20261015T120003.000000000Z.jsonl.gz") {
+		t.Fatalf("expected the two newest rotations kept, gzipped, got %v", rotated)
+	}
+	var got []deviceResult
+	if _, err := readJSONL(rotated[1], func(batch []deviceResult) { got = append(got, batch...) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Instance != "Fridge" || got[0].CurrentWatts != 5 || !got[0].Time.Equal(now.Add(-time.Second)) {
+		t.Fatalf("expected the last record read back from the rotated file, got %+v", got)
+	}
+}
+
+func TestJSONLSinkRetriesFailedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+	s, err := newJSONLSink(path, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A read-only handle fails every write, as a full disk would.
+	s.file.Close()
+	if s.file, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(context.Background(), []deviceResult{{Instance: "Lamp"}}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if err := s.Write(context.Background(), []deviceResult{{Instance: "Plug"}}); err != nil {
+		t.Fatalf("expected the file reopened on the next cycle, got %v", err)
+	}
+	var names []string
+	if _, err := readJSONL(path, func(batch []deviceResult) {
+		for _, r := range batch {
+			names = append(names, r.Instance)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "Lamp,Plug" {
+		t.Fatalf("expected the failed records written first, got %v", names)
+	}
+}
+
+func TestJSONLSinkDropsOldestHeldRecords(t *testing.T) {
+	s := &jsonlSink{}
+	line := strings.Repeat("x", 1<<20) + "\n"
+	s.hold([]byte(strings.Repeat(line, 20)))
+	if len(s.pending) > jsonlMaxPending || !strings.HasPrefix(string(s.pending), "x") || len(s.pending)%len(line) != 0 {
+		t.Fatalf("expected whole records kept within the bound, got %d bytes", len(s.pending))
+	}
+}
+
+func TestReplayJSONLWritesThroughSinks(t *testing.T) {
+	path := writeFile(t, "readings.jsonl", `{"time":"2026-10-15T12:00:00Z","instance":"Lamp","currentWatts":12.5}
+
+{"time":"2026-10-15T12:00:10Z","instance":"Plug","currentWatts":3}
+`)
+	sink := &fakeSink{}
+	opts := options{sinks: &sinkSet{}}
+	opts.sinks.add("influx", sink, feedFresh)
+	if err := replayJSONL(context.Background(), opts, path); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 2 {
+		t.Fatalf("expected both records in one batch, got %+v", sink.batches)
+	}
+	if r := sink.batches[0][0]; r.Instance != "Lamp" || r.CurrentWatts != 12.5 || r.Time.IsZero() {
+		t.Fatalf("unexpected replayed record %+v", r)
+	}
+
+	opts.jsonlPath = path
+	if err := replayJSONL(context.Background(), opts, path); err == nil {
+		t.Fatal("expected replaying into the --jsonl file itself rejected")
+	}
+	if err := replayJSONL(context.Background(), options{}, path); err == nil {
+		t.Fatal("expected replaying without sinks rejected")
+	}
+	if err := replayJSONL(context.Background(), options{sinks: opts.sinks}, writeFile(t, "bad.jsonl", "{not json\n")); err == nil || !strings.Contains(err.Error(), "bad.jsonl:1") {
+		t.Fatalf("expected the broken line named, got %v", err)
+	}
+}
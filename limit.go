@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// fastPollInterval is how often --count polls without --interval: as soon
+// as each cycle ends, for as fast as the rate limiter allows.
+const fastPollInterval = 10 * time.Millisecond
+
+// Limits that end a bounded polling run, as named in the shutdown report.
+const (
+	limitCount    = "count"
+	limitDuration = "duration"
+)
+
+// runLimit ends a polling run after --count successful poll cycles or once
+// --duration has passed, whichever comes first, by cancelling its context.
+// A cycle is successful when any of its queries is.
+type runLimit struct {
+	count int
+	stop  context.CancelFunc
+	timer *time.Timer
+
+	mu      sync.Mutex
+	cycles  int
+	reached string
+}
+
+// newRunLimit returns the limit of a run bounded by count cycles and
+// duration, either zero for none, and the context it cancels once
+// reached.
+func newRunLimit(ctx context.Context, count int, duration time.Duration) (*runLimit, context.Context) {
+	ctx, stop := context.WithCancel(ctx)
+	l := &runLimit{count: count, stop: stop}
+	if duration > 0 {
+		l.timer = time.AfterFunc(duration, func() { l.end(limitDuration) })
+	}
+	return l, ctx
+}
+
+// cycle counts a finished poll cycle.
+func (l *runLimit) cycle(readings []collector.Reading) {
+	if l.count <= 0 || !anySucceeded(readings) {
+		return
+	}
+	l.mu.Lock()
+	l.cycles++
+	done := l.cycles >= l.count
+	l.mu.Unlock()
+	if done {
+		l.end(limitCount)
+	}
+}
+
+// end stops the run for the limit reached, unless another was first.
+func (l *runLimit) end(limit string) {
+	l.mu.Lock()
+	if l.reached == "" {
+		l.reached = limit
+	}
+	l.mu.Unlock()
+	l.stop()
+}
+
+// release stops the duration timer and cancels the limit's context.
+func (l *runLimit) release() {
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.stop()
+}
+
+// limit returns the limit that ended the run, or "" if none did.
+func (l *runLimit) limit() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reached
+}
+
+// anySucceeded reports whether any of readings is a fresh, successful
+// query; readings reused within --min-gap do not count.
+func anySucceeded(readings []collector.Reading) bool {
+	for _, r := range readings {
+		if r.Err == nil && r.Power != nil && !r.Cached {
+			return true
+		}
+	}
+	return false
+}
+
+// pollUntil polls every interval until stop is done. Each cycle runs on
+// ctx, so that one under way when stop ends still finishes.
+func pollUntil(ctx, stop context.Context, p *collector.Poller, interval time.Duration, fn func(collector.Reading)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop.Done():
+			return
+		case <-ticker.C:
+			if stop.Err() == nil {
+				p.Poll(ctx, fn)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func TestRunLimitCountsSuccessfulCycles(t *testing.T) {
+	limit, ctx := newRunLimit(context.Background(), 2, 0)
+	defer limit.release()
+
+	ok := collector.Reading{Power: &collector.PowerInfo{CurrentWatts: 5}}
+	failed := collector.Reading{Err: errors.New("timeout")}
+	cached := collector.Reading{Power: &collector.PowerInfo{CurrentWatts: 5}, Cached: true}
+
+	limit.cycle([]collector.Reading{ok})
+	limit.cycle([]collector.Reading{failed, cached})
+	if ctx.Err() != nil {
+		t.Fatal("expected failed and cached cycles not to count")
+	}
+	limit.cycle([]collector.Reading{failed, ok})
+	if ctx.Err() == nil || limit.limit() != limitCount {
+		t.Fatalf("expected the run stopped by --count, got %q", limit.limit())
+	}
+}
+
+func TestRunLimitDuration(t *testing.T) {
+	limit, ctx := newRunLimit(context.Background(), 100, 20*time.Millisecond)
+	defer limit.release()
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the run stopped by --duration")
+	}
+	limit.cycle([]collector.Reading{{Power: &collector.PowerInfo{}}})
+	if limit.limit() != limitDuration {
+		t.Fatalf("expected the first limit reached kept, got %q", limit.limit())
+	}
+
+	unbounded, ctx := newRunLimit(context.Background(), 0, 0)
+	unbounded.cycle([]collector.Reading{{Power: &collector.PowerInfo{}}})
+	if ctx.Err() != nil || unbounded.limit() != "" {
+		t.Fatal("expected an unbounded run to go on")
+	}
+	unbounded.release()
+	if ctx.Err() == nil || unbounded.limit() != "" {
+		t.Fatal("expected release to cancel without reaching a limit")
+	}
+}
+
+func TestRunStopsAfterCount(t *testing.T) {
+	var queries atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if queries.Add(1)%2 == 0 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	opts := statusOptions(addr.Port)
+	opts.format = formatText
+	opts.count = 3
+	opts.minPollGap = 0
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- run(context.Background(), opts, &out, io.Discard) }()
+	select {
+	case err := <-done:
+		if code := exitCode(err); code != exitOK {
+			t.Fatalf("expected a bounded run with some failures to succeed, got %d (%v)", code, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the run to stop after --count cycles")
+	}
+	if !strings.Contains(out.String(), "Reached --count after") {
+		t.Fatalf("expected the final summary to name the limit, got %q", out.String())
+	}
+}
+
+func TestRunRejectsLimitsWithList(t *testing.T) {
+	opts := statusOptions(1)
+	opts.listOnly = true
+	opts.duration = time.Minute
+	err := run(context.Background(), opts, io.Discard, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "cannot be combined with --list") {
+		t.Fatalf("expected --duration rejected with --list, got %v", err)
+	}
+}
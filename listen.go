@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// unixPrefix marks a --listen address as a Unix socket path.
+	unixPrefix = "unix:"
+	// listenSystemd is the --listen value that requires a socket passed
+	// by systemd.
+	listenSystemd = "systemd"
+	// defaultSocketMode is the permission of a --listen Unix socket.
+	defaultSocketMode = 0o660
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation; tests replace it.
+var listenFDsStart = 3
+
+// socketModeFlag is a flag.Value holding octal file permissions such as
+// 0660.
+type socketModeFlag os.FileMode
+
+func (m *socketModeFlag) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m).Perm())
+}
+
+func (m *socketModeFlag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0o777 {
+		return fmt.Errorf("invalid socket mode %q: want octal permissions such as 0660", s)
+	}
+	*m = socketModeFlag(v)
+	return nil
+}
+
+// listen opens the listener of the metrics server. A socket passed by
+// systemd socket activation takes precedence over addr; otherwise addr is
+// either a "unix:" socket path, created with mode, or a TCP host:port.
+func listen(addr string, mode os.FileMode, getenv func(string) string) (net.Listener, error) {
+	ln, err := activationListener(getenv)
+	if err != nil || ln != nil {
+		return ln, err
+	}
+	if addr == listenSystemd {
+		return nil, errors.New("--listen=systemd requires a socket passed by systemd (LISTEN_FDS)")
+	}
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("set socket mode: %w", err)
+	}
+	return ln, nil
+}
+
+// activationListener returns the first socket passed by systemd, or nil
+// when the process was not socket activated.
+func activationListener(getenv func(string) string) (net.Listener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		slog.Warn("socket activation passed several sockets, using the first", "count", n)
+	}
+	f := os.NewFile(uintptr(listenFDsStart), "systemd socket") // #nosec G115 -- a small descriptor number
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	slog.Info("using socket passed by systemd", "addr", ln.Addr().String())
+	return ln, nil
+}
+
+// removeStaleSocket deletes a socket file left behind at path by a process
+// that has exited. A socket still accepting connections, or any other kind
+// of file, is left alone and reported.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen %s: file exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("listen %s: socket is in use by another process", path)
+	}
+	slog.Debug("removing stale socket", "path", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func noEnv(string) string { return "" }
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collector.sock")
+	ln, err := listen(unixPrefix+path, 0o600, noEnv)
+	if err != nil {
+		t.Fatalf("expected a unix listener, got %v", err)
+	}
+	defer ln.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a socket with mode 0600, got %v", info.Mode())
+	}
+
+	if _, err := listen(unixPrefix+path, 0o600, noEnv); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expected a live socket to be left alone, got %v", err)
+	}
+}
+
+func TestListenRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collector.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(unixPrefix+path, defaultSocketMode, noEnv)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixPrefix+path, defaultSocketMode, noEnv); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("expected a regular file to be left alone, got %v", err)
+	}
+}
+
+func TestListenUsesActivationSocket(t *testing.T) {
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer passed.Close()
+	f, err := passed.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The listener takes ownership of the passed descriptor, so hand it a
+	// copy the test does not close.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(start int) { listenFDsStart = start }(listenFDsStart)
+	listenFDsStart = fd
+
+	env := map[string]string{"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "1"}
+	ln, err := listen(":0", defaultSocketMode, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("expected the passed socket, got %v", err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != passed.Addr().String() {
+		t.Fatalf("expected %s, got %s", passed.Addr(), ln.Addr())
+	}
+
+	env["LISTEN_PID"] = "1"
+	if _, err := listen(listenSystemd, defaultSocketMode, func(k string) string { return env[k] }); err == nil {
+		t.Fatal("expected --listen=systemd to fail when the sockets are meant for another process")
+	}
+}
+
+func TestSocketModeFlag(t *testing.T) {
+	var m socketModeFlag
+	if err := m.Set("0640"); err != nil || os.FileMode(m) != 0o640 || m.String() != "0640" {
+		t.Fatalf("expected 0640, got %v (%v)", m.String(), err)
+	}
+	for _, bad := range []string{"rw", "0999", "1777"} {
+		if err := m.Set(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRunServesMetricsOnUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collector.sock")
+	opts := defaultOptions()
+	opts.listen = unixPrefix + path
+	opts.socketMode = defaultSocketMode
+	opts.interval = time.Hour
+	opts.noDiscovery = true
+	opts.cfg = &config{devices: []staticDevice{{Name: "Lamp", Address: "192.0.2.1"}}}
+	opts.httpTimeout = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, opts, io.Discard, io.Discard) }()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://collector/metrics"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("expected metrics over the socket, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %s", resp.Status)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed on shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// Log formats accepted by --log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// parseLogLevel converts a --log-level name to a slog level.
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", name)
+}
+
+// newLogger returns a logger writing diagnostics to w at the given level
+// and format.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	handlerOpts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case logFormatText, "":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case logFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+}
+
+// fetchDevice queries d with f, logging the request details at debug level
+// and any failure as a warning.
+func fetchDevice(ctx context.Context, f *collector.Fetcher, d collector.Device) (*collector.PowerInfo, error) {
+	start := time.Now()
+	power, err := f.Fetch(ctx, d)
+	attrs := []any{
+		"device", d.Instance,
+		"txt", d.Text,
+		"address", d.Address,
+		"url", f.URL(d),
+		"latency", time.Since(start),
+	}
+	if power != nil && power.RawUnit != "" {
+		attrs = append(attrs, "rawPower", power.RawPower, "rawUnit", power.RawUnit)
+	}
+	slog.Debug("power query", attrs...)
+	if err != nil {
+		slog.Warn("power query failed", "device", d.Instance, "host", d.HostName, "error", err)
+	}
+	return power, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestNewLoggerRejectsUnknownSettings(t *testing.T) {
+	if _, err := newLogger(io.Discard, "loud", logFormatText); err == nil {
+		t.Fatal("expected error for unknown level")
+	}
+	if _, err := newLogger(io.Discard, "info", "xml"); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestNewLoggerFiltersByLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn", logFormatJSON)
+	if err != nil {
+		t.Fatalf("expected logger, got %v", err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "device", "Lamp")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q (%v)", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record["device"] != "Lamp" {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
+
+func TestFetchDeviceLogsDebugDetails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger, _ := newLogger(&buf, "debug", logFormatText)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	d := collector.Device{Instance: "Lamp", Address: addr.IP.String(), Text: []string{"fv=1.0"}}
+	if _, err := fetchDevice(context.Background(), &collector.Fetcher{Port: addr.Port}, d); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{"level=DEBUG", `txt="[fv=1.0]"`, "url=" + server.URL + "/api/power", "latency="} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in debug log, got %q", want, got)
+		}
+	}
+}
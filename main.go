@@ -1,139 +1,1637 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
 )
 
-// PowerInfo models a simple JSON response for current power usage.
-// Adjust fields to match your devices' API shape.
-type PowerInfo struct {
-	DeviceName   string  `json:"deviceName"`
-	CurrentWatts float64 `json:"currentWatts"`
-	Voltage      float64 `json:"voltage,omitempty"`
-	Amperage     float64 `json:"amperage,omitempty"`
-	Timestamp    string  `json:"timestamp,omitempty"`
-}
+// options holds the parsed command-line flags.
+type options struct {
+	configPath     string
+	showConfig     bool
+	showVersion    bool
+	jsonOutput     bool
+	verbose        bool
+	quiet          bool
+	listOnly       bool
+	format         string
+	outputPath     string
+	interval       time.Duration
+	adaptivePoll   bool
+	intervalMin    time.Duration
+	intervalMax    time.Duration
+	adaptiveThresh wattsFlag
+	count          int
+	duration       time.Duration
+	minPollGap     time.Duration
+	failThreshold  int
+	offlineAfter   int
+	offlinePoll    time.Duration
+	rateLimitPoll  time.Duration
+	listen         string
+	socketMode     socketModeFlag
+	scrapeOnDemand bool
+	staleness      time.Duration
+	metricTTL      time.Duration
+	concurrency    int
+	browseTimeout  time.Duration
+	services       serviceFlag
+	interfaces     interfaceFlag
+	domain         string
+	httpTimeout    time.Duration
+	headerTimeout  time.Duration
+	bodyTimeout    time.Duration
+	retries        int
+	retryBackoff   time.Duration
+	maxRetryAfter  time.Duration
+	rateLimit      float64
+	rateBurst      int
+	deviceSpacing  time.Duration
+	settle         time.Duration
+	scheme         string
+	connectBy      string
+	port           int
+	insecure       bool
+	caCert         string
+	powerPath      string
+	urlTemplate    string
+	driver         string
+	fields         collector.FieldPaths
+	esphomeSensor  string
+	maxResponse    byteSizeFlag
+	groupTXTKey    string
+	noColor        bool
+	colorWarnWatts float64
+	colorHighWatts float64
+	minFirmware    string
+	expectedPath   string
+	vendorPath     string
+	influxURL      string
+	influxToken    string
+	influxOrg      string
+	influxBucket   string
+	pushgatewayURL string
+	pushCollector  string
+	mqttBroker     string
+	mqttTopic      string
+	mqttUsername   string
+	mqttPassword   string
+	mqttClientID   string
+	mqttQoS        int
+	mqttRetain     bool
+	mqttInsecure   bool
+	mqttCACert     string
+	haDiscovery    bool
+	haREST         bool
+	ingest         bool
+	ingestToken    string
+	enablePprof    bool
+	autoUnit       bool
+	haPrefix       string
+	haCleanup      bool
+	devicesPath    string
+	noDiscovery    bool
+	mustDiscover   bool
+	allowDupes     bool
+	preferIPv6     bool
+	ipv4Only       bool
+	ipv6Only       bool
+	logLevel       string
+	logFormat      string
+	carryLast      bool
+	onlyChanges    bool
+	changeThresh   changeThresholdFlag
+	heartbeat      time.Duration
+	maxGap         time.Duration
+	statePath      string
+	reportPath     string
+	reportEvery    time.Duration
+	alertAbove     wattsFlag
+	alertClear     wattsFlag
+	alertBelow     signedWattsFlag
+	alertClearUp   signedWattsFlag
+	alertWebhook   string
+	alertInterval  time.Duration
+	standbyThresh  wattsFlag
+	sqlitePath     string
+	sqliteKeep     retentionFlag
+	jsonlPath      string
+	jsonlMaxSize   byteSizeFlag
+	jsonlKeep      int
+	jsonlGzip      bool
+	jsonlReplay    string
+	spoolDir       string
+	spoolMaxSize   byteSizeFlag
+	command        string
+	match          string
+	exclude        string
+	requireTXT     string
+	failOnAnyError bool
+	httpUser       string
+	httpPass       string
+	httpToken      string
+	stampLayout    string
+	maxSkew        time.Duration
+	timezone       string
+	timeFormat     string
+	watch          bool
+	sortBy         string
+	tableWidth     int
+	recordPath     string
+	replayPath     string
+	replaySpeed    speedFlag
+	showUnaliased  bool
+	tariffRate     float64
+	noProbe        bool
+	noHostLookup   bool
+	graphiteAddr   string
+	graphitePrefix string
+	graphiteBuffer int
+	statsdAddr     string
+	statsdFormat   string
+	otlpEndpoint   string
+	otlpHeaders    string
+	otlpTLS        bool
+	otlpInsecure   bool
+	otlpCACert     string
+	webhookURL     string
+	webhookHeaders headerFlag
+	statsWindow    time.Duration
+	statsTimezone  string
+	cachePath      string
+	useCache       bool
+	cacheTTL       retentionFlag
+	maxWatts       float64
+	rejectNegative bool
+	voltageRange   voltageRangeFlag
+	maxMismatch    float64
+	anomalyMode    string
+	includeSuspect bool
+	traceHTTP      bool
+	scanCIDRs      prefixFlag
+	scanInterval   time.Duration
+	scanTimeout    time.Duration
 
-func main() {
-	listOnly := flag.Bool("list", false, "Only list Matter devices with their name and firmware version")
-	flag.Parse()
+	// cfg is the loaded config file, if any.
+	cfg *config
+	// explicit are the flags given on the command line, which neither the
+	// config file nor a reload of it overrides.
+	explicit map[string]bool
+	// fromEnv are the flags set from their environment variables.
+	fromEnv []string
+	// setFlags are the flags set by any means, for the --report document.
+	setFlags map[string]string
+	// logs is where diagnostics are written.
+	logs io.Writer
+	// resolver browses for devices.
+	resolver collector.Resolver
+	// sourceFailures records the discovery sources that failed.
+	sourceFailures *sourceFailures
+	// httpFetcher is built once from the flags so every query shares its
+	// HTTP client.
+	httpFetcher *collector.Fetcher
+	// out is the destination for device records.
+	out *output
+	// sinks receives each run or poll cycle's records: InfluxDB, the
+	// Pushgateway, MQTT, Graphite, StatsD, OTLP, the webhook and SQLite,
+	// as enabled.
+	sinks *sinkSet
+	// statsd, when set, is the StatsD sink, whose failed sends are
+	// reported on shutdown.
+	statsd *statsdSink
+	// report collects the run for --report.
+	report *runRecorder
+	// expectedFW, when set, flags listed devices with outdated firmware.
+	expectedFW *expectedFirmware
+	// vendors names the vendor IDs devices advertise.
+	vendors vendorDB
+	// units, when set, warns about readings in another unit than watts.
+	units *unitCheck
+	// hosts, when set, looks up the addresses of devices announced
+	// without any.
+	hosts *hostLookup
+	// staticDevices are loaded from the --devices file.
+	staticDevices []collector.Device
+	// alerts, when set, checks every reading against its power threshold.
+	alerts *alerter
+	// filter drops discovered devices before they are queried.
+	filter *collector.Filter
+	// watchTable, when set, draws the live --watch table.
+	watchTable *watchTable
+	// aliases holds the display names from the config file.
+	aliases aliases
+	// groups assigns devices to the groups readings are subtotalled by.
+	groups *grouper
+	// tariff, when set, prices the energy integrated in polling mode.
+	tariff *tariff
+	// cache, when set, remembers discovered devices in the --cache file.
+	cache *deviceCache
+	// deviceLog reports discovered devices' firmware, ID and host name
+	// changes.
+	deviceLog *deviceLog
+	// statsLocation is the --stats-timezone in which days begin.
+	statsLocation *time.Location
+	// times renders output timestamps as --timezone and --time-format
+	// say.
+	times timeFormat
+	// limiterWaits, when set, records how long requests waited for
+	// --rate-limit and --per-device-min-interval.
+	limiterWaits *histogram
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
+// Ways --connect-by reaches devices.
+const (
+	connectByIP       = "ip"
+	connectByHostName = "hostname"
+)
 
-	fmt.Println("Discovering Matter devices via _matter._tcp…")
-	resolver, err := zeroconf.NewResolver(nil)
+// newFetcher builds the power fetcher configured by the flags.
+func newFetcher(o options) (*collector.Fetcher, error) {
+	if o.scheme != "http" && o.scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme %q: must be http or https", o.scheme)
+	}
+	switch o.connectBy {
+	case "", connectByIP, connectByHostName:
+	default:
+		return nil, fmt.Errorf("invalid --connect-by %q: must be %s or %s", o.connectBy, connectByIP, connectByHostName)
+	}
+	if o.headerTimeout < 0 || o.bodyTimeout < 0 {
+		return nil, errors.New("--http-header-timeout and --http-body-timeout must not be negative")
+	}
+	tlsConfig, err := collector.NewTLSConfig(o.insecure, o.caCert)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "resolver error: %v\n", err)
-		os.Exit(1)
+		return nil, err
+	}
+	f := &collector.Fetcher{
+		Timeout:           o.httpTimeout,
+		HeaderTimeout:     o.headerTimeout,
+		BodyTimeout:       o.bodyTimeout,
+		Scheme:            o.scheme,
+		ConnectByHostName: o.connectBy == connectByHostName,
+		HostNameFailed: func(d collector.Device, err error) {
+			slog.Warn("device host name did not resolve, querying its last known address", "device", d.Instance, "host", d.HostName, "address", d.Address, "error", err)
+		},
+		Port:             o.port,
+		Path:             o.powerPath,
+		TLSConfig:        tlsConfig,
+		Fields:           o.fields,
+		ESPHomeSensor:    o.esphomeSensor,
+		MaxResponseBytes: int64(o.maxResponse),
+		UserAgent:        currentBuild().userAgent(),
+		Retries:          o.retries,
+		RetryBackoff:     o.retryBackoff,
+		MaxRetryAfter:    o.maxRetryAfter,
+		Auth:             collector.Credentials{Username: o.httpUser, Password: o.httpPass, Token: o.httpToken},
+		TimestampLayout:  o.stampLayout,
+		MaxSkew:          o.maxSkew,
+		TimestampWarning: func(d collector.Device, err error) {
+			slog.Warn("device timestamp rejected, using fetch time", "device", d.Instance, "host", d.HostName, "error", err)
+		},
+		ContentTypeWarning: func(url, contentType string) {
+			slog.Warn("device answered with a non-JSON content type; decoding it anyway", "url", url, "contentType", contentType)
+		},
+		ProbeEndpoints: !o.noProbe,
+		EndpointProbed: func(d collector.Device, path string) {
+			slog.Info("found power endpoint by probing", "device", d.Instance, "host", d.HostName, "path", path)
+		},
+		AddressSwitched: func(d collector.Device, from, to string) {
+			slog.Info("device answered on another address", "device", d.Instance, "host", d.HostName, "from", from, "to", to)
+		},
+		AttemptDone: func(url string, attempt int, elapsed time.Duration, err error) {
+			slog.Debug("power query attempt", "url", url, "attempt", attempt, "elapsed", elapsed, "error", err)
+		},
+	}
+	if o.traceHTTP {
+		f.HTTPTrace = func(url string, t collector.HTTPTiming) {
+			slog.Debug("power query timing", "url", url, "dns", t.DNS, "connect", t.Connect, "tls", t.TLS, "firstByte", t.FirstByte, "reused", t.Reused)
+		}
+	}
+	if o.rateLimit < 0 || o.deviceSpacing < 0 {
+		return nil, errors.New("--rate-limit and --per-device-min-interval must not be negative")
 	}
+	if o.rateLimit > 0 || o.deviceSpacing > 0 {
+		f.Limiter = collector.NewLimiter(o.rateLimit, o.rateBurst, o.deviceSpacing)
+	}
+	if f.Validator, err = newValidator(o); err != nil {
+		return nil, err
+	}
+	if o.driver != "" && o.driver != "auto" {
+		if f.Driver, err = collector.LookupDriver(o.driver); err != nil {
+			return nil, err
+		}
+	}
+	if o.urlTemplate != "" {
+		if f.Template, err = collector.ParseURLTemplate(o.urlTemplate); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
 
-	entries := make(chan *zeroconf.ServiceEntry)
-	go func() {
-		for entry := range entries {
-			handleEntry(entry, *listOnly)
+// newFilter builds the discovery filter configured by the flags, or nil
+// when no filtering was asked for.
+func newFilter(o options) (*collector.Filter, error) {
+	if o.match == "" && o.exclude == "" && o.requireTXT == "" {
+		return nil, nil
+	}
+	f := &collector.Filter{}
+	var err error
+	if o.match != "" {
+		if f.Match, err = regexp.Compile(o.match); err != nil {
+			return nil, fmt.Errorf("invalid --match pattern %q: %w", o.match, err)
 		}
-	}()
+	}
+	if o.exclude != "" {
+		if f.Exclude, err = regexp.Compile(o.exclude); err != nil {
+			return nil, fmt.Errorf("invalid --exclude pattern %q: %w", o.exclude, err)
+		}
+	}
+	if f.RequireTXT, err = collector.ParseTXTPairs(o.requireTXT); err != nil {
+		return nil, fmt.Errorf("--require-txt: %w", err)
+	}
+	return f, nil
+}
 
-	if err := resolver.Browse(ctx, "_matter._tcp", "local.", entries); err != nil {
-		fmt.Fprintf(os.Stderr, "browse error: %v\n", err)
-		os.Exit(1)
+// fetcher returns the power fetcher configured by the flags.
+func (o options) fetcher() *collector.Fetcher {
+	if o.httpFetcher == nil {
+		return &collector.Fetcher{Timeout: o.httpTimeout}
 	}
-	<-ctx.Done()
+	return o.httpFetcher
 }
 
-func handleEntry(entry *zeroconf.ServiceEntry, listOnly bool) {
-	host := strings.TrimSuffix(entry.HostName, ".")
-	addr := pickIPv4(entry)
+// output returns the destination for device records, defaulting to stdout.
+func (o options) output() *output {
+	if o.out == nil {
+		return newOutput(os.Stdout, o.format)
+	}
+	return o.out
+}
 
-	fmt.Printf("\nDiscovered: %s (%s)\n", entry.Instance, host)
-	if listOnly {
-		fw := firmwareVersion(entry)
-		if fw == "" {
-			fw = "unknown"
+// discoverOptions returns the discovery settings configured by the flags.
+func (o options) discoverOptions() collector.DiscoverOptions {
+	opts := collector.DiscoverOptions{
+		Resolver:        o.resolver,
+		Services:        o.services.services,
+		Domain:          o.domain,
+		Static:          o.staticDevices,
+		NoBrowse:        o.noDiscovery,
+		AllowDuplicates: o.allowDupes,
+		PreferIPv6:      o.preferIPv6,
+		IPv4Only:        o.ipv4Only,
+		IPv6Only:        o.ipv6Only,
+		Filter:          o.filter,
+		VendorName:      o.vendors.name,
+		SourceFailed:    o.sourceFailures.record,
+		Strict:          o.mustDiscover,
+	}
+	if len(o.aliases) > 0 {
+		opts.Alias = o.aliases.name
+	}
+	if o.listOnly {
+		opts.Settle = o.settle
+	}
+	if len(o.scanCIDRs) > 0 {
+		opts.Scan = &collector.Scanner{
+			Prefixes:    o.scanCIDRs,
+			Probe:       o.fetcher().Fetch,
+			Concurrency: o.concurrency,
+			Timeout:     o.scanTimeout,
 		}
+	}
+	return opts
+}
+
+// defaultMetricsInterval is the background refresh interval used with
+// --listen when no --interval is given.
+const defaultMetricsInterval = 30 * time.Second
+
+// defaultMinPollGap is how long a reading is reused in polling mode.
+const defaultMinPollGap = 10 * time.Second
+
+// defaultOfflinePollInterval is how often offline devices are polled.
+const defaultOfflinePollInterval = 5 * time.Minute
+
+// The --adaptive-poll defaults: the interval bounds, and the change in
+// watts that returns a device to the shortest.
+const (
+	defaultAdaptiveMin       = 5 * time.Second
+	defaultAdaptiveMax       = 5 * time.Minute
+	defaultAdaptiveThreshold = 10
+)
+
+// registerFlags defines every command-line flag on fs, storing the values
+// in o.
+func registerFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.configPath, "config", os.Getenv(envName("config")), "YAML config file (TOML is not supported) setting any flag by name, plus a devices list (flags and "+envPrefix+"* environment variables take precedence)")
+	fs.BoolVar(&o.showConfig, "print-config", false, "Print the effective configuration as YAML and exit")
+	fs.BoolVar(&o.showVersion, "version", false, "Print the version, commit and build date and exit")
+	fs.BoolVar(&o.listOnly, "list", false, "Only list Matter devices with their name and firmware version")
+	fs.BoolVar(&o.jsonOutput, "json", false, "Shorthand for --format=json")
+	fs.StringVar(&o.format, "format", formatText, "Output format: "+strings.Join(outputFormats, ", "))
+	fs.BoolVar(&o.noColor, "no-color", false, "Never color text output (also disabled by NO_COLOR, or when stdout is not a terminal)")
+	fs.Float64Var(&o.colorWarnWatts, "color-warn-watts", defaultColorWarnWatts, "Show readings of at least this many watts in yellow in text output (0 disables)")
+	fs.Float64Var(&o.colorHighWatts, "color-high-watts", defaultColorHighWatts, "Show readings of at least this many watts in red in text output (0 disables)")
+	fs.StringVar(&o.minFirmware, "min-firmware", "", "Flag devices whose firmware version is older than this as outdated in text output")
+	fs.StringVar(&o.vendorPath, "vendor-db", "", "CSV file of id,name rows naming Matter vendor IDs, added over the built-in table")
+	fs.StringVar(&o.expectedPath, "expected-firmware", "", "YAML file of the latest firmware by vendor and product ID; --list marks older devices OUTDATED and exits with status 4")
+	fs.StringVar(&o.outputPath, "output", "", "Append device records to this file instead of stdout")
+	fs.DurationVar(&o.interval, "interval", 0, "Keep running and re-query discovered devices every interval (e.g. 30s)")
+	fs.BoolVar(&o.adaptivePoll, "adaptive-poll", false, "Keep running and poll each device between --interval-min and --interval-max: every --interval-min while its power changes, less and less often while it holds steady")
+	fs.DurationVar(&o.intervalMin, "interval-min", defaultAdaptiveMin, "Shortest poll interval with --adaptive-poll, used while a device's power changes")
+	fs.DurationVar(&o.intervalMax, "interval-max", defaultAdaptiveMax, "Longest poll interval with --adaptive-poll, reached by doubling while a device's power holds steady")
+	o.adaptiveThresh = defaultAdaptiveThreshold
+	fs.Var(&o.adaptiveThresh, "adaptive-threshold", "Change in power between readings, e.g. 10W, above which --adaptive-poll polls a device every --interval-min again")
+	fs.IntVar(&o.count, "count", 0, "Poll until this many cycles have succeeded, then stop with the final summary; without --interval, poll back to back as fast as the rate limit allows")
+	fs.DurationVar(&o.duration, "duration", 0, "Poll for this long, then stop with the final summary (with --count, whichever comes first)")
+	fs.DurationVar(&o.minPollGap, "min-poll-gap", defaultMinPollGap, "In polling mode, reuse a device's reading younger than this instead of querying it again (at most half the interval; 0 disables)")
+	fs.IntVar(&o.failThreshold, "fail-threshold", collector.DefaultFailureThreshold, "Consecutive failed polls before a device is flagged as failing")
+	fs.IntVar(&o.offlineAfter, "offline-threshold", collector.DefaultOfflineThreshold, "Consecutive failed polls before a device is considered offline (0 disables)")
+	fs.DurationVar(&o.offlinePoll, "offline-poll-interval", defaultOfflinePollInterval, "How often offline devices are polled instead of every --interval")
+	fs.DurationVar(&o.rateLimitPoll, "max-rate-limit-interval", 0, "Longest a device answering 429 has its poll interval stretched to, returning to --interval after an hour without one (default 8x --interval; set to --interval to disable)")
+	fs.StringVar(&o.listen, "listen", "", "Serve Prometheus metrics at /metrics and the JSON API (/devices, /healthz, /device-events) with live readings (/stream, /events) on this address (e.g. :9109), Unix socket (unix:/run/powercollector.sock) or socket passed by systemd")
+	o.socketMode = defaultSocketMode
+	fs.Var(&o.socketMode, "socket-mode", "Permissions of the socket created for --listen=unix:<path>")
+	fs.DurationVar(&o.staleness, "metric-staleness", 2*time.Minute, "With --listen, stop exporting a device's readings once its last successful one is this old (0 to export it forever)")
+	fs.DurationVar(&o.metricTTL, "metric-device-ttl", 0, "With --listen, remove every series of a device neither discovered nor answering for this long (0 to keep them)")
+	fs.BoolVar(&o.scrapeOnDemand, "scrape-on-demand", false, "With --listen, query devices on every scrape instead of on a background interval")
+	fs.BoolVar(&o.ingest, "ingest", false, "With --listen, accept readings pushed by devices that cannot be polled at POST /ingest, as a PowerInfo JSON object or array named by deviceName")
+	fs.StringVar(&o.ingestToken, "ingest-token", "", "Bearer token required by POST /ingest")
+	fs.BoolVar(&o.enablePprof, "enable-pprof", false, "Serve the Go runtime profiles under /debug/pprof/ on the --listen address")
+	fs.BoolVar(&o.haREST, "ha-rest", false, "With --listen, serve each device's last reading at /ha/{device} (by name, alias or host name, in any case) and the total at /ha/total for Home Assistant's RESTful sensor, e.g.:\n"+
+		"  sensor:\n"+
+		"    - platform: rest\n"+
+		"      name: Office Lamp\n"+
+		"      resource: http://collector:9109/ha/office%20lamp\n"+
+		"      value_template: \"{{ value_json.state }}\"\n"+
+		"      json_attributes_path: \"$.attributes\"\n"+
+		"      json_attributes: [voltage, current]\n"+
+		"      unit_of_measurement: W\n"+
+		"      device_class: power\n"+
+		"      scan_interval: 30")
+	fs.IntVar(&o.concurrency, "concurrency", collector.DefaultConcurrency, "Maximum number of devices queried at once")
+	fs.DurationVar(&o.browseTimeout, "timeout", 15*time.Second, "How long to browse for devices in one-shot mode")
+	o.services = serviceFlag{services: slices.Clone(defaultServices)}
+	fs.Var(&o.services, "service", "mDNS service type to browse, repeatable to browse several at once (e.g. _shelly._tcp, or _matterd._udp for commissioners)")
+	fs.Var(&o.interfaces, "interface", "Browse for devices only on this network interface (repeatable; default: all)")
+	fs.StringVar(&o.domain, "domain", collector.DefaultDomain, "mDNS domain to browse")
+	fs.DurationVar(&o.httpTimeout, "http-timeout", collector.DefaultHTTPTimeout, "Timeout for each device power query, retries included")
+	fs.DurationVar(&o.headerTimeout, "http-header-timeout", 0, "Timeout for a device's response headers once a query is sent (0 leaves it to --http-timeout)")
+	fs.DurationVar(&o.bodyTimeout, "http-body-timeout", 0, "Timeout for a device's response body once its headers arrive, for firmware that trickles its JSON (0 leaves it to --http-timeout); timed-out bodies are not retried")
+	fs.IntVar(&o.retries, "retries", 0, "Retry a power query this many times after a connection error, timeout or 5xx response")
+	fs.DurationVar(&o.retryBackoff, "retry-backoff", collector.DefaultRetryBackoff, "Delay before the first retry, doubled (with jitter) for each further retry")
+	fs.DurationVar(&o.maxRetryAfter, "max-retry-after", collector.DefaultMaxRetryAfter, "Longest Retry-After delay of a 429 response waited out before retrying; longer ones fail the query")
+	fs.Float64Var(&o.rateLimit, "rate-limit", 0, "Send at most this many device requests per second, retries included (0 means unlimited)")
+	fs.IntVar(&o.rateBurst, "rate-limit-burst", 1, "Requests --rate-limit lets through at once before pacing them")
+	fs.DurationVar(&o.deviceSpacing, "per-device-min-interval", 0, "Minimum time between two requests to the same device")
+	fs.DurationVar(&o.settle, "settle", 3*time.Second, "With --list, stop once no new device has appeared for this long (0 waits for the full timeout)")
+	fs.StringVar(&o.scheme, "scheme", "http", "Scheme used to reach device power endpoints (http or https)")
+	fs.StringVar(&o.connectBy, "connect-by", connectByIP, "Reach devices by their discovered address (ip) or by their mDNS host name through the system resolver (hostname), falling back to the address when the name does not resolve")
+	fs.IntVar(&o.port, "port", 0, "Port of device power endpoints (default 80 for http, 443 for https)")
+	fs.BoolVar(&o.insecure, "insecure-skip-verify", false, "Skip TLS certificate verification for HTTPS devices")
+	fs.StringVar(&o.httpUser, "http-user", "", "Username for devices requiring basic or digest authentication")
+	fs.StringVar(&o.httpPass, "http-pass", "", "Password for devices requiring basic or digest authentication")
+	fs.StringVar(&o.httpToken, "http-token", "", "Bearer token sent with every power query")
+	fs.StringVar(&o.caCert, "ca-cert", "", "PEM bundle of extra CA certificates trusted for HTTPS devices")
+	fs.StringVar(&o.powerPath, "power-path", "", "Path of the power endpoint on each device (default depends on the driver; /api/power for generic)")
+	fs.StringVar(&o.urlTemplate, "url-template", "", "Full URL template for power queries using {addr}, {port}, {host}, {instance} and {channel} (overrides --scheme and --power-path)")
+	o.maxResponse = collector.DefaultMaxResponseBytes
+	fs.Var(&o.maxResponse, "max-response-bytes", "Largest device response read, once decompressed, e.g. 64KB or 1MB; larger ones fail the query")
+	fs.BoolVar(&o.noHostLookup, "no-host-lookup", false, "Do not look up the host names of devices announced without address records through the system resolver, for where .local lookups hang")
+	fs.BoolVar(&o.noProbe, "no-probe", false, "Do not try well-known endpoints (/status, /rpc/Switch.GetStatus?id=0, /cm?cmnd=Status%208) on devices that answer 404 on the power path")
+	fs.StringVar(&o.driver, "driver", "auto", "Device driver: auto, "+strings.Join(collector.DriverNames(), ", "))
+	fs.StringVar(&o.fields.Watts, "watts-field", "", "Dotted JSON path to the watts value, e.g. StatusSNS.ENERGY.Power or meters.0.power")
+	fs.StringVar(&o.fields.Voltage, "voltage-field", "", "Dotted JSON path to the voltage value")
+	fs.StringVar(&o.fields.Amperage, "amps-field", "", "Dotted JSON path to the amperage value")
+	fs.StringVar(&o.fields.PowerFactor, "pf-field", "", "Dotted JSON path to the power factor value")
+	fs.StringVar(&o.fields.Frequency, "frequency-field", "", "Dotted JSON path to the line frequency value in hertz")
+	fs.StringVar(&o.fields.PhaseWatts, "phase-watts-field", "", "Dotted JSON path to each phase's watts of a polyphase meter, with {phase} for its index from 0, e.g. emeters.{phase}.power")
+	fs.StringVar(&o.fields.PhaseVoltage, "phase-voltage-field", "", "Dotted JSON path to each phase's voltage, with {phase} as in --phase-watts-field")
+	fs.StringVar(&o.fields.PhaseAmperage, "phase-amps-field", "", "Dotted JSON path to each phase's amperage, with {phase} as in --phase-watts-field")
+	fs.StringVar(&o.fields.PhasePowerFactor, "phase-pf-field", "", "Dotted JSON path to each phase's power factor, with {phase} as in --phase-watts-field")
+	fs.StringVar(&o.groupTXTKey, "group-by-txt-key", "", "Group discovered devices by the value of this TXT record key, e.g. room; devices without it, and static devices without a group, fall into the default group")
+	fs.StringVar(&o.esphomeSensor, "esphome-sensor", "", "ID of the sensor the esphome driver reads, e.g. power_consumption (default: the first sensor reporting watts)")
+	fs.StringVar(&o.influxURL, "influx-url", "", "InfluxDB v2 server URL to write readings to (e.g. http://influx:8086)")
+	fs.StringVar(&o.influxToken, "influx-token", "", "InfluxDB API token")
+	fs.StringVar(&o.influxOrg, "influx-org", "", "InfluxDB organization")
+	fs.StringVar(&o.influxBucket, "influx-bucket", "", "InfluxDB bucket")
+	fs.StringVar(&o.pushgatewayURL, "pushgateway-url", "", "Prometheus Pushgateway to push device gauges to after each run or poll cycle (e.g. http://pushgateway:9091)")
+	fs.StringVar(&o.pushCollector, "pushgateway-collector", "", "Collector label of this run's Pushgateway groups; only groups under it are deleted when their device disappears (default: the host name)")
+	fs.StringVar(&o.graphiteAddr, "graphite-addr", "", "Graphite/Carbon plaintext host:port to send readings to after every run or poll cycle (e.g. graphite:2003)")
+	fs.StringVar(&o.graphitePrefix, "graphite-prefix", "power", "Prefix of the Graphite metric paths, as in <prefix>.<device>.watts")
+	fs.IntVar(&o.graphiteBuffer, "graphite-buffer", defaultGraphiteBuffer, "Points held while Graphite is unreachable; the oldest are dropped beyond this")
+	fs.StringVar(&o.statsdAddr, "statsd-addr", "", "StatsD host:port to send readings to over UDP after every run or poll cycle (e.g. 127.0.0.1:8125)")
+	fs.StringVar(&o.statsdFormat, "statsd-format", statsdFormatDog, "StatsD dialect: dogstatsd (device tags) or plain (device in the metric name)")
+	fs.StringVar(&o.otlpEndpoint, "otlp-endpoint", "", "OpenTelemetry collector to export metrics to after every run or poll cycle: host:port for gRPC (e.g. localhost:4317) or an http(s):// URL for HTTP/protobuf (e.g. http://localhost:4318)")
+	fs.StringVar(&o.otlpHeaders, "otlp-headers", "", "Headers sent with every OTLP export, as comma-separated key=value pairs (e.g. authorization=Bearer%20token)")
+	fs.BoolVar(&o.otlpTLS, "otlp-tls", false, "Use TLS for a gRPC --otlp-endpoint")
+	fs.BoolVar(&o.otlpInsecure, "otlp-insecure-skip-verify", false, "Skip TLS certificate verification for the OTLP endpoint")
+	fs.StringVar(&o.otlpCACert, "otlp-ca-cert", "", "PEM bundle of extra CA certificates trusted for the OTLP endpoint")
+	fs.StringVar(&o.webhookURL, "webhook-url", "", "URL that each run or poll cycle's readings are POSTed to as one JSON batch")
+	fs.Var(&o.webhookHeaders, "webhook-header", "Header sent with every --webhook-url batch, as \"Name: value\" (repeatable)")
+	fs.StringVar(&o.mqttBroker, "mqtt-broker", "", "MQTT broker to publish readings to (e.g. tcp://192.168.1.10:1883 or ssl://broker:8883)")
+	fs.StringVar(&o.mqttTopic, "mqtt-topic", "power/{instance}", "MQTT topic for each device's readings, using {instance}, {host} and {channel} (a channel not placed is added as a last level)")
+	fs.StringVar(&o.mqttUsername, "mqtt-username", "", "MQTT username")
+	fs.StringVar(&o.mqttPassword, "mqtt-password", "", "MQTT password")
+	fs.StringVar(&o.mqttClientID, "mqtt-client-id", "", "MQTT client identifier (default powerusagecollection-<pid>)")
+	fs.IntVar(&o.mqttQoS, "mqtt-qos", 0, "MQTT QoS level for readings (0 or 1)")
+	fs.BoolVar(&o.mqttRetain, "mqtt-retain", true, "Publish readings as retained messages so new subscribers get the latest value")
+	fs.BoolVar(&o.mqttInsecure, "mqtt-insecure-skip-verify", false, "Skip TLS certificate verification for the MQTT broker")
+	fs.StringVar(&o.mqttCACert, "mqtt-ca-cert", "", "PEM bundle of extra CA certificates trusted for the MQTT broker")
+	fs.BoolVar(&o.haDiscovery, "ha-discovery", false, "Publish Home Assistant MQTT discovery configs for each device (requires --mqtt-broker)")
+	fs.StringVar(&o.haPrefix, "ha-prefix", defaultHAPrefix, "Home Assistant MQTT discovery prefix")
+	fs.BoolVar(&o.haCleanup, "ha-cleanup", false, "With --ha-discovery, remove the announced entities on graceful shutdown")
+	fs.StringVar(&o.cachePath, "cache", "", "File that remembers discovered devices across runs, saved at exit")
+	fs.BoolVar(&o.useCache, "use-cache", false, "Start querying the devices in the --cache file at once while discovery refreshes it")
+	o.cacheTTL = retentionFlag(defaultCacheTTL)
+	fs.Var(&o.cacheTTL, "cache-ttl", "Drop cached devices not discovered for this long (e.g. 7d or 72h, 0 to keep them)")
+	fs.StringVar(&o.devicesPath, "devices", "", "YAML file listing devices to query in addition to discovered ones")
+	fs.BoolVar(&o.noDiscovery, "no-discovery", false, "Disable mDNS discovery and query only the configured devices")
+	fs.BoolVar(&o.mustDiscover, "require-discovery", false, "Fail when any discovery source (mDNS browse, cache) fails, instead of carrying on with the others")
+	fs.Var(&o.scanCIDRs, "scan-cidr", "Also find devices by probing every host of this subnet on the power endpoint, e.g. 192.168.30.0/24 (repeatable)")
+	fs.DurationVar(&o.scanInterval, "scan-interval", defaultScanInterval, "In polling mode, repeat --scan-cidr scans this often to follow address changes (0 scans once)")
+	fs.DurationVar(&o.scanTimeout, "scan-timeout", collector.DefaultScanTimeout, "How long to wait for each host probed by --scan-cidr")
+	fs.BoolVar(&o.allowDupes, "allow-duplicates", false, "Handle every mDNS announcement, including repeats of a device already seen")
+	fs.BoolVar(&o.preferIPv6, "prefer-ipv6", false, "Query devices on their IPv6 address when they advertise one")
+	fs.BoolVar(&o.ipv4Only, "ipv4-only", false, "Query discovered devices only on IPv4 addresses")
+	fs.BoolVar(&o.ipv6Only, "ipv6-only", false, "Query discovered devices only on IPv6 addresses")
+	fs.StringVar(&o.match, "match", "", "Only handle discovered devices whose instance name matches this regular expression")
+	fs.StringVar(&o.exclude, "exclude", "", "Skip discovered devices whose instance name matches this regular expression")
+	fs.StringVar(&o.requireTXT, "require-txt", "", "Only handle discovered devices advertising these TXT records, as comma-separated key=value pairs (e.g. VP=65521+32768)")
+	fs.StringVar(&o.logLevel, "log-level", "info", "Diagnostic log level on stderr: debug, info, warn or error")
+	fs.StringVar(&o.logFormat, "log-format", logFormatText, "Diagnostic log format: text or json")
+	fs.BoolVar(&o.verbose, "verbose", false, "Shorthand for --log-level=debug")
+	fs.BoolVar(&o.quiet, "quiet", false, "Shorthand for --log-level=error")
+	fs.BoolVar(&o.carryLast, "carry-last", false, "In cycle summaries, count a failed device at its last known reading")
+	fs.BoolVar(&o.onlyChanges, "only-changes", false, "In polling mode, write, publish and POST a device's reading only when it changed since the last one emitted (Prometheus gauges and summaries still see every reading)")
+	fs.Var(&o.changeThresh, "change-threshold", "With --only-changes, how far a reading must move to count as a change: a power such as 1.5W or a percentage such as 5% (default: any change)")
+	fs.DurationVar(&o.heartbeat, "heartbeat", 0, "With --only-changes, emit a device's reading at least this often even when unchanged (0 never forces one)")
+	fs.DurationVar(&o.maxGap, "max-gap", defaultMaxGap, "In polling mode, do not integrate energy across gaps between readings longer than this")
+	fs.StringVar(&o.statePath, "state", "", "File that persists accumulated energy across restarts")
+	fs.StringVar(&o.reportPath, "report", "", "Write a JSON report of the run to this file when it ends: its settings, every device's last reading, availability and error count, and the totals")
+	fs.DurationVar(&o.reportEvery, "report-interval", 0, "In polling mode, also rewrite the --report file this often while running (0 to write it only on shutdown)")
+	fs.Var(&o.standbyThresh, "standby-threshold", "In polling mode, estimate each device's idle power as the 10th percentile of its readings over the last 24h and report those idling above this, e.g. 3W")
+	fs.DurationVar(&o.statsWindow, "stats-window", defaultStatsWindow, "In polling mode, report per-device min, max, mean and p95 power over this rolling window (0 to disable the window)")
+	fs.StringVar(&o.statsTimezone, "stats-timezone", "", "Time zone whose midnight starts the daily statistics, e.g. Europe/London (default: local time)")
+	fs.Float64Var(&o.tariffRate, "tariff", 0, "In polling mode, price energy at this rate per kWh (time-of-use rates go under tariff-schedule: in the config file)")
+	fs.Var(&o.alertAbove, "alert-above", "Alert when a reading exceeds this power, e.g. 1500W (per-device rules go under alerts: in the config file)")
+	fs.Var(&o.alertClear, "alert-clear-below", "Re-arm an alert once readings drop below this power (default: the --alert-above threshold)")
+	fs.Var(&o.alertBelow, "alert-below", "Alert when a reading drops below this power, e.g. -3kW for export by a bidirectional meter")
+	fs.Var(&o.alertClearUp, "alert-clear-above", "Re-arm a --alert-below alert once readings rise above this power (default: the --alert-below threshold)")
+	fs.StringVar(&o.alertWebhook, "alert-webhook", "", "URL that alerts are POSTed to as JSON")
+	fs.DurationVar(&o.alertInterval, "alert-interval", defaultAlertInterval, "Minimum time between alerts for the same device")
+	fs.StringVar(&o.sqlitePath, "sqlite", "", "SQLite database file that every reading is stored in")
+	fs.Var(&o.sqliteKeep, "sqlite-retention", "Delete SQLite readings older than this (e.g. 30d or 72h), on startup and daily")
+	fs.StringVar(&o.jsonlPath, "jsonl", "", "File that every reading is appended to as a JSON line, once per poll cycle (re-send it to the sinks with the "+replayJSONLCommand+" command)")
+	o.jsonlMaxSize = defaultJSONLMaxSize
+	fs.Var(&o.jsonlMaxSize, "jsonl-max-size", "Rotate the --jsonl file, renaming it with a timestamp, once it grows past this size (0 never rotates)")
+	fs.IntVar(&o.jsonlKeep, "jsonl-keep", defaultJSONLKeep, "Rotated --jsonl files to keep, the oldest removed first (0 keeps all)")
+	fs.BoolVar(&o.jsonlGzip, "jsonl-gzip", false, "Gzip rotated --jsonl files")
+	fs.StringVar(&o.spoolDir, "spool-dir", "", "Directory where batches for the Influx, Graphite, webhook and QoS 1 MQTT sinks are kept until delivered, and replayed in order after an outage or restart")
+	o.spoolMaxSize = defaultSpoolMaxSize
+	fs.Var(&o.spoolMaxSize, "spool-max-size", "Cap on each sink's --spool-dir spool, past which the oldest batches are evicted (0 for no cap)")
+	fs.BoolVar(&o.failOnAnyError, "fail-on-any-error", false, "Exit with status 2 when any device query fails, not only when all do")
+	fs.StringVar(&o.stampLayout, "timestamp-layout", "", "Go time layout for device timestamps that are not RFC 3339 or epoch seconds/milliseconds, e.g. \"02/01/2006 15:04\" (read in local time)")
+	fs.DurationVar(&o.maxSkew, "max-timestamp-skew", collector.DefaultMaxSkew, "Replace device timestamps more than this far in the future with the fetch time")
+	fs.BoolVar(&o.autoUnit, "auto-unit", false, "Warn about devices whose readings look to be in milliwatts or kilowatts, suggesting the unit: to set for them in the devices file")
+	fs.Float64Var(&o.maxWatts, "max-watts", 0, "Treat readings above this many watts, imported or exported, as implausible, e.g. 4000 (0 disables the check)")
+	fs.BoolVar(&o.rejectNegative, "reject-negative", false, "Treat negative power as implausible, except from devices marked bidirectional: in the devices file")
+	fs.Var(&o.voltageRange, "voltage-range", "Treat readings with a voltage outside MIN-MAX as implausible, e.g. 90-260")
+	fs.Float64Var(&o.maxMismatch, "max-power-mismatch", 0, "Treat readings whose watts differ from voltage × amperage by more than this percentage as implausible (0 disables the check)")
+	fs.StringVar(&o.anomalyMode, "anomaly-mode", string(collector.AnomalyFlag), "What to do with implausible readings: flag (keep them marked \"suspect\"), clamp (limit them to the plausible range) or drop")
+	fs.BoolVar(&o.includeSuspect, "include-suspect", false, "Count suspect readings in totals, energy and statistics")
+	fs.BoolVar(&o.traceHTTP, "trace-http", false, "Log the DNS, connect, TLS and first-byte time of every power query at debug level")
+	fs.BoolVar(&o.watch, "watch", false, "Keep polling and redraw a live table of devices on stdout every interval (default 5s)")
+	fs.StringVar(&o.sortBy, "sort", sortWatts, "Order of the --watch table and of --format=table: "+strings.Join(watchSorts, ", "))
+	fs.IntVar(&o.tableWidth, "width", 0, "Width --format=table keeps within by truncating device names (0 detects the terminal's)")
+	fs.StringVar(&o.timezone, "timezone", "", "Time zone output timestamps are shown in, e.g. Europe/London (default: UTC in CSV, as recorded elsewhere)")
+	fs.StringVar(&o.timeFormat, "time-format", timeFormatRFC3339, "Format of output timestamps: rfc3339, unix, unixms or a Go layout such as \"2006-01-02 15:04:05\" (metrics always use seconds since the epoch)")
+	fs.StringVar(&o.recordPath, "record", "", "Record every discovered service and HTTP response of the run to this session file")
+	fs.StringVar(&o.replayPath, "replay", "", "Replay a session recorded with --record instead of using the network")
+	o.replaySpeed = 1
+	fs.Var(&o.replaySpeed, "replay-speed", "Speed-up factor for --replay timing, e.g. 10x")
+	fs.BoolVar(&o.showUnaliased, "print-unaliased", false, "List discovered devices without an entry under aliases: in the config file, as YAML to fill in, and exit")
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == mockCommand {
+		os.Exit(mockMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == completionCommand {
+		os.Exit(completionMain(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 && slices.Contains(subcommands, args[0]) {
+		command, args = args[0], args[1:]
+	}
 
-		fmt.Printf("  Name: %s\n", entry.Instance)
-		fmt.Printf("  Firmware: %s\n", fw)
+	var opts options
+	registerFlags(flag.CommandLine, &opts)
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	if opts.showVersion {
+		fmt.Println(currentBuild())
 		return
 	}
+	opts.explicit = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { opts.explicit[f.Name] = true })
 
-	if addr == "" {
-		fmt.Println("  No IPv4 address available; skipping power query.")
+	if opts.configPath != "" {
+		var err error
+		if opts.cfg, err = loadConfig(opts.configPath, flag.CommandLine, os.Stderr); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitSetup)
+		}
+	}
+	var err error
+	if opts.fromEnv, err = applySettings(flag.CommandLine, opts.cfg, os.Getenv); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitSetup)
+	}
+	opts.setFlags = reportedFlags(flag.CommandLine)
+	if err := opts.setCommand(command, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitSetup)
+	}
+	if opts.showConfig {
+		if err := writeConfig(os.Stdout, flag.CommandLine, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(exitSetup)
+		}
 		return
 	}
 
-	powerURL := fmt.Sprintf("http://%s:80/api/power", addr)
-	fmt.Printf("  Querying: %s\n", powerURL)
+	ifaces, err := browseInterfaces(opts.interfaces)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--interface: %v\n", err)
+		os.Exit(exitSetup)
+	}
+	resolver, err := zeroconf.NewResolver(ifaces)
+	switch {
+	case err != nil && opts.mustDiscover:
+		fmt.Fprintf(os.Stderr, "resolver error: %v\n", err)
+		os.Exit(exitSetup)
+	case err != nil:
+		// Browsing then fails as one discovery source, leaving the others.
+		resolver = brokenResolver{fmt.Errorf("resolver error: %w", err)}
+	}
+	opts.resolver = resolver
 
-	power, err := fetchPower(powerURL)
+	ctx, stop := notifyShutdown(context.Background())
+	err = run(ctx, opts, os.Stdout, os.Stderr)
+	stop()
 	if err != nil {
-		fmt.Printf("  Power query failed: %v\n", err)
-		return
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// run validates opts, sets up the configured sinks and queries devices
+// until the one-shot pass ends or ctx is cancelled. Records go to stdout
+// unless --output names a file, and diagnostics to stderr. The returned
+// error carries the process's exit status; see exitCode.
+func run(ctx context.Context, opts options, stdout, stderr io.Writer) error {
+	if opts.jsonOutput {
+		opts.format = formatJSON
+	}
+	if opts.verbose {
+		opts.logLevel = "debug"
+	} else if opts.quiet {
+		opts.logLevel = "error"
+	}
+	opts.logs = stderr
+	logger, err := newLogger(stderr, opts.logLevel, opts.logFormat)
+	if err != nil {
+		return err
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+	opts.sourceFailures = new(sourceFailures)
+	if !slices.Contains(outputFormats, opts.format) {
+		return fmt.Errorf("invalid format %q: must be one of %s", opts.format, strings.Join(outputFormats, ", "))
+	}
+	if len(opts.services.services) == 0 {
+		return errors.New("--service must name at least one service type")
+	}
+	for _, service := range opts.services.services {
+		if err := collector.ValidateService(service); err != nil {
+			return err
+		}
+	}
+	if !slices.Contains(watchSorts, opts.sortBy) {
+		return fmt.Errorf("invalid sort %q: must be one of %s", opts.sortBy, strings.Join(watchSorts, ", "))
+	}
+	if opts.ipv4Only && (opts.ipv6Only || opts.preferIPv6) {
+		return errors.New("--ipv4-only cannot be combined with --ipv6-only or --prefer-ipv6")
+	}
+	if opts.watch && opts.listOnly {
+		return errors.New("--watch cannot be combined with --list")
+	}
+	if opts.expectedPath != "" {
+		if !opts.listOnly {
+			return errors.New("--expected-firmware requires --list")
+		}
+		if opts.expectedFW, err = loadExpectedFirmware(opts.expectedPath); err != nil {
+			return err
+		}
+	}
+	if opts.vendors, err = loadVendorDB(opts.vendorPath); err != nil {
+		return err
+	}
+	if !opts.noHostLookup {
+		opts.hosts = newHostLookup(opts)
+	}
+	if opts.autoUnit {
+		opts.units = newUnitCheck()
+	}
+	if opts.httpFetcher, err = newFetcher(opts); err != nil {
+		return err
+	}
+	if l := opts.httpFetcher.Limiter; l != nil {
+		waits := newHistogram(limiterWaitBuckets...)
+		l.OnWait = func(host string, wait time.Duration) {
+			waits.observe(wait.Seconds())
+			if wait > 0 {
+				slog.Debug("rate limited", "host", host, "wait", wait)
+			}
+		}
+		opts.limiterWaits = waits
+	}
+	if opts.filter, err = newFilter(opts); err != nil {
+		return err
+	}
+	var schedule []tariffPeriodConfig
+	if opts.cfg != nil {
+		if opts.aliases, err = newAliases(opts.cfg.aliases); err != nil {
+			return err
+		}
+		schedule = opts.cfg.tariffSchedule
+	}
+	if opts.tariff, err = newTariff(opts.tariffRate, schedule, time.Local); err != nil {
+		return err
+	}
+	if opts.statsWindow < 0 {
+		return errors.New("--stats-window must not be negative")
+	}
+	if opts.staleness < 0 || opts.metricTTL < 0 {
+		return errors.New("--metric-staleness and --metric-device-ttl must not be negative")
+	}
+	if opts.maxRetryAfter < 0 || opts.rateLimitPoll < 0 {
+		return errors.New("--max-retry-after and --max-rate-limit-interval must not be negative")
+	}
+	opts.statsLocation = time.Local
+	if opts.statsTimezone != "" {
+		if opts.statsLocation, err = time.LoadLocation(opts.statsTimezone); err != nil {
+			return fmt.Errorf("--stats-timezone: %w", err)
+		}
+	}
+	var timeLoc *time.Location
+	if opts.timezone != "" {
+		if timeLoc, err = time.LoadLocation(opts.timezone); err != nil {
+			return fmt.Errorf("--timezone: %w", err)
+		}
+	}
+	if opts.times, err = newTimeFormat(timeLoc, opts.timeFormat); err != nil {
+		return err
+	}
+	switch {
+	case opts.recordPath != "" && opts.replayPath != "":
+		return errors.New("--record and --replay cannot be used together")
+	case opts.replayPath != "":
+		s, err := loadSession(opts.replayPath)
+		if err != nil {
+			return err
+		}
+		speed := float64(opts.replaySpeed)
+		if speed <= 0 {
+			speed = 1
+		}
+		opts.resolver = &replayResolver{entries: s.Entries, speed: speed}
+		opts.httpFetcher.Transport = newReplayTransport(s.Responses, speed)
+		slog.Info("replaying session", "path", opts.replayPath, "entries", len(s.Entries), "responses", len(s.Responses), "speed", opts.replaySpeed.String())
+	case opts.recordPath != "":
+		rec := newRecorder()
+		opts.resolver = rec.resolver(opts.resolver)
+		transport := collector.NewTransport(opts.httpFetcher.TLSConfig)
+		transport.ResponseHeaderTimeout = opts.headerTimeout
+		opts.httpFetcher.Transport = rec.transport(transport)
+		defer func() {
+			if err := rec.save(opts.recordPath); err != nil {
+				slog.Error("record error", "path", opts.recordPath, "error", err)
+			}
+		}()
+	}
+	if opts.showUnaliased {
+		if err := printUnaliased(ctx, opts, stdout); err != nil {
+			return fmt.Errorf("browse error: %w", err)
+		}
+		return nil
+	}
+	if opts.command == discoverCommand {
+		if err := writeInventory(ctx, opts, stdout); err != nil {
+			return fmt.Errorf("browse error: %w", err)
+		}
+		return nil
+	}
+	out, err := openOutput(opts.outputPath, opts.format, stdout)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.times = opts.times
+	if opts.outputPath == "" && (opts.format == formatText || opts.format == formatTable) {
+		out.palette = newPalette(opts, stdout)
+	}
+	if out.table != nil {
+		out.table.sortBy, out.table.verbose = opts.sortBy, opts.verbose
+		if opts.outputPath == "" {
+			out.table.width = tableWidth(stdout, opts.tableWidth)
+		} else {
+			out.table.width = opts.tableWidth
+		}
+	}
+	opts.out = out
+	if opts.watch {
+		// The table takes over stdout; records still go to --output.
+		opts.watchTable = newWatchTable(stdout, opts.sortBy, newPalette(opts, stdout))
+		if opts.outputPath == "" {
+			opts.out = newOutput(io.Discard, opts.format)
+			opts.out.times = opts.times
+		}
+	}
+	if opts.spoolMaxSize < 0 {
+		return errors.New("--spool-max-size must not be negative")
+	}
+	opts.sinks = &sinkSet{spoolDir: opts.spoolDir, spoolMaxSize: int64(opts.spoolMaxSize)}
+	defer opts.sinks.close()
+	if opts.influxURL != "" {
+		influx, err := newInfluxWriter(opts.influxURL, opts.influxToken, opts.influxOrg, opts.influxBucket)
+		if err != nil {
+			return err
+		}
+		if err := opts.sinks.addSpooled("influx", influx, feedFresh); err != nil {
+			return err
+		}
+	}
+	if opts.pushgatewayURL != "" {
+		pushgateway, err := newPushgateway(opts.pushgatewayURL, opts.pushCollector)
+		if err != nil {
+			return err
+		}
+		opts.sinks.add("pushgateway", pushgateway, feedAll)
+	}
+	if opts.graphiteAddr != "" {
+		graphite, err := newGraphiteSink(opts.graphiteAddr, opts.graphitePrefix, opts.graphiteBuffer)
+		if err != nil {
+			return err
+		}
+		graphite.spooled = opts.spoolDir != ""
+		if err := opts.sinks.addSpooled("graphite", graphite, feedFresh); err != nil {
+			return err
+		}
+	}
+	if opts.webhookURL != "" {
+		webhook, err := newWebhookSink(opts.webhookURL, opts.webhookHeaders)
+		if err != nil {
+			return err
+		}
+		if err := opts.sinks.addSpooled("webhook", webhook, feedChanges); err != nil {
+			return err
+		}
+	}
+	if opts.otlpEndpoint != "" {
+		otlp, err := newOTLPExporter(opts)
+		if err != nil {
+			return err
+		}
+		opts.sinks.add("otlp", otlp, feedFresh)
+	}
+	if opts.statsdAddr != "" {
+		if opts.statsd, err = newStatsdSink(opts.statsdAddr, opts.statsdFormat); err != nil {
+			return err
+		}
+		opts.sinks.add("statsd", opts.statsd, feedFresh)
+	}
+	var configDevices []staticDevice
+	var configAlerts map[string]alertRuleConfig
+	if opts.cfg != nil {
+		configDevices = opts.cfg.devices
+		configAlerts = opts.cfg.alerts
+	}
+	if opts.alertWebhook != "" {
+		rule, err := alertRule{Above: float64(opts.alertAbove), ClearBelow: float64(opts.alertClear), Below: opts.alertBelow.threshold(), ClearAbove: opts.alertClearUp.threshold()}.withDefaults()
+		if err != nil {
+			return err
+		}
+		rules := map[string]alertRule{}
+		if opts.cfg != nil {
+			if rules, err = opts.cfg.alertRules(); err != nil {
+				return err
+			}
+		}
+		opts.alerts = newAlerter(opts.alertWebhook, rule, rules, opts.alertInterval)
+		defer opts.alerts.wait()
+	} else if opts.alertAbove > 0 || opts.alertBelow.set || len(configAlerts) > 0 {
+		return errors.New("alert thresholds require --alert-webhook")
+	}
+	if opts.sqlitePath != "" {
+		sqlite, err := openSQLite(ctx, opts.sqlitePath, time.Duration(opts.sqliteKeep))
+		if err != nil {
+			return err
+		}
+		opts.sinks.add("sqlite", sqlite, feedFresh)
+	}
+	if opts.jsonlPath != "" {
+		jsonl, err := newJSONLSink(opts.jsonlPath, int64(opts.jsonlMaxSize), opts.jsonlKeep, opts.jsonlGzip)
+		if err != nil {
+			return err
+		}
+		opts.sinks.add("jsonl", jsonl, feedFresh)
+	}
+	if opts.count < 0 || opts.duration < 0 {
+		return errors.New("--count and --duration must not be negative")
+	}
+	if opts.listOnly && (opts.count > 0 || opts.duration > 0) {
+		return errors.New("--count and --duration cannot be combined with --list")
+	}
+	if opts.adaptivePoll {
+		if opts.interval > 0 {
+			return errors.New("--adaptive-poll takes its bounds from --interval-min and --interval-max, not --interval")
+		}
+		if opts.intervalMin <= 0 || opts.intervalMax < opts.intervalMin {
+			return errors.New("--interval-min must be positive and no longer than --interval-max")
+		}
+	}
+	polling := (opts.interval > 0 || opts.adaptivePoll || opts.listen != "" || opts.watch || opts.count > 0 || opts.duration > 0) && !opts.listOnly
+	if polling && opts.format == formatTable {
+		return errors.New("--format=table is for one-shot runs; use --watch for a live table")
+	}
+	if opts.tableWidth < 0 {
+		return errors.New("--width must not be negative")
+	}
+	if opts.reportEvery < 0 {
+		return errors.New("--report-interval must not be negative")
+	}
+	if opts.reportPath != "" {
+		mode := reportModeOnce
+		if polling {
+			mode = reportModePolling
+		}
+		opts.report = newRunRecorder(opts.reportPath, mode, opts.setFlags, opts.reportEvery)
+	} else if opts.reportEvery > 0 {
+		return errors.New("--report-interval requires --report")
+	}
+	if !opts.onlyChanges && (opts.changeThresh.value > 0 || opts.heartbeat > 0) {
+		return errors.New("--change-threshold and --heartbeat require --only-changes")
+	}
+	if opts.haREST && opts.listen == "" {
+		return errors.New("--ha-rest requires --listen")
+	}
+	if opts.ingest && opts.listen == "" {
+		return errors.New("--ingest requires --listen")
+	}
+	if opts.enablePprof && opts.listen == "" {
+		return errors.New("--enable-pprof requires --listen")
+	}
+	if opts.ingestToken != "" && !opts.ingest {
+		return errors.New("--ingest-token requires --ingest")
+	}
+	if opts.haDiscovery && opts.mqttBroker == "" {
+		return errors.New("--ha-discovery requires --mqtt-broker")
+	}
+	if opts.mqttBroker != "" {
+		mqtt, err := newMQTTSink(opts)
+		if err != nil {
+			return err
+		}
+		// Only QoS 1 publishes are acknowledged, so only they can be
+		// spooled until they are.
+		if opts.mqttQoS == 1 {
+			err = opts.sinks.addSpooled("mqtt", mqtt, feedChanges)
+		} else {
+			opts.sinks.add("mqtt", mqtt, feedChanges)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if opts.jsonlReplay != "" {
+		return replayJSONL(ctx, opts, opts.jsonlReplay)
 	}
 
-	fmt.Printf("  Current power: %.2f W", power.CurrentWatts)
-	if power.Timestamp != "" {
-		fmt.Printf(" (timestamp: %s)", power.Timestamp)
+	if opts.staticDevices, err = staticDevices(configDevices, "config "+opts.configPath); err != nil {
+		return err
+	}
+	grouped := configDevices
+	if opts.devicesPath != "" {
+		list, err := readDevicesFile(opts.devicesPath)
+		if err != nil {
+			return err
+		}
+		fileDevices, err := staticDevices(list, "devices file "+opts.devicesPath)
+		if err != nil {
+			return err
+		}
+		opts.staticDevices = append(opts.staticDevices, fileDevices...)
+		grouped = append(slices.Clip(grouped), list...)
+	}
+	opts.groups = newGrouper(grouped, opts.groupTXTKey)
+	if opts.noDiscovery && len(opts.staticDevices) == 0 && len(opts.scanCIDRs) == 0 {
+		return errors.New("--no-discovery requires devices from --devices, the config file or --scan-cidr")
+	}
+	for _, prefix := range opts.scanCIDRs {
+		if _, err := collector.ScanHosts(prefix); err != nil {
+			return fmt.Errorf("--scan-cidr: %w", err)
+		}
+	}
+	if opts.useCache && opts.cachePath == "" {
+		return errors.New("--use-cache requires --cache")
+	}
+	if opts.cachePath != "" {
+		opts.cache = newDeviceCache(time.Duration(opts.cacheTTL))
+		if err := opts.cache.load(opts.cachePath, time.Now()); err != nil {
+			if opts.mustDiscover {
+				return fmt.Errorf("--cache: %w", err)
+			}
+			opts.sourceFailures.record(cacheSource, err)
+		}
+		opts.fetcher().LearnAddresses(opts.cache.preferred())
+		defer func() {
+			opts.cache.setPreferred(opts.fetcher().Addresses())
+			opts.cache.saveAndLog(opts.cachePath)
+		}()
+	}
+	opts.deviceLog = newDeviceLog(opts.sinks)
+	defer opts.deviceLog.wait()
+	opts.deviceLog.restore(opts.cache.fresh(time.Now()))
+
+	build := currentBuild()
+	if opts.noDiscovery {
+		slog.Info("querying configured devices", "count", len(opts.staticDevices), "version", build.Version, "commit", build.Commit)
+	} else {
+		slog.Info("discovering devices", "services", opts.services.String(), "domain", opts.domain, "static", len(opts.staticDevices), "version", build.Version, "commit", build.Commit)
+	}
+
+	if polling {
+		rep, err := runPolling(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("browse error: %w", err)
+		}
+		if rep.Limit != "" {
+			// A bounded run that reached its limit succeeded if any
+			// query did, whatever its last cycle.
+			return resultError(rep, false)
+		}
+		return nil
+	}
+	stats, err := runOnce(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("browse error: %w", err)
+	}
+	if interrupted(ctx) {
+		// An interrupted run stopped cleanly, however far it got.
+		return nil
 	}
-	fmt.Println()
+	return resultError(stats.report(time.Now()), opts.failOnAnyError)
 }
 
-func pickIPv4(entry *zeroconf.ServiceEntry) string {
-	for _, ip := range entry.AddrIPv4 {
-		if ip.To4() != nil {
-			return ip.String()
+// runOnce performs a single discovery pass, querying each device on the
+// worker pool as it is found, waits for every query to finish and returns
+// the pass's statistics. An interrupt cancels in-flight queries, which get
+// shutdownGrace to return, and adds a run report after the summary; the
+// browse timeout cancels nothing but browsing.
+func runOnce(ctx context.Context, opts options) (*runStats, error) {
+	browseCtx, cancel := context.WithTimeout(ctx, opts.browseTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var results []deviceResult
+	stats := newRunStats()
+	pool := collector.NewPool(opts.concurrency)
+	query := func(d collector.Device) {
+		channels := []collector.Device{d}
+		if !opts.listOnly {
+			channels = opts.fetcher().SplitChannels(d)
+		}
+		for _, ch := range channels {
+			pool.Go(func() {
+				result := handleEntry(ctx, ch, opts)
+				if result.Disabled && !opts.listOnly {
+					return
+				}
+				stats.observe(result)
+				opts.report.observe(result)
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			})
+		}
+	}
+	// Discovery reports a device again when it learns more about it, such
+	// as another service it is advertised under. Listing waits for
+	// discovery to end so each device is listed once, and querying skips
+	// repeats at an address already queried.
+	var listed []collector.Device
+	index := make(map[string]int)
+	queried := make(map[string]string)
+	report := func(d collector.Device) {
+		d.Group = opts.groups.group(d)
+		switch {
+		case opts.allowDupes:
+		case opts.listOnly:
+			if i, ok := index[d.Key()]; ok {
+				listed[i] = d
+			} else {
+				index[d.Key()] = len(listed)
+				listed = append(listed, d)
+			}
+			return
+		default:
+			if addr, ok := queried[d.Key()]; ok && addr == d.Address {
+				return
+			}
+			queried[d.Key()] = d.Address
 		}
+		query(d)
+	}
+	var cached []collector.Device
+	if opts.useCache {
+		cached = opts.vendors.named(opts.cache.fresh(time.Now()))
+		slog.Info("querying cached devices", "count", len(cached))
+		for _, d := range cached {
+			report(d)
+		}
+	}
+	err := collector.DiscoverFunc(browseCtx, opts.discoverOptions(), func(d collector.Device) {
+		slog.Debug("discovered device", "device", d.Instance, "host", d.HostName, "address", d.Address, "services", d.Services, "txt", d.Text)
+		opts.deviceLog.seen(ctx, d, time.Now())
+		opts.cache.seen(d, time.Now())
+		report(d)
+	})
+	err = cachedFallback(err, cached, opts)
+	for _, d := range listed {
+		query(d)
+	}
+	waitGrace(ctx, pool.Wait)
+
+	mu.Lock()
+	passed := slices.Clone(results)
+	mu.Unlock()
+	writeDeviceTable(opts.output(), passed, opts.listOnly)
+	opts.output().writeResultTable()
+	if opts.listOnly && opts.expectedFW != nil {
+		writeFirmwareSummary(opts.output(), passed)
 	}
+	if !opts.listOnly {
+		flushCtx, cancelFlush := graceContext(ctx)
+		defer cancelFlush()
+		opts.sinks.write(flushCtx, newSinkBatch(passed))
+		opts.sinks.flush(flushCtx)
 
-	if len(entry.AddrIPv6) > 0 {
-		return fmt.Sprintf("[%s]", entry.AddrIPv6[0].String())
+		summaries := newSummarizer(false)
+		summaries.includeSuspect = opts.includeSuspect
+		sum := summaries.summarize(time.Now(), passed)
+		sum.FailedSources = opts.sourceFailures.list()
+		sum.Sinks = opts.sinks.counts()
+		writeSummary(opts.output(), sum)
+	}
+	if interrupted(ctx) && !opts.listOnly {
+		writeRunReport(opts.output(), finalReport(stats, opts))
 	}
-	return ""
+	opts.report.writeAndLog(time.Now(), nil)
+	return stats, err
 }
 
-func fetchPower(url string) (*PowerInfo, error) {
-	client := http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, err
+// runPolling keeps discovery running in the background and re-queries every
+// known device each interval until interrupted. With --listen the readings
+// are also served as Prometheus metrics and through the JSON API, and with
+// --watch they are drawn as a live table.
+func runPolling(ctx context.Context, opts options) (runReport, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	stats := newRunStats()
+	limit, pollCtx := newRunLimit(ctx, opts.count, opts.duration)
+	defer limit.release()
+
+	interval := opts.interval
+	switch {
+	case opts.adaptivePoll:
+		interval = opts.intervalMin
+	case interval > 0:
+	case opts.count > 0:
+		interval = fastPollInterval
+	case opts.watchTable != nil:
+		interval = defaultWatchInterval
+	default:
+		interval = defaultMetricsInterval
+	}
+	poller := collector.NewPoller(interval)
+	poller.FailureThreshold = opts.failThreshold
+	poller.OfflineThreshold = opts.offlineAfter
+	poller.OfflineInterval = opts.offlinePoll
+	if opts.rateLimitPoll > 0 {
+		poller.MaxRateLimitInterval = opts.rateLimitPoll
+	}
+	if opts.adaptivePoll {
+		poller.AdaptiveMaxInterval = opts.intervalMax
+		poller.AdaptiveThreshold = float64(opts.adaptiveThresh)
+	}
+	poller.OnIntervalChange = func(d collector.Device, from, to time.Duration) {
+		slog.Debug("poll interval changed", "device", deviceLabel(d.Instance, d.Channel), "host", d.HostName, "from", from, "to", to)
+	}
+	poller.OnStateChange = func(d collector.Device, from, to collector.Availability, reason string) {
+		attrs := []any{"device", deviceLabel(d.Instance, d.Channel), "host", d.HostName, "from", from, "to", to}
+		if reason != "" {
+			attrs = append(attrs, "reason", reason)
+		}
+		slog.Info("device availability changed", attrs...)
+	}
+	// A reading is never reused into the next scheduled poll.
+	poller.MinGap = min(opts.minPollGap, interval/2)
+	poller.Pool = collector.NewPool(opts.concurrency)
+	poller.Fetch = func(ctx context.Context, d collector.Device) (*collector.PowerInfo, error) {
+		d = opts.hosts.resolve(ctx, d)
+		power, err := fetchDevice(ctx, opts.fetcher(), d)
+		opts.units.check(d, power)
+		return power, err
+	}
+	energy := newEnergyMeter(opts.maxGap)
+	energy.tariff = opts.tariff
+	if opts.statePath != "" {
+		if err := energy.load(opts.statePath); err != nil {
+			return runReport{}, err
+		}
+		opts.fetcher().LearnEndpoints(energy.endpoints)
+	}
+	var baselines *baselineTracker
+	if opts.standbyThresh > 0 {
+		baselines = newBaselineTracker(float64(opts.standbyThresh))
+		baselines.restore(energy.baselines)
+	}
+	saveEnergy := func() {
+		if opts.statePath == "" {
+			return
+		}
+		energy.setEndpoints(opts.fetcher().Endpoints())
+		if baselines != nil {
+			energy.setBaselines(baselines.snapshot())
+		}
+		if err := energy.save(opts.statePath); err != nil {
+			slog.Error("energy state error", "path", opts.statePath, "error", err)
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
-		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	trends := newStatsTracker(opts.statsWindow, opts.statsLocation)
+
+	var metrics *exporter
+	var status *api
+	var monitor *selfMonitor
+	summaries := newSummarizer(opts.carryLast)
+	summaries.includeSuspect = opts.includeSuspect
+	var changes *changeFilter
+	if opts.onlyChanges {
+		changes = newChangeFilter(opts.changeThresh, opts.heartbeat)
+	}
+	// Readings taken outside poll cycles reach the sinks with the next.
+	var backlog sinkBacklog
+	var pushed *ingester
+	poller.OnCycle = func(ctx context.Context, readings []collector.Reading) {
+		if poller.MinGap > 0 {
+			hits, misses := poller.CacheStats()
+			slog.Debug("reading cache", "hits", hits, "misses", misses)
+		}
+		readings = append(readings, pushed.cycle()...)
+		sum := summaries.summarizeReadings(time.Now(), latestReadings(readings))
+		sum.Energy = energy.report()
+		sum.Stats = trends.report(sum.Time)
+		sum.Standby = baselines.standby(sum.Time)
+		sum.FailedSources = opts.sourceFailures.list()
+		writeSummary(opts.output(), sum)
+		saveEnergy()
+		if opts.report.due(sum.Time) {
+			opts.report.writeAndLog(sum.Time, sum.Stats)
+		}
+		if metrics != nil {
+			metrics.recordSummary(sum)
+		}
+		if status != nil {
+			status.recordCycle(sum.Time, latestReadings(readings))
+		}
+		if opts.watchTable != nil {
+			opts.watchTable.draw(sum.Time)
+		}
+		opts.sinks.write(ctx, backlog.cycle(readings, changes))
+		monitor.cycle(sum.Time, poller.LastCycle(), readings, backlog.len(), poller.Pool, opts.sinks)
+		limit.cycle(readings)
 	}
 
-	var info PowerInfo
-	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		return nil, err
+	onReading := func(r collector.Reading) {
+		if r.Cached {
+			// Every sink already has this reading.
+			return
+		}
+		var cost, baseline *float64
+		var trend *deviceStats
+		if opts.includeSuspect || !suspect(r) {
+			cost = energy.add(r)
+			trend = trends.add(r)
+			baseline = baselines.add(r)
+		}
+		stats.observe(readingResult(r))
+		opts.report.observe(readingResult(r))
+		// Only the emitted readings are written, published and POSTed;
+		// every other sink sees them all.
+		emit := changes.allow(r)
+		if metrics != nil {
+			metrics.record(r)
+			status.record(r)
+			status.stream.publish(r)
+		}
+		if opts.alerts != nil {
+			opts.alerts.observe(ctx, readingResult(r))
+		}
+		if opts.watchTable != nil {
+			opts.watchTable.record(r)
+		}
+		if emit {
+			writeReading(opts.output(), r, cost, trend, baseline)
+		}
+	}
+
+	if opts.listen != "" {
+		metrics = newExporter()
+		metrics.limiterWaits = opts.limiterWaits
+		metrics.sinks = opts.sinks
+		metrics.staleness = opts.staleness
+		metrics.deviceTTL = opts.metricTTL
+		metrics.baselines = baselines
+		monitor = newSelfMonitor()
+		metrics.monitor = monitor
+		status = newAPI()
+		status.monitor = monitor
+		status.events = opts.deviceLog
+		status.pprof = opts.enablePprof
+		status.stats = trends
+		status.baselines = baselines
+		status.stream = newStreamHub()
+		status.homeAssistant = opts.haREST
+		if opts.ingest {
+			pushed = newIngester(opts.ingestToken, opts.fetcher(), opts.groups.group, onReading)
+			status.ingest = pushed
+		}
+		if opts.scrapeOnDemand {
+			metrics.refresh = func(ctx context.Context) { poller.Poll(ctx, onReading) }
+		}
+		srv := newMetricsServer(opts.listen, metrics, status)
+		go func() {
+			ln, err := listen(opts.listen, os.FileMode(opts.socketMode), os.Getenv)
+			if err == nil {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				slog.Error("metrics server error", "addr", opts.listen, "error", err)
+				stop()
+			}
+		}()
+		defer func() {
+			status.stream.close()
+			shutdownCtx, cancel := graceContext(ctx)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+	}
+
+	names := newLiveAliases(opts.aliases)
+	if status != nil {
+		status.names = names
 	}
-	return &info, nil
+	add := func(d collector.Device) {
+		d.Group = opts.groups.group(d)
+		if d.Disabled {
+			slog.Info("device disabled; not polling", "device", d.Instance, "host", d.HostName)
+			announceDevice(d, opts)
+			return
+		}
+		announced := false
+		for _, ch := range opts.fetcher().SplitChannels(d) {
+			if metrics != nil {
+				metrics.seen(ch)
+			}
+			if !poller.Add(ch) {
+				continue
+			}
+			if !announced {
+				slog.Debug("discovered device", "device", d.Instance, "host", d.HostName, "address", d.Address, "txt", d.Text)
+				announceDevice(d, opts)
+				announced = true
+			}
+			poller.Pool.Go(func() {
+				r := poller.PollDevice(ctx, ch)
+				onReading(r)
+				backlog.add(r, changes.emitted(r))
+			})
+		}
+	}
+	var cached []collector.Device
+	if opts.useCache {
+		cached = opts.vendors.named(opts.cache.fresh(time.Now()))
+		slog.Info("polling cached devices", "count", len(cached))
+		for _, d := range cached {
+			add(d)
+		}
+	}
+	if opts.configPath != "" || opts.devicesPath != "" {
+		r, err := newReloader(opts, poller, energy, names, add)
+		if err != nil {
+			return runReport{}, err
+		}
+		onReload(ctx, r.reload)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		discover := opts.discoverOptions()
+		// Aliases are applied live, so that a reload can change them.
+		discover.Alias = names.name
+		if discover.Scan != nil {
+			discover.Scan.Interval = opts.scanInterval
+		}
+		err := collector.DiscoverFunc(ctx, discover, func(d collector.Device) {
+			monitor.entry()
+			opts.deviceLog.seen(ctx, d, time.Now())
+			opts.cache.seen(d, time.Now())
+			add(d)
+		})
+		errc <- cachedFallback(err, cached, opts)
+	}()
+
+	if opts.listen != "" && opts.scrapeOnDemand {
+		<-pollCtx.Done()
+	} else {
+		pollUntil(ctx, pollCtx, poller, interval, onReading)
+	}
+	// Once a limit ends the run, so does discovery.
+	stop()
+	err := <-errc
+	waitGrace(ctx, poller.Pool.Wait)
+
+	flushCtx, cancelFlush := graceContext(ctx)
+	defer cancelFlush()
+	for _, r := range pushed.cycle() {
+		backlog.add(r, changes.emitted(r))
+	}
+	if held := backlog.drain(changes != nil); len(held.fresh) > 0 {
+		opts.sinks.write(flushCtx, held)
+	}
+	opts.sinks.flush(flushCtx)
+	writeEnergyReport(opts.output(), time.Now(), energy.report())
+	saveEnergy()
+	rep := finalReport(stats, opts)
+	rep.Limit = limit.limit()
+	writeRunReport(opts.output(), rep)
+	opts.report.writeAndLog(rep.Time, trends.report(rep.Time))
+	return rep, err
+}
+
+// finalReport returns the run report, with the sink failures counted
+// outside stats.
+func finalReport(stats *runStats, opts options) runReport {
+	rep := stats.report(time.Now())
+	rep.StatsdErrors = opts.statsd.sendErrors()
+	rep.Sinks = opts.sinks.counts()
+	return rep
+}
+
+// announceDevice reports a newly discovered device in polling mode, where
+// its readings are written separately.
+func announceDevice(d collector.Device, opts options) {
+	out := opts.output()
+	if out.machineReadable() {
+		return
+	}
+	out.text([]byte(fmt.Sprintf("\nDiscovered: %s (%s)\n", d.Instance, d.HostName)))
 }
 
-func firmwareVersion(entry *zeroconf.ServiceEntry) string {
-	for _, txt := range entry.Text {
-		parts := strings.SplitN(txt, "=", 2)
-		if len(parts) != 2 {
-			continue
+// handleEntry queries d and writes its complete output in one piece so
+// concurrent devices never interleave. It returns the device's record.
+func handleEntry(ctx context.Context, d collector.Device, opts options) deviceResult {
+	result := queryDevice(ctx, d, opts)
+	if result.Disabled && !opts.listOnly {
+		writeEntry(opts.output(), result, false)
+		return result
+	}
+	if opts.alerts != nil {
+		opts.alerts.observe(ctx, result)
+	}
+
+	writeEntry(opts.output(), result, opts.listOnly)
+	return result
+}
+
+// writeEntry writes r in the output format, in one piece.
+func writeEntry(out *output, r deviceResult, listOnly bool) {
+	if out.machineReadable() {
+		out.result(r)
+		return
+	}
+
+	var buf bytes.Buffer
+	writeEntryText(&buf, r, listOnly, out.palette, out.times)
+	out.text(buf.Bytes())
+}
+
+// writeEntryText writes r as a block of text, with its reading, failure
+// and outdated firmware colored by pal and its timestamp rendered by times.
+func writeEntryText(w io.Writer, r deviceResult, listOnly bool, pal palette, times timeFormat) {
+	fmt.Fprintf(w, "\nDiscovered: %s (%s)\n", r.Instance, r.HostName)
+	if r.Channel != "" {
+		fmt.Fprintf(w, "  Channel: %s\n", r.Channel)
+	}
+	if listOnly {
+		fw, color := pal.deviceFirmware(r)
+		if fw == "" {
+			fw = "unknown"
 		}
 
-		switch strings.ToLower(parts[0]) {
-		case "fv", "firmware", "firmwareversion", "version":
-			return parts[1]
+		fmt.Fprintf(w, "  Name: %s\n", r.Instance)
+		fmt.Fprintf(w, "  Firmware: %s\n", pal.paint(color, fw))
+		if r.VendorID != 0 || r.ProductID != 0 {
+			vendor := fmt.Sprintf("0x%04X", r.VendorID)
+			if r.Vendor != "" && r.Vendor != vendor {
+				vendor = fmt.Sprintf("%s (%s)", r.Vendor, vendor)
+			}
+			fmt.Fprintf(w, "  Vendor: %s  Product: 0x%04X\n", vendor, r.ProductID)
+		}
+		if r.DeviceType != 0 {
+			fmt.Fprintf(w, "  Device type: 0x%04X\n", r.DeviceType)
+		}
+		if r.Discriminator != 0 {
+			fmt.Fprintf(w, "  Discriminator: %d\n", r.Discriminator)
+		}
+		if status := matterStatus(r); status != "" {
+			fmt.Fprintf(w, "  Status: %s\n", status)
+		}
+		if len(r.Services) > 1 {
+			fmt.Fprintf(w, "  Services: %s\n", strings.Join(r.Services, ", "))
 		}
+		return
 	}
 
-	return ""
+	if r.Disabled {
+		fmt.Fprintln(w, "  Disabled; skipping power query.")
+		return
+	}
+	if r.URL == "" {
+		fmt.Fprintln(w, "  No usable address available; skipping power query.")
+		return
+	}
+
+	fmt.Fprintf(w, "  Querying: %s\n", r.URL)
+
+	if r.Error != "" {
+		fmt.Fprintf(w, "  Power query failed: %s\n", pal.paint(ansiRed, r.Error))
+		return
+	}
+
+	fmt.Fprintf(w, "  Current power: %s", pal.paint(pal.wattsColor(r.CurrentWatts), fmt.Sprintf("%.2f W", r.CurrentWatts)))
+	if !r.Timestamp.IsZero() && r.TimestampSource != collector.TimestampSourceCollector {
+		fmt.Fprintf(w, " (timestamp: %s)", times.format(r.Timestamp))
+	}
+	fmt.Fprintln(w)
+	if line := electricalText(*r.PowerInfo); line != "" {
+		fmt.Fprintf(w, "  Electrical: %s\n", line)
+	}
+	for _, ph := range r.Phases {
+		fmt.Fprintf(w, "  Phase %s: %.2f W", ph.Name, ph.Watts)
+		if ph.Voltage != 0 {
+			fmt.Fprintf(w, ", %.1f V", ph.Voltage)
+		}
+		if ph.Amperage != 0 {
+			fmt.Fprintf(w, ", %.3f A", ph.Amperage)
+		}
+		if ph.PowerFactor != 0 {
+			fmt.Fprintf(w, ", PF %.2f", ph.PowerFactor)
+		}
+		fmt.Fprintln(w)
+	}
+	if r.Suspect {
+		fmt.Fprintf(w, "  Suspect reading: %s\n", r.Anomaly)
+	}
 }
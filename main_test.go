@@ -2,143 +2,348 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
 )
 
-func TestPickIPv4(t *testing.T) {
-	entry := &zeroconf.ServiceEntry{AddrIPv4: []net.IP{net.ParseIP("192.168.1.5")}}
-	if got := pickIPv4(entry); got != "192.168.1.5" {
-		t.Fatalf("expected IPv4 address, got %q", got)
+func TestHandleEntryListOnly(t *testing.T) {
+	entry := &collector.ServiceEntry{
+		Instance: "Demo Device",
+		HostName: "demo.local.",
+		Text:     []string{"firmware=9.9.9"},
 	}
-}
 
-func TestPickIPv4FallsBackToIPv6(t *testing.T) {
-	entry := &zeroconf.ServiceEntry{AddrIPv6: []net.IP{net.ParseIP("fe80::1")}}
-	if got := pickIPv4(entry); got != "[fe80::1]" {
-		t.Fatalf("expected IPv6 wrapped value, got %q", got)
+	output := handleEntryOutput(collector.NewDevice(entry), options{listOnly: true})
+
+	if !strings.Contains(output, "Demo Device (demo.local)") {
+		t.Fatalf("expected device header in output, got %q", output)
+	}
+	if !strings.Contains(output, "Firmware: 9.9.9") {
+		t.Fatalf("expected firmware value in output, got %q", output)
 	}
 }
 
-func TestPickIPv4ReturnsEmptyWhenNoAddresses(t *testing.T) {
-	entry := &zeroconf.ServiceEntry{}
-	if got := pickIPv4(entry); got != "" {
-		t.Fatalf("expected empty address, got %q", got)
+func TestHandleEntryListsMatterIdentifiers(t *testing.T) {
+	entry := &collector.ServiceEntry{
+		Instance: "Plug",
+		HostName: "plug.local.",
+		Text:     []string{"VP=65521+32768", "DT=266", "D=3840", "T=1"},
+	}
+	d := collector.NewDevice(entry)
+
+	output := handleEntryOutput(d, options{listOnly: true})
+	for _, want := range []string{"Vendor: 0xFFF1  Product: 0x8000", "Device type: 0x010A", "Discriminator: 3840"} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("expected %q in output, got %q", want, output)
+		}
+	}
+
+	output = handleEntryOutput(d, options{listOnly: true, format: formatJSON})
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(output), &decoded); err != nil {
+		t.Fatalf("expected JSON output, got %q (%v)", output, err)
+	}
+	if decoded["vendorId"] != 65521.0 || decoded["productId"] != 32768.0 || decoded["deviceType"] != 266.0 || decoded["discriminator"] != 3840.0 {
+		t.Fatalf("unexpected identifiers in %v", decoded)
+	}
+	if txt, _ := decoded["txt"].(map[string]any); txt["T"] != "1" {
+		t.Fatalf("expected unknown TXT keys in the JSON, got %v", decoded["txt"])
 	}
 }
 
-func TestFirmwareVersion(t *testing.T) {
-	entry := &zeroconf.ServiceEntry{Text: []string{"other=value", "FirmwareVersion=1.2.3"}}
-	if got := firmwareVersion(entry); got != "1.2.3" {
-		t.Fatalf("expected firmware version to be %q, got %q", "1.2.3", got)
+func TestHandleEntryNoIPv4(t *testing.T) {
+	entry := &collector.ServiceEntry{
+		Instance: "NoIP Device",
+		HostName: "noip.local.",
+	}
+
+	output := handleEntryOutput(collector.NewDevice(entry), options{})
+
+	if !strings.Contains(output, "No usable address available") {
+		t.Fatalf("expected no IPv4 message, got %q", output)
 	}
 }
 
-func TestFirmwareVersionEmptyWhenMissing(t *testing.T) {
-	entry := &zeroconf.ServiceEntry{Text: []string{"missing", "noequal"}}
-	if got := firmwareVersion(entry); got != "" {
-		t.Fatalf("expected empty firmware version, got %q", got)
+// handleEntryOutput runs handleEntry with opts and returns what it wrote.
+func handleEntryOutput(d collector.Device, opts options) string {
+	var buf bytes.Buffer
+	opts.out = newOutput(&buf, opts.format)
+	handleEntry(context.Background(), d, opts)
+	return buf.String()
+}
+
+func TestRunOnceListSettlesEarly(t *testing.T) {
+	resolver := zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Delay: 10 * time.Millisecond, Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local."}},
+		zeroconf.ScheduledEntry{Delay: 30 * time.Millisecond, Entry: &collector.ServiceEntry{Instance: "Plug", HostName: "plug.local."}},
+	)
+	var buf bytes.Buffer
+	opts := options{listOnly: true, browseTimeout: 10 * time.Second, settle: 100 * time.Millisecond, resolver: resolver, out: newOutput(&buf, formatText)}
+
+	start := time.Now()
+	_, err := runOnce(context.Background(), opts)
+	output := buf.String()
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected list mode to exit once discovery settled, took %v", elapsed)
+	}
+	if !strings.Contains(output, "Lamp (lamp.local)") || !strings.Contains(output, "Plug (plug.local)") {
+		t.Fatalf("expected both devices listed, got %q", output)
 	}
 }
 
-func TestFetchPowerSuccess(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		io.WriteString(w, `{"deviceName":"Lamp","currentWatts":12.5,"timestamp":"2024-02-02T15:04:05Z"}`)
+func TestHandleEntryQueriesHTTPSDevice(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"deviceName":"Plug","currentWatts":7.5}`)
 	}))
 	defer server.Close()
 
-	info, err := fetchPower(server.URL)
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	opts := options{scheme: "https", port: addr.Port, insecure: true}
+	fetcher, err := newFetcher(opts)
 	if err != nil {
-		t.Fatalf("expected success, got error: %v", err)
+		t.Fatalf("expected fetcher, got error: %v", err)
+	}
+	opts.httpFetcher = fetcher
+
+	entry := &collector.ServiceEntry{Instance: "Plug", HostName: "plug.local.", AddrIPv4: []net.IP{addr.IP}}
+	output := handleEntryOutput(collector.NewDevice(entry), opts)
+
+	if !strings.Contains(output, fmt.Sprintf("Querying: https://127.0.0.1:%d/api/power", addr.Port)) {
+		t.Fatalf("expected HTTPS query URL in output, got %q", output)
+	}
+	if !strings.Contains(output, "Current power: 7.50 W") {
+		t.Fatalf("expected power reading in output, got %q", output)
+	}
+}
+
+func TestNewFetcherRejectsUnknownScheme(t *testing.T) {
+	if _, err := newFetcher(options{scheme: "ftp"}); err == nil {
+		t.Fatal("expected error for unsupported scheme")
+	}
+}
+
+func TestNewFetcherRejectsBadTemplate(t *testing.T) {
+	_, err := newFetcher(options{scheme: "http", urlTemplate: "http://{ip}/status"})
+	if err == nil || !strings.Contains(err.Error(), "{ip}") {
+		t.Fatalf("expected startup error naming the bad placeholder, got %v", err)
+	}
+}
+
+func TestNewFilterNamesBadPattern(t *testing.T) {
+	_, err := newFilter(options{match: "Plug", exclude: "(Bulb"})
+	if err == nil || !strings.Contains(err.Error(), `"(Bulb"`) || !strings.Contains(err.Error(), "--exclude") {
+		t.Fatalf("expected startup error naming the bad pattern, got %v", err)
+	}
+	if f, err := newFilter(options{}); f != nil || err != nil {
+		t.Fatalf("expected no filter without flags, got %+v (%v)", f, err)
+	}
+}
+
+func TestNewFetcherDriver(t *testing.T) {
+	f, err := newFetcher(options{scheme: "http", driver: "tasmota"})
+	if err != nil || f.Driver == nil || f.Driver.Name() != "tasmota" {
+		t.Fatalf("expected forced tasmota driver, got %+v, %v", f, err)
+	}
+
+	f, err = newFetcher(options{scheme: "http", driver: "auto"})
+	if err != nil || f.Driver != nil {
+		t.Fatalf("expected automatic driver selection, got %+v, %v", f, err)
 	}
 
-	if info.DeviceName != "Lamp" || info.CurrentWatts != 12.5 || info.Timestamp != "2024-02-02T15:04:05Z" {
-		t.Fatalf("unexpected PowerInfo: %+v", info)
+	if _, err := newFetcher(options{scheme: "http", driver: "zigbee"}); err == nil {
+		t.Fatal("expected error for unknown driver")
 	}
 }
 
-func TestFetchPowerNonOK(t *testing.T) {
+func TestRunOnceQueriesRepeatedAnnouncementOnce(t *testing.T) {
+	var queries atomic.Int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "oops", http.StatusInternalServerError)
+		queries.Add(1)
+		io.WriteString(w, `{"currentWatts":5}`)
 	}))
 	defer server.Close()
 
-	if _, err := fetchPower(server.URL); err == nil || !strings.Contains(err.Error(), "unexpected status 500") {
-		t.Fatalf("expected status error, got %v", err)
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	entry := &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}}
+	var schedule []zeroconf.ScheduledEntry
+	for i := 0; i < 3; i++ {
+		schedule = append(schedule, zeroconf.ScheduledEntry{Delay: time.Duration(i) * 5 * time.Millisecond, Entry: entry})
+	}
+
+	opts := options{format: formatJSON, browseTimeout: 100 * time.Millisecond, scheme: "http", port: addr.Port}
+	fetcher, err := newFetcher(opts)
+	if err != nil {
+		t.Fatalf("expected fetcher, got error: %v", err)
+	}
+	opts.httpFetcher = fetcher
+	opts.out = newOutput(io.Discard, formatJSON)
+	opts.resolver = zeroconf.NewScheduledResolver(schedule...)
+	if _, err := runOnce(context.Background(), opts); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if got := queries.Load(); got != 1 {
+		t.Fatalf("expected exactly one power query, got %d", got)
 	}
+
+	opts.allowDupes = true
+	queries.Store(0)
+	opts.resolver = zeroconf.NewScheduledResolver(schedule...)
+	if _, err := runOnce(context.Background(), opts); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if got := queries.Load(); got != 3 {
+		t.Fatalf("expected a query per announcement with --allow-duplicates, got %d", got)
+	}
+}
+
+// defaultOptions returns the options given by every flag's default.
+func defaultOptions() options {
+	var opts options
+	registerFlags(flag.NewFlagSet("test", flag.ContinueOnError), &opts)
+	return opts
 }
 
-func TestFetchPowerDecodeError(t *testing.T) {
+func TestRunWritesReadingsAndSummary(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "not-json")
+		io.WriteString(w, `{"currentWatts":12.5}`)
 	}))
 	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
 
-	if _, err := fetchPower(server.URL); err == nil {
-		t.Fatal("expected decode error, got nil")
+	opts := defaultOptions()
+	opts.browseTimeout = 100 * time.Millisecond
+	opts.port = addr.Port
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+
+	var stdout, stderr bytes.Buffer
+	if err := run(context.Background(), opts, &stdout, &stderr); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	for _, want := range []string{"Discovered: Lamp (lamp.local)", "Current power: 12.50 W", "Total: 12.50 W from 1 devices (0 failed"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Fatalf("expected %q in output, got %q", want, stdout.String())
+		}
+	}
+	if !strings.Contains(stderr.String(), "discovering devices") {
+		t.Fatalf("expected diagnostics on stderr, got %q", stderr.String())
 	}
 }
 
-func TestHandleEntryListOnly(t *testing.T) {
-	entry := &zeroconf.ServiceEntry{
-		Instance: "Demo Device",
-		HostName: "demo.local.",
-		Text:     []string{"firmware=9.9.9"},
-	}
+func TestRunNormalisesDeviceTimestamps(t *testing.T) {
+	stamps := map[string]string{"/lamp": `,"timestamp":"02/01/2024 15:04 +0100"`, "/plug": ""}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":1`+stamps[r.URL.Path]+`}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
 
-	output := captureOutput(func() { handleEntry(entry, true) })
+	opts := statusOptions(addr.Port)
+	opts.concurrency = 1
+	opts.allowDupes = true
+	opts.stampLayout = "02/01/2006 15:04 -0700"
+	opts.urlTemplate = "http://{addr}:{port}/{instance}"
+	opts.resolver = zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}}},
+		zeroconf.ScheduledEntry{Entry: &collector.ServiceEntry{Instance: "plug", HostName: "plug.local.", AddrIPv4: []net.IP{addr.IP}}},
+	)
 
-	if !strings.Contains(output, "Demo Device (demo.local)") {
-		t.Fatalf("expected device header in output, got %q", output)
+	var stdout bytes.Buffer
+	if err := run(context.Background(), opts, &stdout, io.Discard); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
 	}
-	if !strings.Contains(output, "Firmware: 9.9.9") {
-		t.Fatalf("expected firmware value in output, got %q", output)
+	out := stdout.String()
+	if !strings.Contains(out, `"instance":"lamp"`) || !strings.Contains(out, `"timestamp":"2024-01-02T14:04:00Z","latencyMs":`) {
+		t.Fatalf("expected lamp's timestamp in UTC, got %q", out)
+	}
+	if !strings.Contains(out, `"timestampSource":"collector"`) {
+		t.Fatalf("expected plug stamped by the collector, got %q", out)
 	}
 }
 
-func TestHandleEntryNoIPv4(t *testing.T) {
-	entry := &zeroconf.ServiceEntry{
-		Instance: "NoIP Device",
-		HostName: "noip.local.",
+func TestRunRejectsConflictingAddressFamilies(t *testing.T) {
+	opts := defaultOptions()
+	opts.ipv4Only = true
+	opts.ipv6Only = true
+	err := run(context.Background(), opts, io.Discard, io.Discard)
+	if exitCode(err) != exitSetup || !strings.Contains(err.Error(), "--ipv4-only cannot be combined") {
+		t.Fatalf("expected a setup error, got %v", err)
 	}
+}
 
-	output := captureOutput(func() { handleEntry(entry, false) })
-
-	if !strings.Contains(output, "No IPv4 address available") {
-		t.Fatalf("expected no IPv4 message, got %q", output)
+func TestRunRejectsAdaptivePollWithInterval(t *testing.T) {
+	opts := defaultOptions()
+	opts.adaptivePoll = true
+	opts.interval = time.Minute
+	err := run(context.Background(), opts, io.Discard, io.Discard)
+	if exitCode(err) != exitSetup || !strings.Contains(err.Error(), "not --interval") {
+		t.Fatalf("expected a setup error, got %v", err)
 	}
-}
 
-func captureOutput(fn func()) string {
-	original := os.Stdout
-	r, w, err := os.Pipe()
-	if err != nil {
-		panic(err)
+	opts.interval = 0
+	opts.intervalMin, opts.intervalMax = time.Minute, time.Second
+	err = run(context.Background(), opts, io.Discard, io.Discard)
+	if exitCode(err) != exitSetup || !strings.Contains(err.Error(), "--interval-min") {
+		t.Fatalf("expected a setup error, got %v", err)
 	}
+}
 
-	os.Stdout = w
+func TestRunRejectsInvalidSetup(t *testing.T) {
+	opts := defaultOptions()
+	opts.format = "xml"
 
-	done := make(chan string)
-	go func() {
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, r); err != nil {
-			panic(err)
-		}
-		done <- buf.String()
-	}()
+	var stdout bytes.Buffer
+	err := run(context.Background(), opts, &stdout, io.Discard)
+	if exitCode(err) != exitSetup || !strings.Contains(err.Error(), `invalid format "xml"`) {
+		t.Fatalf("expected a setup error, got %v", err)
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("expected no output, got %q", stdout.String())
+	}
+}
 
-	fn()
+func TestRunQueriesEveryChannel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		watts := map[string]string{"0": "40", "1": "60"}[r.URL.Query().Get("channel")]
+		io.WriteString(w, `{"currentWatts":`+watts+`}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
 
-	w.Close()
-	os.Stdout = original
+	opts := statusOptions(addr.Port)
+	opts.noDiscovery = true
+	opts.cfg = &config{devices: []staticDevice{{Name: "Office Plug", Address: addr.IP.String(), Channels: []string{"0", "1"}}}}
 
-	return <-done
+	var stdout bytes.Buffer
+	if err := run(context.Background(), opts, &stdout, io.Discard); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	out := stdout.String()
+	for _, want := range []string{
+		`"instance":"Office Plug","hostname":"` + addr.IP.String() + `","channel":"0"`,
+		`"channel":"1"`,
+		`"currentWatts":60`,
+		`"totalWatts":100,"devices":1,"failed":0,"minWatts":100,"maxWatts":100,"deviceWatts":{"Office Plug":100}`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output, got %s", want, out)
+		}
+	}
 }
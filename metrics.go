@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"powerusagecollection/internal/promtext"
+	"powerusagecollection/pkg/collector"
+)
+
+// exporter serves the latest readings as Prometheus metrics.
+type exporter struct {
+	// refresh, when set, is called on every scrape to poll devices before
+	// the metrics are rendered.
+	refresh func(ctx context.Context)
+
+	mu       sync.Mutex
+	readings map[string]collector.Reading
+	errors   map[string]float64
+	// failures counts each device's failed queries by FailureReason.
+	failures map[string]map[string]float64
+	devices  map[string]collector.Device
+	up       map[string]float64
+	summary  *summary
+	// fetchDurations holds each device's histogram of successful query
+	// latencies.
+	fetchDurations map[string]*histogram
+	// limiterWaits, when set, is exported as the rate limiter's wait
+	// histogram.
+	limiterWaits *histogram
+	// sinks, when set, has its write counts exported.
+	sinks *sinkSet
+	// staleness, when positive, is how long a device's last reading keeps
+	// being exported, or twice its poll interval when that is longer;
+	// older readings drop out of the exposition.
+	staleness time.Duration
+	// deviceTTL, when positive, is how long a device may go without being
+	// discovered or answering a query before all its series are removed.
+	deviceTTL time.Duration
+	// lastSeen is when each device was last discovered or answered.
+	lastSeen map[string]time.Time
+	// baselines, when set, has each device's idle baseline exported.
+	baselines *baselineTracker
+	// monitor, when set, has the collector's own health exported.
+	monitor *selfMonitor
+	// now returns the current time.
+	now func() time.Time
+}
+
+func newExporter() *exporter {
+	return &exporter{
+		readings: make(map[string]collector.Reading),
+		errors:   make(map[string]float64),
+		failures: make(map[string]map[string]float64),
+		devices:  make(map[string]collector.Device),
+		up:       make(map[string]float64),
+		lastSeen: make(map[string]time.Time),
+		now:      time.Now,
+
+		fetchDurations: make(map[string]*histogram),
+	}
+}
+
+// seen notes that discovery announced d, keeping its series past the
+// device TTL.
+func (e *exporter) seen(d collector.Device) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastSeen[d.Key()] = e.now()
+}
+
+// record stores a reading, counting it as a scrape error when it failed.
+// A reading without a time is taken to be from now.
+func (e *exporter) record(r collector.Reading) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := r.Device.Key()
+	e.devices[key] = r.Device
+	if _, ok := e.lastSeen[key]; !ok {
+		e.lastSeen[key] = e.now()
+	}
+	e.up[key] = 1
+	if r.State == collector.Offline || (r.State == "" && r.Err != nil) {
+		e.up[key] = 0
+	}
+	if r.Err != nil {
+		e.errors[key]++
+		if e.failures[key] == nil {
+			e.failures[key] = make(map[string]float64)
+		}
+		e.failures[key][collector.FailureReason(r.Err)]++
+		return
+	}
+	if _, ok := e.errors[key]; !ok {
+		e.errors[key] = 0
+	}
+	if r.Time.IsZero() {
+		r.Time = e.now()
+	}
+	e.lastSeen[key] = e.now()
+	if r.Power.Latency > 0 {
+		h, ok := e.fetchDurations[key]
+		if !ok {
+			h = newHistogram(fetchDurationBuckets...)
+			e.fetchDurations[key] = h
+		}
+		h.observe(r.Power.Latency.Seconds())
+	}
+	e.readings[key] = r
+}
+
+// recordSummary stores the totals of the latest poll cycle.
+func (e *exporter) recordSummary(sum summary) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.summary = &sum
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e.refresh != nil {
+		e.refresh(r.Context())
+	}
+
+	w.Header().Set("Content-Type", promtext.ContentType)
+	pw := promtext.NewWriter(w)
+	e.write(pw)
+	pw.Flush()
+}
+
+// prune removes every series of the devices not seen within the device
+// TTL.
+func (e *exporter) prune(now time.Time) {
+	if e.deviceTTL <= 0 {
+		return
+	}
+	for key, seen := range e.lastSeen {
+		if now.Sub(seen) <= e.deviceTTL {
+			continue
+		}
+		delete(e.lastSeen, key)
+		delete(e.devices, key)
+		delete(e.readings, key)
+		delete(e.errors, key)
+		delete(e.failures, key)
+		delete(e.up, key)
+		delete(e.fetchDurations, key)
+	}
+}
+
+// stale reports whether r is too old to be exported.
+func (e *exporter) stale(r collector.Reading, now time.Time) bool {
+	return e.staleness > 0 && now.Sub(r.Time) > max(e.staleness, 2*r.Interval)
+}
+
+func (e *exporter) write(pw *promtext.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	e.prune(now)
+	keys := make([]string, 0, len(e.devices))
+	for key := range e.devices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	build := currentBuild()
+	pw.Family("power_collector_build_info", "The collector's version, commit and Go version; always 1.", promtext.Gauge)
+	pw.Sample("power_collector_build_info", 1, "version", build.Version, "commit", build.Commit, "goversion", build.GoVersion)
+
+	pw.Family("power_device_info", "Device metadata from mDNS discovery.", promtext.Gauge)
+	for _, key := range keys {
+		d := e.devices[key]
+		info := []string{"firmware", d.Firmware}
+		if vendor := vendorText(d.Meta); vendor != "" {
+			info = append(info, "vendor", vendor)
+		}
+		if d.Source != "" {
+			info = append(info, "source", d.Source)
+		}
+		pw.Sample("power_device_info", 1, seriesLabels(d.Instance, d.HostName, d.Channel, d.Group, info...)...)
+	}
+
+	// A polyphase meter's phases are further series of its gauges, with
+	// a phase label.
+	gauges := []struct {
+		name, help string
+		value      func(*collector.PowerInfo) float64
+		phase      func(collector.PhaseInfo) float64
+		optional   bool
+	}{
+		{"power_device_watts", "Current power draw in watts, in total and per phase.", func(p *collector.PowerInfo) float64 { return p.CurrentWatts }, func(ph collector.PhaseInfo) float64 { return ph.Watts }, false},
+		{"power_device_voltage", "Line voltage in volts, overall and per phase.", func(p *collector.PowerInfo) float64 { return p.Voltage }, func(ph collector.PhaseInfo) float64 { return ph.Voltage }, true},
+		{"power_device_amperage", "Current in amperes, in total and per phase.", func(p *collector.PowerInfo) float64 { return p.Amperage }, func(ph collector.PhaseInfo) float64 { return ph.Amperage }, true},
+		{"power_device_power_factor", "Power factor, overall and per phase.", func(p *collector.PowerInfo) float64 { return p.PowerFactor }, func(ph collector.PhaseInfo) float64 { return ph.PowerFactor }, true},
+		{"power_device_frequency_hertz", "Line frequency in hertz.", func(p *collector.PowerInfo) float64 { return p.FrequencyHz }, noPhase, true},
+		{"power_device_apparent_power_va", "Apparent power in volt-amperes.", func(p *collector.PowerInfo) float64 { return p.ApparentVA }, noPhase, true},
+		{"power_device_reactive_power_var", "Reactive power in volt-amperes reactive.", func(p *collector.PowerInfo) float64 { return p.ReactiveVAr }, noPhase, true},
+	}
+	for _, g := range gauges {
+		pw.Family(g.name, g.help, promtext.Gauge)
+		for _, key := range keys {
+			r, ok := e.readings[key]
+			if !ok || e.stale(r, now) {
+				continue
+			}
+			d := r.Device
+			if v := g.value(r.Power); !g.optional || v != 0 {
+				pw.Sample(g.name, v, seriesLabels(d.Instance, d.HostName, d.Channel, d.Group)...)
+			}
+			for _, ph := range r.Power.Phases {
+				if v := g.phase(ph); !g.optional || v != 0 {
+					pw.Sample(g.name, v, seriesLabels(d.Instance, d.HostName, d.Channel, d.Group, "phase", ph.Name)...)
+				}
+			}
+		}
+	}
+
+	if e.baselines != nil {
+		pw.Family("power_device_baseline_watts", "Estimated idle power: the 10th percentile of the device's readings over the last 24 hours.", promtext.Gauge)
+		for _, key := range keys {
+			if watts, ok := e.baselines.device(key, now); ok {
+				d := e.devices[key]
+				pw.Sample("power_device_baseline_watts", watts, seriesLabels(d.Instance, d.HostName, d.Channel, d.Group)...)
+			}
+		}
+	}
+
+	pw.Family("power_device_reading_age_seconds", "Age of the device's last successful reading, exported even once the reading is too stale for the gauges.", promtext.Gauge)
+	for _, key := range keys {
+		if r, ok := e.readings[key]; ok {
+			d := r.Device
+			pw.Sample("power_device_reading_age_seconds", max(now.Sub(r.Time).Seconds(), 0), seriesLabels(d.Instance, d.HostName, d.Channel, d.Group)...)
+		}
+	}
+
+	pw.Family("power_device_up", "Whether the device is available: 0 once it is offline, or after a failed query when it is not polled.", promtext.Gauge)
+	for _, key := range keys {
+		d := e.devices[key]
+		pw.Sample("power_device_up", e.up[key], seriesLabels(d.Instance, d.HostName, d.Channel, d.Group)...)
+	}
+
+	pw.Family("power_scrape_errors_total", "Failed power queries per device.", promtext.Counter)
+	for _, key := range keys {
+		d := e.devices[key]
+		pw.Sample("power_scrape_errors_total", e.errors[key], seriesLabels(d.Instance, d.HostName, d.Channel, d.Group)...)
+	}
+
+	pw.Family("power_scrape_failures_total", "Failed power queries per device, by reason: timeout connecting or awaiting headers, body read timeout, unreachable, http error, decode error or implausible reading.", promtext.Counter)
+	for _, key := range keys {
+		d := e.devices[key]
+		for _, reason := range sortedKeys(e.failures[key]) {
+			pw.Sample("power_scrape_failures_total", e.failures[key][reason], seriesLabels(d.Instance, d.HostName, d.Channel, d.Group, "reason", reason)...)
+		}
+	}
+
+	pw.Family("power_fetch_duration_seconds", "Time successful power queries took per device, retries included.", promtext.Histogram)
+	for _, key := range keys {
+		if h, ok := e.fetchDurations[key]; ok {
+			d := e.devices[key]
+			h.samples(pw, "power_fetch_duration_seconds", seriesLabels(d.Instance, d.HostName, d.Channel, d.Group)...)
+		}
+	}
+
+	if e.limiterWaits != nil {
+		e.limiterWaits.write(pw, "power_rate_limit_wait_seconds", "Time device requests waited for the rate limiter.")
+	}
+
+	if counts := e.sinks.counts(); len(counts) > 0 {
+		pw.Family("power_sink_writes_total", "Writes and flushes per output sink, by result.", promtext.Counter)
+		for _, name := range sortedKeys(counts) {
+			pw.Sample("power_sink_writes_total", float64(counts[name].OK), "sink", name, "result", "ok")
+			pw.Sample("power_sink_writes_total", float64(counts[name].Failed), "sink", name, "result", "error")
+		}
+	}
+
+	if e.summary != nil {
+		pw.Family("power_total_watts", "Total power draw across devices in the last poll cycle.", promtext.Gauge)
+		pw.Sample("power_total_watts", e.summary.TotalWatts)
+		pw.Family("power_devices", "Devices polled in the last poll cycle.", promtext.Gauge)
+		pw.Sample("power_devices", float64(e.summary.Devices))
+		pw.Family("power_failed_devices", "Devices whose query failed in the last poll cycle.", promtext.Gauge)
+		pw.Sample("power_failed_devices", float64(e.summary.Failed))
+		if len(e.summary.Groups) > 0 {
+			pw.Family("power_group_watts", "Total power draw per device group in the last poll cycle.", promtext.Gauge)
+			for _, name := range sortedKeys(e.summary.Groups) {
+				pw.Sample("power_group_watts", e.summary.Groups[name].TotalWatts, "group", name)
+			}
+		}
+		if rep := e.summary.Energy; rep != nil && rep.TotalCost != nil {
+			pw.Family("power_device_cost_total", "Cost of the energy used per device at the configured tariff.", promtext.Counter)
+			for _, name := range sortedKeys(rep.Costs) {
+				pw.Sample("power_device_cost_total", rep.Costs[name], "device", name)
+			}
+		}
+	}
+	e.monitor.write(pw, e.sinks)
+}
+
+// noPhase is the per-phase value of a gauge phases do not report.
+func noPhase(collector.PhaseInfo) float64 { return 0 }
+
+// limiterWaitBuckets are the upper bounds, in seconds, of the rate
+// limiter's wait histogram.
+var limiterWaitBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// fetchDurationBuckets are the upper bounds, in seconds, of the per-device
+// query latency histograms.
+var fetchDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations into buckets, safe for concurrent use.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// newHistogram returns a histogram with the given ascending bucket upper
+// bounds; a +Inf bucket is implied.
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]float64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram as the family name with cumulative buckets.
+func (h *histogram) write(pw *promtext.Writer, name, help string) {
+	pw.Family(name, help, promtext.Histogram)
+	h.samples(pw, name)
+}
+
+// samples writes the histogram's series of the family name with labels,
+// for a family holding several histograms.
+func (h *histogram) samples(pw *promtext.Writer, name string, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative float64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		pw.Sample(name+"_bucket", cumulative, append(slices.Clone(labels), "le", formatFloat(bound))...)
+	}
+	pw.Sample(name+"_bucket", h.count, append(slices.Clone(labels), "le", "+Inf")...)
+	pw.Sample(name+"_sum", h.sum, labels...)
+	pw.Sample(name+"_count", h.count, labels...)
+}
+
+// seriesLabels returns the label pairs of a device's series, with a
+// channel label for each channel of a multi-channel device and a group
+// label when groups are configured, followed by extra.
+func seriesLabels(instance, host, channel, group string, extra ...string) []string {
+	labels := []string{"device", instance, "host", host}
+	if channel != "" {
+		labels = append(labels, "channel", channel)
+	}
+	if group != "" {
+		labels = append(labels, "group", group)
+	}
+	return append(labels, extra...)
+}
+
+// newMetricsServer returns an HTTP server exposing the exporter at /metrics
+// and, when a is set, the JSON API alongside it.
+func newMetricsServer(addr string, e *exporter, a *api) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	if a != nil {
+		a.register(mux)
+	}
+	return &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func scrape(t *testing.T, e *exporter) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestExporterRendersReadings(t *testing.T) {
+	e := newExporter()
+	lamp := collector.Device{Instance: "Lamp", HostName: "demo.local", Firmware: "1.2.3"}
+	e.record(collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230.1}})
+
+	body := scrape(t, e)
+	for _, want := range []string{
+		`power_device_watts{device="Lamp",host="demo.local"} 12.5`,
+		`power_device_voltage{device="Lamp",host="demo.local"} 230.1`,
+		`power_device_info{device="Lamp",host="demo.local",firmware="1.2.3"} 1`,
+		`power_scrape_errors_total{device="Lamp",host="demo.local"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in exposition:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "power_device_amperage{") {
+		t.Fatalf("expected no amperage sample when unreported:\n%s", body)
+	}
+}
+
+func TestExporterLabelsChannels(t *testing.T) {
+	e := newExporter()
+	plug := collector.Device{Instance: "Office Plug", HostName: "plug.local"}
+	for ch, watts := range map[string]float64{"0": 40, "1": 60} {
+		d := plug
+		d.Channel = ch
+		e.record(collector.Reading{Device: d, Power: &collector.PowerInfo{CurrentWatts: watts}})
+	}
+
+	body := scrape(t, e)
+	for _, want := range []string{
+		`power_device_watts{device="Office Plug",host="plug.local",channel="0"} 40`,
+		`power_device_watts{device="Office Plug",host="plug.local",channel="1"} 60`,
+		`power_device_info{device="Office Plug",host="plug.local",channel="1",firmware=""} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in exposition:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporterCountsErrors(t *testing.T) {
+	e := newExporter()
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local"}
+	e.record(collector.Reading{Device: plug, Err: errors.New("timeout")})
+	e.record(collector.Reading{Device: plug, Err: errors.New("timeout")})
+
+	body := scrape(t, e)
+	if !strings.Contains(body, `power_scrape_errors_total{device="Plug",host="plug.local"} 2`) {
+		t.Fatalf("expected two scrape errors:\n%s", body)
+	}
+	if strings.Contains(body, `power_device_watts{device="Plug"`) {
+		t.Fatalf("expected no watts sample for a device that never answered:\n%s", body)
+	}
+
+	e.record(collector.Reading{Device: plug, Err: context.DeadlineExceeded})
+	body = scrape(t, e)
+	for _, want := range []string{
+		`power_scrape_failures_total{device="Plug",host="plug.local",reason="timeout"} 1`,
+		`power_scrape_failures_total{device="Plug",host="plug.local",reason="unreachable"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in exposition:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporterReportsDeviceUp(t *testing.T) {
+	e := newExporter()
+	lamp := collector.Device{Instance: "Lamp", HostName: "lamp.local"}
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local"}
+	kettle := collector.Device{Instance: "Kettle", HostName: "kettle.local"}
+	e.record(collector.Reading{Device: lamp, Err: errors.New("timeout"), State: collector.Degraded})
+	e.record(collector.Reading{Device: plug, Err: errors.New("timeout"), State: collector.Offline})
+	e.record(collector.Reading{Device: kettle, Err: errors.New("timeout")})
+
+	body := scrape(t, e)
+	for _, want := range []string{
+		`power_device_up{device="Lamp",host="lamp.local"} 1`,
+		`power_device_up{device="Plug",host="plug.local"} 0`,
+		`power_device_up{device="Kettle",host="kettle.local"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in exposition:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporterRendersLimiterWaits(t *testing.T) {
+	e := newExporter()
+	e.limiterWaits = newHistogram(0.1, 1)
+	for _, v := range []float64{0, 0.5, 2} {
+		e.limiterWaits.observe(v)
+	}
+
+	body := scrape(t, e)
+	for _, want := range []string{
+		"# TYPE power_rate_limit_wait_seconds histogram",
+		`power_rate_limit_wait_seconds_bucket{le="0.1"} 1`,
+		`power_rate_limit_wait_seconds_bucket{le="1"} 2`,
+		`power_rate_limit_wait_seconds_bucket{le="+Inf"} 3`,
+		"power_rate_limit_wait_seconds_sum 2.5",
+		"power_rate_limit_wait_seconds_count 3",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in exposition:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporterRendersFetchDurations(t *testing.T) {
+	e := newExporter()
+	lamp := collector.Device{Instance: "Lamp", HostName: "lamp.local"}
+	for _, latency := range []time.Duration{20 * time.Millisecond, 3 * time.Second} {
+		e.record(collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 1, Latency: latency}})
+	}
+	e.record(collector.Reading{Device: collector.Device{Instance: "Plug", HostName: "plug.local"}, Err: errors.New("timeout")})
+
+	body := scrape(t, e)
+	for _, want := range []string{
+		"# TYPE power_fetch_duration_seconds histogram",
+		`power_fetch_duration_seconds_bucket{device="Lamp",host="lamp.local",le="0.025"} 1`,
+		`power_fetch_duration_seconds_bucket{device="Lamp",host="lamp.local",le="5"} 2`,
+		`power_fetch_duration_seconds_bucket{device="Lamp",host="lamp.local",le="+Inf"} 2`,
+		`power_fetch_duration_seconds_sum{device="Lamp",host="lamp.local"} 3.02`,
+		`power_fetch_duration_seconds_count{device="Lamp",host="lamp.local"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in exposition:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `power_fetch_duration_seconds_count{device="Plug"`) {
+		t.Fatalf("expected no histogram for a device that never answered:\n%s", body)
+	}
+}
+
+func TestExporterRefreshesOnScrape(t *testing.T) {
+	e := newExporter()
+	calls := 0
+	e.refresh = func(ctx context.Context) {
+		calls++
+		e.record(collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: float64(calls)}})
+	}
+
+	scrape(t, e)
+	body := scrape(t, e)
+	if calls != 2 || !strings.Contains(body, `power_device_watts{device="Lamp",host=""} 2`) {
+		t.Fatalf("expected on-demand refresh per scrape, got %d calls:\n%s", calls, body)
+	}
+}
+
+func TestExporterRendersSummary(t *testing.T) {
+	e := newExporter()
+	if body := scrape(t, e); strings.Contains(body, "power_total_watts") {
+		t.Fatalf("expected no totals before the first cycle, got:\n%s", body)
+	}
+
+	e.recordSummary(summary{TotalWatts: 42.5, Devices: 3, Failed: 1})
+	body := scrape(t, e)
+	for _, want := range []string{"power_total_watts 42.5", "power_devices 3", "power_failed_devices 1"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "power_device_cost_total") {
+		t.Fatalf("expected no cost without a tariff, got:\n%s", body)
+	}
+
+	total := 1.25
+	e.recordSummary(summary{Energy: &energyReport{TotalCost: &total, Costs: map[string]float64{"Lamp": 1.25}}})
+	body = scrape(t, e)
+	if !strings.Contains(body, "# TYPE power_device_cost_total counter") || !strings.Contains(body, `power_device_cost_total{device="Lamp"} 1.25`) {
+		t.Fatalf("expected the cost counter, got:\n%s", body)
+	}
+}
+
+func TestExporterRendersBuildInfo(t *testing.T) {
+	build := currentBuild()
+	want := fmt.Sprintf(`power_collector_build_info{version=%q,commit=%q,goversion=%q} 1`, build.Version, build.Commit, build.GoVersion)
+	if body := scrape(t, newExporter()); !strings.Contains(body, want) {
+		t.Fatalf("expected %q in metrics, got:\n%s", want, body)
+	}
+}
+
+func TestExporterLabelsGroups(t *testing.T) {
+	e := newExporter()
+	e.record(collector.Reading{Device: collector.Device{Instance: "Lamp", HostName: "lamp.local", Group: "office"}, Power: &collector.PowerInfo{CurrentWatts: 12.5}})
+	e.recordSummary(summary{TotalWatts: 12.5, Devices: 1, Groups: map[string]*groupTotal{"office": {TotalWatts: 12.5, Devices: 1}}})
+
+	body := scrape(t, e)
+	for _, want := range []string{`power_device_watts{device="Lamp",host="lamp.local",group="office"} 12.5`, `power_group_watts{group="office"} 12.5`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporterLabelsPhases(t *testing.T) {
+	e := newExporter()
+	mains := collector.Device{Instance: "Mains", HostName: "mains.local"}
+	e.record(collector.Reading{Device: mains, Power: &collector.PowerInfo{CurrentWatts: 300, Phases: []collector.PhaseInfo{
+		{Name: "L1", Watts: 100, Voltage: 230, PowerFactor: 0.9},
+		{Name: "L2", Watts: 200},
+	}}})
+
+	body := scrape(t, e)
+	for _, want := range []string{
+		`power_device_watts{device="Mains",host="mains.local"} 300`,
+		`power_device_watts{device="Mains",host="mains.local",phase="L1"} 100`,
+		`power_device_watts{device="Mains",host="mains.local",phase="L2"} 200`,
+		`power_device_voltage{device="Mains",host="mains.local",phase="L1"} 230`,
+		`power_device_power_factor{device="Mains",host="mains.local",phase="L1"} 0.9`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `phase="L2"} 0`) {
+		t.Fatalf("expected no unreported phase values, got:\n%s", body)
+	}
+}
+
+func TestExporterRendersElectricalGauges(t *testing.T) {
+	e := newExporter()
+	lamp := collector.Device{Instance: "Lamp", HostName: "lamp.local"}
+	e.record(collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 12.5, PowerFactor: 0.94, FrequencyHz: 50, ApparentVA: 13.3, ReactiveVAr: 4.5}})
+
+	body := scrape(t, e)
+	for _, want := range []string{
+		`power_device_power_factor{device="Lamp",host="lamp.local"} 0.94`,
+		`power_device_frequency_hertz{device="Lamp",host="lamp.local"} 50`,
+		`power_device_apparent_power_va{device="Lamp",host="lamp.local"} 13.3`,
+		`power_device_reactive_power_var{device="Lamp",host="lamp.local"} 4.5`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestExporterDropsStaleReadings(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	e := newExporter()
+	e.now = func() time.Time { return now }
+	e.staleness = 2 * time.Minute
+	lamp := collector.Device{Instance: "Lamp", HostName: "lamp.local"}
+	e.record(collector.Reading{Device: lamp, Time: now, Power: &collector.PowerInfo{CurrentWatts: 12.5}})
+
+	now = now.Add(90 * time.Second)
+	e.record(collector.Reading{Device: lamp, Time: now, Err: errors.New("timeout")})
+	body := scrape(t, e)
+	for _, want := range []string{
+		`power_device_watts{device="Lamp",host="lamp.local"} 12.5`,
+		`power_device_reading_age_seconds{device="Lamp",host="lamp.local"} 90`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q while the reading is fresh:\n%s", want, body)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	body = scrape(t, e)
+	if strings.Contains(body, "power_device_watts{") {
+		t.Fatalf("expected the stale reading to be dropped, not zeroed:\n%s", body)
+	}
+	for _, want := range []string{
+		`power_device_reading_age_seconds{device="Lamp",host="lamp.local"} 150`,
+		`power_scrape_errors_total{device="Lamp",host="lamp.local"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q once the reading is stale:\n%s", want, body)
+		}
+	}
+
+	e.record(collector.Reading{Device: lamp, Time: now, Power: &collector.PowerInfo{CurrentWatts: 13}})
+	if body := scrape(t, e); !strings.Contains(body, `power_device_watts{device="Lamp",host="lamp.local"} 13`) {
+		t.Fatalf("expected a fresh reading to be exported again:\n%s", body)
+	}
+}
+
+func TestExporterRemovesVanishedDevices(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	e := newExporter()
+	e.now = func() time.Time { return now }
+	e.deviceTTL = 10 * time.Minute
+	lamp := collector.Device{Instance: "Lamp", HostName: "lamp.local"}
+	plug := collector.Device{Instance: "Plug", HostName: "plug.local"}
+	e.record(collector.Reading{Device: lamp, Time: now, Power: &collector.PowerInfo{CurrentWatts: 12.5, Latency: time.Millisecond}})
+	e.record(collector.Reading{Device: plug, Time: now, Err: errors.New("timeout")})
+
+	// The lamp keeps being announced while its queries fail.
+	for range 3 {
+		now = now.Add(5 * time.Minute)
+		e.seen(lamp)
+		e.record(collector.Reading{Device: lamp, Time: now, Err: errors.New("timeout")})
+		e.record(collector.Reading{Device: plug, Time: now, Err: errors.New("timeout")})
+	}
+
+	body := scrape(t, e)
+	if strings.Contains(body, `device="Plug"`) {
+		t.Fatalf("expected every series of the vanished device to be removed:\n%s", body)
+	}
+	for _, want := range []string{
+		`power_device_up{device="Lamp",host="lamp.local"} 0`,
+		`power_scrape_errors_total{device="Lamp",host="lamp.local"} 3`,
+		`power_fetch_duration_seconds_count{device="Lamp",host="lamp.local"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q for the announced device:\n%s", want, body)
+		}
+	}
+}
+
+func TestRunScrapesReuseRecentReadings(t *testing.T) {
+	var mu sync.Mutex
+	queries := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := ln.Addr().String()
+	ln.Close()
+
+	opts := statusOptions(addr.Port)
+	opts.listen = listen
+	opts.scrapeOnDemand = true
+	opts.interval = time.Hour
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, opts, io.Discard, io.Discard) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var body string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get("http://" + listen + "/metrics")
+		if err != nil {
+			continue
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if body = string(b); strings.Contains(body, `power_device_watts{device="Lamp"`) {
+			break
+		}
+	}
+	for range 3 {
+		resp, err := http.Get("http://" + listen + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(body, `power_device_watts{device="Lamp"`) || queries != 1 {
+		t.Fatalf("expected one device query across scrapes, got %d:\n%s", queries, body)
+	}
+}
+
+func TestExporterKeepsReadingsWithinPollInterval(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	e := newExporter()
+	e.now = func() time.Time { return now }
+	e.staleness = 2 * time.Minute
+	fridge := collector.Device{Instance: "Fridge", HostName: "fridge.local"}
+	e.record(collector.Reading{Device: fridge, Time: now, Power: &collector.PowerInfo{CurrentWatts: 80}, Interval: 5 * time.Minute})
+
+	now = now.Add(4 * time.Minute)
+	if body := scrape(t, e); !strings.Contains(body, `power_device_watts{device="Fridge",host="fridge.local"} 80`) {
+		t.Fatalf("expected a reading within its poll interval exported:\n%s", body)
+	}
+	now = now.Add(7 * time.Minute)
+	if body := scrape(t, e); strings.Contains(body, "power_device_watts{") {
+		t.Fatalf("expected the reading dropped after twice its poll interval:\n%s", body)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// mockCommand is the subcommand that serves fake devices.
+const mockCommand = "serve-mock"
+
+// Waveforms accepted by --mock-waveform.
+const (
+	waveConstant   = "constant"
+	waveSine       = "sine"
+	waveRandomWalk = "random-walk"
+)
+
+var mockWaveforms = []string{waveConstant, waveSine, waveRandomWalk}
+
+// Response shapes accepted by --mock-shape.
+const (
+	shapePowerInfo = "powerinfo"
+	shapeShelly    = "shelly"
+)
+
+var mockShapes = []string{shapePowerInfo, shapeShelly}
+
+const (
+	// mockVoltage, mockPowerFactor and mockFrequency are the line
+	// voltage, power factor and line frequency the mock devices report.
+	mockVoltage     = 230
+	mockPowerFactor = 0.95
+	mockFrequency   = 50
+	// defaultMockMDNSPort is the port announced devices share when no
+	// --mock-port is given.
+	defaultMockMDNSPort = 8080
+	// shellyStatusPath is where the Shelly driver queries Gen2 devices.
+	shellyStatusPath = "/rpc/Switch.GetStatus"
+)
+
+// mockOptions holds the serve-mock flags.
+type mockOptions struct {
+	devices   int
+	baseWatts float64
+	jitter    float64
+	failRate  float64
+	waveform  string
+	period    time.Duration
+	shape     string
+	port      int
+	mdns      bool
+	seed      uint64
+}
+
+func registerMockFlags(fs *flag.FlagSet, o *mockOptions) {
+	fs.IntVar(&o.devices, "mock-devices", 5, "Number of fake devices to serve")
+	fs.Float64Var(&o.baseWatts, "mock-base-watts", 40, "Mean power draw of each fake device in watts")
+	fs.Float64Var(&o.jitter, "mock-jitter", 5, "Random noise added to each reading in watts, or the step size of --mock-waveform random-walk")
+	fs.Float64Var(&o.failRate, "mock-fail-rate", 0, "Fraction of queries answered with 503 to simulate flaky devices (0-1)")
+	fs.StringVar(&o.waveform, "mock-waveform", waveConstant, "Shape of the power draw over time: "+strings.Join(mockWaveforms, ", "))
+	fs.DurationVar(&o.period, "mock-period", time.Minute, "Period of --mock-waveform sine")
+	fs.StringVar(&o.shape, "mock-shape", shapePowerInfo, "Response format: powerinfo (the generic "+collector.DefaultPowerPath+" document) or shelly (Gen2 "+shellyStatusPath+")")
+	fs.IntVar(&o.port, "mock-port", 0, "First port to serve on, one per device (default: any free port); with --mock-mdns, the port every device shares (default 8080)")
+	fs.BoolVar(&o.mdns, "mock-mdns", false, "Announce the devices over mDNS as _matter._tcp services, each on its own loopback address (127.0.0.1, 127.0.0.2, ...)")
+	fs.Uint64Var(&o.seed, "mock-seed", 0, "Seed for the random readings and failures, for reproducible runs (default: random)")
+}
+
+func (o mockOptions) validate() error {
+	switch {
+	case o.devices < 1 || o.devices > 254:
+		return fmt.Errorf("invalid --mock-devices %d: want 1 to 254", o.devices)
+	case o.failRate < 0 || o.failRate > 1:
+		return fmt.Errorf("invalid --mock-fail-rate %v: want 0 to 1", o.failRate)
+	case o.baseWatts < 0 || o.jitter < 0:
+		return errors.New("--mock-base-watts and --mock-jitter must not be negative")
+	case o.waveform == waveSine && o.period <= 0:
+		return fmt.Errorf("invalid --mock-period %s: must be positive", o.period)
+	}
+	if !slices.Contains(mockWaveforms, o.waveform) {
+		return fmt.Errorf("invalid waveform %q: must be one of %s", o.waveform, strings.Join(mockWaveforms, ", "))
+	}
+	if !slices.Contains(mockShapes, o.shape) {
+		return fmt.Errorf("invalid shape %q: must be one of %s", o.shape, strings.Join(mockShapes, ", "))
+	}
+	return nil
+}
+
+// mockMain runs the serve-mock subcommand and returns the exit status.
+func mockMain(args []string) int {
+	fs := flag.NewFlagSet(mockCommand, flag.ContinueOnError)
+	var o mockOptions
+	registerMockFlags(fs, &o)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitSetup
+	}
+	ctx, stop := notifyShutdown(context.Background())
+	defer stop()
+	if err := serveMock(ctx, o, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitSetup
+	}
+	return exitOK
+}
+
+// serveMock serves the fake devices until ctx is done, writing the URL of
+// each to w.
+func serveMock(ctx context.Context, o mockOptions, w io.Writer) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	devices, err := startMockDevices(o)
+	if err != nil {
+		return err
+	}
+	var services []zeroconf.Service
+	for _, d := range devices {
+		fmt.Fprintf(w, "%s: %s\n", d.name, d.url())
+		services = append(services, d.service())
+	}
+	if o.mdns {
+		go func() {
+			r := &zeroconf.Responder{Services: services}
+			if err := r.Serve(ctx); err != nil {
+				slog.Warn("mock devices not announced", "error", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, d := range devices {
+		d.server.Shutdown(shutdownCtx)
+	}
+	return nil
+}
+
+// startMockDevices starts the HTTP server of every fake device.
+func startMockDevices(o mockOptions) ([]*mockDevice, error) {
+	seed := o.seed
+	if seed == 0 {
+		seed = rand.Uint64() // #nosec G404 -- mock readings need no cryptographic randomness
+	}
+	var devices []*mockDevice
+	for i := range o.devices {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(mockPort(o, i)))
+		if o.mdns {
+			addr = net.JoinHostPort(fmt.Sprintf("127.0.0.%d", i+1), strconv.Itoa(mockPort(o, i)))
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, d := range devices {
+				d.server.Close()
+			}
+			return nil, fmt.Errorf("mock device %d: %w", i+1, err)
+		}
+		d := newMockDevice(o, i, seed)
+		d.addr = ln.Addr().(*net.TCPAddr)
+		d.server = &http.Server{Handler: d, ReadHeaderTimeout: 10 * time.Second}
+		go d.server.Serve(ln)
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// mockPort returns the port device i listens on.
+func mockPort(o mockOptions, i int) int {
+	switch {
+	case o.mdns && o.port == 0:
+		return defaultMockMDNSPort
+	case o.mdns:
+		return o.port
+	case o.port == 0:
+		return 0
+	}
+	return o.port + i
+}
+
+// mockDevice is one fake device answering power queries.
+type mockDevice struct {
+	name   string
+	host   string
+	o      mockOptions
+	phase  float64
+	start  time.Time
+	addr   *net.TCPAddr
+	server *http.Server
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	walk float64
+}
+
+func newMockDevice(o mockOptions, i int, seed uint64) *mockDevice {
+	name, host := fmt.Sprintf("Mock Plug %d", i+1), fmt.Sprintf("mock-plug-%d", i+1)
+	if o.shape == shapeShelly {
+		name, host = fmt.Sprintf("Mock Shelly %d", i+1), fmt.Sprintf("shellyplus1pm-mock%d", i+1)
+	}
+	return &mockDevice{
+		name:  name,
+		host:  host,
+		o:     o,
+		phase: 2 * math.Pi * float64(i) / float64(o.devices),
+		start: time.Now(),
+		rng:   rand.New(rand.NewPCG(seed, uint64(i))), // #nosec G404 -- mock readings need no cryptographic randomness
+		walk:  o.baseWatts,
+	}
+}
+
+// url returns the device's power endpoint.
+func (d *mockDevice) url() string {
+	path := collector.DefaultPowerPath
+	if d.o.shape == shapeShelly {
+		path = shellyStatusPath + "?id=0"
+	}
+	return "http://" + d.addr.String() + path
+}
+
+// service returns the mDNS announcement of the device.
+func (d *mockDevice) service() zeroconf.Service {
+	text := []string{"fv=mock-1.0"}
+	if d.o.shape == shapeShelly {
+		text = append(text, "gen=2", "app=Plus1PM")
+	}
+	return zeroconf.Service{
+		Instance: d.name,
+		Service:  collector.DefaultService,
+		HostName: d.host + ".local.",
+		Port:     d.addr.Port,
+		IPs:      []net.IP{d.addr.IP},
+		Text:     text,
+	}
+}
+
+// reading returns the power draw at at and whether the query should fail.
+func (d *mockDevice) reading(at time.Time) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fail := d.o.failRate > 0 && d.rng.Float64() < d.o.failRate
+	noise := (2*d.rng.Float64() - 1) * d.o.jitter
+	var watts float64
+	switch d.o.waveform {
+	case waveSine:
+		angle := 2*math.Pi*at.Sub(d.start).Seconds()/d.o.period.Seconds() + d.phase
+		watts = d.o.baseWatts + d.o.baseWatts/2*math.Sin(angle) + noise
+	case waveRandomWalk:
+		d.walk = max(d.walk+noise, 0)
+		watts = d.walk
+	default:
+		watts = d.o.baseWatts + noise
+	}
+	return math.Round(max(watts, 0)*100) / 100, fail
+}
+
+func (d *mockDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := collector.DefaultPowerPath
+	if d.o.shape == shapeShelly {
+		path = shellyStatusPath
+	}
+	if r.Method != http.MethodGet || r.URL.Path != path {
+		http.NotFound(w, r)
+		return
+	}
+	now := time.Now()
+	watts, fail := d.reading(now)
+	if fail {
+		http.Error(w, "simulated failure", http.StatusServiceUnavailable)
+		return
+	}
+
+	amps := math.Round(watts/mockVoltage/mockPowerFactor*1000) / 1000
+	var body any = collector.PowerInfo{DeviceName: d.name, CurrentWatts: watts, Voltage: mockVoltage, Amperage: amps, PowerFactor: mockPowerFactor, FrequencyHz: mockFrequency, Timestamp: now.UTC()}
+	if d.o.shape == shapeShelly {
+		body = map[string]any{"id": 0, "source": "mock", "output": true, "apower": watts, "voltage": mockVoltage, "current": amps, "pf": mockPowerFactor, "freq": mockFrequency}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
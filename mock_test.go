@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func defaultMockOptions() mockOptions {
+	var o mockOptions
+	registerMockFlags(flag.NewFlagSet("test", flag.ContinueOnError), &o)
+	o.devices = 2
+	o.seed = 1
+	return o
+}
+
+// startMock starts o's devices, shutting them down with the test.
+func startMock(t *testing.T, o mockOptions) []*mockDevice {
+	t.Helper()
+	devices, err := startMockDevices(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, d := range devices {
+			d.server.Close()
+		}
+	})
+	return devices
+}
+
+// fetchMock queries d the way a discovered device is queried.
+func fetchMock(d *mockDevice) (*collector.PowerInfo, error) {
+	s := d.service()
+	f := &collector.Fetcher{Port: d.addr.Port}
+	return f.Fetch(context.Background(), collector.Device{Instance: s.Instance, HostName: strings.TrimSuffix(s.HostName, "."), Address: d.addr.IP.String(), Text: s.Text})
+}
+
+func TestMockOptionsValidate(t *testing.T) {
+	if err := defaultMockOptions().validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+	for name, change := range map[string]func(*mockOptions){
+		"devices":   func(o *mockOptions) { o.devices = 0 },
+		"fail rate": func(o *mockOptions) { o.failRate = 1.5 },
+		"waveform":  func(o *mockOptions) { o.waveform = "square" },
+		"shape":     func(o *mockOptions) { o.shape = "tasmota" },
+		"period":    func(o *mockOptions) { o.waveform, o.period = waveSine, 0 },
+	} {
+		o := defaultMockOptions()
+		change(&o)
+		if err := o.validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMockWaveforms(t *testing.T) {
+	o := defaultMockOptions()
+	o.jitter = 0
+	d := newMockDevice(o, 0, 1)
+	if watts, _ := d.reading(time.Now()); watts != 40 {
+		t.Fatalf("expected a constant 40 W, got %v", watts)
+	}
+
+	o.waveform, o.period = waveSine, time.Minute
+	d = newMockDevice(o, 0, 1)
+	if watts, _ := d.reading(d.start.Add(15 * time.Second)); watts != 60 {
+		t.Fatalf("expected the sine to peak at 60 W a quarter period in, got %v", watts)
+	}
+
+	o.waveform, o.jitter = waveRandomWalk, 5
+	a, b := newMockDevice(o, 0, 7), newMockDevice(o, 0, 7)
+	for range 10 {
+		wa, _ := a.reading(time.Now())
+		wb, _ := b.reading(time.Now())
+		if wa != wb || wa < 0 {
+			t.Fatalf("expected seeded walks to match, got %v and %v", wa, wb)
+		}
+	}
+}
+
+func TestMockDevicesAnswerDrivers(t *testing.T) {
+	for _, shape := range mockShapes {
+		o := defaultMockOptions()
+		o.shape = shape
+		for _, d := range startMock(t, o) {
+			info, err := fetchMock(d)
+			if err != nil {
+				t.Fatalf("%s: %v", shape, err)
+			}
+			if info.CurrentWatts < 35 || info.CurrentWatts > 45 || info.Voltage != mockVoltage {
+				t.Fatalf("%s: unexpected reading %+v", shape, info)
+			}
+			if info.PowerFactor != mockPowerFactor || info.FrequencyHz != mockFrequency || info.ApparentVA == 0 {
+				t.Fatalf("%s: expected the power factor and frequency, got %+v", shape, info)
+			}
+		}
+	}
+}
+
+func TestMockDevicesFail(t *testing.T) {
+	o := defaultMockOptions()
+	o.devices, o.failRate = 1, 1
+	d := startMock(t, o)[0]
+	resp, err := http.Get(d.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a simulated failure, got %s", resp.Status)
+	}
+}
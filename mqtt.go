@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/internal/mqtt"
+	"powerusagecollection/pkg/collector"
+)
+
+const (
+	// mqttMinBackoff and mqttMaxBackoff bound the delay between reconnect
+	// attempts after the broker connection is lost.
+	mqttMinBackoff = time.Second
+	mqttMaxBackoff = time.Minute
+	// mqttDialTimeout bounds each connection attempt.
+	mqttDialTimeout = 10 * time.Second
+)
+
+// mqttTopicEscaper keeps device names from adding topic levels or wildcards.
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttPublisher is the part of an MQTT connection used by the sink.
+type mqttPublisher interface {
+	Publish(ctx context.Context, msg mqtt.Message) error
+	Done() <-chan struct{}
+	Close() error
+}
+
+// mqttSink publishes readings to per-device topics, reconnecting with
+// exponential backoff when the broker connection is lost. Readings that
+// arrive while disconnected are dropped rather than blocking polling.
+type mqttSink struct {
+	topic  string
+	qos    byte
+	retain bool
+	dial   func(ctx context.Context) (mqttPublisher, error)
+
+	// haPrefix, when set, enables Home Assistant discovery announcements
+	// under this topic prefix.
+	haPrefix string
+	// haCleanup removes the announced entities again on Close.
+	haCleanup bool
+
+	mu        sync.Mutex
+	client    mqttPublisher
+	backoff   time.Duration
+	retryAt   time.Time
+	announced map[string]bool
+}
+
+// newMQTTSink returns a sink for the broker configured by the flags. The
+// connection is made on the first publish.
+func newMQTTSink(o options) (*mqttSink, error) {
+	if o.mqttQoS > 1 {
+		return nil, fmt.Errorf("invalid --mqtt-qos %d: must be 0 or 1", o.mqttQoS)
+	}
+	if o.mqttTopic == "" {
+		return nil, fmt.Errorf("--mqtt-topic must not be empty")
+	}
+	tlsConfig, err := collector.NewTLSConfig(o.mqttInsecure, o.mqttCACert)
+	if err != nil {
+		return nil, err
+	}
+	clientID := o.mqttClientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("powerusagecollection-%d", os.Getpid())
+	}
+	dialOpts := mqtt.Options{
+		Broker:    o.mqttBroker,
+		ClientID:  clientID,
+		Username:  o.mqttUsername,
+		Password:  o.mqttPassword,
+		TLSConfig: tlsConfig,
+		KeepAlive: 60 * time.Second,
+	}
+
+	s := &mqttSink{
+		topic:     o.mqttTopic,
+		qos:       byte(o.mqttQoS),
+		retain:    o.mqttRetain,
+		haCleanup: o.haCleanup,
+		announced: make(map[string]bool),
+		dial: func(ctx context.Context) (mqttPublisher, error) {
+			return mqtt.Dial(ctx, dialOpts)
+		},
+	}
+	if o.haDiscovery {
+		s.haPrefix = o.haPrefix
+	}
+	return s, nil
+}
+
+// mqttTopic expands the {instance}, {host} and {channel} placeholders of
+// topic for r. A channel the topic does not place is added as a last
+// level, so each channel of a device gets its own topic.
+func mqttTopic(topic string, r deviceResult) string {
+	if r.Channel != "" && !strings.Contains(topic, "{channel}") {
+		topic += "/{channel}"
+	}
+	return strings.NewReplacer(
+		"{instance}", mqttTopicEscaper.Replace(r.Instance),
+		"{host}", mqttTopicEscaper.Replace(r.HostName),
+		"{channel}", mqttTopicEscaper.Replace(r.Channel),
+	).Replace(topic)
+}
+
+// mqttEventsTopic returns the topic device events are published to: the
+// events level under the part of topic before its placeholders, such as
+// power/events for power/{instance}.
+func mqttEventsTopic(topic string) string {
+	prefix, _, _ := strings.Cut(topic, "{")
+	if prefix = strings.TrimRight(prefix, "/"); prefix == "" {
+		return "events"
+	}
+	return prefix + "/events"
+}
+
+// event publishes ev to the events topic.
+func (s *mqttSink) event(ctx context.Context, ev deviceEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.Publish(ctx, mqtt.Message{Topic: mqttEventsTopic(s.topic), Payload: payload, QoS: s.qos}); err != nil {
+		if ctx.Err() == nil {
+			s.disconnect(client)
+		}
+		return err
+	}
+	return nil
+}
+
+// Write publishes the reading of each record that has one, going on past
+// failures to return them all.
+func (s *mqttSink) Write(ctx context.Context, results []deviceResult) error {
+	var errs []error
+	for _, r := range results {
+		if r.PowerInfo == nil {
+			continue
+		}
+		if err := s.send(ctx, r); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", deviceLabel(r.Instance, r.Channel), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush does nothing; Write publishes every reading.
+func (s *mqttSink) Flush(context.Context) error {
+	return nil
+}
+
+func (s *mqttSink) send(ctx context.Context, r deviceResult) error {
+	payload, err := json.Marshal(r.PowerInfo)
+	if err != nil {
+		return err
+	}
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if s.haPrefix != "" {
+		if err := s.announce(ctx, client, r); err != nil {
+			if ctx.Err() == nil {
+				s.disconnect(client)
+			}
+			return err
+		}
+	}
+	msg := mqtt.Message{Topic: mqttTopic(s.topic, r), Payload: payload, QoS: s.qos, Retain: s.retain}
+	if err := client.Publish(ctx, msg); err != nil {
+		if ctx.Err() == nil {
+			s.disconnect(client)
+		}
+		return err
+	}
+	return nil
+}
+
+// connect returns the live connection, dialling a new one unless a
+// reconnect is still backing off.
+func (s *mqttSink) connect(ctx context.Context) (mqttPublisher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		select {
+		case <-s.client.Done():
+			s.client = nil
+		default:
+			return s.client, nil
+		}
+	}
+	if wait := time.Until(s.retryAt); wait > 0 {
+		return nil, fmt.Errorf("broker unavailable, reconnecting in %s", wait.Round(time.Second))
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, mqttDialTimeout)
+	defer cancel()
+	client, err := s.dial(dialCtx)
+	if err != nil {
+		s.scheduleRetry()
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	s.client = client
+	s.backoff = 0
+	return client, nil
+}
+
+// disconnect drops client after a failed publish so the next one redials.
+func (s *mqttSink) disconnect(client mqttPublisher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != client {
+		return
+	}
+	client.Close()
+	s.client = nil
+	s.scheduleRetry()
+}
+
+// scheduleRetry doubles the reconnect delay. The caller must hold s.mu.
+func (s *mqttSink) scheduleRetry() {
+	if s.backoff == 0 {
+		s.backoff = mqttMinBackoff
+	} else {
+		s.backoff = min(s.backoff*2, mqttMaxBackoff)
+	}
+	s.retryAt = time.Now().Add(s.backoff)
+}
+
+// Close disconnects from the broker, first removing the Home Assistant
+// entities when cleanup is enabled.
+func (s *mqttSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	if s.haCleanup {
+		ctx, cancel := context.WithTimeout(context.Background(), mqttDialTimeout)
+		s.removeAnnouncements(ctx, s.client)
+		cancel()
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
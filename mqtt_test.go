@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/mqtt"
+	"powerusagecollection/pkg/collector"
+)
+
+// fakePublisher records messages and fails publishes while broken is set.
+type fakePublisher struct {
+	mu       sync.Mutex
+	messages []mqtt.Message
+	broken   bool
+	done     chan struct{}
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{done: make(chan struct{})}
+}
+
+func (p *fakePublisher) Publish(_ context.Context, msg mqtt.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.broken {
+		return mqtt.ErrClosed
+	}
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func (p *fakePublisher) Done() <-chan struct{} { return p.done }
+func (p *fakePublisher) Close() error          { return nil }
+
+func TestMQTTTopicEscapesDeviceNames(t *testing.T) {
+	r := deviceResult{Instance: "Lamp/#1", HostName: "lamp.local"}
+	if got := mqttTopic("power/{host}/{instance}", r); got != "power/lamp.local/Lamp__1" {
+		t.Fatalf("unexpected topic %q", got)
+	}
+}
+
+func TestMQTTTopicSeparatesChannels(t *testing.T) {
+	r := deviceResult{Instance: "Office Plug", HostName: "plug.local", Channel: "1"}
+	if got := mqttTopic("power/{instance}", r); got != "power/Office Plug/1" {
+		t.Fatalf("expected the channel as a last level, got %q", got)
+	}
+	if got := mqttTopic("power/{instance}-{channel}/state", r); got != "power/Office Plug-1/state" {
+		t.Fatalf("expected the placed channel, got %q", got)
+	}
+}
+
+func TestMQTTSinkPublishesRetainedJSON(t *testing.T) {
+	pub := newFakePublisher()
+	sink := &mqttSink{topic: "power/{instance}", qos: 1, retain: true, dial: func(context.Context) (mqttPublisher, error) { return pub, nil }}
+
+	err := sink.Write(context.Background(), []deviceResult{
+		{Instance: "Lamp", PowerInfo: &collector.PowerInfo{DeviceName: "Lamp", CurrentWatts: 12.5}},
+		{Instance: "Broken", Error: "timeout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pub.messages) != 1 {
+		t.Fatalf("expected only the successful reading to be published, got %+v", pub.messages)
+	}
+	msg := pub.messages[0]
+	if msg.Topic != "power/Lamp" || string(msg.Payload) != `{"deviceName":"Lamp","currentWatts":12.5}` || msg.QoS != 1 || !msg.Retain {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+}
+
+func TestMQTTSinkBacksOffAfterConnectionLoss(t *testing.T) {
+	dials := 0
+	var pub *fakePublisher
+	sink := &mqttSink{topic: "power/{instance}", dial: func(context.Context) (mqttPublisher, error) {
+		dials++
+		if dials == 2 {
+			return nil, errors.New("connection refused")
+		}
+		pub = newFakePublisher()
+		return pub, nil
+	}}
+	r := deviceResult{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}}
+	ctx := context.Background()
+
+	if err := sink.send(ctx, r); err != nil {
+		t.Fatalf("expected first publish to succeed, got %v", err)
+	}
+	pub.broken = true
+	if err := sink.send(ctx, r); err == nil {
+		t.Fatal("expected publish on a lost connection to fail")
+	}
+	if err := sink.send(ctx, r); err == nil || dials != 1 {
+		t.Fatalf("expected publish to be dropped while backing off, got %v after %d dials", err, dials)
+	}
+	if sink.backoff != mqttMinBackoff {
+		t.Fatalf("expected backoff %s, got %s", mqttMinBackoff, sink.backoff)
+	}
+
+	sink.retryAt = time.Time{}
+	if err := sink.send(ctx, r); err == nil || dials != 2 {
+		t.Fatalf("expected failed reconnect, got %v after %d dials", err, dials)
+	}
+	if sink.backoff != 2*mqttMinBackoff {
+		t.Fatalf("expected backoff to double, got %s", sink.backoff)
+	}
+
+	sink.retryAt = time.Time{}
+	if err := sink.send(ctx, r); err != nil || dials != 3 {
+		t.Fatalf("expected reconnect to succeed, got %v after %d dials", err, dials)
+	}
+	if sink.backoff != 0 || len(pub.messages) != 1 {
+		t.Fatalf("expected backoff reset and message delivered, got %s and %d messages", sink.backoff, len(pub.messages))
+	}
+}
+
+func TestNewMQTTSinkRejectsQoS2(t *testing.T) {
+	if _, err := newMQTTSink(options{mqttBroker: "tcp://broker:1883", mqttTopic: "power/{instance}", mqttQoS: 2}); err == nil {
+		t.Fatal("expected error for QoS 2")
+	}
+}
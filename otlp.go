@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/internal/otlp"
+	"powerusagecollection/pkg/collector"
+)
+
+const (
+	// otlpServiceName is the service.name resource attribute.
+	otlpServiceName = "powerusagecollection"
+	// otlpTimeout bounds each export.
+	otlpTimeout = 10 * time.Second
+)
+
+// otlpExporter exports the device gauges and query error counters to an
+// OpenTelemetry collector after every run or poll cycle.
+type otlpExporter struct {
+	client   *otlp.Client
+	resource []otlp.Attribute
+	start    time.Time
+
+	mu sync.Mutex
+	// gauges holds the readings since the last successful export.
+	gauges map[string]otlp.Point
+	// errors holds each device's query errors over the whole run.
+	errors map[string]otlp.Point
+}
+
+// newOTLPExporter returns an exporter for the endpoint configured by the
+// flags.
+func newOTLPExporter(o options) (*otlpExporter, error) {
+	headers, err := parseOTLPHeaders(o.otlpHeaders)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := collector.NewTLSConfig(o.otlpInsecure, o.otlpCACert)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && (o.otlpTLS || strings.HasPrefix(o.otlpEndpoint, "https://")) {
+		tlsConfig = new(tls.Config)
+	}
+	client, err := otlp.NewClient(o.otlpEndpoint, tlsConfig, headers, otlpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	resource := []otlp.Attribute{{Key: "service.name", Value: otlpServiceName}}
+	if host, err := os.Hostname(); err == nil {
+		resource = append(resource, otlp.Attribute{Key: "host.name", Value: host})
+	}
+	return &otlpExporter{
+		client:   client,
+		resource: resource,
+		start:    time.Now(),
+		gauges:   make(map[string]otlp.Point),
+		errors:   make(map[string]otlp.Point),
+	}, nil
+}
+
+// parseOTLPHeaders parses --otlp-headers, comma-separated key=value pairs
+// with percent-encoded values.
+func parseOTLPHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --otlp-headers entry %q: want key=value", pair)
+		}
+		decoded, err := url.PathUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --otlp-headers value for %s: %w", key, err)
+		}
+		headers[key] = decoded
+	}
+	return headers, nil
+}
+
+// otlpAttributes returns the data point attributes of r's device.
+func otlpAttributes(r deviceResult) []otlp.Attribute {
+	attrs := []otlp.Attribute{{Key: "device", Value: r.Instance}}
+	if r.HostName != "" {
+		attrs = append(attrs, otlp.Attribute{Key: "host", Value: r.HostName})
+	}
+	if r.Channel != "" {
+		attrs = append(attrs, otlp.Attribute{Key: "channel", Value: r.Channel})
+	}
+	if r.Source != "" {
+		attrs = append(attrs, otlp.Attribute{Key: "source", Value: r.Source})
+	}
+	return attrs
+}
+
+// record notes r's reading, or counts its error.
+func (e *otlpExporter) record(r deviceResult) {
+	stamp := r.Time
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+	key := resultKey(r)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if r.PowerInfo != nil {
+		e.gauges[key] = otlp.Point{Attributes: otlpAttributes(r), Time: stamp, Value: r.CurrentWatts}
+	}
+	errs, ok := e.errors[key]
+	if !ok {
+		errs = otlp.Point{Attributes: otlpAttributes(r), Start: e.start}
+	}
+	if r.Error != "" {
+		errs.Value++
+	}
+	errs.Time = stamp
+	e.errors[key] = errs
+}
+
+// request returns the export of the readings since the last export and
+// the error counters, with the time of each exported reading.
+func (e *otlpExporter) request() (otlp.Request, map[string]time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	exported := make(map[string]time.Time, len(e.gauges))
+	watts := otlp.Metric{Name: "power.device.watts", Description: "Current power draw of each device.", Unit: "W"}
+	for _, key := range sortedKeys(e.gauges) {
+		watts.Points = append(watts.Points, e.gauges[key])
+		exported[key] = e.gauges[key].Time
+	}
+	errs := otlp.Metric{Name: "power.collector.scrape.errors", Description: "Failed power queries per device.", Unit: "{error}", Sum: true}
+	for _, key := range sortedKeys(e.errors) {
+		errs.Points = append(errs.Points, e.errors[key])
+	}
+	req := otlp.Request{Resource: e.resource, Scope: otlpServiceName}
+	for _, m := range []otlp.Metric{watts, errs} {
+		if len(m.Points) > 0 {
+			req.Metrics = append(req.Metrics, m)
+		}
+	}
+	return req, exported
+}
+
+// Write records results and exports the metrics.
+func (e *otlpExporter) Write(ctx context.Context, results []deviceResult) error {
+	for _, r := range results {
+		e.record(r)
+	}
+	return e.export(ctx)
+}
+
+// Flush exports the readings that failed to export, if any.
+func (e *otlpExporter) Flush(ctx context.Context) error {
+	e.mu.Lock()
+	pending := len(e.gauges) > 0
+	e.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	return e.export(ctx)
+}
+
+// Close does nothing; every request is made and closed by export.
+func (e *otlpExporter) Close() error {
+	return nil
+}
+
+// export exports the metrics. Readings that failed to export are sent
+// again with the next export unless replaced.
+func (e *otlpExporter) export(ctx context.Context) error {
+	req, exported := e.request()
+	if len(req.Metrics) == 0 {
+		return nil
+	}
+	if err := e.client.Export(ctx, req); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, at := range exported {
+		if g, ok := e.gauges[key]; ok && g.Time.Equal(at) {
+			delete(e.gauges, key)
+		}
+	}
+	return nil
+}
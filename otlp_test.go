@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// fakeOTLP records the bodies of the exports it receives.
+type fakeOTLP struct {
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func newFakeOTLP(t *testing.T) (*fakeOTLP, *httptest.Server) {
+	c := &fakeOTLP{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		c.mu.Lock()
+		c.bodies = append(c.bodies, body)
+		c.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return c, server
+}
+
+func (c *fakeOTLP) exports() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.bodies...)
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	headers, err := parseOTLPHeaders("authorization=Bearer%20t0ken, x-scope = a%2Cb ,")
+	if err != nil || len(headers) != 2 || headers["authorization"] != "Bearer t0ken" || headers["x-scope"] != "a,b" {
+		t.Fatalf("unexpected headers %v (%v)", headers, err)
+	}
+	if _, err := parseOTLPHeaders("novalue"); err == nil {
+		t.Fatal("expected an entry without a value to be rejected")
+	}
+}
+
+func TestOTLPExporterSendsNewReadingsAndCumulativeErrors(t *testing.T) {
+	sink, server := newFakeOTLP(t)
+	opts := defaultOptions()
+	opts.otlpEndpoint = server.URL
+	e, err := newOTLPExporter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.record(deviceResult{Instance: "Lamp", HostName: "lamp.local", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}})
+	e.record(deviceResult{Instance: "Plug", Error: "timeout"})
+	req, _ := e.request()
+	if len(req.Metrics) != 2 || len(req.Metrics[0].Points) != 1 || req.Metrics[1].Points[1].Value != 1 {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if req.Resource[0].Value != otlpServiceName || len(req.Resource) != 2 || req.Resource[1].Key != "host.name" {
+		t.Fatalf("unexpected resource %+v", req.Resource)
+	}
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.exports(); len(got) != 1 || !bytes.Equal(got[0], req.Marshal()) {
+		t.Fatalf("expected the request to be exported, got %d exports", len(got))
+	}
+
+	// The reading went out; the error counter keeps counting.
+	e.record(deviceResult{Instance: "Plug", Error: "timeout"})
+	req, _ = e.request()
+	if len(req.Metrics) != 1 || !req.Metrics[0].Sum || req.Metrics[0].Points[1].Value != 2 {
+		t.Fatalf("expected only the error counters, got %+v", req)
+	}
+}
+
+func TestRunExportsOTLPOnce(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer device.Close()
+	addr := device.Listener.Addr().(*net.TCPAddr)
+	sink, server := newFakeOTLP(t)
+
+	opts := statusOptions(addr.Port)
+	opts.otlpEndpoint = server.URL
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	exports := sink.exports()
+	if len(exports) != 1 || !bytes.Contains(exports[0], []byte("power.device.watts")) || !bytes.Contains(exports[0], []byte("Lamp")) {
+		t.Fatalf("expected a single export with the reading, got %q", exports)
+	}
+}
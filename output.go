@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// Output formats accepted by --format.
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+var outputFormats = []string{formatText, formatJSON, formatCSV, formatInflux, formatTable}
+
+// csvHeader lists the CSV columns in their fixed order, ending with those
+// of each of csvPhases phases.
+var csvHeader = append([]string{"timestamp", "instance", "host", "address", "watts", "voltage", "amperage", "firmware", "error", "channel", "cost", "latencyMs", "powerFactor", "frequencyHz", "apparentVA", "reactiveVAr", "baselineWatts", "source"}, phaseColumns()...)
+
+// csvPhases is how many phases of a polyphase meter CSV records have
+// columns for.
+const csvPhases = 3
+
+// phaseColumns returns the CSV columns of the phases, the reading's
+// columns suffixed with the phase name.
+func phaseColumns() []string {
+	var columns []string
+	for i := range csvPhases {
+		name := "L" + strconv.Itoa(i+1)
+		columns = append(columns, "watts_"+name, "voltage_"+name, "amperage_"+name, "powerFactor_"+name)
+	}
+	return columns
+}
+
+// deviceResult is the machine-readable record emitted for each device.
+type deviceResult struct {
+	Instance string `json:"instance"`
+	HostName string `json:"hostname"`
+	// Channel is the meter channel of a multi-channel device.
+	Channel string `json:"channel,omitempty"`
+	// Group is the device's group, when groups are configured.
+	Group     string   `json:"group,omitempty"`
+	Address   string   `json:"address,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Firmware  string   `json:"firmware,omitempty"`
+	// ExpectedFirmware is the firmware --expected-firmware expects of the
+	// device's product in list mode, and Outdated whether it runs older.
+	ExpectedFirmware string `json:"expectedFirmware,omitempty"`
+	Outdated         bool   `json:"outdated,omitempty"`
+	// Matter identifiers advertised in the device's TXT records, with any
+	// keys not decoded into them kept in TXT.
+	// Vendor names VendorID, or repeats it in hex when unknown.
+	VendorID      int               `json:"vendorId,omitempty"`
+	Vendor        string            `json:"vendor,omitempty"`
+	ProductID     int               `json:"productId,omitempty"`
+	DeviceType    int               `json:"deviceType,omitempty"`
+	Discriminator int               `json:"discriminator,omitempty"`
+	TXT           map[string]string `json:"txt,omitempty"`
+	// Services lists the service types the device was discovered under,
+	// and Operational and Commissionable what they say of it.
+	Services       []string `json:"services,omitempty"`
+	Operational    bool     `json:"operational,omitempty"`
+	Commissionable bool     `json:"commissionable,omitempty"`
+	// Disabled devices are listed but not queried.
+	Disabled bool `json:"disabled,omitempty"`
+	// Source is "push" for devices that push their readings to POST
+	// /ingest.
+	Source string `json:"source,omitempty"`
+	URL    string `json:"url,omitempty"`
+	*collector.PowerInfo
+	// LatencyMs is how long the query took in milliseconds, retries
+	// included.
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// reason is the kind of failure of Error, as --format=table shows it.
+	reason  string
+	Failing bool `json:"failing,omitempty"`
+	// State, LastSeen and LastSuccess report the device's availability in
+	// polling mode.
+	State       collector.Availability `json:"state,omitempty"`
+	LastSeen    time.Time              `json:"lastSeen,omitzero"`
+	LastSuccess time.Time              `json:"lastSuccess,omitzero"`
+	// Cost is the device's accumulated energy cost, with --tariff in
+	// polling mode.
+	Cost *float64 `json:"cost,omitempty"`
+	// Stats holds the device's power statistics in polling mode.
+	Stats *deviceStats `json:"stats,omitempty"`
+	// Baseline is the device's idle power, with --standby-threshold in
+	// polling mode.
+	Baseline *float64 `json:"baselineWatts,omitempty"`
+
+	// Time is when the collector produced the record.
+	Time time.Time `json:"-"`
+}
+
+// output serialises records to a single destination so concurrent devices
+// never interleave, writing the CSV header only once. Text output is
+// colored by palette, which stays zero for every other format, and
+// timestamps are rendered by times.
+type output struct {
+	format  string
+	palette palette
+	times   timeFormat
+
+	mu     sync.Mutex
+	w      io.Writer
+	csv    *csv.Writer
+	header bool
+	closer io.Closer
+	// labelWidth is the widest device label written in a reading line so
+	// far, which later lines are padded to.
+	labelWidth int
+	// table collects the results of --format=table.
+	table *resultTable
+}
+
+// newOutput returns an output writing format to w. An empty format means
+// text.
+func newOutput(w io.Writer, format string) *output {
+	if format == "" {
+		format = formatText
+	}
+	o := &output{format: format, w: w}
+	switch format {
+	case formatCSV:
+		o.csv = csv.NewWriter(w)
+	case formatTable:
+		o.table = &resultTable{}
+	}
+	return o
+}
+
+// openOutput returns an output writing to path, or to stdout when path is
+// empty. Files are appended to, and a CSV header is skipped when the file
+// already has content.
+func openOutput(path, format string, stdout io.Writer) (*output, error) {
+	if path == "" {
+		return newOutput(stdout, format), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644) // #nosec G302 G304 -- operator-chosen output file
+	if err != nil {
+		return nil, fmt.Errorf("open output: %w", err)
+	}
+	o := newOutput(f, format)
+	o.closer = f
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		o.header = true
+	}
+	return o, nil
+}
+
+// machineReadable reports whether the output carries structured records
+// rather than human-readable prose.
+func (o *output) machineReadable() bool {
+	return o.format != formatText
+}
+
+// align returns label followed by a colon and padded to the widest label
+// written so far, so the readings of many devices line up.
+func (o *output) align(label string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := utf8.RuneCountInString(label)
+	o.labelWidth = max(o.labelWidth, n)
+	return label + ":" + strings.Repeat(" ", o.labelWidth-n)
+}
+
+// text writes preformatted human-readable output in one piece.
+func (o *output) text(b []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.w.Write(b)
+}
+
+// result writes a record in the structured output format.
+func (o *output) result(r deviceResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch o.format {
+	case formatCSV:
+		if !o.header {
+			o.csv.Write(csvHeader)
+			o.header = true
+		}
+		o.csv.Write(csvRecord(r, o.times))
+		o.csv.Flush()
+		if err := o.csv.Error(); err != nil {
+			slog.Error("csv write error", "error", err)
+		}
+	case formatInflux:
+		if line := influxLine(r); line != "" {
+			io.WriteString(o.w, line+"\n")
+		}
+	case formatTable:
+		o.table.rows = append(o.table.rows, r)
+	default:
+		writeJSONResult(o.w, r, o.times)
+	}
+}
+
+// Close releases the output file, if any.
+func (o *output) Close() error {
+	if o.closer == nil {
+		return nil
+	}
+	return o.closer.Close()
+}
+
+// csvRecord returns the CSV columns of r, its timestamp rendered by times
+// and in UTC unless times sets a zone.
+func csvRecord(r deviceResult, times timeFormat) []string {
+	stamp := ""
+	if !r.Time.IsZero() {
+		stamp = times.format(r.Time.UTC())
+	}
+	var watts, voltage, amperage, pf, frequency, apparent, reactive string
+	if r.PowerInfo != nil {
+		watts = formatFloat(r.CurrentWatts)
+		voltage = optionalFloat(r.Voltage)
+		amperage = optionalFloat(r.Amperage)
+		pf = optionalFloat(r.PowerFactor)
+		frequency = optionalFloat(r.FrequencyHz)
+		apparent = optionalFloat(r.ApparentVA)
+		reactive = optionalFloat(r.ReactiveVAr)
+	}
+	cost := ""
+	if r.Cost != nil {
+		cost = strconv.FormatFloat(*r.Cost, 'f', 4, 64)
+	}
+	baseline := ""
+	if r.Baseline != nil {
+		baseline = formatFloat(*r.Baseline)
+	}
+	record := []string{stamp, r.Instance, r.HostName, r.Address, watts, voltage, amperage, r.Firmware, r.Error, r.Channel, cost, optionalFloat(r.LatencyMs), pf, frequency, apparent, reactive, baseline, r.Source}
+	for i := range csvPhases {
+		if r.PowerInfo == nil || i >= len(r.Phases) {
+			record = append(record, "", "", "", "")
+			continue
+		}
+		ph := r.Phases[i]
+		record = append(record, formatFloat(ph.Watts), optionalFloat(ph.Voltage), optionalFloat(ph.Amperage), optionalFloat(ph.PowerFactor))
+	}
+	return record
+}
+
+// electricalText describes the power factor, line frequency and apparent
+// and reactive power of a reading in text output, such as
+// "PF 0.94, 50.02 Hz, 13.35 VA, 4.68 var", leaving out what the device did
+// not report.
+func electricalText(p collector.PowerInfo) string {
+	var parts []string
+	if p.PowerFactor != 0 {
+		parts = append(parts, fmt.Sprintf("PF %.2f", p.PowerFactor))
+	}
+	if p.FrequencyHz != 0 {
+		parts = append(parts, fmt.Sprintf("%.2f Hz", p.FrequencyHz))
+	}
+	if p.ApparentVA != 0 {
+		parts = append(parts, fmt.Sprintf("%.2f VA", p.ApparentVA))
+	}
+	if p.ReactiveVAr != 0 {
+		parts = append(parts, fmt.Sprintf("%.2f var", p.ReactiveVAr))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// phasesText describes the phases of a polyphase reading in text output,
+// such as "L1 951.20 W, L2 -951.10 W, L3 715.40 W".
+func phasesText(phases []collector.PhaseInfo) string {
+	parts := make([]string, len(phases))
+	for i, ph := range phases {
+		parts[i] = fmt.Sprintf("%s %.2f W", ph.Name, ph.Watts)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// latencyMs converts a query latency to milliseconds, to the microsecond.
+func latencyMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func optionalFloat(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return formatFloat(v)
+}
+
+// newResult returns the record for d without any reading.
+func newResult(d collector.Device) deviceResult {
+	return deviceResult{
+		Instance:       d.Instance,
+		HostName:       d.HostName,
+		Channel:        d.Channel,
+		Group:          d.Group,
+		Address:        d.Address,
+		Addresses:      d.Addresses,
+		Firmware:       d.Firmware,
+		VendorID:       d.Meta.VendorID,
+		Vendor:         vendorText(d.Meta),
+		ProductID:      d.Meta.ProductID,
+		DeviceType:     d.Meta.DeviceType,
+		Discriminator:  d.Meta.Discriminator,
+		TXT:            d.Meta.Extra,
+		Services:       d.Services,
+		Operational:    d.Operational(),
+		Commissionable: d.Commissionable(),
+		Disabled:       d.Disabled,
+		Source:         d.Source,
+		Time:           time.Now(),
+	}
+}
+
+// queryDevice fetches the device's power reading unless listing only or
+// the device is disabled, and records any failure in the result instead of
+// returning it.
+func queryDevice(ctx context.Context, d collector.Device, opts options) deviceResult {
+	result := newResult(d)
+	if opts.listOnly {
+		opts.expectedFW.check(&result)
+		return result
+	}
+	if d.Disabled {
+		return result
+	}
+
+	if d.Address == "" {
+		d = opts.hosts.resolve(ctx, d)
+		result.Address, result.Addresses = d.Address, d.Addresses
+	}
+	result.URL = opts.fetcher().URL(d)
+	if result.URL == "" {
+		result.Error = "no usable address available"
+		result.reason = "no address"
+		return result
+	}
+
+	power, err := fetchDevice(ctx, opts.fetcher(), d)
+	opts.units.check(d, power)
+	result.Time = time.Now()
+	if err != nil {
+		result.Error = err.Error()
+		result.reason = collector.FailureReason(err)
+		return result
+	}
+	result.PowerInfo = power
+	result.LatencyMs = latencyMs(power.Latency)
+	return result
+}
+
+// readingResult converts a poll reading into its machine-readable record.
+func readingResult(r collector.Reading) deviceResult {
+	result := newResult(r.Device)
+	result.PowerInfo = r.Power
+	if r.Power != nil {
+		result.LatencyMs = latencyMs(r.Power.Latency)
+	}
+	result.Failing = r.Failing
+	result.State = r.State
+	result.LastSeen = r.LastSeen
+	result.LastSuccess = r.LastSuccess
+	result.Time = r.Time
+	if r.Err != nil {
+		result.Error = r.Err.Error()
+	}
+	return result
+}
+
+// writeReading writes a poll reading in the configured output format,
+// with the device's accumulated cost, power statistics and idle baseline
+// when given.
+func writeReading(out *output, r collector.Reading, cost *float64, stats *deviceStats, baseline *float64) {
+	if out.machineReadable() {
+		result := readingResult(r)
+		result.Cost = cost
+		result.Stats = stats
+		result.Baseline = baseline
+		out.result(result)
+		return
+	}
+
+	pal := out.palette
+	stamp := out.times.format(r.Time)
+	label := out.align(deviceLabel(r.Device.Instance, r.Device.Channel))
+	var reading, color string
+	if r.Err != nil {
+		reading, color = fmt.Sprintf("power query failed: %v", r.Err), ansiRed
+		if r.Failing {
+			reading += fmt.Sprintf(" (failing, %d consecutive failures)", r.Failures)
+		}
+	} else {
+		reading, color = fmt.Sprintf("%.2f W", r.Power.CurrentWatts), pal.wattsColor(r.Power.CurrentWatts)
+	}
+	// Offline devices are dimmed as a whole instead.
+	if r.State == collector.Offline {
+		color = ""
+	}
+	line := fmt.Sprintf("%s %s %s", stamp, label, pal.paint(color, reading))
+	if r.Err == nil {
+		if electrical := electricalText(*r.Power); electrical != "" {
+			line += ", " + electrical
+		}
+	}
+	if r.Err == nil && len(r.Power.Phases) > 0 {
+		line += " [" + phasesText(r.Power.Phases) + "]"
+	}
+	if r.Err == nil && r.Power.Suspect {
+		line += fmt.Sprintf(" (suspect: %s)", r.Power.Anomaly)
+	}
+	if r.Device.Source != "" {
+		line += fmt.Sprintf(" (source: %s)", r.Device.Source)
+	}
+	if r.State == collector.Offline {
+		line = pal.paint(ansiDim, line)
+	}
+	out.text([]byte(line + "\n"))
+}
+
+// writeDeviceTable writes the devices of a pass as an aligned table after
+// their blocks, in text output with more than one device, so many devices
+// can be compared at a glance.
+func writeDeviceTable(out *output, results []deviceResult, listOnly bool) {
+	if out.machineReadable() || len(results) < 2 {
+		return
+	}
+	results = slices.Clone(results)
+	slices.SortFunc(results, func(a, b deviceResult) int {
+		return cmp.Or(
+			cmp.Compare(deviceLabel(a.Instance, a.Channel), deviceLabel(b.Instance, b.Channel)),
+			cmp.Compare(a.HostName, b.HostName),
+		)
+	})
+
+	pal := out.palette
+	header := []string{"DEVICE", "ADDRESS", "WATTS", "LATENCY", "FIRMWARE", "ERROR"}
+	if listOnly {
+		header = []string{"DEVICE", "HOST", "ADDRESS", "FIRMWARE", "STATUS"}
+	}
+	rows := make([][]cell, 0, len(results))
+	for _, r := range results {
+		firmware, firmwareColor := pal.deviceFirmware(r)
+		label, address, fw := cell{text: deviceLabel(r.Instance, r.Channel)}, cell{text: orDash(r.Address)}, cell{orDash(firmware), firmwareColor}
+		if listOnly {
+			rows = append(rows, []cell{label, {text: r.HostName}, address, fw, {text: matterStatus(r)}})
+			continue
+		}
+		watts, latency, failure := cell{text: "-"}, "-", cell{}
+		switch {
+		case r.PowerInfo != nil:
+			watts = cell{fmt.Sprintf("%.2f W", r.CurrentWatts), pal.wattsColor(r.CurrentWatts)}
+			latency = strconv.FormatFloat(r.LatencyMs, 'f', 0, 64) + " ms"
+		case r.Error != "":
+			failure = cell{r.Error, ansiRed}
+		}
+		rows = append(rows, []cell{label, address, watts, {text: latency}, fw, failure})
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('\n')
+	pal.writeTable(&buf, header, rows)
+	out.text(buf.Bytes())
+}
+
+// deviceLabel names a device, or one channel of it, in text output.
+func deviceLabel(instance, channel string) string {
+	if channel == "" {
+		return instance
+	}
+	return instance + " channel " + channel
+}
+
+// resultKey identifies the device and channel of r across records.
+func resultKey(r deviceResult) string {
+	key := r.Instance + "|" + r.HostName
+	if r.Channel != "" {
+		key += "|" + r.Channel
+	}
+	return key
+}
+
+// writeJSONResult writes result as a single NDJSON line, with its
+// timestamps rendered by times when set.
+func writeJSONResult(w io.Writer, result deviceResult, times timeFormat) {
+	var v any = result
+	if times.set() {
+		// The fields at the top level take the place of those of
+		// result.
+		var stamp time.Time
+		if result.PowerInfo != nil {
+			stamp = result.Timestamp
+		}
+		v = struct {
+			deviceResult
+			Timestamp   any `json:"timestamp,omitempty"`
+			LastSeen    any `json:"lastSeen,omitempty"`
+			LastSuccess any `json:"lastSuccess,omitempty"`
+		}{result, times.value(stamp), times.value(result.LastSeen), times.value(result.LastSuccess)}
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("json encode error", "error", err)
+	}
+}
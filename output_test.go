@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestWriteJSONResultIncludesPowerFields(t *testing.T) {
+	var buf bytes.Buffer
+	writeJSONResult(&buf, deviceResult{
+		Instance:  "Lamp",
+		HostName:  "lamp.local",
+		Addresses: []string{"10.0.0.7"},
+		PowerInfo: &collector.PowerInfo{DeviceName: "Lamp", CurrentWatts: 12.5},
+	}, timeFormat{})
+
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected a single NDJSON line, got %q", line)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+		t.Fatalf("expected valid JSON, got error: %v", err)
+	}
+	if decoded["instance"] != "Lamp" || decoded["currentWatts"] != 12.5 {
+		t.Fatalf("unexpected JSON object: %v", decoded)
+	}
+	if _, ok := decoded["error"]; ok {
+		t.Fatalf("expected no error field, got %v", decoded)
+	}
+}
+
+func TestQueryDeviceRecordsErrors(t *testing.T) {
+	d := collector.Device{Instance: "NoIP Device", HostName: "noip.local"}
+
+	result := queryDevice(context.Background(), d, options{format: formatJSON})
+	if result.Error == "" || result.PowerInfo != nil {
+		t.Fatalf("expected error result, got %+v", result)
+	}
+}
+
+func TestQueryDeviceListOnlySkipsFetch(t *testing.T) {
+	d := collector.Device{Instance: "Lamp", Address: "10.0.0.7", Firmware: "1.0"}
+
+	result := queryDevice(context.Background(), d, options{listOnly: true, format: formatJSON})
+	if result.Error != "" || result.PowerInfo != nil || result.Firmware != "1.0" {
+		t.Fatalf("expected list-only result without fetch, got %+v", result)
+	}
+}
+
+func TestHandleEntryJSONWritesErrorObject(t *testing.T) {
+	entry := &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local."}
+	output := handleEntryOutput(collector.NewDevice(entry), options{format: formatJSON})
+
+	var decoded deviceResult
+	if err := json.Unmarshal([]byte(output), &decoded); err != nil {
+		t.Fatalf("expected JSON output, got %q (%v)", output, err)
+	}
+	if decoded.Instance != "Lamp" || decoded.Error == "" {
+		t.Fatalf("unexpected result: %+v", decoded)
+	}
+}
+
+func TestWriteReadingText(t *testing.T) {
+	stamp := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	d := collector.Device{Instance: "Lamp"}
+
+	var buf bytes.Buffer
+	out := newOutput(&buf, formatText)
+	writeReading(out, collector.Reading{Device: d, Power: &collector.PowerInfo{CurrentWatts: 12.5}, Time: stamp}, nil, nil, nil)
+	if got := buf.String(); got != "2024-02-02T15:04:05Z Lamp: 12.50 W\n" {
+		t.Fatalf("unexpected reading line %q", got)
+	}
+
+	buf.Reset()
+	writeReading(out, collector.Reading{Device: d, Power: &collector.PowerInfo{CurrentWatts: 12.5, PowerFactor: 0.94, FrequencyHz: 50}, Time: stamp}, nil, nil, nil)
+	if got := buf.String(); got != "2024-02-02T15:04:05Z Lamp: 12.50 W, PF 0.94, 50.00 Hz\n" {
+		t.Fatalf("unexpected electrical reading line %q", got)
+	}
+
+	buf.Reset()
+	writeReading(out, collector.Reading{Device: d, Err: errors.New("timeout"), Time: stamp, Failures: 3, Failing: true}, nil, nil, nil)
+	if got := buf.String(); !strings.Contains(got, "power query failed: timeout") || !strings.Contains(got, "failing, 3 consecutive failures") {
+		t.Fatalf("unexpected failure line %q", got)
+	}
+}
+
+func TestWriteReadingTextAlignsAndColors(t *testing.T) {
+	stamp := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	out := newOutput(&buf, formatText)
+	out.palette = palette{enabled: true, warnWatts: 1000, highWatts: 2000}
+	writeReading(out, collector.Reading{Device: collector.Device{Instance: "Kitchen kettle"}, Power: &collector.PowerInfo{CurrentWatts: 2200}, Time: stamp}, nil, nil, nil)
+	writeReading(out, collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: 12.5}, Time: stamp}, nil, nil, nil)
+	writeReading(out, collector.Reading{Device: collector.Device{Instance: "Plug"}, Err: errors.New("timeout"), Time: stamp}, nil, nil, nil)
+	writeReading(out, collector.Reading{Device: collector.Device{Instance: "Fan"}, Err: errors.New("timeout"), Time: stamp, State: collector.Offline}, nil, nil, nil)
+
+	want := "2024-02-02T15:04:05Z Kitchen kettle: \x1b[31m2200.00 W\x1b[0m\n" +
+		"2024-02-02T15:04:05Z Lamp:           12.50 W\n" +
+		"2024-02-02T15:04:05Z Plug:           \x1b[31mpower query failed: timeout\x1b[0m\n" +
+		"\x1b[2m2024-02-02T15:04:05Z Fan:            power query failed: timeout\x1b[0m\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected lines:\n%q\nwant:\n%q", buf.String(), want)
+	}
+}
+
+func TestMachineReadableOutputHasNoEscapeCodes(t *testing.T) {
+	r := collector.Reading{Device: collector.Device{Instance: "Kettle", Firmware: "0.1"}, Power: &collector.PowerInfo{CurrentWatts: 2200}, Time: time.Now(), State: collector.Offline}
+	for _, format := range []string{formatJSON, formatCSV, formatInflux} {
+		var buf bytes.Buffer
+		out := newOutput(&buf, format)
+		out.palette = palette{enabled: true, warnWatts: 1000, highWatts: 2000, minFirmware: "1.0"}
+		writeReading(out, r, nil, nil, nil)
+		writeDeviceTable(out, []deviceResult{readingResult(r), readingResult(r)}, false)
+		if buf.Len() == 0 || strings.Contains(buf.String(), "\x1b") {
+			t.Fatalf("%s: expected records without escape codes, got %q", format, buf.String())
+		}
+	}
+}
+
+func TestWriteDeviceTable(t *testing.T) {
+	var buf bytes.Buffer
+	out := newOutput(&buf, formatText)
+	out.palette = palette{minFirmware: "1.2"}
+	results := []deviceResult{
+		{Instance: "Plug", Address: "10.0.0.8", Firmware: "1.2", Error: "timeout"},
+		{Instance: "Lamp", Address: "10.0.0.7", Firmware: "1.0", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}, LatencyMs: 41.6},
+	}
+	writeDeviceTable(out, results[:1], false)
+	if buf.Len() != 0 {
+		t.Fatalf("expected no table for a single device, got %q", buf.String())
+	}
+	writeDeviceTable(out, results, false)
+	want := "\n" +
+		"DEVICE  ADDRESS   WATTS    LATENCY  FIRMWARE        ERROR\n" +
+		"Lamp    10.0.0.7  12.50 W  42 ms    1.0 (outdated)  \n" +
+		"Plug    10.0.0.8  -        -        1.2             timeout\n"
+	if buf.String() != want {
+		t.Fatalf("unexpected table:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteReadingJSONFlagsFailing(t *testing.T) {
+	var buf bytes.Buffer
+	r := collector.Reading{Device: collector.Device{Instance: "Lamp"}, Err: errors.New("timeout"), Failing: true}
+	writeReading(newOutput(&buf, formatJSON), r, nil, nil, nil)
+
+	var decoded deviceResult
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("expected JSON output, got error: %v", err)
+	}
+	if !decoded.Failing || decoded.Error != "timeout" {
+		t.Fatalf("unexpected result: %+v", decoded)
+	}
+}
+
+func TestCSVOutputWritesHeaderOnce(t *testing.T) {
+	stamp := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	out := newOutput(&buf, formatCSV)
+
+	lamp := collector.Device{Instance: "Lamp, \"Desk\"", HostName: "lamp.local", Address: "10.0.0.7", Firmware: "1.0"}
+	writeReading(out, collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230.1}, Time: stamp}, nil, nil, nil)
+	writeReading(out, collector.Reading{Device: lamp, Err: errors.New("timeout"), Time: stamp}, nil, nil, nil)
+	lamp.Channel = "1"
+	cost, baseline := 0.125, 2.5
+	writeReading(out, collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 3, Latency: 12345 * time.Microsecond}, Time: stamp}, &cost, nil, &baseline)
+
+	noPhases := strings.Repeat(",", 6+4*csvPhases)
+	want := "timestamp,instance,host,address,watts,voltage,amperage,firmware,error,channel,cost,latencyMs,powerFactor,frequencyHz,apparentVA,reactiveVAr,baselineWatts,source," + strings.Join(phaseColumns(), ",") + "\n" +
+		"2024-02-02T15:04:05Z,\"Lamp, \"\"Desk\"\"\",lamp.local,10.0.0.7,12.5,230.1,,1.0,,,," + noPhases + "\n" +
+		"2024-02-02T15:04:05Z,\"Lamp, \"\"Desk\"\"\",lamp.local,10.0.0.7,,,,1.0,timeout,,," + noPhases + "\n" +
+		"2024-02-02T15:04:05Z,\"Lamp, \"\"Desk\"\"\",lamp.local,10.0.0.7,3,,,1.0,,1,0.1250,12.345,,,,,2.5," + strings.Repeat(",", 4*csvPhases) + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected CSV:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestOutputRendersPhases(t *testing.T) {
+	stamp := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	r := collector.Reading{Device: collector.Device{Instance: "Mains"}, Time: stamp, Power: &collector.PowerInfo{CurrentWatts: 300, Phases: []collector.PhaseInfo{
+		{Name: "L1", Watts: 100, Voltage: 230, Amperage: 0.5, PowerFactor: 0.9},
+		{Name: "L2", Watts: 200},
+	}}}
+
+	var buf bytes.Buffer
+	writeReading(newOutput(&buf, formatCSV), r, nil, nil, nil)
+	if rows := strings.Split(buf.String(), "\n"); !strings.HasSuffix(rows[1], ",300,,,,,,,,,,,,,,100,230,0.5,0.9,200,,,,,,,") {
+		t.Fatalf("expected the phase columns, got %q", rows[1])
+	}
+
+	buf.Reset()
+	writeReading(newOutput(&buf, formatJSON), r, nil, nil, nil)
+	if !strings.Contains(buf.String(), `"phases":[{"name":"L1","watts":100,"voltage":230,"amperage":0.5,"powerFactor":0.9},{"name":"L2","watts":200}]`) {
+		t.Fatalf("expected nested phases, got %s", buf.String())
+	}
+
+	buf.Reset()
+	writeReading(newOutput(&buf, formatText), r, nil, nil, nil)
+	if !strings.Contains(buf.String(), "300.00 W [L1 100.00 W, L2 200.00 W]") {
+		t.Fatalf("expected the phases after the total, got %q", buf.String())
+	}
+}
+
+func TestOpenOutputAppendsWithoutRepeatingHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.csv")
+	r := collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: 1}, Time: time.Now()}
+
+	for i := 0; i < 2; i++ {
+		out, err := openOutput(path, formatCSV, io.Discard)
+		if err != nil {
+			t.Fatalf("expected output to open, got %v", err)
+		}
+		writeReading(out, r, nil, nil, nil)
+		out.Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || strings.Count(string(data), "timestamp,instance") != 1 {
+		t.Fatalf("expected one header and two rows, got:\n%s", data)
+	}
+}
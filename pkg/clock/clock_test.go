@@ -0,0 +1,20 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRealClock(t *testing.T) {
+	c := Or(nil)
+	if c != Real {
+		t.Fatal("expected nil to mean the real clock")
+	}
+	ticker := c.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	before := c.Now()
+	<-ticker.C()
+	if got := <-c.After(time.Millisecond); got.Before(before) {
+		t.Fatalf("expected time to move on, got %v before %v", got, before)
+	}
+}
@@ -0,0 +1,151 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// addressCache remembers the address each device last answered on, when
+// that is not the one it was first queried on.
+type addressCache struct {
+	mu    sync.Mutex
+	addrs map[string]string
+}
+
+// LearnAddresses restores addresses learned by an earlier session, keyed
+// by EndpointKey. An address is only used while the device still lists
+// it among its Addresses.
+func (f *Fetcher) LearnAddresses(addrs map[string]string) {
+	f.addresses.mu.Lock()
+	defer f.addresses.mu.Unlock()
+	for key, addr := range addrs {
+		f.addresses.set(key, addr)
+	}
+}
+
+// Addresses returns the addresses learned by falling back from a device's
+// first address, keyed by EndpointKey.
+func (f *Fetcher) Addresses() map[string]string {
+	f.addresses.mu.Lock()
+	defer f.addresses.mu.Unlock()
+	addrs := make(map[string]string, len(f.addresses.addrs))
+	for key, addr := range f.addresses.addrs {
+		addrs[key] = addr
+	}
+	return addrs
+}
+
+func (c *addressCache) set(key, addr string) {
+	if c.addrs == nil {
+		c.addrs = make(map[string]string)
+	}
+	c.addrs[key] = addr
+}
+
+// learnedAddress returns d with the address it last answered on, when
+// that is still one of its addresses.
+func (f *Fetcher) learnedAddress(d Device) Device {
+	f.addresses.mu.Lock()
+	addr, ok := f.addresses.addrs[EndpointKey(d)]
+	f.addresses.mu.Unlock()
+	if ok && !sameAddress(addr, d.Address) && hasAddress(d, addr) {
+		d.Address = addr
+	}
+	return d
+}
+
+// fetchFallback fetches d on its address and, when that does not reach
+// the device, on each of its other addresses in turn. The address that
+// answers is used for d's later queries.
+func (f *Fetcher) fetchFallback(ctx context.Context, d Device) (*PowerInfo, error) {
+	d = f.learnedAddress(d)
+	info, err := f.fetchDevice(ctx, d)
+	if err == nil || answered(err) {
+		return info, err
+	}
+	for _, addr := range fallbackAddresses(d) {
+		if ctx.Err() != nil {
+			break
+		}
+		next := d
+		next.Address = addr
+		if info, nextErr := f.fetchDevice(ctx, next); nextErr == nil || answered(nextErr) {
+			f.addresses.mu.Lock()
+			f.addresses.set(EndpointKey(d), addr)
+			f.addresses.mu.Unlock()
+			if f.AddressSwitched != nil {
+				f.AddressSwitched(d, d.Address, addr)
+			}
+			return info, nextErr
+		}
+	}
+	return nil, err
+}
+
+// fallbackAddresses returns d's addresses other than the one it is queried
+// on, leaving out link-local IPv6 addresses without an interface zone,
+// which cannot be reached.
+func fallbackAddresses(d Device) []string {
+	var addrs []string
+	for _, addr := range d.Addresses {
+		if sameAddress(addr, d.Address) {
+			continue
+		}
+		if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() && ip.IsLinkLocalUnicast() && ip.Zone() == "" {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// hasAddress reports whether addr is one of d's addresses.
+func hasAddress(d Device, addr string) bool {
+	if sameAddress(addr, d.Address) {
+		return true
+	}
+	for _, a := range d.Addresses {
+		if sameAddress(addr, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddress reports whether a and b are the same address, ignoring any
+// IPv6 zone one of them lacks.
+func sameAddress(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ipA, errA := netip.ParseAddr(a)
+	ipB, errB := netip.ParseAddr(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	if ipA.Zone() == "" || ipB.Zone() == "" {
+		return ipA.WithZone("") == ipB.WithZone("")
+	}
+	return ipA == ipB
+}
+
+// byHostName returns d to be queried on its host name, and whether
+// ConnectByHostName applies to it.
+func (f *Fetcher) byHostName(d Device) (Device, bool) {
+	if !f.ConnectByHostName || d.HostName == "" {
+		return d, false
+	}
+	d.Address = strings.TrimSuffix(d.HostName, ".")
+	return d, true
+}
+
+// isResolutionError reports whether err is the failure to look up a host
+// name.
+func isResolutionError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
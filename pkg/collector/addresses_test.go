@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestFetcherFallsBackToAnotherAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":12}`)
+	}))
+	defer server.Close()
+	d, port := serverDevice(server)
+	// Nothing listens on 127.0.0.2, so its connections are refused.
+	d.Address, d.Addresses = "127.0.0.2", []string{"127.0.0.2", d.Address}
+
+	var switches []string
+	f := &Fetcher{Port: port, AddressSwitched: func(d Device, from, to string) {
+		switches = append(switches, from+">"+to)
+	}}
+	for range 2 {
+		info, err := f.Fetch(context.Background(), d)
+		if err != nil || info.CurrentWatts != 12 {
+			t.Fatalf("expected a reading through the second address, got %+v, %v", info, err)
+		}
+	}
+	if !slices.Equal(switches, []string{"127.0.0.2>127.0.0.1"}) {
+		t.Fatalf("expected one switch, remembered for the next poll, got %v", switches)
+	}
+
+	learned := &Fetcher{Port: port, AddressSwitched: func(Device, string, string) { t.Fatal("expected the learned address used first") }}
+	learned.LearnAddresses(f.Addresses())
+	if _, err := learned.Fetch(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Addresses = []string{"127.0.0.2"}
+	if _, err := learned.Fetch(context.Background(), d); err == nil {
+		t.Fatal("expected a learned address the device no longer lists to be ignored")
+	}
+}
+
+func TestFallbackAddresses(t *testing.T) {
+	d := Device{
+		Address:   "fe80::1%eth0",
+		Addresses: []string{"192.168.1.20", "fe80::1", "fe80::2", "2001:db8::20"},
+	}
+	if got := fallbackAddresses(d); !slices.Equal(got, []string{"192.168.1.20", "2001:db8::20"}) {
+		t.Fatalf("expected the queried and zoneless link-local addresses left out, got %v", got)
+	}
+	if !hasAddress(d, "fe80::1") || hasAddress(d, "10.0.0.1") {
+		t.Fatal("expected addresses matched regardless of zone")
+	}
+}
+
+func TestFetcherConnectsByHostName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":4}`)
+	}))
+	defer server.Close()
+	d, port := serverDevice(server)
+
+	var failed []string
+	f := &Fetcher{Port: port, ConnectByHostName: true, HostNameFailed: func(d Device, err error) {
+		failed = append(failed, d.HostName)
+	}}
+	byName := d
+	byName.HostName, byName.Address = "localhost", "192.0.2.1"
+	if got := f.URL(byName); got != "http://localhost:"+strconv.Itoa(port)+"/api/power" {
+		t.Fatalf("expected the URL built from the host name, got %q", got)
+	}
+	if _, err := f.Fetch(context.Background(), byName); err != nil {
+		t.Fatalf("expected the device reached by host name, got %v", err)
+	}
+
+	// An empty label fails the lookup without asking a DNS server.
+	d.HostName = "plug..local"
+	if _, err := f.Fetch(context.Background(), d); err != nil {
+		t.Fatalf("expected a fall back to the address, got %v", err)
+	}
+	if !slices.Equal(failed, []string{"plug..local"}) {
+		t.Fatalf("expected the fallback reported once, got %v", failed)
+	}
+	d.Address = ""
+	if _, err := f.Fetch(context.Background(), d); err == nil {
+		t.Fatal("expected the lookup failure without an address to fall back to")
+	}
+
+	template, err := ParseURLTemplate("https://{addr}:{port}/status?name={host}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Template = template
+	if got := f.URL(byName); got != "https://localhost:"+strconv.Itoa(port)+"/status?name=localhost" {
+		t.Fatalf("expected {addr} to expand to the host name, got %q", got)
+	}
+	f.ConnectByHostName = false
+	if got := f.URL(byName); got != "https://192.0.2.1:"+strconv.Itoa(port)+"/status?name=localhost" {
+		t.Fatalf("expected {addr} to expand to the address, got %q", got)
+	}
+}
@@ -0,0 +1,277 @@
+package collector
+
+import (
+	"crypto/md5" // #nosec G501 -- MD5 is part of the digest auth scheme devices offer
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Credentials authenticate power queries. A token is sent as a bearer
+// token; a username and password answer basic or digest (RFC 7616)
+// challenges, whichever the device asks for.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// IsZero reports whether no credentials are set.
+func (c Credentials) IsZero() bool {
+	return c == Credentials{}
+}
+
+// String describes c without revealing the secrets, so credentials never
+// end up in logs by accident.
+func (c Credentials) String() string {
+	switch {
+	case c.Token != "":
+		return "bearer [redacted]"
+	case c.Username != "":
+		return c.Username + ":[redacted]"
+	}
+	return ""
+}
+
+// GoString is String, covering %#v.
+func (c Credentials) GoString() string { return c.String() }
+
+// credentials returns the credentials used to query d: its own when set,
+// otherwise the Fetcher's.
+func (f *Fetcher) credentials(d Device) Credentials {
+	if !d.Auth.IsZero() {
+		return d.Auth
+	}
+	return f.Auth
+}
+
+// authCache remembers the scheme each host asked for, so later queries can
+// authenticate without first being challenged.
+type authCache struct {
+	mu    sync.Mutex
+	hosts map[string]*challenge
+}
+
+// challenge is a parsed WWW-Authenticate header. nc counts the requests
+// made with a digest nonce.
+type challenge struct {
+	scheme string
+	params map[string]string
+	nc     int
+}
+
+func (a *authCache) get(host string) *challenge {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.hosts[host]
+}
+
+func (a *authCache) set(host string, c *challenge) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.hosts == nil {
+		a.hosts = make(map[string]*challenge)
+	}
+	a.hosts[host] = c
+}
+
+// authorize sets the Authorization header of req for creds, answering
+// the host's last challenge when one is known.
+func (f *Fetcher) authorize(req *http.Request, creds Credentials) error {
+	if creds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+creds.Token)
+		return nil
+	}
+	if creds.Username == "" {
+		return nil
+	}
+	c := f.auth.get(req.URL.Host)
+	if c == nil {
+		return nil
+	}
+	switch c.scheme {
+	case "basic":
+		req.SetBasicAuth(creds.Username, creds.Password)
+	case "digest":
+		f.auth.mu.Lock()
+		c.nc++
+		nc := c.nc
+		f.auth.mu.Unlock()
+		header, err := digestAuthorization(c.params, creds, req.Method, req.URL.RequestURI(), nc)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", header)
+	}
+	return nil
+}
+
+// learnChallenge records the challenge of a 401 response that creds can
+// answer, reporting whether the request is worth retrying.
+func (f *Fetcher) learnChallenge(resp *http.Response, creds Credentials) bool {
+	if creds.Username == "" || creds.Token != "" {
+		return false
+	}
+	var best *challenge
+	for _, h := range resp.Header.Values("WWW-Authenticate") {
+		c := parseChallenge(h)
+		if c == nil {
+			continue
+		}
+		if c.scheme == "digest" {
+			if _, ok := digestHash(c.params["algorithm"]); !ok {
+				continue
+			}
+		}
+		if best == nil || challengeRank(c) > challengeRank(best) {
+			best = c
+		}
+	}
+	if best == nil {
+		return false
+	}
+	f.auth.set(resp.Request.URL.Host, best)
+	return true
+}
+
+// challengeRank prefers digest over basic, and SHA-256 over MD5.
+func challengeRank(c *challenge) int {
+	switch {
+	case c.scheme == "basic":
+		return 0
+	case strings.HasPrefix(strings.ToUpper(c.params["algorithm"]), "SHA-256"):
+		return 2
+	}
+	return 1
+}
+
+// parseChallenge parses a WWW-Authenticate header value holding one basic
+// or digest challenge, returning nil for other schemes.
+func parseChallenge(h string) *challenge {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	scheme = strings.ToLower(scheme)
+	if scheme != "basic" && scheme != "digest" {
+		return nil
+	}
+	c := &challenge{scheme: scheme, params: make(map[string]string)}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		var key, value string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, `"`) {
+			value, rest = unquote(rest[1:])
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		if key != "" {
+			c.params[key] = value
+		}
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return c
+}
+
+// unquote reads a quoted-string whose opening quote has been consumed,
+// returning its value and the remaining input.
+func unquote(s string) (string, string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), ""
+}
+
+// digestHash returns the hash for a digest algorithm, MD5 when none is
+// named, and whether the algorithm is supported.
+func digestHash(algorithm string) (func() hash.Hash, bool) {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New, true
+	case "SHA-256":
+		return sha256.New, true
+	}
+	return nil, false
+}
+
+// digestAuthorization computes the Authorization header answering a
+// digest challenge for the nc-th request with its nonce.
+func digestAuthorization(params map[string]string, creds Credentials, method, uri string, nc int) (string, error) {
+	cnonce := make([]byte, 16)
+	if _, err := rand.Read(cnonce); err != nil {
+		return "", err
+	}
+	return digestHeader(params, creds, method, uri, nc, hex.EncodeToString(cnonce))
+}
+
+// digestHeader computes a digest Authorization header with the given
+// client nonce.
+func digestHeader(params map[string]string, creds Credentials, method, uri string, nc int, cnonce string) (string, error) {
+	algorithm := params["algorithm"]
+	newHash, ok := digestHash(algorithm)
+	if !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+
+	ha1 := h(creds.Username, realm, creds.Password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	ha2 := h(method, uri)
+
+	qop := ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	ncValue := fmt.Sprintf("%08x", nc)
+
+	var response string
+	if qop != "" {
+		response = h(ha1, nonce, ncValue, cnonce, qop, ha2)
+	} else {
+		response = h(ha1, nonce, ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf("username=%q", creds.Username),
+		fmt.Sprintf("realm=%q", realm),
+		fmt.Sprintf("nonce=%q", nonce),
+		fmt.Sprintf("uri=%q", uri),
+	}
+	if algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	fields = append(fields, fmt.Sprintf("response=%q", response))
+	if qop != "" {
+		fields = append(fields, "qop="+qop, "nc="+ncValue, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf("opaque=%q", opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDigestHeaderMatchesRFC7616Example(t *testing.T) {
+	params := map[string]string{
+		"realm":  "http-auth@example.org",
+		"qop":    "auth, auth-int",
+		"nonce":  "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		"opaque": "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+	}
+	creds := Credentials{Username: "Mufasa", Password: "Circle of Life"}
+	cnonce := "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+
+	tests := []struct {
+		algorithm, response string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		params["algorithm"] = tt.algorithm
+		header, err := digestHeader(params, creds, http.MethodGet, "/dir/index.html", 1, cnonce)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.algorithm, err)
+		}
+		if !strings.Contains(header, `response="`+tt.response+`"`) {
+			t.Fatalf("%s: unexpected header %s", tt.algorithm, header)
+		}
+		if !strings.Contains(header, "nc=00000001") || !strings.Contains(header, `opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`) {
+			t.Fatalf("%s: missing fields in %s", tt.algorithm, header)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	c := parseChallenge(`Digest qop="auth", realm="shellyplus1pm-a8032ab12345", nonce="60dc59c6", algorithm=SHA-256`)
+	if c == nil || c.scheme != "digest" {
+		t.Fatalf("expected a digest challenge, got %+v", c)
+	}
+	if c.params["realm"] != "shellyplus1pm-a8032ab12345" || c.params["nonce"] != "60dc59c6" || c.params["algorithm"] != "SHA-256" || c.params["qop"] != "auth" {
+		t.Fatalf("unexpected params %v", c.params)
+	}
+	if c := parseChallenge(`Basic realm="a \"quoted\" realm"`); c == nil || c.params["realm"] != `a "quoted" realm` {
+		t.Fatalf("unexpected basic challenge %+v", c)
+	}
+	if c := parseChallenge(`Negotiate`); c != nil {
+		t.Fatalf("expected other schemes to be ignored, got %+v", c)
+	}
+}
+
+// digestServer requires SHA-256 digest auth for admin/secret, as Shelly
+// Gen2 devices do, and counts the challenges it sends.
+func digestServer(challenges *atomic.Int32) *httptest.Server {
+	const realm, nonce = "shellyplus1pm", "60dc59c6"
+	h := func(parts ...string) string {
+		sum := sha256.Sum256([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum[:])
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			c := parseChallenge(auth)
+			p := c.params
+			want := h(h("admin", realm, "secret"), nonce, p["nc"], p["cnonce"], p["qop"], h(r.Method, r.URL.RequestURI()))
+			if p["username"] == "admin" && p["uri"] == r.URL.RequestURI() && p["response"] == want {
+				io.WriteString(w, `{"currentWatts":4.5}`)
+				return
+			}
+		}
+		challenges.Add(1)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest qop="auth", realm=%q, nonce=%q, algorithm=SHA-256`, realm, nonce))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+}
+
+func TestFetcherAnswersDigestChallenge(t *testing.T) {
+	var challenges atomic.Int32
+	server := digestServer(&challenges)
+	defer server.Close()
+
+	f := &Fetcher{Auth: Credentials{Username: "admin", Password: "secret"}}
+	for i := 0; i < 2; i++ {
+		info, err := f.fetch(context.Background(), server.URL+"/api/power")
+		if err != nil {
+			t.Fatalf("expected digest auth to succeed, got %v", err)
+		}
+		if info.CurrentWatts != 4.5 {
+			t.Fatalf("unexpected reading %+v", info)
+		}
+	}
+	if got := challenges.Load(); got != 1 {
+		t.Fatalf("expected the challenge to be reused, got %d challenges", got)
+	}
+
+	f = &Fetcher{Auth: Credentials{Username: "admin", Password: "wrong"}}
+	if _, err := f.fetch(context.Background(), server.URL+"/api/power"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected a 401 with the wrong password, got %v", err)
+	}
+}
+
+func TestFetcherBasicAndBearerAuth(t *testing.T) {
+	var challenges atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && user == "admin" && pass == "secret" {
+			io.WriteString(w, `{"currentWatts":1}`)
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer t0ken" {
+			io.WriteString(w, `{"currentWatts":2}`)
+			return
+		}
+		challenges.Add(1)
+		w.Header().Set("WWW-Authenticate", `Basic realm="plug"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	f := &Fetcher{Auth: Credentials{Username: "admin", Password: "secret"}}
+	for i := 0; i < 2; i++ {
+		if info, err := f.fetch(context.Background(), server.URL); err != nil || info.CurrentWatts != 1 {
+			t.Fatalf("expected basic auth to succeed, got %+v, %v", info, err)
+		}
+	}
+	if got := challenges.Load(); got != 1 {
+		t.Fatalf("expected basic auth to be sent up front after the first challenge, got %d challenges", got)
+	}
+
+	f = &Fetcher{Auth: Credentials{Token: "t0ken"}}
+	if info, err := f.fetch(context.Background(), server.URL); err != nil || info.CurrentWatts != 2 {
+		t.Fatalf("expected bearer auth to succeed, got %+v, %v", info, err)
+	}
+}
+
+func TestFetcherUsesDeviceCredentials(t *testing.T) {
+	var challenges atomic.Int32
+	server := digestServer(&challenges)
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	f := &Fetcher{Port: addr.Port, Auth: Credentials{Username: "admin", Password: "wrong"}}
+	d := Device{Instance: "Plug", Address: addr.IP.String(), Auth: Credentials{Username: "admin", Password: "secret"}}
+	if _, err := f.Fetch(context.Background(), d); err != nil {
+		t.Fatalf("expected the device's credentials to win, got %v", err)
+	}
+}
+
+func TestCredentialsFormattingRedactsSecrets(t *testing.T) {
+	d := Device{Instance: "Plug", Auth: Credentials{Username: "admin", Password: "hunter2"}}
+	for _, s := range []string{fmt.Sprint(d), fmt.Sprintf("%+v", d), fmt.Sprintf("%#v", d), fmt.Sprint(Credentials{Token: "t0ken"})} {
+		if strings.Contains(s, "hunter2") || strings.Contains(s, "t0ken") {
+			t.Fatalf("expected secrets to be redacted, got %s", s)
+		}
+	}
+}
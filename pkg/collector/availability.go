@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// DefaultOfflineThreshold is the number of consecutive failed polls after
+// which a device is considered offline.
+const DefaultOfflineThreshold = 10
+
+// Availability is a polled device's state, derived from its consecutive
+// failures.
+type Availability string
+
+const (
+	// Online devices answered their latest poll, or have failed fewer
+	// times than the poller's FailureThreshold.
+	Online Availability = "online"
+	// Degraded devices have failed FailureThreshold polls in a row.
+	Degraded Availability = "degraded"
+	// Offline devices have failed OfflineThreshold polls in a row and are
+	// polled only every OfflineInterval.
+	Offline Availability = "offline"
+)
+
+// Reasons returned by FailureReason.
+const (
+	ReasonTimeout     = "timeout"
+	ReasonBodyTimeout = "body read timeout"
+	ReasonUnreachable = "unreachable"
+	ReasonHTTPError   = "http error"
+	ReasonDecodeError = "decode error"
+	ReasonImplausible = "implausible reading"
+)
+
+// FailureReason classifies a failed query: the device could not be
+// connected to or did not send its response headers in time, sent its
+// headers but not its body in time, could not be reached, answered with
+// an HTTP error, or answered with a document that could not be decoded or
+// held an implausible reading.
+func FailureReason(err error) string {
+	var se *statusError
+	var de *decodeError
+	var ie *implausibleError
+	var be *bodyTimeoutError
+	var ne net.Error
+	switch {
+	case errors.As(err, &se):
+		return ReasonHTTPError
+	case errors.As(err, &de):
+		return ReasonDecodeError
+	case errors.As(err, &ie):
+		return ReasonImplausible
+	case errors.As(err, &be):
+		return ReasonBodyTimeout
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return ReasonTimeout
+	}
+	return ReasonUnreachable
+}
+
+// answered reports whether a query failing with err still reached the
+// device, which then counts as seen.
+func answered(err error) bool {
+	if err == nil {
+		return true
+	}
+	reason := FailureReason(err)
+	return reason == ReasonHTTPError || reason == ReasonDecodeError || reason == ReasonImplausible || reason == ReasonBodyTimeout
+}
+
+// availability returns the state of a device after failures consecutive
+// failed polls.
+func (p *Poller) availability(failures int) Availability {
+	switch {
+	case p.OfflineThreshold > 0 && failures >= p.OfflineThreshold:
+		return Offline
+	case p.FailureThreshold > 0 && failures >= p.FailureThreshold:
+		return Degraded
+	}
+	return Online
+}
@@ -0,0 +1,105 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailureReason(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/garbage":
+			w.Write([]byte("not json"))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedURL := "http://" + closed.Addr().String() + "/"
+	closed.Close()
+
+	f := &Fetcher{Timeout: 50 * time.Millisecond}
+	for url, want := range map[string]string{
+		server.URL + "/missing": ReasonHTTPError,
+		server.URL + "/garbage": ReasonDecodeError,
+		server.URL + "/slow":    ReasonTimeout,
+		closedURL:               ReasonUnreachable,
+	} {
+		_, err := f.fetch(context.Background(), url)
+		if got := FailureReason(err); got != want {
+			t.Errorf("%s: expected %q, got %q (%v)", url, want, got, err)
+		}
+	}
+	if got := FailureReason(attemptsError(request{retries: 1}, 2, &decodeError{errors.New("bad")})); got != ReasonDecodeError {
+		t.Errorf("expected the reason to survive wrapping, got %q", got)
+	}
+}
+
+func TestPollerTracksAvailability(t *testing.T) {
+	p := NewPoller(time.Second)
+	p.FailureThreshold = 2
+	p.OfflineThreshold = 3
+	p.OfflineInterval = time.Hour
+	var err error
+	fetches := 0
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		fetches++
+		if err != nil {
+			return nil, err
+		}
+		return &PowerInfo{CurrentWatts: 5}, nil
+	}
+	var changes []string
+	p.OnStateChange = func(d Device, from, to Availability, reason string) {
+		changes = append(changes, string(from)+">"+string(to)+":"+reason)
+	}
+	p.Add(Device{Instance: "Lamp"})
+
+	var last Reading
+	poll := func() { p.Poll(context.Background(), func(r Reading) { last = r }) }
+
+	poll()
+	if last.State != Online || last.LastSeen.IsZero() || !last.LastSuccess.Equal(last.Time) {
+		t.Fatalf("expected an online device, got %+v", last)
+	}
+	success := last.LastSuccess
+
+	err = &statusError{status: "500 Internal Server Error", code: 500}
+	poll()
+	poll()
+	if last.State != Degraded || !last.LastSeen.Equal(last.Time) || !last.LastSuccess.Equal(success) {
+		t.Fatalf("expected a degraded device that still answers, got %+v", last)
+	}
+	seen := last.LastSeen
+
+	err = context.DeadlineExceeded
+	poll()
+	if last.State != Offline || !last.LastSeen.Equal(seen) {
+		t.Fatalf("expected an offline device last seen when it answered, got %+v", last)
+	}
+	poll()
+	if fetches != 4 {
+		t.Fatalf("expected the offline device to wait for the offline interval, got %d fetches", fetches)
+	}
+
+	p.OfflineInterval = 0
+	err = nil
+	poll()
+	want := []string{"online>degraded:http error", "degraded>offline:timeout", "offline>online:"}
+	if last.State != Online || len(changes) != len(want) {
+		t.Fatalf("expected transitions %q, got %q", want, changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("expected transitions %q, got %q", want, changes)
+		}
+	}
+}
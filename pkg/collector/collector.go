@@ -0,0 +1,596 @@
+// Package collector discovers Matter devices over mDNS and queries their
+// HTTP power endpoints.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+)
+
+const (
+	// OperationalService is the service type commissioned Matter nodes
+	// advertise.
+	OperationalService = "_matter._tcp"
+	// CommissionableService is the service type of Matter nodes that can
+	// be commissioned, and CommissionerService that of commissioners.
+	CommissionableService = "_matterc._udp"
+	CommissionerService   = "_matterd._udp"
+	// DefaultService is the mDNS service type browsed when none is given.
+	DefaultService = OperationalService
+	// DefaultDomain is the mDNS domain browsed when none is given.
+	DefaultDomain = "local."
+)
+
+// PowerInfo models a simple JSON response for current power usage.
+// Adjust fields to match your devices' API shape.
+type PowerInfo struct {
+	DeviceName   string  `json:"deviceName"`
+	CurrentWatts float64 `json:"currentWatts"`
+	Voltage      float64 `json:"voltage,omitempty"`
+	Amperage     float64 `json:"amperage,omitempty"`
+	// PowerFactor and FrequencyHz are set by meters that measure them.
+	PowerFactor float64 `json:"powerFactor,omitempty"`
+	FrequencyHz float64 `json:"frequencyHz,omitempty"`
+	// ApparentVA and ReactiveVAr are the apparent and reactive power, as
+	// the device reports them or else derived by a Fetcher from the other
+	// fields.
+	ApparentVA  float64 `json:"apparentVA,omitempty"`
+	ReactiveVAr float64 `json:"reactiveVAr,omitempty"`
+	// Phases holds each phase of a polyphase meter, whose total power
+	// CurrentWatts remains.
+	Phases []PhaseInfo `json:"phases,omitempty"`
+	// Timestamp is when the reading was taken, in UTC. A Fetcher sets it
+	// from the device's timestamp, or to the fetch time when the device
+	// gave none.
+	Timestamp time.Time `json:"timestamp,omitzero"`
+	// TimestampSource is TimestampSourceCollector when Timestamp is the
+	// fetch time rather than the device's own.
+	TimestampSource string `json:"timestampSource,omitempty"`
+	// RawTimestamp is the timestamp as the device reported it, set by
+	// drivers for the Fetcher to parse.
+	RawTimestamp string `json:"-"`
+	// Latency is how long a Fetcher took to get the reading, retries
+	// included.
+	Latency time.Duration `json:"-"`
+	// RawPower is the power as the device reported it in RawUnit, when a
+	// Fetcher converted it to watts; see Device.Unit.
+	RawPower float64 `json:"-"`
+	RawUnit  string  `json:"-"`
+	// Suspect marks a reading a Validator found implausible but passed
+	// through; Anomaly says what was wrong with it, including for
+	// readings that were clamped.
+	Suspect bool   `json:"suspect,omitempty"`
+	Anomaly string `json:"anomaly,omitempty"`
+}
+
+// PhaseInfo is the reading of one phase of a polyphase meter.
+type PhaseInfo struct {
+	// Name is the phase's name, L1, L2 and so on unless the device names
+	// it.
+	Name        string  `json:"name"`
+	Watts       float64 `json:"watts"`
+	Voltage     float64 `json:"voltage,omitempty"`
+	Amperage    float64 `json:"amperage,omitempty"`
+	PowerFactor float64 `json:"powerFactor,omitempty"`
+}
+
+// completePhases names the phases the device left unnamed and, when the
+// device reported phases but no total, totals them into CurrentWatts.
+func (p *PowerInfo) completePhases() {
+	var sum float64
+	for i := range p.Phases {
+		if p.Phases[i].Name == "" {
+			p.Phases[i].Name = "L" + strconv.Itoa(i+1)
+		}
+		sum += p.Phases[i].Watts
+	}
+	if p.CurrentWatts == 0 {
+		p.CurrentWatts = sum
+	}
+}
+
+// derivePower fills in the apparent power from voltage and current, or
+// from the power factor, and the reactive power from the apparent power,
+// where the device reported enough to tell.
+func (p *PowerInfo) derivePower() {
+	if p.ApparentVA == 0 {
+		switch {
+		case p.Voltage > 0 && p.Amperage > 0:
+			p.ApparentVA = roundMilli(p.Voltage * p.Amperage)
+		case p.PowerFactor > 0 && p.PowerFactor <= 1:
+			p.ApparentVA = roundMilli(math.Abs(p.CurrentWatts) / p.PowerFactor)
+		}
+	}
+	if p.ReactiveVAr == 0 && p.ApparentVA >= math.Abs(p.CurrentWatts) {
+		p.ReactiveVAr = roundMilli(math.Sqrt(p.ApparentVA*p.ApparentVA - p.CurrentWatts*p.CurrentWatts))
+	}
+}
+
+// roundMilli rounds v to three decimal places, hiding the floating point
+// noise of derived values.
+func roundMilli(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// ServiceEntry represents a discovered service instance.
+type ServiceEntry = zeroconf.ServiceEntry
+
+// Resolver browses for service instances. Implementations send discovered
+// entries on the channel and close it once ctx is done.
+type Resolver = zeroconf.Resolver
+
+// Device is a discovered or configured device that can be queried for
+// power readings.
+type Device struct {
+	Instance string
+	HostName string
+	// Address is the IP address or host name the device is queried on.
+	// IPv6 addresses are unbracketed, with a zone for link-local ones,
+	// such as "fe80::1%eth0".
+	Address   string
+	Addresses []string
+	Firmware  string
+	Text      []string
+	// Meta holds the Matter fields parsed from Text.
+	Meta DeviceMeta
+	// Services lists the service types the device was discovered under.
+	Services []string
+
+	// Port, Path, Driver, Auth, Timeout and Retries override the
+	// Fetcher's settings for this device when set. They come from
+	// statically configured devices.
+	Port    int
+	Path    string
+	Driver  string
+	Auth    Credentials
+	Timeout time.Duration
+	Retries *int
+	// Disabled devices are reported by discovery but never queried.
+	Disabled bool
+	// Unit, when set, is the unit the device reports power in, mW, W or
+	// kW, for drivers reading a bare number; readings are converted to
+	// watts. Drivers that are told the unit, such as kasa, ignore it.
+	Unit string
+	// Bidirectional devices, such as a meter behind a solar inverter,
+	// report export as negative power; a Validator set to RejectNegative
+	// accepts it from them alone.
+	Bidirectional bool
+
+	// Channels lists the meter channels of a device reporting several,
+	// such as a dual-relay plug. Empty means a single unnamed channel
+	// unless the driver probes some; see Fetcher.SplitChannels.
+	Channels []string
+	// Channel is the meter channel this device queries, set on each of
+	// the devices returned by Fetcher.SplitChannels.
+	Channel string
+
+	// Group is the user-defined group, such as a room, the device is
+	// reported under. The collector does not interpret it.
+	Group string
+
+	// Source is how the device's readings arrive when it is not queried
+	// for them, such as SourcePush; empty for discovered and configured
+	// devices.
+	Source string
+}
+
+// SourcePush is the Source of devices that push their readings instead of
+// being polled; see Fetcher.Ingest.
+const SourcePush = "push"
+
+// NewDevice builds a Device from a discovered service entry.
+func NewDevice(entry *ServiceEntry) Device {
+	return Device{
+		Instance:  entry.Instance,
+		HostName:  strings.TrimSuffix(entry.HostName, "."),
+		Address:   PickIPv4(entry),
+		Addresses: addresses(entry),
+		Firmware:  FirmwareVersion(entry),
+		Text:      entry.Text,
+		Meta:      ParseTXT(entry),
+	}
+}
+
+// Operational reports whether d was discovered as a commissioned Matter
+// node.
+func (d Device) Operational() bool {
+	return slices.Contains(d.Services, OperationalService)
+}
+
+// Commissionable reports whether d was discovered as a Matter node open for
+// commissioning, advertising a nonzero CM key.
+func (d Device) Commissionable() bool {
+	return slices.Contains(d.Services, CommissionableService) && d.Meta.CommissioningMode != 0
+}
+
+func addresses(entry *ServiceEntry) []string {
+	var addrs []string
+	for _, ip := range entry.AddrIPv4 {
+		addrs = append(addrs, ip.String())
+	}
+	for _, ip := range entry.AddrIPv6 {
+		addrs = append(addrs, zonedAddress(entry, ip))
+	}
+	return addrs
+}
+
+// zonedAddress returns ip as an address, with entry's interface as the
+// zone of a link-local IPv6 address when known.
+func zonedAddress(entry *ServiceEntry, ip net.IP) string {
+	if ip.IsLinkLocalUnicast() && ip.To4() == nil && entry.Interface != "" {
+		return ip.String() + "%" + entry.Interface
+	}
+	return ip.String()
+}
+
+// PowerURL returns the URL of the device's power endpoint using the default
+// scheme and port, or an empty string when the device has no usable address.
+func (d Device) PowerURL() string {
+	return (&Fetcher{}).URL(d)
+}
+
+// DiscoverOptions configures a discovery pass.
+type DiscoverOptions struct {
+	Resolver Resolver
+	// Services lists the service types browsed concurrently, or
+	// DefaultService alone when empty.
+	Services []string
+	Domain   string
+	// Settle, when positive, ends discovery early once no new entry has
+	// arrived for this long after the first one.
+	Settle time.Duration
+	// Static devices are reported before browsing starts. Discovered
+	// entries sharing an address with a static device are skipped, so the
+	// configured name wins.
+	Static []Device
+	// NoBrowse disables mDNS browsing, reporting only the static devices.
+	NoBrowse bool
+	// AllowDuplicates reports every announcement, including repeats of a
+	// device already seen during this pass.
+	AllowDuplicates bool
+	// PreferIPv6 picks a device's IPv6 address over its IPv4 one.
+	PreferIPv6 bool
+	// IPv4Only and IPv6Only restrict discovered devices to addresses of
+	// one family. A device with none is still reported, without an
+	// address.
+	IPv4Only bool
+	IPv6Only bool
+	// Filter, when set, drops discovered devices it does not allow. Static
+	// devices are always reported.
+	Filter *Filter
+	// Alias, when set, returns the display name of a discovered device,
+	// which replaces its instance name unless empty. It is consulted after
+	// Filter, so filters see the advertised name.
+	Alias func(Device) string
+	// VendorName, when set, returns the name of a vendor ID, or an empty
+	// string when it does not know it, to set the VendorName of every
+	// discovered device advertising one.
+	VendorName func(id int) string
+	// Scan, when set, also finds devices by probing subnets, even with
+	// NoBrowse.
+	Scan *Scanner
+	// SourceFailed, when set, is called for each discovery source that
+	// could not start, such as the browse of one service, named like
+	// "mdns _matter._tcp".
+	SourceFailed func(source string, err error)
+	// Strict fails discovery when any source fails, not only when every
+	// one does.
+	Strict bool
+}
+
+// Discover browses for devices until ctx is done and returns every device
+// that was found.
+func Discover(ctx context.Context, opts DiscoverOptions) ([]Device, error) {
+	var devices []Device
+	err := DiscoverFunc(ctx, opts, func(d Device) {
+		devices = append(devices, d)
+	})
+	return devices, err
+}
+
+// DiscoverFunc browses for devices until ctx is done, calling fn for each
+// entry as it arrives. Entries are handled on the calling goroutine, so
+// DiscoverFunc only returns once the resolver has closed its channel and fn
+// has returned for every entry.
+//
+// Repeated announcements of a device, keyed by Device.Key, are skipped
+// unless opts.AllowDuplicates is set. A repeat is still reported when it
+// brings an IPv4 address the earlier announcement lacked. Without
+// AllowDuplicates, an entry for a host already found under another service
+// is merged into that host's device, which is reported again with the new
+// service added.
+//
+// With opts.Scan, devices found by scanning are reported alongside the
+// browsed ones; whichever reaches an address first keeps it, and static
+// devices keep theirs.
+//
+// The static devices, the browse of each service and the scan are
+// independent sources. One that fails is reported to opts.SourceFailed
+// and discovery carries on with the others; DiscoverFunc only returns an
+// error, joining every failure, when no source is left or, with
+// opts.Strict, when any failed.
+func DiscoverFunc(ctx context.Context, opts DiscoverOptions, fn func(Device)) error {
+	static := make(map[string]bool)
+	for _, d := range opts.Static {
+		static[d.Address] = true
+		fn(d)
+	}
+	scanning := opts.Scan != nil && len(opts.Scan.Prefixes) > 0
+	if opts.NoBrowse && !scanning {
+		return nil
+	}
+	services := opts.Services
+	if len(services) == 0 {
+		services = []string{DefaultService}
+	}
+	domain := opts.Domain
+	if domain == "" {
+		domain = DefaultDomain
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var settled *time.Timer
+	if opts.Settle > 0 {
+		settled = time.AfterFunc(opts.Settle, cancel)
+		settled.Stop()
+		defer settled.Stop()
+	}
+
+	var failures []error
+	fail := func(source string, err error) {
+		failures = append(failures, fmt.Errorf("%s: %w", source, err))
+		if opts.SourceFailed != nil {
+			opts.SourceFailed(source, err)
+		}
+	}
+	working := len(opts.Static)
+	var entries <-chan serviceEntry
+	switch {
+	case opts.NoBrowse:
+	case opts.Resolver == nil:
+		fail("mdns", errors.New("collector: no resolver configured"))
+	default:
+		var started int
+		entries, started = browseServices(ctx, opts.Resolver, services, domain, func(service string, err error) {
+			fail("mdns "+service, err)
+		})
+		working += started
+	}
+	if scanning {
+		working++
+	}
+	if len(failures) > 0 && (working == 0 || opts.Strict) {
+		cancel()
+		if entries != nil {
+			for range entries {
+			}
+		}
+		return errors.Join(failures...)
+	}
+	var scanned chan Device
+	if scanning {
+		scanned = make(chan Device)
+		go opts.Scan.run(ctx, scanned)
+	}
+
+	report := func(d Device) {
+		if opts.VendorName != nil && d.Meta.VendorID != 0 {
+			d.Meta.VendorName = opts.VendorName(d.Meta.VendorID)
+		}
+		if opts.Alias != nil {
+			if name := opts.Alias(d); name != "" {
+				d.Instance = name
+			}
+		}
+		fn(d)
+	}
+	seen := newDeviceMerger()
+	browsed := make(map[string]bool)
+	scans := newScanMerger()
+	for entries != nil || scanned != nil {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				entries = nil
+				continue
+			}
+			if settled != nil {
+				settled.Reset(opts.Settle)
+			}
+			d := NewDevice(entry.ServiceEntry)
+			d.Services = []string{entry.service}
+			switch {
+			case opts.IPv4Only:
+				d.Address = familyAddress(entry.ServiceEntry, false)
+				d.Addresses = onlyFamily(d.Addresses, false)
+			case opts.IPv6Only:
+				d.Address = familyAddress(entry.ServiceEntry, true)
+				d.Addresses = onlyFamily(d.Addresses, true)
+			case opts.PreferIPv6:
+				d.Address = PickAddress(entry.ServiceEntry, true)
+			}
+			if sharesAddress(d, static) || sharesAddress(d, scans.addrs) || !opts.Filter.Allow(d) {
+				continue
+			}
+			if !opts.AllowDuplicates {
+				var changed bool
+				if d, changed = seen.add(d); !changed {
+					continue
+				}
+			}
+			for _, addr := range append([]string{d.Address}, d.Addresses...) {
+				browsed[addr] = true
+			}
+			report(d)
+
+		case d, ok := <-scanned:
+			if !ok {
+				scanned = nil
+				continue
+			}
+			if settled != nil {
+				settled.Reset(opts.Settle)
+			}
+			if sharesAddress(d, static) || sharesAddress(d, browsed) || !opts.Filter.Allow(d) {
+				continue
+			}
+			if !scans.add(d) && !opts.AllowDuplicates {
+				continue
+			}
+			report(d)
+		}
+	}
+	return nil
+}
+
+// hasIPv4 reports whether d's address is an IPv4 address.
+func hasIPv4(d Device) bool {
+	return d.Address != "" && !strings.Contains(d.Address, ":")
+}
+
+// sharesAddress reports whether any of d's addresses is in addrs.
+func sharesAddress(d Device, addrs map[string]bool) bool {
+	if len(addrs) == 0 {
+		return false
+	}
+	if addrs[d.Address] {
+		return true
+	}
+	for _, a := range d.Addresses {
+		if addrs[a] {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateService checks that service looks like an mDNS service type such
+// as "_matter._tcp".
+func ValidateService(service string) error {
+	if !strings.HasPrefix(service, "_") || !(strings.HasSuffix(service, "._tcp") || strings.HasSuffix(service, "._udp")) {
+		return fmt.Errorf("invalid service %q: must start with \"_\" and end in \"._tcp\" or \"._udp\"", service)
+	}
+	return nil
+}
+
+// PickIPv4 returns the most reachable IPv4 address of entry, falling back
+// to an IPv6 address. It returns an empty string if none is available.
+func PickIPv4(entry *ServiceEntry) string {
+	return PickAddress(entry, false)
+}
+
+// PickAddress returns the most reachable address of entry in the preferred
+// family, falling back to the other. Within a family, global unicast
+// addresses beat private ones, which beat link-local ones. A link-local
+// IPv6 address carries the entry's interface as its zone when known.
+func PickAddress(entry *ServiceEntry, preferIPv6 bool) string {
+	ipv4, ipv6 := familyAddress(entry, false), familyAddress(entry, true)
+	if (preferIPv6 && ipv6 != "") || ipv4 == "" {
+		return ipv6
+	}
+	return ipv4
+}
+
+// onlyFamily returns the addresses of one family in addrs.
+func onlyFamily(addrs []string, ipv6 bool) []string {
+	var kept []string
+	for _, addr := range addrs {
+		if strings.Contains(addr, ":") == ipv6 {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+// familyAddress returns the most reachable address of entry in one family,
+// or an empty string if it has none.
+func familyAddress(entry *ServiceEntry, ipv6 bool) string {
+	if !ipv6 {
+		var v4 []net.IP
+		for _, ip := range entry.AddrIPv4 {
+			if ip.To4() != nil {
+				v4 = append(v4, ip)
+			}
+		}
+		if ip := bestIP(v4); ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+	ip := bestIP(entry.AddrIPv6)
+	if ip == nil {
+		return ""
+	}
+	return zonedAddress(entry, ip)
+}
+
+// URLHost returns addr in the form used as a URL host: IPv6 addresses are
+// bracketed, with any zone escaped as RFC 6874 requires.
+func URLHost(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return addr
+	}
+	return "[" + escapeZone(addr) + "]"
+}
+
+// hostPort joins addr and port into a URL host.
+func hostPort(addr string, port int) string {
+	return net.JoinHostPort(escapeZone(addr), strconv.Itoa(port))
+}
+
+// escapeZone percent-encodes the zone of an IPv6 address for use in a URL.
+func escapeZone(addr string) string {
+	ip, zone, ok := strings.Cut(addr, "%")
+	if !ok {
+		return addr
+	}
+	return ip + "%25" + url.PathEscape(zone)
+}
+
+// bestIP returns the first of ips with the lowest addressRank.
+func bestIP(ips []net.IP) net.IP {
+	var best net.IP
+	for _, ip := range ips {
+		if best == nil || addressRank(ip) < addressRank(best) {
+			best = ip
+		}
+	}
+	return best
+}
+
+// addressRank orders addresses by how likely they are to be reachable.
+func addressRank(ip net.IP) int {
+	switch {
+	case ip.IsGlobalUnicast() && !ip.IsPrivate():
+		return 0
+	case ip.IsPrivate():
+		return 1
+	case ip.IsLinkLocalUnicast():
+		return 2
+	}
+	return 3
+}
+
+// FirmwareVersion extracts the firmware version from the entry's TXT
+// records, or returns an empty string if none is advertised.
+func FirmwareVersion(entry *ServiceEntry) string {
+	for _, txt := range entry.Text {
+		key, value, ok := strings.Cut(txt, "=")
+		if ok && isFirmwareKey(key) {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,440 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+)
+
+func TestPickIPv4(t *testing.T) {
+	entry := &ServiceEntry{AddrIPv4: []net.IP{net.ParseIP("192.168.1.5")}}
+	if got := PickIPv4(entry); got != "192.168.1.5" {
+		t.Fatalf("expected IPv4 address, got %q", got)
+	}
+}
+
+func TestPickIPv4FallsBackToIPv6(t *testing.T) {
+	entry := &ServiceEntry{AddrIPv6: []net.IP{net.ParseIP("fe80::1")}}
+	if got := PickIPv4(entry); got != "fe80::1" {
+		t.Fatalf("expected the IPv6 address, got %q", got)
+	}
+}
+
+func TestPickAddressOrdering(t *testing.T) {
+	ips := func(addrs ...string) []net.IP {
+		var out []net.IP
+		for _, a := range addrs {
+			out = append(out, net.ParseIP(a))
+		}
+		return out
+	}
+	cases := []struct {
+		name       string
+		entry      *ServiceEntry
+		preferIPv6 bool
+		want       string
+	}{
+		{"private beats link-local", &ServiceEntry{AddrIPv4: ips("169.254.10.1", "192.168.1.5")}, false, "192.168.1.5"},
+		{"global beats private", &ServiceEntry{AddrIPv4: ips("10.0.0.2", "203.0.113.9")}, false, "203.0.113.9"},
+		{"first of equal rank", &ServiceEntry{AddrIPv4: ips("192.168.1.5", "10.0.0.2")}, false, "192.168.1.5"},
+		{"link-local only", &ServiceEntry{AddrIPv4: ips("169.254.10.1")}, false, "169.254.10.1"},
+		{"IPv6 skips fe80", &ServiceEntry{AddrIPv6: ips("fe80::1", "fd00::5")}, false, "fd00::5"},
+		{"IPv6 link-local gets zone", &ServiceEntry{AddrIPv6: ips("fe80::1"), Interface: "eth0"}, false, "fe80::1%eth0"},
+		{"prefer IPv6", &ServiceEntry{AddrIPv4: ips("192.168.1.5"), AddrIPv6: ips("2001:db8::1")}, true, "2001:db8::1"},
+		{"prefer IPv6 falls back", &ServiceEntry{AddrIPv4: ips("192.168.1.5")}, true, "192.168.1.5"},
+	}
+	for _, c := range cases {
+		if got := PickAddress(c.entry, c.preferIPv6); got != c.want {
+			t.Fatalf("%s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestDiscoverRestrictsAddressFamily(t *testing.T) {
+	entry := &ServiceEntry{
+		Instance:  "Lamp",
+		HostName:  "lamp.local.",
+		AddrIPv4:  []net.IP{net.ParseIP("192.168.1.5")},
+		AddrIPv6:  []net.IP{net.ParseIP("fe80::1")},
+		Interface: "eth0",
+	}
+	cases := []struct {
+		name string
+		opts DiscoverOptions
+		want string
+	}{
+		{"default", DiscoverOptions{}, "192.168.1.5"},
+		{"IPv4 only", DiscoverOptions{IPv4Only: true}, "192.168.1.5"},
+		{"IPv6 only", DiscoverOptions{IPv6Only: true}, "fe80::1%eth0"},
+		{"IPv4 only without one", DiscoverOptions{IPv4Only: true}, ""},
+	}
+	for _, c := range cases {
+		e := *entry
+		if c.name == "IPv4 only without one" {
+			e.AddrIPv4 = nil
+		}
+		c.opts.Resolver = &fakeResolver{entries: []*ServiceEntry{&e}}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		devices, err := Discover(ctx, c.opts)
+		cancel()
+		if err != nil || len(devices) != 1 {
+			t.Fatalf("%s: expected one device, got %+v, %v", c.name, devices, err)
+		}
+		if devices[0].Address != c.want {
+			t.Fatalf("%s: expected address %q, got %q", c.name, c.want, devices[0].Address)
+		}
+		if c.opts.IPv4Only && len(devices[0].Addresses) > 1 || c.opts.IPv6Only && !slices.Equal(devices[0].Addresses, []string{"fe80::1%eth0"}) {
+			t.Fatalf("%s: expected fallback addresses of the one family, got %v", c.name, devices[0].Addresses)
+		}
+	}
+}
+
+func TestAddressesZoneLinkLocal(t *testing.T) {
+	entry := &ServiceEntry{
+		AddrIPv4:  []net.IP{net.ParseIP("192.168.1.5")},
+		AddrIPv6:  []net.IP{net.ParseIP("fe80::1"), net.ParseIP("2001:db8::5")},
+		Interface: "eth0",
+	}
+	if got := addresses(entry); !slices.Equal(got, []string{"192.168.1.5", "fe80::1%eth0", "2001:db8::5"}) {
+		t.Fatalf("expected the link-local address zoned, got %v", got)
+	}
+	entry.Interface = ""
+	if got := addresses(entry); !slices.Equal(got, []string{"192.168.1.5", "fe80::1", "2001:db8::5"}) {
+		t.Fatalf("expected no zone without an interface, got %v", got)
+	}
+}
+
+func TestPickIPv4ReturnsEmptyWhenNoAddresses(t *testing.T) {
+	entry := &ServiceEntry{}
+	if got := PickIPv4(entry); got != "" {
+		t.Fatalf("expected empty address, got %q", got)
+	}
+}
+
+func TestFirmwareVersion(t *testing.T) {
+	entry := &ServiceEntry{Text: []string{"other=value", "FirmwareVersion=1.2.3"}}
+	if got := FirmwareVersion(entry); got != "1.2.3" {
+		t.Fatalf("expected firmware version to be %q, got %q", "1.2.3", got)
+	}
+}
+
+func TestFirmwareVersionEmptyWhenMissing(t *testing.T) {
+	entry := &ServiceEntry{Text: []string{"missing", "noequal"}}
+	if got := FirmwareVersion(entry); got != "" {
+		t.Fatalf("expected empty firmware version, got %q", got)
+	}
+}
+
+func TestNewDevice(t *testing.T) {
+	entry := &ServiceEntry{
+		Instance: "Lamp",
+		HostName: "lamp.local.",
+		Text:     []string{"fv=2.0"},
+		AddrIPv4: []net.IP{net.ParseIP("10.0.0.7")},
+	}
+
+	d := NewDevice(entry)
+	if d.Instance != "Lamp" || d.HostName != "lamp.local" || d.Address != "10.0.0.7" || d.Firmware != "2.0" {
+		t.Fatalf("unexpected Device: %+v", d)
+	}
+	if got := d.PowerURL(); got != "http://10.0.0.7:80/api/power" {
+		t.Fatalf("unexpected power URL %q", got)
+	}
+}
+
+func (f *fakeResolver) Browse(ctx context.Context, _ string, _ string, entries chan<- *ServiceEntry) error {
+	go func() {
+		defer close(entries)
+		for _, e := range f.entries {
+			select {
+			case entries <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return nil
+}
+
+func TestDiscoverUsesInjectedResolver(t *testing.T) {
+	resolver := &fakeResolver{entries: []*ServiceEntry{
+		{Instance: "One", HostName: "one.local."},
+		{Instance: "Two", HostName: "two.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.0.2")}},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Instance != "One" || devices[1].Address != "10.0.0.2" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+}
+
+func TestDiscoverRequiresResolver(t *testing.T) {
+	if _, err := Discover(context.Background(), DiscoverOptions{}); err == nil {
+		t.Fatal("expected error without resolver, got nil")
+	}
+}
+
+func TestValidateService(t *testing.T) {
+	for _, ok := range []string{"_matter._tcp", "_matterc._udp", "_shelly._tcp"} {
+		if err := ValidateService(ok); err != nil {
+			t.Fatalf("expected %q to be valid, got %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"matter._tcp", "_matter", "_matter._sctp", ""} {
+		if err := ValidateService(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestDiscoverSettlesAfterQuietPeriod(t *testing.T) {
+	resolver := zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Delay: 10 * time.Millisecond, Entry: &ServiceEntry{Instance: "One"}},
+		zeroconf.ScheduledEntry{Delay: 40 * time.Millisecond, Entry: &ServiceEntry{Instance: "Two"}},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver, Settle: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected discovery to settle well before the timeout, took %v", elapsed)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected both scheduled devices, got %+v", devices)
+	}
+}
+
+func TestDiscoverDoesNotSettleBeforeFirstEntry(t *testing.T) {
+	resolver := zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Delay: 150 * time.Millisecond, Entry: &ServiceEntry{Instance: "Late"}},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver, Settle: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("expected the late device to be found, got %+v", devices)
+	}
+}
+
+func TestDiscoverFuncWaitsForSlowHandler(t *testing.T) {
+	server := slowServer(t, 200*time.Millisecond)
+	resolver := zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Delay: 10 * time.Millisecond, Entry: &ServiceEntry{Instance: "Slow"}},
+	)
+
+	// The browse deadline expires while the device is still answering.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var printed []string
+	err := DiscoverFunc(ctx, DiscoverOptions{Resolver: resolver}, func(d Device) {
+		info, err := fetchPower(context.Background(), server.URL)
+		if err != nil {
+			t.Errorf("expected slow fetch to succeed, got %v", err)
+			return
+		}
+		printed = append(printed, fmt.Sprintf("%s: %.1f W", d.Instance, info.CurrentWatts))
+	})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(printed) != 1 || printed[0] != "Slow: 1.0 W" {
+		t.Fatalf("expected the slow device's result before returning, got %v", printed)
+	}
+}
+
+type failingResolver struct{}
+
+func (failingResolver) Browse(context.Context, string, string, chan<- *ServiceEntry) error {
+	return errors.New("multicast unavailable")
+}
+
+func TestDiscoverFuncReturnsBrowseError(t *testing.T) {
+	err := DiscoverFunc(context.Background(), DiscoverOptions{Resolver: failingResolver{}}, func(Device) {
+		t.Error("expected no devices from a failing resolver")
+	})
+	if err == nil || !strings.Contains(err.Error(), "multicast unavailable") {
+		t.Fatalf("expected browse error, got %v", err)
+	}
+}
+
+func TestDiscoverFallsBackToStaticDevices(t *testing.T) {
+	static := []Device{{Instance: "Garage", Address: "10.0.20.5"}}
+	var failed []string
+	devices, err := Discover(context.Background(), DiscoverOptions{
+		Resolver:     failingResolver{},
+		Static:       static,
+		SourceFailed: func(source string, err error) { failed = append(failed, source) },
+	})
+	if err != nil {
+		t.Fatalf("expected the static devices to keep discovery going, got %v", err)
+	}
+	if len(devices) != 1 || devices[0].Instance != "Garage" || !slices.Equal(failed, []string{"mdns " + DefaultService}) {
+		t.Fatalf("expected the static device and a failed browse, got %+v and %v", devices, failed)
+	}
+}
+
+func TestDiscoverMergesStaticDevices(t *testing.T) {
+	resolver := &fakeResolver{entries: []*ServiceEntry{
+		{Instance: "shelly-plug-1", HostName: "shelly.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.20.5")}},
+		{Instance: "Other", HostName: "other.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.0.9")}},
+	}}
+	static := []Device{{Instance: "Garage", HostName: "10.0.20.5", Address: "10.0.20.5"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver, Static: static})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Instance != "Garage" || devices[1].Instance != "Other" {
+		t.Fatalf("expected static device to replace its discovered duplicate, got %+v", devices)
+	}
+}
+
+func TestDiscoverNoBrowseReportsOnlyStaticDevices(t *testing.T) {
+	static := []Device{{Instance: "Garage", Address: "10.0.20.5"}}
+
+	devices, err := Discover(context.Background(), DiscoverOptions{Static: static, NoBrowse: true})
+	if err != nil {
+		t.Fatalf("expected success without a resolver, got error: %v", err)
+	}
+	if len(devices) != 1 || devices[0].Instance != "Garage" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+}
+
+func TestDiscoverSkipsRepeatedAnnouncements(t *testing.T) {
+	lamp := &ServiceEntry{Instance: "Lamp", HostName: "lamp.local."}
+	lampWithIPv4 := &ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.0.7")}}
+	resolver := &fakeResolver{entries: []*ServiceEntry{lamp, lamp, lampWithIPv4, lampWithIPv4}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Address != "" || devices[1].Address != "10.0.0.7" {
+		t.Fatalf("expected first announcement plus the IPv4 update, got %+v", devices)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	devices, _ = Discover(ctx, DiscoverOptions{Resolver: resolver, AllowDuplicates: true})
+	if len(devices) != 4 {
+		t.Fatalf("expected every announcement with AllowDuplicates, got %d", len(devices))
+	}
+}
+
+func TestDiscoverAppliesFilterToDiscoveredDevices(t *testing.T) {
+	resolver := &fakeResolver{entries: []*ServiceEntry{
+		{Instance: "Kitchen Plug", HostName: "plug.local.", Text: []string{"VP=65521+32768"}},
+		{Instance: "Hall Thermostat", HostName: "thermo.local.", Text: []string{"VP=4874+1"}},
+	}}
+	static := []Device{{Instance: "Garage", Address: "10.0.20.5"}}
+	filter := &Filter{Match: regexp.MustCompile("Plug")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver, Static: static, Filter: filter})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Instance != "Garage" || devices[1].Instance != "Kitchen Plug" {
+		t.Fatalf("expected the static device and the matching plug, got %+v", devices)
+	}
+}
+
+func TestDiscoverAppliesAliasAfterFilter(t *testing.T) {
+	resolver := &fakeResolver{entries: []*ServiceEntry{
+		{Instance: "A3F2C1B4D5E6F708-0000000000000017", HostName: "a3f2.local."},
+		{Instance: "Hall Thermostat", HostName: "thermo.local."},
+	}}
+	static := []Device{{Instance: "Garage", Address: "10.0.20.5"}}
+	filter := &Filter{Match: regexp.MustCompile("^A3F2|Thermostat")}
+	alias := func(d Device) string {
+		if d.HostName == "a3f2.local" || d.Instance == "Garage" {
+			return "Kettle"
+		}
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver, Static: static, Filter: filter, Alias: alias})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(devices) != 3 || devices[0].Instance != "Garage" || devices[1].Instance != "Kettle" || devices[2].Instance != "Hall Thermostat" {
+		t.Fatalf("expected only the discovered match to be renamed, got %+v", devices)
+	}
+}
+
+func TestDiscoverNamesVendors(t *testing.T) {
+	resolver := &fakeResolver{entries: []*ServiceEntry{
+		{Instance: "Plug", HostName: "plug.local.", Text: []string{"VP=4874+77"}},
+		{Instance: "Lamp", HostName: "lamp.local."},
+	}}
+	names := func(id int) string {
+		if id == 4874 {
+			return "Eve Systems"
+		}
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	devices, err := Discover(ctx, DiscoverOptions{Resolver: resolver, VendorName: names})
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Meta.VendorName != "Eve Systems" || devices[1].Meta.VendorName != "" {
+		t.Fatalf("expected only the advertised vendor named, got %+v", devices)
+	}
+}
+
+func TestDerivePower(t *testing.T) {
+	cases := []struct {
+		in                 PowerInfo
+		apparent, reactive float64
+	}{
+		{PowerInfo{CurrentWatts: 80, Voltage: 200, Amperage: 0.5}, 100, 60},
+		{PowerInfo{CurrentWatts: -80, PowerFactor: 0.8}, 100, 60},
+		{PowerInfo{CurrentWatts: 80, ApparentVA: 100, ReactiveVAr: 50}, 100, 50},
+		{PowerInfo{CurrentWatts: 80}, 0, 0},
+	}
+	for _, c := range cases {
+		info := c.in
+		info.derivePower()
+		if info.ApparentVA != c.apparent || info.ReactiveVAr != c.reactive {
+			t.Errorf("%+v: expected %v VA and %v var, got %v VA and %v var", c.in, c.apparent, c.reactive, info.ApparentVA, info.ReactiveVAr)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Driver queries one family of devices and normalises its payload into a
+// PowerInfo so downstream output stays uniform.
+type Driver interface {
+	// Name identifies the driver, as accepted by --driver.
+	Name() string
+	// Probe reports whether the driver recognises the device, typically
+	// from its TXT records or host name.
+	Probe(d Device) bool
+	// Fetch queries the device using the fetcher's transport settings.
+	Fetch(ctx context.Context, f *Fetcher, d Device) (*PowerInfo, error)
+}
+
+// ChannelProber is implemented by drivers that can tell a device's meter
+// channels from its discovery record.
+type ChannelProber interface {
+	// Channels returns the device's channels, or nil for a single
+	// unnamed one.
+	Channels(d Device) []string
+}
+
+// GenericDriver is the name of the fallback driver, which expects the
+// PowerInfo JSON shape at /api/power.
+const GenericDriver = "generic"
+
+// drivers lists the built-in drivers in probe order. The generic driver
+// comes last because it accepts every device.
+var drivers = []Driver{
+	&httpDriver{name: "shelly-em", path: "/rpc/EM.GetStatus?id=0", probe: probeShellyEM, decode: decodeShellyEM},
+	&httpDriver{name: "shelly", path: "/rpc/Switch.GetStatus?id=0", channelParam: "id", probe: probeShelly, channels: shellyChannels, decode: decodeShelly},
+	&httpDriver{name: "tasmota", path: "/cm?cmnd=Status%208", probe: probeTasmota, decode: decodeTasmota},
+	kasaDriver{},
+	esphomeDriver{},
+	&httpDriver{name: GenericDriver, path: DefaultPowerPath, channelParam: "channel", probe: func(Device) bool { return true }, decode: decodeGeneric},
+}
+
+// LookupDriver returns the built-in driver with the given name.
+func LookupDriver(name string) (Driver, error) {
+	for _, d := range drivers {
+		if d.Name() == name {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown driver %q (available: %s)", name, strings.Join(DriverNames(), ", "))
+}
+
+// DriverNames returns the names of the built-in drivers, sorted.
+func DriverNames() []string {
+	names := make([]string, 0, len(drivers))
+	for _, d := range drivers {
+		names = append(names, d.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SelectDriver returns the first built-in driver whose probe accepts d.
+func SelectDriver(d Device) Driver {
+	for _, drv := range drivers {
+		if drv.Probe(d) {
+			return drv
+		}
+	}
+	return drivers[len(drivers)-1]
+}
+
+// httpDriver fetches a JSON document from a fixed path and decodes it.
+// A channel is selected by setting the channelParam query parameter or,
+// without one, picked out of the document by decode.
+type httpDriver struct {
+	name         string
+	path         string
+	channelParam string
+	probe        func(Device) bool
+	channels     func(Device) []string
+	decode       func(body []byte, channel string) (*PowerInfo, error)
+}
+
+func (h *httpDriver) Name() string        { return h.name }
+func (h *httpDriver) Probe(d Device) bool { return h.probe(d) }
+
+func (h *httpDriver) Channels(d Device) []string {
+	if h.channels == nil {
+		return nil
+	}
+	return h.channels(d)
+}
+
+func (h *httpDriver) Fetch(ctx context.Context, f *Fetcher, d Device) (*PowerInfo, error) {
+	return h.fetchURL(ctx, f, d, f.urlFor(d, h.path, h.channelParam), !f.Fields.IsZero())
+}
+
+// fetchURL queries url and decodes the response, with the Fetcher's
+// field paths when fields is set.
+func (h *httpDriver) fetchURL(ctx context.Context, f *Fetcher, d Device, url string, fields bool) (*PowerInfo, error) {
+	if url == "" {
+		return nil, fmt.Errorf("device %q has no usable address", d.Instance)
+	}
+	body, err := f.get(ctx, url, f.requestFor(d))
+	if err != nil {
+		return nil, err
+	}
+	decode := h.decode
+	if fields {
+		decode = f.Fields.decodeChannel
+	}
+	info, err := decode(body, d.Channel)
+	if err != nil {
+		return nil, &decodeError{fmt.Errorf("%s: decode response: %w", h.name, err)}
+	}
+	return info, nil
+}
+
+// decodeError reports a response that could not be decoded into a
+// reading, as opposed to a device that did not answer.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string { return e.err.Error() }
+
+func (e *decodeError) Unwrap() error { return e.err }
+
+// decodeGeneric decodes the PowerInfo document. The channel was already
+// selected by the query parameter.
+func decodeGeneric(body []byte, _ string) (*PowerInfo, error) {
+	// The timestamp may be a string or an epoch number, so it is decoded
+	// separately from the rest of the document.
+	var doc struct {
+		PowerInfo
+		Timestamp any `json:"timestamp"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	info := doc.PowerInfo
+	info.RawTimestamp = rawTimestamp(doc.Timestamp)
+	info.completePhases()
+	return &info, nil
+}
+
+// txtValue returns the value of the TXT record key, compared
+// case-insensitively.
+func txtValue(d Device, key string) (string, bool) {
+	for _, txt := range d.Text {
+		k, v, ok := strings.Cut(txt, "=")
+		if ok && strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func hasNamePrefix(d Device, prefix string) bool {
+	return strings.HasPrefix(strings.ToLower(d.Instance), prefix) ||
+		strings.HasPrefix(strings.ToLower(d.HostName), prefix)
+}
+
+// probeShelly matches Shelly Gen2 devices, which advertise a "gen" TXT key
+// and default to shelly-prefixed host names.
+func probeShelly(d Device) bool {
+	if gen, ok := txtValue(d, "gen"); ok && gen != "1" {
+		return true
+	}
+	return hasNamePrefix(d, "shelly")
+}
+
+// shellyModel matches the app TXT value of multi-channel Shelly meters,
+// such as Plus2PM or Pro4PM, capturing the channel count.
+var shellyModel = regexp.MustCompile(`(?i)^(?:plus|pro)([2-4])pm`)
+
+// shellyChannels returns the switch ids of a multi-channel Shelly, from
+// the model in its app TXT record.
+func shellyChannels(d Device) []string {
+	app, _ := txtValue(d, "app")
+	m := shellyModel.FindStringSubmatch(app)
+	if m == nil {
+		return nil
+	}
+	n, _ := strconv.Atoi(m[1])
+	channels := make([]string, n)
+	for i := range channels {
+		channels[i] = strconv.Itoa(i)
+	}
+	return channels
+}
+
+func decodeShelly(body []byte, _ string) (*PowerInfo, error) {
+	var status struct {
+		ID      int      `json:"id"`
+		APower  *float64 `json:"apower"`
+		Voltage float64  `json:"voltage"`
+		Current float64  `json:"current"`
+		PF      float64  `json:"pf"`
+		Freq    float64  `json:"freq"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	if status.APower == nil {
+		return nil, fmt.Errorf("missing apower field")
+	}
+	return &PowerInfo{CurrentWatts: *status.APower, Voltage: status.Voltage, Amperage: status.Current, PowerFactor: status.PF, FrequencyHz: status.Freq}, nil
+}
+
+// probeShellyEM matches the Shelly Pro 3EM three-phase meter by its app
+// TXT record or default host name.
+func probeShellyEM(d Device) bool {
+	if app, ok := txtValue(d, "app"); ok && strings.HasPrefix(strings.ToLower(app), "pro3em") {
+		return true
+	}
+	return hasNamePrefix(d, "shellypro3em")
+}
+
+// decodeShellyEM decodes an EM.GetStatus response, which reports phases
+// a, b and c as L1, L2 and L3 alongside their total.
+func decodeShellyEM(body []byte, _ string) (*PowerInfo, error) {
+	// Besides numbers, the status holds arrays such as
+	// user_calibrated_phase, so values are decoded one at a time.
+	var status map[string]json.RawMessage
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	number := func(key string) (float64, bool) {
+		var v *float64
+		if json.Unmarshal(status[key], &v) != nil || v == nil {
+			return 0, false
+		}
+		return *v, true
+	}
+	value := func(key string) float64 {
+		v, _ := number(key)
+		return v
+	}
+	total, ok := number("total_act_power")
+	if !ok {
+		return nil, fmt.Errorf("missing total_act_power field")
+	}
+	info := &PowerInfo{CurrentWatts: total, Amperage: value("total_current"), ApparentVA: value("total_aprt_power")}
+	for i, phase := range []string{"a", "b", "c"} {
+		watts, ok := number(phase + "_act_power")
+		if !ok {
+			continue
+		}
+		info.Phases = append(info.Phases, PhaseInfo{
+			Name:        "L" + strconv.Itoa(i+1),
+			Watts:       watts,
+			Voltage:     value(phase + "_voltage"),
+			Amperage:    value(phase + "_current"),
+			PowerFactor: value(phase + "_pf"),
+		})
+		if info.FrequencyHz == 0 {
+			info.FrequencyHz = value(phase + "_freq")
+		}
+	}
+	return info, nil
+}
+
+// probeTasmota matches Tasmota devices by their default host name or an
+// explicit devicetype TXT hint.
+func probeTasmota(d Device) bool {
+	if v, ok := txtValue(d, "devicetype"); ok && strings.EqualFold(v, "tasmota") {
+		return true
+	}
+	return hasNamePrefix(d, "tasmota")
+}
+
+// decodeTasmota decodes a Status 8 response. Multi-channel devices report
+// each ENERGY value as an array, indexed by channel from 0.
+func decodeTasmota(body []byte, channel string) (*PowerInfo, error) {
+	var status struct {
+		StatusSNS *struct {
+			Time   string `json:"Time"`
+			ENERGY *struct {
+				Power         tasmotaValue `json:"Power"`
+				Voltage       tasmotaValue `json:"Voltage"`
+				Current       tasmotaValue `json:"Current"`
+				Factor        tasmotaValue `json:"Factor"`
+				Frequency     tasmotaValue `json:"Frequency"`
+				ApparentPower tasmotaValue `json:"ApparentPower"`
+				ReactivePower tasmotaValue `json:"ReactivePower"`
+			} `json:"ENERGY"`
+		} `json:"StatusSNS"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	if status.StatusSNS == nil || status.StatusSNS.ENERGY == nil || status.StatusSNS.ENERGY.Power == nil {
+		return nil, fmt.Errorf("missing StatusSNS.ENERGY.Power field")
+	}
+	index := 0
+	if channel != "" {
+		var err error
+		if index, err = strconv.Atoi(channel); err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid channel %q: want an index from 0", channel)
+		}
+	}
+	energy := status.StatusSNS.ENERGY
+	power, ok := energy.Power.at(index, false)
+	if !ok {
+		return nil, fmt.Errorf("missing StatusSNS.ENERGY.Power value for channel %s", channel)
+	}
+	voltage, _ := energy.Voltage.at(index, true)
+	current, _ := energy.Current.at(index, false)
+	factor, _ := energy.Factor.at(index, false)
+	frequency, _ := energy.Frequency.at(index, true)
+	apparent, _ := energy.ApparentPower.at(index, false)
+	reactive, _ := energy.ReactivePower.at(index, false)
+	return &PowerInfo{
+		CurrentWatts: power,
+		Voltage:      voltage,
+		Amperage:     current,
+		PowerFactor:  factor,
+		FrequencyHz:  frequency,
+		ApparentVA:   apparent,
+		ReactiveVAr:  reactive,
+		RawTimestamp: status.StatusSNS.Time,
+	}, nil
+}
+
+// tasmotaValue is an ENERGY reading: a number, or an array with one
+// number per channel.
+type tasmotaValue []float64
+
+func (v *tasmotaValue) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var one float64
+	if err := json.Unmarshal(b, &one); err == nil {
+		*v = tasmotaValue{one}
+		return nil
+	}
+	var many []float64
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*v = many
+	return nil
+}
+
+// at returns the value of the channel at index. A single value serves
+// only channel 0, unless it is shared by every channel, as the line
+// voltage is.
+func (v tasmotaValue) at(index int, shared bool) (float64, bool) {
+	if shared && len(v) == 1 {
+		return v[0], true
+	}
+	if index >= len(v) {
+		return 0, false
+	}
+	return v[index], true
+}
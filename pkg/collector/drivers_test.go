@@ -0,0 +1,198 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return body
+}
+
+func TestDriversDecodeFixtures(t *testing.T) {
+	cases := []struct {
+		driver  string
+		fixture string
+		path    string
+		want    PowerInfo
+		// stamp is the parsed device timestamp; zero expects the fetch
+		// time.
+		stamp time.Time
+	}{
+		{GenericDriver, "generic_power.json", "/api/power", PowerInfo{DeviceName: "Lamp", CurrentWatts: 12.5, Voltage: 230.1, Amperage: 0.058, PowerFactor: 0.94, FrequencyHz: 50.02, ApparentVA: 13.346, ReactiveVAr: 4.676, RawTimestamp: "2024-02-02T15:04:05Z"}, time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)},
+		{"shelly", "shelly_switch_status.json", "/rpc/Switch.GetStatus?id=0", PowerInfo{CurrentWatts: 12.3, Voltage: 231.1, Amperage: 0.065, PowerFactor: 0.82, FrequencyHz: 50, ApparentVA: 15.022, ReactiveVAr: 8.624}, time.Time{}},
+		{"shelly-em", "shelly_em_status.json", "/rpc/EM.GetStatus?id=0", PowerInfo{CurrentWatts: 715.5, Amperage: 11.087, FrequencyHz: 50, ApparentVA: 2620.3, ReactiveVAr: 2520.721, Phases: []PhaseInfo{
+			{Name: "L1", Watts: 951.2, Voltage: 236.1, Amperage: 4.029, PowerFactor: 1},
+			{Name: "L2", Watts: -951.1, Voltage: 236.201, Amperage: 4.027, PowerFactor: 1},
+			{Name: "L3", Watts: 715.4, Voltage: 236.402, Amperage: 3.03, PowerFactor: 0.99},
+		}}, time.Time{}},
+		{"tasmota", "tasmota_status8.json", "/cm?cmnd=Status%208", PowerInfo{CurrentWatts: 48, Voltage: 229, Amperage: 0.266, PowerFactor: 0.79, ApparentVA: 61, ReactiveVAr: 38, RawTimestamp: "2024-02-02T15:04:05"}, time.Date(2024, 2, 2, 15, 4, 5, 0, time.Local)},
+	}
+	for _, c := range cases {
+		t.Run(c.driver, func(t *testing.T) {
+			body := readFixture(t, c.fixture)
+			var gotPath string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.RequestURI()
+				w.Write(body)
+			}))
+			defer server.Close()
+
+			drv, err := LookupDriver(c.driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := server.Listener.Addr().(*net.TCPAddr)
+			f := &Fetcher{Port: addr.Port, Driver: drv}
+
+			info, err := f.Fetch(context.Background(), Device{Instance: "dev", Address: addr.IP.String()})
+			if err != nil {
+				t.Fatalf("expected fetch to succeed, got %v", err)
+			}
+			if gotPath != c.path {
+				t.Fatalf("expected request to %q, got %q", c.path, gotPath)
+			}
+			got := *info
+			if c.stamp.IsZero() {
+				if got.TimestampSource != TimestampSourceCollector || got.Timestamp.IsZero() {
+					t.Fatalf("expected the fetch time to be used, got %v from %q", got.Timestamp, got.TimestampSource)
+				}
+			} else if !got.Timestamp.Equal(c.stamp) || got.Timestamp.Location() != time.UTC || got.TimestampSource != "" {
+				t.Fatalf("expected device timestamp %v in UTC, got %v from %q", c.stamp, got.Timestamp, got.TimestampSource)
+			}
+			if got.Latency <= 0 {
+				t.Fatalf("expected the query latency to be recorded, got %v", got.Latency)
+			}
+			got.Timestamp, got.TimestampSource, got.Latency = time.Time{}, "", 0
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("expected %+v, got %+v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestDriversRejectWrongShape(t *testing.T) {
+	for _, name := range []string{"shelly", "tasmota"} {
+		drv, _ := LookupDriver(name)
+		h := drv.(*httpDriver)
+		if _, err := h.decode(readFixture(t, "generic_power.json"), ""); err == nil {
+			t.Fatalf("expected %s to reject a generic payload", name)
+		}
+	}
+}
+
+func TestSelectDriver(t *testing.T) {
+	cases := []struct {
+		device Device
+		want   string
+	}{
+		{Device{Instance: "shellyplus1pm-a8032ab12345", Text: []string{"gen=2", "app=Plus1PM"}}, "shelly"},
+		{Device{Instance: "Office", HostName: "shellyplugsg3-0011.local"}, "shelly"},
+		{Device{Instance: "Mains", Text: []string{"gen=2", "app=Pro3EM"}}, "shelly-em"},
+		{Device{Instance: "Heater", HostName: "tasmota-4F2A1C.local"}, "tasmota"},
+		{Device{Instance: "Heater", Text: []string{"devicetype=Tasmota"}}, "tasmota"},
+		{Device{Instance: "Old Shelly", Text: []string{"gen=1"}}, GenericDriver},
+		{Device{Instance: "Lamp", HostName: "lamp.local"}, GenericDriver},
+	}
+	for _, c := range cases {
+		if got := SelectDriver(c.device).Name(); got != c.want {
+			t.Fatalf("SelectDriver(%+v) = %q, want %q", c.device, got, c.want)
+		}
+	}
+}
+
+func TestLookupDriverUnknown(t *testing.T) {
+	_, err := LookupDriver("zigbee")
+	if err == nil || !strings.Contains(err.Error(), "shelly") {
+		t.Fatalf("expected error listing available drivers, got %v", err)
+	}
+}
+
+func TestFetcherPathOverridesDriverPath(t *testing.T) {
+	d := Device{Instance: "shelly-1", Address: "10.0.0.9", Text: []string{"gen=2"}}
+
+	if got, want := (&Fetcher{}).URL(d), "http://10.0.0.9:80/rpc/Switch.GetStatus?id=0"; got != want {
+		t.Fatalf("expected driver path %q, got %q", want, got)
+	}
+	if got, want := (&Fetcher{Path: "/custom"}).URL(d), "http://10.0.0.9:80/custom"; got != want {
+		t.Fatalf("expected explicit path %q, got %q", want, got)
+	}
+}
+
+func TestSplitChannels(t *testing.T) {
+	f := &Fetcher{}
+	cases := []struct {
+		device Device
+		want   []string
+	}{
+		{Device{Instance: "Lamp"}, []string{""}},
+		{Device{Instance: "Office Plug", Channels: []string{"0", "1"}}, []string{"0", "1"}},
+		{Device{Instance: "Pro", Text: []string{"gen=2", "app=Pro4PM"}}, []string{"0", "1", "2", "3"}},
+		{Device{Instance: "Plus", Text: []string{"gen=2", "app=Plus1PM"}}, []string{""}},
+	}
+	for _, c := range cases {
+		var got []string
+		for _, d := range f.SplitChannels(c.device) {
+			if d.Instance != c.device.Instance {
+				t.Fatalf("expected channels of %s to keep its name, got %q", c.device.Instance, d.Instance)
+			}
+			got = append(got, d.Channel)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("SplitChannels(%s) = %q, want %q", c.device.Instance, got, c.want)
+		}
+	}
+}
+
+func TestChannelURLs(t *testing.T) {
+	tmpl, err := ParseURLTemplate("http://{addr}/meter/{channel}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		f      *Fetcher
+		device Device
+		want   string
+	}{
+		{&Fetcher{}, Device{Address: "10.0.0.9", Channel: "1"}, "http://10.0.0.9:80/api/power?channel=1"},
+		{&Fetcher{}, Device{Address: "10.0.0.9", Channel: "1", Text: []string{"gen=2"}}, "http://10.0.0.9:80/rpc/Switch.GetStatus?id=1"},
+		{&Fetcher{Path: "/status?x=1"}, Device{Address: "10.0.0.9", Channel: "a b"}, "http://10.0.0.9:80/status?x=1&channel=a+b"},
+		{&Fetcher{Template: tmpl}, Device{Address: "10.0.0.9", Channel: "1"}, "http://10.0.0.9/meter/1"},
+		{&Fetcher{}, Device{Address: "10.0.0.9"}, "http://10.0.0.9:80/api/power"},
+	}
+	for _, c := range cases {
+		if got := c.f.URL(c.device); got != c.want {
+			t.Errorf("URL(%+v) = %q, want %q", c.device, got, c.want)
+		}
+	}
+}
+
+func TestDecodeTasmotaChannels(t *testing.T) {
+	body := []byte(`{"StatusSNS":{"ENERGY":{"Power":[48,12],"Voltage":229,"Current":[0.266,0.05]}}}`)
+	info, err := decodeTasmota(body, "1")
+	if err != nil {
+		t.Fatalf("expected channel 1 to decode, got %v", err)
+	}
+	if info.CurrentWatts != 12 || info.Voltage != 229 || info.Amperage != 0.05 {
+		t.Fatalf("unexpected channel 1 reading %+v", info)
+	}
+	if info, err = decodeTasmota(body, ""); err != nil || info.CurrentWatts != 48 || info.Voltage != 229 {
+		t.Fatalf("expected the first channel by default, got %+v (%v)", info, err)
+	}
+	if _, err := decodeTasmota(body, "2"); err == nil {
+		t.Fatal("expected a missing channel to be rejected")
+	}
+}
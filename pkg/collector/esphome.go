@@ -0,0 +1,190 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// ESPHomeDriver is the name of the ESPHome web server driver.
+	ESPHomeDriver = "esphome"
+	// ESPHomeService is the service type ESPHome nodes advertise.
+	ESPHomeService = "_esphomelib._tcp"
+)
+
+// esphomeIndexes are the index pages listing a node's sensors, in the
+// order they are searched for a power sensor.
+var esphomeIndexes = []string{"sensor", "text_sensor"}
+
+// esphomeDriver reads a power sensor from the REST API of the ESPHome web
+// server, at /sensor/<id>. The sensor is the device's channel, then the
+// Fetcher's ESPHomeSensor, or else the first sensor whose state is in
+// watts, found through the index pages and remembered per device. The
+// web server's password is sent with the device's credentials.
+type esphomeDriver struct{}
+
+func (esphomeDriver) Name() string { return ESPHomeDriver }
+
+// Probe matches nodes discovered under ESPHomeService or configured with a
+// platform=esphome hint.
+func (esphomeDriver) Probe(d Device) bool {
+	if slices.Contains(d.Services, ESPHomeService) {
+		return true
+	}
+	platform, _ := txtValue(d, "platform")
+	return strings.EqualFold(platform, "esphome")
+}
+
+func (e esphomeDriver) Fetch(ctx context.Context, f *Fetcher, d Device) (*PowerInfo, error) {
+	path, err := e.sensorPath(ctx, f, d)
+	if err != nil {
+		return nil, err
+	}
+	u := f.urlFor(d, path, "")
+	if u == "" {
+		return nil, fmt.Errorf("device %q has no usable address", d.Instance)
+	}
+	body, err := f.get(ctx, u, f.requestFor(d))
+	if err != nil {
+		return nil, err
+	}
+	var state esphomeState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, &decodeError{fmt.Errorf("%s: decode response: %w", ESPHomeDriver, err)}
+	}
+	watts, err := state.watts()
+	if err != nil {
+		return nil, &decodeError{fmt.Errorf("%s: %w", ESPHomeDriver, err)}
+	}
+	return &PowerInfo{CurrentWatts: watts}, nil
+}
+
+// path returns the sensor path of d when it is known without a lookup,
+// and the first sensor index otherwise, for URL.
+func (esphomeDriver) path(f *Fetcher, d Device) string {
+	if path := f.esphomeSensorPath(d); path != "" {
+		return path
+	}
+	return "/" + esphomeIndexes[0]
+}
+
+// sensorPath returns the path of d's power sensor, searching the index
+// pages the first time d has none configured.
+func (esphomeDriver) sensorPath(ctx context.Context, f *Fetcher, d Device) (string, error) {
+	if path := f.esphomeSensorPath(d); path != "" || f.Template != nil {
+		return path, nil
+	}
+	r := f.requestFor(d)
+	for _, index := range esphomeIndexes {
+		u := f.pathURL(d, "/"+index, "")
+		if u == "" {
+			return "", fmt.Errorf("device %q has no usable address", d.Instance)
+		}
+		body, err := f.get(ctx, u, r)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		var states []esphomeState
+		if err := json.Unmarshal(body, &states); err != nil {
+			return "", &decodeError{fmt.Errorf("%s: decode /%s: %w", ESPHomeDriver, index, err)}
+		}
+		for _, st := range states {
+			if _, err := st.watts(); err == nil && st.unit() != "" {
+				path := "/" + index + "/" + url.PathEscape(st.objectID(index))
+				f.esphome.set(EndpointKey(d), path)
+				return path, nil
+			}
+		}
+	}
+	return "", &decodeError{fmt.Errorf("%s: no sensor reports power in W", ESPHomeDriver)}
+}
+
+// esphomeSensorPath returns the sensor path configured or found for d, or
+// an empty string. Configured paths take precedence, as in urlFor.
+func (f *Fetcher) esphomeSensorPath(d Device) string {
+	switch {
+	case d.Path != "":
+		return d.Path
+	case f.Path != "":
+		return f.Path
+	case d.Channel != "":
+		return "/sensor/" + url.PathEscape(d.Channel)
+	case f.ESPHomeSensor != "":
+		return "/sensor/" + url.PathEscape(f.ESPHomeSensor)
+	}
+	return f.esphome.get(EndpointKey(d))
+}
+
+// sensorCache remembers the power sensor found for each ESPHome node.
+type sensorCache struct {
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+func (c *sensorCache) get(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paths[key]
+}
+
+func (c *sensorCache) set(key, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paths == nil {
+		c.paths = make(map[string]string)
+	}
+	c.paths[key] = path
+}
+
+// esphomeState is a sensor state as the web server reports it, such as
+// {"id":"sensor-power","value":23.4,"state":"23.4 W"}.
+type esphomeState struct {
+	ID    string `json:"id"`
+	Value any    `json:"value"`
+	State string `json:"state"`
+}
+
+// objectID returns the sensor's id without the domain prefix of index.
+func (s esphomeState) objectID(index string) string {
+	return strings.TrimPrefix(s.ID, index+"-")
+}
+
+// unit returns the unit of the state string, if any.
+func (s esphomeState) unit() string {
+	_, unit, _ := strings.Cut(strings.TrimSpace(s.State), " ")
+	return strings.TrimSpace(unit)
+}
+
+// watts returns the sensor's power in watts. The state string is
+// preferred, so its unit can be converted; a state without a unit falls
+// back to the numeric value.
+func (s esphomeState) watts() (float64, error) {
+	number, unit, hasUnit := strings.Cut(strings.TrimSpace(s.State), " ")
+	if hasUnit {
+		scale, ok := powerUnits[strings.TrimSpace(unit)]
+		if !ok {
+			return 0, fmt.Errorf("sensor %q reports %q, not power", s.ID, unit)
+		}
+		v, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, fmt.Errorf("sensor %q has no reading: state %q", s.ID, s.State)
+		}
+		return v * scale, nil
+	}
+	if v, ok := s.Value.(float64); ok {
+		return v, nil
+	}
+	if v, err := strconv.ParseFloat(number, 64); err == nil {
+		return v, nil
+	}
+	return 0, fmt.Errorf("sensor %q has no reading: state %q", s.ID, s.State)
+}
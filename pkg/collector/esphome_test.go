@@ -0,0 +1,165 @@
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// esphomeServer serves the given paths, answering 404 elsewhere, and
+// records the paths requested.
+func esphomeServer(t *testing.T, pages map[string]string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func TestESPHomeStateWatts(t *testing.T) {
+	for state, want := range map[esphomeState]float64{
+		{State: "23.4 W"}:              23.4,
+		{State: "1.5 kW"}:              1500,
+		{State: "250 mW"}:              0.25,
+		{Value: 12.5, State: "12.5"}:   12.5,
+		{Value: 7.0, State: ""}:        7,
+		{State: "  42  W "}:            42,
+		{ID: "sensor-p", State: "9 W"}: 9,
+	} {
+		got, err := state.watts()
+		if err != nil || got != want {
+			t.Fatalf("%+v: expected %v W, got %v, %v", state, want, got, err)
+		}
+	}
+	for _, state := range []esphomeState{{State: "230 V"}, {State: "NA W"}, {State: "unknown"}} {
+		if _, err := state.watts(); err == nil {
+			t.Fatalf("%+v: expected an error", state)
+		}
+	}
+}
+
+func TestESPHomeProbe(t *testing.T) {
+	for _, d := range []Device{
+		{Instance: "dryer", Services: []string{ESPHomeService}},
+		{Instance: "dryer", Text: []string{"platform=ESPHome"}},
+	} {
+		if got := SelectDriver(d).Name(); got != ESPHomeDriver {
+			t.Fatalf("%+v: expected the esphome driver, got %s", d, got)
+		}
+	}
+	if (esphomeDriver{}).Probe(Device{Instance: "dryer", Text: []string{"platform=tasmota"}}) {
+		t.Fatal("expected other platforms not to match")
+	}
+}
+
+func TestESPHomeDriverReadsConfiguredSensor(t *testing.T) {
+	server, requests := esphomeServer(t, map[string]string{
+		"/sensor/power_consumption": `{"id":"sensor-power_consumption","value":0.5,"state":"0.5 kW"}`,
+		"/sensor/dryer":             `{"id":"sensor-dryer","value":812,"state":"812 W"}`,
+	})
+	d, port := serverDevice(server)
+	d.Driver = ESPHomeDriver
+
+	f := &Fetcher{Port: port, ESPHomeSensor: "power_consumption"}
+	if got, want := f.URL(d), server.URL+"/sensor/power_consumption"; got != want {
+		t.Fatalf("expected URL %q, got %q", want, got)
+	}
+	info, err := f.Fetch(context.Background(), d)
+	if err != nil || info.CurrentWatts != 500 {
+		t.Fatalf("expected 500 W, got %+v, %v", info, err)
+	}
+
+	d.Channel = "dryer"
+	if info, err := f.Fetch(context.Background(), d); err != nil || info.CurrentWatts != 812 {
+		t.Fatalf("expected the channel's sensor, got %+v, %v", info, err)
+	}
+	if got := requests(); len(got) != 2 {
+		t.Fatalf("expected no index lookups, got %v", got)
+	}
+}
+
+func TestESPHomeDriverFindsPowerSensor(t *testing.T) {
+	for name, pages := range map[string]map[string]string{
+		"sensor": {
+			"/sensor":                   `[{"id":"sensor-voltage","value":231,"state":"231 V"},{"id":"sensor-power_consumption","value":23.4,"state":"23.4 W"}]`,
+			"/sensor/power_consumption": `{"id":"sensor-power_consumption","value":23.4,"state":"23.4 W"}`,
+		},
+		"text_sensor": {
+			"/text_sensor":      `[{"id":"text_sensor-version","state":"2024.6.1"},{"id":"text_sensor-load","state":"23.4 W"}]`,
+			"/text_sensor/load": `{"id":"text_sensor-load","state":"23.4 W"}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, requests := esphomeServer(t, pages)
+			d, port := serverDevice(server)
+			d.Services = []string{ESPHomeService}
+
+			f := &Fetcher{Port: port}
+			for range 2 {
+				info, err := f.Fetch(context.Background(), d)
+				if err != nil || info.CurrentWatts != 23.4 {
+					t.Fatalf("expected 23.4 W, got %+v, %v", info, err)
+				}
+			}
+			want := 3
+			if name == "text_sensor" {
+				want = 4
+			}
+			if got := requests(); len(got) != want {
+				t.Fatalf("expected the sensor to be looked up once, got %v", got)
+			}
+		})
+	}
+}
+
+func TestESPHomeDriverWithoutPowerSensor(t *testing.T) {
+	server, _ := esphomeServer(t, map[string]string{
+		"/sensor": `[{"id":"sensor-temperature","value":21,"state":"21 °C"}]`,
+	})
+	d, port := serverDevice(server)
+	d.Driver = ESPHomeDriver
+
+	_, err := (&Fetcher{Port: port}).Fetch(context.Background(), d)
+	if FailureReason(err) != ReasonDecodeError {
+		t.Fatalf("expected a decode error, got %v", err)
+	}
+}
+
+func TestESPHomeDriverSendsWebServerPassword(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "hunter2" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Login Required"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"id":"sensor-power","value":5,"state":"5 W"}`)
+	}))
+	defer server.Close()
+	d, port := serverDevice(server)
+	d.Driver = ESPHomeDriver
+	d.Channel = "power"
+	d.Auth = Credentials{Username: "admin", Password: "hunter2"}
+
+	info, err := (&Fetcher{Port: port}).Fetch(context.Background(), d)
+	if err != nil || info.CurrentWatts != 5 {
+		t.Fatalf("expected the password to be sent, got %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,806 @@
+package collector
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/clock"
+)
+
+const (
+	// DefaultHTTPTimeout bounds each device power query.
+	DefaultHTTPTimeout = 5 * time.Second
+	// DefaultRetryBackoff is the delay before the first retry of a failed
+	// query.
+	DefaultRetryBackoff = 500 * time.Millisecond
+	// DefaultMaxRetryAfter is the longest Retry-After delay a query waits
+	// out before retrying.
+	DefaultMaxRetryAfter = 30 * time.Second
+	// DefaultMaxResponseBytes is the largest response body, once
+	// decompressed, a query reads.
+	DefaultMaxResponseBytes = 64 << 10
+)
+
+// Fetcher queries device power endpoints over HTTP or HTTPS. A Fetcher
+// reuses one HTTP client across queries and must not be copied after first
+// use.
+type Fetcher struct {
+	// Timeout bounds each query, its retries included. Zero means
+	// DefaultHTTPTimeout.
+	Timeout time.Duration
+	// HeaderTimeout bounds the wait for a response's headers once a
+	// request is sent, through the transport's ResponseHeaderTimeout. It
+	// does not apply to a Transport set below. Zero leaves it to Timeout.
+	HeaderTimeout time.Duration
+	// BodyTimeout bounds the read of a response's body once its headers
+	// have arrived, so that a device trickling its body is given up on
+	// early. Zero leaves it to Timeout. A body that does not arrive in
+	// time fails with the ReasonBodyTimeout reason and is not retried,
+	// since the next attempt would only be tied up the same way.
+	BodyTimeout time.Duration
+	// Scheme is "http" or "https". Empty means "http".
+	Scheme string
+	// Port overrides the scheme's default port when positive.
+	Port int
+	// Path overrides the driver's power endpoint path when set.
+	Path string
+	// Template, when set, replaces the scheme, address, port and path
+	// used to build each device's URL.
+	Template *URLTemplate
+	// TLSConfig configures HTTPS connections. Nil uses the system roots.
+	TLSConfig *tls.Config
+	// Driver forces a driver for every device. Nil selects one per device
+	// by probing.
+	Driver Driver
+	// Fields, when set, replaces the HTTP driver's decoding with dotted
+	// JSON path extraction.
+	Fields FieldPaths
+	// Retries is how many times a query is retried after a connection
+	// error, timeout or 5xx response.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubled for each
+	// further one and jittered. Zero means DefaultRetryBackoff.
+	RetryBackoff time.Duration
+	// MaxRetryAfter is the longest delay asked for by a 429 response's
+	// Retry-After header that is waited out before retrying; longer ones
+	// end the query. Zero means DefaultMaxRetryAfter.
+	MaxRetryAfter time.Duration
+	// Auth authenticates every query, unless a device has its own.
+	Auth Credentials
+	// Transport, when set, carries every request instead of one built
+	// from TLSConfig, so responses can be recorded or replayed.
+	Transport http.RoundTripper
+	// TimestampLayout is a time.Parse layout tried before the built-in
+	// forms when parsing device timestamps.
+	TimestampLayout string
+	// MaxSkew is how far in the future a device timestamp may lie before
+	// the fetch time is used instead. Zero means DefaultMaxSkew.
+	MaxSkew time.Duration
+	// TimestampWarning, when set, is told about device timestamps that
+	// could not be parsed or were too far in the future.
+	TimestampWarning func(d Device, err error)
+	// ProbeEndpoints tries well-known endpoints on devices that answer
+	// 404 on their configured path. It does not apply with a Template or
+	// Fields.
+	ProbeEndpoints bool
+	// EndpointProbed, when set, is told about each endpoint found by
+	// probing, so it can be restored with LearnEndpoints after a restart.
+	EndpointProbed func(d Device, path string)
+	// ConnectByHostName queries devices on their HostName rather than
+	// their Address, looked up by the system resolver, which answers
+	// .local names with Avahi or systemd-resolved where they run. A
+	// device whose host name does not resolve is queried on its address.
+	ConnectByHostName bool
+	// HostNameFailed, when set, is told each time a device is queried on
+	// its address because its host name did not resolve.
+	HostNameFailed func(d Device, err error)
+	// AddressSwitched, when set, is told each time a device that could
+	// not be reached on one address answers on another, so the address
+	// can be restored with LearnAddresses after a restart.
+	AddressSwitched func(d Device, from, to string)
+	// Limiter, when set, paces every attempt sent, including retries and
+	// probes; the answer to an authentication challenge goes out in its
+	// attempt's slot. Time queued on it is not charged to a query's
+	// timeout.
+	Limiter *Limiter
+	// Validator, when set, checks every reading for implausible values.
+	Validator *Validator
+	// AttemptDone, when set, is told how long each attempt of a query
+	// took on its own and how it ended; every retry is an attempt.
+	AttemptDone func(url string, attempt int, elapsed time.Duration, err error)
+	// HTTPTrace, when set, is told the DNS, connect, TLS and first-byte
+	// timings of every request sent.
+	HTTPTrace func(url string, t HTTPTiming)
+	// ESPHomeSensor is the id of the sensor the esphome driver reads,
+	// such as "power_consumption". Empty means the first sensor reporting
+	// power in watts.
+	ESPHomeSensor string
+	// MaxResponseBytes is the largest response body, once decompressed,
+	// a query reads; a larger one fails it. Zero means
+	// DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+	// ContentTypeWarning, when set, is told the first time each URL
+	// answers with a Content-Type other than JSON. The body is decoded
+	// all the same.
+	ContentTypeWarning func(url, contentType string)
+	// UserAgent, when set, is sent as the User-Agent header of every
+	// request.
+	UserAgent string
+	// Clock, when set, replaces the system clock for fetch times, latency
+	// and retry backoff.
+	Clock clock.Clock
+
+	once      sync.Once
+	warned    sync.Map
+	client    *http.Client
+	auth      authCache
+	endpoints endpointCache
+	addresses addressCache
+	esphome   sensorCache
+}
+
+// NewTLSConfig returns the TLS configuration for HTTPS devices. Unless
+// verification is skipped, the system roots are trusted along with any
+// certificates in the optional PEM bundle at caFile.
+func NewTLSConfig(insecureSkipVerify bool, caFile string) (*tls.Config, error) {
+	if insecureSkipVerify {
+		return &tls.Config{InsecureSkipVerify: true}, nil // #nosec G402 -- explicitly requested for self-signed devices
+	}
+	if caFile == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(caFile) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %s contains no PEM certificates", caFile)
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
+
+// FetchPower queries the device's power endpoint with default settings.
+func FetchPower(ctx context.Context, d Device) (*PowerInfo, error) {
+	return (&Fetcher{}).Fetch(ctx, d)
+}
+
+// DriverFor returns the driver used to query d: the device's own driver,
+// then the Fetcher's, then one selected by probing.
+func (f *Fetcher) DriverFor(d Device) Driver {
+	if d.Driver != "" {
+		if drv, err := LookupDriver(d.Driver); err == nil {
+			return drv
+		}
+	}
+	if f.Driver != nil {
+		return f.Driver
+	}
+	return SelectDriver(d)
+}
+
+// URL returns the URL of the device's power endpoint, or an empty string
+// when the device has no usable address.
+func (f *Fetcher) URL(d Device) string {
+	d, _ = f.byHostName(d)
+	switch drv := f.DriverFor(d).(type) {
+	case *httpDriver:
+		return f.urlFor(d, drv.path, drv.channelParam)
+	case kasaDriver:
+		return drv.url(d)
+	case esphomeDriver:
+		return f.urlFor(d, drv.path(f, d), "")
+	}
+	return f.urlFor(d, DefaultPowerPath, "channel")
+}
+
+// SplitChannels returns one device per meter channel of d, each with its
+// Channel set, or d alone when it has a single unnamed channel. The
+// channels are d's own, or else those its driver probes.
+func (f *Fetcher) SplitChannels(d Device) []Device {
+	channels := d.Channels
+	if len(channels) == 0 {
+		if p, ok := f.DriverFor(d).(ChannelProber); ok {
+			channels = p.Channels(d)
+		}
+	}
+	if len(channels) == 0 || d.Channel != "" {
+		return []Device{d}
+	}
+	split := make([]Device, len(channels))
+	for i, ch := range channels {
+		split[i] = d
+		split[i].Channel = ch
+	}
+	return split
+}
+
+// urlFor builds the URL for d, using driverPath unless a path or template
+// was configured. The device's own port and path take precedence. The
+// channel of a multi-channel device is set as the channelParam query
+// parameter, unless a template places it with {channel}.
+func (f *Fetcher) urlFor(d Device, driverPath, channelParam string) string {
+	if f.Template != nil {
+		return f.Template.Expand(d, f.port(d))
+	}
+	path := d.Path
+	if path == "" {
+		path = f.Path
+	}
+	if path == "" {
+		path = driverPath
+	}
+	return f.pathURL(d, path, channelParam)
+}
+
+// pathURL builds the URL of path on d, or an empty string when d has no
+// usable address.
+func (f *Fetcher) pathURL(d Device, path, channelParam string) string {
+	if d.Address == "" {
+		return ""
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if d.Channel != "" && channelParam != "" {
+		path = withQuery(path, channelParam, d.Channel)
+	}
+	return f.scheme() + "://" + hostPort(d.Address, f.port(d)) + path
+}
+
+func (f *Fetcher) scheme() string {
+	if f.Scheme == "" {
+		return "http"
+	}
+	return f.Scheme
+}
+
+// port returns the port d is queried on: its own, then the Fetcher's,
+// then the scheme's default.
+func (f *Fetcher) port(d Device) int {
+	if d.Port > 0 {
+		return d.Port
+	}
+	if f.Port > 0 {
+		return f.Port
+	}
+	if f.scheme() == "https" {
+		return 443
+	}
+	return 80
+}
+
+// withQuery sets the query parameter key of path to value, leaving the
+// rest of the path as it was given.
+func withQuery(path, key, value string) string {
+	base, query, _ := strings.Cut(path, "?")
+	var kept []string
+	for _, param := range strings.Split(query, "&") {
+		if name, _, _ := strings.Cut(param, "="); param != "" && name != key {
+			kept = append(kept, param)
+		}
+	}
+	kept = append(kept, key+"="+url.QueryEscape(value))
+	return base + "?" + strings.Join(kept, "&")
+}
+
+// Fetch queries the device using its driver, converts power reported in
+// the device's Unit to watts, normalises the reading's timestamp, records
+// the query's total time, retries included, as its Latency, and checks it
+// with the Validator. The device's timeout bounds the whole query on an
+// address, its retries and the backoff between them included, but not
+// the time it is held back by the Limiter. A disabled device is an error.
+// With ProbeEndpoints set, a device answering 404 is probed for a
+// well-known endpoint, which is then used for the rest of the session. A
+// device that cannot be reached on its address is tried on its other
+// Addresses, and the one that answers is used from then on. With
+// ConnectByHostName, a device is queried on its host name first.
+func (f *Fetcher) Fetch(ctx context.Context, d Device) (*PowerInfo, error) {
+	if d.Disabled {
+		return nil, fmt.Errorf("device %q is disabled", d.Instance)
+	}
+	if byName, ok := f.byHostName(d); ok {
+		info, err := f.fetchDevice(ctx, byName)
+		if !isResolutionError(err) || d.Address == "" || ctx.Err() != nil {
+			return info, err
+		}
+		if f.HostNameFailed != nil {
+			f.HostNameFailed(d, err)
+		}
+	}
+	return f.fetchFallback(ctx, d)
+}
+
+// fetchDevice queries d on its address, within d's timeout.
+func (f *Fetcher) fetchDevice(ctx context.Context, d Device) (*PowerInfo, error) {
+	clk := clock.Or(f.Clock)
+	start := clk.Now()
+	ctx = withBudget(ctx, start, f.requestFor(d).timeout)
+	var info *PowerInfo
+	var err error
+	unit := d.Unit
+	if ep := f.endpoint(d); ep != nil {
+		info, err = ep.fetchURL(ctx, f, d, f.pathURL(d, ep.path, ep.channelParam), false)
+	} else {
+		drv := f.DriverFor(d)
+		info, err = drv.Fetch(ctx, f, d)
+		if err != nil && f.canProbe() && isNotFound(err) {
+			info, err = f.probe(ctx, d, err)
+		} else if reportsUnit(drv) {
+			unit = ""
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := clk.Now()
+	info.Latency = now.Sub(start)
+	if err := f.complete(info, d, unit, now); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// complete converts info from unit to watts, normalises its timestamp
+// against now, derives the power values it lacks and checks it with the
+// Validator.
+func (f *Fetcher) complete(info *PowerInfo, d Device, unit string, now time.Time) error {
+	info.convertUnit(unit)
+	f.stamp(info, d, now)
+	info.derivePower()
+	if f.Validator != nil {
+		if err := f.Validator.check(d, info); err != nil {
+			return err
+		}
+	}
+	flagPowerFactor(info)
+	return nil
+}
+
+func fetchPower(ctx context.Context, url string) (*PowerInfo, error) {
+	return (&Fetcher{}).fetch(ctx, url)
+}
+
+// fetch GETs url and decodes it as a generic PowerInfo document.
+func (f *Fetcher) fetch(ctx context.Context, url string) (*PowerInfo, error) {
+	body, err := f.get(ctx, url, f.requestFor(Device{}))
+	if err != nil {
+		return nil, err
+	}
+	info, err := decodeGeneric(body, "")
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+	return info, nil
+}
+
+func (f *Fetcher) httpClient() *http.Client {
+	f.once.Do(func() {
+		transport := f.Transport
+		if transport == nil {
+			t := NewTransport(f.TLSConfig)
+			t.ResponseHeaderTimeout = f.HeaderTimeout
+			transport = t
+		}
+		// Each request is bounded by its device's timeout instead.
+		f.client = &http.Client{Transport: transport}
+	})
+	return f.client
+}
+
+func (f *Fetcher) timeout() time.Duration {
+	if f.Timeout <= 0 {
+		return DefaultHTTPTimeout
+	}
+	return f.Timeout
+}
+
+// request holds the settings of one device's queries.
+type request struct {
+	creds   Credentials
+	timeout time.Duration
+	retries int
+}
+
+// requestFor returns the settings for querying d: its own credentials,
+// timeout and retries where set, and the Fetcher's otherwise.
+func (f *Fetcher) requestFor(d Device) request {
+	req := request{creds: f.credentials(d), timeout: f.timeout(), retries: f.Retries}
+	if d.Timeout > 0 {
+		req.timeout = d.Timeout
+	}
+	if d.Retries != nil {
+		req.retries = *d.Retries
+	}
+	return req
+}
+
+// queryBudget is the time one query of a device may take: its attempts,
+// the backoff between them and any probes. Unlike a context deadline it
+// is pushed back by the time the query is held back by the Limiter, so
+// that requests spaced out for a device do not time out before they are
+// sent. A query runs on one goroutine, which alone uses its budget.
+type queryBudget struct {
+	deadline time.Time
+}
+
+type budgetKey struct{}
+
+// withBudget returns ctx carrying a queryBudget of timeout from now.
+func withBudget(ctx context.Context, now time.Time, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, budgetKey{}, &queryBudget{deadline: now.Add(timeout)})
+}
+
+// budgetOf returns the budget of the query on ctx, or nil.
+func budgetOf(ctx context.Context) *queryBudget {
+	b, _ := ctx.Value(budgetKey{}).(*queryBudget)
+	return b
+}
+
+// timeLeft returns how long the query on ctx may still take: the rest of
+// its budget or of ctx's deadline, whichever is sooner. ok is false when
+// it has neither.
+func (f *Fetcher) timeLeft(ctx context.Context) (left time.Duration, ok bool) {
+	now := clock.Or(f.Clock).Now()
+	if deadline, has := ctx.Deadline(); has {
+		left, ok = deadline.Sub(now), true
+	}
+	if b := budgetOf(ctx); b != nil && (!ok || b.deadline.Sub(now) < left) {
+		left, ok = b.deadline.Sub(now), true
+	}
+	return left, ok
+}
+
+// spent reports whether the query on ctx has ended or has no time left.
+func (f *Fetcher) spent(ctx context.Context) bool {
+	left, ok := f.timeLeft(ctx)
+	return ctx.Err() != nil || ok && left <= 0
+}
+
+// attemptTimeout returns how long the next attempt of the query on ctx
+// may take: what is left of its budget, or r's timeout without one.
+func (f *Fetcher) attemptTimeout(ctx context.Context, r request) time.Duration {
+	if b := budgetOf(ctx); b != nil {
+		return b.deadline.Sub(clock.Or(f.Clock).Now())
+	}
+	return r.timeout
+}
+
+// wait waits on ctx for the Limiter to let a request to host go, pushing
+// back the budget of the query on ctx by the time waited.
+func (f *Fetcher) wait(ctx context.Context, host string) error {
+	if f.Limiter == nil {
+		return nil
+	}
+	waited, err := f.Limiter.Wait(ctx, host)
+	if b := budgetOf(ctx); b != nil && err == nil {
+		b.deadline = b.deadline.Add(waited)
+	}
+	return err
+}
+
+// NewTransport returns the HTTP transport used for device queries, with
+// the given TLS configuration.
+func NewTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
+
+// statusError reports a non-200 response.
+type statusError struct {
+	status string
+	code   int
+	body   string
+	// retryAfter is the delay asked for by a 429 response, if any.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.status, e.body)
+}
+
+// get performs a GET request with the settings of r and returns the body
+// of a 200 response, retrying transient failures.
+func (f *Fetcher) get(ctx context.Context, url string, r request) ([]byte, error) {
+	return f.retry(ctx, url, r, func() ([]byte, error) { return f.getOnce(ctx, url, r) })
+}
+
+// retry calls once, a query of target, until it succeeds, retrying
+// transient failures up to r's retries with jittered exponential backoff.
+// A 429 response is retried after its Retry-After delay instead, unless
+// that exceeds MaxRetryAfter. Retries stop early when ctx or the query's
+// budget would run out before the next attempt.
+func (f *Fetcher) retry(ctx context.Context, target string, r request, once func() ([]byte, error)) ([]byte, error) {
+	backoff := f.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	clk := clock.Or(f.Clock)
+	for attempt := 1; ; attempt++ {
+		start := clk.Now()
+		body, err := once()
+		if f.AttemptDone != nil {
+			f.AttemptDone(target, attempt, clk.Now().Sub(start), err)
+		}
+		if err == nil {
+			return body, nil
+		}
+		if attempt > r.retries || !retryable(ctx, err) {
+			return nil, attemptsError(r, attempt, err)
+		}
+
+		wait := jitter(backoff << (attempt - 1))
+		if after, ok := RetryAfter(err); ok && after > 0 {
+			if after > f.maxRetryAfter() {
+				return nil, attemptsError(r, attempt, err)
+			}
+			wait = after
+		}
+		if left, ok := f.timeLeft(ctx); ok && left < wait {
+			return nil, attemptsError(r, attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, attemptsError(r, attempt, err)
+		case <-clk.After(wait):
+		}
+	}
+}
+
+// attemptsError notes the number of attempts in err when r has retries.
+func attemptsError(r request, attempts int, err error) error {
+	if r.retries <= 0 {
+		return err
+	}
+	return fmt.Errorf("after %d attempts: %w", attempts, err)
+}
+
+func (f *Fetcher) maxRetryAfter() time.Duration {
+	if f.MaxRetryAfter <= 0 {
+		return DefaultMaxRetryAfter
+	}
+	return f.MaxRetryAfter
+}
+
+// retryable reports whether err is a connection error, timeout, 429 or
+// 5xx response, over HTTP or a raw connection, unless ctx itself has
+// ended.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	var ue *url.Error
+	var oe *net.OpError
+	return errors.As(err, &ue) || errors.As(err, &oe)
+}
+
+// jitter returns a random duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2) // #nosec G404 -- jitter needs no cryptographic randomness
+}
+
+// getOnce performs a single GET request once the Limiter lets it go,
+// within r's timeout or what is left of the query's budget. A 401
+// challenge that r's credentials can answer is retried once with the
+// computed authorization.
+func (f *Fetcher) getOnce(ctx context.Context, url string, r request) ([]byte, error) {
+	if err := f.wait(ctx, hostOf(url)); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.attemptTimeout(ctx, r))
+	defer cancel()
+	ctx, cancelBody := context.WithCancelCause(ctx)
+	defer cancelBody(nil)
+	for challenged := false; ; challenged = true {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if f.UserAgent != "" {
+			req.Header.Set("User-Agent", f.UserAgent)
+		}
+		// Setting Accept-Encoding leaves decompression to readBody, so
+		// that it also happens with a recording or replaying Transport.
+		req.Header.Set("Accept-Encoding", "gzip")
+		if err := f.authorize(req, r.creds); err != nil {
+			return nil, err
+		}
+
+		var timing HTTPTiming
+		if f.HTTPTrace != nil {
+			req = req.WithContext(withTiming(req.Context(), &timing))
+		}
+		resp, err := f.httpClient().Do(req)
+		if f.HTTPTrace != nil {
+			f.HTTPTrace(url, timing)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && !challenged && f.learnChallenge(resp, r.creds) {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			continue
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			var body []byte
+			if reader, err := decodedBody(resp); err == nil {
+				body, _ = io.ReadAll(io.LimitReader(reader, 512))
+			}
+			se := &statusError{status: resp.Status, code: resp.StatusCode, body: strings.TrimSpace(string(body))}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				se.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), clock.Or(f.Clock).Now())
+			}
+			return nil, se
+		}
+		f.checkContentType(url, resp.Header.Get("Content-Type"))
+		clk := clock.Or(f.Clock)
+		started := clk.Now()
+		if f.BodyTimeout > 0 {
+			expired, read := clk.After(f.BodyTimeout), make(chan struct{})
+			defer close(read)
+			go func() {
+				select {
+				case <-expired:
+					cancelBody(errBodyTimeout)
+				case <-read:
+				}
+			}()
+		}
+		body, err := f.readBody(url, resp)
+		if err != nil && bodyTimedOut(ctx, err) {
+			return nil, &bodyTimeoutError{after: clk.Now().Sub(started)}
+		}
+		return body, err
+	}
+}
+
+// errBodyTimeout cancels a request whose body outlasts BodyTimeout.
+var errBodyTimeout = errors.New("body timeout")
+
+// bodyTimeoutError reports a response whose headers arrived but whose
+// body did not, within BodyTimeout or the query's timeout.
+type bodyTimeoutError struct {
+	after time.Duration
+}
+
+func (e *bodyTimeoutError) Error() string {
+	return fmt.Sprintf("body read timeout: response body incomplete after %s", e.after.Round(time.Millisecond))
+}
+
+// bodyTimedOut reports whether reading a body on ctx failed with err
+// because time ran out, rather than because the device broke off.
+func bodyTimedOut(ctx context.Context, err error) bool {
+	if errors.Is(context.Cause(ctx), errBodyTimeout) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// readBody reads the body of resp, decompressing it, up to
+// MaxResponseBytes.
+func (f *Fetcher) readBody(url string, resp *http.Response) ([]byte, error) {
+	r, err := decodedBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	limit := f.maxResponseBytes()
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, &decodeError{fmt.Errorf("response from %s is larger than the %d-byte limit", url, limit)}
+	}
+	return body, nil
+}
+
+// decodedBody returns the body of resp, decompressed according to its
+// Content-Encoding.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, &decodeError{fmt.Errorf("decompress response: %w", err)}
+		}
+		return zr, nil
+	default:
+		return nil, &decodeError{fmt.Errorf("unsupported content encoding %q", encoding)}
+	}
+}
+
+func (f *Fetcher) maxResponseBytes() int64 {
+	if f.MaxResponseBytes <= 0 {
+		return DefaultMaxResponseBytes
+	}
+	return f.MaxResponseBytes
+}
+
+// checkContentType tells ContentTypeWarning, once per URL, about a
+// response that is not declared as JSON. A missing Content-Type passes.
+func (f *Fetcher) checkContentType(url, contentType string) {
+	if f.ContentTypeWarning == nil || contentType == "" {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return
+	}
+	if _, warned := f.warned.LoadOrStore(url, true); !warned {
+		f.ContentTypeWarning(url, contentType)
+	}
+}
+
+// hostOf returns the host of rawURL, which the Limiter paces requests to.
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// RetryAfter reports whether err is a 429 Too Many Requests response, and
+// the delay its Retry-After header asked for, or zero without one.
+func RetryAfter(err error) (time.Duration, bool) {
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusTooManyRequests {
+		return 0, false
+	}
+	return se.retryAfter, true
+}
+
+// parseRetryAfter parses a Retry-After value, either delta-seconds or an
+// HTTP date, into a delay from now. Invalid or past values are zero.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs <= 0 || secs > math.MaxInt64/int64(time.Second) {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
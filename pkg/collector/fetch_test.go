@@ -0,0 +1,631 @@
+package collector
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/testsupport"
+)
+
+func TestFetchPowerSuccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"deviceName":"Lamp","currentWatts":12.5,"timestamp":"2024-02-02T15:04:05Z"}`)
+	}))
+	defer server.Close()
+
+	info, err := fetchPower(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+
+	if info.DeviceName != "Lamp" || info.CurrentWatts != 12.5 || info.RawTimestamp != "2024-02-02T15:04:05Z" {
+		t.Fatalf("unexpected PowerInfo: %+v", info)
+	}
+}
+
+func TestFetchPowerNonOK(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if _, err := fetchPower(context.Background(), server.URL); err == nil || !strings.Contains(err.Error(), "unexpected status 500") {
+		t.Fatalf("expected status error, got %v", err)
+	}
+}
+
+func TestFetchPowerDecodeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "not-json")
+	}))
+	defer server.Close()
+
+	if _, err := fetchPower(context.Background(), server.URL); err == nil {
+		t.Fatal("expected decode error, got nil")
+	}
+}
+
+func TestFetcherDecompressesGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/json" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, `{"currentWatts":12.5}`)
+		zw.Close()
+	}))
+	defer server.Close()
+
+	info, err := fetchPower(context.Background(), server.URL)
+	if err != nil || info.CurrentWatts != 12.5 {
+		t.Fatalf("expected the gzip body to be decoded, got %+v, %v", info, err)
+	}
+}
+
+func TestFetcherSendsUserAgent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":1,"deviceName":"`+r.UserAgent()+`"}`)
+	}))
+	defer server.Close()
+
+	f := &Fetcher{UserAgent: "powerusagecollection/1.4.0"}
+	if info, err := f.fetch(context.Background(), server.URL); err != nil || info.DeviceName != "powerusagecollection/1.4.0" {
+		t.Fatalf("expected the User-Agent to be sent, got %+v, %v", info, err)
+	}
+}
+
+func TestFetcherLimitsResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `{"currentWatts":12.5,"debug":"` + strings.Repeat("x", 2000) + `"}`
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, body)
+			zw.Close()
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	f := &Fetcher{MaxResponseBytes: 1024}
+	for _, path := range []string{"/", "/gzip"} {
+		_, err := f.fetch(context.Background(), server.URL+path)
+		if err == nil || !strings.Contains(err.Error(), "larger than the 1024-byte limit") || FailureReason(err) != ReasonDecodeError {
+			t.Fatalf("%s: expected the size limit to fail the query, got %v", path, err)
+		}
+	}
+	f.MaxResponseBytes = 4096
+	if info, err := f.fetch(context.Background(), server.URL+"/gzip"); err != nil || info.CurrentWatts != 12.5 {
+		t.Fatalf("expected a body within the limit to be read, got %+v, %v", info, err)
+	}
+}
+
+func TestFetcherWarnsAboutContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case "/vendor":
+			w.Header().Set("Content-Type", "application/vnd.device+json")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+		}
+		io.WriteString(w, `{"currentWatts":12.5}`)
+	}))
+	defer server.Close()
+
+	var warnings []string
+	f := &Fetcher{ContentTypeWarning: func(url, contentType string) {
+		warnings = append(warnings, strings.TrimPrefix(url, server.URL)+" "+contentType)
+	}}
+	for _, path := range []string{"/html", "/html", "/vendor", "/"} {
+		if info, err := f.fetch(context.Background(), server.URL+path); err != nil || info.CurrentWatts != 12.5 {
+			t.Fatalf("%s: expected the body to be decoded anyway, got %+v, %v", path, info, err)
+		}
+	}
+	if len(warnings) != 1 || warnings[0] != "/html text/html; charset=utf-8" {
+		t.Fatalf("expected one warning about the HTML response, got %q", warnings)
+	}
+}
+
+func TestFetchPowerWithoutAddress(t *testing.T) {
+	if _, err := FetchPower(context.Background(), Device{Instance: "Nowhere"}); err == nil {
+		t.Fatal("expected error for device without address, got nil")
+	}
+}
+
+type fakeResolver struct {
+	entries []*ServiceEntry
+}
+
+func TestFetcherTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, `{"currentWatts":1}`)
+	}))
+	defer server.Close()
+
+	f := &Fetcher{Timeout: 20 * time.Millisecond}
+	start := time.Now()
+	if _, err := f.fetch(context.Background(), server.URL); err == nil {
+		t.Fatal("expected timeout error, got nil")
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatalf("expected fetch to give up after the timeout, took %v", elapsed)
+	}
+}
+
+// tricklingServer flushes its headers at once and then sends its JSON
+// body a chunk at a time, gap apart, until the client gives up.
+func tricklingServer(t *testing.T, gap time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	calls := new(atomic.Int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.(http.Flusher).Flush()
+		for _, chunk := range []string{`{"current`, `Watts":`, `1}`} {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(gap):
+			}
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func TestFetcherBodyTimeout(t *testing.T) {
+	server, calls := tricklingServer(t, 300*time.Millisecond)
+
+	f := &Fetcher{Timeout: 5 * time.Second, BodyTimeout: 100 * time.Millisecond, Retries: 2, RetryBackoff: time.Millisecond}
+	start := time.Now()
+	_, err := f.fetch(context.Background(), server.URL)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("expected the fetch aborted at the body deadline, took %v", elapsed)
+	}
+	if FailureReason(err) != ReasonBodyTimeout || !strings.Contains(err.Error(), "body read timeout") {
+		t.Fatalf("expected a body read timeout, got %q (%v)", FailureReason(err), err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected a body timeout not retried, got %d attempts", got)
+	}
+
+	f = &Fetcher{Timeout: 100 * time.Millisecond}
+	if _, err := f.fetch(context.Background(), server.URL); FailureReason(err) != ReasonBodyTimeout {
+		t.Fatalf("expected a body cut off by the query timeout classified as a body timeout, got %v", err)
+	}
+
+	server, _ = tricklingServer(t, 10*time.Millisecond)
+	f = &Fetcher{BodyTimeout: time.Second}
+	if info, err := f.fetch(context.Background(), server.URL); err != nil || info.CurrentWatts != 1 {
+		t.Fatalf("expected a body within the deadline read, got %+v, %v", info, err)
+	}
+}
+
+func TestFetcherBodyTimeoutUsesClock(t *testing.T) {
+	server, _ := tricklingServer(t, time.Hour)
+	clk := testsupport.NewFakeClock(time.Unix(0, 0))
+	f := &Fetcher{Timeout: 5 * time.Second, BodyTimeout: 30 * time.Second, Clock: clk}
+	done := fetchAsync(f, server.URL)
+
+	clk.BlockUntil(1)
+	clk.Advance(30 * time.Second)
+	if err := <-done; FailureReason(err) != ReasonBodyTimeout || !strings.Contains(err.Error(), "after 30s") {
+		t.Fatalf("expected a body read timeout after 30s on the clock, got %q (%v)", FailureReason(err), err)
+	}
+}
+
+func TestFetcherHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	f := &Fetcher{Timeout: 5 * time.Second, HeaderTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := f.fetch(context.Background(), server.URL)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("expected the fetch aborted at the header deadline, took %v", elapsed)
+	}
+	if FailureReason(err) != ReasonTimeout {
+		t.Fatalf("expected a header timeout classified as a timeout, got %q (%v)", FailureReason(err), err)
+	}
+}
+
+func tlsServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"deviceName":"Plug","currentWatts":7.5}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetcherRejectsUntrustedCertificate(t *testing.T) {
+	server := tlsServer(t)
+
+	f := &Fetcher{}
+	if _, err := f.fetch(context.Background(), server.URL); err == nil {
+		t.Fatal("expected certificate verification error, got nil")
+	}
+}
+
+func TestFetcherSkipVerify(t *testing.T) {
+	server := tlsServer(t)
+
+	cfg, err := NewTLSConfig(true, "")
+	if err != nil {
+		t.Fatalf("expected TLS config, got error: %v", err)
+	}
+	f := &Fetcher{TLSConfig: cfg}
+	info, err := f.fetch(context.Background(), server.URL)
+	if err != nil || info.CurrentWatts != 7.5 {
+		t.Fatalf("expected skip-verify fetch to succeed, got %+v, %v", info, err)
+	}
+}
+
+func TestFetcherVerifiesWithCABundle(t *testing.T) {
+	server := tlsServer(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := NewTLSConfig(false, caFile)
+	if err != nil {
+		t.Fatalf("expected TLS config, got error: %v", err)
+	}
+
+	u, _ := url.Parse(server.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	f := &Fetcher{Scheme: "https", Port: port, TLSConfig: cfg}
+	info, err := f.Fetch(context.Background(), Device{Instance: "Plug", Address: host})
+	if err != nil || info.DeviceName != "Plug" {
+		t.Fatalf("expected verified fetch to succeed, got %+v, %v", info, err)
+	}
+}
+
+func TestNewTLSConfigRejectsEmptyBundle(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(caFile, []byte("not a certificate"), 0o600)
+
+	if _, err := NewTLSConfig(false, caFile); err == nil {
+		t.Fatal("expected error for bundle without certificates")
+	}
+}
+
+func TestFetcherURL(t *testing.T) {
+	d := Device{Address: "10.0.0.7"}
+	cases := []struct {
+		f    *Fetcher
+		want string
+	}{
+		{&Fetcher{}, "http://10.0.0.7:80/api/power"},
+		{&Fetcher{Scheme: "https"}, "https://10.0.0.7:443/api/power"},
+		{&Fetcher{Scheme: "https", Port: 8443}, "https://10.0.0.7:8443/api/power"},
+	}
+	for _, c := range cases {
+		if got := c.f.URL(d); got != c.want {
+			t.Fatalf("expected %q, got %q", c.want, got)
+		}
+	}
+}
+
+func TestFetcherURLFormatsIPv6(t *testing.T) {
+	cases := []struct {
+		addr string
+		want string
+	}{
+		{"2001:db8::1", "http://[2001:db8::1]:80/api/power"},
+		{"fd12:3456::5", "http://[fd12:3456::5]:80/api/power"},
+		{"fe80::1%eth0", "http://[fe80::1%25eth0]:80/api/power"},
+		{"fe80::1%en 0", "http://[fe80::1%25en%200]:80/api/power"},
+	}
+	for _, c := range cases {
+		got := (&Fetcher{}).URL(Device{Address: c.addr})
+		if got != c.want {
+			t.Fatalf("URL for %q = %q, want %q", c.addr, got, c.want)
+		}
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Fatalf("URL %q does not parse: %v", got, err)
+		}
+		if host := u.Hostname(); host != c.addr {
+			t.Fatalf("URL %q has host %q, want %q", got, host, c.addr)
+		}
+	}
+}
+
+func TestFetcherURLUsesDeviceOverrides(t *testing.T) {
+	f := &Fetcher{Port: 8080, Path: "/status"}
+	d := Device{Address: "10.0.0.7", Port: 9000, Path: "/meter", Driver: "tasmota"}
+	if got := f.URL(d); got != "http://10.0.0.7:9000/meter" {
+		t.Fatalf("expected device port and path to win, got %q", got)
+	}
+	if got := f.DriverFor(d).Name(); got != "tasmota" {
+		t.Fatalf("expected device driver, got %q", got)
+	}
+}
+
+func flakyServer(t *testing.T, failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			http.Error(w, "busy", status)
+			return
+		}
+		io.WriteString(w, `{"currentWatts":3}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestFetcherRetriesServerErrors(t *testing.T) {
+	server, calls := flakyServer(t, 2, http.StatusServiceUnavailable)
+
+	f := &Fetcher{Retries: 3, RetryBackoff: time.Millisecond}
+	power, err := f.fetch(context.Background(), server.URL)
+	if err != nil || power.CurrentWatts != 3 {
+		t.Fatalf("expected success after retries, got %+v, %v", power, err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 attempts, got %d", got)
+	}
+}
+
+func TestFetcherReportsAttempts(t *testing.T) {
+	server, calls := flakyServer(t, 10, http.StatusInternalServerError)
+
+	f := &Fetcher{Retries: 2, RetryBackoff: time.Millisecond}
+	_, err := f.fetch(context.Background(), server.URL)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("expected error noting 3 attempts, got %v", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 attempts, got %d", got)
+	}
+}
+
+func TestFetcherDoesNotRetryClientErrors(t *testing.T) {
+	server, calls := flakyServer(t, 10, http.StatusNotFound)
+
+	f := &Fetcher{Retries: 3, RetryBackoff: time.Millisecond}
+	if _, err := f.fetch(context.Background(), server.URL); err == nil {
+		t.Fatal("expected error for 404 response")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected a single attempt for a 4xx response, got %d", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"":                              0,
+		"7":                             7 * time.Second,
+		" 120 ":                         2 * time.Minute,
+		"-3":                            0,
+		"soon":                          0,
+		"Fri, 01 Mar 2024 12:00:45 GMT": 45 * time.Second,
+		"Fri, 01 Mar 2024 11:59:00 GMT": 0,
+	} {
+		if got := parseRetryAfter(value, now); got != want {
+			t.Fatalf("%q: expected %v, got %v", value, want, got)
+		}
+	}
+}
+
+// rateLimitedServer answers 429 with retryAfter for the first failures
+// requests.
+func rateLimitedServer(t *testing.T, failures int32, retryAfter string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, `{"currentWatts":3}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+// fetchAsync fetches url with f in the background, returning the
+// channel its error is sent on.
+func fetchAsync(f *Fetcher, url string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.fetch(context.Background(), url)
+		done <- err
+	}()
+	return done
+}
+
+func TestFetcherBacksOffExponentially(t *testing.T) {
+	server, calls := flakyServer(t, 2, http.StatusServiceUnavailable)
+	clk := testsupport.NewFakeClock(time.Unix(0, 0))
+	f := &Fetcher{Retries: 2, RetryBackoff: 4 * time.Second, Clock: clk}
+	done := fetchAsync(f, server.URL)
+
+	// Jittered, the first retry waits 2-4s and the second 4-8s.
+	for i, wait := range []time.Duration{2 * time.Second, 4 * time.Second} {
+		clk.BlockUntil(1)
+		clk.Advance(wait - time.Nanosecond)
+		if got := calls.Load(); got != int32(i+1) {
+			t.Fatalf("retry %d: expected no retry before %v, got %d attempts", i+1, wait, got)
+		}
+		clk.Advance(wait + time.Nanosecond)
+	}
+	if err := <-done; err != nil || calls.Load() != 3 {
+		t.Fatalf("expected success on the third attempt, got %v after %d attempts", err, calls.Load())
+	}
+}
+
+func TestFetcherHonorsRetryAfter(t *testing.T) {
+	server, calls := rateLimitedServer(t, 1, "30")
+	clk := testsupport.NewFakeClock(time.Unix(0, 0))
+	f := &Fetcher{Retries: 1, RetryBackoff: time.Millisecond, MaxRetryAfter: time.Minute, Clock: clk}
+	done := fetchAsync(f, server.URL)
+
+	clk.BlockUntil(1)
+	clk.Advance(30*time.Second - time.Nanosecond)
+	if calls.Load() != 1 {
+		t.Fatal("expected the retry to wait for Retry-After")
+	}
+	clk.Advance(time.Nanosecond)
+	if err := <-done; err != nil || calls.Load() != 2 {
+		t.Fatalf("expected success after a retry, got %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestFetcherCapsRetryAfter(t *testing.T) {
+	server, calls := rateLimitedServer(t, 10, "3600")
+
+	f := &Fetcher{Retries: 3, RetryBackoff: time.Millisecond, MaxRetryAfter: time.Minute}
+	_, err := f.fetch(context.Background(), server.URL)
+	if after, limited := RetryAfter(err); !limited || after != time.Hour || calls.Load() != 1 {
+		t.Fatalf("expected a single attempt reporting an hour's Retry-After, got %v, %v after %d calls", after, err, calls.Load())
+	}
+	if FailureReason(err) != ReasonHTTPError {
+		t.Fatalf("expected an http error, got %v", err)
+	}
+
+	server, calls = rateLimitedServer(t, 2, "")
+	if _, err := f.fetch(context.Background(), server.URL); err != nil || calls.Load() != 3 {
+		t.Fatalf("expected a 429 without Retry-After to be retried with backoff, got %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestFetcherRetriesStopAtDeadline(t *testing.T) {
+	server, calls := flakyServer(t, 10, http.StatusBadGateway)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	f := &Fetcher{Retries: 5, RetryBackoff: time.Second}
+	start := time.Now()
+	if _, err := f.fetch(ctx, server.URL); err == nil {
+		t.Fatal("expected error once retries exceed the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected retries to stop within the deadline, took %v", elapsed)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected no retry that would overrun the deadline, got %d attempts", got)
+	}
+}
+
+func TestFetcherTimeoutBoundsRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(60 * time.Millisecond)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	d, port := serverDevice(server)
+
+	f := &Fetcher{Port: port, Timeout: 150 * time.Millisecond, Retries: 5, RetryBackoff: time.Millisecond}
+	start := time.Now()
+	if _, err := f.Fetch(context.Background(), d); err == nil {
+		t.Fatal("expected the query to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("expected the retries to stop at the device's timeout, took %v", elapsed)
+	}
+	if got := calls.Load(); got < 2 || got > 3 {
+		t.Fatalf("expected the attempts that fit in the timeout, got %d", got)
+	}
+}
+
+func TestFetcherAppliesDeviceTimeoutAndRetries(t *testing.T) {
+	server, calls := flakyServer(t, 2, http.StatusServiceUnavailable)
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	retries := 2
+	f := &Fetcher{Port: addr.Port, RetryBackoff: time.Millisecond}
+	if _, err := f.Fetch(context.Background(), Device{Address: addr.IP.String(), Retries: &retries}); err != nil {
+		t.Fatalf("expected the device's retries to ride out two failures, got %v", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 attempts, got %d", got)
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, `{"currentWatts":3}`)
+	}))
+	defer slow.Close()
+	slowAddr := slow.Listener.Addr().(*net.TCPAddr)
+	f = &Fetcher{Port: slowAddr.Port, Timeout: 20 * time.Millisecond}
+	if _, err := f.Fetch(context.Background(), Device{Address: slowAddr.IP.String()}); err == nil {
+		t.Fatal("expected the global timeout to cut the query short")
+	}
+	if _, err := f.Fetch(context.Background(), Device{Address: slowAddr.IP.String(), Timeout: time.Second}); err != nil {
+		t.Fatalf("expected the device's longer timeout to apply, got %v", err)
+	}
+	if _, err := f.Fetch(context.Background(), Device{Address: slowAddr.IP.String(), Disabled: true}); err == nil {
+		t.Fatal("expected a disabled device not to be queried")
+	}
+}
+
+func TestFetchPowerReturnsPromptlyOnCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := fetchPower(ctx, server.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected fetch to return promptly after cancel, took %v", elapsed)
+	}
+}
+
+func TestFetcherSharesHTTPClient(t *testing.T) {
+	f := &Fetcher{}
+	if f.httpClient() != f.httpClient() {
+		t.Fatal("expected the same HTTP client across queries")
+	}
+}
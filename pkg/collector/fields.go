@@ -0,0 +1,195 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FieldPaths extracts PowerInfo values from arbitrary JSON using dotted
+// paths such as "StatusSNS.ENERGY.Power" or "meters.0.power". Numeric
+// path segments index into arrays, and a {channel} segment is replaced
+// by the channel being queried, as in "meters.{channel}.power".
+//
+// The Phase paths read each phase of a polyphase meter, with a {phase}
+// segment standing for its index from 0, as in "emeters.{phase}.power".
+// Phases are read until PhaseWatts is missing.
+type FieldPaths struct {
+	Watts       string
+	Voltage     string
+	Amperage    string
+	PowerFactor string
+	Frequency   string
+
+	PhaseWatts       string
+	PhaseVoltage     string
+	PhaseAmperage    string
+	PhasePowerFactor string
+}
+
+// IsZero reports whether no paths are configured.
+func (p FieldPaths) IsZero() bool {
+	return p.Watts == "" && p.Voltage == "" && p.Amperage == "" && p.PowerFactor == "" && p.Frequency == "" && p.PhaseWatts == ""
+}
+
+// Decode extracts the configured fields from body. Paths that are not set
+// fall back to the generic PowerInfo field names; explicitly configured
+// paths other than the phase ones must be present. With phases, a missing
+// total is their sum.
+func (p FieldPaths) Decode(body []byte) (*PowerInfo, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	watts := p.Watts
+	if watts == "" {
+		watts = "currentWatts"
+	}
+	info := &PowerInfo{}
+	var err error
+	if info.Phases, err = p.phases(doc); err != nil {
+		return nil, err
+	}
+	if info.CurrentWatts, err = numberAt(doc, watts); err != nil && (p.Watts != "" || len(info.Phases) == 0) {
+		return nil, err
+	}
+	if info.Voltage, err = optionalNumberAt(doc, p.Voltage, "voltage"); err != nil {
+		return nil, err
+	}
+	if info.Amperage, err = optionalNumberAt(doc, p.Amperage, "amperage"); err != nil {
+		return nil, err
+	}
+	if info.PowerFactor, err = optionalNumberAt(doc, p.PowerFactor, "powerFactor"); err != nil {
+		return nil, err
+	}
+	if info.FrequencyHz, err = optionalNumberAt(doc, p.Frequency, "frequencyHz"); err != nil {
+		return nil, err
+	}
+	if name, err := lookupPath(doc, "deviceName"); err == nil {
+		info.DeviceName, _ = name.(string)
+	}
+	if stamp, err := lookupPath(doc, "timestamp"); err == nil {
+		info.RawTimestamp = rawTimestamp(stamp)
+	}
+	info.completePhases()
+	return info, nil
+}
+
+// phases reads the phases at the Phase paths, or none when PhaseWatts is
+// not set.
+func (p FieldPaths) phases(doc any) ([]PhaseInfo, error) {
+	if p.PhaseWatts == "" {
+		return nil, nil
+	}
+	var phases []PhaseInfo
+	for i := 0; ; i++ {
+		r := strings.NewReplacer("{phase}", strconv.Itoa(i))
+		watts, err := numberAt(doc, r.Replace(p.PhaseWatts))
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			return phases, nil
+		}
+		phase := PhaseInfo{Watts: watts}
+		for _, f := range []struct {
+			path string
+			v    *float64
+		}{{p.PhaseVoltage, &phase.Voltage}, {p.PhaseAmperage, &phase.Amperage}, {p.PhasePowerFactor, &phase.PowerFactor}} {
+			if f.path == "" {
+				continue
+			}
+			if *f.v, err = numberAt(doc, r.Replace(f.path)); err != nil {
+				return nil, err
+			}
+		}
+		phases = append(phases, phase)
+	}
+}
+
+// decodeChannel decodes body with {channel} in the paths replaced by
+// channel, which defaults to 0.
+func (p FieldPaths) decodeChannel(body []byte, channel string) (*PowerInfo, error) {
+	if channel == "" {
+		channel = "0"
+	}
+	r := strings.NewReplacer("{channel}", channel)
+	return FieldPaths{
+		Watts:            r.Replace(p.Watts),
+		Voltage:          r.Replace(p.Voltage),
+		Amperage:         r.Replace(p.Amperage),
+		PowerFactor:      r.Replace(p.PowerFactor),
+		Frequency:        r.Replace(p.Frequency),
+		PhaseWatts:       r.Replace(p.PhaseWatts),
+		PhaseVoltage:     r.Replace(p.PhaseVoltage),
+		PhaseAmperage:    r.Replace(p.PhaseAmperage),
+		PhasePowerFactor: r.Replace(p.PhasePowerFactor),
+	}.Decode(body)
+}
+
+func optionalNumberAt(doc any, path, fallback string) (float64, error) {
+	if path != "" {
+		return numberAt(doc, path)
+	}
+	v, err := numberAt(doc, fallback)
+	if err != nil {
+		return 0, nil
+	}
+	return v, nil
+}
+
+// numberAt returns the number at path, accepting numeric strings such as
+// "12.5".
+func numberAt(doc any, path string) (float64, error) {
+	v, err := lookupPath(doc, path)
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case float64:
+		return n, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("path %q: %q is not a number", path, n)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("path %q: expected a number, got %T", path, v)
+}
+
+// lookupPath walks a dotted path through a decoded JSON document.
+func lookupPath(doc any, path string) (any, error) {
+	cur := doc
+	segments := strings.Split(path, ".")
+	for i, seg := range segments {
+		walked := strings.Join(segments[:i+1], ".")
+		switch node := cur.(type) {
+		case map[string]any:
+			next, ok := node[seg]
+			if !ok {
+				return nil, fmt.Errorf("path %q: missing segment %q at %q", path, seg, walked)
+			}
+			cur = next
+		case []any:
+			idx, err := strconv.Atoi(seg)
+			if err != nil {
+				return nil, fmt.Errorf("path %q: segment %q at %q must be an array index", path, seg, walked)
+			}
+			if idx < 0 || idx >= len(node) {
+				return nil, fmt.Errorf("path %q: index %d out of range at %q (length %d)", path, idx, walked, len(node))
+			}
+			cur = node[idx]
+		default:
+			return nil, fmt.Errorf("path %q: cannot descend into segment %q at %q", path, seg, walked)
+		}
+	}
+	return cur, nil
+}
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFieldPathsNestedObject(t *testing.T) {
+	p := FieldPaths{Watts: "StatusSNS.ENERGY.Power", Voltage: "StatusSNS.ENERGY.Voltage", Amperage: "StatusSNS.ENERGY.Current"}
+	info, err := p.Decode(readFixture(t, "tasmota_status8.json"))
+	if err != nil {
+		t.Fatalf("expected decode to succeed, got %v", err)
+	}
+	if info.CurrentWatts != 48 || info.Voltage != 229 || info.Amperage != 0.266 {
+		t.Fatalf("unexpected PowerInfo: %+v", info)
+	}
+}
+
+func TestFieldPathsArrayIndexAndNumericStrings(t *testing.T) {
+	body := []byte(`{"meters":[{"power":"3.5"},{"power":"12.5","voltage":"231"}]}`)
+	info, err := FieldPaths{Watts: "meters.1.power", Voltage: "meters.1.voltage"}.Decode(body)
+	if err != nil {
+		t.Fatalf("expected decode to succeed, got %v", err)
+	}
+	if info.CurrentWatts != 12.5 || info.Voltage != 231 {
+		t.Fatalf("unexpected PowerInfo: %+v", info)
+	}
+}
+
+func TestFieldPathsDefaultsMatchGenericShape(t *testing.T) {
+	info, err := FieldPaths{Voltage: "voltage"}.Decode(readFixture(t, "generic_power.json"))
+	if err != nil {
+		t.Fatalf("expected decode to succeed, got %v", err)
+	}
+	if info.DeviceName != "Lamp" || info.CurrentWatts != 12.5 || info.Amperage != 0.058 {
+		t.Fatalf("unexpected PowerInfo: %+v", info)
+	}
+}
+
+func TestFieldPathsErrors(t *testing.T) {
+	body := []byte(`{"StatusSNS":{"ENERGY":{"Power":"n/a"}},"meters":[{"power":1}]}`)
+	cases := []struct {
+		paths FieldPaths
+		want  string
+	}{
+		{FieldPaths{Watts: "StatusSNS.ENERGY.Pwr"}, `missing segment "Pwr"`},
+		{FieldPaths{Watts: "StatusSNS.ENERGY.Power"}, `"n/a" is not a number`},
+		{FieldPaths{Watts: "meters.3.power"}, "index 3 out of range"},
+		{FieldPaths{Watts: "meters.first.power"}, "must be an array index"},
+		{FieldPaths{Watts: "meters.0.power", Voltage: "meters.0.voltage"}, `missing segment "voltage"`},
+		{FieldPaths{Watts: "meters.0.power.value"}, `cannot descend into segment "value"`},
+	}
+	for _, c := range cases {
+		_, err := c.paths.Decode(body)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("Decode(%+v): expected error containing %q, got %v", c.paths, c.want, err)
+		}
+	}
+}
+
+func TestFieldPathsChannelPlaceholder(t *testing.T) {
+	body := []byte(`{"meters":[{"power":5},{"power":7.5}]}`)
+	p := FieldPaths{Watts: "meters.{channel}.power"}
+	for channel, want := range map[string]float64{"": 5, "1": 7.5} {
+		info, err := p.decodeChannel(body, channel)
+		if err != nil || info.CurrentWatts != want {
+			t.Errorf("channel %q: got %+v (%v), want %v W", channel, info, err, want)
+		}
+	}
+}
+
+func TestFieldPathsPhases(t *testing.T) {
+	body := []byte(`{"emeters":[{"power":100,"voltage":230,"pf":0.9},{"power":"50.5","voltage":231,"pf":1}]}`)
+	p := FieldPaths{PhaseWatts: "emeters.{phase}.power", PhaseVoltage: "emeters.{phase}.voltage", PhasePowerFactor: "emeters.{phase}.pf"}
+	info, err := p.Decode(body)
+	if err != nil {
+		t.Fatalf("expected decode to succeed, got %v", err)
+	}
+	if info.CurrentWatts != 150.5 || len(info.Phases) != 2 {
+		t.Fatalf("expected two phases totalled, got %+v", info)
+	}
+	if ph := info.Phases[1]; ph.Name != "L2" || ph.Watts != 50.5 || ph.Voltage != 231 || ph.PowerFactor != 1 {
+		t.Fatalf("unexpected second phase: %+v", ph)
+	}
+
+	if _, err := (FieldPaths{PhaseWatts: "meters.{phase}.power"}).Decode(body); err == nil {
+		t.Fatal("expected an error when no phase is found")
+	}
+	if _, err := (FieldPaths{PhaseWatts: "emeters.{phase}.power", PhaseAmperage: "emeters.{phase}.current"}).Decode(body); err == nil {
+		t.Fatal("expected an error for a missing phase amperage")
+	}
+}
@@ -0,0 +1,67 @@
+package collector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter selects which discovered devices are processed.
+type Filter struct {
+	// Match, when set, keeps only devices whose instance name matches.
+	Match *regexp.Regexp
+	// Exclude drops devices whose instance name matches.
+	Exclude *regexp.Regexp
+	// RequireTXT lists key=value pairs that must all appear among a
+	// device's TXT records. Keys are compared case-insensitively.
+	RequireTXT []string
+}
+
+// ParseTXTPairs splits a comma-separated list of key=value pairs, as
+// accepted by Filter.RequireTXT.
+func ParseTXTPairs(s string) ([]string, error) {
+	var pairs []string
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		if key, _, ok := strings.Cut(pair, "="); !ok || key == "" {
+			return nil, fmt.Errorf("invalid TXT requirement %q: want key=value", pair)
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// Allow reports whether d passes the filter. A nil filter allows every
+// device.
+func (f *Filter) Allow(d Device) bool {
+	if f == nil {
+		return true
+	}
+	if f.Match != nil && !f.Match.MatchString(d.Instance) {
+		return false
+	}
+	if f.Exclude != nil && f.Exclude.MatchString(d.Instance) {
+		return false
+	}
+	for _, pair := range f.RequireTXT {
+		if !hasTXT(d.Text, pair) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTXT reports whether text contains the key=value pair.
+func hasTXT(text []string, pair string) bool {
+	key, value, _ := strings.Cut(pair, "=")
+	for _, t := range text {
+		k, v, _ := strings.Cut(t, "=")
+		if strings.EqualFold(k, key) && v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package collector
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFilterAllow(t *testing.T) {
+	plug := Device{Instance: "Kitchen Plug", Text: []string{"VP=65521+32768", "CM=0"}}
+	bulb := Device{Instance: "Hall Bulb", Text: []string{"VP=4874+1"}}
+
+	tests := []struct {
+		name   string
+		filter *Filter
+		plug   bool
+		bulb   bool
+	}{
+		{"nil", nil, true, true},
+		{"match", &Filter{Match: regexp.MustCompile("(?i)plug")}, true, false},
+		{"exclude", &Filter{Exclude: regexp.MustCompile("Bulb$")}, true, false},
+		{"match and exclude", &Filter{Match: regexp.MustCompile("^(Kitchen|Hall)"), Exclude: regexp.MustCompile("Kitchen")}, false, true},
+		{"txt", &Filter{RequireTXT: []string{"vp=65521+32768"}}, true, false},
+		{"every txt pair", &Filter{RequireTXT: []string{"VP=65521+32768", "CM=1"}}, false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Allow(plug); got != tt.plug {
+			t.Errorf("%s: Allow(plug) = %v, want %v", tt.name, got, tt.plug)
+		}
+		if got := tt.filter.Allow(bulb); got != tt.bulb {
+			t.Errorf("%s: Allow(bulb) = %v, want %v", tt.name, got, tt.bulb)
+		}
+	}
+}
+
+func TestParseTXTPairs(t *testing.T) {
+	pairs, err := ParseTXTPairs("VP=65521+32768, DT=266")
+	if err != nil || len(pairs) != 2 || pairs[1] != "DT=266" {
+		t.Fatalf("unexpected pairs %v (%v)", pairs, err)
+	}
+	if _, err := ParseTXTPairs("VP"); err == nil {
+		t.Fatal("expected a pair without = to be rejected")
+	}
+}
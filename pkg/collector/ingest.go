@@ -0,0 +1,48 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"powerusagecollection/pkg/clock"
+)
+
+// DecodePushed decodes a body pushed by a device rather than fetched from
+// it: a PowerInfo document, as the generic driver reads, or an array of
+// them.
+func DecodePushed(body []byte) ([]*PowerInfo, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty body")
+	}
+	if body[0] != '[' {
+		info, err := decodeGeneric(body, "")
+		if err != nil {
+			return nil, err
+		}
+		return []*PowerInfo{info}, nil
+	}
+	var docs []json.RawMessage
+	if err := json.Unmarshal(body, &docs); err != nil {
+		return nil, err
+	}
+	infos := make([]*PowerInfo, len(docs))
+	for i, doc := range docs {
+		info, err := decodeGeneric(doc, "")
+		if err != nil {
+			return nil, fmt.Errorf("reading %d: %w", i, err)
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+// Ingest completes a reading pushed by d as Fetch would a queried one: it
+// converts power from the device's Unit to watts, normalises the
+// timestamp and checks the reading with the Validator. It returns the
+// Validator's error for a rejected reading.
+func (f *Fetcher) Ingest(d Device, info *PowerInfo) error {
+	return f.complete(info, d, d.Unit, clock.Or(f.Clock).Now())
+}
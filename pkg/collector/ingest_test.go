@@ -0,0 +1,43 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/testsupport"
+)
+
+func TestDecodePushed(t *testing.T) {
+	infos, err := DecodePushed([]byte(` {"deviceName":"Sensor","currentWatts":12.5,"timestamp":1700000000} `))
+	if err != nil || len(infos) != 1 || infos[0].DeviceName != "Sensor" || infos[0].CurrentWatts != 12.5 || infos[0].RawTimestamp == "" {
+		t.Fatalf("expected one reading, got %+v, %v", infos, err)
+	}
+
+	infos, err = DecodePushed([]byte(`[{"deviceName":"A","currentWatts":1},{"deviceName":"B","currentWatts":2}]`))
+	if err != nil || len(infos) != 2 || infos[1].DeviceName != "B" {
+		t.Fatalf("expected an array of readings, got %+v, %v", infos, err)
+	}
+
+	for _, body := range []string{"", "not json", `[{"deviceName":"A"}, 3]`} {
+		if _, err := DecodePushed([]byte(body)); err == nil {
+			t.Errorf("expected %q rejected", body)
+		}
+	}
+}
+
+func TestFetcherIngest(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := &Fetcher{Clock: testsupport.NewFakeClock(now), Validator: &Validator{MaxWatts: 1000, Mode: AnomalyDrop}}
+
+	info := &PowerInfo{CurrentWatts: 1500}
+	if err := f.Ingest(Device{Instance: "Heater", Unit: "mW", Source: SourcePush}, info); err != nil || info.CurrentWatts != 1.5 {
+		t.Fatalf("expected the power converted to watts, got %g, %v", info.CurrentWatts, err)
+	}
+	if !info.Timestamp.Equal(now) || info.TimestampSource != TimestampSourceCollector {
+		t.Fatalf("expected the receipt time as timestamp, got %s (%s)", info.Timestamp, info.TimestampSource)
+	}
+
+	if err := f.Ingest(Device{Instance: "Heater"}, &PowerInfo{CurrentWatts: 1500}); FailureReason(err) != ReasonImplausible {
+		t.Fatalf("expected the same range checks as polled readings, got %v", err)
+	}
+}
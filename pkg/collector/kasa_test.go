@@ -0,0 +1,124 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// kasaServer answers every connection with the frame response, after
+// checking the request frame against want when set.
+func kasaServer(t *testing.T, want, response []byte) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				req, err := readKasaFrame(conn)
+				if err != nil {
+					t.Errorf("read request: %v", err)
+					return
+				}
+				if want != nil && !bytes.Equal(kasaFrame(req), want) {
+					t.Errorf("unexpected request %q", req)
+				}
+				conn.Write(response)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestKasaCipherMatchesCapture(t *testing.T) {
+	capture := readFixture(t, "kasa_realtime_request.bin")
+	if got := kasaFrame(kasaRealtimeRequest("")); !bytes.Equal(got, capture) {
+		t.Fatalf("expected request frame % x, got % x", capture, got)
+	}
+	plain, err := readKasaFrame(bytes.NewReader(readFixture(t, "kasa_realtime_response.bin")))
+	if err != nil || !strings.HasPrefix(string(plain), `{"emeter":{"get_realtime":{"voltage_mv":231885,`) {
+		t.Fatalf("unexpected decrypted response %q, %v", plain, err)
+	}
+	if got := kasaDecrypt(kasaEncrypt([]byte("round trip"))); string(got) != "round trip" {
+		t.Fatalf("expected decrypt to reverse encrypt, got %q", got)
+	}
+}
+
+func TestKasaDriverFetchesRealtime(t *testing.T) {
+	for _, fixture := range []string{"kasa_realtime_response.bin", "kasa_realtime_response_v1.bin"} {
+		t.Run(fixture, func(t *testing.T) {
+			addr := kasaServer(t, readFixture(t, "kasa_realtime_request.bin"), readFixture(t, fixture))
+
+			f := &Fetcher{}
+			d := Device{Instance: "Heater", Address: addr.IP.String(), Port: addr.Port, Driver: KasaDriver}
+			if got, want := f.URL(d), "tcp://"+addr.String(); got != want {
+				t.Fatalf("expected URL %q, got %q", want, got)
+			}
+			info, err := f.Fetch(context.Background(), d)
+			if err != nil {
+				t.Fatalf("expected fetch to succeed, got %v", err)
+			}
+			if info.CurrentWatts != 15.432 || info.Voltage != 231.885 || info.Amperage != 0.126 || info.TimestampSource != TimestampSourceCollector {
+				t.Fatalf("unexpected reading %+v", info)
+			}
+		})
+	}
+}
+
+func TestKasaDriverAddressesChildOutlet(t *testing.T) {
+	want := kasaFrame([]byte(`{"context":{"child_ids":["8006A0"]},"emeter":{"get_realtime":{}}}`))
+	addr := kasaServer(t, want, readFixture(t, "kasa_realtime_response.bin"))
+
+	f := &Fetcher{}
+	d := Device{Instance: "Strip", Address: addr.IP.String(), Port: addr.Port, Driver: KasaDriver, Channel: "8006A0"}
+	if _, err := f.Fetch(context.Background(), d); err != nil {
+		t.Fatalf("expected fetch to succeed, got %v", err)
+	}
+}
+
+func TestKasaDriverReportsDeviceErrors(t *testing.T) {
+	addr := kasaServer(t, nil, kasaFrame([]byte(`{"emeter":{"get_realtime":{"err_code":-1,"err_msg":"module not support"}}}`)))
+
+	f := &Fetcher{}
+	_, err := f.Fetch(context.Background(), Device{Instance: "Plug", Address: addr.IP.String(), Port: addr.Port, Driver: KasaDriver})
+	if FailureReason(err) != ReasonDecodeError || !strings.Contains(err.Error(), "module not support") {
+		t.Fatalf("expected a decode error naming the device error, got %v", err)
+	}
+}
+
+func TestKasaDriverRetriesConnectionErrors(t *testing.T) {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	attempts := 0
+	f := &Fetcher{Retries: 1, RetryBackoff: time.Millisecond, AttemptDone: func(string, int, time.Duration, error) { attempts++ }}
+	_, err := f.Fetch(context.Background(), Device{Instance: "Plug", Address: addr.IP.String(), Port: addr.Port, Driver: KasaDriver})
+	var oe *net.OpError
+	if !errors.As(err, &oe) || attempts != 2 || FailureReason(err) != ReasonUnreachable {
+		t.Fatalf("expected two failed connection attempts, got %d, %v", attempts, err)
+	}
+}
+
+func TestReadKasaFrameRejectsOversizedResponse(t *testing.T) {
+	if _, err := readKasaFrame(bytes.NewReader([]byte{0x7f, 0, 0, 0})); FailureReason(err) != ReasonDecodeError {
+		t.Fatalf("expected an oversized frame to be rejected, got %v", err)
+	}
+	if _, err := readKasaFrame(bytes.NewReader([]byte{0, 0, 0, 9, 1})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a truncated frame to fail, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// HTTPTiming breaks down the round trip of one request. Phases that did
+// not happen, such as DNS for an address or TLS over a reused connection,
+// are zero.
+type HTTPTiming struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// FirstByte is from writing the request to the first response byte.
+	FirstByte time.Duration
+	// Reused is set when the request went over a pooled connection.
+	Reused bool
+}
+
+// withTiming returns ctx traced into t. Connect is the time of the first
+// dial that succeeds, as the transport may dial several addresses at once.
+func withTiming(ctx context.Context, t *HTTPTiming) context.Context {
+	var dnsStart, tlsStart, wrote time.Time
+	var mu sync.Mutex
+	connectStart := make(map[string]time.Time)
+	connected := false
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.DNS = time.Since(dnsStart) },
+		ConnectStart: func(_, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectStart[addr] = time.Now()
+		},
+		ConnectDone: func(_, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && !connected {
+				connected = true
+				t.Connect = time.Since(connectStart[addr])
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.TLS = time.Since(tlsStart) },
+		GotConn:           func(info httptrace.GotConnInfo) { t.Reused = info.Reused },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() {
+			if !wrote.IsZero() {
+				t.FirstByte = time.Since(wrote)
+			}
+		},
+	})
+}
@@ -0,0 +1,85 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchRecordsLatencyAndAttempts(t *testing.T) {
+	server, _ := flakyServer(t, 1, http.StatusServiceUnavailable)
+	u, _ := url.Parse(server.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	var mu sync.Mutex
+	var attempts []error
+	var timings []HTTPTiming
+	f := &Fetcher{
+		Port:         port,
+		Retries:      1,
+		RetryBackoff: 10 * time.Millisecond,
+		AttemptDone: func(_ string, attempt int, elapsed time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if attempt != len(attempts)+1 || elapsed <= 0 {
+				t.Errorf("unexpected attempt %d after %v", attempt, elapsed)
+			}
+			attempts = append(attempts, err)
+		},
+		HTTPTrace: func(_ string, timing HTTPTiming) {
+			mu.Lock()
+			defer mu.Unlock()
+			timings = append(timings, timing)
+		},
+	}
+	info, err := f.Fetch(context.Background(), Device{Instance: "Plug", Address: host})
+	if err != nil {
+		t.Fatalf("expected success after a retry, got %v", err)
+	}
+	if info.Latency < 10*time.Millisecond/2 {
+		t.Fatalf("expected the latency to cover the retry backoff, got %v", info.Latency)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 2 || attempts[0] == nil || attempts[1] != nil {
+		t.Fatalf("expected a failed then a successful attempt, got %v", attempts)
+	}
+	if len(timings) != 2 || timings[0].Connect <= 0 || timings[0].FirstByte <= 0 || !timings[1].Reused {
+		t.Fatalf("unexpected timings %+v", timings)
+	}
+}
+
+func TestWithTimingTimesTheDialThatConnects(t *testing.T) {
+	var timing HTTPTiming
+	trace := httptrace.ContextClientTrace(withTiming(context.Background(), &timing))
+
+	// A dual-stack dial starts a fallback to the other address while the
+	// first is still connecting, on goroutines of their own.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		trace.ConnectStart("tcp", "[2001:db8::1]:80")
+		time.Sleep(60 * time.Millisecond)
+		trace.ConnectDone("tcp", "[2001:db8::1]:80", nil)
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(40 * time.Millisecond)
+		trace.ConnectStart("tcp", "192.0.2.1:80")
+		time.Sleep(40 * time.Millisecond)
+		trace.ConnectDone("tcp", "192.0.2.1:80", nil)
+	}()
+	wg.Wait()
+	if timing.Connect < 50*time.Millisecond || timing.Connect >= 80*time.Millisecond {
+		t.Fatalf("expected the time of the first address's dial, got %v", timing.Connect)
+	}
+}
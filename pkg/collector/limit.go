@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/clock"
+)
+
+// Limiter paces requests to devices: globally to Rate per second with a
+// token bucket holding up to Burst requests, and per device so requests
+// to one host are at least PerDevice apart. Every request counts,
+// including retries, so a Limiter shared by a Fetcher bounds the traffic
+// the whole pool of queries produces.
+type Limiter struct {
+	// OnWait, when set, is told how long each request waited for the
+	// limiter, including requests that did not wait at all.
+	OnWait func(host string, wait time.Duration)
+	// Clock, when set, replaces the system clock. It must be set before
+	// the Limiter is first used.
+	Clock clock.Clock
+
+	// interval is the time one token takes to refill and tolerance how
+	// far ahead of it a burst may run; both are zero without a rate.
+	interval  time.Duration
+	tolerance time.Duration
+	perDevice time.Duration
+
+	mu sync.Mutex
+	// due is when the bucket will next be full of refilled tokens
+	// (the theoretical arrival time of the generic cell rate algorithm).
+	due time.Time
+	// next holds the earliest time each host may be sent a request.
+	next map[string]time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate requests per second with
+// bursts of up to burst, and at most one request per perDevice to each
+// host. A rate of zero or less leaves the global rate unlimited; a burst
+// below one is treated as one.
+func NewLimiter(rate float64, burst int, perDevice time.Duration) *Limiter {
+	l := &Limiter{perDevice: perDevice, next: make(map[string]time.Time)}
+	if rate > 0 {
+		l.interval = time.Duration(math.Round(float64(time.Second) / rate))
+		l.tolerance = time.Duration(max(burst, 1)-1) * l.interval
+	}
+	return l
+}
+
+// Wait blocks until a request to host may be sent, returning how long it
+// waited. The request's slot is reserved even when ctx ends first.
+func (l *Limiter) Wait(ctx context.Context, host string) (time.Duration, error) {
+	clk := clock.Or(l.Clock)
+	now := clk.Now()
+	wait := l.reserve(host, now).Sub(now)
+	if l.OnWait != nil {
+		l.OnWait(host, max(wait, 0))
+	}
+	if wait <= 0 {
+		return 0, nil
+	}
+	select {
+	case <-ctx.Done():
+		return wait, context.Cause(ctx)
+	case <-clk.After(wait):
+		return wait, nil
+	}
+}
+
+// reserve returns when the next request to host may be sent, claiming
+// that slot for it.
+func (l *Limiter) reserve(host string, now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	at := now
+	if next := l.next[host]; next.After(at) {
+		at = next
+	}
+	if l.interval > 0 {
+		if l.due.Before(at) {
+			l.due = at
+		}
+		if earliest := l.due.Add(-l.tolerance); earliest.After(at) {
+			at = earliest
+		}
+		l.due = l.due.Add(l.interval)
+	}
+	if l.perDevice > 0 {
+		l.next[host] = at.Add(l.perDevice)
+	}
+	return at
+}
@@ -0,0 +1,103 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserveBurstsThenPaces(t *testing.T) {
+	l := NewLimiter(10, 3, 0)
+	now := time.Now()
+	var got []time.Duration
+	for i := range 5 {
+		got = append(got, l.reserve("plug-"+string(rune('a'+i)), now).Sub(now))
+	}
+	want := []time.Duration{0, 0, 0, 100 * time.Millisecond, 200 * time.Millisecond}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected slots %v, got %v", want, got)
+		}
+	}
+
+	// Once the bucket has refilled, a burst goes through again.
+	if at := l.reserve("plug-f", now.Add(time.Second)); !at.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected a refilled bucket, got a slot %v late", at.Sub(now.Add(time.Second)))
+	}
+}
+
+func TestLimiterSpacesRequestsPerDevice(t *testing.T) {
+	l := NewLimiter(0, 0, 2*time.Second)
+	now := time.Now()
+	if at := l.reserve("plug", now); !at.Equal(now) {
+		t.Fatal("expected the first request to go at once")
+	}
+	if at := l.reserve("lamp", now); !at.Equal(now) {
+		t.Fatal("expected another device not to wait")
+	}
+	if at := l.reserve("plug", now.Add(time.Second)); !at.Equal(now.Add(2 * time.Second)) {
+		t.Fatalf("expected the device's second request 2s after its first, got %v", at.Sub(now))
+	}
+}
+
+func TestLimiterWaitEndsWithContext(t *testing.T) {
+	l := NewLimiter(0, 0, time.Hour)
+	l.Wait(context.Background(), "plug")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Wait(ctx, "plug"); err == nil {
+		t.Fatal("expected the wait to end with the context")
+	}
+}
+
+func TestFetcherRetriesConsumeLimiterTokens(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"currentWatts":5}`))
+	}))
+	defer server.Close()
+
+	var waits []time.Duration
+	l := NewLimiter(0, 0, 50*time.Millisecond)
+	l.OnWait = func(host string, wait time.Duration) { waits = append(waits, wait) }
+	f := &Fetcher{Retries: 1, RetryBackoff: time.Millisecond, Limiter: l}
+	if _, err := f.fetch(context.Background(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 2 || waits[0] != 0 || waits[1] < 30*time.Millisecond {
+		t.Fatalf("expected the retry to wait for the device spacing, got %v", waits)
+	}
+}
+
+func TestFetcherLimiterWaitIsNotChargedToTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"currentWatts":5}`))
+	}))
+	defer server.Close()
+	d, port := serverDevice(server)
+
+	// The channels of one device share its host, so the last of them
+	// queues for twice the spacing, which is longer than the timeout.
+	f := &Fetcher{Port: port, Timeout: 100 * time.Millisecond, Limiter: NewLimiter(0, 0, 150*time.Millisecond)}
+	errs := make(chan error, 3)
+	for _, channel := range []string{"0", "1", "2"} {
+		d := d
+		d.Channel = channel
+		go func() {
+			_, err := f.Fetch(context.Background(), d)
+			errs <- err
+		}()
+	}
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Fatalf("expected every channel read once the limiter let it go, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package collector
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/clock"
+)
+
+const (
+	// DefaultFailureThreshold is the number of consecutive failed polls
+	// after which a device is flagged as failing.
+	DefaultFailureThreshold = 3
+	// DefaultRateLimitStretch is how many times the poll interval a
+	// rate-limited device's interval may be stretched to by default.
+	DefaultRateLimitStretch = 8
+	// RateLimitRecovery is how long a stretched device must go without
+	// being rate limited before its interval returns to normal.
+	RateLimitRecovery = time.Hour
+)
+
+// FetchFunc queries a device for its current power reading.
+type FetchFunc func(ctx context.Context, d Device) (*PowerInfo, error)
+
+// Reading is the outcome of a single power query against a device.
+type Reading struct {
+	Device Device
+	Power  *PowerInfo
+	Err    error
+	Time   time.Time
+	// Failures counts consecutive failed polls, including this one.
+	Failures int
+	// Failing is set once Failures reaches the poller's threshold.
+	Failing bool
+	// State is the device's availability after this reading.
+	State Availability
+	// LastSeen is when the device last answered at all, even with an
+	// error; LastSuccess is when it last returned a reading. Both are
+	// zero until then.
+	LastSeen    time.Time
+	LastSuccess time.Time
+	// Cached is set when the reading was reused from an earlier query
+	// instead of being fetched; see Poller.MinGap.
+	Cached bool
+	// Interval is how often the device is polled after this reading,
+	// longer than the poller's Interval while it is rate limited or its
+	// adaptive interval has grown.
+	Interval time.Duration
+}
+
+// Poller periodically queries every device added to it. Devices may be
+// added and removed while it runs; failing devices are flagged but never
+// removed.
+type Poller struct {
+	Interval         time.Duration
+	FailureThreshold int
+	Fetch            FetchFunc
+	// Pool bounds how many devices are queried at once.
+	Pool *Pool
+	// OnCycle, when set, is called after every Poll with all of the
+	// cycle's readings.
+	OnCycle func(ctx context.Context, readings []Reading)
+	// MinGap, when positive, is how long a device's last successful
+	// reading is reused before the device is queried again, so that
+	// announcements and scrapes between polls add no device requests.
+	MinGap time.Duration
+	// OfflineThreshold is the number of consecutive failed polls after
+	// which a device is offline. Zero never marks devices offline.
+	OfflineThreshold int
+	// OfflineInterval, when positive, is how often offline devices are
+	// polled instead of every Interval.
+	OfflineInterval time.Duration
+	// MaxRateLimitInterval, when positive, lets the interval of a device
+	// answering 429 Too Many Requests be stretched, doubling each time it
+	// is rate limited and at least to its Retry-After delay, up to this
+	// long. It returns to Interval after RateLimitRecovery without a 429.
+	MaxRateLimitInterval time.Duration
+	// AdaptiveMaxInterval, when longer than Interval, adapts each device's
+	// poll interval to its readings: a device whose power changes by more
+	// than AdaptiveThreshold watts between successful readings is polled
+	// every Interval again, and one whose power holds steady has its
+	// interval doubled after each reading, up to AdaptiveMaxInterval.
+	AdaptiveMaxInterval time.Duration
+	AdaptiveThreshold   float64
+	// OnIntervalChange, when set, is called whenever a device's poll
+	// interval changes, adapted or stretched by rate limiting.
+	OnIntervalChange func(d Device, from, to time.Duration)
+	// OnStateChange, when set, is called whenever a device's availability
+	// changes, with the failure reason of the reading that changed it; see
+	// FailureReason. A device's first successful reading is not a change.
+	OnStateChange func(d Device, from, to Availability, reason string)
+	// Clock, when set, replaces the system clock for scheduling polls and
+	// timing readings.
+	Clock clock.Clock
+
+	// cycle is held for reading by every Poll and for writing by Between.
+	cycle   sync.RWMutex
+	mu      sync.Mutex
+	devices []*polledDevice
+	index   map[string]*polledDevice
+	hits    int
+	misses  int
+	// lastCycle is how long the latest Poll took to query its devices.
+	lastCycle time.Duration
+}
+
+type polledDevice struct {
+	device   Device
+	failures int
+	// state is empty until the device's first reading.
+	state       Availability
+	lastSeen    time.Time
+	lastSuccess time.Time
+	// attempted is when the device was last queried.
+	attempted time.Time
+	// last is the latest successful reading, reused within MinGap.
+	last *Reading
+	// interval is the device's stretched poll interval, zero when it is
+	// not rate limited; unlimited is when it last stopped being so.
+	interval  time.Duration
+	unlimited time.Time
+	// adaptive is the device's adapted poll interval, zero until its
+	// first successful reading with AdaptiveMaxInterval set.
+	adaptive time.Duration
+}
+
+// NewPoller returns a Poller that queries devices every interval using
+// FetchPower.
+func NewPoller(interval time.Duration) *Poller {
+	return &Poller{
+		Interval:             interval,
+		FailureThreshold:     DefaultFailureThreshold,
+		OfflineThreshold:     DefaultOfflineThreshold,
+		MaxRateLimitInterval: DefaultRateLimitStretch * interval,
+		Fetch:                FetchPower,
+		Pool:                 NewPool(DefaultConcurrency),
+		index:                make(map[string]*polledDevice),
+	}
+}
+
+// Key identifies a device across repeated announcements. Each channel of a
+// multi-channel device has its own key.
+func (d Device) Key() string {
+	if d.Channel != "" {
+		return d.Instance + "|" + d.HostName + "|" + d.Channel
+	}
+	return d.Instance + "|" + d.HostName
+}
+
+// Add registers d for polling. It reports whether the device was new; known
+// devices have their record refreshed instead.
+func (p *Poller) Add(d Device) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if existing, ok := p.index[d.Key()]; ok {
+		existing.device = d
+		return false
+	}
+
+	pd := &polledDevice{device: d}
+	p.devices = append(p.devices, pd)
+	p.index[d.Key()] = pd
+	return true
+}
+
+// Remove stops polling the device with d's key. It reports whether the
+// device was being polled. A query of d already under way still returns
+// its reading.
+func (p *Poller) Remove(d Device) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pd, ok := p.index[d.Key()]
+	if !ok {
+		return false
+	}
+	delete(p.index, d.Key())
+	p.devices = slices.DeleteFunc(p.devices, func(other *polledDevice) bool { return other == pd })
+	return true
+}
+
+// Between calls fn while no Poll is in progress, waiting for the current
+// cycle, OnCycle included, to finish first. Cycles due meanwhile start
+// once fn returns, so fn can change the devices and whatever the cycle's
+// callbacks read without either seeing half of the change.
+func (p *Poller) Between(fn func()) {
+	p.cycle.Lock()
+	defer p.cycle.Unlock()
+	fn()
+}
+
+// Devices returns a snapshot of the devices being polled.
+func (p *Poller) Devices() []Device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	devices := make([]Device, 0, len(p.devices))
+	for _, pd := range p.devices {
+		devices = append(devices, pd.device)
+	}
+	return devices
+}
+
+// due returns the devices to query in a cycle starting at now: all of them
+// except offline devices queried within OfflineInterval and those queried
+// within their stretched or adapted interval. Half an Interval of slack
+// keeps the queries that ended just after a tick from skipping it.
+func (p *Poller) due(now time.Time) []Device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	devices := make([]Device, 0, len(p.devices))
+	for _, pd := range p.devices {
+		if pd.state == Offline && p.OfflineInterval > 0 && now.Sub(pd.attempted) < p.OfflineInterval {
+			continue
+		}
+		if iv := p.interval(pd); iv > p.Interval && now.Sub(pd.attempted) < iv-p.Interval/2 {
+			continue
+		}
+		devices = append(devices, pd.device)
+	}
+	return devices
+}
+
+// Poll queries every device once on the pool, calling fn with each reading,
+// and returns when all queries have finished. fn may be called
+// concurrently. Offline devices are skipped until OfflineInterval has
+// passed since they were last queried, and others until their stretched
+// or adapted interval has.
+func (p *Poller) Poll(ctx context.Context, fn func(Reading)) {
+	p.cycle.RLock()
+	defer p.cycle.RUnlock()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		readings []Reading
+	)
+	start := clock.Or(p.Clock).Now()
+	for _, d := range p.due(start) {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		p.Pool.Go(func() {
+			defer wg.Done()
+			r := p.PollDevice(ctx, d)
+			fn(r)
+			mu.Lock()
+			readings = append(readings, r)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	p.mu.Lock()
+	p.lastCycle = clock.Or(p.Clock).Now().Sub(start)
+	p.mu.Unlock()
+
+	if p.OnCycle != nil {
+		p.OnCycle(ctx, readings)
+	}
+}
+
+// LastCycle returns how long the latest Poll took to query its devices,
+// OnCycle not included; zero before the first.
+func (p *Poller) LastCycle() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastCycle
+}
+
+// Run polls every Interval until ctx is done. The first cycle starts after
+// one interval has elapsed.
+func (p *Poller) Run(ctx context.Context, fn func(Reading)) {
+	ticker := clock.Or(p.Clock).NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			p.Poll(ctx, fn)
+		}
+	}
+}
+
+// PollDevice queries a single device that was previously added and returns
+// its reading. Within MinGap of the device's last successful reading,
+// that reading is returned again, marked Cached.
+func (p *Poller) PollDevice(ctx context.Context, d Device) Reading {
+	if r, ok := p.cached(d); ok {
+		return r
+	}
+	power, err := p.Fetch(ctx, d)
+	r := Reading{Device: d, Power: power, Err: err, Time: clock.Or(p.Clock).Now()}
+
+	p.mu.Lock()
+	pd, ok := p.index[d.Key()]
+	if !ok {
+		// d was removed while it was being queried.
+		p.mu.Unlock()
+		return r
+	}
+	pd.attempted = r.Time
+	was := p.interval(pd)
+	if answered(err) {
+		pd.lastSeen = r.Time
+	}
+	if err != nil {
+		pd.failures++
+	} else {
+		pd.failures = 0
+		pd.lastSuccess = r.Time
+	}
+	p.adjustInterval(pd, err, r.Time)
+	if err == nil {
+		p.adapt(pd, power)
+	}
+	from := pd.state
+	pd.state = p.availability(pd.failures)
+	r.Failures = pd.failures
+	r.Failing = p.FailureThreshold > 0 && pd.failures >= p.FailureThreshold
+	r.State = pd.state
+	r.LastSeen = pd.lastSeen
+	r.LastSuccess = pd.lastSuccess
+	r.Interval = p.interval(pd)
+	if err == nil {
+		pd.last = &r
+	}
+	p.mu.Unlock()
+
+	if p.OnStateChange != nil && from != r.State && (from != "" || r.State != Online) {
+		reason := ""
+		if err != nil {
+			reason = FailureReason(err)
+		}
+		p.OnStateChange(d, from, r.State, reason)
+	}
+	if p.OnIntervalChange != nil && was != r.Interval {
+		p.OnIntervalChange(d, was, r.Interval)
+	}
+	return r
+}
+
+// adjustInterval stretches pd's interval when err is a 429 response, and
+// returns it to normal once pd has not been rate limited for
+// RateLimitRecovery. p.mu must be held.
+func (p *Poller) adjustInterval(pd *polledDevice, err error, now time.Time) {
+	if p.MaxRateLimitInterval <= 0 {
+		return
+	}
+	if after, limited := RetryAfter(err); limited {
+		next := max(2*p.interval(pd), after, p.Interval)
+		pd.interval = min(next, max(p.MaxRateLimitInterval, p.Interval))
+		pd.unlimited = time.Time{}
+		return
+	}
+	if pd.interval == 0 {
+		return
+	}
+	if pd.unlimited.IsZero() {
+		pd.unlimited = now
+	} else if now.Sub(pd.unlimited) >= RateLimitRecovery {
+		pd.interval = 0
+		pd.unlimited = time.Time{}
+	}
+}
+
+// adapt sets pd's adapted interval from power, its latest reading: back
+// to Interval when the power changed by more than AdaptiveThreshold since
+// the last reading, and doubled, up to AdaptiveMaxInterval, when it did
+// not. p.mu must be held.
+func (p *Poller) adapt(pd *polledDevice, power *PowerInfo) {
+	if p.AdaptiveMaxInterval <= p.Interval || power == nil {
+		return
+	}
+	if pd.last == nil || pd.last.Power == nil || math.Abs(power.CurrentWatts-pd.last.Power.CurrentWatts) > p.AdaptiveThreshold {
+		pd.adaptive = p.Interval
+		return
+	}
+	pd.adaptive = min(2*max(pd.adaptive, p.Interval), p.AdaptiveMaxInterval)
+}
+
+// interval returns pd's effective poll interval, the longest of its
+// stretched and adapted intervals and Interval. p.mu must be held.
+func (p *Poller) interval(pd *polledDevice) time.Duration {
+	return max(pd.interval, pd.adaptive, p.Interval)
+}
+
+// cached returns d's last successful reading if it is younger than
+// MinGap, counting the cache hit or miss.
+func (p *Poller) cached(d Device) (Reading, bool) {
+	if p.MinGap <= 0 {
+		return Reading{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pd := p.index[d.Key()]
+	if pd == nil || pd.last == nil || clock.Or(p.Clock).Now().Sub(pd.last.Time) >= p.MinGap {
+		p.misses++
+		return Reading{}, false
+	}
+	p.hits++
+	r := *pd.last
+	r.Device = d
+	r.Cached = true
+	r.State = pd.state
+	r.LastSeen = pd.lastSeen
+	r.Interval = p.interval(pd)
+	return r, true
+}
+
+// CacheStats returns how many PollDevice calls reused a cached reading and
+// how many queried the device, since the poller was created.
+func (p *Poller) CacheStats() (hits, misses int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hits, p.misses
+}
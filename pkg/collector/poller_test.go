@@ -0,0 +1,300 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/testsupport"
+)
+
+func TestPollerAddDeduplicates(t *testing.T) {
+	p := NewPoller(time.Second)
+
+	if !p.Add(Device{Instance: "Lamp", HostName: "lamp.local"}) {
+		t.Fatal("expected first Add to report a new device")
+	}
+	if p.Add(Device{Instance: "Lamp", HostName: "lamp.local", Address: "10.0.0.7"}) {
+		t.Fatal("expected repeated Add to report a known device")
+	}
+
+	devices := p.Devices()
+	if len(devices) != 1 || devices[0].Address != "10.0.0.7" {
+		t.Fatalf("expected refreshed single device, got %+v", devices)
+	}
+}
+
+func TestPollerRemove(t *testing.T) {
+	p := NewPoller(time.Second)
+	lamp, fridge := Device{Instance: "Lamp"}, Device{Instance: "Fridge"}
+	p.Add(lamp)
+	p.Add(fridge)
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		// The device goes away while it is being queried.
+		p.Remove(d)
+		return &PowerInfo{CurrentWatts: 5}, nil
+	}
+
+	if !p.Remove(lamp) || p.Remove(lamp) {
+		t.Fatal("expected Remove to report whether the device was polled")
+	}
+	if devices := p.Devices(); len(devices) != 1 || devices[0].Instance != "Fridge" {
+		t.Fatalf("expected only the fridge to be left, got %+v", devices)
+	}
+	if r := p.PollDevice(context.Background(), fridge); r.Power == nil || len(p.Devices()) != 0 {
+		t.Fatalf("expected the reading of a removed device to be returned, got %+v", r)
+	}
+}
+
+func TestPollerBetweenWaitsForCycle(t *testing.T) {
+	p := NewPoller(time.Second)
+	p.Add(Device{Instance: "Lamp"})
+	started, release := make(chan struct{}), make(chan struct{})
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		close(started)
+		<-release
+		return &PowerInfo{CurrentWatts: 5}, nil
+	}
+
+	cycled := make(chan struct{})
+	p.OnCycle = func(context.Context, []Reading) { close(cycled) }
+	go p.Poll(context.Background(), func(Reading) {})
+	<-started
+	ran := make(chan struct{})
+	go p.Between(func() {
+		select {
+		case <-cycled:
+		default:
+			t.Error("expected Between to wait for the cycle")
+		}
+		close(ran)
+	})
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	<-ran
+}
+
+func TestPollerFlagsConsecutiveFailures(t *testing.T) {
+	p := NewPoller(time.Second)
+	p.FailureThreshold = 2
+	fail := true
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		if fail {
+			return nil, errors.New("unreachable")
+		}
+		return &PowerInfo{CurrentWatts: 5}, nil
+	}
+	p.Add(Device{Instance: "Lamp"})
+
+	var readings []Reading
+	collect := func(r Reading) { readings = append(readings, r) }
+
+	p.Poll(context.Background(), collect)
+	p.Poll(context.Background(), collect)
+	fail = false
+	p.Poll(context.Background(), collect)
+
+	if readings[0].Failing || readings[0].Failures != 1 {
+		t.Fatalf("expected first failure not to be flagged, got %+v", readings[0])
+	}
+	if !readings[1].Failing || readings[1].Failures != 2 {
+		t.Fatalf("expected second failure to be flagged, got %+v", readings[1])
+	}
+	if readings[2].Failing || readings[2].Failures != 0 || readings[2].Power == nil {
+		t.Fatalf("expected success to reset failures, got %+v", readings[2])
+	}
+	if len(p.Devices()) != 1 {
+		t.Fatal("expected failing device to remain in the polling set")
+	}
+}
+
+func TestPollerRunStopsOnCancel(t *testing.T) {
+	p := NewPoller(10 * time.Millisecond)
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		return &PowerInfo{CurrentWatts: 1}, nil
+	}
+	p.Add(Device{Instance: "Lamp"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	polls := 0
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, func(Reading) {
+			polls++
+			if polls == 2 {
+				cancel()
+			}
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return after cancellation")
+	}
+	if polls < 2 {
+		t.Fatalf("expected at least two polls, got %d", polls)
+	}
+}
+
+func TestPollerOnCycleReceivesAllReadings(t *testing.T) {
+	p := NewPoller(time.Second)
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		return &PowerInfo{CurrentWatts: 1}, nil
+	}
+	p.Add(Device{Instance: "Lamp"})
+	p.Add(Device{Instance: "Plug"})
+
+	var cycle []Reading
+	p.OnCycle = func(ctx context.Context, readings []Reading) { cycle = readings }
+	p.Poll(context.Background(), func(Reading) {})
+
+	if len(cycle) != 2 {
+		t.Fatalf("expected both readings in the cycle, got %d", len(cycle))
+	}
+}
+
+func TestPollerLastCycle(t *testing.T) {
+	clk := testsupport.NewFakeClock(time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC))
+	p := NewPoller(time.Minute)
+	p.Clock = clk
+	p.Pool = NewPool(1)
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		clk.Advance(3 * time.Second)
+		return &PowerInfo{CurrentWatts: 1}, nil
+	}
+	p.Add(Device{Instance: "Lamp"})
+	p.Add(Device{Instance: "Plug"})
+	if p.LastCycle() != 0 {
+		t.Fatal("expected no cycle duration before the first poll")
+	}
+	p.Poll(context.Background(), func(Reading) {})
+	if got := p.LastCycle(); got != 6*time.Second {
+		t.Fatalf("expected the two queries to take 6s, got %v", got)
+	}
+}
+
+func TestPollerReusesReadingsWithinMinGap(t *testing.T) {
+	p := NewPoller(time.Second)
+	p.MinGap = time.Hour
+	fetches := 0
+	fail := true
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		fetches++
+		if fail {
+			return nil, errors.New("unreachable")
+		}
+		return &PowerInfo{CurrentWatts: float64(fetches)}, nil
+	}
+	lamp := Device{Instance: "Lamp"}
+	p.Add(lamp)
+
+	if r := p.PollDevice(context.Background(), lamp); r.Err == nil || r.Cached {
+		t.Fatalf("expected a fetched failure, got %+v", r)
+	}
+	fail = false
+	first := p.PollDevice(context.Background(), lamp)
+	second := p.PollDevice(context.Background(), lamp)
+	if fetches != 2 || first.Cached || !second.Cached || second.Power.CurrentWatts != 2 || !second.Time.Equal(first.Time) {
+		t.Fatalf("expected the second success to be reused, got %d fetches, %+v then %+v", fetches, first, second)
+	}
+	if hits, misses := p.CacheStats(); hits != 1 || misses != 2 {
+		t.Fatalf("expected 1 hit and 2 misses, got %d and %d", hits, misses)
+	}
+
+	p.MinGap = 0
+	if r := p.PollDevice(context.Background(), lamp); r.Cached || fetches != 3 {
+		t.Fatalf("expected no caching without MinGap, got %+v after %d fetches", r, fetches)
+	}
+}
+
+func TestPollerStretchesRateLimitedDevices(t *testing.T) {
+	p := NewPoller(10 * time.Second)
+	p.MaxRateLimitInterval = time.Minute
+	var retryAfter time.Duration
+	limited := true
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		if limited {
+			return nil, &statusError{status: "429 Too Many Requests", code: 429, retryAfter: retryAfter}
+		}
+		return &PowerInfo{CurrentWatts: 5}, nil
+	}
+	lamp := Device{Instance: "Lamp"}
+	p.Add(lamp)
+
+	var intervals []time.Duration
+	for _, after := range []time.Duration{0, 0, 35 * time.Second, 0} {
+		retryAfter = after
+		intervals = append(intervals, p.PollDevice(context.Background(), lamp).Interval)
+	}
+	want := []time.Duration{20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i := range want {
+		if intervals[i] != want[i] {
+			t.Fatalf("expected intervals %v, got %v", want, intervals)
+		}
+	}
+	if due := p.due(time.Now().Add(30 * time.Second)); len(due) != 0 {
+		t.Fatalf("expected the device to wait out its interval, got %+v", due)
+	}
+	if due := p.due(time.Now().Add(55 * time.Second)); len(due) != 1 {
+		t.Fatalf("expected the device to be due near its interval, got %+v", due)
+	}
+
+	limited = false
+	if r := p.PollDevice(context.Background(), lamp); r.Interval != time.Minute {
+		t.Fatalf("expected the interval to stay stretched, got %v", r.Interval)
+	}
+	pd := p.index[lamp.Key()]
+	start := pd.unlimited
+	p.adjustInterval(pd, nil, start.Add(RateLimitRecovery-time.Second))
+	if p.interval(pd) != time.Minute {
+		t.Fatalf("expected the interval to stay stretched within the recovery time, got %v", p.interval(pd))
+	}
+	p.adjustInterval(pd, nil, start.Add(RateLimitRecovery))
+	if p.interval(pd) != p.Interval {
+		t.Fatalf("expected the interval to recover after an hour, got %v", p.interval(pd))
+	}
+}
+
+func TestPollerAdaptsIntervals(t *testing.T) {
+	clk := testsupport.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	p := NewPoller(5 * time.Second)
+	p.Clock = clk
+	p.AdaptiveMaxInterval = 30 * time.Second
+	p.AdaptiveThreshold = 2
+	watts := []float64{100, 101, 100, 100.5, 100, 400, 400}
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		w := watts[0]
+		watts = watts[1:]
+		return &PowerInfo{CurrentWatts: w}, nil
+	}
+	var changes []time.Duration
+	p.OnIntervalChange = func(d Device, from, to time.Duration) { changes = append(changes, to) }
+	heater := Device{Instance: "Heater"}
+	p.Add(heater)
+
+	var intervals []time.Duration
+	for range len(watts) {
+		r := p.PollDevice(context.Background(), heater)
+		intervals = append(intervals, r.Interval)
+		clk.Advance(r.Interval)
+	}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second, 5 * time.Second, 10 * time.Second}
+	if !slices.Equal(intervals, want) {
+		t.Fatalf("expected intervals %v, got %v", want, intervals)
+	}
+	if want := []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 5 * time.Second, 10 * time.Second}; !slices.Equal(changes, want) {
+		t.Fatalf("expected interval changes %v, got %v", want, changes)
+	}
+
+	now := clk.Now()
+	if due := p.due(now.Add(-3 * time.Second)); len(due) != 0 {
+		t.Fatalf("expected the device to wait out its adapted interval, got %+v", due)
+	}
+	if due := p.due(now); len(due) != 1 {
+		t.Fatalf("expected the device due once its interval passed, got %+v", due)
+	}
+}
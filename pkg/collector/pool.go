@@ -0,0 +1,62 @@
+package collector
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultConcurrency is the default number of concurrent device queries.
+const DefaultConcurrency = 8
+
+// Pool runs work on a bounded number of goroutines.
+type Pool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+	// waiting counts the callers of Go blocked on a full pool.
+	waiting atomic.Int64
+}
+
+// PoolStats is a snapshot of a Pool's workers.
+type PoolStats struct {
+	// Size is the most tasks the pool runs at once, and Busy how many it
+	// is running.
+	Size int `json:"size"`
+	Busy int `json:"busy"`
+	// Waiting is how many tasks are waiting for a free slot.
+	Waiting int `json:"waiting"`
+}
+
+// NewPool returns a Pool running at most size tasks at once. A size below
+// one is treated as one.
+func NewPool(size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{sem: make(chan struct{}, size)}
+}
+
+// Go runs fn on a new goroutine once a slot is free, blocking the caller
+// while the pool is full.
+func (p *Pool) Go(fn func()) {
+	p.wg.Add(1)
+	p.waiting.Add(1)
+	p.sem <- struct{}{}
+	p.waiting.Add(-1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		fn()
+	}()
+}
+
+// Stats returns the pool's current load.
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{Size: cap(p.sem), Busy: len(p.sem), Waiting: int(p.waiting.Load())}
+}
+
+// Wait blocks until every task submitted so far has finished.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,136 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func slowServer(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		io.WriteString(w, `{"currentWatts":1}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPoolBoundsWallTimeByPoolSize(t *testing.T) {
+	const (
+		devices = 6
+		size    = 3
+		delay   = 150 * time.Millisecond
+	)
+	var urls []string
+	for i := 0; i < devices; i++ {
+		urls = append(urls, slowServer(t, delay).URL)
+	}
+
+	pool := NewPool(size)
+	var ok atomic.Int32
+	start := time.Now()
+	for _, url := range urls {
+		pool.Go(func() {
+			if _, err := fetchPower(context.Background(), url); err == nil {
+				ok.Add(1)
+			}
+		})
+	}
+	pool.Wait()
+	elapsed := time.Since(start)
+
+	if got := ok.Load(); got != devices {
+		t.Fatalf("expected %d successful fetches, got %d", devices, got)
+	}
+	// Six slow devices on three workers need two rounds, not six.
+	if elapsed < 2*delay || elapsed >= 4*delay {
+		t.Fatalf("expected wall time around %v, got %v", 2*delay, elapsed)
+	}
+}
+
+func TestPoolLimitsConcurrency(t *testing.T) {
+	pool := NewPool(2)
+	var running, peak atomic.Int32
+	for i := 0; i < 10; i++ {
+		pool.Go(func() {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		})
+	}
+	pool.Wait()
+
+	if got := peak.Load(); got != 2 {
+		t.Fatalf("expected peak concurrency 2, got %d", got)
+	}
+}
+
+func TestPollerPollsConcurrently(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	servers := map[string]string{}
+	p := NewPoller(time.Second)
+	p.Pool = NewPool(4)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("dev-%d", i)
+		servers[name] = slowServer(t, delay).URL
+		p.Add(Device{Instance: name})
+	}
+	p.Fetch = func(ctx context.Context, d Device) (*PowerInfo, error) {
+		return fetchPower(ctx, servers[d.Instance])
+	}
+
+	var mu sync.Mutex
+	var readings []Reading
+	start := time.Now()
+	p.Poll(context.Background(), func(r Reading) {
+		mu.Lock()
+		defer mu.Unlock()
+		readings = append(readings, r)
+	})
+	elapsed := time.Since(start)
+
+	if len(readings) != 4 {
+		t.Fatalf("expected 4 readings, got %d", len(readings))
+	}
+	if elapsed >= 2*delay {
+		t.Fatalf("expected concurrent poll to finish within %v, took %v", 2*delay, elapsed)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	pool := NewPool(2)
+	release := make(chan struct{})
+	for range 3 {
+		go pool.Go(func() { <-release })
+	}
+	want := PoolStats{Size: 2, Busy: 2, Waiting: 1}
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Stats() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := pool.Stats(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	close(release)
+	deadline = time.Now().Add(2 * time.Second)
+	for pool.Stats().Waiting != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	pool.Wait()
+	if got := pool.Stats(); got != (PoolStats{Size: 2}) {
+		t.Fatalf("expected an idle pool, got %+v", got)
+	}
+}
@@ -0,0 +1,144 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// probeEndpoints are tried, in order, on a device that answers 404 on its
+// configured path.
+var probeEndpoints = []*httpDriver{
+	{name: "shelly-gen1", path: "/status", decode: decodeShellyStatus},
+	{name: "shelly", path: "/rpc/Switch.GetStatus?id=0", channelParam: "id", decode: decodeShelly},
+	{name: "tasmota", path: "/cm?cmnd=Status%208", decode: decodeTasmota},
+}
+
+// endpointCache remembers the endpoint found by probing each device.
+type endpointCache struct {
+	mu    sync.Mutex
+	paths map[string]*httpDriver
+}
+
+// EndpointKey identifies a device in the endpoints passed to
+// LearnEndpoints. Every channel of a device shares its endpoint.
+func EndpointKey(d Device) string {
+	d.Channel = ""
+	return d.Key()
+}
+
+// LearnEndpoints restores endpoints found by an earlier session, as paths
+// keyed by EndpointKey. Paths that are not well-known endpoints are
+// ignored.
+func (f *Fetcher) LearnEndpoints(paths map[string]string) {
+	f.endpoints.mu.Lock()
+	defer f.endpoints.mu.Unlock()
+	for key, path := range paths {
+		for _, ep := range probeEndpoints {
+			if ep.path == path {
+				f.endpoints.set(key, ep)
+			}
+		}
+	}
+}
+
+// Endpoints returns the endpoints found by probing, as paths keyed by
+// EndpointKey.
+func (f *Fetcher) Endpoints() map[string]string {
+	f.endpoints.mu.Lock()
+	defer f.endpoints.mu.Unlock()
+	paths := make(map[string]string, len(f.endpoints.paths))
+	for key, ep := range f.endpoints.paths {
+		paths[key] = ep.path
+	}
+	return paths
+}
+
+func (c *endpointCache) set(key string, ep *httpDriver) {
+	if c.paths == nil {
+		c.paths = make(map[string]*httpDriver)
+	}
+	c.paths[key] = ep
+}
+
+// endpoint returns the endpoint probed for d, or nil.
+func (f *Fetcher) endpoint(d Device) *httpDriver {
+	if !f.canProbe() {
+		return nil
+	}
+	f.endpoints.mu.Lock()
+	defer f.endpoints.mu.Unlock()
+	return f.endpoints.paths[EndpointKey(d)]
+}
+
+func (f *Fetcher) canProbe() bool {
+	return f.ProbeEndpoints && f.Template == nil && f.Fields.IsZero()
+}
+
+// probe tries each well-known endpoint on d, remembering the first that
+// returns a reading. The probes share the budget of the query that
+// answered 404, so a device that answers on none fails no later than a
+// normal query would; notFound is returned then.
+func (f *Fetcher) probe(ctx context.Context, d Device, notFound error) (*PowerInfo, error) {
+	for _, ep := range probeEndpoints {
+		info, err := ep.fetchURL(ctx, f, d, f.pathURL(d, ep.path, ep.channelParam), false)
+		if err != nil {
+			if f.spent(ctx) {
+				break
+			}
+			continue
+		}
+		f.endpoints.mu.Lock()
+		f.endpoints.set(EndpointKey(d), ep)
+		f.endpoints.mu.Unlock()
+		if f.EndpointProbed != nil {
+			f.EndpointProbed(d, ep.path)
+		}
+		return info, nil
+	}
+	return nil, fmt.Errorf("%w (no well-known endpoint answered)", notFound)
+}
+
+// isNotFound reports whether err is a 404 response.
+func isNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.code == http.StatusNotFound
+}
+
+// decodeShellyStatus decodes the /status document of a Shelly Gen1
+// device. Energy meters report under emeters and relays with metering
+// under meters, indexed by channel from 0.
+func decodeShellyStatus(body []byte, channel string) (*PowerInfo, error) {
+	type meter struct {
+		Power   *float64 `json:"power"`
+		Voltage float64  `json:"voltage"`
+		Current float64  `json:"current"`
+	}
+	var status struct {
+		Meters  []meter `json:"meters"`
+		EMeters []meter `json:"emeters"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	index := 0
+	if channel != "" {
+		var err error
+		if index, err = strconv.Atoi(channel); err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid channel %q: want an index from 0", channel)
+		}
+	}
+	meters := status.EMeters
+	if len(meters) == 0 {
+		meters = status.Meters
+	}
+	if index >= len(meters) || meters[index].Power == nil {
+		return nil, fmt.Errorf("missing meters power field for channel %d", index)
+	}
+	m := meters[index]
+	return &PowerInfo{CurrentWatts: *m.Power, Voltage: m.Voltage, Amperage: m.Current}, nil
+}
@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// probeServer serves a reading on request URIs starting with prefix only,
+// recording every request.
+func probeServer(t *testing.T, prefix, body string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.RequestURI())
+		mu.Unlock()
+		if !strings.HasPrefix(r.URL.RequestURI(), prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func serverDevice(server *httptest.Server) (Device, int) {
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	return Device{Instance: "Plug", HostName: "plug.local", Address: addr.IP.String()}, addr.Port
+}
+
+func TestFetcherProbesEndpointsOn404(t *testing.T) {
+	server, requests := probeServer(t, "/rpc/Switch.GetStatus?id=", `{"id":0,"apower":7.5,"voltage":231}`)
+	d, port := serverDevice(server)
+
+	var probed []string
+	f := &Fetcher{Port: port, Retries: 2, RetryBackoff: time.Millisecond, ProbeEndpoints: true, EndpointProbed: func(d Device, path string) {
+		probed = append(probed, d.Instance+" "+path)
+	}}
+	info, err := f.Fetch(context.Background(), d)
+	if err != nil || info.CurrentWatts != 7.5 || info.Voltage != 231 {
+		t.Fatalf("expected the probed endpoint's reading, got %+v, %v", info, err)
+	}
+	want := []string{"/api/power", "/status", "/rpc/Switch.GetStatus?id=0"}
+	if got := requests(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected requests %q, got %q", want, got)
+	}
+	if len(probed) != 1 || probed[0] != "Plug /rpc/Switch.GetStatus?id=0" {
+		t.Fatalf("expected one probe report, got %q", probed)
+	}
+
+	// The endpoint is remembered for the device and all its channels.
+	d.Channel = "1"
+	if _, err := f.Fetch(context.Background(), d); err != nil {
+		t.Fatalf("expected the remembered endpoint to be used, got %v", err)
+	}
+	if got := requests(); got[len(got)-1] != "/rpc/Switch.GetStatus?id=1" || len(got) != 4 {
+		t.Fatalf("expected a single request to the remembered endpoint, got %q", got)
+	}
+	if got := f.Endpoints(); got[EndpointKey(d)] != "/rpc/Switch.GetStatus?id=0" {
+		t.Fatalf("unexpected endpoints %v", got)
+	}
+}
+
+func TestFetcherWithoutProbingReports404(t *testing.T) {
+	server, requests := probeServer(t, "/status", `{"meters":[{"power":1}]}`)
+	d, port := serverDevice(server)
+
+	f := &Fetcher{Port: port}
+	if _, err := f.Fetch(context.Background(), d); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected the 404 without probing, got %v", err)
+	}
+	if got := requests(); len(got) != 1 {
+		t.Fatalf("expected no probes, got %q", got)
+	}
+}
+
+func TestFetcherProbeFailsWithinOneQueryTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/power" {
+			http.NotFound(w, r)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	d, port := serverDevice(server)
+
+	f := &Fetcher{Port: port, Timeout: 200 * time.Millisecond, Retries: 3, RetryBackoff: time.Millisecond, ProbeEndpoints: true}
+	start := time.Now()
+	_, err := f.Fetch(context.Background(), d)
+	if err == nil || !strings.Contains(err.Error(), "no well-known endpoint answered") {
+		t.Fatalf("expected the probe to fail, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected probing to stop after one query timeout, took %v", elapsed)
+	}
+	if len(f.Endpoints()) != 0 {
+		t.Fatalf("expected no endpoint to be remembered, got %v", f.Endpoints())
+	}
+}
+
+func TestFetcherProbesWithinTheQueryTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/power" {
+			time.Sleep(150 * time.Millisecond)
+			http.NotFound(w, r)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	d, port := serverDevice(server)
+
+	f := &Fetcher{Port: port, Timeout: 200 * time.Millisecond, ProbeEndpoints: true}
+	start := time.Now()
+	if _, err := f.Fetch(context.Background(), d); err == nil {
+		t.Fatal("expected the probe to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("expected the probes to get only what the 404 left of the timeout, took %v", elapsed)
+	}
+}
+
+func TestFetcherLearnEndpoints(t *testing.T) {
+	server, requests := probeServer(t, "/cm?cmnd=Status%208", `{"StatusSNS":{"ENERGY":{"Power":42}}}`)
+	d, port := serverDevice(server)
+
+	f := &Fetcher{Port: port, ProbeEndpoints: true}
+	f.LearnEndpoints(map[string]string{EndpointKey(d): "/cm?cmnd=Status%208", "Other|other.local": "/evil"})
+	info, err := f.Fetch(context.Background(), d)
+	if err != nil || info.CurrentWatts != 42 {
+		t.Fatalf("expected the learned endpoint's reading, got %+v, %v", info, err)
+	}
+	if got := requests(); len(got) != 1 {
+		t.Fatalf("expected the learned endpoint to be queried directly, got %q", got)
+	}
+	if got := f.Endpoints(); len(got) != 1 {
+		t.Fatalf("expected unknown paths to be ignored, got %v", got)
+	}
+}
+
+func TestDecodeShellyStatus(t *testing.T) {
+	body := []byte(`{"meters":[{"power":0}],"emeters":[{"power":120.5,"voltage":230,"current":0.5},{"power":60}]}`)
+	info, err := decodeShellyStatus(body, "")
+	if err != nil || info.CurrentWatts != 120.5 || info.Voltage != 230 || info.Amperage != 0.5 {
+		t.Fatalf("expected the first energy meter, got %+v, %v", info, err)
+	}
+	if info, err := decodeShellyStatus(body, "1"); err != nil || info.CurrentWatts != 60 {
+		t.Fatalf("expected the second energy meter, got %+v, %v", info, err)
+	}
+	if _, err := decodeShellyStatus(body, "2"); err == nil {
+		t.Fatal("expected an error for a missing channel")
+	}
+	if info, err := decodeShellyStatus([]byte(`{"meters":[{"power":8}]}`), ""); err != nil || info.CurrentWatts != 8 {
+		t.Fatalf("expected the relay meter, got %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,153 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	// DefaultScanTimeout bounds the probe of each scanned host.
+	DefaultScanTimeout = time.Second
+	// maxScanHosts bounds the hosts of one scanned prefix.
+	maxScanHosts = 1 << 16
+)
+
+// ScanHosts returns the host addresses of prefix. The network and
+// broadcast addresses of IPv4 prefixes are skipped, except in /31 and /32
+// prefixes, which have none. Prefixes of more than 65536 addresses are
+// refused.
+func ScanHosts(prefix netip.Prefix) ([]netip.Addr, error) {
+	if !prefix.IsValid() {
+		return nil, fmt.Errorf("invalid prefix %v", prefix)
+	}
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 16 {
+		return nil, fmt.Errorf("prefix %v has more than %d addresses", prefix, maxScanHosts)
+	}
+	n := 1 << hostBits
+	addr := prefix.Masked().Addr()
+	skipEnds := prefix.Addr().Is4() && hostBits > 1
+	if skipEnds {
+		addr = addr.Next()
+		n -= 2
+	}
+	hosts := make([]netip.Addr, 0, n)
+	for range n {
+		hosts = append(hosts, addr)
+		addr = addr.Next()
+	}
+	return hosts, nil
+}
+
+// Scanner finds devices by probing every host of some subnets, for
+// networks where multicast discovery cannot reach them.
+type Scanner struct {
+	Prefixes []netip.Prefix
+	// Probe queries a candidate device, succeeding when the host answers
+	// with a power reading.
+	Probe func(ctx context.Context, d Device) (*PowerInfo, error)
+	// Concurrency bounds the hosts probed at once. Zero means
+	// DefaultConcurrency.
+	Concurrency int
+	// Timeout bounds each probe. Zero means DefaultScanTimeout.
+	Timeout time.Duration
+	// Interval, when positive, repeats the scan until ctx is done, so
+	// devices that moved to another address are found again.
+	Interval time.Duration
+}
+
+// scan probes every host once, sending each responder on found. It returns
+// once every probe has finished or ctx is done.
+func (s *Scanner) scan(ctx context.Context, found chan<- Device) {
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScanTimeout
+	}
+
+	pool := NewPool(concurrency)
+	defer pool.Wait()
+	for _, prefix := range s.Prefixes {
+		hosts, err := ScanHosts(prefix)
+		if err != nil {
+			continue
+		}
+		for _, host := range hosts {
+			if ctx.Err() != nil {
+				return
+			}
+			pool.Go(func() {
+				d := scannedDevice(host)
+				probeCtx, cancel := context.WithTimeout(ctx, timeout)
+				defer cancel()
+				info, err := s.Probe(probeCtx, d)
+				if err != nil {
+					return
+				}
+				if info.DeviceName != "" {
+					d.Instance = info.DeviceName
+				}
+				select {
+				case found <- d:
+				case <-ctx.Done():
+				}
+			})
+		}
+	}
+}
+
+// run scans until ctx is done, or once without an Interval, then closes
+// found.
+func (s *Scanner) run(ctx context.Context, found chan<- Device) {
+	defer close(found)
+	for {
+		s.scan(ctx, found)
+		if s.Interval <= 0 {
+			return
+		}
+		timer := time.NewTimer(s.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// scannedDevice is the device probed at host, named after its address
+// until its reading gives a better name.
+func scannedDevice(host netip.Addr) Device {
+	addr := host.String()
+	return Device{Instance: addr, Address: addr, Addresses: []string{addr}}
+}
+
+// scanMerger remembers the address each scanned device was last reported
+// at, so rescans only report devices that are new or have moved.
+type scanMerger struct {
+	byKey map[string]string
+	addrs map[string]bool
+}
+
+func newScanMerger() *scanMerger {
+	return &scanMerger{byKey: make(map[string]string), addrs: make(map[string]bool)}
+}
+
+// add records d and reports whether it is new or at another address.
+func (m *scanMerger) add(d Device) bool {
+	prev, ok := m.byKey[d.Key()]
+	if ok && prev == d.Address {
+		return false
+	}
+	if ok {
+		delete(m.addrs, prev)
+	}
+	m.byKey[d.Key()] = d.Address
+	m.addrs[d.Address] = true
+	return true
+}
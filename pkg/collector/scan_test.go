@@ -0,0 +1,142 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScanHosts(t *testing.T) {
+	for prefix, want := range map[string][]string{
+		"192.168.30.0/30": {"192.168.30.1", "192.168.30.2"},
+		"192.168.30.4/31": {"192.168.30.4", "192.168.30.5"},
+		"10.0.0.9/32":     {"10.0.0.9"},
+		"fd00::/127":      {"fd00::", "fd00::1"},
+	} {
+		hosts, err := ScanHosts(netip.MustParsePrefix(prefix))
+		if err != nil || len(hosts) != len(want) {
+			t.Fatalf("%s: expected %v, got %v, %v", prefix, want, hosts, err)
+		}
+		for i, h := range hosts {
+			if h.String() != want[i] {
+				t.Fatalf("%s: expected %v, got %v", prefix, want, hosts)
+			}
+		}
+	}
+	if hosts, _ := ScanHosts(netip.MustParsePrefix("10.1.0.0/16")); len(hosts) != 65534 {
+		t.Fatalf("expected a /16 to have 65534 hosts, got %d", len(hosts))
+	}
+	if _, err := ScanHosts(netip.MustParsePrefix("10.0.0.0/8")); err == nil {
+		t.Fatal("expected a /8 to be refused")
+	}
+}
+
+// scanProbe answers after delay for the hosts in watts, naming them from
+// names.
+func scanProbe(delay time.Duration, watts map[string]float64, names map[string]string) func(context.Context, Device) (*PowerInfo, error) {
+	return func(_ context.Context, d Device) (*PowerInfo, error) {
+		time.Sleep(delay)
+		w, ok := watts[d.Address]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		return &PowerInfo{DeviceName: names[d.Address], CurrentWatts: w}, nil
+	}
+}
+
+func TestDiscoverMergesScannedDevices(t *testing.T) {
+	opts := DiscoverOptions{
+		Resolver: &fakeResolver{entries: []*ServiceEntry{
+			{Instance: "Fridge", HostName: "fridge.local.", AddrIPv4: []net.IP{net.IPv4(10, 0, 0, 3)}},
+		}},
+		Static: []Device{{Instance: "Heater", Address: "10.0.0.2"}},
+		// The browsed device is reported before the scan gets to its
+		// address, which also answers.
+		Scan: &Scanner{
+			Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/29")},
+			Probe:    scanProbe(20*time.Millisecond, map[string]float64{"10.0.0.1": 5, "10.0.0.2": 1000, "10.0.0.3": 80, "10.0.0.5": 12}, map[string]string{"10.0.0.5": "Lamp"}),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	devices, err := Discover(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byAddress := make(map[string]string)
+	for _, d := range devices {
+		if _, dup := byAddress[d.Address]; dup {
+			t.Fatalf("expected one device per address, got %+v", devices)
+		}
+		byAddress[d.Address] = d.Instance
+	}
+	want := map[string]string{"10.0.0.1": "10.0.0.1", "10.0.0.2": "Heater", "10.0.0.3": "Fridge", "10.0.0.5": "Lamp"}
+	if len(byAddress) != len(want) {
+		t.Fatalf("expected %v, got %v", want, byAddress)
+	}
+	for addr, name := range want {
+		if byAddress[addr] != name {
+			t.Fatalf("expected %v, got %v", want, byAddress)
+		}
+	}
+}
+
+func TestDiscoverScansWithoutBrowsing(t *testing.T) {
+	opts := DiscoverOptions{
+		NoBrowse: true,
+		Scan: &Scanner{
+			Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/30")},
+			Probe:    scanProbe(0, map[string]float64{"10.0.0.2": 5}, nil),
+		},
+	}
+	devices, err := Discover(context.Background(), opts)
+	if err != nil || len(devices) != 1 || devices[0].Address != "10.0.0.2" {
+		t.Fatalf("expected the one responder, got %+v, %v", devices, err)
+	}
+}
+
+func TestDiscoverRescansFollowMovedDevices(t *testing.T) {
+	var mu sync.Mutex
+	at := "10.0.0.1"
+	opts := DiscoverOptions{
+		NoBrowse: true,
+		Scan: &Scanner{
+			Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/30")},
+			Interval: 10 * time.Millisecond,
+			Probe: func(_ context.Context, d Device) (*PowerInfo, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if d.Address != at {
+					return nil, errors.New("connection refused")
+				}
+				return &PowerInfo{DeviceName: "Lamp"}, nil
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var devices []Device
+	err := DiscoverFunc(ctx, opts, func(d Device) {
+		devices = append(devices, d)
+		switch len(devices) {
+		case 1:
+			mu.Lock()
+			at = "10.0.0.2"
+			mu.Unlock()
+		case 2:
+			cancel()
+		}
+	})
+	if err != nil || len(devices) != 2 {
+		t.Fatalf("expected the device to be reported again once moved, got %+v, %v", devices, err)
+	}
+	if devices[0].Key() != devices[1].Key() || devices[1].Address != "10.0.0.2" {
+		t.Fatalf("expected the same device at its new address, got %+v", devices)
+	}
+}
@@ -0,0 +1,113 @@
+package collector
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// serviceEntry is a discovered entry with the service it was browsed
+// under.
+type serviceEntry struct {
+	*ServiceEntry
+	service string
+}
+
+// browseServices browses every service concurrently, merging their entries
+// into one channel. The channel is closed once every browse has ended,
+// which happens when ctx is done. A browse that cannot start is passed to
+// failed and the others carry on; started counts those that did.
+func browseServices(ctx context.Context, r Resolver, services []string, domain string, failed func(service string, err error)) (out <-chan serviceEntry, started int) {
+	ctx, cancel := context.WithCancel(ctx)
+	merged := make(chan serviceEntry)
+	var wg sync.WaitGroup
+	for _, service := range services {
+		entries := make(chan *ServiceEntry)
+		if err := r.Browse(ctx, service, domain, entries); err != nil {
+			failed(service, err)
+			continue
+		}
+		started++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Entries are drained until the resolver closes the channel,
+			// even once nobody reads them.
+			for e := range entries {
+				select {
+				case merged <- serviceEntry{e, service}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(merged)
+	}()
+	return merged, started
+}
+
+// deviceMerger remembers the devices reported during a discovery pass, so
+// repeats are skipped and a host found under several services becomes one
+// device.
+type deviceMerger struct {
+	byKey  map[string]*Device
+	byHost map[string][]string
+}
+
+func newDeviceMerger() *deviceMerger {
+	return &deviceMerger{byKey: make(map[string]*Device), byHost: make(map[string][]string)}
+}
+
+// add records d, whose Services holds the service it was just found under,
+// and returns the device to report along with whether it is new or brings
+// an IPv4 address or service its earlier record lacked. An entry for a
+// host already known under another service is merged into that host's
+// device, keeping its name.
+func (m *deviceMerger) add(d Device) (Device, bool) {
+	prev, ok := m.byKey[d.Key()]
+	if !ok && d.HostName != "" {
+		for _, key := range m.byHost[d.HostName] {
+			if p := m.byKey[key]; !slices.Contains(p.Services, d.Services[0]) {
+				prev, ok = p, true
+				break
+			}
+		}
+	}
+	if !ok {
+		m.byKey[d.Key()] = &d
+		m.byHost[d.HostName] = append(m.byHost[d.HostName], d.Key())
+		return d, true
+	}
+
+	changed := false
+	if hasIPv4(d) && !hasIPv4(*prev) {
+		prev.Address, prev.Addresses = d.Address, d.Addresses
+		changed = true
+	}
+	for _, service := range d.Services {
+		if !slices.Contains(prev.Services, service) {
+			prev.Services = append(prev.Services, service)
+			changed = true
+		}
+	}
+	if !changed {
+		return *prev, false
+	}
+	for _, txt := range d.Text {
+		if !slices.Contains(prev.Text, txt) {
+			prev.Text = append(prev.Text, txt)
+		}
+	}
+	prev.Meta = ParseTXT(&ServiceEntry{Text: prev.Text})
+	if prev.Firmware == "" {
+		prev.Firmware = d.Firmware
+	}
+
+	merged := *prev
+	merged.Services = slices.Clone(prev.Services)
+	merged.Text = slices.Clone(prev.Text)
+	return merged, true
+}
@@ -0,0 +1,111 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serviceResolver emits the entries listed under each service browsed.
+type serviceResolver map[string][]*ServiceEntry
+
+func (r serviceResolver) Browse(ctx context.Context, service, _ string, entries chan<- *ServiceEntry) error {
+	if _, ok := r[service]; !ok {
+		return errors.New("unknown service " + service)
+	}
+	return (&fakeResolver{entries: r[service]}).Browse(ctx, service, "", entries)
+}
+
+func TestDiscoverMergesHostsAcrossServices(t *testing.T) {
+	resolver := serviceResolver{
+		OperationalService: {
+			{Instance: "A1B2-0001", HostName: "plug.local.", Text: []string{"SII=5000"}, AddrIPv4: []net.IP{net.ParseIP("10.0.0.7")}},
+			{Instance: "A1B2-0002", HostName: "plug.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.0.7")}},
+		},
+		CommissionableService: {
+			{Instance: "F00D", HostName: "plug.local.", Text: []string{"CM=1", "D=3840"}, AddrIPv4: []net.IP{net.ParseIP("10.0.0.7")}},
+			{Instance: "BEEF", HostName: "new.local.", Text: []string{"CM=1"}, AddrIPv4: []net.IP{net.ParseIP("10.0.0.8")}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	latest := make(map[string]Device)
+	err := DiscoverFunc(ctx, DiscoverOptions{Resolver: resolver, Services: []string{OperationalService, CommissionableService}}, func(d Device) {
+		latest[d.Key()] = d
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The commissionable entry joins the first operational device on its
+	// host; the second fabric's operational instance stays separate.
+	if len(latest) != 3 {
+		t.Fatalf("expected three devices, got %+v", latest)
+	}
+	var merged Device
+	for _, d := range latest {
+		if len(d.Services) == 2 {
+			merged = d
+		}
+	}
+	if !slices.Contains(merged.Services, OperationalService) || !slices.Contains(merged.Services, CommissionableService) {
+		t.Fatalf("expected a device found under both services, got %+v", latest)
+	}
+	if !merged.Operational() || !merged.Commissionable() || merged.Meta.Discriminator != 3840 || merged.Meta.SessionIdle != 5*time.Second {
+		t.Fatalf("expected the merged device to carry both advertisements, got %+v", merged)
+	}
+	if d := latest["BEEF|new.local"]; d.Operational() || !d.Commissionable() {
+		t.Fatalf("expected an uncommissioned device, got %+v", d)
+	}
+}
+
+func TestDiscoverCarriesOnWithoutFailingService(t *testing.T) {
+	resolver := serviceResolver{OperationalService: {{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{net.ParseIP("10.0.0.7")}}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	failed := make(map[string]error)
+	var found []Device
+	err := DiscoverFunc(ctx, DiscoverOptions{
+		Resolver: resolver,
+		Services: []string{OperationalService, "_other._udp"},
+		SourceFailed: func(source string, err error) {
+			failed[source] = err
+		},
+	}, func(d Device) {
+		found = append(found, d)
+	})
+	if err != nil {
+		t.Fatalf("expected discovery to carry on, got %v", err)
+	}
+	if len(found) != 1 || found[0].Instance != "Lamp" {
+		t.Fatalf("expected the working service's device, got %+v", found)
+	}
+	if len(failed) != 1 || failed["mdns _other._udp"] == nil {
+		t.Fatalf("expected the failing service to be reported, got %v", failed)
+	}
+}
+
+func TestDiscoverStrictFailsOnAnyService(t *testing.T) {
+	resolver := serviceResolver{OperationalService: nil}
+	err := DiscoverFunc(context.Background(), DiscoverOptions{Resolver: resolver, Services: []string{OperationalService, "_other._udp"}, Strict: true}, func(Device) {})
+	if err == nil || !strings.Contains(err.Error(), "mdns _other._udp: unknown service") {
+		t.Fatalf("expected the failing service's error, got %v", err)
+	}
+}
+
+func TestCommissionableNeedsCommissioningMode(t *testing.T) {
+	d := Device{Services: []string{CommissionableService}}
+	if d.Commissionable() {
+		t.Fatal("expected a device without CM=1 not to be commissionable")
+	}
+	d.Meta.CommissioningMode = 2
+	if !d.Commissionable() || d.Operational() {
+		t.Fatalf("unexpected status of %+v", d)
+	}
+}
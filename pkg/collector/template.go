@@ -0,0 +1,102 @@
+package collector
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultPowerPath is the path queried on each device when no path or URL
+// template is configured.
+const DefaultPowerPath = "/api/power"
+
+// URLTemplate builds per-device URLs from a pattern such as
+// "http://{addr}:{port}/rpc/Switch.GetStatus?id=0". The placeholders
+// {addr}, {port}, {host}, {instance} and {channel} are substituted for
+// each device; {addr} is bracketed for IPv6 addresses and {channel} is
+// empty for a device with a single unnamed channel.
+type URLTemplate struct {
+	raw   string
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal     string
+	placeholder string
+}
+
+var templatePlaceholders = map[string]bool{"addr": true, "port": true, "host": true, "instance": true, "channel": true}
+
+// ParseURLTemplate parses and validates a URL template.
+func ParseURLTemplate(s string) (*URLTemplate, error) {
+	t := &URLTemplate{raw: s}
+	rest := s
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("url template %q: unclosed placeholder", s)
+		}
+		name := rest[open+1 : open+end]
+		if !templatePlaceholders[name] {
+			return nil, fmt.Errorf("url template %q: unknown placeholder {%s}", s, name)
+		}
+		t.parts = append(t.parts, templatePart{placeholder: name})
+		rest = rest[open+end+1:]
+	}
+
+	sample := t.expand(Device{Instance: "sample", HostName: "sample.local", Address: "192.0.2.1"}, 80)
+	u, err := url.Parse(sample)
+	if err != nil {
+		return nil, fmt.Errorf("url template %q: %w", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url template %q: must be an absolute http or https URL", s)
+	}
+	return t, nil
+}
+
+// String returns the template as it was given.
+func (t *URLTemplate) String() string {
+	return t.raw
+}
+
+// Expand returns the URL for d, or an empty string when the template needs
+// an address or host name the device does not have.
+func (t *URLTemplate) Expand(d Device, port int) string {
+	for _, p := range t.parts {
+		if (p.placeholder == "addr" && d.Address == "") || (p.placeholder == "host" && d.HostName == "") {
+			return ""
+		}
+	}
+	return t.expand(d, port)
+}
+
+func (t *URLTemplate) expand(d Device, port int) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.placeholder {
+		case "":
+			b.WriteString(p.literal)
+		case "addr":
+			b.WriteString(URLHost(d.Address))
+		case "port":
+			b.WriteString(strconv.Itoa(port))
+		case "host":
+			b.WriteString(d.HostName)
+		case "instance":
+			b.WriteString(url.PathEscape(d.Instance))
+		case "channel":
+			b.WriteString(url.QueryEscape(d.Channel))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package collector
+
+import "testing"
+
+func TestURLTemplatePlaceholders(t *testing.T) {
+	d := Device{Instance: "Office Plug", HostName: "plug.local", Address: "10.0.0.7"}
+	cases := []struct {
+		template string
+		want     string
+	}{
+		{"http://{addr}/status", "http://10.0.0.7/status"},
+		{"http://{addr}:{port}/rpc/Switch.GetStatus?id=0", "http://10.0.0.7:8080/rpc/Switch.GetStatus?id=0"},
+		{"https://{host}/api/power", "https://plug.local/api/power"},
+		{"http://{addr}/devices/{instance}", "http://10.0.0.7/devices/Office%20Plug"},
+	}
+	for _, c := range cases {
+		tmpl, err := ParseURLTemplate(c.template)
+		if err != nil {
+			t.Fatalf("expected %q to parse, got %v", c.template, err)
+		}
+		if got := tmpl.Expand(d, 8080); got != c.want {
+			t.Fatalf("Expand(%q) = %q, want %q", c.template, got, c.want)
+		}
+	}
+}
+
+func TestURLTemplateBracketsIPv6(t *testing.T) {
+	tmpl, err := ParseURLTemplate("http://{addr}:{port}/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]string{
+		"2001:db8::1":  "http://[2001:db8::1]:80/status",
+		"fe80::1%eth0": "http://[fe80::1%25eth0]:80/status",
+	} {
+		if got := tmpl.Expand(Device{Address: addr}, 80); got != want {
+			t.Fatalf("Expand for %q = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestURLTemplateEscapesInstance(t *testing.T) {
+	tmpl, err := ParseURLTemplate("http://{addr}/q?name={instance}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tmpl.Expand(Device{Instance: "Kitchen Kettle/2", Address: "10.0.0.8"}, 80)
+	if want := "http://10.0.0.8/q?name=Kitchen%20Kettle%2F2"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestURLTemplateNeedsAddress(t *testing.T) {
+	tmpl, _ := ParseURLTemplate("http://{addr}/status")
+	if got := tmpl.Expand(Device{Instance: "NoIP"}, 80); got != "" {
+		t.Fatalf("expected empty URL without an address, got %q", got)
+	}
+
+	byHost, _ := ParseURLTemplate("http://{host}/status")
+	if got := byHost.Expand(Device{Instance: "NoIP", HostName: "noip.local"}, 80); got != "http://noip.local/status" {
+		t.Fatalf("expected host-based URL without an address, got %q", got)
+	}
+}
+
+func TestParseURLTemplateErrors(t *testing.T) {
+	for _, bad := range []string{
+		"http://{addr/status",
+		"http://{ip}/status",
+		"ftp://{addr}/status",
+		"/api/power",
+		"http://{addr}:{port}/%zz",
+	} {
+		if _, err := ParseURLTemplate(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestFetcherUsesPathAndTemplate(t *testing.T) {
+	d := Device{Instance: "Plug", Address: "10.0.0.7"}
+
+	f := &Fetcher{Path: "/rpc/Switch.GetStatus?id=0"}
+	if got, want := f.URL(d), "http://10.0.0.7:80/rpc/Switch.GetStatus?id=0"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	tmpl, _ := ParseURLTemplate("https://{addr}:{port}/status")
+	f = &Fetcher{Scheme: "https", Template: tmpl}
+	if got, want := f.URL(d), "https://10.0.0.7:443/status"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
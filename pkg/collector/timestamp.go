@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampSourceCollector marks a reading stamped with the time it was
+	// fetched because the device gave no usable timestamp.
+	TimestampSourceCollector = "collector"
+	// DefaultMaxSkew is how far in the future a device timestamp may lie
+	// before it is rejected.
+	DefaultMaxSkew = 5 * time.Minute
+)
+
+// epochMillisThreshold separates epoch seconds from epoch milliseconds:
+// 1e11 seconds is in the year 5138, while 1e11 milliseconds is in 1973.
+const epochMillisThreshold = 1e11
+
+// localLayout is the zoneless ISO 8601 form used by Tasmota, read in local
+// time.
+const localLayout = "2006-01-02T15:04:05"
+
+// ParseTimestamp parses a device timestamp. layout, when set, is tried
+// first, then RFC 3339, epoch seconds or milliseconds, and finally an ISO
+// 8601 date and time without a zone. Layouts without a zone are read in
+// local time. The result is in UTC.
+func ParseTimestamp(s, layout string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if layout != "" {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if math.Abs(float64(n)) >= epochMillisThreshold {
+			return time.UnixMilli(n).UTC(), nil
+		}
+		return time.Unix(n, 0).UTC(), nil
+	}
+	// Fractional epochs are kept to the microsecond, beyond which float64
+	// cannot be trusted.
+	if n, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(n, 0) && !math.IsNaN(n) {
+		if math.Abs(n) >= epochMillisThreshold {
+			return time.UnixMicro(int64(math.Round(n * 1e3))).UTC(), nil
+		}
+		return time.UnixMicro(int64(math.Round(n * 1e6))).UTC(), nil
+	}
+	if t, err := time.ParseInLocation(localLayout, s, time.Local); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
+
+// rawTimestamp returns a decoded JSON timestamp value as text: strings as
+// they are and numbers in their original digits.
+func rawTimestamp(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return ""
+}
+
+// stamp sets info.Timestamp from the device's raw timestamp, falling back
+// to fetched when there is none or it is rejected. Rejections are passed to
+// TimestampWarning.
+func (f *Fetcher) stamp(info *PowerInfo, d Device, fetched time.Time) {
+	raw := info.RawTimestamp
+	info.Timestamp, info.TimestampSource = time.Time{}, ""
+	if raw != "" {
+		t, err := ParseTimestamp(raw, f.TimestampLayout)
+		if err == nil {
+			maxSkew := f.MaxSkew
+			if maxSkew <= 0 {
+				maxSkew = DefaultMaxSkew
+			}
+			if ahead := t.Sub(fetched); ahead > maxSkew {
+				err = fmt.Errorf("timestamp %s is %s in the future", t.Format(time.RFC3339), ahead.Round(time.Second))
+			}
+		}
+		if err == nil {
+			info.Timestamp = t
+			return
+		}
+		if f.TimestampWarning != nil {
+			f.TimestampWarning(d, err)
+		}
+	}
+	info.Timestamp = fetched.UTC()
+	info.TimestampSource = TimestampSourceCollector
+}
@@ -0,0 +1,111 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	cases := []struct {
+		in, layout string
+		want       time.Time
+	}{
+		{"2024-02-02T15:04:05Z", "", time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)},
+		{"2024-02-02T16:04:05.25+01:00", "", time.Date(2024, 2, 2, 15, 4, 5, 250e6, time.UTC)},
+		{"1706886245", "", time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)},
+		{"1706886245.5", "", time.Date(2024, 2, 2, 15, 4, 5, 500e6, time.UTC)},
+		{"1706886245123", "", time.Date(2024, 2, 2, 15, 4, 5, 123e6, time.UTC)},
+		{" 1706886245123 ", "", time.Date(2024, 2, 2, 15, 4, 5, 123e6, time.UTC)},
+		{"2024-02-02T15:04:05", "", time.Date(2024, 2, 2, 15, 4, 5, 0, time.Local)},
+		{"02/01/2024 15:04", "02/01/2006 15:04", time.Date(2024, 1, 2, 15, 4, 0, 0, time.Local)},
+		{"02/01/2024 15:04 +0200", "02/01/2006 15:04 -0700", time.Date(2024, 1, 2, 13, 4, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got, err := ParseTimestamp(c.in, c.layout)
+		if err != nil {
+			t.Errorf("ParseTimestamp(%q, %q) failed: %v", c.in, c.layout, err)
+			continue
+		}
+		if !got.Equal(c.want) || got.Location() != time.UTC {
+			t.Errorf("ParseTimestamp(%q, %q) = %v, want %v in UTC", c.in, c.layout, got, c.want.UTC())
+		}
+	}
+
+	for _, in := range []string{"", "yesterday", "02/01/2024 15:04", "NaN"} {
+		if _, err := ParseTimestamp(in, ""); err == nil {
+			t.Errorf("ParseTimestamp(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestStampFallsBackToFetchTime(t *testing.T) {
+	fetched := time.Date(2024, 2, 2, 15, 4, 5, 0, time.FixedZone("CET", 3600))
+	var warnings []string
+	f := &Fetcher{MaxSkew: time.Minute, TimestampWarning: func(d Device, err error) {
+		warnings = append(warnings, d.Instance+": "+err.Error())
+	}}
+
+	cases := []struct {
+		raw        string
+		want       time.Time
+		source     string
+		warnedWith string
+	}{
+		{"", fetched, TimestampSourceCollector, ""},
+		{"garbage", fetched, TimestampSourceCollector, `unrecognised timestamp "garbage"`},
+		{"2024-02-02T14:05:00Z", time.Date(2024, 2, 2, 14, 5, 0, 0, time.UTC), "", ""},
+		{"2024-02-02T14:06:05Z", fetched, TimestampSourceCollector, "is 2m0s in the future"},
+		{"2023-01-01T00:00:00Z", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), "", ""},
+	}
+	for _, c := range cases {
+		warnings = nil
+		info := &PowerInfo{RawTimestamp: c.raw}
+		f.stamp(info, Device{Instance: "Lamp"}, fetched)
+		if !info.Timestamp.Equal(c.want) || info.Timestamp.Location() != time.UTC || info.TimestampSource != c.source {
+			t.Errorf("raw %q: got %v from %q, want %v from %q", c.raw, info.Timestamp, info.TimestampSource, c.want, c.source)
+		}
+		switch {
+		case c.warnedWith == "" && len(warnings) > 0:
+			t.Errorf("raw %q: unexpected warnings %q", c.raw, warnings)
+		case c.warnedWith != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], c.warnedWith)):
+			t.Errorf("raw %q: expected a warning containing %q, got %q", c.raw, c.warnedWith, warnings)
+		}
+	}
+}
+
+func TestFetchNormalisesEpochMillis(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":3,"timestamp":1706886245123}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	for _, f := range []*Fetcher{{Port: addr.Port}, {Port: addr.Port, Fields: FieldPaths{Watts: "currentWatts"}}} {
+		info, err := f.Fetch(context.Background(), Device{Instance: "Lamp", Address: addr.IP.String()})
+		if err != nil {
+			t.Fatalf("expected success, got %v", err)
+		}
+		if want := time.Date(2024, 2, 2, 15, 4, 5, 123e6, time.UTC); !info.Timestamp.Equal(want) || info.TimestampSource != "" {
+			t.Fatalf("expected device timestamp %v, got %v from %q", want, info.Timestamp, info.TimestampSource)
+		}
+	}
+}
+
+func TestPowerInfoLeavesOutZeroTimestamp(t *testing.T) {
+	// omitzero needs the encoding/json of Go 1.24, the toolchain CI
+	// installs from go.mod; older ones ignore it and encode the zero time.
+	body, err := json.Marshal(PowerInfo{CurrentWatts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "timestamp") {
+		t.Fatalf("expected the zero timestamp left out, got %s", body)
+	}
+}
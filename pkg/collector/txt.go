@@ -0,0 +1,113 @@
+package collector
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeviceMeta holds the structured fields of a Matter DNS-SD advertisement's
+// TXT records. Numeric fields are zero when not advertised.
+type DeviceMeta struct {
+	// VendorID and ProductID come from the VP key ("vendor+product").
+	VendorID  int
+	ProductID int
+	// VendorName names VendorID when DiscoverOptions.VendorName knows it.
+	VendorName string
+	// DeviceType is the DT key, e.g. 266 for an on/off plug-in unit.
+	DeviceType int
+	// DeviceName is the DN key, a user-facing name when advertised.
+	DeviceName string
+	// Discriminator is the D key of a commissionable advertisement.
+	Discriminator int
+	// CommissioningMode is the CM key: 0 when not in commissioning mode,
+	// 1 or 2 while open for commissioning.
+	CommissioningMode int
+	// SessionIdle and SessionActive are the SII and SAI retry intervals,
+	// and SessionActiveThreshold the SAT key.
+	SessionIdle            time.Duration
+	SessionActive          time.Duration
+	SessionActiveThreshold time.Duration
+	// Extra holds keys that are not decoded above, along with any known
+	// key whose value failed to parse.
+	Extra map[string]string
+}
+
+// ParseTXT decodes the Matter fields of entry's TXT records. Keys are
+// matched case-insensitively; firmware keys are left to FirmwareVersion.
+func ParseTXT(entry *ServiceEntry) DeviceMeta {
+	var meta DeviceMeta
+	for _, txt := range entry.Text {
+		key, value, _ := strings.Cut(txt, "=")
+		if key == "" || isFirmwareKey(key) {
+			continue
+		}
+		if !meta.set(strings.ToUpper(key), value) {
+			if meta.Extra == nil {
+				meta.Extra = make(map[string]string)
+			}
+			meta.Extra[key] = value
+		}
+	}
+	return meta
+}
+
+// set decodes a known key into m, reporting false for unknown keys and
+// values that do not parse.
+func (m *DeviceMeta) set(key, value string) bool {
+	var err error
+	switch key {
+	case "VP":
+		vendor, product, hasProduct := strings.Cut(value, "+")
+		if m.VendorID, err = ParseMatterID(vendor); err == nil && hasProduct {
+			m.ProductID, err = ParseMatterID(product)
+		}
+	case "DT":
+		m.DeviceType, err = strconv.Atoi(value)
+	case "DN":
+		m.DeviceName = value
+	case "D":
+		m.Discriminator, err = strconv.Atoi(value)
+	case "CM":
+		m.CommissioningMode, err = strconv.Atoi(value)
+	case "SII":
+		m.SessionIdle, err = parseMillis(value)
+	case "SAI":
+		m.SessionActive, err = parseMillis(value)
+	case "SAT":
+		m.SessionActiveThreshold, err = parseMillis(value)
+	default:
+		return false
+	}
+	return err == nil
+}
+
+// ParseMatterID parses a 16-bit vendor or product ID. The VP key carries
+// them in decimal, but some devices advertise hex, with or without a 0x
+// prefix; a value with hex digits is taken as hex.
+func ParseMatterID(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	base := 10
+	if rest, ok := strings.CutPrefix(strings.ToLower(s), "0x"); ok {
+		s, base = rest, 16
+	} else if strings.ContainsAny(strings.ToLower(s), "abcdef") {
+		base = 16
+	}
+	id, err := strconv.ParseUint(s, base, 16)
+	return int(id), err
+}
+
+func parseMillis(s string) (time.Duration, error) {
+	ms, err := strconv.ParseUint(s, 10, 32)
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+// isFirmwareKey reports whether key is one of the TXT keys
+// FirmwareVersion reads.
+func isFirmwareKey(key string) bool {
+	switch strings.ToLower(key) {
+	case "fv", "firmware", "firmwareversion", "version":
+		return true
+	}
+	return false
+}
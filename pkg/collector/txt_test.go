@@ -0,0 +1,69 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTXTCommissionable(t *testing.T) {
+	// A plug-in unit advertising _matterc._udp while open for commissioning.
+	entry := &ServiceEntry{Text: []string{"D=3840", "VP=4874+77", "CM=1", "DT=266", "DN=Eve Energy", "SII=5000", "SAI=300", "T=1", "PH=33", "PI="}}
+
+	meta := ParseTXT(entry)
+	if meta.VendorID != 4874 || meta.ProductID != 77 || meta.DeviceType != 266 || meta.Discriminator != 3840 {
+		t.Fatalf("unexpected identifiers %+v", meta)
+	}
+	if meta.DeviceName != "Eve Energy" || meta.CommissioningMode != 1 {
+		t.Fatalf("unexpected name or mode %+v", meta)
+	}
+	if meta.SessionIdle != 5*time.Second || meta.SessionActive != 300*time.Millisecond {
+		t.Fatalf("unexpected session intervals %+v", meta)
+	}
+	if len(meta.Extra) != 3 || meta.Extra["T"] != "1" || meta.Extra["PH"] != "33" {
+		t.Fatalf("expected unknown keys to be kept, got %v", meta.Extra)
+	}
+	if v, ok := meta.Extra["PI"]; !ok || v != "" {
+		t.Fatalf("expected an empty PI value to be kept, got %v", meta.Extra)
+	}
+}
+
+func TestParseTXTOperational(t *testing.T) {
+	// Operational _matter._tcp advertisements only carry session hints.
+	entry := &ServiceEntry{Text: []string{"SII=800", "SAI=800", "SAT=4000", "T=0"}}
+
+	meta := ParseTXT(entry)
+	if meta.VendorID != 0 || meta.DeviceType != 0 || meta.SessionActiveThreshold != 4*time.Second {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+}
+
+func TestParseTXTAcceptsHexVendorProduct(t *testing.T) {
+	for _, vp := range []string{"4874+77", "0x130A+0x4D", "0X130a+4D", "130A+004D"} {
+		meta := ParseTXT(&ServiceEntry{Text: []string{"VP=" + vp}})
+		if meta.VendorID != 0x130A || meta.ProductID != 77 {
+			t.Fatalf("%s: unexpected identifiers %+v", vp, meta)
+		}
+	}
+	meta := ParseTXT(&ServiceEntry{Text: []string{"VP=0x10000+1"}})
+	if meta.Extra["VP"] != "0x10000+1" {
+		t.Fatalf("expected an out of range VP to be kept, got %+v", meta)
+	}
+}
+
+func TestParseTXTKeepsUnparsableValues(t *testing.T) {
+	entry := &ServiceEntry{Text: []string{"VP=65521", "dt=oops", "fv=1.2", "noequal"}}
+
+	meta := ParseTXT(entry)
+	if meta.VendorID != 65521 || meta.ProductID != 0 {
+		t.Fatalf("expected a vendor-only VP to parse, got %+v", meta)
+	}
+	if meta.Extra["dt"] != "oops" {
+		t.Fatalf("expected an invalid DT to be kept, got %v", meta.Extra)
+	}
+	if _, ok := meta.Extra["fv"]; ok {
+		t.Fatalf("expected firmware keys to be left to FirmwareVersion, got %v", meta.Extra)
+	}
+	if v, ok := meta.Extra["noequal"]; !ok || v != "" {
+		t.Fatalf("expected a bare key to be kept, got %v", meta.Extra)
+	}
+}
@@ -0,0 +1,73 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Units a device may report power in; see Device.Unit.
+const (
+	UnitMilliwatts = "mW"
+	UnitWatts      = "W"
+	UnitKilowatts  = "kW"
+)
+
+// powerUnits converts power units to watts.
+var powerUnits = map[string]float64{UnitMilliwatts: 0.001, UnitWatts: 1, UnitKilowatts: 1000}
+
+// UnitReporter is implemented by drivers whose devices say what unit they
+// report power in, such as kasa's power_mw, and which convert it to watts
+// themselves. Device.Unit does not apply to them.
+type UnitReporter interface {
+	ReportsUnit() bool
+}
+
+func (kasaDriver) ReportsUnit() bool    { return true }
+func (esphomeDriver) ReportsUnit() bool { return true }
+
+// ParseUnit checks that unit is one of mW, W or kW.
+func ParseUnit(unit string) (string, error) {
+	if _, ok := powerUnits[unit]; !ok {
+		return "", fmt.Errorf("invalid unit %q: must be one of %s", unit, unitNames())
+	}
+	return unit, nil
+}
+
+// convertUnit scales the power of p, reported in unit, to watts, keeping
+// the reported value in RawPower. Voltage and current are left alone.
+func (p *PowerInfo) convertUnit(unit string) {
+	if unit != UnitMilliwatts && unit != UnitKilowatts {
+		return
+	}
+	p.RawPower, p.RawUnit = p.CurrentWatts, unit
+	p.CurrentWatts = toWatts(p.CurrentWatts, unit)
+	p.ApparentVA = toWatts(p.ApparentVA, unit)
+	p.ReactiveVAr = toWatts(p.ReactiveVAr, unit)
+	for i := range p.Phases {
+		p.Phases[i].Watts = toWatts(p.Phases[i].Watts, unit)
+	}
+}
+
+// toWatts converts v from unit to watts, dividing rather than multiplying
+// by a thousandth so that 12450 mW is exactly 12.45 W.
+func toWatts(v float64, unit string) float64 {
+	switch unit {
+	case UnitMilliwatts:
+		return v / 1000
+	case UnitKilowatts:
+		return v * 1000
+	}
+	return v
+}
+
+// reportsUnit reports whether drv converts its devices' power to watts
+// itself.
+func reportsUnit(drv Driver) bool {
+	r, ok := drv.(UnitReporter)
+	return ok && r.ReportsUnit()
+}
+
+// unitNames lists the units for error messages.
+func unitNames() string {
+	return strings.Join([]string{UnitMilliwatts, UnitWatts, UnitKilowatts}, ", ")
+}
@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchConvertsDeviceUnit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":12450,"voltage":230,"phases":[{"watts":12450}]}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	f := &Fetcher{Port: addr.Port}
+	d := Device{Instance: "Plug", Address: addr.IP.String(), Driver: GenericDriver, Unit: UnitMilliwatts}
+	info, err := f.Fetch(context.Background(), d)
+	if err != nil {
+		t.Fatalf("expected fetch to succeed, got %v", err)
+	}
+	if info.CurrentWatts != 12.45 || info.Phases[0].Watts != 12.45 || info.Voltage != 230 {
+		t.Fatalf("expected power in watts and voltage untouched, got %+v", info)
+	}
+	if info.RawPower != 12450 || info.RawUnit != UnitMilliwatts {
+		t.Fatalf("expected the reported value kept, got %v %q", info.RawPower, info.RawUnit)
+	}
+
+	d.Unit = UnitWatts
+	if info, _ = f.Fetch(context.Background(), d); info.CurrentWatts != 12450 || info.RawUnit != "" {
+		t.Fatalf("expected watts left alone, got %+v", info)
+	}
+}
+
+func TestKasaIgnoresDeviceUnit(t *testing.T) {
+	addr := kasaServer(t, nil, readFixture(t, "kasa_realtime_response.bin"))
+	d := Device{Instance: "Heater", Address: addr.IP.String(), Port: addr.Port, Driver: KasaDriver, Unit: UnitKilowatts}
+	info, err := (&Fetcher{}).Fetch(context.Background(), d)
+	if err != nil || info.CurrentWatts != 15.432 || info.RawUnit != "" {
+		t.Fatalf("expected kasa's own conversion only, got %+v, %v", info, err)
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	for _, unit := range []string{"mW", "W", "kW"} {
+		if _, err := ParseUnit(unit); err != nil {
+			t.Fatalf("%s: unexpected error %v", unit, err)
+		}
+	}
+	if _, err := ParseUnit("MW"); err == nil || err.Error() != `invalid unit "MW": must be one of mW, W, kW` {
+		t.Fatalf("expected megawatts rejected, got %v", err)
+	}
+}
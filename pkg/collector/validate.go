@@ -0,0 +1,149 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// AnomalyMode is what a Validator does with an implausible reading.
+type AnomalyMode string
+
+const (
+	// AnomalyFlag passes implausible readings through marked Suspect.
+	AnomalyFlag AnomalyMode = "flag"
+	// AnomalyClamp limits out-of-range values to the plausible range.
+	// Readings whose power disagrees with voltage times current cannot be
+	// clamped and are flagged instead.
+	AnomalyClamp AnomalyMode = "clamp"
+	// AnomalyDrop fails the query with an implausible reading error.
+	AnomalyDrop AnomalyMode = "drop"
+)
+
+// AnomalyModes lists the valid anomaly modes.
+var AnomalyModes = []AnomalyMode{AnomalyFlag, AnomalyClamp, AnomalyDrop}
+
+// Validator checks readings against plausible ranges. Zero limits are not
+// checked.
+type Validator struct {
+	// MaxWatts is the highest plausible power in either direction, as
+	// devices that meter export report it as negative power.
+	MaxWatts float64
+	// RejectNegative makes negative power implausible except from
+	// Bidirectional devices.
+	RejectNegative bool
+	// MinVolts and MaxVolts bound the plausible voltage of readings that
+	// report one.
+	MinVolts float64
+	MaxVolts float64
+	// MaxMismatch is how far, in percent, power may differ from voltage
+	// times current in readings that report both, and a polyphase total
+	// from the sum of its phases.
+	MaxMismatch float64
+	// Mode is what happens to an implausible reading. Empty means
+	// AnomalyFlag.
+	Mode AnomalyMode
+}
+
+// implausibleError reports a reading dropped by a Validator.
+type implausibleError struct {
+	anomaly string
+}
+
+func (e *implausibleError) Error() string {
+	return "implausible reading: " + e.anomaly
+}
+
+// flagPowerFactor marks a reading suspect when its power factor, or that
+// of any of its phases, lies outside 0-1, whatever the Validator's mode.
+func flagPowerFactor(info *PowerInfo) {
+	var anomalies []string
+	if info.PowerFactor < 0 || info.PowerFactor > 1 {
+		anomalies = append(anomalies, fmt.Sprintf("power factor %g outside 0-1", info.PowerFactor))
+	}
+	for _, ph := range info.Phases {
+		if ph.PowerFactor < 0 || ph.PowerFactor > 1 {
+			anomalies = append(anomalies, fmt.Sprintf("%s power factor %g outside 0-1", ph.Name, ph.PowerFactor))
+		}
+	}
+	if len(anomalies) == 0 {
+		return
+	}
+	if info.Anomaly != "" {
+		anomalies = append([]string{info.Anomaly}, anomalies...)
+	}
+	info.Anomaly = strings.Join(anomalies, "; ")
+	info.Suspect = true
+}
+
+// check validates info, read from d, clamping or flagging it in place or
+// returning an error when it is dropped, according to v.Mode.
+func (v *Validator) check(d Device, info *PowerInfo) error {
+	var anomalies []string
+	switch {
+	case v.MaxWatts > 0 && info.CurrentWatts > v.MaxWatts:
+		anomalies = append(anomalies, fmt.Sprintf("%g W above %g W", info.CurrentWatts, v.MaxWatts))
+		if v.Mode == AnomalyClamp {
+			info.CurrentWatts = v.MaxWatts
+		}
+	case info.CurrentWatts < 0 && v.RejectNegative && !d.Bidirectional:
+		anomalies = append(anomalies, fmt.Sprintf("%g W negative on a device not metering export", info.CurrentWatts))
+		if v.Mode == AnomalyClamp {
+			info.CurrentWatts = 0
+		}
+	case v.MaxWatts > 0 && info.CurrentWatts < -v.MaxWatts:
+		anomalies = append(anomalies, fmt.Sprintf("%g W export above %g W", -info.CurrentWatts, v.MaxWatts))
+		if v.Mode == AnomalyClamp {
+			info.CurrentWatts = -v.MaxWatts
+		}
+	}
+	if info.Voltage != 0 && (v.MinVolts > 0 || v.MaxVolts > 0) {
+		if info.Voltage < v.MinVolts || (v.MaxVolts > 0 && info.Voltage > v.MaxVolts) {
+			anomalies = append(anomalies, fmt.Sprintf("%g V outside %g-%g V", info.Voltage, v.MinVolts, v.MaxVolts))
+			if v.Mode == AnomalyClamp {
+				info.Voltage = math.Max(info.Voltage, v.MinVolts)
+				if v.MaxVolts > 0 {
+					info.Voltage = math.Min(info.Voltage, v.MaxVolts)
+				}
+			}
+		}
+	}
+	mismatched := false
+	if v.MaxMismatch > 0 && info.Voltage > 0 && info.Amperage > 0 {
+		apparent := info.Voltage * info.Amperage
+		// Exported power is negative while voltage and current are
+		// not, so magnitudes are compared.
+		if off := math.Abs(math.Abs(info.CurrentWatts)-apparent) / apparent * 100; off > v.MaxMismatch {
+			anomalies = append(anomalies, fmt.Sprintf("%g W is %.0f%% off %g V × %g A", info.CurrentWatts, off, info.Voltage, info.Amperage))
+			mismatched = true
+		}
+	}
+	if v.MaxMismatch > 0 && len(info.Phases) > 0 {
+		var sum float64
+		for _, ph := range info.Phases {
+			sum += ph.Watts
+		}
+		if base := math.Max(math.Abs(info.CurrentWatts), math.Abs(sum)); base > 0 {
+			if off := math.Abs(info.CurrentWatts-sum) / base * 100; off > v.MaxMismatch {
+				anomalies = append(anomalies, fmt.Sprintf("phases sum to %g W, %.0f%% off the %g W total", sum, off, info.CurrentWatts))
+				mismatched = true
+			}
+		}
+	}
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	anomaly := strings.Join(anomalies, "; ")
+	switch v.Mode {
+	case AnomalyDrop:
+		return &implausibleError{anomaly}
+	case AnomalyClamp:
+		info.Anomaly = anomaly
+		info.Suspect = mismatched
+	default:
+		info.Anomaly = anomaly
+		info.Suspect = true
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package collector
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidatorModes(t *testing.T) {
+	v := Validator{MaxWatts: 4000, MinVolts: 90, MaxVolts: 260}
+
+	ok := &PowerInfo{CurrentWatts: 100, Voltage: 230}
+	if err := v.check(Device{}, ok); err != nil || ok.Suspect || ok.Anomaly != "" {
+		t.Fatalf("expected a plausible reading to pass untouched, got %+v, %v", ok, err)
+	}
+
+	flagged := &PowerInfo{CurrentWatts: 65535, Voltage: 230}
+	if err := v.check(Device{}, flagged); err != nil || !flagged.Suspect || flagged.CurrentWatts != 65535 || !strings.Contains(flagged.Anomaly, "above 4000 W") {
+		t.Fatalf("expected the reading to be flagged, got %+v, %v", flagged, err)
+	}
+
+	v.Mode = AnomalyClamp
+	clamped := &PowerInfo{CurrentWatts: 65535, Voltage: 20}
+	if err := v.check(Device{}, clamped); err != nil || clamped.Suspect || clamped.CurrentWatts != 4000 || clamped.Voltage != 90 || clamped.Anomaly == "" {
+		t.Fatalf("expected the reading to be clamped, got %+v, %v", clamped, err)
+	}
+
+	v.Mode = AnomalyDrop
+	if err := v.check(Device{}, &PowerInfo{CurrentWatts: 10, Voltage: 300}); FailureReason(err) != ReasonImplausible {
+		t.Fatalf("expected the reading to be dropped, got %v", err)
+	}
+	if !answered(&implausibleError{"x"}) {
+		t.Fatal("expected a dropped reading to count as answered")
+	}
+}
+
+func TestValidatorMismatch(t *testing.T) {
+	v := Validator{MaxMismatch: 20}
+
+	if info := (&PowerInfo{CurrentWatts: 220, Voltage: 230, Amperage: 1}); v.check(Device{}, info) != nil || info.Suspect {
+		t.Fatalf("expected a reading within 20%% to pass, got %+v", info)
+	}
+	if info := (&PowerInfo{CurrentWatts: 100, Voltage: 0, Amperage: 1}); v.check(Device{}, info) != nil || info.Suspect {
+		t.Fatalf("expected a reading without voltage to go unchecked, got %+v", info)
+	}
+
+	v.Mode = AnomalyClamp
+	info := &PowerInfo{CurrentWatts: 1000, Voltage: 230, Amperage: 1}
+	if err := v.check(Device{}, info); err != nil || !info.Suspect || info.CurrentWatts != 1000 {
+		t.Fatalf("expected a mismatch to be flagged even when clamping, got %+v, %v", info, err)
+	}
+}
+
+func TestValidatorPhaseMismatch(t *testing.T) {
+	v := Validator{MaxMismatch: 5}
+	phases := []PhaseInfo{{Name: "L1", Watts: 100}, {Name: "L2", Watts: 200}, {Name: "L3", Watts: 300}}
+
+	if info := (&PowerInfo{CurrentWatts: 590, Phases: phases}); v.check(Device{}, info) != nil || info.Suspect {
+		t.Fatalf("expected phases within 5%% of the total to pass, got %+v", info)
+	}
+	info := &PowerInfo{CurrentWatts: 400, Phases: phases}
+	if err := v.check(Device{}, info); err != nil || !info.Suspect || !strings.Contains(info.Anomaly, "phases sum to 600 W") {
+		t.Fatalf("expected the phase sum mismatch to be flagged, got %+v, %v", info, err)
+	}
+}
+
+func TestFetchValidatesReadings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"deviceName":"Plug","currentWatts":65535}`)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	f := &Fetcher{Port: port, Validator: &Validator{MaxWatts: 4000}}
+	info, err := f.Fetch(context.Background(), Device{Instance: "Plug", Address: host})
+	if err != nil || !info.Suspect {
+		t.Fatalf("expected a suspect reading, got %+v, %v", info, err)
+	}
+
+	f.Validator.Mode = AnomalyDrop
+	if _, err := f.Fetch(context.Background(), Device{Instance: "Plug", Address: host}); err == nil || !strings.Contains(err.Error(), "implausible reading") {
+		t.Fatalf("expected the reading to be dropped, got %v", err)
+	}
+}
+
+func TestFetchFlagsPowerFactorOutOfRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":100,"powerFactor":1.2}`)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	// Without any Validator, too.
+	info, err := (&Fetcher{Port: port}).Fetch(context.Background(), Device{Instance: "Plug", Address: host})
+	if err != nil || !info.Suspect || info.Anomaly != "power factor 1.2 outside 0-1" {
+		t.Fatalf("expected a suspect reading, got %+v, %v", info, err)
+	}
+	if info.ApparentVA != 0 {
+		t.Fatalf("expected no apparent power derived from an implausible power factor, got %v", info.ApparentVA)
+	}
+}
+
+func TestValidatorNegativePower(t *testing.T) {
+	v := Validator{MaxWatts: 4000, MaxMismatch: 10}
+	export := &PowerInfo{CurrentWatts: -2300, Voltage: 230, Amperage: 10}
+	if err := v.check(Device{}, export); err != nil || export.Suspect {
+		t.Fatalf("expected export to pass by default, got %+v, %v", export, err)
+	}
+	if info := (&PowerInfo{CurrentWatts: -65535}); v.check(Device{}, info) != nil || !strings.Contains(info.Anomaly, "export above 4000 W") {
+		t.Fatalf("expected --max-watts to bound export too, got %+v", info)
+	}
+
+	v.RejectNegative = true
+	v.Mode = AnomalyClamp
+	info := &PowerInfo{CurrentWatts: -5}
+	if err := v.check(Device{Instance: "Lamp"}, info); err != nil || info.CurrentWatts != 0 || !strings.Contains(info.Anomaly, "negative") {
+		t.Fatalf("expected negative power clamped on a one-way device, got %+v, %v", info, err)
+	}
+	info = &PowerInfo{CurrentWatts: -1500}
+	if err := v.check(Device{Instance: "Solar", Bidirectional: true}, info); err != nil || info.CurrentWatts != -1500 || info.Anomaly != "" {
+		t.Fatalf("expected export accepted from a bidirectional device, got %+v, %v", info, err)
+	}
+}
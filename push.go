@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// maxIngestBytes bounds the body of a POST /ingest request.
+const maxIngestBytes = 1 << 20
+
+// ingestRejected is a pushed reading that was not accepted.
+type ingestRejected struct {
+	Device string `json:"device,omitempty"`
+	Error  string `json:"error"`
+}
+
+// ingestResponse is the body of a POST /ingest response.
+type ingestResponse struct {
+	Accepted int              `json:"accepted"`
+	Rejected []ingestRejected `json:"rejected,omitempty"`
+}
+
+// ingester accepts readings pushed to POST /ingest by devices that cannot
+// be polled. Each reading is attributed to a device by its deviceName,
+// completed and range-checked as a polled one would be, and passed to
+// record at once; the readings pushed since the last poll cycle join the
+// next one, so that they reach the summary and the sinks with it.
+type ingester struct {
+	// token, when set, must be sent as a bearer token.
+	token   string
+	fetcher *collector.Fetcher
+	// group returns the group a new pushed device is reported under.
+	group  func(collector.Device) string
+	record func(collector.Reading)
+	now    func() time.Time
+
+	mu      sync.Mutex
+	devices map[string]collector.Device
+	pending []collector.Reading
+}
+
+func newIngester(token string, fetcher *collector.Fetcher, group func(collector.Device) string, record func(collector.Reading)) *ingester {
+	return &ingester{token: token, fetcher: fetcher, group: group, record: record, now: time.Now, devices: make(map[string]collector.Device)}
+}
+
+func (in *ingester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !in.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ingest"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong ingest token"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "body is larger than the 1 MiB limit"})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	infos, err := collector.DecodePushed(body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid PowerInfo JSON: " + err.Error()})
+		return
+	}
+	for _, info := range infos {
+		if strings.TrimSpace(info.DeviceName) == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "every reading needs a deviceName"})
+			return
+		}
+	}
+
+	var resp ingestResponse
+	for _, info := range infos {
+		d := in.device(strings.TrimSpace(info.DeviceName))
+		if err := in.fetcher.Ingest(d, info); err != nil {
+			resp.Rejected = append(resp.Rejected, ingestRejected{Device: d.Instance, Error: err.Error()})
+			continue
+		}
+		in.add(collector.Reading{Device: d, Power: info, Time: in.now(), State: collector.Online, LastSeen: in.now(), LastSuccess: in.now()})
+		resp.Accepted++
+	}
+	status := http.StatusAccepted
+	if resp.Accepted == 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, resp)
+}
+
+// authorized reports whether r carries the ingest token, if one is set.
+func (in *ingester) authorized(r *http.Request) bool {
+	if in.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(in.token)) == 1
+}
+
+// device returns the pushed device named name, creating its record the
+// first time it pushes.
+func (in *ingester) device(name string) collector.Device {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if d, ok := in.devices[name]; ok {
+		return d
+	}
+	d := collector.Device{Instance: name, Source: collector.SourcePush}
+	if in.group != nil {
+		d.Group = in.group(d)
+	}
+	in.devices[name] = d
+	slog.Info("new pushed device", "device", name)
+	return d
+}
+
+// add records a pushed reading and holds it for the next poll cycle.
+func (in *ingester) add(r collector.Reading) {
+	in.record(r)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.pending = append(in.pending, r)
+}
+
+// cycle returns the readings pushed since the last cycle, and stops
+// holding them. A nil ingester has none.
+func (in *ingester) cycle() []collector.Reading {
+	if in == nil {
+		return nil
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	pending := in.pending
+	in.pending = nil
+	return pending
+}
+
+// latestReadings keeps the last of the readings of each device, so that a
+// device pushing more than once in a cycle is counted once in its summary.
+func latestReadings(readings []collector.Reading) []collector.Reading {
+	index := make(map[string]int, len(readings))
+	var latest []collector.Reading
+	for _, r := range readings {
+		if i, ok := index[r.Device.Key()]; ok {
+			latest[i] = r
+			continue
+		}
+		index[r.Device.Key()] = len(latest)
+		latest = append(latest, r)
+	}
+	return latest
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// postIngest sends body to in with token as its bearer token and decodes
+// the response.
+func postIngest(t *testing.T, in *ingester, token, body string) (int, ingestResponse) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/ingest", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	in.ServeHTTP(rec, req)
+	var resp ingestResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+func TestIngesterAcceptsPushedReadings(t *testing.T) {
+	var mu sync.Mutex
+	var recorded []collector.Reading
+	fetcher := &collector.Fetcher{Validator: &collector.Validator{MaxWatts: 1000, Mode: collector.AnomalyDrop}}
+	group := func(d collector.Device) string { return "Garage" }
+	in := newIngester("secret", fetcher, group, func(r collector.Reading) {
+		mu.Lock()
+		defer mu.Unlock()
+		recorded = append(recorded, r)
+	})
+
+	if code, _ := postIngest(t, in, "", `{"deviceName":"Sensor","currentWatts":5}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected a push without the token refused, got %d", code)
+	}
+	if code, _ := postIngest(t, in, "wrong", `{"deviceName":"Sensor","currentWatts":5}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected a push with the wrong token refused, got %d", code)
+	}
+	if code, _ := postIngest(t, in, "secret", `{"currentWatts":5}`); code != http.StatusBadRequest {
+		t.Fatalf("expected a reading without deviceName rejected, got %d", code)
+	}
+	if code, _ := postIngest(t, in, "secret", `not json`); code != http.StatusBadRequest {
+		t.Fatalf("expected invalid JSON rejected, got %d", code)
+	}
+
+	code, resp := postIngest(t, in, "secret", `[{"deviceName":"Sensor","currentWatts":5},{"deviceName":"Heater","currentWatts":5000},{"deviceName":"Sensor","currentWatts":7}]`)
+	if code != http.StatusAccepted || resp.Accepted != 2 || len(resp.Rejected) != 1 || resp.Rejected[0].Device != "Heater" {
+		t.Fatalf("expected the implausible reading rejected and the rest accepted, got %d %+v", code, resp)
+	}
+	mu.Lock()
+	if len(recorded) != 2 {
+		t.Fatalf("expected the accepted readings recorded, got %+v", recorded)
+	}
+	d := recorded[0].Device
+	mu.Unlock()
+	if d.Instance != "Sensor" || d.Source != collector.SourcePush || d.Group != "Garage" {
+		t.Fatalf("expected a pushed device record, got %+v", d)
+	}
+
+	pending := in.cycle()
+	if latest := latestReadings(pending); len(pending) != 2 || len(latest) != 1 || latest[0].Power.CurrentWatts != 7 {
+		t.Fatalf("expected both readings held and the latest summarized, got %+v", latest)
+	}
+	if in.cycle() != nil {
+		t.Fatal("expected the held readings released")
+	}
+
+	if code, _ := postIngest(t, in, "secret", `{"deviceName":"Heater","currentWatts":5000}`); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a push with no acceptable reading refused, got %d", code)
+	}
+}
+
+func TestRunIngestsPushedReadings(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := ln.Addr().String()
+	ln.Close()
+
+	opts := statusOptions(1)
+	opts.listen = listen
+	opts.interval = 20 * time.Millisecond
+	opts.ingest = true
+	opts.resolver = zeroconf.NewScheduledResolver()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, opts, io.Discard, io.Discard) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	pushed := false
+	var body string
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if !pushed {
+			resp, err := http.Post("http://"+listen+"/ingest", "application/json", strings.NewReader(`{"deviceName":"Sensor","currentWatts":42}`))
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("expected the push accepted, got %s", resp.Status)
+			}
+			pushed = true
+		}
+		resp, err := http.Get("http://" + listen + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if body = string(b); strings.Contains(body, "power_total_watts 42") {
+			break
+		}
+	}
+	for _, want := range []string{
+		`power_device_watts{device="Sensor",host=""} 42`,
+		`power_device_info{device="Sensor",host="",firmware="",source="push"} 1`,
+		"power_total_watts 42",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q once the pushed reading joined a cycle:\n%s", want, body)
+		}
+	}
+
+	resp, err := http.Get("http://" + listen + "/devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var devices []apiDevice
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil || len(devices) != 1 || devices[0].Source != collector.SourcePush {
+		t.Fatalf("expected the pushed device listed with its source, got %+v (%v)", devices, err)
+	}
+}
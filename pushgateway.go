@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/internal/promtext"
+)
+
+const (
+	// pushJob is the job label of every group pushed to the Pushgateway.
+	pushJob = "power_collector"
+	// pushAttempts is how many times each Pushgateway request is tried.
+	pushAttempts = 3
+)
+
+// pushgateway pushes each device's gauges to a Prometheus Pushgateway as a
+// group keyed by job, collector and instance, deleting the groups of
+// devices that are no longer seen. Only groups under its own collector
+// label are deleted, so collectors sharing a gateway leave each other's
+// devices alone.
+type pushgateway struct {
+	baseURL       string
+	collectorName string
+	client        *http.Client
+	backoff       time.Duration
+
+	mu sync.Mutex
+	// pushed holds the instances of the last push, in case the gateway's
+	// group listing is unavailable.
+	pushed map[string]bool
+}
+
+// newPushgateway returns a pusher for the Pushgateway at baseURL, grouping
+// its pushes under collectorName, or the host name when that is empty.
+func newPushgateway(baseURL, collectorName string) (*pushgateway, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid pushgateway url %q", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if collectorName == "" {
+		if collectorName, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("pushgateway collector: %w", err)
+		}
+	}
+	return &pushgateway{
+		baseURL:       u.String(),
+		collectorName: collectorName,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		backoff:       time.Second,
+		pushed:        make(map[string]bool),
+	}, nil
+}
+
+// Write pushes results, replacing the groups pushed before.
+func (p *pushgateway) Write(ctx context.Context, results []deviceResult) error {
+	return p.push(ctx, results)
+}
+
+// Flush does nothing; every push is complete.
+func (p *pushgateway) Flush(context.Context) error {
+	return nil
+}
+
+// Close does nothing; the pushed groups outlive the run.
+func (p *pushgateway) Close() error {
+	return nil
+}
+
+// push replaces each device's group with its latest gauges and deletes the
+// groups of this collector's devices missing from results.
+func (p *pushgateway) push(ctx context.Context, results []deviceResult) error {
+	groups := make(map[string][]deviceResult)
+	for _, r := range results {
+		groups[r.Instance] = append(groups[r.Instance], r)
+	}
+
+	stale := make(map[string]bool)
+	remote, err := p.groups(ctx)
+	if err != nil {
+		slog.Warn("pushgateway group listing failed, cleaning up only groups pushed by this run", "error", err)
+	}
+	p.mu.Lock()
+	for instance := range p.pushed {
+		remote = append(remote, instance)
+	}
+	p.mu.Unlock()
+	for _, instance := range remote {
+		if _, ok := groups[instance]; !ok {
+			stale[instance] = true
+		}
+	}
+
+	var errs []string
+	pushed := make(map[string]bool)
+	for _, instance := range sortedKeys(groups) {
+		if err := p.send(ctx, http.MethodPut, p.groupURL(instance), pushBody(groups[instance])); err != nil {
+			errs = append(errs, fmt.Sprintf("push %s: %v", instance, err))
+			continue
+		}
+		pushed[instance] = true
+	}
+	for _, instance := range sortedKeys(stale) {
+		if err := p.send(ctx, http.MethodDelete, p.groupURL(instance), nil); err != nil {
+			errs = append(errs, fmt.Sprintf("delete %s: %v", instance, err))
+			pushed[instance] = true
+			continue
+		}
+		slog.Debug("deleted pushgateway group", "instance", instance)
+	}
+
+	p.mu.Lock()
+	p.pushed = pushed
+	p.mu.Unlock()
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// groupURL returns the URL of this collector's group for instance.
+func (p *pushgateway) groupURL(instance string) string {
+	return p.baseURL + "/metrics/job/" + pushJob + groupLabel("collector", p.collectorName) + groupLabel("instance", instance)
+}
+
+// groupLabel returns the path segment of a grouping label. Values
+// containing a slash, or empty ones, use the gateway's base64 label
+// encoding.
+func groupLabel(name, value string) string {
+	switch {
+	case value == "":
+		return "/" + name + "@base64/="
+	case strings.Contains(value, "/"):
+		return "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+// groups lists the instances the gateway holds for pushJob under this
+// collector.
+func (p *pushgateway) groups(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/api/v1/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var listing struct {
+		Data []struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("decode group listing: %w", err)
+	}
+	var instances []string
+	for _, g := range listing.Data {
+		if g.Labels["job"] == pushJob && g.Labels["collector"] == p.collectorName {
+			instances = append(instances, g.Labels["instance"])
+		}
+	}
+	return instances, nil
+}
+
+// send makes a request, retrying with exponential backoff.
+func (p *pushgateway) send(ctx context.Context, method, target string, body []byte) error {
+	backoff := p.backoff
+	var err error
+	for attempt := 1; attempt <= pushAttempts; attempt++ {
+		if err = p.do(ctx, method, target, body); err == nil {
+			return nil
+		}
+		if attempt == pushAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("after %d attempts: %w", pushAttempts, err)
+}
+
+func (p *pushgateway) do(ctx context.Context, method, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", promtext.ContentType)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// pushBody renders the gauges of one group's devices.
+func pushBody(results []deviceResult) []byte {
+	var buf bytes.Buffer
+	pw := promtext.NewWriter(&buf)
+
+	pw.Family("power_device_info", "Device metadata from mDNS discovery.", promtext.Gauge)
+	for _, r := range results {
+		info := []string{"firmware", r.Firmware}
+		if r.Source != "" {
+			info = append(info, "source", r.Source)
+		}
+		pw.Sample("power_device_info", 1, seriesLabels(r.Instance, r.HostName, r.Channel, r.Group, info...)...)
+	}
+	pw.Family("power_device_up", "Whether the last power query succeeded.", promtext.Gauge)
+	for _, r := range results {
+		up := 0.0
+		if r.PowerInfo != nil && r.Error == "" {
+			up = 1
+		}
+		pw.Sample("power_device_up", up, seriesLabels(r.Instance, r.HostName, r.Channel, r.Group)...)
+	}
+
+	gauges := []struct {
+		name, help string
+		value      func(deviceResult) float64
+		optional   bool
+	}{
+		{"power_device_watts", "Current power draw in watts.", func(r deviceResult) float64 { return r.CurrentWatts }, false},
+		{"power_device_voltage", "Line voltage in volts.", func(r deviceResult) float64 { return r.Voltage }, true},
+		{"power_device_amperage", "Current in amperes.", func(r deviceResult) float64 { return r.Amperage }, true},
+		{"power_device_power_factor", "Power factor.", func(r deviceResult) float64 { return r.PowerFactor }, true},
+		{"power_device_frequency_hertz", "Line frequency in hertz.", func(r deviceResult) float64 { return r.FrequencyHz }, true},
+		{"power_device_apparent_power_va", "Apparent power in volt-amperes.", func(r deviceResult) float64 { return r.ApparentVA }, true},
+		{"power_device_reactive_power_var", "Reactive power in volt-amperes reactive.", func(r deviceResult) float64 { return r.ReactiveVAr }, true},
+	}
+	for _, g := range gauges {
+		pw.Family(g.name, g.help, promtext.Gauge)
+		for _, r := range results {
+			if r.PowerInfo == nil || r.Error != "" {
+				continue
+			}
+			v := g.value(r)
+			if g.optional && v == 0 {
+				continue
+			}
+			pw.Sample(g.name, v, seriesLabels(r.Instance, r.HostName, r.Channel, r.Group)...)
+		}
+	}
+	pw.Flush()
+	return buf.Bytes()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// fakePushgateway records pushes and deletes, listing the groups it holds
+// for the group listing API.
+type fakePushgateway struct {
+	mu       sync.Mutex
+	groups   map[string]string
+	requests []string
+	// failures is how many requests fail before the gateway recovers.
+	failures int
+}
+
+func newFakePushgateway(t *testing.T, groups ...string) (*fakePushgateway, *httptest.Server) {
+	g := &fakePushgateway{groups: make(map[string]string)}
+	for _, path := range groups {
+		g.groups[path] = ""
+	}
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	return g, server
+}
+
+func (g *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests = append(g.requests, r.Method+" "+r.URL.EscapedPath())
+	if g.failures > 0 {
+		g.failures--
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var data []string
+		for path := range g.groups {
+			parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+			var labels []string
+			for i := 0; i+1 < len(parts); i += 2 {
+				labels = append(labels, `"`+parts[i]+`":"`+parts[i+1]+`"`)
+			}
+			data = append(data, `{"labels":{`+strings.Join(labels, ",")+`}}`)
+		}
+		io.WriteString(w, `{"status":"success","data":[`+strings.Join(data, ",")+`]}`)
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		g.groups[r.URL.EscapedPath()] = string(body)
+	case http.MethodDelete:
+		delete(g.groups, r.URL.EscapedPath())
+	}
+}
+
+func (g *fakePushgateway) group(path string) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	body, ok := g.groups[path]
+	return body, ok
+}
+
+func TestPushgatewayPushesGroupsAndDeletesStaleOnes(t *testing.T) {
+	gw, server := newFakePushgateway(t,
+		"/metrics/job/power_collector/collector/a/instance/Old",
+		"/metrics/job/power_collector/collector/b/instance/Theirs",
+		"/metrics/job/other/instance/Kept")
+	p, err := newPushgateway(server.URL+"/", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := []deviceResult{
+		{Instance: "Lamp", HostName: "lamp.local", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230}},
+		{Instance: "Shelf/1", HostName: "shelf.local", Error: "timeout"},
+	}
+	if err := p.push(context.Background(), results); err != nil {
+		t.Fatalf("expected push to succeed, got %v", err)
+	}
+
+	lamp, ok := gw.group("/metrics/job/power_collector/collector/a/instance/Lamp")
+	if !ok {
+		t.Fatalf("expected a Lamp group, got requests %q", gw.requests)
+	}
+	for _, want := range []string{
+		`power_device_watts{device="Lamp",host="lamp.local"} 12.5`,
+		`power_device_voltage{device="Lamp",host="lamp.local"} 230`,
+		`power_device_up{device="Lamp",host="lamp.local"} 1`,
+	} {
+		if !strings.Contains(lamp, want) {
+			t.Fatalf("expected %q in pushed body:\n%s", want, lamp)
+		}
+	}
+	shelf, ok := gw.group("/metrics/job/power_collector/collector/a/instance@base64/U2hlbGYvMQ")
+	if !ok || !strings.Contains(shelf, `power_device_up{device="Shelf/1",host="shelf.local"} 0`) || strings.Contains(shelf, "power_device_watts{") {
+		t.Fatalf("expected a base64 Shelf/1 group without watts, got %q (requests %q)", shelf, gw.requests)
+	}
+	if _, ok := gw.group("/metrics/job/power_collector/collector/a/instance/Old"); ok {
+		t.Fatal("expected the stale Old group to be deleted")
+	}
+	if _, ok := gw.group("/metrics/job/other/instance/Kept"); !ok {
+		t.Fatal("expected another job's group to be left alone")
+	}
+	if _, ok := gw.group("/metrics/job/power_collector/collector/b/instance/Theirs"); !ok {
+		t.Fatal("expected another collector's group to be left alone")
+	}
+
+	// Once the lamp disappears its group goes too, even if the listing
+	// fails.
+	gw.mu.Lock()
+	gw.failures = pushAttempts
+	gw.mu.Unlock()
+	p.backoff = time.Millisecond
+	if err := p.push(context.Background(), results[1:]); err != nil {
+		t.Fatalf("expected push to succeed once the gateway recovered, got %v", err)
+	}
+	if _, ok := gw.group("/metrics/job/power_collector/collector/a/instance/Lamp"); ok {
+		t.Fatal("expected the Lamp group to be deleted")
+	}
+}
+
+func TestPushgatewayRetriesThenGivesUp(t *testing.T) {
+	gw, server := newFakePushgateway(t)
+	gw.failures = 100
+	p, err := newPushgateway(server.URL, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.backoff = time.Millisecond
+
+	err = p.push(context.Background(), []deviceResult{{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}}})
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("expected the push to fail after 3 attempts, got %v", err)
+	}
+	var puts int
+	for _, r := range gw.requests {
+		if strings.HasPrefix(r, "PUT ") {
+			puts++
+		}
+	}
+	if puts != pushAttempts {
+		t.Fatalf("expected %d push attempts, got %q", pushAttempts, gw.requests)
+	}
+}
+
+func TestNewPushgatewayRejectsInvalidURL(t *testing.T) {
+	for _, raw := range []string{"", "pushgateway:9091", "ftp://host"} {
+		if _, err := newPushgateway(raw, "a"); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestRunPushesToPushgateway(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer device.Close()
+	addr := device.Listener.Addr().(*net.TCPAddr)
+	gw, server := newFakePushgateway(t)
+	gw.failures = 100
+
+	opts := statusOptions(addr.Port)
+	opts.pushgatewayURL = server.URL
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+	var stderr strings.Builder
+	opts.logLevel = "error"
+	start := time.Now()
+	if err := run(context.Background(), opts, io.Discard, &stderr); err != nil {
+		t.Fatalf("expected a failing push not to fail the run, got %v", err)
+	}
+	if !strings.Contains(stderr.String(), "pushgateway error") {
+		t.Fatalf("expected the push failure to be logged, got %q", stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed > shutdownGrace+time.Second {
+		t.Fatalf("expected retries to be bounded, took %v", elapsed)
+	}
+}
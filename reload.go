@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// reloadableFlags are the flags a reload applies while polling. A change
+// to any other flag in the config file takes a restart.
+var reloadableFlags = map[string]bool{"devices": true, "log-level": true, "tariff": true, "alert-above": true, "alert-clear-below": true, "alert-below": true, "alert-clear-above": true}
+
+// reloader rereads the config file and the devices file on SIGHUP and
+// applies what can change while polling: the static devices, aliases,
+// groups, alert thresholds, tariff and log level. Everything is read and
+// validated first, so a bad file changes nothing, and then applied
+// between two poll cycles, so no cycle sees half of it. Energy totals and
+// discovered devices are kept.
+type reloader struct {
+	opts   options
+	poller *collector.Poller
+	energy *energyMeter
+	names  *liveAliases
+	// add starts polling a device, as discovery does.
+	add    func(collector.Device)
+	getenv func(string) string
+
+	// current is the configuration last applied.
+	current reloadState
+}
+
+// reloadState is the part of the configuration a reload replaces.
+type reloadState struct {
+	cfg *config
+	// settings are the flags as cfg and the environment set them.
+	settings *flag.FlagSet
+	// The reloadable flags in effect, the command line's included.
+	devicesPath string
+	logLevel    string
+	tariffRate  float64
+	alertAbove  wattsFlag
+	alertClear  wattsFlag
+	alertBelow  signedWattsFlag
+	alertUp     signedWattsFlag
+	static      []collector.Device
+
+	// Built by load from the above.
+	entries []staticDevice
+	logger  *slog.Logger
+	aliases aliases
+	rule    alertRule
+	rules   map[string]alertRule
+	tariff  *tariff
+}
+
+func newReloader(opts options, poller *collector.Poller, energy *energyMeter, names *liveAliases, add func(collector.Device)) (*reloader, error) {
+	r := &reloader{opts: opts, poller: poller, energy: energy, names: names, add: add, getenv: os.Getenv}
+	fs, _ := newSettings()
+	if _, err := applySettings(fs, opts.cfg, r.getenv); err != nil {
+		return nil, err
+	}
+	r.current = reloadState{
+		cfg:         opts.cfg,
+		settings:    fs,
+		devicesPath: opts.devicesPath,
+		logLevel:    opts.logLevel,
+		tariffRate:  opts.tariffRate,
+		alertAbove:  opts.alertAbove,
+		alertClear:  opts.alertClear,
+		alertBelow:  opts.alertBelow,
+		alertUp:     opts.alertClearUp,
+		static:      opts.staticDevices,
+	}
+	return r, nil
+}
+
+// newSettings returns a flag set holding every flag at its default.
+func newSettings() (*flag.FlagSet, *options) {
+	o := new(options)
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	registerFlags(fs, o)
+	return fs, o
+}
+
+// load reads and validates the configuration a reload applies. Flags given
+// on the command line keep their values, as they do at startup.
+func (r *reloader) load() (reloadState, error) {
+	fs, o := newSettings()
+	var next reloadState
+	if r.opts.configPath != "" {
+		cfg, err := loadConfig(r.opts.configPath, fs, r.opts.logs)
+		if err != nil {
+			return next, err
+		}
+		next.cfg = cfg
+	}
+	if _, err := applySettings(fs, next.cfg, r.getenv); err != nil {
+		return next, err
+	}
+	explicit := r.opts.explicit
+	next.settings = fs
+	next.devicesPath = pick(explicit["devices"], r.opts.devicesPath, o.devicesPath)
+	next.logLevel = pick(explicit["log-level"] || r.opts.verbose || r.opts.quiet, r.opts.logLevel, o.logLevel)
+	next.tariffRate = pick(explicit["tariff"], r.opts.tariffRate, o.tariffRate)
+	next.alertAbove = pick(explicit["alert-above"], r.opts.alertAbove, o.alertAbove)
+	next.alertClear = pick(explicit["alert-clear-below"], r.opts.alertClear, o.alertClear)
+	next.alertBelow = pick(explicit["alert-below"], r.opts.alertBelow, o.alertBelow)
+	next.alertUp = pick(explicit["alert-clear-above"], r.opts.alertClearUp, o.alertClearUp)
+
+	var err error
+	if next.cfg != nil {
+		next.entries = next.cfg.devices
+		if next.static, err = staticDevices(next.cfg.devices, "config "+r.opts.configPath); err != nil {
+			return next, err
+		}
+		if next.aliases, err = newAliases(next.cfg.aliases); err != nil {
+			return next, err
+		}
+		if next.rules, err = next.cfg.alertRules(); err != nil {
+			return next, err
+		}
+	}
+	if next.devicesPath != "" {
+		list, err := readDevicesFile(next.devicesPath)
+		if err != nil {
+			return next, err
+		}
+		fileDevices, err := staticDevices(list, "devices file "+next.devicesPath)
+		if err != nil {
+			return next, err
+		}
+		next.entries = append(next.entries[:len(next.entries):len(next.entries)], list...)
+		next.static = append(next.static, fileDevices...)
+	}
+	if r.opts.alerts == nil && (next.alertAbove > 0 || next.alertBelow.set || len(next.rules) > 0) {
+		return next, errors.New("alert thresholds require --alert-webhook")
+	}
+	if next.rule, err = (alertRule{Above: float64(next.alertAbove), ClearBelow: float64(next.alertClear), Below: next.alertBelow.threshold(), ClearAbove: next.alertUp.threshold()}).withDefaults(); err != nil {
+		return next, err
+	}
+	if next.tariff, err = newTariff(next.tariffRate, schedule(next.cfg), time.Local); err != nil {
+		return next, err
+	}
+	if next.logger, err = newLogger(r.opts.logs, next.logLevel, r.opts.logFormat); err != nil {
+		return next, err
+	}
+	return next, nil
+}
+
+// pick returns current when keep is set, and next otherwise.
+func pick[T any](keep bool, current, next T) T {
+	if keep {
+		return current
+	}
+	return next
+}
+
+// reload applies the configuration files anew, logging what changed. An
+// unreadable or invalid file keeps the current configuration.
+func (r *reloader) reload() {
+	next, err := r.load()
+	if err != nil {
+		slog.Error("reload failed; keeping the current configuration", "error", err)
+		return
+	}
+	prev := r.current
+	ignored := r.ignored(prev.settings, next.settings)
+
+	var changed []string
+	var added, removed, updated, renamed, regrouped int
+	r.poller.Between(func() {
+		if next.logLevel != prev.logLevel {
+			slog.SetDefault(next.logger)
+			changed = append(changed, "log-level")
+		}
+		if next.tariffRate != prev.tariffRate || !reflect.DeepEqual(schedule(next.cfg), schedule(prev.cfg)) {
+			r.energy.setTariff(next.tariff)
+			changed = append(changed, "tariff")
+		}
+		if next.alertAbove != prev.alertAbove || next.alertClear != prev.alertClear || next.alertBelow != prev.alertBelow || next.alertUp != prev.alertUp || !reflect.DeepEqual(alertsOf(next.cfg), alertsOf(prev.cfg)) {
+			if r.opts.alerts != nil {
+				r.opts.alerts.setRules(next.rule, next.rules)
+			}
+			changed = append(changed, "alerts")
+		}
+		if !reflect.DeepEqual(aliasesOf(next.cfg), aliasesOf(prev.cfg)) {
+			r.names.set(next.aliases)
+			changed = append(changed, "aliases")
+		}
+		r.opts.groups.set(next.entries)
+
+		// Static devices that went away or changed stop being polled, and
+		// new or changed ones start.
+		was, is := staticIndex(prev.static), staticIndex(next.static)
+		for _, d := range prev.static {
+			key := baseKey(d.Instance, d.HostName)
+			nd, ok := is[key]
+			if ok && sameStatic(d, nd) {
+				continue
+			}
+			for _, polled := range r.poller.Devices() {
+				if baseKey(polled.Instance, polled.HostName) == key {
+					r.poller.Remove(polled)
+				}
+			}
+			if ok {
+				updated++
+			} else {
+				removed++
+			}
+		}
+		for _, d := range next.static {
+			key := baseKey(d.Instance, d.HostName)
+			if od, ok := was[key]; ok && sameStatic(od, d) {
+				continue
+			}
+			if _, ok := was[key]; !ok {
+				added++
+			}
+			r.add(d)
+		}
+
+		// Every other device takes its name and group anew.
+		for _, d := range r.poller.Devices() {
+			key := baseKey(d.Instance, d.HostName)
+			if _, ok := is[key]; !ok {
+				if name := r.names.rename(d); name != d.Instance {
+					r.poller.Remove(d)
+					d.Instance = name
+					d.Group = r.opts.groups.group(d)
+					r.poller.Add(d)
+					renamed++
+					continue
+				}
+			}
+			if group := r.opts.groups.group(d); group != d.Group {
+				d.Group = group
+				r.poller.Add(d)
+				regrouped++
+			}
+		}
+	})
+	r.current = next
+	slog.Info("reloaded configuration", "changed", changed, "ignored", ignored, "added", added, "removed", removed, "updated", updated, "renamed", renamed, "regrouped", regrouped)
+}
+
+// ignored logs, and returns, the flags whose value the config file changed
+// but that a reload leaves alone.
+func (r *reloader) ignored(prev, next *flag.FlagSet) []string {
+	var ignored []string
+	next.VisitAll(func(f *flag.Flag) {
+		if configOnlyFlags[f.Name] || f.Value.String() == prev.Lookup(f.Name).Value.String() {
+			return
+		}
+		switch {
+		case r.opts.explicit[f.Name]:
+			slog.Warn("config change ignored: the flag was given on the command line", "key", f.Name)
+		case !reloadableFlags[f.Name]:
+			slog.Warn("config change ignored: it takes effect on restart", "key", f.Name)
+		default:
+			return
+		}
+		ignored = append(ignored, f.Name)
+	})
+	return ignored
+}
+
+// staticIndex keys static devices the way their polled channels are
+// matched.
+func staticIndex(devices []collector.Device) map[string]collector.Device {
+	index := make(map[string]collector.Device, len(devices))
+	for _, d := range devices {
+		index[baseKey(d.Instance, d.HostName)] = d
+	}
+	return index
+}
+
+// sameStatic reports whether a and b are configured alike, leaving aside
+// their group, which is applied without polling them anew.
+func sameStatic(a, b collector.Device) bool {
+	a.Group, b.Group = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+func schedule(cfg *config) []tariffPeriodConfig {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.tariffSchedule
+}
+
+func alertsOf(cfg *config) map[string]alertRuleConfig {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.alerts
+}
+
+func aliasesOf(cfg *config) map[string]string {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.aliases
+}
+
+// onReload calls fn on every SIGHUP until ctx is done.
+func onReload(ctx context.Context, fn func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				fn()
+			}
+		}
+	}()
+}
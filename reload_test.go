@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// startReloader sets up polling the config file at configPath as run and
+// runPolling do, with args given on the command line, and returns the
+// reloader and the log it writes to.
+func startReloader(t *testing.T, configPath string, args ...string) (*reloader, *bytes.Buffer) {
+	t.Helper()
+	logs := new(bytes.Buffer)
+	logger, _ := newLogger(logs, "info", logFormatText)
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	slog.SetDefault(logger)
+
+	var opts options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs, &opts)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	opts.explicit = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { opts.explicit[f.Name] = true })
+	opts.configPath, opts.logs = configPath, logs
+	var err error
+	if opts.cfg, err = loadConfig(configPath, fs, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	noEnv := func(string) string { return "" }
+	if _, err := applySettings(fs, opts.cfg, noEnv); err != nil {
+		t.Fatal(err)
+	}
+	if opts.aliases, err = newAliases(opts.cfg.aliases); err != nil {
+		t.Fatal(err)
+	}
+	if opts.staticDevices, err = staticDevices(opts.cfg.devices, "config"); err != nil {
+		t.Fatal(err)
+	}
+	if opts.tariff, err = newTariff(opts.tariffRate, opts.cfg.tariffSchedule, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	opts.groups = newGrouper(opts.cfg.devices, "")
+	opts.alerts = newAlerter("http://127.0.0.1:9/", alertRule{Above: float64(opts.alertAbove), ClearBelow: float64(opts.alertAbove)}, nil, 0)
+
+	poller := collector.NewPoller(time.Minute)
+	energy := newEnergyMeter(0)
+	energy.tariff = opts.tariff
+	names := newLiveAliases(opts.aliases)
+	add := func(d collector.Device) {
+		d.Group = opts.groups.group(d)
+		poller.Add(d)
+	}
+	for _, d := range opts.staticDevices {
+		add(d)
+	}
+	r, err := newReloader(opts, poller, energy, names, add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.getenv = noEnv
+	return r, logs
+}
+
+// discover adds d to r's poller as discovery would.
+func discover(r *reloader, d collector.Device) {
+	if name := r.names.name(d); name != "" {
+		d.Instance = name
+	}
+	r.add(d)
+}
+
+func rewrite(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// polled returns the group of every device polled, by name.
+func polled(p *collector.Poller) map[string]string {
+	groups := make(map[string]string)
+	for _, d := range p.Devices() {
+		groups[d.Instance] = d.Group
+	}
+	return groups
+}
+
+func TestReloadAppliesLiveSettings(t *testing.T) {
+	path := writeFile(t, "config.yaml", `listen: ":9109"
+alert-above: 1500W
+devices:
+  - name: Desk Lamp
+    address: 10.0.0.7
+    group: office
+  - name: Kettle
+    address: 10.0.0.8
+aliases:
+  shelly-1: Heater
+`)
+	r, logs := startReloader(t, path)
+	discover(r, collector.Device{Instance: "shelly-1", HostName: "shelly-1.local"})
+	discover(r, collector.Device{Instance: "shelly-2", HostName: "shelly-2.local"})
+
+	rewrite(t, path, `listen: ":9200"
+log-level: debug
+alert-above: 2kW
+devices:
+  - name: Kettle
+    address: 10.0.0.8
+    group: kitchen
+  - name: Fridge
+    address: 10.0.0.9
+aliases:
+  shelly-1: Radiator
+  shelly-2.local: Fan
+tariff-schedule:
+  - {from: "00:00", to: "24:00", rate: 0.5}
+`)
+	r.reload()
+
+	want := map[string]string{"Kettle": "kitchen", "Fridge": defaultGroup, "Radiator": defaultGroup, "Fan": defaultGroup}
+	if got := polled(r.poller); !maps.Equal(got, want) {
+		t.Fatalf("expected devices %v, got %v", want, got)
+	}
+	if r.opts.alerts.rule.Above != 2000 {
+		t.Fatalf("expected the new alert threshold, got %+v", r.opts.alerts.rule)
+	}
+	if r.energy.tariff == nil || r.energy.tariff.rateAt(time.Now()) != 0.5 {
+		t.Fatal("expected the new tariff")
+	}
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("expected the new log level")
+	}
+	for _, want := range []string{
+		`msg="config change ignored: it takes effect on restart" key=listen`,
+		`msg="reloaded configuration" changed="[log-level tariff alerts aliases]" ignored=[listen] added=1 removed=1 updated=0 renamed=2 regrouped=1`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("expected %q in the log, got:\n%s", want, logs.String())
+		}
+	}
+
+	// The renamed device is renamed again from its advertised name.
+	rewrite(t, path, "devices:\n  - name: Kettle\n    address: 10.0.0.8\n")
+	r.reload()
+	if got := polled(r.poller); !slices.Equal(sortedKeys(got), []string{"Kettle", "shelly-1", "shelly-2"}) {
+		t.Fatalf("expected the aliases to be dropped, got %v", got)
+	}
+}
+
+func TestReloadKeepsCommandLineFlags(t *testing.T) {
+	path := writeFile(t, "config.yaml", "tariff: 0.2\n")
+	r, logs := startReloader(t, path, "--tariff=0.3")
+
+	rewrite(t, path, "tariff: 0.4\n")
+	r.reload()
+	if rate := r.energy.tariff.rateAt(time.Now()); rate != 0.3 {
+		t.Fatalf("expected the command line's tariff to be kept, got %v", rate)
+	}
+	if !strings.Contains(logs.String(), `msg="config change ignored: the flag was given on the command line" key=tariff`) {
+		t.Fatalf("expected the change to be reported as ignored, got:\n%s", logs.String())
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	path := writeFile(t, "config.yaml", "devices:\n  - name: Kettle\n    address: 10.0.0.8\n    group: kitchen\n")
+	r, logs := startReloader(t, path)
+
+	for _, content := range []string{
+		"devices:\n  - name: Kettle\n    adress: 10.0.0.8\n",
+		"devices:\n  - name: Fridge\n    address: 10.0.0.9\naliases:\n  shelly-1: \"\"\n",
+		"devices: [",
+	} {
+		rewrite(t, path, content)
+		r.reload()
+		if got := polled(r.poller); len(got) != 1 || got["Kettle"] != "kitchen" {
+			t.Fatalf("%q: expected the devices to be kept, got %v", content, got)
+		}
+	}
+	if n := strings.Count(logs.String(), "reload failed; keeping the current configuration"); n != 3 {
+		t.Fatalf("expected every failure to be logged, got:\n%s", logs.String())
+	}
+}
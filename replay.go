@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// sessionVersion is the layout version of --record files.
+const sessionVersion = 1
+
+// session is a recorded run: every discovered service entry and every HTTP
+// response, with enough timing to replay them.
+type session struct {
+	Version   int               `json:"version"`
+	Entries   []sessionEntry    `json:"entries"`
+	Responses []sessionResponse `json:"responses"`
+}
+
+// sessionEntry is a service entry and when it arrived, relative to the
+// start of the recording.
+type sessionEntry struct {
+	AtMillis  int64    `json:"atMillis"`
+	Instance  string   `json:"instance"`
+	HostName  string   `json:"hostname"`
+	Service   string   `json:"service,omitempty"`
+	Port      int      `json:"port,omitempty"`
+	Text      []string `json:"txt,omitempty"`
+	IPv4      []string `json:"ipv4,omitempty"`
+	IPv6      []string `json:"ipv6,omitempty"`
+	Interface string   `json:"interface,omitempty"`
+}
+
+// sessionResponse is the response to one HTTP request.
+type sessionResponse struct {
+	Method        string `json:"method"`
+	URL           string `json:"url"`
+	Status        int    `json:"status"`
+	ContentType   string `json:"contentType,omitempty"`
+	Body          string `json:"body"`
+	LatencyMillis int64  `json:"latencyMillis"`
+}
+
+func newSessionEntry(at time.Duration, e *collector.ServiceEntry) sessionEntry {
+	se := sessionEntry{
+		AtMillis:  at.Milliseconds(),
+		Instance:  e.Instance,
+		HostName:  e.HostName,
+		Service:   e.Service,
+		Port:      e.Port,
+		Text:      e.Text,
+		Interface: e.Interface,
+	}
+	for _, ip := range e.AddrIPv4 {
+		se.IPv4 = append(se.IPv4, ip.String())
+	}
+	for _, ip := range e.AddrIPv6 {
+		se.IPv6 = append(se.IPv6, ip.String())
+	}
+	return se
+}
+
+func (se sessionEntry) entry() *collector.ServiceEntry {
+	e := &collector.ServiceEntry{
+		Instance:  se.Instance,
+		HostName:  se.HostName,
+		Service:   se.Service,
+		Port:      se.Port,
+		Text:      se.Text,
+		Interface: se.Interface,
+	}
+	for _, s := range se.IPv4 {
+		if ip := net.ParseIP(s); ip != nil {
+			e.AddrIPv4 = append(e.AddrIPv4, ip)
+		}
+	}
+	for _, s := range se.IPv6 {
+		if ip := net.ParseIP(s); ip != nil {
+			e.AddrIPv6 = append(e.AddrIPv6, ip)
+		}
+	}
+	return e
+}
+
+// loadSession reads a session recorded with --record.
+func loadSession(path string) (*session, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return nil, fmt.Errorf("read replay session: %w", err)
+	}
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse replay session %s: %w", path, err)
+	}
+	if s.Version != sessionVersion {
+		return nil, fmt.Errorf("replay session %s: unsupported version %d", path, s.Version)
+	}
+	return &s, nil
+}
+
+// recorder captures a session as the run goes.
+type recorder struct {
+	start time.Time
+
+	mu      sync.Mutex
+	session session
+}
+
+func newRecorder() *recorder {
+	return &recorder{start: time.Now(), session: session{Version: sessionVersion}}
+}
+
+// resolver wraps r so every entry it emits is recorded.
+func (rec *recorder) resolver(r collector.Resolver) collector.Resolver {
+	return &recordingResolver{next: r, rec: rec}
+}
+
+// transport wraps rt so every response it returns is recorded.
+func (rec *recorder) transport(rt http.RoundTripper) http.RoundTripper {
+	return &recordingTransport{next: rt, rec: rec}
+}
+
+// save writes the session to path, replacing it atomically.
+func (rec *recorder) save(path string) error {
+	rec.mu.Lock()
+	data, err := json.MarshalIndent(rec.session, "", "  ")
+	rec.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("save session: %w", err)
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("save session: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("save session: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type recordingResolver struct {
+	next collector.Resolver
+	rec  *recorder
+}
+
+func (r *recordingResolver) Browse(ctx context.Context, service, domain string, entries chan<- *collector.ServiceEntry) error {
+	inner := make(chan *collector.ServiceEntry)
+	if err := r.next.Browse(ctx, service, domain, inner); err != nil {
+		return err
+	}
+	go func() {
+		defer close(entries)
+		for e := range inner {
+			se := newSessionEntry(time.Since(r.rec.start), e)
+			if se.Service == "" {
+				se.Service = service
+			}
+			r.rec.mu.Lock()
+			r.rec.session.Entries = append(r.rec.session.Entries, se)
+			r.rec.mu.Unlock()
+			entries <- e
+		}
+	}()
+	return nil
+}
+
+type recordingTransport struct {
+	next http.RoundTripper
+	rec  *recorder
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Bodies are recorded decompressed, as the session holds them as
+	// text, and passed on the same way.
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if plain, err := io.ReadAll(zr); err == nil {
+				body = plain
+				resp.Header.Del("Content-Encoding")
+				resp.ContentLength = int64(len(body))
+			}
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.rec.mu.Lock()
+	t.rec.session.Responses = append(t.rec.session.Responses, sessionResponse{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		Status:        resp.StatusCode,
+		ContentType:   resp.Header.Get("Content-Type"),
+		Body:          string(body),
+		LatencyMillis: time.Since(start).Milliseconds(),
+	})
+	t.rec.mu.Unlock()
+	return resp, nil
+}
+
+// replayResolver emits a session's entries on their recorded schedule,
+// divided by speed, and closes the channel after the last one. Each browse
+// gets the entries recorded under its service; entries of sessions
+// recorded before services were, from browsing a single one, go to the
+// first service browsed.
+type replayResolver struct {
+	entries []sessionEntry
+	speed   float64
+
+	mu    sync.Mutex
+	first string
+}
+
+func (r *replayResolver) Browse(ctx context.Context, service, _ string, entries chan<- *collector.ServiceEntry) error {
+	r.mu.Lock()
+	if r.first == "" {
+		r.first = service
+	}
+	untagged := r.first
+	r.mu.Unlock()
+
+	go func() {
+		defer close(entries)
+		start := time.Now()
+		for _, se := range r.entries {
+			if se.Service != service && (se.Service != "" || service != untagged) {
+				continue
+			}
+			if !sleepUntil(ctx, start.Add(scaled(se.AtMillis, r.speed))) {
+				return
+			}
+			select {
+			case entries <- se.entry():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// replayTransport answers requests from a session's responses, in recorded
+// order per method and URL. Once a URL's responses run out its last one is
+// repeated, so polling can continue past the recording.
+type replayTransport struct {
+	speed float64
+
+	mu        sync.Mutex
+	responses map[string][]sessionResponse
+	served    map[string]int
+}
+
+func newReplayTransport(responses []sessionResponse, speed float64) *replayTransport {
+	t := &replayTransport{speed: speed, responses: make(map[string][]sessionResponse), served: make(map[string]int)}
+	for _, r := range responses {
+		key := r.Method + " " + r.URL
+		t.responses[key] = append(t.responses[key], r)
+	}
+	return t
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + req.URL.String()
+	t.mu.Lock()
+	recorded := t.responses[key]
+	i := min(t.served[key], len(recorded)-1)
+	t.served[key]++
+	t.mu.Unlock()
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("replay: no recorded response for %s", key)
+	}
+	r := recorded[i]
+
+	if !sleepUntil(req.Context(), time.Now().Add(scaled(r.LatencyMillis, t.speed))) {
+		return nil, req.Context().Err()
+	}
+	header := make(http.Header)
+	if r.ContentType != "" {
+		header.Set("Content-Type", r.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}, nil
+}
+
+// scaled converts a recorded offset to the replay delay at speed.
+func scaled(millis int64, speed float64) time.Duration {
+	return time.Duration(float64(millis) * float64(time.Millisecond) / speed)
+}
+
+// sleepUntil waits until t, reporting false if ctx ended first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// speedFlag is a replay speed-up factor such as "10x" or "0.5".
+type speedFlag float64
+
+func (s *speedFlag) String() string {
+	return strconv.FormatFloat(float64(*s), 'f', -1, 64) + "x"
+}
+
+func (s *speedFlag) Set(v string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v)), "x"), 64)
+	if err != nil || f <= 0 {
+		return errors.New("must be a positive factor such as 10x")
+	}
+	*s = speedFlag(f)
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// latencyField matches the measured query latency of a JSON record.
+var latencyField = regexp.MustCompile(`,"latencyMs":[0-9.e+-]+`)
+
+// deviceLines returns the device records of JSON output, dropping the
+// timestamped summary and the measured latencies.
+func deviceLines(output string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if line != "" && !strings.Contains(line, `"type":"summary"`) {
+			lines = append(lines, latencyField.ReplaceAllString(line, ""))
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func TestReplayMatchesGolden(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "replay.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		opts := statusOptions(0)
+		opts.browseTimeout = 10 * time.Second
+		opts.concurrency = 1
+		opts.replayPath = filepath.Join("testdata", "replay-session.json")
+		opts.replaySpeed = 100
+
+		var stdout bytes.Buffer
+		if err := run(context.Background(), opts, &stdout, io.Discard); err != nil {
+			t.Fatalf("replay failed: %v", err)
+		}
+		if got := deviceLines(stdout.String()); got != string(want) {
+			t.Fatalf("replay %d differs from golden:\ngot:\n%s\nwant:\n%s", i, got, want)
+		}
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"currentWatts":42,"timestamp":"2026-01-02T03:04:05+01:00"}`)
+	}))
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	path := filepath.Join(t.TempDir(), "session.json")
+
+	opts := statusOptions(addr.Port)
+	opts.recordPath = path
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Delay: 20 * time.Millisecond,
+		Entry: &collector.ServiceEntry{Instance: "Plug", HostName: "plug.local.", Service: collector.OperationalService, Port: 5540, Text: []string{"DN=Desk"}, AddrIPv4: []net.IP{addr.IP}},
+	})
+	var recorded bytes.Buffer
+	if err := run(context.Background(), opts, &recorded, io.Discard); err != nil {
+		t.Fatalf("recorded run failed: %v", err)
+	}
+	server.Close()
+
+	s, err := loadSession(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Entries) != 1 || s.Entries[0].Instance != "Plug" || s.Entries[0].AtMillis < 20 || s.Entries[0].Port != 5540 {
+		t.Fatalf("unexpected recorded entries: %+v", s.Entries)
+	}
+	if len(s.Responses) != 1 || s.Responses[0].Status != http.StatusOK || !strings.HasPrefix(s.Responses[0].Body, `{"currentWatts":42,`) {
+		t.Fatalf("unexpected recorded responses: %+v", s.Responses)
+	}
+
+	// The server is gone, so the replay can only be served from the session.
+	opts = statusOptions(addr.Port)
+	opts.browseTimeout = 10 * time.Second
+	opts.replayPath = path
+	opts.replaySpeed = 10
+	var replayed bytes.Buffer
+	if err := run(context.Background(), opts, &replayed, io.Discard); err != nil {
+		t.Fatalf("replayed run failed: %v", err)
+	}
+	if got, want := deviceLines(replayed.String()), deviceLines(recorded.String()); got != want {
+		t.Fatalf("replay differs from recording:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRecordAndReplayAreExclusive(t *testing.T) {
+	opts := statusOptions(0)
+	opts.recordPath = "a.json"
+	opts.replayPath = "b.json"
+	err := run(context.Background(), opts, io.Discard, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "cannot be used together") {
+		t.Fatalf("expected an exclusivity error, got %v", err)
+	}
+}
+
+func TestReplayTransport(t *testing.T) {
+	transport := newReplayTransport([]sessionResponse{
+		{Method: "GET", URL: "http://a/p", Status: 200, Body: "first"},
+		{Method: "GET", URL: "http://a/p", Status: 503, Body: "second"},
+	}, 1)
+	client := &http.Client{Transport: transport}
+
+	get := func(url string) (int, string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), nil
+	}
+	for i, want := range []string{"first", "second", "second"} {
+		_, body, err := get("http://a/p")
+		if err != nil || body != want {
+			t.Fatalf("request %d: got %q, %v, want %q", i, body, err, want)
+		}
+	}
+	if _, _, err := get("http://b/p"); err == nil || !strings.Contains(err.Error(), "no recorded response for GET http://b/p") {
+		t.Fatalf("expected an unknown URL error, got %v", err)
+	}
+}
+
+func TestRecordingTransportDecompresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, `{"currentWatts":42}`)
+		zw.Close()
+	}))
+	defer server.Close()
+
+	rec := newRecorder()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := rec.transport(http.DefaultTransport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"currentWatts":42}` || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("expected the body to be passed on decompressed, got %q", body)
+	}
+	if got := rec.session.Responses; len(got) != 1 || got[0].Body != `{"currentWatts":42}` {
+		t.Fatalf("expected the body to be recorded decompressed, got %+v", got)
+	}
+}
+
+func TestReplayResolverCompressesTiming(t *testing.T) {
+	r := &replayResolver{entries: []sessionEntry{{AtMillis: 1000, Instance: "Lamp", IPv4: []string{"192.0.2.1"}}}, speed: 100}
+	entries := make(chan *collector.ServiceEntry)
+	start := time.Now()
+	if err := r.Browse(context.Background(), "_matter._tcp", "local.", entries); err != nil {
+		t.Fatal(err)
+	}
+	e := <-entries
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected the entry after about 10ms, got %v", elapsed)
+	}
+	if e.Instance != "Lamp" || len(e.AddrIPv4) != 1 || !e.AddrIPv4[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	if _, ok := <-entries; ok {
+		t.Fatal("expected the channel to close after the last entry")
+	}
+}
+
+func TestSpeedFlag(t *testing.T) {
+	for in, want := range map[string]speedFlag{"10x": 10, "2": 2, "0.5X": 0.5} {
+		var s speedFlag
+		if err := s.Set(in); err != nil || s != want {
+			t.Errorf("Set(%q) = %v, %v; want %v", in, s, err, want)
+		}
+	}
+	for _, in := range []string{"", "0x", "-1", "fast"} {
+		var s speedFlag
+		if err := s.Set(in); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// reportSchemaVersion is the schemaVersion of --report documents. Fields
+// may be added to the document, but it only changes when one is removed
+// or changes meaning.
+const reportSchemaVersion = 1
+
+// Run modes recorded in the --report document.
+const (
+	reportModeOnce    = "once"
+	reportModePolling = "polling"
+)
+
+// reportDocument is the --report file.
+type reportDocument struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	Run           reportRun        `json:"run"`
+	Devices       []reportDevice   `json:"devices"`
+	Statistics    reportStatistics `json:"statistics"`
+}
+
+// reportRun describes the run a report covers.
+type reportRun struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Mode      string    `json:"mode"`
+	Collector buildInfo `json:"collector"`
+	// Flags are the settings given on the command line, in the environment
+	// or in the config file, with secrets redacted.
+	Flags map[string]string `json:"flags"`
+}
+
+// reportDevice is a device's record over the run.
+type reportDevice struct {
+	Device       string                 `json:"device"`
+	Host         string                 `json:"host"`
+	Channel      string                 `json:"channel,omitempty"`
+	Address      string                 `json:"address,omitempty"`
+	Firmware     string                 `json:"firmware,omitempty"`
+	Availability collector.Availability `json:"availability"`
+	// LastReading is the device's last successful reading.
+	LastReading *collector.PowerInfo `json:"lastReading,omitempty"`
+	Queries     int                  `json:"queries"`
+	Errors      int                  `json:"errors"`
+	LastError   string               `json:"lastError,omitempty"`
+}
+
+// reportStatistics aggregates the run's queries.
+type reportStatistics struct {
+	Devices int `json:"devices"`
+	Queries int `json:"queries"`
+	Failed  int `json:"failed"`
+	// TotalWatts sums the devices' last successful readings.
+	TotalWatts float64 `json:"totalWatts"`
+	// Power holds the per-device power statistics in polling mode.
+	Power map[string]*deviceStats `json:"power,omitempty"`
+}
+
+// runRecorder collects the run's device records for --report and writes
+// them out. A nil runRecorder records nothing.
+type runRecorder struct {
+	path  string
+	mode  string
+	flags map[string]string
+	// every, when positive, is how often a polling run rewrites the
+	// report before it ends.
+	every time.Duration
+	start time.Time
+
+	mu      sync.Mutex
+	devices map[string]*reportDevice
+	written time.Time
+}
+
+func newRunRecorder(path, mode string, flags map[string]string, every time.Duration) *runRecorder {
+	return &runRecorder{path: path, mode: mode, flags: flags, every: every, start: time.Now(), devices: make(map[string]*reportDevice)}
+}
+
+// observe records a device's query.
+func (r *runRecorder) observe(res deviceResult) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := res.Instance + "|" + res.HostName + "|" + res.Channel
+	d, ok := r.devices[key]
+	if !ok {
+		d = &reportDevice{Device: res.Instance, Host: res.HostName, Channel: res.Channel}
+		r.devices[key] = d
+	}
+	d.Address = cmp.Or(res.Address, d.Address)
+	d.Firmware = cmp.Or(res.Firmware, d.Firmware)
+	d.Queries++
+	d.Availability = res.State
+	if res.Error != "" {
+		d.Errors++
+		d.LastError = res.Error
+		if d.Availability == "" {
+			d.Availability = collector.Offline
+		}
+		return
+	}
+	d.LastReading = res.PowerInfo
+	if d.Availability == "" {
+		d.Availability = collector.Online
+	}
+}
+
+// due reports whether a polling run should rewrite the report at now.
+func (r *runRecorder) due(now time.Time) bool {
+	if r == nil || r.every <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last := r.written
+	if last.IsZero() {
+		last = r.start
+	}
+	return now.Sub(last) >= r.every
+}
+
+// document returns the report as of now, with the per-device power
+// statistics when given.
+func (r *runRecorder) document(now time.Time, power map[string]*deviceStats) reportDocument {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc := reportDocument{
+		SchemaVersion: reportSchemaVersion,
+		Run:           reportRun{Start: r.start, End: now, Mode: r.mode, Collector: currentBuild(), Flags: r.flags},
+		Devices:       make([]reportDevice, 0, len(r.devices)),
+		Statistics:    reportStatistics{Devices: len(r.devices), Power: power},
+	}
+	if doc.Run.Flags == nil {
+		doc.Run.Flags = map[string]string{}
+	}
+	for _, d := range r.devices {
+		doc.Devices = append(doc.Devices, *d)
+		doc.Statistics.Queries += d.Queries
+		doc.Statistics.Failed += d.Errors
+		if d.LastReading != nil {
+			doc.Statistics.TotalWatts += d.LastReading.CurrentWatts
+		}
+	}
+	sort.Slice(doc.Devices, func(i, j int) bool {
+		a, b := doc.Devices[i], doc.Devices[j]
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Channel < b.Channel
+	})
+	return doc
+}
+
+// write writes the report as of now to its file, replacing it atomically
+// so that a crash never leaves half a report.
+func (r *runRecorder) write(now time.Time, power map[string]*deviceStats) error {
+	data, err := json.MarshalIndent(r.document(now, power), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write report: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	r.mu.Lock()
+	r.written = now
+	r.mu.Unlock()
+	return nil
+}
+
+// writeAndLog writes the report, logging any error.
+func (r *runRecorder) writeAndLog(now time.Time, power map[string]*deviceStats) {
+	if r == nil {
+		return
+	}
+	if err := r.write(now, power); err != nil {
+		slog.Error("run report error", "path", r.path, "error", err)
+	}
+}
+
+// reportedFlags returns the flags of fs that were set, by any means, with
+// secrets redacted, for the report's run metadata.
+func reportedFlags(fs *flag.FlagSet) map[string]string {
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if configOnlyFlags[f.Name] && f.Name != "config" {
+			return
+		}
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "<redacted>"
+		}
+		flags[f.Name] = v
+	})
+	return flags
+}
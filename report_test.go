@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func TestRunRecorderDocument(t *testing.T) {
+	rec := newRunRecorder(filepath.Join(t.TempDir(), "report.json"), reportModePolling, map[string]string{"interval": "30s"}, 0)
+	rec.observe(deviceResult{Instance: "Plug", HostName: "plug.local", Firmware: "1.0", PowerInfo: &collector.PowerInfo{CurrentWatts: 40}})
+	rec.observe(deviceResult{Instance: "Lamp", HostName: "lamp.local", Address: "10.0.0.7", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}})
+	rec.observe(deviceResult{Instance: "Lamp", HostName: "lamp.local", Error: "timeout", State: collector.Degraded})
+
+	doc := rec.document(rec.start.Add(time.Minute), nil)
+	if doc.SchemaVersion != 1 || doc.Run.Mode != reportModePolling || doc.Run.Flags["interval"] != "30s" || !doc.Run.End.Equal(rec.start.Add(time.Minute)) {
+		t.Fatalf("unexpected run metadata %+v", doc.Run)
+	}
+	if len(doc.Devices) != 2 || doc.Devices[0].Device != "Lamp" {
+		t.Fatalf("expected both devices sorted by name, got %+v", doc.Devices)
+	}
+	lamp := doc.Devices[0]
+	if lamp.Address != "10.0.0.7" || lamp.Queries != 2 || lamp.Errors != 1 || lamp.LastError != "timeout" || lamp.Availability != collector.Degraded || lamp.LastReading.CurrentWatts != 12.5 {
+		t.Fatalf("unexpected device record %+v", lamp)
+	}
+	if plug := doc.Devices[1]; plug.Availability != collector.Online || plug.Firmware != "1.0" {
+		t.Fatalf("unexpected device record %+v", plug)
+	}
+	if st := doc.Statistics; st.Devices != 2 || st.Queries != 3 || st.Failed != 1 || st.TotalWatts != 52.5 {
+		t.Fatalf("unexpected statistics %+v", st)
+	}
+}
+
+func TestRunRecorderWritesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.json")
+	rec := newRunRecorder(path, reportModeOnce, nil, time.Hour)
+	if rec.due(rec.start.Add(time.Minute)) || !rec.due(rec.start.Add(time.Hour)) {
+		t.Fatal("expected the report to be due once the interval passed")
+	}
+	now := rec.start.Add(time.Hour)
+	if err := rec.write(now, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec.due(now.Add(time.Minute)) {
+		t.Fatal("expected the interval to restart once written")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("expected only the report, got %v", entries)
+	}
+
+	rec.path = filepath.Join(dir, "missing", "report.json")
+	if err := rec.write(now, nil); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+	var nilRec *runRecorder
+	nilRec.observe(deviceResult{})
+	nilRec.writeAndLog(now, nil)
+}
+
+func TestReportedFlagsRedactsSecrets(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs, new(options))
+	if err := fs.Parse([]string{"--interval", "30s", "--mqtt-password", "hunter2", "--print-config"}); err != nil {
+		t.Fatal(err)
+	}
+	flags := reportedFlags(fs)
+	if len(flags) != 2 || flags["interval"] != "30s" || flags["mqtt-password"] != "<redacted>" {
+		t.Fatalf("unexpected flags %v", flags)
+	}
+}
+
+func TestRunWritesReport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	opts := statusOptions(addr.Port)
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+	opts.reportPath = filepath.Join(t.TempDir(), "report.json")
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(opts.reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc reportDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.SchemaVersion != reportSchemaVersion || doc.Run.Mode != reportModeOnce || len(doc.Devices) != 1 || doc.Devices[0].LastReading.CurrentWatts != 5 {
+		t.Fatalf("unexpected report:\n%s", data)
+	}
+
+	opts.reportPath = ""
+	opts.reportEvery = time.Minute
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err == nil || errors.Is(err, context.Canceled) {
+		t.Fatalf("expected --report-interval without --report to be rejected, got %v", err)
+	}
+}
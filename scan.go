@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// defaultScanInterval is how often --scan-cidr subnets are rescanned in
+// polling mode.
+const defaultScanInterval = 10 * time.Minute
+
+// prefixFlag collects the subnets of a repeatable flag, each also
+// accepting a comma-separated list.
+type prefixFlag []netip.Prefix
+
+func (f *prefixFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, p := range *f {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *prefixFlag) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return fmt.Errorf("invalid subnet %q: want CIDR notation such as 192.168.30.0/24", part)
+		}
+		*f = append(*f, prefix.Masked())
+	}
+	return nil
+}
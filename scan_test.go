@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrefixFlag(t *testing.T) {
+	var f prefixFlag
+	if err := f.Set("192.168.30.7/24, 10.0.0.0/30"); err != nil {
+		t.Fatal(err)
+	}
+	if f.String() != "192.168.30.0/24,10.0.0.0/30" {
+		t.Fatalf("expected masked subnets, got %s", f.String())
+	}
+	if err := f.Set("192.168.30.0"); err == nil {
+		t.Fatal("expected an address without a prefix length to be rejected")
+	}
+}
+
+func TestRunScansSubnetWithoutDiscovery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"deviceName":"Desk lamp","currentWatts":7}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	opts := statusOptions(addr.Port)
+	opts.noDiscovery = true
+	opts.scanCIDRs.Set(addr.IP.String() + "/32")
+
+	var stdout bytes.Buffer
+	if err := run(context.Background(), opts, &stdout, io.Discard); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if out := stdout.String(); !strings.Contains(out, `"instance":"Desk lamp"`) || !strings.Contains(out, `"currentWatts":7`) {
+		t.Fatalf("expected the scanned device's reading, got %q", out)
+	}
+}
+
+func TestRunRejectsOversizedScan(t *testing.T) {
+	opts := statusOptions(0)
+	opts.scanCIDRs.Set("10.0.0.0/8")
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err == nil || !strings.Contains(err.Error(), "--scan-cidr") {
+		t.Fatalf("expected the /8 to be refused, got %v", err)
+	}
+}
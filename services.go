@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// defaultServices are the service types browsed without --service: Matter
+// nodes both commissioned and awaiting commissioning.
+var defaultServices = []string{collector.OperationalService, collector.CommissionableService}
+
+// serviceFlag is a repeatable flag.Value listing the service types to
+// browse. Each value may also be a comma-separated list, as from the
+// environment or a config file. The first value given replaces the
+// defaults.
+type serviceFlag struct {
+	services []string
+	set      bool
+}
+
+func (f *serviceFlag) String() string {
+	return strings.Join(f.services, ",")
+}
+
+func (f *serviceFlag) Set(s string) error {
+	if !f.set {
+		f.services, f.set = nil, true
+	}
+	for _, service := range strings.Split(s, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			f.services = append(f.services, service)
+		}
+	}
+	return nil
+}
+
+// matterStatus describes how r was advertised in --list output: as an
+// operational node, one open for commissioning, or both. It is empty for
+// devices found under other services.
+func matterStatus(r deviceResult) string {
+	var status []string
+	if r.Operational {
+		status = append(status, "operational")
+	}
+	if r.Commissionable {
+		status = append(status, "commissionable")
+	}
+	return strings.Join(status, ", ")
+}
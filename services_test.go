@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func TestServiceFlagReplacesDefaults(t *testing.T) {
+	opts := defaultOptions()
+	if got := opts.services.String(); got != "_matter._tcp,_matterc._udp" {
+		t.Fatalf("unexpected default services %q", got)
+	}
+	opts.services.Set("_matterd._udp")
+	opts.services.Set(" _shelly._tcp, _matter._tcp ,")
+	if got := opts.services.String(); got != "_matterd._udp,_shelly._tcp,_matter._tcp" {
+		t.Fatalf("unexpected services %q", got)
+	}
+}
+
+func TestRunOnceListsDeviceOnceAcrossServices(t *testing.T) {
+	resolver := zeroconf.NewScheduledResolver(
+		zeroconf.ScheduledEntry{Delay: 10 * time.Millisecond, Entry: &collector.ServiceEntry{Instance: "A1B2-0001", HostName: "plug.local.", Service: collector.OperationalService}},
+		zeroconf.ScheduledEntry{Delay: 20 * time.Millisecond, Entry: &collector.ServiceEntry{Instance: "F00D", HostName: "plug.local.", Service: collector.CommissionableService, Text: []string{"CM=1", "D=3840"}}},
+		zeroconf.ScheduledEntry{Delay: 20 * time.Millisecond, Entry: &collector.ServiceEntry{Instance: "BEEF", HostName: "new.local.", Service: collector.CommissionableService, Text: []string{"CM=0"}}},
+	)
+	var buf bytes.Buffer
+	opts := defaultOptions()
+	opts.listOnly, opts.settle, opts.resolver, opts.out = true, 100*time.Millisecond, resolver, newOutput(&buf, formatText)
+
+	if _, err := runOnce(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+	if n := strings.Count(output, "Discovered:"); n != 2 {
+		t.Fatalf("expected two devices listed, got %d in %q", n, output)
+	}
+	for _, want := range []string{"A1B2-0001 (plug.local)", "Status: operational, commissionable", "Services: _matter._tcp, _matterc._udp", "Discriminator: 3840", "BEEF (new.local)"} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("expected %q in output, got %q", want, output)
+		}
+	}
+	if strings.Count(output, "Status:") != 1 {
+		t.Fatalf("expected no status for a device closed to commissioning, got %q", output)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownGrace bounds how long in-flight queries and sink flushes may run
+// once shutdown has begun.
+const shutdownGrace = 5 * time.Second
+
+// errInterrupted is the cancellation cause of a context ended by a signal.
+var errInterrupted = errors.New("interrupted")
+
+// exit ends the process; tests replace it.
+var exit = os.Exit
+
+// notifyShutdown returns a context that is cancelled by the first SIGINT or
+// SIGTERM, with errInterrupted as its cause. A second signal exits the
+// process immediately. stop releases the signal handler.
+func notifyShutdown(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			slog.Info("shutting down, signal again to force", "signal", sig)
+			cancel(errInterrupted)
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			slog.Warn("forced exit", "signal", sig)
+			exit(exitForced)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(done)
+			cancel(nil)
+		})
+	}
+}
+
+// interrupted reports whether ctx was ended by a signal.
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errInterrupted)
+}
+
+// graceContext returns a context for finishing work after ctx has ended,
+// bounded by shutdownGrace.
+func graceContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), shutdownGrace)
+}
+
+// waitGrace calls wait and returns once it does, or shutdownGrace after
+// ctx has ended, reporting whether wait finished in time.
+func waitGrace(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+	timer := time.NewTimer(shutdownGrace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		slog.Warn("gave up waiting for in-flight queries", "grace", shutdownGrace)
+		return false
+	}
+}
+
+// runStats counts the queries made over the whole run for the report
+// written on shutdown.
+type runStats struct {
+	start time.Time
+
+	mu      sync.Mutex
+	devices map[string]bool
+	ok      int
+	failed  int
+	// outdated counts the listed devices with outdated firmware.
+	outdated int
+}
+
+func newRunStats() *runStats {
+	return &runStats{start: time.Now(), devices: make(map[string]bool)}
+}
+
+// observe counts a device's query.
+func (s *runStats) observe(r deviceResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[r.Instance+"|"+r.HostName] = true
+	if r.Error != "" {
+		s.failed++
+	} else {
+		s.ok++
+	}
+	if r.Outdated {
+		s.outdated++
+	}
+}
+
+// runReport is the final record written when the collector is stopped.
+type runReport struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"timestamp"`
+	Runtime float64   `json:"runtimeSeconds"`
+	Devices int       `json:"devices"`
+	OK      int       `json:"ok"`
+	Failed  int       `json:"failed"`
+	// Outdated counts the listed devices running older firmware than
+	// --expected-firmware expects.
+	Outdated int `json:"outdated,omitempty"`
+	// StatsdErrors counts the StatsD datagrams that failed to send.
+	StatsdErrors int `json:"statsdErrors,omitempty"`
+	// Sinks counts each output sink's writes.
+	Sinks map[string]sinkCounts `json:"sinks,omitempty"`
+	// Limit names the limit that ended a bounded run, "count" or
+	// "duration".
+	Limit string `json:"limit,omitempty"`
+}
+
+func (s *runStats) report(now time.Time) runReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return runReport{
+		Type:     "shutdown",
+		Time:     now,
+		Runtime:  now.Sub(s.start).Seconds(),
+		Devices:  len(s.devices),
+		OK:       s.ok,
+		Failed:   s.failed,
+		Outdated: s.outdated,
+	}
+}
+
+// writeRunReport writes the shutdown report in text or JSON; other formats
+// carry only device records.
+func writeRunReport(out *output, rep runReport) {
+	switch out.format {
+	case formatText:
+		runtime := time.Duration(rep.Runtime * float64(time.Second)).Round(time.Second)
+		stopped := "Stopped"
+		if rep.Limit != "" {
+			stopped = "Reached --" + rep.Limit
+		}
+		line := fmt.Sprintf("%s %s after %s: %d devices seen, %d queries OK, %d failed",
+			out.times.format(rep.Time), stopped, runtime, rep.Devices, rep.OK, rep.Failed)
+		if rep.StatsdErrors > 0 {
+			line += fmt.Sprintf(", %d StatsD sends failed", rep.StatsdErrors)
+		}
+		if len(rep.Sinks) > 0 {
+			line += "; sinks: " + sinksText(rep.Sinks)
+		}
+		out.text([]byte(line + "\n"))
+	case formatJSON:
+		var v any = rep
+		if out.times.set() {
+			v = struct {
+				runReport
+				Time any `json:"timestamp"`
+			}{rep, out.times.value(rep.Time)}
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		out.text(append(b, '\n'))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyShutdownCancelsThenForcesExit(t *testing.T) {
+	codes := make(chan int, 1)
+	defer func(orig func(int)) { exit = orig }(exit)
+	exit = func(code int) { codes <- code }
+
+	ctx, stop := notifyShutdown(context.Background())
+	defer stop()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the first signal to cancel the context")
+	}
+	if !interrupted(ctx) {
+		t.Fatalf("expected the context to be marked interrupted, got cause %v", context.Cause(ctx))
+	}
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	select {
+	case code := <-codes:
+		if code != exitForced {
+			t.Fatalf("expected exit status %d, got %d", exitForced, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the second signal to force an exit")
+	}
+}
+
+func TestNotifyShutdownStopIsNotAnInterrupt(t *testing.T) {
+	ctx, stop := notifyShutdown(context.Background())
+	stop()
+	stop()
+
+	if ctx.Err() == nil || interrupted(ctx) {
+		t.Fatalf("expected stop to cancel without an interrupt, got cause %v", context.Cause(ctx))
+	}
+}
+
+func TestWaitGraceWaitsWhileRunning(t *testing.T) {
+	finished := false
+	ok := waitGrace(context.Background(), func() {
+		time.Sleep(20 * time.Millisecond)
+		finished = true
+	})
+	if !ok || !finished {
+		t.Fatalf("expected waitGrace to wait for completion, got %v", ok)
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	stats := newRunStats()
+	stats.start = time.Date(2024, 2, 2, 15, 0, 0, 0, time.UTC)
+	stats.observe(deviceResult{Instance: "Lamp", HostName: "lamp.local"})
+	stats.observe(deviceResult{Instance: "Lamp", HostName: "lamp.local", Error: "timeout"})
+	stats.observe(deviceResult{Instance: "Plug", HostName: "plug.local"})
+	rep := stats.report(stats.start.Add(90 * time.Second))
+
+	var buf bytes.Buffer
+	writeRunReport(newOutput(&buf, formatText), rep)
+	if got, want := buf.String(), "2024-02-02T15:01:30Z Stopped after 1m30s: 2 devices seen, 2 queries OK, 1 failed\n"; got != want {
+		t.Fatalf("unexpected report %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	writeRunReport(newOutput(&buf, formatJSON), rep)
+	var decoded runReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("expected JSON output, got %q (%v)", buf.String(), err)
+	}
+	if decoded.Type != "shutdown" || decoded.Runtime != 90 || decoded.Devices != 2 || decoded.OK != 2 || decoded.Failed != 1 {
+		t.Fatalf("unexpected report %+v", decoded)
+	}
+
+	buf.Reset()
+	writeRunReport(newOutput(&buf, formatCSV), rep)
+	if buf.Len() != 0 {
+		t.Fatalf("expected no report in CSV output, got %q", buf.String())
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// sink is an output each run or poll cycle's records fan out to.
+type sink interface {
+	// Write delivers a run or poll cycle's records.
+	Write(ctx context.Context, results []deviceResult) error
+	// Flush sends whatever the sink still holds, once the run ends.
+	Flush(ctx context.Context) error
+	// Close releases the sink's connections and files.
+	Close() error
+}
+
+// queuedSink is a sink that holds records it has yet to deliver, such as
+// a batch kept for retry while its server is down.
+type queuedSink interface {
+	// queued returns how many records the sink holds.
+	queued() int
+}
+
+// sinkDurationBuckets are the upper bounds, in seconds, of the per-sink
+// write and flush latency histograms.
+var sinkDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// sinkFeed is which of a batch's records a sink takes.
+type sinkFeed int
+
+const (
+	// feedFresh sinks take the records of fresh queries.
+	feedFresh sinkFeed = iota
+	// feedAll sinks take every device's latest record, so that they can
+	// replace what they hold.
+	feedAll
+	// feedChanges sinks take the fresh records --only-changes emits.
+	feedChanges
+)
+
+// sinkBatch is a run or poll cycle's records, as each feed takes them.
+type sinkBatch struct {
+	// all holds every record, readings reused from an earlier query
+	// included; it is nil outside poll cycles.
+	all []deviceResult
+	// fresh leaves out the reused readings, which the sinks already have.
+	fresh []deviceResult
+	// changes holds the fresh records --only-changes emits, and filtered
+	// whether it is on.
+	changes  []deviceResult
+	filtered bool
+}
+
+// newSinkBatch returns the batch of a one-shot run, whose records are all
+// fresh and all emitted.
+func newSinkBatch(results []deviceResult) sinkBatch {
+	return sinkBatch{all: results, fresh: results, changes: results}
+}
+
+// records returns the records of b that feed takes, and false when a
+// changes sink has nothing to take.
+func (b sinkBatch) records(feed sinkFeed) ([]deviceResult, bool) {
+	switch feed {
+	case feedAll:
+		return b.all, b.all != nil
+	case feedChanges:
+		return b.changes, !b.filtered || len(b.changes) > 0
+	}
+	return b.fresh, true
+}
+
+// sinkBacklog holds the readings taken between poll cycles, such as a new
+// device's first, for the next cycle's batch.
+type sinkBacklog struct {
+	mu      sync.Mutex
+	fresh   []deviceResult
+	changes []deviceResult
+}
+
+// add holds r, which --only-changes emitted or not.
+func (q *sinkBacklog) add(r collector.Reading, emitted bool) {
+	if r.Cached {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := readingResult(r)
+	q.fresh = append(q.fresh, res)
+	if emitted {
+		q.changes = append(q.changes, res)
+	}
+}
+
+// len returns how many readings are held.
+func (q *sinkBacklog) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.fresh)
+}
+
+// drain returns the batch of the readings held, and stops holding them.
+func (q *sinkBacklog) drain(filtered bool) sinkBatch {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := sinkBatch{fresh: q.fresh, changes: q.changes, filtered: filtered}
+	q.fresh, q.changes = nil, nil
+	return b
+}
+
+// cycle returns the batch of a poll cycle's readings, of which changes,
+// when set, picks the emitted ones, after the readings held since the
+// last cycle.
+func (q *sinkBacklog) cycle(readings []collector.Reading, changes *changeFilter) sinkBatch {
+	b := q.drain(changes != nil)
+	b.all = make([]deviceResult, 0, len(readings))
+	for _, r := range readings {
+		res := readingResult(r)
+		b.all = append(b.all, res)
+		if r.Cached {
+			continue
+		}
+		b.fresh = append(b.fresh, res)
+		if changes.emitted(r) {
+			b.changes = append(b.changes, res)
+		}
+	}
+	return b
+}
+
+// sinkCounts counts a sink's successful and failed writes and flushes.
+type sinkCounts struct {
+	OK     int `json:"ok"`
+	Failed int `json:"failed"`
+}
+
+// namedSink is an enabled sink, by the name logs, reports and metrics
+// know it by.
+type namedSink struct {
+	name string
+	sink sink
+	feed sinkFeed
+
+	mu     sync.Mutex
+	counts sinkCounts
+	// durations holds the latencies of the sink's writes and flushes.
+	durations *histogram
+}
+
+// count records the outcome of a write or flush.
+func (n *namedSink) count(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.counts.Failed++
+	} else {
+		n.counts.OK++
+	}
+}
+
+// sinkSet fans records out to every enabled sink at once, so that a slow
+// or failing sink neither holds up nor fails the others: each error is
+// logged and counted against its sink alone. A nil sinkSet has no sinks.
+type sinkSet struct {
+	sinks []*namedSink
+	// spoolDir, when set, is where addSpooled keeps each remote sink's
+	// undelivered batches, up to spoolMaxSize each.
+	spoolDir     string
+	spoolMaxSize int64
+}
+
+// add enables s under name, fed the records of feed.
+func (s *sinkSet) add(name string, snk sink, feed sinkFeed) {
+	s.sinks = append(s.sinks, &namedSink{name: name, sink: snk, feed: feed, durations: newHistogram(sinkDurationBuckets...)})
+}
+
+// addSpooled enables the remote sink s as add does, spooling its batches
+// under spoolDir when set.
+func (s *sinkSet) addSpooled(name string, snk sink, feed sinkFeed) error {
+	if s.spoolDir != "" {
+		spooled, err := openSpooledSink(s.spoolDir, name, s.spoolMaxSize, snk)
+		if err != nil {
+			return err
+		}
+		snk = spooled
+	}
+	s.add(name, snk, feed)
+	return nil
+}
+
+// write delivers b to every sink and waits for them all.
+func (s *sinkSet) write(ctx context.Context, b sinkBatch) {
+	s.each("write", func(n *namedSink) (bool, error) {
+		results, ok := b.records(n.feed)
+		if !ok {
+			return false, nil
+		}
+		return true, n.sink.Write(ctx, results)
+	})
+}
+
+// flush flushes every sink and waits for them all.
+func (s *sinkSet) flush(ctx context.Context) {
+	s.each("flush", func(n *namedSink) (bool, error) {
+		return true, n.sink.Flush(ctx)
+	})
+}
+
+// each runs op on every sink concurrently, counting, timing and logging
+// the outcome of each op that ran.
+func (s *sinkSet) each(op string, fn func(*namedSink) (bool, error)) {
+	if s == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, n := range s.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			ran, err := fn(n)
+			if !ran {
+				return
+			}
+			n.durations.observe(time.Since(start).Seconds())
+			n.count(err)
+			if err != nil {
+				slog.Error("sink "+op+" error", "sink", n.name, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// event delivers ev to every sink that takes device events, logging
+// failures. A spooled sink takes them unspooled.
+func (s *sinkSet) event(ctx context.Context, ev deviceEvent) {
+	if s == nil {
+		return
+	}
+	for _, n := range s.sinks {
+		snk := n.sink
+		if spooled, ok := snk.(*spooledSink); ok {
+			snk = spooled.sink
+		}
+		es, ok := snk.(eventSink)
+		if !ok {
+			continue
+		}
+		if err := es.event(ctx, ev); err != nil {
+			slog.Error("device event delivery failed", "sink", n.name, "device", ev.Device, "error", err)
+		}
+	}
+}
+
+// close closes every sink, the last enabled first.
+func (s *sinkSet) close() {
+	if s == nil {
+		return
+	}
+	for i := len(s.sinks) - 1; i >= 0; i-- {
+		n := s.sinks[i]
+		if err := n.sink.Close(); err != nil {
+			slog.Error("sink close error", "sink", n.name, "error", err)
+		}
+	}
+}
+
+// counts returns each sink's counts by name, or nil without sinks.
+func (s *sinkSet) counts() map[string]sinkCounts {
+	if s == nil || len(s.sinks) == 0 {
+		return nil
+	}
+	counts := make(map[string]sinkCounts, len(s.sinks))
+	for _, n := range s.sinks {
+		n.mu.Lock()
+		counts[n.name] = n.counts
+		n.mu.Unlock()
+	}
+	return counts
+}
+
+// queued returns how many records each sink holding some has yet to
+// deliver, by name, or nil without such sinks.
+func (s *sinkSet) queued() map[string]int {
+	if s == nil {
+		return nil
+	}
+	var queued map[string]int
+	for _, n := range s.sinks {
+		if q, ok := n.sink.(queuedSink); ok {
+			if queued == nil {
+				queued = make(map[string]int)
+			}
+			queued[n.name] = q.queued()
+		}
+	}
+	return queued
+}
+
+// sinksText describes the sink counts in text output, such as
+// "influx 12 OK, mqtt 10 OK 2 failed".
+func sinksText(counts map[string]sinkCounts) string {
+	parts := make([]string, 0, len(counts))
+	for _, name := range sortedKeys(counts) {
+		c := counts[name]
+		part := fmt.Sprintf("%s %d OK", name, c.OK)
+		if c.Failed > 0 {
+			part += fmt.Sprintf(" %d failed", c.Failed)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// fakeSink records the batches written to it, failing every write with
+// err and blocking each write until release is closed, when set.
+type fakeSink struct {
+	err     error
+	release chan struct{}
+
+	mu      sync.Mutex
+	batches [][]deviceResult
+	flushes int
+	closed  bool
+}
+
+func (s *fakeSink) Write(ctx context.Context, results []deviceResult) error {
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, results)
+	return s.err
+}
+
+func (s *fakeSink) Flush(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushes++
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSink) written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.batches)
+}
+
+func TestSinkSetIsolatesFailingSink(t *testing.T) {
+	good, bad := &fakeSink{}, &fakeSink{err: errors.New("broker unavailable")}
+	var set sinkSet
+	set.add("bad", bad, feedFresh)
+	set.add("good", good, feedFresh)
+
+	batch := newSinkBatch([]deviceResult{{Instance: "Lamp"}})
+	set.write(context.Background(), batch)
+	set.write(context.Background(), batch)
+	set.flush(context.Background())
+
+	if good.written() != 2 || bad.written() != 2 {
+		t.Fatalf("expected both sinks written twice, got %d and %d", good.written(), bad.written())
+	}
+	counts := set.counts()
+	if counts["good"] != (sinkCounts{OK: 3}) || counts["bad"] != (sinkCounts{OK: 1, Failed: 2}) {
+		t.Fatalf("unexpected counts %+v", counts)
+	}
+
+	set.close()
+	if !good.closed || !bad.closed {
+		t.Fatal("expected every sink closed")
+	}
+}
+
+func TestSinkSetWritesPastSlowSink(t *testing.T) {
+	fast, slow := &fakeSink{}, &fakeSink{release: make(chan struct{})}
+	var set sinkSet
+	set.add("slow", slow, feedFresh)
+	set.add("fast", fast, feedFresh)
+
+	done := make(chan struct{})
+	go func() {
+		set.write(context.Background(), newSinkBatch([]deviceResult{{Instance: "Lamp"}}))
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for fast.written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the fast sink written while the slow one blocks")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if slow.written() != 0 {
+		t.Fatal("expected the slow sink still blocked")
+	}
+	close(slow.release)
+	<-done
+	if counts := set.counts(); counts["slow"].OK != 1 || counts["fast"].OK != 1 {
+		t.Fatalf("unexpected counts %+v", counts)
+	}
+}
+
+func TestSinkBatchFeeds(t *testing.T) {
+	lamp := collector.Device{Instance: "Lamp"}
+	plug := collector.Device{Instance: "Plug"}
+	changes := newChangeFilter(changeThresholdFlag{}, 0)
+	now := time.Now()
+
+	var backlog sinkBacklog
+	early := collector.Reading{Device: plug, Power: &collector.PowerInfo{CurrentWatts: 3}, Time: now}
+	backlog.add(early, changes.allow(early))
+
+	first := collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 10}, Time: now}
+	changes.allow(first)
+	b := backlog.cycle([]collector.Reading{first, {Device: plug, Power: &collector.PowerInfo{CurrentWatts: 3}, Time: now.Add(time.Second), Cached: true}}, changes)
+	if all, ok := b.records(feedAll); !ok || len(all) != 2 {
+		t.Fatalf("expected every reading for feedAll, got %d", len(all))
+	}
+	if fresh, _ := b.records(feedFresh); len(fresh) != 2 || fresh[0].Instance != "Plug" || fresh[1].Instance != "Lamp" {
+		t.Fatalf("expected the held reading then the fresh one, got %+v", fresh)
+	}
+	if emitted, ok := b.records(feedChanges); !ok || len(emitted) != 2 {
+		t.Fatalf("expected both first readings emitted, got %+v", emitted)
+	}
+
+	second := collector.Reading{Device: lamp, Power: &collector.PowerInfo{CurrentWatts: 10}, Time: now.Add(time.Minute)}
+	changes.allow(second)
+	b = backlog.cycle([]collector.Reading{second}, changes)
+	if _, ok := b.records(feedChanges); ok {
+		t.Fatal("expected changes sinks skipped when nothing changed")
+	}
+	if held := backlog.drain(true); held.all != nil || len(held.fresh) != 0 {
+		t.Fatalf("expected an empty backlog, got %+v", held)
+	}
+	if _, ok := (sinkBatch{fresh: []deviceResult{{}}}).records(feedAll); ok {
+		t.Fatal("expected feedAll sinks skipped outside poll cycles")
+	}
+}
+
+func TestSinkCountsReported(t *testing.T) {
+	counts := map[string]sinkCounts{"mqtt": {OK: 10, Failed: 2}, "influx": {OK: 12}}
+	if got := sinksText(counts); got != "influx 12 OK, mqtt 10 OK 2 failed" {
+		t.Fatalf("unexpected text %q", got)
+	}
+
+	var buf bytes.Buffer
+	writeRunReport(newOutput(&buf, formatText), runReport{Time: time.Unix(0, 0).UTC(), Sinks: counts})
+	if !strings.Contains(buf.String(), "; sinks: influx 12 OK, mqtt 10 OK 2 failed") {
+		t.Fatalf("expected sink counts in the run report, got %q", buf.String())
+	}
+
+	var set sinkSet
+	set.add("mqtt", &fakeSink{err: errors.New("down")}, feedChanges)
+	set.write(context.Background(), newSinkBatch(nil))
+	e := newExporter()
+	e.sinks = &set
+	if body := scrape(t, e); !strings.Contains(body, `power_sink_writes_total{sink="mqtt",result="error"} 1`) {
+		t.Fatalf("expected sink counters in the metrics, got %s", body)
+	}
+}
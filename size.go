@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteUnits are the suffixes parseByteSize accepts, largest first. Units
+// are binary, so 64KB is 65536 bytes.
+var byteUnits = []struct {
+	suffixes []string
+	size     int64
+}{
+	{[]string{"mib", "mb", "m"}, 1 << 20},
+	{[]string{"kib", "kb", "k"}, 1 << 10},
+	{[]string{"b"}, 1},
+}
+
+// parseByteSize parses a size such as "65536", "64KB" or "1MiB".
+func parseByteSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	scale := int64(1)
+unit:
+	for _, u := range byteUnits {
+		for _, suffix := range u.suffixes {
+			if strings.HasSuffix(v, suffix) {
+				v, scale = strings.TrimSpace(strings.TrimSuffix(v, suffix)), u.size
+				break unit
+			}
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/scale {
+		return 0, fmt.Errorf("invalid size %q: want a value such as 65536, 64KB or 1MB", s)
+	}
+	return n * scale, nil
+}
+
+// byteSizeFlag is a flag.Value accepting parseByteSize syntax.
+type byteSizeFlag int64
+
+func (b *byteSizeFlag) String() string {
+	n := int64(*b)
+	for _, u := range byteUnits[:2] {
+		if n >= u.size && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + strings.ToUpper(u.suffixes[1])
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func (b *byteSizeFlag) Set(s string) error {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSizeFlag(n)
+	return nil
+}
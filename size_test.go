@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"65536": 65536,
+		"64KB":  65536,
+		"64kib": 65536,
+		"64 k":  65536,
+		"1MB":   1 << 20,
+		"512B":  512,
+		"0":     0,
+	} {
+		if got, err := parseByteSize(in); err != nil || got != want {
+			t.Fatalf("parseByteSize(%q): expected %d, got %d (%v)", in, want, got, err)
+		}
+	}
+	for _, in := range []string{"", "big", "-1KB", "1.5MB", "64GB"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Fatalf("parseByteSize(%q): expected an error", in)
+		}
+	}
+}
+
+func TestByteSizeFlagString(t *testing.T) {
+	for n, want := range map[byteSizeFlag]string{65536: "64KB", 1 << 20: "1MB", 1000: "1000", 0: "0"} {
+		if got := n.String(); got != want {
+			t.Fatalf("%d: expected %q, got %q", int64(n), want, got)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSpoolMaxSize caps each sink's spool under --spool-dir.
+	defaultSpoolMaxSize = 64 << 20
+	// spoolExt names spooled batch files, and spoolCorruptExt those set
+	// aside as unreadable.
+	spoolExt        = ".batch"
+	spoolCorruptExt = ".corrupt"
+)
+
+// errCorruptSpool reports a spooled batch file that is cut short or not
+// in the spool format.
+var errCorruptSpool = errors.New("corrupt spool file")
+
+// spoolBatch is a batch of records kept in the spool, and when it was
+// written.
+type spoolBatch struct {
+	Time     time.Time      `json:"time"`
+	Readings []deviceResult `json:"readings"`
+}
+
+// spoolEntry is a batch file in a sink's spool.
+type spoolEntry struct {
+	seq     uint64
+	size    int64
+	records int
+}
+
+// timedSink is a sink that stamps each batch it sends with the time it was
+// taken, which a replayed batch keeps.
+type timedSink interface {
+	writeAt(ctx context.Context, at time.Time, results []deviceResult) error
+}
+
+// spooledSink writes each batch for a remote sink to a file in dir before
+// sending it, and removes the file once the sink has taken the batch. A
+// batch the sink fails to take stays spooled, and every write first sends
+// the spooled batches, oldest first, stopping at the first failure; so
+// batches are delivered in order and at least once, a batch sent just
+// before a crash being sent again after it. Past maxSize the oldest
+// batches are evicted.
+//
+// Each file holds one batch as its length in bytes on a line, followed by
+// the batch as a JSON line, so that it can be inspected with a pager and a
+// file cut short is told apart from a whole one.
+type spooledSink struct {
+	name    string
+	dir     string
+	maxSize int64
+	sink    sink
+
+	mu      sync.Mutex
+	entries []spoolEntry
+	size    int64
+	next    uint64
+	evicted int
+}
+
+// openSpooledSink opens the spool of the sink name under dir, creating it
+// if needed, and picks up the batches left by an earlier run. Files left
+// half written by a crash are removed, and unreadable batches set aside
+// with the spoolCorruptExt extension.
+func openSpooledSink(dir, name string, maxSize int64, snk sink) (*spooledSink, error) {
+	s := &spooledSink{name: name, dir: filepath.Join(dir, name), maxSize: maxSize, sink: snk, next: 1}
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("open spool: %w", err)
+	}
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("open spool: %w", err)
+	}
+	for _, f := range files {
+		path := filepath.Join(s.dir, f.Name())
+		base, ok := strings.CutSuffix(f.Name(), spoolExt)
+		if !ok {
+			if strings.HasSuffix(f.Name(), ".tmp") {
+				os.Remove(path)
+			}
+			continue
+		}
+		seq, err := strconv.ParseUint(base, 10, 64)
+		if err != nil {
+			continue
+		}
+		s.next = max(s.next, seq+1)
+		b, err := readSpoolBatch(path)
+		if err != nil {
+			s.setAside(path, err)
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return nil, fmt.Errorf("open spool: %w", err)
+		}
+		s.entries = append(s.entries, spoolEntry{seq: seq, size: info.Size(), records: len(b.Readings)})
+		s.size += info.Size()
+	}
+	slices.SortFunc(s.entries, func(a, b spoolEntry) int { return cmp.Compare(a.seq, b.seq) })
+	if len(s.entries) > 0 {
+		slog.Info("spooled batches to replay", "sink", name, "batches", len(s.entries), "readings", s.queued())
+	}
+	return s, nil
+}
+
+// Write spools results and sends every spooled batch. When the batch
+// cannot be spooled, it is sent after them all the same.
+func (s *spooledSink) Write(ctx context.Context, results []deviceResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := spoolBatch{Time: time.Now(), Readings: results}
+	if err := s.persist(b); err != nil {
+		err = fmt.Errorf("spool %s: %w", s.name, err)
+		sendErr := s.replay(ctx)
+		if sendErr == nil {
+			sendErr = s.send(ctx, b)
+		}
+		return errors.Join(err, sendErr)
+	}
+	return s.replay(ctx)
+}
+
+// Flush sends every spooled batch, then flushes the sink.
+func (s *spooledSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(ctx); err != nil {
+		return err
+	}
+	return s.sink.Flush(ctx)
+}
+
+// Close closes the sink; the spooled batches stay for the next run.
+func (s *spooledSink) Close() error {
+	return s.sink.Close()
+}
+
+// queued returns how many records are spooled, with those the sink itself
+// holds.
+func (s *spooledSink) queued() int {
+	s.mu.Lock()
+	n := 0
+	for _, e := range s.entries {
+		n += e.records
+	}
+	s.mu.Unlock()
+	if q, ok := s.sink.(queuedSink); ok {
+		n += q.queued()
+	}
+	return n
+}
+
+// evictions returns how many batches were evicted so far.
+func (s *spooledSink) evictions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evicted
+}
+
+// path returns the file of the batch seq.
+func (s *spooledSink) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// persist writes b as the newest batch, then evicts the oldest batches
+// while the spool is over maxSize; the newest is always kept. The file is
+// written under a temporary name, synced and renamed into place, so that
+// a crash leaves either the whole batch or none. The caller holds s.mu.
+func (s *spooledSink) persist(b spoolBatch) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	record := strconv.AppendInt(nil, int64(len(data)), 10)
+	record = append(append(append(record, '\n'), data...), '\n')
+
+	tmp, err := os.CreateTemp(s.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(record); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	seq := s.next
+	if err := os.Rename(tmp.Name(), s.path(seq)); err != nil {
+		return err
+	}
+	s.next++
+	s.entries = append(s.entries, spoolEntry{seq: seq, size: int64(len(record)), records: len(b.Readings)})
+	s.size += int64(len(record))
+
+	evicted, readings := 0, 0
+	for s.maxSize > 0 && s.size > s.maxSize && len(s.entries) > 1 {
+		readings += s.entries[0].records
+		s.drop()
+		evicted++
+	}
+	if evicted > 0 {
+		s.evicted += evicted
+		slog.Warn("spool full, evicted oldest batches", "sink", s.name, "batches", evicted, "readings", readings, "max_size", s.maxSize)
+	}
+	return nil
+}
+
+// replay sends the spooled batches, oldest first, removing each the sink
+// takes and stopping at the first it fails to. The caller holds s.mu.
+func (s *spooledSink) replay(ctx context.Context) error {
+	for len(s.entries) > 0 {
+		path := s.path(s.entries[0].seq)
+		b, err := readSpoolBatch(path)
+		if err != nil {
+			s.setAside(path, err)
+			s.size -= s.entries[0].size
+			s.entries = s.entries[1:]
+			continue
+		}
+		if err := s.send(ctx, b); err != nil {
+			return fmt.Errorf("%w (%d batches spooled)", err, len(s.entries))
+		}
+		s.drop()
+	}
+	return nil
+}
+
+// send hands b to the sink, with the time it was taken when the sink
+// stamps batches.
+func (s *spooledSink) send(ctx context.Context, b spoolBatch) error {
+	if ts, ok := s.sink.(timedSink); ok {
+		return ts.writeAt(ctx, b.Time, b.Readings)
+	}
+	return s.sink.Write(ctx, b.Readings)
+}
+
+// drop removes the oldest batch. The caller holds s.mu.
+func (s *spooledSink) drop() {
+	e := s.entries[0]
+	if err := os.Remove(s.path(e.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("spool remove error", "sink", s.name, "error", err)
+	}
+	s.size -= e.size
+	s.entries = s.entries[1:]
+}
+
+// setAside renames the unreadable batch file at path so that it is not
+// replayed, keeping it for inspection.
+func (s *spooledSink) setAside(path string, err error) {
+	slog.Error("spooled batch unreadable; setting it aside", "sink", s.name, "path", path, "error", err)
+	if err := os.Rename(path, strings.TrimSuffix(path, spoolExt)+spoolCorruptExt); err != nil {
+		os.Remove(path)
+	}
+}
+
+// readSpoolBatch reads the batch file at path.
+func readSpoolBatch(path string) (spoolBatch, error) {
+	var b spoolBatch
+	data, err := os.ReadFile(path) // #nosec G304 -- path is in the operator's spool directory
+	if err != nil {
+		return b, err
+	}
+	head, body, ok := bytes.Cut(data, []byte("\n"))
+	n, err := strconv.Atoi(string(head))
+	if !ok || err != nil || n < 0 || len(body) != n+1 || body[n] != '\n' {
+		return b, errCorruptSpool
+	}
+	if err := json.Unmarshal(body[:n], &b); err != nil {
+		return b, fmt.Errorf("%w: %v", errCorruptSpool, err)
+	}
+	return b, nil
+}
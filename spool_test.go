@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// outageSink delivers batches while up, recording the instance of their
+// first reading, and fails them while down.
+type outageSink struct {
+	mu        sync.Mutex
+	down      bool
+	delivered []string
+	times     []time.Time
+}
+
+func (s *outageSink) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *outageSink) Write(ctx context.Context, results []deviceResult) error {
+	return s.writeAt(ctx, time.Time{}, results)
+}
+
+func (s *outageSink) writeAt(_ context.Context, at time.Time, results []deviceResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("connection refused")
+	}
+	s.delivered = append(s.delivered, results[0].Instance)
+	s.times = append(s.times, at)
+	return nil
+}
+
+func (s *outageSink) Flush(context.Context) error { return nil }
+func (s *outageSink) Close() error                { return nil }
+
+func spoolResults(id int) []deviceResult {
+	return []deviceResult{{Instance: fmt.Sprintf("batch-%d", id), PowerInfo: &collector.PowerInfo{CurrentWatts: float64(id)}}}
+}
+
+func TestSpooledSinkReplaysInOrder(t *testing.T) {
+	ctx := context.Background()
+	inner := &outageSink{down: true}
+	s, err := openSpooledSink(t.TempDir(), "webhook", defaultSpoolMaxSize, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 3; id++ {
+		if err := s.Write(ctx, spoolResults(id)); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("(%d batches spooled)", id)) {
+			t.Fatalf("expected the outage reported with the spooled batches, got %v", err)
+		}
+	}
+	if s.queued() != 3 || len(inner.delivered) != 0 {
+		t.Fatalf("expected 3 readings spooled, got %d", s.queued())
+	}
+
+	inner.setDown(false)
+	if err := s.Write(ctx, spoolResults(4)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"batch-1", "batch-2", "batch-3", "batch-4"}; !slices.Equal(inner.delivered, want) {
+		t.Fatalf("expected %v delivered in order, got %v", want, inner.delivered)
+	}
+	if inner.times[0].IsZero() || inner.times[0].After(inner.times[3]) {
+		t.Fatalf("expected replayed batches stamped with when they were taken, got %v", inner.times)
+	}
+	files, _ := os.ReadDir(s.dir)
+	if s.queued() != 0 || len(files) != 0 {
+		t.Fatalf("expected the spool emptied once delivered, got %d files", len(files))
+	}
+}
+
+func TestSpooledSinkEvictsOldest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	inner := &outageSink{down: true}
+	s, err := openSpooledSink(dir, "influx", 0, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(ctx, spoolResults(1))
+	s.maxSize = s.size*2 + s.size/2
+
+	for id := 2; id <= 5; id++ {
+		s.Write(ctx, spoolResults(id))
+	}
+	if s.evictions() != 3 || len(s.entries) != 2 {
+		t.Fatalf("expected the 3 oldest batches evicted, got %d evicted and %d spooled", s.evictions(), len(s.entries))
+	}
+
+	e := newExporter()
+	e.sinks = &sinkSet{}
+	e.sinks.add("influx", s, feedFresh)
+	e.monitor = newSelfMonitor()
+	if body := scrape(t, e); !strings.Contains(body, "power_collector_spool_evicted_total{sink=\"influx\"} 3\n") {
+		t.Fatalf("expected the evictions exported:\n%s", body)
+	}
+
+	inner.setDown(false)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"batch-4", "batch-5"}; !slices.Equal(inner.delivered, want) {
+		t.Fatalf("expected %v delivered, got %v", want, inner.delivered)
+	}
+}
+
+func TestOpenSpooledSinkSetsAsideCorruptBatches(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := openSpooledSink(dir, "graphite", defaultSpoolMaxSize, &outageSink{down: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(ctx, spoolResults(1))
+	good, err := os.ReadFile(s.path(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]string{
+		s.path(2):                       string(good[:len(good)/2]),
+		s.path(3):                       "12\nnot json at\n",
+		filepath.Join(s.dir, "123.tmp"): string(good[:10]),
+	} {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inner := &outageSink{}
+	s, err = openSpooledSink(dir, "graphite", defaultSpoolMaxSize, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.entries) != 1 || s.next != 4 {
+		t.Fatalf("expected only the whole batch picked up, got %+v", s.entries)
+	}
+	for _, name := range []string{"00000000000000000002.corrupt", "00000000000000000003.corrupt"} {
+		if _, err := os.Stat(filepath.Join(s.dir, name)); err != nil {
+			t.Fatalf("expected the unreadable batch set aside: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "123.tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the half-written file removed, got %v", err)
+	}
+	if err := s.Write(ctx, spoolResults(4)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"batch-1", "batch-4"}; !slices.Equal(inner.delivered, want) {
+		t.Fatalf("expected %v delivered, got %v", want, inner.delivered)
+	}
+}
+
+// crashSink logs each batch it takes to a file, synced, and hangs once it
+// has taken the batch hangAt, as though the process died before the
+// delivery was acknowledged.
+type crashSink struct {
+	log    *os.File
+	hangAt string
+	ready  string
+}
+
+func (s *crashSink) Write(_ context.Context, results []deviceResult) error {
+	fmt.Fprintln(s.log, results[0].Instance)
+	s.log.Sync()
+	if results[0].Instance == s.hangAt {
+		os.WriteFile(s.ready, nil, 0o600)
+		select {}
+	}
+	return nil
+}
+
+func (s *crashSink) Flush(context.Context) error { return nil }
+func (s *crashSink) Close() error                { return nil }
+
+// spoolCrashChild runs in the process TestSpooledSinkSurvivesCrash kills:
+// it spools five batches through an outage, then hangs mid-replay.
+func spoolCrashChild(dir string) {
+	ctx := context.Background()
+	log, err := os.OpenFile(filepath.Join(dir, "delivered"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		panic(err)
+	}
+	down, err := openSpooledSink(dir, "mqtt", defaultSpoolMaxSize, &outageSink{down: true})
+	if err != nil {
+		panic(err)
+	}
+	for id := 1; id <= 5; id++ {
+		down.Write(ctx, spoolResults(id))
+	}
+	s, err := openSpooledSink(dir, "mqtt", defaultSpoolMaxSize, &crashSink{log: log, hangAt: "batch-3", ready: filepath.Join(dir, "ready")})
+	if err != nil {
+		panic(err)
+	}
+	s.Write(ctx, spoolResults(6))
+}
+
+func TestSpooledSinkSurvivesCrash(t *testing.T) {
+	if dir := os.Getenv("SPOOL_CRASH_DIR"); dir != "" {
+		spoolCrashChild(dir)
+		return
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSpooledSinkSurvivesCrash$")
+	cmd.Env = append(os.Environ(), "SPOOL_CRASH_DIR="+dir)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "ready")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatal("child never reached the hanging delivery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+
+	inner := &outageSink{}
+	s, err := openSpooledSink(dir, "mqtt", defaultSpoolMaxSize, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, "delivered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var delivered []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		delivered = append(delivered, sc.Text())
+	}
+	delivered = append(delivered, inner.delivered...)
+
+	// The batch taken as the process died is sent again; nothing else is.
+	want := []string{"batch-1", "batch-2", "batch-3", "batch-3", "batch-4", "batch-5", "batch-6"}
+	if !slices.Equal(delivered, want) {
+		t.Fatalf("expected %v delivered, got %v", want, delivered)
+	}
+	files, _ := os.ReadDir(s.dir)
+	if len(files) != 0 {
+		t.Fatalf("expected no files left in the spool, got %v", files)
+	}
+}
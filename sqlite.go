@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the pure-Go "sqlite" driver
+)
+
+// sqliteTimeFormat is a fixed-width UTC timestamp so stored times sort and
+// compare as text.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// sqlitePruneEvery is how often old readings are pruned while running.
+const sqlitePruneEvery = 24 * time.Hour
+
+// sqliteMigrations are applied in order; PRAGMA user_version records how
+// many have run.
+var sqliteMigrations = []string{
+	`CREATE TABLE readings (
+		id INTEGER PRIMARY KEY,
+		device TEXT NOT NULL,
+		host TEXT NOT NULL,
+		address TEXT NOT NULL,
+		watts REAL NOT NULL,
+		voltage REAL,
+		amperage REAL,
+		firmware TEXT NOT NULL,
+		ts TEXT NOT NULL
+	);
+	CREATE INDEX readings_ts ON readings (ts);
+	CREATE INDEX readings_device_ts ON readings (device, ts);
+	CREATE TABLE devices (
+		instance TEXT PRIMARY KEY,
+		host TEXT NOT NULL,
+		address TEXT NOT NULL,
+		firmware TEXT NOT NULL,
+		first_seen TEXT NOT NULL,
+		last_seen TEXT NOT NULL
+	);`,
+	`ALTER TABLE readings ADD COLUMN channel TEXT NOT NULL DEFAULT '';`,
+}
+
+// parseRetention parses a duration that may also be given in days, such as
+// "30d".
+func parseRetention(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid retention %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid retention %q", s)
+	}
+	return d, nil
+}
+
+// retentionFlag is a flag.Value accepting parseRetention syntax.
+type retentionFlag time.Duration
+
+func (r *retentionFlag) String() string {
+	d := time.Duration(*r)
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	}
+	if d == 0 {
+		return "0"
+	}
+	return d.String()
+}
+
+func (r *retentionFlag) Set(s string) error {
+	d, err := parseRetention(s)
+	if err != nil {
+		return err
+	}
+	*r = retentionFlag(d)
+	return nil
+}
+
+// sqliteStore batches records and writes them to a SQLite database, one
+// transaction per poll cycle.
+type sqliteStore struct {
+	db        *sql.DB
+	retention time.Duration
+
+	mu        sync.Mutex
+	batch     []deviceResult
+	lastPrune time.Time
+}
+
+// openSQLite opens the database at path, migrating its schema and pruning
+// readings older than retention, if positive.
+func openSQLite(ctx context.Context, path string, retention time.Duration) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	// SQLite allows one writer; a single connection avoids busy errors.
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db, retention: retention}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.prune(ctx, time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) migrate(ctx context.Context) error {
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("sqlite schema version: %w", err)
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// prune deletes readings older than the retention period.
+func (s *sqliteStore) prune(ctx context.Context, now time.Time) error {
+	s.lastPrune = now
+	if s.retention <= 0 {
+		return nil
+	}
+	cutoff := now.Add(-s.retention).UTC().Format(sqliteTimeFormat)
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM readings WHERE ts < ?", cutoff); err != nil {
+		return fmt.Errorf("sqlite prune: %w", err)
+	}
+	return nil
+}
+
+// add queues r for the next flush.
+func (s *sqliteStore) add(r deviceResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batch = append(s.batch, r)
+}
+
+// queued returns how many records wait for the next flush.
+func (s *sqliteStore) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.batch)
+}
+
+// Write stores results in one transaction.
+func (s *sqliteStore) Write(ctx context.Context, results []deviceResult) error {
+	for _, r := range results {
+		s.add(r)
+	}
+	return s.flush(ctx)
+}
+
+// Flush writes the pending batch.
+func (s *sqliteStore) Flush(ctx context.Context) error {
+	return s.flush(ctx)
+}
+
+// flushAndLog writes the pending batch, logging any failure.
+func (s *sqliteStore) flushAndLog(ctx context.Context) {
+	if err := s.flush(ctx); err != nil {
+		slog.Error("sqlite write error", "error", err)
+	}
+}
+
+// flush writes the pending batch in one transaction: a row per successful
+// reading, and an upsert of every device seen. Old readings are pruned
+// once a day.
+func (s *sqliteStore) flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch := s.batch
+	s.batch = nil
+
+	if len(batch) > 0 {
+		if err := s.write(ctx, batch); err != nil {
+			return fmt.Errorf("dropping %d records: %w", len(batch), err)
+		}
+	}
+	if now := time.Now(); now.Sub(s.lastPrune) >= sqlitePruneEvery {
+		return s.prune(ctx, now)
+	}
+	return nil
+}
+
+func (s *sqliteStore) write(ctx context.Context, batch []deviceResult) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.PrepareContext(ctx, `INSERT INTO readings
+		(device, host, address, watts, voltage, amperage, firmware, ts, channel)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	upsert, err := tx.PrepareContext(ctx, `INSERT INTO devices
+		(instance, host, address, firmware, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (instance) DO UPDATE SET
+			host = excluded.host,
+			address = excluded.address,
+			firmware = excluded.firmware,
+			last_seen = excluded.last_seen`)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+
+	for _, r := range batch {
+		ts := r.Time.UTC().Format(sqliteTimeFormat)
+		if _, err := upsert.ExecContext(ctx, r.Instance, r.HostName, r.Address, r.Firmware, ts, ts); err != nil {
+			return err
+		}
+		if r.PowerInfo == nil || r.Error != "" {
+			continue
+		}
+		if _, err := insert.ExecContext(ctx, r.Instance, r.HostName, r.Address, r.CurrentWatts,
+			nullFloat(r.Voltage), nullFloat(r.Amperage), r.Firmware, ts, r.Channel); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nullFloat stores an unreported zero value as NULL.
+func nullFloat(v float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: v, Valid: v != 0}
+}
+
+// Close writes any pending records and closes the database.
+func (s *sqliteStore) Close() error {
+	s.flushAndLog(context.Background())
+	return s.db.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestSQLiteStoreWritesBatch(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "readings.db")
+	s, err := openSQLite(ctx, path, 0)
+	if err != nil {
+		t.Fatalf("expected database to open, got %v", err)
+	}
+
+	now := time.Now()
+	s.add(deviceResult{Instance: "Lamp", HostName: "lamp.local", Address: "10.0.0.7", Firmware: "1.0", Time: now, PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230}})
+	s.add(deviceResult{Instance: "Kettle", HostName: "kettle.local", Time: now, Error: "timeout"})
+	if err := s.flush(ctx); err != nil {
+		t.Fatalf("expected batch to be written, got %v", err)
+	}
+	s.Close()
+
+	// Reopening must not re-run migrations.
+	s, err = openSQLite(ctx, path, 0)
+	if err != nil {
+		t.Fatalf("expected database to reopen, got %v", err)
+	}
+	defer s.Close()
+
+	var device string
+	var watts float64
+	var amperage *float64
+	if err := s.db.QueryRow("SELECT device, watts, amperage FROM readings").Scan(&device, &watts, &amperage); err != nil {
+		t.Fatalf("expected a stored reading, got %v", err)
+	}
+	if device != "Lamp" || watts != 12.5 || amperage != nil {
+		t.Fatalf("unexpected reading %s %v %v", device, watts, amperage)
+	}
+
+	var readings, devices int
+	s.db.QueryRow("SELECT COUNT(*) FROM readings").Scan(&readings)
+	s.db.QueryRow("SELECT COUNT(*) FROM devices").Scan(&devices)
+	if readings != 1 || devices != 2 {
+		t.Fatalf("expected 1 reading and 2 devices, got %d and %d", readings, devices)
+	}
+}
+
+func TestSQLiteStorePrunesOldReadings(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "readings.db")
+	s, err := openSQLite(ctx, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := deviceResult{Instance: "Lamp", Time: time.Now().Add(-48 * time.Hour), PowerInfo: &collector.PowerInfo{CurrentWatts: 1}}
+	recent := deviceResult{Instance: "Lamp", Time: time.Now(), PowerInfo: &collector.PowerInfo{CurrentWatts: 2}}
+	s.add(old)
+	s.add(recent)
+	if err := s.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = openSQLite(ctx, path, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("expected database to reopen, got %v", err)
+	}
+	defer s.Close()
+	var watts []float64
+	rows, err := s.db.Query("SELECT watts FROM readings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var w float64
+		rows.Scan(&w)
+		watts = append(watts, w)
+	}
+	if len(watts) != 1 || watts[0] != 2 {
+		t.Fatalf("expected only the recent reading to survive, got %v", watts)
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	cases := map[string]time.Duration{"30d": 30 * 24 * time.Hour, "72h": 72 * time.Hour, "0": 0}
+	for in, want := range cases {
+		if got, err := parseRetention(in); err != nil || got != want {
+			t.Fatalf("parseRetention(%q): expected %v, got %v (%v)", in, want, got, err)
+		}
+	}
+	if _, err := parseRetention("soon"); err == nil {
+		t.Fatal("expected error for invalid retention")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+const (
+	// defaultStatsWindow is the rolling window of --stats-window.
+	defaultStatsWindow = time.Hour
+	// statsWindowSamples bounds the samples kept per device for the
+	// rolling window; beyond it the oldest are dropped early.
+	statsWindowSamples = 4096
+	// statsReservoirSize is the number of samples kept per device for the
+	// daily percentile.
+	statsReservoirSize = 1024
+)
+
+// powerStats summarizes a device's readings over a period.
+type powerStats struct {
+	Samples int     `json:"samples"`
+	Min     float64 `json:"minWatts"`
+	Max     float64 `json:"maxWatts"`
+	Mean    float64 `json:"meanWatts"`
+	P95     float64 `json:"p95Watts"`
+}
+
+// deviceStats is a device's statistics over the rolling window and since
+// the start of the day.
+type deviceStats struct {
+	Window *powerStats `json:"window,omitempty"`
+	Today  *powerStats `json:"today,omitempty"`
+}
+
+// statsSample is one reading kept for the rolling window.
+type statsSample struct {
+	at    time.Time
+	watts float64
+}
+
+// dailyStats accumulates the readings since day began. The percentile is
+// estimated from a uniform reservoir sample of them.
+type dailyStats struct {
+	day       time.Time
+	count     int
+	min, max  float64
+	sum       float64
+	reservoir []float64
+}
+
+func (d *dailyStats) add(watts float64, rng *rand.Rand) {
+	if d.count == 0 || watts < d.min {
+		d.min = watts
+	}
+	if d.count == 0 || watts > d.max {
+		d.max = watts
+	}
+	d.count++
+	d.sum += watts
+	if len(d.reservoir) < statsReservoirSize {
+		d.reservoir = append(d.reservoir, watts)
+	} else if i := rng.IntN(d.count); i < statsReservoirSize {
+		d.reservoir[i] = watts
+	}
+}
+
+func (d *dailyStats) stats() *powerStats {
+	if d.count == 0 {
+		return nil
+	}
+	return &powerStats{Samples: d.count, Min: d.min, Max: d.max, Mean: d.sum / float64(d.count), P95: percentile(d.reservoir, 0.95)}
+}
+
+// statsDevice holds one device's samples.
+type statsDevice struct {
+	window []statsSample
+	today  dailyStats
+}
+
+// statsTracker keeps rolling and daily power statistics per device. Days
+// begin at midnight in loc; a zero window keeps only the daily ones.
+type statsTracker struct {
+	window time.Duration
+	loc    *time.Location
+
+	mu      sync.Mutex
+	devices map[string]*statsDevice
+	labels  map[string]string
+	rng     *rand.Rand
+}
+
+func newStatsTracker(window time.Duration, loc *time.Location) *statsTracker {
+	return &statsTracker{
+		window:  window,
+		loc:     loc,
+		devices: make(map[string]*statsDevice),
+		labels:  make(map[string]string),
+		rng:     rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())), // #nosec G404 -- reservoir sampling needs no cryptographic randomness
+	}
+}
+
+// add records a successful reading and returns the device's statistics.
+func (s *statsTracker) add(r collector.Reading) *deviceStats {
+	if r.Err != nil || r.Power == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := r.Device.Key()
+	dev, ok := s.devices[key]
+	if !ok {
+		dev = &statsDevice{}
+		s.devices[key] = dev
+	}
+	s.labels[key] = deviceLabel(r.Device.Instance, r.Device.Channel)
+
+	watts := r.Power.CurrentWatts
+	if s.window > 0 {
+		if len(dev.window) == statsWindowSamples {
+			dev.window = slices.Delete(dev.window, 0, 1)
+		}
+		dev.window = append(dev.window, statsSample{at: r.Time, watts: watts})
+	}
+	if day := startOfDay(r.Time, s.loc); !day.Equal(dev.today.day) {
+		dev.today = dailyStats{day: day}
+	}
+	dev.today.add(watts, s.rng)
+	return s.statsLocked(dev, r.Time)
+}
+
+// statsLocked returns dev's statistics as of now, dropping samples that
+// have left the window. The caller holds s.mu.
+func (s *statsTracker) statsLocked(dev *statsDevice, now time.Time) *deviceStats {
+	cutoff := now.Add(-s.window)
+	i := 0
+	for i < len(dev.window) && !dev.window[i].at.After(cutoff) {
+		i++
+	}
+	dev.window = slices.Delete(dev.window, 0, i)
+
+	st := &deviceStats{}
+	if len(dev.window) > 0 {
+		values := make([]float64, len(dev.window))
+		w := &powerStats{Samples: len(values), Min: math.Inf(1), Max: math.Inf(-1)}
+		for i, sample := range dev.window {
+			values[i] = sample.watts
+			w.Min = min(w.Min, sample.watts)
+			w.Max = max(w.Max, sample.watts)
+			w.Mean += sample.watts
+		}
+		w.Mean /= float64(len(values))
+		w.P95 = percentile(values, 0.95)
+		st.Window = w
+	}
+	if dev.today.day.Equal(startOfDay(now, s.loc)) {
+		st.Today = dev.today.stats()
+	}
+	return st
+}
+
+// report returns every device's statistics as of now, keyed by its label.
+func (s *statsTracker) report(now time.Time) map[string]*deviceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rep := make(map[string]*deviceStats, len(s.devices))
+	for key, dev := range s.devices {
+		if st := s.statsLocked(dev, now); st.Window != nil || st.Today != nil {
+			rep[s.labels[key]] = st
+		}
+	}
+	return rep
+}
+
+// device returns the statistics of the device with key as of now.
+func (s *statsTracker) device(key string, now time.Time) (*deviceStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dev, ok := s.devices[key]
+	if !ok {
+		return nil, false
+	}
+	return s.statsLocked(dev, now), true
+}
+
+// startOfDay returns midnight at the start of t's day in loc.
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// percentile returns the p-th quantile of values by linear interpolation
+// between the closest ranks. values is not modified.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	rank := p * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := min(lo+1, len(sorted)-1)
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// statsLine describes st for the text summary.
+func statsLine(st *deviceStats) string {
+	var parts []string
+	for _, p := range []struct {
+		name  string
+		stats *powerStats
+	}{{"window", st.Window}, {"today", st.Today}} {
+		if p.stats != nil {
+			parts = append(parts, fmt.Sprintf("%s min %.2f W, max %.2f W, mean %.2f W, p95 %.2f W", p.name, p.stats.Min, p.stats.Max, p.stats.Mean, p.stats.P95))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
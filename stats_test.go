@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// statsReading is a successful reading of watts from device at t.
+func statsReading(device string, watts float64, t time.Time) collector.Reading {
+	return collector.Reading{Device: collector.Device{Instance: device, HostName: device + ".local"}, Power: &collector.PowerInfo{CurrentWatts: watts}, Time: t}
+}
+
+func TestStatsTrackerRollingWindow(t *testing.T) {
+	s := newStatsTracker(time.Hour, time.UTC)
+	start := time.Date(2024, 2, 2, 10, 0, 0, 0, time.UTC)
+	for i, watts := range []float64{100, 10, 20, 30} {
+		s.add(statsReading("Plug", watts, start.Add(time.Duration(i)*20*time.Minute)))
+	}
+	s.add(collector.Reading{Device: collector.Device{Instance: "Plug", HostName: "Plug.local"}, Err: errors.New("timeout"), Time: start.Add(time.Hour)})
+
+	// The 100 W reading is exactly an hour old and has left the window.
+	st := s.report(start.Add(time.Hour))["Plug"]
+	if st == nil || st.Window == nil {
+		t.Fatalf("expected window statistics, got %+v", st)
+	}
+	if w := *st.Window; w.Samples != 3 || w.Min != 10 || w.Max != 30 || w.Mean != 20 || w.P95 != 29 {
+		t.Fatalf("unexpected window statistics %+v", w)
+	}
+	if d := *st.Today; d.Samples != 4 || d.Min != 10 || d.Max != 100 || d.Mean != 40 {
+		t.Fatalf("unexpected daily statistics %+v", d)
+	}
+
+	if st := s.report(start.Add(3 * time.Hour))["Plug"]; st.Window != nil || st.Today == nil {
+		t.Fatalf("expected only daily statistics once the window empties, got %+v", st)
+	}
+}
+
+func TestStatsTrackerResetsAtMidnightInTimezone(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	s := newStatsTracker(0, loc)
+	// 21:30 UTC is 23:30 in loc, and 22:30 UTC is the next day there.
+	before := time.Date(2024, 2, 2, 21, 30, 0, 0, time.UTC)
+	s.add(statsReading("Plug", 50, before))
+	st := s.add(statsReading("Plug", 5, before.Add(time.Hour)))
+	if st.Window != nil {
+		t.Fatalf("expected no window statistics with a zero window, got %+v", st.Window)
+	}
+	if st.Today == nil || st.Today.Samples != 1 || st.Today.Max != 5 {
+		t.Fatalf("expected the day to restart at midnight in %s, got %+v", loc, st.Today)
+	}
+	if st := s.report(before.Add(25 * time.Hour)); len(st) != 0 {
+		t.Fatalf("expected no statistics on a day without readings, got %+v", st)
+	}
+}
+
+func TestStatsTrackerReservoirBoundsDailySamples(t *testing.T) {
+	s := newStatsTracker(time.Minute, time.UTC)
+	start := time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)
+	for i := range 10 * statsReservoirSize {
+		s.add(statsReading("Plug", float64(i%100), start.Add(time.Duration(i)*time.Second)))
+	}
+	dev := s.devices[collector.Device{Instance: "Plug", HostName: "Plug.local"}.Key()]
+	if len(dev.today.reservoir) != statsReservoirSize {
+		t.Fatalf("expected a reservoir of %d samples, got %d", statsReservoirSize, len(dev.today.reservoir))
+	}
+	if p95 := dev.today.stats().P95; p95 < 85 || p95 > 99 {
+		t.Fatalf("expected a p95 near 94, got %v", p95)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	for _, c := range []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.95, 0},
+		{[]float64{7}, 0.95, 7},
+		{[]float64{3, 1, 2}, 0.5, 2},
+		{[]float64{10, 20}, 0.95, 19.5},
+	} {
+		if got := percentile(c.values, c.p); got != c.want {
+			t.Errorf("percentile(%v, %v) = %v, want %v", c.values, c.p, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	statsdFormatDog   = "dogstatsd"
+	statsdFormatPlain = "plain"
+
+	// statsdPrefix starts every StatsD metric name.
+	statsdPrefix = "power"
+	// statsdMaxPacket keeps datagrams within the payload of a 1500 byte
+	// Ethernet frame.
+	statsdMaxPacket = 1432
+)
+
+// statsdTagEscaper keeps device names from breaking DogStatsD tags.
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdSink sends readings as StatsD gauges over UDP. Gauges are buffered
+// and sent after every run or poll cycle, as many per datagram as fit.
+// Failed sends are counted for the run report rather than retried.
+type statsdSink struct {
+	conn   net.Conn
+	format string
+
+	mu      sync.Mutex
+	pending []string
+	errors  int
+}
+
+// newStatsdSink returns a sink sending to addr, a host:port resolved once
+// here, in format dogstatsd or plain.
+func newStatsdSink(addr, format string) (*statsdSink, error) {
+	if format != statsdFormatDog && format != statsdFormatPlain {
+		return nil, fmt.Errorf("invalid --statsd-format %q: must be %s or %s", format, statsdFormatDog, statsdFormatPlain)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve --statsd-addr: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	return &statsdSink{conn: conn, format: format}, nil
+}
+
+// statsdLines formats the gauges for the reading in r. DogStatsD gauges
+// carry the device as tags; plain StatsD has none, so the device becomes
+// part of each name.
+func statsdLines(r deviceResult, format string) []string {
+	if r.PowerInfo == nil {
+		return nil
+	}
+	values := []struct {
+		name  string
+		value float64
+	}{{"watts", r.CurrentWatts}, {"voltage", r.Voltage}, {"amperage", r.Amperage}}
+
+	var lines []string
+	for _, v := range values {
+		if v.value == 0 && v.name != "watts" {
+			continue
+		}
+		if format == statsdFormatPlain {
+			name := statsdPrefix + "." + graphiteNode(r.Instance)
+			if r.Channel != "" {
+				name += "." + graphiteNode(r.Channel)
+			}
+			lines = append(lines, name+"."+v.name+":"+formatFloat(v.value)+"|g")
+			continue
+		}
+		tags := "device:" + statsdTagEscaper.Replace(r.Instance)
+		if r.HostName != "" {
+			tags += ",host:" + statsdTagEscaper.Replace(r.HostName)
+		}
+		if r.Channel != "" {
+			tags += ",channel:" + statsdTagEscaper.Replace(r.Channel)
+		}
+		lines = append(lines, statsdPrefix+"."+v.name+":"+formatFloat(v.value)+"|g|#"+tags)
+	}
+	return lines
+}
+
+// add buffers the gauges for the reading in r, if any.
+func (s *statsdSink) add(r deviceResult) {
+	lines := statsdLines(r, s.format)
+	if len(lines) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, lines...)
+}
+
+// flush sends the buffered gauges, packing lines into datagrams of at
+// most statsdMaxPacket bytes. A line too long for any datagram is sent
+// alone.
+func (s *statsdSink) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var packet []byte
+	send := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet); err != nil {
+			s.errors++
+			slog.Debug("statsd send error", "error", err)
+		}
+		packet = packet[:0]
+	}
+	for _, line := range s.pending {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			send()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	send()
+	s.pending = nil
+}
+
+// Write sends the gauges for results. Datagrams that fail to send are
+// counted and not retried.
+func (s *statsdSink) Write(_ context.Context, results []deviceResult) error {
+	for _, r := range results {
+		s.add(r)
+	}
+	before := s.sendErrors()
+	s.flush()
+	if failed := s.sendErrors() - before; failed > 0 {
+		return fmt.Errorf("%d datagrams failed to send", failed)
+	}
+	return nil
+}
+
+// Flush does nothing; Write sends every gauge it buffers.
+func (s *statsdSink) Flush(context.Context) error {
+	return nil
+}
+
+// sendErrors returns how many datagrams failed to send. A nil sink has
+// none.
+func (s *statsdSink) sendErrors() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errors
+}
+
+// Close closes the UDP socket.
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
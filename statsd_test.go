@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestStatsdLines(t *testing.T) {
+	r := deviceResult{Instance: "Desk, Lamp", HostName: "lamp.local", Channel: "1", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5, Voltage: 230}}
+
+	dog := statsdLines(r, statsdFormatDog)
+	want := []string{
+		"power.watts:12.5|g|#device:Desk_ Lamp,host:lamp.local,channel:1",
+		"power.voltage:230|g|#device:Desk_ Lamp,host:lamp.local,channel:1",
+	}
+	if strings.Join(dog, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected DogStatsD lines %q", dog)
+	}
+
+	plain := statsdLines(r, statsdFormatPlain)
+	if len(plain) != 2 || plain[0] != "power.Desk_Lamp.1.watts:12.5|g" {
+		t.Fatalf("unexpected plain lines %q", plain)
+	}
+
+	if lines := statsdLines(deviceResult{Instance: "Lamp", Error: "timeout"}, statsdFormatDog); lines != nil {
+		t.Fatalf("expected no gauges for a failed query, got %q", lines)
+	}
+}
+
+func TestStatsdBatchesDatagrams(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := newStatsdSink(conn.LocalAddr().String(), statsdFormatDog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const devices = 40
+	for i := range devices {
+		s.add(deviceResult{Instance: fmt.Sprintf("Device %02d", i), HostName: "device.local", PowerInfo: &collector.PowerInfo{CurrentWatts: float64(i)}})
+	}
+	s.flush()
+
+	var lines, datagrams int
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for lines < devices {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected %d lines, got %d (%v)", devices, lines, err)
+		}
+		if n > statsdMaxPacket {
+			t.Fatalf("expected datagrams of at most %d bytes, got %d", statsdMaxPacket, n)
+		}
+		datagrams++
+		lines += strings.Count(string(buf[:n]), "\n") + 1
+	}
+	// 40 lines of about 64 bytes fit in two datagrams.
+	if datagrams != 2 {
+		t.Fatalf("expected the lines to be batched into 2 datagrams, got %d", datagrams)
+	}
+	if lines != devices || s.sendErrors() != 0 {
+		t.Fatalf("expected %d lines without errors, got %d lines and %d errors", devices, lines, s.sendErrors())
+	}
+}
+
+func TestStatsdCountsSendErrors(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newStatsdSink(conn.LocalAddr().String(), statsdFormatPlain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	s.Close()
+
+	s.add(deviceResult{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}})
+	s.flush()
+	if got := s.sendErrors(); got != 1 {
+		t.Fatalf("expected 1 send error, got %d", got)
+	}
+
+	var buf strings.Builder
+	writeRunReport(newOutput(&buf, formatText), runReport{Time: time.Unix(0, 0).UTC(), StatsdErrors: s.sendErrors()})
+	if !strings.Contains(buf.String(), "1 StatsD sends failed") {
+		t.Fatalf("expected the run report to mention send errors, got %q", buf.String())
+	}
+}
+
+func TestNewStatsdSinkRejectsInvalidSettings(t *testing.T) {
+	if _, err := newStatsdSink("statsd.invalid:8125", statsdFormatDog); err == nil {
+		t.Error("expected an unresolvable address to be rejected")
+	}
+	if _, err := newStatsdSink("127.0.0.1:8125", "influx"); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit statuses. The result-based ones only apply to one-shot runs and to
+// polling runs that reach their --count or --duration; an interrupted
+// one-shot run and polling mode otherwise exit with exitOK once shut down
+// cleanly.
+const (
+	exitOK = 0
+	// exitSetup covers invalid flags or config and discovery that could
+	// not start.
+	exitSetup = 1
+	// exitFailed means devices were found but every query failed, or any
+	// query failed with --fail-on-any-error.
+	exitFailed = 2
+	// exitNoDevices means no device was discovered at all.
+	exitNoDevices = 3
+	// exitOutdated means a --list run found devices running older
+	// firmware than --expected-firmware expects.
+	exitOutdated = 4
+	// exitForced is used when a second signal cuts shutdown short,
+	// matching a shell's 128+SIGINT.
+	exitForced = 130
+)
+
+// exitStatusHelp documents the exit statuses in --help.
+const exitStatusHelp = `
+Exit status:
+  0    at least one device was queried successfully (or the run was interrupted, or
+       polling stopped cleanly)
+  1    setup error: invalid flags or config, or discovery could not start
+  2    devices were found but every query failed (any failure with --fail-on-any-error;
+       a run reaching --count or --duration fails only if every query did)
+  3    no devices were discovered (also by a run reaching --count or --duration)
+  4    --list found devices with firmware older than --expected-firmware
+  130  a second interrupt forced an immediate exit
+`
+
+// exitError carries a non-zero exit status out of run.
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e *exitError) Error() string { return e.msg }
+
+// exitCode returns the exit status for run's error: exitOK for nil, the
+// carried status for an exitError and exitSetup for anything else.
+func exitCode(err error) int {
+	var ee *exitError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &ee):
+		return ee.code
+	}
+	return exitSetup
+}
+
+// resultError maps a one-shot run's report to the error run returns, nil
+// when the run succeeded.
+func resultError(rep runReport, failOnAnyError bool) error {
+	switch {
+	case rep.Devices == 0:
+		return &exitError{exitNoDevices, "no devices discovered"}
+	case rep.OK == 0:
+		return &exitError{exitFailed, fmt.Sprintf("all %d device queries failed", rep.Failed)}
+	case failOnAnyError && rep.Failed > 0:
+		return &exitError{exitFailed, fmt.Sprintf("%d of %d device queries failed", rep.Failed, rep.OK+rep.Failed)}
+	case rep.Outdated > 0:
+		return &exitError{exitOutdated, fmt.Sprintf("%d of %d devices run outdated firmware", rep.Outdated, rep.Devices)}
+	}
+	return nil
+}
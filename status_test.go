@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+type failingResolver struct{}
+
+func (failingResolver) Browse(context.Context, string, string, chan<- *collector.ServiceEntry) error {
+	return errors.New("multicast unavailable")
+}
+
+// statusOptions returns one-shot options querying devices on port.
+func statusOptions(port int) options {
+	opts := defaultOptions()
+	opts.format = formatJSON
+	opts.browseTimeout = 100 * time.Millisecond
+	opts.port = port
+	opts.logLevel = "error"
+	return opts
+}
+
+func TestRunExitStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	ok := &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}}
+	// Nothing listens on port 1, so queries to this device fail.
+	unreachable := staticDevice{Name: "Plug", Address: "127.0.0.2", Port: 1}
+
+	tests := []struct {
+		name      string
+		entries   []*collector.ServiceEntry
+		static    []staticDevice
+		failOnAny bool
+		want      int
+	}{
+		{"success", []*collector.ServiceEntry{ok}, nil, false, exitOK},
+		{"partial failure", []*collector.ServiceEntry{ok}, []staticDevice{unreachable}, false, exitOK},
+		{"partial failure with --fail-on-any-error", []*collector.ServiceEntry{ok}, []staticDevice{unreachable}, true, exitFailed},
+		{"all failed", nil, []staticDevice{unreachable}, false, exitFailed},
+		{"nothing discovered", nil, nil, false, exitNoDevices},
+	}
+	for _, tt := range tests {
+		var schedule []zeroconf.ScheduledEntry
+		for _, e := range tt.entries {
+			schedule = append(schedule, zeroconf.ScheduledEntry{Entry: e})
+		}
+		opts := statusOptions(addr.Port)
+		opts.resolver = zeroconf.NewScheduledResolver(schedule...)
+		opts.failOnAnyError = tt.failOnAny
+		opts.cfg = &config{devices: tt.static}
+
+		if got := exitCode(run(context.Background(), opts, io.Discard, io.Discard)); got != tt.want {
+			t.Errorf("%s: exit status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunExitStatusInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errInterrupted)
+	opts := statusOptions(1)
+	opts.resolver = zeroconf.NewScheduledResolver()
+	if got := exitCode(run(ctx, opts, io.Discard, io.Discard)); got != exitOK {
+		t.Fatalf("expected exit status %d for an interrupted run, got %d", exitOK, got)
+	}
+}
+
+func TestRunExitStatusSetupError(t *testing.T) {
+	opts := statusOptions(1)
+	opts.resolver = failingResolver{}
+	if got := exitCode(run(context.Background(), opts, io.Discard, io.Discard)); got != exitSetup {
+		t.Fatalf("expected exit status %d when browsing fails, got %d", exitSetup, got)
+	}
+}
+
+func TestResultError(t *testing.T) {
+	if err := resultError(runReport{Devices: 2, OK: 2}, true); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	err := resultError(runReport{Devices: 2, OK: 1, Failed: 1}, true)
+	if exitCode(err) != exitFailed || err.Error() != "1 of 2 device queries failed" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := exitCode(errors.New("bad flag")); got != exitSetup {
+		t.Fatalf("expected other errors to be setup errors, got %d", got)
+	}
+}
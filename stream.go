@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"powerusagecollection/internal/websocket"
+	"powerusagecollection/pkg/collector"
+)
+
+const (
+	// streamBuffer is how many messages each /stream and /events client
+	// may fall behind by before its oldest are dropped.
+	streamBuffer = 64
+	// streamKeepAlive is how often streaming clients are pinged and told
+	// of dropped messages.
+	streamKeepAlive = 30 * time.Second
+)
+
+// streamDrops is the message telling a streaming client how many readings
+// it missed by falling behind since the last one.
+type streamDrops struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"timestamp"`
+	Dropped int       `json:"dropped"`
+}
+
+// streamHub pushes every reading to the clients of GET /stream (WebSocket)
+// and GET /events (Server-Sent Events) as it is stored. Slow clients never
+// hold up the poller: each has a bounded buffer that drops its oldest
+// messages.
+type streamHub struct {
+	keepAlive time.Duration
+
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+// streamClient is one connected client, receiving the readings of device
+// or, when it is empty, of every device.
+type streamClient struct {
+	device   string
+	messages chan []byte
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{keepAlive: streamKeepAlive, clients: make(map[*streamClient]struct{}), done: make(chan struct{})}
+}
+
+// register routes GET /stream and GET /events to h.
+func (h *streamHub) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /stream", h.serveWebSocket)
+	mux.HandleFunc("GET /events", h.serveEvents)
+}
+
+// publish sends r to every client following its device.
+func (h *streamHub) publish(r collector.Reading) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+	msg, err := json.Marshal(readingResult(r))
+	if err != nil {
+		slog.Error("stream encode error", "device", r.Device.Instance, "error", err)
+		return
+	}
+	for c := range h.clients {
+		if c.device == "" || c.device == r.Device.Instance {
+			c.send(msg)
+		}
+	}
+}
+
+// send queues msg, dropping the oldest queued message when the buffer is
+// full. Only publish sends, so the buffer has room after one drop.
+func (c *streamClient) send(msg []byte) {
+	select {
+	case c.messages <- msg:
+		return
+	default:
+	}
+	select {
+	case <-c.messages:
+		c.mu.Lock()
+		c.dropped++
+		c.mu.Unlock()
+	default:
+	}
+	c.messages <- msg
+}
+
+// drops returns the messages dropped since it was last called, as the
+// message reporting them, or nil when none were.
+func (c *streamClient) drops(now time.Time) []byte {
+	c.mu.Lock()
+	n := c.dropped
+	c.dropped = 0
+	c.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	msg, _ := json.Marshal(streamDrops{Type: "dropped", Time: now, Dropped: n})
+	return msg
+}
+
+// subscribe adds a client for r's ?device= filter. It returns false once
+// the hub is closed.
+func (h *streamHub) subscribe(r *http.Request) (*streamClient, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	c := &streamClient{device: r.URL.Query().Get("device"), messages: make(chan []byte, streamBuffer)}
+	h.clients[c] = struct{}{}
+	return c, true
+}
+
+func (h *streamHub) unsubscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// close disconnects every client, for shutdown.
+func (h *streamHub) close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		h.closed = true
+		close(h.done)
+	}
+}
+
+func (h *streamHub) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.subscribe(r)
+	if !ok {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(c)
+	conn, err := websocket.Upgrade(w, r, 2*h.keepAlive)
+	if err != nil {
+		slog.Debug("stream upgrade failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	tick := time.NewTicker(h.keepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case msg := <-c.messages:
+			if conn.WriteText(msg) != nil {
+				return
+			}
+		case now := <-tick.C:
+			if msg := c.drops(now); msg != nil && conn.WriteText(msg) != nil {
+				return
+			}
+			if conn.Ping() != nil {
+				return
+			}
+		case <-conn.Done():
+			return
+		case <-h.done:
+			conn.Close(websocket.CloseGoingAway, "collector shutting down")
+			return
+		}
+	}
+}
+
+func (h *streamHub) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c, ok := h.subscribe(r)
+	if !ok {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(c)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tick := time.NewTicker(h.keepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case msg := <-c.messages:
+			fmt.Fprintf(w, "event: reading\ndata: %s\n\n", msg)
+		case now := <-tick.C:
+			if msg := c.drops(now); msg != nil {
+				fmt.Fprintf(w, "event: dropped\ndata: %s\n\n", msg)
+			}
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// streamServer serves h's routes, closing h before the server.
+func streamServer(t *testing.T, h *streamHub) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	h.register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		h.close()
+		server.Close()
+	})
+	return server
+}
+
+// waitForClients waits until h has n clients.
+func waitForClients(t *testing.T, h *streamHub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.mu.Lock()
+		got := len(h.clients)
+		h.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d stream clients, got %d", n, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamEventsFiltersDevices(t *testing.T) {
+	h := newStreamHub()
+	server := streamServer(t, h)
+	resp, err := http.Get(server.URL + "/events?device=Lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	waitForClients(t, h, 1)
+
+	h.publish(collector.Reading{Device: collector.Device{Instance: "Plug"}, Power: &collector.PowerInfo{CurrentWatts: 40}})
+	h.publish(collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: 12.5}})
+	r := bufio.NewReader(resp.Body)
+	event, _ := r.ReadString('\n')
+	data, _ := r.ReadString('\n')
+	if event != "event: reading\n" || !strings.Contains(data, `"instance":"Lamp"`) || !strings.Contains(data, `"currentWatts":12.5`) {
+		t.Fatalf("unexpected event %q %q", event, data)
+	}
+}
+
+func TestStreamClientDropsOldest(t *testing.T) {
+	c := &streamClient{messages: make(chan []byte, 2)}
+	for i := range 5 {
+		c.send([]byte(fmt.Sprint(i)))
+	}
+	if got := string(<-c.messages) + string(<-c.messages); got != "34" {
+		t.Fatalf("expected the newest messages to be kept, got %q", got)
+	}
+	msg := c.drops(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	if string(msg) != `{"type":"dropped","timestamp":"2026-01-01T12:00:00Z","dropped":3}` {
+		t.Fatalf("unexpected drop report %s", msg)
+	}
+	if c.drops(time.Now()) != nil {
+		t.Fatal("expected drops to be reported once")
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	h := newStreamHub()
+	h.keepAlive = 20 * time.Millisecond
+	server := streamServer(t, h)
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /stream HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the upgrade, got %v (%v)", resp, err)
+	}
+	waitForClients(t, h, 1)
+
+	// readFrame returns the next server frame other than a ping.
+	readFrame := func() (byte, string) {
+		t.Helper()
+		for {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var head [2]byte
+			if _, err := io.ReadFull(r, head[:]); err != nil {
+				t.Fatal(err)
+			}
+			n := int(head[1] & 0x7F)
+			if n == 126 {
+				var ext [2]byte
+				io.ReadFull(r, ext[:])
+				n = int(binary.BigEndian.Uint16(ext[:]))
+			}
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				t.Fatal(err)
+			}
+			if op := head[0] & 0x0F; op != 0x9 {
+				return op, string(payload)
+			}
+		}
+	}
+
+	h.publish(collector.Reading{Device: collector.Device{Instance: "Lamp"}, Power: &collector.PowerInfo{CurrentWatts: 12.5}})
+	if op, msg := readFrame(); op != 0x1 || !strings.Contains(msg, `"currentWatts":12.5`) {
+		t.Fatalf("expected the reading as a text message, got %x %q", op, msg)
+	}
+
+	h.close()
+	if op, msg := readFrame(); op != 0x8 || binary.BigEndian.Uint16([]byte(msg)) != 1001 {
+		t.Fatalf("expected a going-away close on shutdown, got %x %q", op, msg)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// summary aggregates one discovery pass or poll cycle across all devices.
+// TotalWatts is the net power, exported power counting against it.
+type summary struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"timestamp"`
+	TotalWatts float64   `json:"totalWatts"`
+	// ImportWatts and ExportWatts subtotal the devices drawing power and
+	// those exporting it, reporting negative power, when any do.
+	ImportWatts float64 `json:"importWatts,omitempty"`
+	ExportWatts float64 `json:"exportWatts,omitempty"`
+	Devices     int     `json:"devices"`
+	Failed      int     `json:"failed"`
+	Carried     int     `json:"carried,omitempty"`
+	MinWatts    float64 `json:"minWatts"`
+	MaxWatts    float64 `json:"maxWatts"`
+	// DeviceWatts totals the channels of each multi-channel device.
+	DeviceWatts map[string]float64 `json:"deviceWatts,omitempty"`
+	// Groups subtotals the devices of each group, when groups are
+	// configured.
+	Groups map[string]*groupTotal `json:"groups,omitempty"`
+	// Energy is the cumulative energy so far, in polling mode.
+	Energy *energyReport `json:"energy,omitempty"`
+	// Stats holds each device's power statistics in polling mode, keyed
+	// by device label.
+	Stats map[string]*deviceStats `json:"stats,omitempty"`
+	// Standby lists the devices idling above --standby-threshold, the
+	// largest first.
+	Standby []standbyDevice `json:"standby,omitempty"`
+	// FailedSources names the discovery sources that failed so far.
+	FailedSources []string `json:"failedSources,omitempty"`
+	// Sinks counts each output sink's writes, in a one-shot run.
+	Sinks map[string]sinkCounts `json:"sinks,omitempty"`
+}
+
+// groupTotal is the subtotal of one group of devices in a summary.
+type groupTotal struct {
+	TotalWatts float64 `json:"totalWatts"`
+	Devices    int     `json:"devices"`
+	Failed     int     `json:"failed"`
+}
+
+// summarizer totals each cycle's records. With carryLast, a failed device
+// contributes its last successful reading instead of being left out.
+// Suspect readings are left out of the totals without counting as
+// failures, unless includeSuspect is set.
+type summarizer struct {
+	carryLast      bool
+	includeSuspect bool
+
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+func newSummarizer(carryLast bool) *summarizer {
+	return &summarizer{carryLast: carryLast, last: make(map[string]float64)}
+}
+
+// summarize aggregates results taken at now. The channels of a
+// multi-channel device are summed into one device first. A device with a
+// failed channel counts towards Failed and, unless carried, that channel
+// is excluded from the total; a device with no counted channel is left
+// out of the range. Devices with a group are also subtotalled under it.
+func (s *summarizer) summarize(now time.Time, results []deviceResult) summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type deviceTotal struct {
+		name, group              string
+		watts                    float64
+		channels                 int
+		counted, failed, carried bool
+	}
+	var order []string
+	devices := make(map[string]*deviceTotal)
+	for _, r := range results {
+		key := r.Instance + "|" + r.HostName
+		dev, ok := devices[key]
+		if !ok {
+			dev = &deviceTotal{name: r.Instance, group: r.Group}
+			devices[key] = dev
+			order = append(order, key)
+		}
+		if r.Channel != "" {
+			dev.channels++
+		}
+
+		watts, ok := 0.0, r.PowerInfo != nil && r.Error == ""
+		if ok && r.Suspect && !s.includeSuspect {
+			continue
+		}
+		if ok {
+			watts = r.CurrentWatts
+			s.last[resultKey(r)] = watts
+		} else {
+			dev.failed = true
+			if !s.carryLast {
+				continue
+			}
+			if watts, ok = s.last[resultKey(r)]; !ok {
+				continue
+			}
+			dev.carried = true
+		}
+		dev.watts += watts
+		dev.counted = true
+	}
+
+	sum := summary{Type: "summary", Time: now, Devices: len(order)}
+	counted := 0
+	for _, key := range order {
+		dev := devices[key]
+		var group *groupTotal
+		if dev.group != "" {
+			if sum.Groups == nil {
+				sum.Groups = make(map[string]*groupTotal)
+			}
+			if group = sum.Groups[dev.group]; group == nil {
+				group = &groupTotal{}
+				sum.Groups[dev.group] = group
+			}
+			group.Devices++
+		}
+		if dev.failed {
+			sum.Failed++
+			if group != nil {
+				group.Failed++
+			}
+		}
+		if dev.carried {
+			sum.Carried++
+		}
+		if !dev.counted {
+			continue
+		}
+		if group != nil {
+			group.TotalWatts += dev.watts
+		}
+		if dev.channels > 0 {
+			if sum.DeviceWatts == nil {
+				sum.DeviceWatts = make(map[string]float64)
+			}
+			sum.DeviceWatts[dev.name] += dev.watts
+		}
+
+		sum.TotalWatts += dev.watts
+		if dev.watts < 0 {
+			sum.ExportWatts -= dev.watts
+		} else {
+			sum.ImportWatts += dev.watts
+		}
+		if counted == 0 || dev.watts < sum.MinWatts {
+			sum.MinWatts = dev.watts
+		}
+		if counted == 0 || dev.watts > sum.MaxWatts {
+			sum.MaxWatts = dev.watts
+		}
+		counted++
+	}
+	if sum.ExportWatts == 0 {
+		sum.ImportWatts = 0
+	}
+	return sum
+}
+
+// summarizeReadings aggregates a poll cycle.
+func (s *summarizer) summarizeReadings(now time.Time, readings []collector.Reading) summary {
+	results := make([]deviceResult, 0, len(readings))
+	for _, r := range readings {
+		results = append(results, readingResult(r))
+	}
+	return s.summarize(now, results)
+}
+
+// writeSummary writes sum as a text line or a JSON object. Other formats
+// have a fixed record shape and get no summary.
+func writeSummary(out *output, sum summary) {
+	switch out.format {
+	case formatText:
+		line := fmt.Sprintf("%s Total: %.2f W", out.times.format(sum.Time), sum.TotalWatts)
+		if sum.ExportWatts > 0 {
+			line += fmt.Sprintf(" net (%.2f W imported, %.2f W exported)", sum.ImportWatts, sum.ExportWatts)
+		}
+		line += fmt.Sprintf(" from %d devices (%d failed", sum.Devices, sum.Failed)
+		if sum.Carried > 0 {
+			line += fmt.Sprintf(", %d carried", sum.Carried)
+		}
+		if sum.Devices > sum.Failed || sum.Carried > 0 {
+			line += fmt.Sprintf("; min %.2f W, max %.2f W", sum.MinWatts, sum.MaxWatts)
+		}
+		for _, name := range sortedKeys(sum.DeviceWatts) {
+			line += fmt.Sprintf("; %s %.2f W", name, sum.DeviceWatts[name])
+		}
+		if sum.Energy != nil {
+			line += fmt.Sprintf("; %.3f kWh so far", sum.Energy.TotalKWh)
+			if sum.Energy.ExportKWh > 0 {
+				line += fmt.Sprintf(", %.3f kWh exported", sum.Energy.ExportKWh)
+			}
+			if sum.Energy.TotalCost != nil {
+				line += fmt.Sprintf(", cost %.2f", *sum.Energy.TotalCost)
+			}
+		}
+		line += ")\n"
+		for _, name := range sortedKeys(sum.Groups) {
+			g := sum.Groups[name]
+			line += fmt.Sprintf("  Group %s: %.2f W from %d devices (%d failed)\n", name, g.TotalWatts, g.Devices, g.Failed)
+		}
+		if len(sum.FailedSources) > 0 {
+			line += fmt.Sprintf("  Discovery failed: %s\n", strings.Join(sum.FailedSources, ", "))
+		}
+		if len(sum.Sinks) > 0 {
+			line += fmt.Sprintf("  Sinks: %s\n", sinksText(sum.Sinks))
+		}
+		if len(sum.Standby) > 0 {
+			line += fmt.Sprintf("  Standby: %s\n", standbyText(sum.Standby))
+		}
+		for _, name := range sortedKeys(sum.Stats) {
+			if st := statsLine(sum.Stats[name]); st != "" {
+				line += fmt.Sprintf("  %s: %s\n", name, st)
+			}
+		}
+		out.text([]byte(line))
+	case formatJSON:
+		var v any = sum
+		if out.times.set() {
+			v = struct {
+				summary
+				Time any `json:"timestamp"`
+			}{sum, out.times.value(sum.Time)}
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		out.text(append(b, '\n'))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestSummarizeExcludesFailedDevices(t *testing.T) {
+	now := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	results := []deviceResult{
+		{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}},
+		{Instance: "Fridge", PowerInfo: &collector.PowerInfo{CurrentWatts: 80}},
+		{Instance: "Kettle", Error: "timeout"},
+	}
+
+	sum := newSummarizer(false).summarize(now, results)
+	if sum.TotalWatts != 92.5 || sum.Devices != 3 || sum.Failed != 1 || sum.MinWatts != 12.5 || sum.MaxWatts != 80 {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+}
+
+func TestSummarizeCarriesLastReading(t *testing.T) {
+	s := newSummarizer(true)
+	s.summarize(time.Now(), []deviceResult{{Instance: "Kettle", PowerInfo: &collector.PowerInfo{CurrentWatts: 2000}}})
+
+	sum := s.summarize(time.Now(), []deviceResult{
+		{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}},
+		{Instance: "Kettle", Error: "timeout"},
+	})
+	if sum.TotalWatts != 2012.5 || sum.Failed != 1 || sum.Carried != 1 || sum.MaxWatts != 2000 {
+		t.Fatalf("expected the kettle's last reading to be carried, got %+v", sum)
+	}
+}
+
+func TestSummarizeSumsChannelsPerDevice(t *testing.T) {
+	results := []deviceResult{
+		{Instance: "Office Plug", HostName: "plug.local", Channel: "0", PowerInfo: &collector.PowerInfo{CurrentWatts: 40}},
+		{Instance: "Office Plug", HostName: "plug.local", Channel: "1", PowerInfo: &collector.PowerInfo{CurrentWatts: 60}},
+		{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}},
+		{Instance: "Heater", HostName: "heater.local", Channel: "0", PowerInfo: &collector.PowerInfo{CurrentWatts: 500}},
+		{Instance: "Heater", HostName: "heater.local", Channel: "1", Error: "timeout"},
+	}
+
+	sum := newSummarizer(false).summarize(time.Now(), results)
+	if sum.TotalWatts != 612.5 || sum.Devices != 3 || sum.Failed != 1 || sum.MinWatts != 12.5 || sum.MaxWatts != 500 {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+	if len(sum.DeviceWatts) != 2 || sum.DeviceWatts["Office Plug"] != 100 || sum.DeviceWatts["Heater"] != 500 {
+		t.Fatalf("expected per-device channel totals, got %v", sum.DeviceWatts)
+	}
+
+	var buf bytes.Buffer
+	writeSummary(newOutput(&buf, formatText), sum)
+	if !strings.Contains(buf.String(), "; Heater 500.00 W; Office Plug 100.00 W)") {
+		t.Fatalf("expected per-device totals in the text summary, got %q", buf.String())
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	sum := summary{Type: "summary", Time: time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC), TotalWatts: 92.5, Devices: 3, Failed: 1, MinWatts: 12.5, MaxWatts: 80}
+
+	var buf bytes.Buffer
+	writeSummary(newOutput(&buf, formatText), sum)
+	if got := buf.String(); got != "2024-02-02T15:04:05Z Total: 92.50 W from 3 devices (1 failed; min 12.50 W, max 80.00 W)\n" {
+		t.Fatalf("unexpected summary line %q", got)
+	}
+
+	buf.Reset()
+	writeSummary(newOutput(&buf, formatJSON), sum)
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("expected JSON summary, got %q (%v)", buf.String(), err)
+	}
+	if decoded["type"] != "summary" || decoded["totalWatts"] != 92.5 || decoded["failed"] != 1.0 {
+		t.Fatalf("unexpected JSON summary %v", decoded)
+	}
+
+	buf.Reset()
+	withStats := sum
+	withStats.Stats = map[string]*deviceStats{"Plug": {Today: &powerStats{Samples: 2, Min: 10, Max: 30, Mean: 20, P95: 29}}}
+	writeSummary(newOutput(&buf, formatText), withStats)
+	if got, want := buf.String(), "  Plug: today min 10.00 W, max 30.00 W, mean 20.00 W, p95 29.00 W\n"; !strings.HasSuffix(got, want) {
+		t.Fatalf("expected a statistics line ending %q, got %q", want, got)
+	}
+
+	buf.Reset()
+	writeSummary(newOutput(&buf, formatCSV), sum)
+	if buf.Len() != 0 {
+		t.Fatalf("expected no summary in CSV output, got %q", buf.String())
+	}
+}
+
+func TestSummarizeSubtotalsGroups(t *testing.T) {
+	results := []deviceResult{
+		{Instance: "Desk Lamp", Group: "office", PowerInfo: &collector.PowerInfo{CurrentWatts: 12.5}},
+		{Instance: "Monitor", Group: "office", PowerInfo: &collector.PowerInfo{CurrentWatts: 30}},
+		{Instance: "Kettle", Group: "kitchen", Error: "timeout"},
+		{Instance: "Shed", Group: defaultGroup, PowerInfo: &collector.PowerInfo{CurrentWatts: 5}},
+	}
+
+	sum := newSummarizer(false).summarize(time.Now(), results)
+	office, kitchen := sum.Groups["office"], sum.Groups["kitchen"]
+	if len(sum.Groups) != 3 || office == nil || office.TotalWatts != 42.5 || office.Devices != 2 || kitchen == nil || kitchen.Failed != 1 {
+		t.Fatalf("unexpected group subtotals %v", sum.Groups)
+	}
+	if sum := newSummarizer(false).summarize(time.Now(), []deviceResult{{Instance: "Lamp", PowerInfo: &collector.PowerInfo{CurrentWatts: 1}}}); sum.Groups != nil {
+		t.Fatalf("expected no groups without grouped devices, got %v", sum.Groups)
+	}
+
+	var buf bytes.Buffer
+	writeSummary(newOutput(&buf, formatText), sum)
+	if !strings.Contains(buf.String(), "  Group office: 42.50 W from 2 devices (0 failed)\n") {
+		t.Fatalf("expected group subtotals in the text summary, got %q", buf.String())
+	}
+}
+
+func TestSummarizeNetsExport(t *testing.T) {
+	now := time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC)
+	results := []deviceResult{
+		{Instance: "Solar", PowerInfo: &collector.PowerInfo{CurrentWatts: -1500}},
+		{Instance: "Fridge", PowerInfo: &collector.PowerInfo{CurrentWatts: 80}},
+		{Instance: "Kettle", PowerInfo: &collector.PowerInfo{CurrentWatts: 2000}},
+	}
+	sum := newSummarizer(false).summarize(now, results)
+	if sum.TotalWatts != 580 || sum.ImportWatts != 2080 || sum.ExportWatts != 1500 || sum.MinWatts != -1500 {
+		t.Fatalf("expected the net total with import and export subtotals, got %+v", sum)
+	}
+
+	var buf bytes.Buffer
+	writeSummary(newOutput(&buf, formatText), sum)
+	if got := buf.String(); !strings.HasPrefix(got, "2024-06-21T12:00:00Z Total: 580.00 W net (2080.00 W imported, 1500.00 W exported) from 3 devices") {
+		t.Fatalf("unexpected summary line %q", got)
+	}
+
+	if sum := newSummarizer(false).summarize(now, results[1:]); sum.ImportWatts != 0 || sum.ExportWatts != 0 {
+		t.Fatalf("expected no subtotals without export, got %+v", sum)
+	}
+}
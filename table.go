@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// formatTable collects a one-shot run's results and writes them as one
+// aligned table at its end.
+const formatTable = "table"
+
+// minTableNameWidth is the narrowest the NAME column is truncated to when
+// the table does not fit the terminal.
+const minTableNameWidth = 8
+
+// resultTable holds the results of a --format=table run until the end.
+type resultTable struct {
+	// sortBy orders the rows, as --sort does the --watch table.
+	sortBy string
+	// width is the width the table is kept within by truncating names;
+	// zero means no limit.
+	width int
+	// verbose lists the full errors below the table.
+	verbose bool
+	// times renders when the readings were taken, below the table.
+	times timeFormat
+
+	rows []deviceResult
+}
+
+// writeResultTable writes the results collected by a --format=table
+// output, if any.
+func (o *output) writeResultTable() {
+	if o.table == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var buf bytes.Buffer
+	o.table.times = o.times
+	renderResultTable(&buf, o.table.rows, o.table, o.palette)
+	o.w.Write(buf.Bytes())
+	o.table.rows = nil
+}
+
+// renderResultTable writes results as a table of NAME, ADDRESS, FIRMWARE,
+// WATTS, VOLTS, AMPS and STATUS, with a footer totalling the power of the
+// devices that answered, and the time the last reading was taken below it.
+// A failed device's STATUS is the kind of failure; its full error is
+// listed below the table when t.verbose is set.
+func renderResultTable(w io.Writer, results []deviceResult, t *resultTable, pal palette) {
+	results = slices.Clone(results)
+	sortResults(results, t.sortBy)
+
+	header := []string{"NAME", "ADDRESS", "FIRMWARE", "WATTS", "VOLTS", "AMPS", "STATUS"}
+	rows := make([][]cell, 0, len(results)+1)
+	var total float64
+	ok, failed := 0, 0
+	var errs []string
+	var taken time.Time
+	for _, r := range results {
+		if r.Time.After(taken) {
+			taken = r.Time
+		}
+		name := deviceLabel(r.Instance, r.Channel)
+		watts, volts, amps := cell{text: "-"}, "-", "-"
+		status := cell{text: "ok"}
+		switch {
+		case r.Disabled:
+			status = cell{text: "disabled"}
+		case r.Error != "":
+			failed++
+			status = cell{orDash(r.reason), ansiRed}
+			errs = append(errs, name+": "+r.Error)
+		case r.PowerInfo != nil:
+			ok++
+			total += r.CurrentWatts
+			watts = cell{strconv.FormatFloat(r.CurrentWatts, 'f', 2, 64), pal.wattsColor(r.CurrentWatts)}
+			volts, amps = optionalTableFloat(r.Voltage, 1), optionalTableFloat(r.Amperage, 3)
+		default:
+			status = cell{text: "listed"}
+		}
+		firmware, firmwareColor := pal.deviceFirmware(r)
+		rows = append(rows, []cell{{text: name}, {text: orDash(r.Address)}, {orDash(firmware), firmwareColor}, watts, {text: volts}, {text: amps}, status})
+	}
+	footer := fmt.Sprintf("%d ok", ok)
+	if failed > 0 {
+		footer += fmt.Sprintf(", %d failed", failed)
+	}
+	rows = append(rows, []cell{{text: "TOTAL"}, {}, {}, {text: strconv.FormatFloat(total, 'f', 2, 64)}, {}, {}, {text: footer}})
+	fitNames(header, rows, t.width)
+
+	pal.writeTable(w, header, rows)
+	if !taken.IsZero() {
+		fmt.Fprintf(w, "Taken: %s\n", t.times.format(taken))
+	}
+	if t.verbose && len(errs) > 0 {
+		fmt.Fprintln(w, "\nErrors:")
+		for _, e := range errs {
+			fmt.Fprintln(w, "  "+e)
+		}
+	}
+}
+
+// sortResults orders results by sortBy, the largest reading first for
+// sortWatts, breaking ties by name and host. Results without a reading
+// come last when sorting by power.
+func sortResults(results []deviceResult, sortBy string) {
+	slices.SortFunc(results, func(a, b deviceResult) int {
+		var c int
+		switch sortBy {
+		case sortWatts:
+			hasA, hasB := a.PowerInfo != nil && a.Error == "", b.PowerInfo != nil && b.Error == ""
+			switch {
+			case hasA != hasB:
+				if hasA {
+					return -1
+				}
+				return 1
+			case hasA:
+				c = cmp.Compare(b.CurrentWatts, a.CurrentWatts)
+			}
+		case sortHost:
+			c = cmp.Compare(a.HostName, b.HostName)
+		}
+		return cmp.Or(c,
+			cmp.Compare(deviceLabel(a.Instance, a.Channel), deviceLabel(b.Instance, b.Channel)),
+			cmp.Compare(a.HostName, b.HostName))
+	})
+}
+
+// fitNames truncates the names in the first column of rows with an
+// ellipsis so that the table is at most width wide, as writeTable lays it
+// out, though never below minTableNameWidth. A zero width fits anything.
+func fitNames(header []string, rows [][]cell, width int) {
+	if width <= 0 {
+		return
+	}
+	widths := make([]int, len(header))
+	for i, h := range header {
+		widths[i] = utf8.RuneCountInString(h)
+	}
+	for _, row := range rows {
+		for i, c := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(c.text))
+		}
+	}
+	total := 2 * (len(widths) - 1)
+	for _, w := range widths {
+		total += w
+	}
+	if total <= width {
+		return
+	}
+	nameWidth := max(widths[0]-(total-width), minTableNameWidth, utf8.RuneCountInString(header[0]))
+	for _, row := range rows {
+		if name := []rune(row[0].text); len(name) > nameWidth {
+			row[0].text = string(name[:nameWidth-1]) + "…"
+		}
+	}
+}
+
+// optionalTableFloat formats v with prec decimals, or a dash for zero.
+func optionalTableFloat(v float64, prec int) string {
+	if v == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(v, 'f', prec, 64)
+}
+
+// tableWidth returns the width --format=table output to w is kept within:
+// width when set, otherwise the terminal's when w is one, falling back to
+// $COLUMNS, or zero for no limit.
+func tableWidth(w io.Writer, width int) int {
+	if width > 0 {
+		return width
+	}
+	if f, ok := w.(*os.File); ok && isTerminal(w) {
+		if cols := terminalColumns(f); cols > 0 {
+			return cols
+		}
+		if cols, err := strconv.Atoi(strings.TrimSpace(os.Getenv("COLUMNS"))); err == nil && cols > 0 {
+			return cols
+		}
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func tableResults() []deviceResult {
+	return []deviceResult{
+		{Instance: "Lamp", Address: "10.0.0.1", Firmware: "1.2", PowerInfo: &collector.PowerInfo{CurrentWatts: 10, Voltage: 230}},
+		{Instance: "Heater in the living room", Address: "10.0.0.2", PowerInfo: &collector.PowerInfo{CurrentWatts: 1500, Amperage: 6.5}},
+		{Instance: "Plug", Address: "10.0.0.3", Error: "Get \"http://10.0.0.3/\": context deadline exceeded", reason: collector.ReasonTimeout},
+	}
+}
+
+func TestRenderResultTable(t *testing.T) {
+	var buf bytes.Buffer
+	renderResultTable(&buf, tableResults(), &resultTable{sortBy: sortWatts}, palette{})
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected a header, three rows and a footer, got:\n%s", buf.String())
+	}
+	for i, want := range []string{"NAME", "Heater in the living room", "Lamp", "Plug", "TOTAL"} {
+		if !strings.HasPrefix(lines[i], want) {
+			t.Fatalf("expected line %d to start with %q, got:\n%s", i, want, buf.String())
+		}
+	}
+	if !strings.Contains(lines[1], "1500.00") || !strings.Contains(lines[1], "6.500") || !strings.HasSuffix(lines[1], "ok") {
+		t.Fatalf("expected the heater's reading, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[3], collector.ReasonTimeout) || strings.Contains(buf.String(), "deadline") {
+		t.Fatalf("expected only the failure reason in STATUS, got:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[4], "1510.00") || !strings.HasSuffix(lines[4], "2 ok, 1 failed") {
+		t.Fatalf("expected the totals in the footer, got %q", lines[4])
+	}
+
+	buf.Reset()
+	renderResultTable(&buf, tableResults(), &resultTable{sortBy: sortName, verbose: true}, palette{})
+	if !strings.HasPrefix(strings.Split(buf.String(), "\n")[1], "Heater") || strings.Index(buf.String(), "Lamp") > strings.Index(buf.String(), "Plug") {
+		t.Fatalf("expected the rows sorted by name, got:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "\nErrors:\n  Plug: Get \"http://10.0.0.3/\": context deadline exceeded\n") {
+		t.Fatalf("expected the full error listed with --verbose, got:\n%s", buf.String())
+	}
+}
+
+func TestRenderResultTableFitsWidth(t *testing.T) {
+	var buf bytes.Buffer
+	renderResultTable(&buf, tableResults(), &resultTable{sortBy: sortName, width: 70}, palette{})
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if n := len([]rune(line)); n > 70 {
+			t.Fatalf("expected every line within 70 columns, got %d:\n%s", n, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "Heater in …") {
+		t.Fatalf("expected the long name truncated with an ellipsis, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	renderResultTable(&buf, tableResults(), &resultTable{width: 10}, palette{})
+	if !strings.Contains(buf.String(), "Heater …") {
+		t.Fatalf("expected names kept to at least %d columns, got:\n%s", minTableNameWidth, buf.String())
+	}
+}
+
+func TestTableWidth(t *testing.T) {
+	if got := tableWidth(new(bytes.Buffer), 100); got != 100 {
+		t.Fatalf("expected --width used, got %d", got)
+	}
+	t.Setenv("COLUMNS", "90")
+	if got := tableWidth(new(bytes.Buffer), 0); got != 0 {
+		t.Fatalf("expected no limit when not writing to a terminal, got %d", got)
+	}
+}
+
+func TestRenderResultTableShowsTaken(t *testing.T) {
+	results := tableResults()
+	results[0].Time = time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	results[1].Time = results[0].Time.Add(2 * time.Second)
+
+	var buf bytes.Buffer
+	renderResultTable(&buf, results, &resultTable{times: timeFormat{layout: timeFormatUnix}}, palette{})
+	if !strings.HasSuffix(buf.String(), "\nTaken: 1719835202\n") {
+		t.Fatalf("expected the last reading's time below the table, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// tariff prices energy at a base rate per kWh, overridden during the
+// periods of a time-of-use schedule. Periods are wall-clock times in loc,
+// so they follow DST transitions, and may cross midnight.
+type tariff struct {
+	base    float64
+	periods []tariffPeriod
+	loc     *time.Location
+}
+
+// tariffPeriod is a daily period from start until end, in minutes since
+// midnight. A period with end before start crosses midnight.
+type tariffPeriod struct {
+	start, end int
+	rate       float64
+}
+
+// tariffPeriodConfig is an entry of the config file's tariff-schedule
+// list, such as {from: "23:00", to: "07:00", rate: 0.18}.
+type tariffPeriodConfig struct {
+	From string  `yaml:"from"`
+	To   string  `yaml:"to"`
+	Rate float64 `yaml:"rate"`
+}
+
+// newTariff returns the tariff with the base rate and schedule, or nil
+// when neither prices anything.
+func newTariff(base float64, schedule []tariffPeriodConfig, loc *time.Location) (*tariff, error) {
+	if base < 0 {
+		return nil, fmt.Errorf("invalid tariff %v: must not be negative", base)
+	}
+	if base == 0 && len(schedule) == 0 {
+		return nil, nil
+	}
+	t := &tariff{base: base, loc: loc}
+	for i, pc := range schedule {
+		start, err := parseClock(pc.From)
+		if err != nil {
+			return nil, fmt.Errorf("tariff schedule entry %d: %w", i+1, err)
+		}
+		end, err := parseClock(pc.To)
+		if err != nil {
+			return nil, fmt.Errorf("tariff schedule entry %d: %w", i+1, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("tariff schedule entry %d: from and to must differ", i+1)
+		}
+		if pc.Rate < 0 {
+			return nil, fmt.Errorf("tariff schedule entry %d: rate must not be negative", i+1)
+		}
+		t.periods = append(t.periods, tariffPeriod{start: start, end: end, rate: pc.Rate})
+	}
+	return t, nil
+}
+
+// parseClock parses a time of day such as "07:00" into minutes since
+// midnight. "24:00" is accepted as the end of the day.
+func parseClock(s string) (int, error) {
+	if len(s) == 5 && s[2] == ':' {
+		h, errH := strconv.Atoi(s[:2])
+		m, errM := strconv.Atoi(s[3:])
+		if errH == nil && errM == nil && m >= 0 && m < 60 && (h >= 0 && h < 24 || h == 24 && m == 0) {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q: want HH:MM", s)
+}
+
+// contains reports whether the minute of the day falls in p.
+func (p tariffPeriod) contains(minute int) bool {
+	if p.start < p.end {
+		return minute >= p.start && minute < p.end
+	}
+	return minute >= p.start || minute < p.end
+}
+
+// rateAt returns the price per kWh at instant at. The first matching
+// period wins.
+func (t *tariff) rateAt(at time.Time) float64 {
+	local := at.In(t.loc)
+	minute := local.Hour()*60 + local.Minute()
+	for _, p := range t.periods {
+		if p.contains(minute) {
+			return p.rate
+		}
+	}
+	return t.base
+}
+
+// nextBoundary returns the first instant after at where a period starts or
+// ends, or the zero time when there are no periods. Boundaries are built
+// from the local date, so a day of 23 or 25 hours is handled, and a
+// boundary falling in a DST gap moves to the wall-clock time after it.
+func (t *tariff) nextBoundary(at time.Time) time.Time {
+	local := at.In(t.loc)
+	var next time.Time
+	for day := 0; day <= 1; day++ {
+		for _, p := range t.periods {
+			for _, minute := range []int{p.start, p.end} {
+				b := time.Date(local.Year(), local.Month(), local.Day()+day, 0, minute, 0, 0, t.loc)
+				if b.After(at) && (next.IsZero() || b.Before(next)) {
+					next = b
+				}
+			}
+		}
+	}
+	return next
+}
+
+// cost prices the energy drawn between from and to while power changed
+// linearly from wFrom to wTo watts, splitting the interval wherever the
+// rate changes.
+func (t *tariff) cost(from, to time.Time, wFrom, wTo float64) float64 {
+	span := to.Sub(from)
+	if span <= 0 {
+		return 0
+	}
+	wattsAt := func(at time.Time) float64 {
+		return wFrom + (wTo-wFrom)*float64(at.Sub(from))/float64(span)
+	}
+
+	var total float64
+	start, wStart := from, wFrom
+	for start.Before(to) {
+		end := t.nextBoundary(start)
+		if end.IsZero() || end.After(to) {
+			end = to
+		}
+		wEnd := wattsAt(end)
+		kwh := (wStart + wEnd) / 2 * end.Sub(start).Hours() / 1000
+		total += kwh * t.rateAt(start)
+		start, wStart = end, wEnd
+	}
+	return total
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func nightTariff(t *testing.T, loc *time.Location) *tariff {
+	t.Helper()
+	tr, err := newTariff(0.32, []tariffPeriodConfig{{From: "23:00", To: "07:00", Rate: 0.18}}, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestTariffRateCrossesMidnight(t *testing.T) {
+	tr := nightTariff(t, time.UTC)
+	for _, tc := range []struct {
+		clock string
+		want  float64
+	}{
+		{"22:59", 0.32}, {"23:00", 0.18}, {"00:00", 0.18}, {"06:59", 0.18}, {"07:00", 0.32}, {"12:00", 0.32},
+	} {
+		at, _ := time.Parse("15:04", tc.clock)
+		if got := tr.rateAt(at); got != tc.want {
+			t.Errorf("rate at %s: expected %v, got %v", tc.clock, tc.want, got)
+		}
+	}
+}
+
+func TestTariffCostSplitsAtBoundaries(t *testing.T) {
+	tr := nightTariff(t, time.UTC)
+	from := time.Date(2024, 2, 2, 22, 0, 0, 0, time.UTC)
+
+	// 1 kW from 22:00 to 08:00: 1 h at 0.32, 8 h at 0.18 and 1 h at 0.32.
+	got := tr.cost(from, from.Add(10*time.Hour), 1000, 1000)
+	if want := 2*0.32 + 8*0.18; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("expected cost %v, got %v", want, got)
+	}
+
+	// Power rising linearly from 0 to 2 kW over 22:30-23:30 draws 0.25 kWh
+	// before 23:00 and 0.75 kWh after.
+	got = tr.cost(from.Add(30*time.Minute), from.Add(90*time.Minute), 0, 2000)
+	if want := 0.25*0.32 + 0.75*0.18; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("expected linear cost %v, got %v", want, got)
+	}
+}
+
+func TestTariffFollowsDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newTariff(0.30, []tariffPeriodConfig{{From: "01:00", To: "04:00", Rate: 0.10}}, berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// On 2024-03-31 clocks jump from 02:00 to 03:00, so the cheap period
+	// lasts two hours; on 2024-10-27 they fall back and it lasts four.
+	for _, tc := range []struct {
+		day        int
+		month      time.Month
+		cheapHours float64
+	}{
+		{31, time.March, 2}, {27, time.October, 4},
+	} {
+		from := time.Date(2024, tc.month, tc.day, 0, 0, 0, 0, berlin)
+		to := time.Date(2024, tc.month, tc.day, 6, 0, 0, 0, berlin)
+		hours := to.Sub(from).Hours()
+		got := tr.cost(from, to, 1000, 1000)
+		if want := tc.cheapHours*0.10 + (hours-tc.cheapHours)*0.30; math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s: expected cost %v, got %v", from.Format(time.DateOnly), want, got)
+		}
+	}
+}
+
+func TestNewTariffRejectsInvalidSchedules(t *testing.T) {
+	if tr, err := newTariff(0, nil, time.UTC); tr != nil || err != nil {
+		t.Fatalf("expected no tariff without a rate, got %+v (%v)", tr, err)
+	}
+	for _, tc := range []struct {
+		base     float64
+		schedule []tariffPeriodConfig
+		want     string
+	}{
+		{-1, nil, "must not be negative"},
+		{0, []tariffPeriodConfig{{From: "7:00", To: "08:00"}}, "want HH:MM"},
+		{0, []tariffPeriodConfig{{From: "23:00", To: "24:30"}}, "want HH:MM"},
+		{0, []tariffPeriodConfig{{From: "07:00", To: "07:00"}}, "must differ"},
+		{0, []tariffPeriodConfig{{From: "07:00", To: "08:00", Rate: -0.1}}, "rate must not be negative"},
+	} {
+		if _, err := newTariff(tc.base, tc.schedule, time.UTC); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: expected error containing %q, got %v", tc.schedule, tc.want, err)
+		}
+	}
+}
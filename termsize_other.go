@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// terminalColumns returns zero: the terminal's width is not detected on
+// this platform, so $COLUMNS or --width is used instead.
+func terminalColumns(*os.File) int {
+	return 0
+}
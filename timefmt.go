@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The --time-format values besides Go layouts.
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatUnix    = "unix"
+	timeFormatUnixMs  = "unixms"
+)
+
+// timeFormat renders the timestamps of output records in loc, when set,
+// and as layout: a Go time layout, or timeFormatUnix or timeFormatUnixMs
+// for seconds or milliseconds since the epoch. The zero timeFormat renders
+// each timestamp as RFC 3339 in its own zone.
+type timeFormat struct {
+	loc    *time.Location
+	layout string
+}
+
+// newTimeFormat returns the timeFormat of --timezone and --time-format.
+func newTimeFormat(loc *time.Location, layout string) (timeFormat, error) {
+	switch strings.ToLower(layout) {
+	case "", timeFormatRFC3339:
+		layout = ""
+	case timeFormatUnix, timeFormatUnixMs:
+		layout = strings.ToLower(layout)
+	default:
+		// A layout without a single time element renders every time
+		// the same.
+		if t := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC); t.Format(layout) == layout {
+			return timeFormat{}, fmt.Errorf("invalid --time-format %q: want rfc3339, unix, unixms or a Go layout such as \"2006-01-02 15:04:05\"", layout)
+		}
+	}
+	return timeFormat{loc: loc, layout: layout}, nil
+}
+
+// set reports whether --timezone or --time-format is in effect.
+func (f timeFormat) set() bool {
+	return f.loc != nil || f.layout != ""
+}
+
+// in returns t in the zone of f.
+func (f timeFormat) in(t time.Time) time.Time {
+	if f.loc == nil {
+		return t
+	}
+	return t.In(f.loc)
+}
+
+// format renders t as text.
+func (f timeFormat) format(t time.Time) string {
+	t = f.in(t)
+	switch f.layout {
+	case "":
+		return t.Format(time.RFC3339)
+	case timeFormatUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case timeFormatUnixMs:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.Format(f.layout)
+}
+
+// value renders t as a JSON value: a number for the epoch formats, a
+// time.Time, encoded with full precision, for RFC 3339, and a string for
+// layouts. A zero t renders as nil, for omitempty.
+func (f timeFormat) value(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	t = f.in(t)
+	switch f.layout {
+	case "":
+		return t
+	case timeFormatUnix:
+		return t.Unix()
+	case timeFormatUnixMs:
+		return t.UnixMilli()
+	}
+	return t.Format(f.layout)
+}
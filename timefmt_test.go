@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/testsupport"
+	"powerusagecollection/pkg/collector"
+)
+
+func loadZone(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	return loc
+}
+
+func TestTimeFormat(t *testing.T) {
+	now := testsupport.NewFakeClock(time.Date(2024, 7, 1, 12, 30, 5, 250e6, time.UTC)).Now()
+	london, tokyo := loadZone(t, "Europe/London"), loadZone(t, "Asia/Tokyo")
+	for _, tc := range []struct {
+		loc    *time.Location
+		layout string
+		want   string
+	}{
+		{nil, "", "2024-07-01T12:30:05Z"},
+		{london, "rfc3339", "2024-07-01T13:30:05+01:00"},
+		{tokyo, "RFC3339", "2024-07-01T21:30:05+09:00"},
+		{london, "2006-01-02 15:04:05", "2024-07-01 13:30:05"},
+		{tokyo, "2006-01-02 15:04:05", "2024-07-01 21:30:05"},
+		{london, "unix", "1719837005"},
+		{tokyo, "unixms", "1719837005250"},
+	} {
+		f, err := newTimeFormat(tc.loc, tc.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.format(now); got != tc.want {
+			t.Fatalf("expected %q with %v and %q, got %q", tc.want, tc.loc, tc.layout, got)
+		}
+	}
+
+	if _, err := newTimeFormat(nil, "yesterday"); err == nil || !strings.Contains(err.Error(), "invalid --time-format") {
+		t.Fatalf("expected a layout without time elements rejected, got %v", err)
+	}
+	if v := (timeFormat{layout: timeFormatUnix}).value(time.Time{}); v != nil {
+		t.Fatalf("expected a zero time left out, got %v", v)
+	}
+}
+
+func TestOutputRendersTimesInZone(t *testing.T) {
+	now := testsupport.NewFakeClock(time.Date(2024, 1, 15, 23, 0, 0, 0, time.UTC)).Now()
+	r := collector.Reading{
+		Device: collector.Device{Instance: "Plug"},
+		Power:  &collector.PowerInfo{CurrentWatts: 10, Timestamp: now.Add(-time.Second)},
+		Time:   now,
+	}
+	for _, tc := range []struct {
+		zone, layout        string
+		csv, text           string
+		jsonStamp, sumStamp any
+	}{
+		{"Europe/London", "2006-01-02 15:04:05", "2024-01-15 23:00:00,Plug", "2024-01-15 23:00:00 Plug:", "2024-01-15 22:59:59", "2024-01-15 23:00:00"},
+		{"Asia/Tokyo", "2006-01-02 15:04:05", "2024-01-16 08:00:00,Plug", "2024-01-16 08:00:00 Plug:", "2024-01-16 07:59:59", "2024-01-16 08:00:00"},
+		{"Asia/Tokyo", "unixms", "1705359600000,Plug", "1705359600000 Plug:", float64(1705359599000), float64(1705359600000)},
+	} {
+		f, err := newTimeFormat(loadZone(t, tc.zone), tc.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		render := func(format string) string {
+			var buf bytes.Buffer
+			out := newOutput(&buf, format)
+			out.times = f
+			writeReading(out, r, nil, nil, nil)
+			return buf.String()
+		}
+		if csv := render(formatCSV); !strings.Contains(csv, "\n"+tc.csv+",") {
+			t.Fatalf("expected %q in CSV, got %q", tc.csv, csv)
+		}
+		if text := render(formatText); !strings.HasPrefix(text, tc.text) {
+			t.Fatalf("expected text to start with %q, got %q", tc.text, text)
+		}
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(render(formatJSON)), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec["timestamp"] != tc.jsonStamp || rec["currentWatts"] != float64(10) {
+			t.Fatalf("expected the device timestamp %v, got %v", tc.jsonStamp, rec)
+		}
+
+		var buf bytes.Buffer
+		out := newOutput(&buf, formatJSON)
+		out.times = f
+		writeSummary(out, summary{Type: "summary", Time: now})
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec["timestamp"] != tc.sumStamp {
+			t.Fatalf("expected the summary stamped %v, got %v", tc.sumStamp, rec["timestamp"])
+		}
+	}
+}
+
+func TestRunRejectsUnknownTimezone(t *testing.T) {
+	opts := defaultOptions()
+	opts.timezone = "Mars/Olympus_Mons"
+	err := run(context.Background(), opts, io.Discard, io.Discard)
+	if exitCode(err) != exitSetup || !strings.Contains(err.Error(), "--timezone") {
+		t.Fatalf("expected a setup error, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// builtinVendors is the table of Matter vendor IDs shipped with the
+// collector.
+//
+//go:embed vendors.csv
+var builtinVendors string
+
+// vendorDB names Matter vendor IDs, as advertised in the VP TXT key. A nil
+// vendorDB knows no names.
+type vendorDB map[int]string
+
+// loadVendorDB returns the built-in vendor table, with the entries of the
+// CSV file at path, when set, added over it.
+func loadVendorDB(path string) (vendorDB, error) {
+	db := make(vendorDB)
+	if err := db.read(strings.NewReader(builtinVendors), "built-in vendor table"); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return db, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("vendor database: %w", err)
+	}
+	defer f.Close()
+	if err := db.read(f, path); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// read adds the id,name rows of r, named source in errors. Lines starting
+// with # and a header row are skipped; IDs may be decimal or hex, as in
+// the VP key.
+func (db vendorDB) read(r io.Reader, source string) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("vendor database %s: %w", source, err)
+		}
+		if strings.EqualFold(row[0], "id") {
+			continue
+		}
+		id, err := collector.ParseMatterID(row[0])
+		if err != nil || id == 0 {
+			line, _ := cr.FieldPos(0)
+			return fmt.Errorf("vendor database %s:%d: invalid vendor ID %q", source, line, row[0])
+		}
+		name := strings.TrimSpace(row[1])
+		if name == "" {
+			line, _ := cr.FieldPos(1)
+			return fmt.Errorf("vendor database %s:%d: empty name for vendor %s", source, line, row[0])
+		}
+		db[id] = name
+	}
+}
+
+// name returns the name of vendor id, or an empty string when unknown.
+func (db vendorDB) name(id int) string {
+	return db[id]
+}
+
+// named sets the vendor names of devices, which did not come through
+// discovery, such as those from the cache.
+func (db vendorDB) named(devices []collector.Device) []collector.Device {
+	for i := range devices {
+		if id := devices[i].Meta.VendorID; id != 0 {
+			devices[i].Meta.VendorName = db.name(id)
+		}
+	}
+	return devices
+}
+
+// vendorText describes a device's vendor: its name, or its ID in hex when
+// unknown, or an empty string when it advertised none.
+func vendorText(meta collector.DeviceMeta) string {
+	switch {
+	case meta.VendorName != "":
+		return meta.VendorName
+	case meta.VendorID != 0:
+		return fmt.Sprintf("0x%04X", meta.VendorID)
+	}
+	return ""
+}
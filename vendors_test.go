@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+func TestLoadVendorDB(t *testing.T) {
+	db, err := loadVendorDB("")
+	if err != nil {
+		t.Fatalf("expected the built-in table to load, got %v", err)
+	}
+	if db.name(4874) != "Eve Systems" || db.name(0x1234) != "" {
+		t.Fatalf("unexpected built-in names %q, %q", db.name(4874), db.name(0x1234))
+	}
+
+	path := writeFile(t, "vendors.csv", "# local additions\nid,name\n4874,Eve\n0x1234, Acme Plugs\n")
+	if db, err = loadVendorDB(path); err != nil {
+		t.Fatalf("expected the override file to load, got %v", err)
+	}
+	if db.name(4874) != "Eve" || db.name(0x1234) != "Acme Plugs" || db.name(0x6006) != "Google" {
+		t.Fatalf("expected the file added over the built-in table, got %v", db)
+	}
+
+	for content, want := range map[string]string{
+		"0x1234\n":        "wrong number of fields",
+		"plug,Acme\n":     `:1: invalid vendor ID "plug"`,
+		"id,name\n42,\n":  ":2: empty name for vendor 42",
+		"0x10000,Acme\n":  "invalid vendor ID",
+		"0,Unspecified\n": "invalid vendor ID",
+	} {
+		_, err := loadVendorDB(writeFile(t, "bad.csv", content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%q: expected an error containing %q, got %v", content, want, err)
+		}
+	}
+}
+
+func TestVendorNamesInOutput(t *testing.T) {
+	db, err := loadVendorDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eve := collector.NewDevice(&collector.ServiceEntry{Instance: "Plug", HostName: "plug.local.", Text: []string{"VP=4874+77"}})
+	unknown := collector.NewDevice(&collector.ServiceEntry{Instance: "Other", HostName: "other.local.", Text: []string{"VP=0x1234"}})
+	eve = db.named([]collector.Device{eve})[0]
+
+	output := handleEntryOutput(eve, options{listOnly: true})
+	if !strings.Contains(output, "Vendor: Eve Systems (0x130A)  Product: 0x004D") {
+		t.Fatalf("expected the vendor named in the list, got %q", output)
+	}
+	output = handleEntryOutput(db.named([]collector.Device{unknown})[0], options{listOnly: true})
+	if !strings.Contains(output, "Vendor: 0x1234  Product: 0x0000") {
+		t.Fatalf("expected an unknown vendor shown by ID, got %q", output)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(handleEntryOutput(eve, options{listOnly: true, format: formatJSON})), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["vendor"] != "Eve Systems" || decoded["vendorId"] != 4874.0 {
+		t.Fatalf("expected the vendor named in the JSON, got %v", decoded)
+	}
+
+	e := newExporter()
+	e.record(collector.Reading{Device: eve, Power: &collector.PowerInfo{CurrentWatts: 5}, Time: time.Now()})
+	if body := scrape(t, e); !strings.Contains(body, `power_device_info{device="Plug",host="plug.local",firmware="",vendor="Eve Systems"} 1`) {
+		t.Fatalf("expected the vendor as a metric label, got %s", body)
+	}
+}
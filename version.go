@@ -0,0 +1,76 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// The build's version, commit and date, set when linking with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Those left unset are taken from the build information Go embeds.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// buildInfo identifies the running build, for --version, the startup log,
+// GET /version and the power_collector_build_info metric.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"goVersion"`
+}
+
+// currentBuild returns the running build's information.
+var currentBuild = sync.OnceValue(func() buildInfo {
+	bi, _ := debug.ReadBuildInfo()
+	return newBuildInfo(version, commit, buildDate, bi)
+})
+
+// newBuildInfo fills in what the link-time values leave unset from bi,
+// which may be nil: the module version, and the VCS revision and commit
+// time. A revision with uncommitted changes is marked dirty.
+func newBuildInfo(version, commit, date string, bi *debug.BuildInfo) buildInfo {
+	b := buildInfo{Version: version, Commit: commit, Date: date}
+	if bi != nil {
+		b.GoVersion = bi.GoVersion
+		if b.Version == "" && bi.Main.Version != "(devel)" {
+			b.Version = bi.Main.Version
+		}
+		settings := make(map[string]string)
+		for _, s := range bi.Settings {
+			settings[s.Key] = s.Value
+		}
+		if b.Commit == "" && settings["vcs.revision"] != "" {
+			b.Commit = settings["vcs.revision"]
+			if len(b.Commit) > 12 {
+				b.Commit = b.Commit[:12]
+			}
+			if settings["vcs.modified"] == "true" {
+				b.Commit += "-dirty"
+			}
+		}
+		if b.Date == "" {
+			b.Date = settings["vcs.time"]
+		}
+	}
+	b.Version = cmp.Or(b.Version, "dev")
+	b.Commit = cmp.Or(b.Commit, "unknown")
+	b.Date = cmp.Or(b.Date, "unknown")
+	return b
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("powerusagecollection %s (commit %s, built %s, %s)", b.Version, b.Commit, b.Date, b.GoVersion)
+}
+
+// userAgent is the User-Agent header of device requests.
+func (b buildInfo) userAgent() string {
+	return "powerusagecollection/" + b.Version
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestNewBuildInfo(t *testing.T) {
+	bi := &debug.BuildInfo{
+		GoVersion: "go1.24.1",
+		Main:      debug.Module{Version: "(devel)"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "f6fa8ab9c9a5c4066f686abb8565f9ecd53758a7"},
+			{Key: "vcs.time", Value: "2026-10-15T08:25:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	for _, c := range []struct {
+		name                  string
+		version, commit, date string
+		bi                    *debug.BuildInfo
+		want                  buildInfo
+	}{
+		{"no build info", "", "", "", nil, buildInfo{Version: "dev", Commit: "unknown", Date: "unknown"}},
+		{"vcs settings", "", "", "", bi, buildInfo{Version: "dev", Commit: "f6fa8ab9c9a5-dirty", Date: "2026-10-15T08:25:00Z", GoVersion: "go1.24.1"}},
+		{"module version", "", "", "", &debug.BuildInfo{Main: debug.Module{Version: "v1.3.0"}}, buildInfo{Version: "v1.3.0", Commit: "unknown", Date: "unknown"}},
+		{"ldflags", "1.4.0", "abc1234", "2026-10-01T00:00:00Z", bi, buildInfo{Version: "1.4.0", Commit: "abc1234", Date: "2026-10-01T00:00:00Z", GoVersion: "go1.24.1"}},
+	} {
+		if got := newBuildInfo(c.version, c.commit, c.date, c.bi); got != c.want {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.want, got)
+		}
+	}
+
+	b := buildInfo{Version: "1.4.0", Commit: "abc1234", Date: "2026-10-01T00:00:00Z", GoVersion: "go1.24.1"}
+	if got, want := b.String(), "powerusagecollection 1.4.0 (commit abc1234, built 2026-10-01T00:00:00Z, go1.24.1)"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if got := b.userAgent(); got != "powerusagecollection/1.4.0" {
+		t.Fatalf("unexpected User-Agent %q", got)
+	}
+}
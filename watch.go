@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"powerusagecollection/pkg/collector"
+)
+
+// Orders accepted by --sort.
+const (
+	sortWatts = "watts"
+	sortName  = "name"
+	sortHost  = "host"
+)
+
+var watchSorts = []string{sortName, sortWatts, sortHost}
+
+// defaultWatchInterval is the refresh interval of --watch when no
+// --interval is given.
+const defaultWatchInterval = 5 * time.Second
+
+// trendThreshold is the change in watts below which a device is shown as
+// steady.
+const trendThreshold = 0.5
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// watchTable keeps the latest reading of every device and draws them as a
+// table. On a terminal each draw replaces the previous one; otherwise the
+// tables are simply written one after another.
+type watchTable struct {
+	w       io.Writer
+	sortBy  string
+	tty     bool
+	palette palette
+
+	mu   sync.Mutex
+	rows map[string]*watchRow
+}
+
+type watchRow struct {
+	device collector.Device
+	// watts and voltage are from the last successful reading, updated at
+	// time updated; previous is the reading before it.
+	watts    float64
+	previous float64
+	voltage  float64
+	latency  time.Duration
+	readings int
+	updated  time.Time
+	// failing is set while the latest query failed.
+	failing bool
+	// state is the device's availability, when polled.
+	state collector.Availability
+}
+
+func newWatchTable(w io.Writer, sortBy string, pal palette) *watchTable {
+	return &watchTable{w: w, sortBy: sortBy, tty: isTerminal(w), palette: pal, rows: make(map[string]*watchRow)}
+}
+
+// isTerminal reports whether w is a character device such as a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// record updates the device's row with a reading.
+func (t *watchTable) record(r collector.Reading) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := r.Device.Key()
+	row := t.rows[key]
+	if row == nil {
+		row = &watchRow{}
+		t.rows[key] = row
+	}
+	row.device = r.Device
+	row.state = r.State
+	row.failing = r.Err != nil || r.Power == nil
+	if row.failing {
+		return
+	}
+	row.previous = row.watts
+	row.watts = r.Power.CurrentWatts
+	row.voltage = r.Power.Voltage
+	row.latency = r.Power.Latency
+	row.readings++
+	row.updated = r.Time
+}
+
+// draw writes the table as of now.
+func (t *watchTable) draw(now time.Time) {
+	t.mu.Lock()
+	rows := make([]watchRow, 0, len(t.rows))
+	for _, row := range t.rows {
+		rows = append(rows, *row)
+	}
+	t.mu.Unlock()
+
+	var buf bytes.Buffer
+	if t.tty {
+		buf.WriteString(clearScreen)
+	}
+	renderWatch(&buf, rows, t.sortBy, now, t.palette)
+	if !t.tty {
+		buf.WriteByte('\n')
+	}
+	t.w.Write(buf.Bytes())
+}
+
+// renderWatch writes the header line and the table of rows, with high
+// readings and failures colored and offline devices dimmed by pal.
+func renderWatch(w io.Writer, rows []watchRow, sortBy string, now time.Time, pal palette) {
+	sortWatchRows(rows, sortBy)
+
+	var total float64
+	for _, row := range rows {
+		if row.readings > 0 && !row.failing {
+			total += row.watts
+		}
+	}
+	fmt.Fprintf(w, "%s  %d devices  %.2f W total\n\n", now.Format("2006-01-02 15:04:05"), len(rows), total)
+
+	table := make([][]cell, 0, len(rows))
+	for _, row := range rows {
+		watts, voltage, latency, age := cell{text: "-"}, "-", "-", cell{text: "never"}
+		if row.readings > 0 {
+			watts = cell{strconv.FormatFloat(row.watts, 'f', 2, 64), pal.wattsColor(row.watts)}
+			age.text = now.Sub(row.updated).Round(time.Second).String() + " ago"
+		}
+		if row.voltage != 0 {
+			voltage = strconv.FormatFloat(row.voltage, 'f', 1, 64)
+		}
+		if row.latency > 0 {
+			latency = strconv.FormatFloat(latencyMs(row.latency), 'f', 0, 64) + " ms"
+		}
+		if row.failing {
+			age = cell{age.text + " (failing)", ansiRed}
+		}
+		firmware, firmwareColor := pal.firmware(row.device.Firmware)
+		cells := []cell{
+			{text: deviceLabel(row.device.Instance, row.device.Channel)},
+			{text: orDash(row.device.Address)},
+			watts,
+			{text: voltage},
+			{text: latency},
+			{orDash(firmware), firmwareColor},
+			age,
+			{text: orDash(string(row.state))},
+			{text: row.trend()},
+		}
+		if row.state == collector.Offline {
+			for i := range cells {
+				cells[i].color = ansiDim
+			}
+		}
+		table = append(table, cells)
+	}
+	pal.writeTable(w, []string{"DEVICE", "ADDRESS", "WATTS", "VOLTAGE", "LATENCY", "FIRMWARE", "UPDATED", "STATE", "TREND"}, table)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// trend is an arrow comparing the last reading with the one before.
+func (r watchRow) trend() string {
+	switch {
+	case r.readings < 2:
+		return ""
+	case r.watts-r.previous > trendThreshold:
+		return "↑"
+	case r.previous-r.watts > trendThreshold:
+		return "↓"
+	}
+	return "→"
+}
+
+// sortWatchRows orders rows by sortBy, breaking ties by name. Devices
+// without a reading come last when sorting by power.
+func sortWatchRows(rows []watchRow, sortBy string) {
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch sortBy {
+		case sortWatts:
+			if (a.readings > 0) != (b.readings > 0) {
+				return a.readings > 0
+			}
+			if a.watts != b.watts {
+				return a.watts > b.watts
+			}
+		case sortHost:
+			if a.device.HostName != b.device.HostName {
+				return a.device.HostName < b.device.HostName
+			}
+		}
+		if a.device.Instance != b.device.Instance {
+			return a.device.Instance < b.device.Instance
+		}
+		return a.device.HostName < b.device.HostName
+	})
+}
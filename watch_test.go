@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+func watchReading(instance, host string, watts float64, at time.Time) collector.Reading {
+	return collector.Reading{
+		Device: collector.Device{Instance: instance, HostName: host, Address: "192.0.2.1", Firmware: "1.2"},
+		Power:  &collector.PowerInfo{CurrentWatts: watts, Voltage: 230, Latency: 42 * time.Millisecond},
+		Time:   at,
+		State:  collector.Online,
+	}
+}
+
+func TestWatchTableRendersSortedRows(t *testing.T) {
+	start := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	table := newWatchTable(io.Discard, sortWatts, palette{})
+	table.record(watchReading("Kettle", "b.local", 2000, start))
+	table.record(watchReading("A very long lamp name", "c.local", 10, start))
+	table.record(watchReading("A very long lamp name", "c.local", 12, start.Add(5*time.Second)))
+	table.record(watchReading("Fridge", "a.local", 150, start))
+	table.record(watchReading("Fridge", "a.local", 90, start.Add(5*time.Second)))
+	table.record(collector.Reading{Device: collector.Device{Instance: "Plug", HostName: "d.local"}, Err: errors.New("timeout"), Time: start, State: collector.Degraded})
+
+	rows := make([]watchRow, 0, len(table.rows))
+	for _, row := range table.rows {
+		rows = append(rows, *row)
+	}
+	var buf bytes.Buffer
+	renderWatch(&buf, rows, sortWatts, start.Add(10*time.Second), palette{})
+
+	want := "2024-02-02 15:04:15  4 devices  2102.00 W total\n" +
+		"\n" +
+		"DEVICE                 ADDRESS    WATTS    VOLTAGE  LATENCY  FIRMWARE  UPDATED          STATE     TREND\n" +
+		"Kettle                 192.0.2.1  2000.00  230.0    42 ms    1.2       10s ago          online    \n" +
+		"Fridge                 192.0.2.1  90.00    230.0    42 ms    1.2       5s ago           online    ↓\n" +
+		"A very long lamp name  192.0.2.1  12.00    230.0    42 ms    1.2       5s ago           online    ↑\n" +
+		"Plug                   -          -        -        -        -         never (failing)  degraded  \n"
+	if buf.String() != want {
+		t.Fatalf("unexpected table:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestSortWatchRows(t *testing.T) {
+	rows := []watchRow{
+		{device: collector.Device{Instance: "b", HostName: "z.local"}, watts: 5, readings: 1},
+		{device: collector.Device{Instance: "c", HostName: "x.local"}},
+		{device: collector.Device{Instance: "a", HostName: "y.local"}, watts: 5, readings: 1},
+	}
+	for sortBy, want := range map[string]string{sortWatts: "abc", sortName: "abc", sortHost: "cab"} {
+		sortWatchRows(rows, sortBy)
+		var got string
+		for _, row := range rows {
+			got += row.device.Instance
+		}
+		if got != want {
+			t.Errorf("sort by %s: got %s, want %s", sortBy, got, want)
+		}
+	}
+}
+
+func TestWatchRowTrend(t *testing.T) {
+	for _, c := range []struct {
+		row  watchRow
+		want string
+	}{
+		{watchRow{watts: 10, readings: 1}, ""},
+		{watchRow{watts: 10, previous: 5, readings: 2}, "↑"},
+		{watchRow{watts: 5, previous: 10, readings: 2}, "↓"},
+		{watchRow{watts: 10.2, previous: 10, readings: 2}, "→"},
+	} {
+		if got := c.row.trend(); got != c.want {
+			t.Errorf("trend of %+v = %q, want %q", c.row, got, c.want)
+		}
+	}
+}
+
+func TestWatchTableClearsOnlyTerminals(t *testing.T) {
+	var buf bytes.Buffer
+	table := newWatchTable(&buf, sortName, palette{})
+	if table.tty {
+		t.Fatal("expected a buffer not to be treated as a terminal")
+	}
+	table.record(watchReading("Lamp", "lamp.local", 5, time.Now()))
+	table.draw(time.Now())
+	table.draw(time.Now())
+	if strings.Contains(buf.String(), clearScreen) || strings.Count(buf.String(), "DEVICE") != 2 {
+		t.Fatalf("expected two plain tables, got %q", buf.String())
+	}
+
+	buf.Reset()
+	table.tty = true
+	table.draw(time.Now())
+	if !strings.HasPrefix(buf.String(), clearScreen) {
+		t.Fatalf("expected the terminal to be cleared, got %q", buf.String())
+	}
+}
+
+func TestRunWatchDrawsTable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":7}`)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	opts := statusOptions(addr.Port)
+	opts.watch = true
+	opts.interval = 20 * time.Millisecond
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	var stdout bytes.Buffer
+	if err := run(ctx, opts, &stdout, io.Discard); err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "DEVICE") || !strings.Contains(out, "7.00") {
+		t.Fatalf("expected the watch table, got %q", out)
+	}
+	if strings.Contains(out, `"instance"`) {
+		t.Fatalf("expected JSON records to be left off stdout, got %q", out)
+	}
+}
+
+func TestRunWatchRejectsBadSort(t *testing.T) {
+	opts := defaultOptions()
+	opts.watch = true
+	opts.sortBy = "power"
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err == nil || !strings.Contains(err.Error(), `invalid sort "power"`) {
+		t.Fatalf("expected a sort error, got %v", err)
+	}
+}
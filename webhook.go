@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookAttempts is how many times a batch is posted before it is
+	// dropped.
+	webhookAttempts = 3
+	// webhookGzipThreshold is the body size above which batches are sent
+	// gzip-compressed.
+	webhookGzipThreshold = 1024
+	// webhookErrorBody bounds how much of a rejected batch's response is
+	// logged.
+	webhookErrorBody = 256
+)
+
+// headerFlag is a repeatable flag.Value collecting "Name: value" HTTP
+// headers.
+type headerFlag []string
+
+func (h *headerFlag) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlag) Set(s string) error {
+	name, _, ok := strings.Cut(s, ":")
+	if !ok || strings.TrimSpace(name) == "" || strings.ContainsAny(strings.TrimSpace(name), " \t") {
+		return fmt.Errorf("invalid header %q: want \"Name: value\"", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// header returns the collected headers.
+func (h headerFlag) header() http.Header {
+	header := make(http.Header, len(h))
+	for _, s := range h {
+		name, value, _ := strings.Cut(s, ":")
+		header.Add(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(value))
+	}
+	return header
+}
+
+// webhookBatch is the document posted after every run or poll cycle, and
+// with Events instead of readings for each device event.
+type webhookBatch struct {
+	Time     time.Time      `json:"timestamp"`
+	Readings []deviceResult `json:"readings"`
+	Events   []deviceEvent  `json:"events,omitempty"`
+}
+
+// webhookSink posts each cycle's readings as one JSON batch.
+type webhookSink struct {
+	url     string
+	header  http.Header
+	client  *http.Client
+	backoff time.Duration
+}
+
+// newWebhookSink returns a sink posting to rawURL with the extra headers.
+func newWebhookSink(rawURL string, headers headerFlag) (*webhookSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q", rawURL)
+	}
+	return &webhookSink{
+		url:     u.String(),
+		header:  headers.header(),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+	}, nil
+}
+
+// webhookStatusError reports a non-2xx response.
+type webhookStatusError struct {
+	status string
+	code   int
+	body   string
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.status, e.body)
+}
+
+// Write posts results as one batch taken now.
+func (w *webhookSink) Write(ctx context.Context, results []deviceResult) error {
+	return w.send(ctx, time.Now(), results)
+}
+
+// writeAt posts results as one batch taken at, for a replayed batch.
+func (w *webhookSink) writeAt(ctx context.Context, at time.Time, results []deviceResult) error {
+	return w.send(ctx, at, results)
+}
+
+// event posts ev as a batch of its own.
+func (w *webhookSink) event(ctx context.Context, ev deviceEvent) error {
+	return w.deliver(ctx, webhookBatch{Time: ev.Time, Readings: []deviceResult{}, Events: []deviceEvent{ev}})
+}
+
+// Flush does nothing; every batch is posted as it is written.
+func (w *webhookSink) Flush(context.Context) error {
+	return nil
+}
+
+// Close does nothing; every request is made and closed by send.
+func (w *webhookSink) Close() error {
+	return nil
+}
+
+// send posts results as one batch taken at.
+func (w *webhookSink) send(ctx context.Context, at time.Time, results []deviceResult) error {
+	if results == nil {
+		results = []deviceResult{}
+	}
+	return w.deliver(ctx, webhookBatch{Time: at, Readings: results})
+}
+
+// deliver posts b, retrying connection errors, timeouts and 5xx responses
+// with exponential backoff. A 4xx response is not retried.
+func (w *webhookSink) deliver(ctx context.Context, b webhookBatch) error {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	gzipped := len(body) > webhookGzipThreshold
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body, gzipped)
+		if err == nil {
+			return nil
+		}
+		var se *webhookStatusError
+		if errors.As(err, &se) && se.code < 500 {
+			return err
+		}
+		if attempt == webhookAttempts || ctx.Err() != nil {
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhookSink) post(ctx context.Context, body []byte, gzipped bool) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range w.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, webhookErrorBody))
+		return &webhookStatusError{status: resp.Status, code: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"powerusagecollection/internal/zeroconf"
+	"powerusagecollection/pkg/collector"
+)
+
+// batchReceiver decodes the batches posted to it, failing the first
+// failures posts with status.
+type batchReceiver struct {
+	mu       sync.Mutex
+	posts    int
+	failures int
+	status   int
+	batches  []webhookBatch
+	headers  []http.Header
+}
+
+func (b *batchReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.posts++
+	if b.failures > 0 {
+		b.failures--
+		http.Error(w, strings.Repeat("x", 1000), b.status)
+		return
+	}
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	var batch webhookBatch
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.batches = append(b.batches, batch)
+	b.headers = append(b.headers, r.Header.Clone())
+}
+
+func TestHeaderFlag(t *testing.T) {
+	var h headerFlag
+	for _, s := range []string{"Authorization: Bearer xyz", "x-api-key:abc"} {
+		if err := h.Set(s); err != nil {
+			t.Fatalf("expected %q to be accepted, got %v", s, err)
+		}
+	}
+	header := h.header()
+	if header.Get("Authorization") != "Bearer xyz" || header.Get("X-Api-Key") != "abc" {
+		t.Fatalf("unexpected headers %v", header)
+	}
+	for _, s := range []string{"Authorization", ": value", "Bad Name: value"} {
+		if err := h.Set(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestWebhookRetriesServerErrorsAndGzipsLargeBatches(t *testing.T) {
+	receiver := &batchReceiver{failures: 1, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	w, err := newWebhookSink(server.URL, headerFlag{"Authorization: Bearer xyz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff = time.Millisecond
+
+	var results []deviceResult
+	for i := range 20 {
+		results = append(results, deviceResult{Instance: fmt.Sprintf("Device %d", i), PowerInfo: &collector.PowerInfo{CurrentWatts: float64(i)}})
+	}
+	results = append(results, deviceResult{Instance: "Broken", Error: "timeout"})
+	at := time.Date(2024, 2, 2, 15, 4, 5, 0, time.UTC)
+	if err := w.send(context.Background(), at, results); err != nil {
+		t.Fatalf("expected the batch to be delivered on retry, got %v", err)
+	}
+
+	if receiver.posts != 2 || len(receiver.batches) != 1 {
+		t.Fatalf("expected delivery on the second attempt, got %d posts", receiver.posts)
+	}
+	batch := receiver.batches[0]
+	if !batch.Time.Equal(at) || len(batch.Readings) != 21 || batch.Readings[20].Error != "timeout" {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+	if h := receiver.headers[0]; h.Get("Content-Encoding") != "gzip" || h.Get("Authorization") != "Bearer xyz" {
+		t.Fatalf("expected a gzipped, authorized post, got %v", h)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	receiver := &batchReceiver{failures: 10, status: http.StatusUnauthorized}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	w, err := newWebhookSink(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backoff = time.Millisecond
+
+	err = w.send(context.Background(), time.Now(), nil)
+	if err == nil || !strings.Contains(err.Error(), "401") || len(err.Error()) > webhookErrorBody+100 {
+		t.Fatalf("expected a truncated 401 error, got %v", err)
+	}
+	if receiver.posts != 1 {
+		t.Fatalf("expected a single attempt, got %d", receiver.posts)
+	}
+}
+
+func TestRunPostsWebhookBatch(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"currentWatts":5}`)
+	}))
+	defer device.Close()
+	addr := device.Listener.Addr().(*net.TCPAddr)
+	receiver := &batchReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	opts := statusOptions(addr.Port)
+	opts.webhookURL = server.URL
+	opts.resolver = zeroconf.NewScheduledResolver(zeroconf.ScheduledEntry{
+		Entry: &collector.ServiceEntry{Instance: "Lamp", HostName: "lamp.local.", AddrIPv4: []net.IP{addr.IP}},
+	})
+	if err := run(context.Background(), opts, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.batches) != 1 || len(receiver.batches[0].Readings) != 1 || receiver.batches[0].Readings[0].CurrentWatts != 5 {
+		t.Fatalf("expected one batch with the reading, got %+v", receiver.batches)
+	}
+	if receiver.headers[0].Get("Content-Encoding") != "" {
+		t.Fatal("expected a small batch to be sent uncompressed")
+	}
+}